@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/backup"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/urfave/cli"
+)
+
+// completionTimeout - shell shall not hang when clickhouse or remote storage doesn't respond, nothing is completed after timeout
+var completionTimeout = 3 * time.Second
+
+// tablesFlags - names of --tables flag, its value is completed by tables from clickhouse
+var tablesFlags = map[string]bool{"-t": true, "--t": true, "-table": true, "--table": true, "-tables": true, "--tables": true}
+
+// completionScripts - scripts call `clickhouse-backup <words before current> <current word> --generate-bash-completion`, current word is passed even when it's empty,
+// bash splits `--tables=value` into `--tables`, `=`, `value` words
+var completionScripts = map[string]string{
+	"bash": `_clickhouse_backup_complete() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  if [[ "$cur" == "=" ]]; then
+    cur=""
+  fi
+  local candidates
+  candidates=$("${COMP_WORDS[0]}" "${COMP_WORDS[@]:1:COMP_CWORD-1}" "$cur" --generate-bash-completion 2>/dev/null)
+  COMPREPLY=($(compgen -W "${candidates}" -- "$cur"))
+}
+complete -o default -F _clickhouse_backup_complete clickhouse-backup
+`,
+	"zsh": `#compdef clickhouse-backup
+
+_clickhouse_backup_complete() {
+  local -a candidates
+  candidates=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[1]} ${words[2,CURRENT-1]} "${words[CURRENT]}" --generate-bash-completion 2>/dev/null)}")
+  if [[ "${candidates[1]}" != "" ]]; then
+    _describe 'values' candidates
+  else
+    _files
+  fi
+}
+
+compdef _clickhouse_backup_complete clickhouse-backup
+`,
+	"fish": `function __clickhouse_backup_complete
+    set -l words (commandline -opc)
+    $words[1] $words[2..-1] (commandline -ct) --generate-bash-completion 2>/dev/null
+end
+
+complete -c clickhouse-backup -f -a '(__clickhouse_backup_complete)'
+`,
+}
+
+// printCompletionScript - `completion bash|zsh|fish` prints script which shall be sourced by shell
+func printCompletionScript(w io.Writer, shell string) error {
+	script, exists := completionScripts[shell]
+	if !exists {
+		return fmt.Errorf("'%s' shell is not supported, use one of: bash, zsh, fish", shell)
+	}
+	_, err := io.WriteString(w, script)
+	return err
+}
+
+// completionKind - what is completed by argument of command after positional arguments: `local` and `remote` backups, `location` for `local` and `remote` words, empty for nothing
+type completionKind func(positional []string) string
+
+func firstArgument(kind string) completionKind {
+	return func(positional []string) string {
+		if len(positional) == 0 {
+			return kind
+		}
+		return ""
+	}
+}
+
+// locationArgument - `delete local|remote <backup_name>`
+func locationArgument(positional []string) string {
+	switch {
+	case len(positional) == 0:
+		return "location"
+	case len(positional) == 1 && (positional[0] == "local" || positional[0] == "remote"):
+		return positional[0]
+	}
+	return ""
+}
+
+// completeBackups - BashComplete of command with backup name argument, prints only candidates to stdout, logs are discarded and errors are ignored
+func completeBackups(kind completionKind) cli.BashCompleteFunc {
+	return func(c *cli.Context) {
+		log.SetHandler(discard.New())
+		// os.Args ends with current word and --generate-bash-completion
+		words := os.Args[1 : len(os.Args)-1]
+		cur := words[len(words)-1]
+		if strings.HasPrefix(cur, "-") && !strings.Contains(cur, "=") {
+			// flags of commands include global flags, so default completion prints them twice
+			var flags bytes.Buffer
+			writer, command := c.App.Writer, c.Command
+			c.App.Writer = &flags
+			cli.DefaultCompleteWithFlags(&command)(c)
+			c.App.Writer = writer
+			printed := map[string]bool{}
+			for _, flag := range strings.Split(strings.TrimSpace(flags.String()), "\n") {
+				if flag != "" && !printed[flag] {
+					printed[flag] = true
+					_, _ = fmt.Fprintln(writer, flag)
+				}
+			}
+			return
+		}
+		positional := []string(c.Args())
+		if len(positional) > 0 && positional[len(positional)-1] == cur {
+			positional = positional[:len(positional)-1]
+		}
+		list := func(kind string) ([]string, error) {
+			cfg, err := config.LoadConfig(config.GetConfigPath(c))
+			log.SetHandler(discard.New())
+			if err != nil {
+				return nil, err
+			}
+			cfg.General.DisableProgressBar = true
+			return listCompletions(cfg, kind)
+		}
+		for _, candidate := range completionCandidates(words[:len(words)-1], cur, kind(positional), list) {
+			if os.Getenv("_CLI_ZSH_AUTOCOMPLETE_HACK") == "1" {
+				candidate = strings.ReplaceAll(candidate, ":", "\\:")
+			}
+			_, _ = fmt.Fprintln(c.App.Writer, candidate)
+		}
+	}
+}
+
+// completionCandidates - candidates for current word cur after words, value of --tables is completed by tables, positional argument by kind
+func completionCandidates(words []string, cur, kind string, list func(kind string) ([]string, error)) []string {
+	prefix := ""
+	prev := ""
+	if len(words) > 0 {
+		prev = words[len(words)-1]
+	}
+	if prev == "=" && len(words) > 1 {
+		prev = words[len(words)-2]
+	} else if i := strings.Index(cur, "="); i > 0 && tablesFlags[cur[:i]] {
+		prev, prefix = cur[:i], cur[:i+1]
+	}
+	if tablesFlags[prev] {
+		kind = "tables"
+	} else if kind == "" || strings.HasPrefix(cur, "-") {
+		return nil
+	}
+	if kind == "location" {
+		return []string{"local", "remote"}
+	}
+	names := withCompletionTimeout(func() ([]string, error) { return list(kind) })
+	candidates := make([]string, 0, len(names))
+	for _, name := range names {
+		candidates = append(candidates, prefix+name)
+	}
+	return candidates
+}
+
+// withCompletionTimeout - result of list or nothing when list fails or doesn't return during completionTimeout
+func withCompletionTimeout(list func() ([]string, error)) []string {
+	result := make(chan []string, 1)
+	go func() {
+		names, err := list()
+		if err != nil {
+			names = nil
+		}
+		result <- names
+	}()
+	select {
+	case names := <-result:
+		return names
+	case <-time.After(completionTimeout):
+		return nil
+	}
+}
+
+// listCompletions - names of local backups, remote backups without reading metadata.json or tables as `db.table`
+func listCompletions(cfg *config.Config, kind string) ([]string, error) {
+	var names []string
+	switch kind {
+	case "local":
+		backups, err := backup.GetLocalBackups(cfg)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range backups {
+			names = append(names, b.BackupName)
+		}
+	case "remote":
+		backups, err := backup.GetRemoteBackups(cfg, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range backups {
+			names = append(names, b.BackupName)
+		}
+	case "tables":
+		tables, err := backup.GetTables(cfg)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tables {
+			names = append(names, fmt.Sprintf("%s.%s", t.Database, t.Name))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompletionCandidates(t *testing.T) {
+	listed := ""
+	list := func(kind string) ([]string, error) {
+		listed = kind
+		if kind == "tables" {
+			return []string{"default.t1", "system.numbers"}, nil
+		}
+		return []string{"daily", "weekly"}, nil
+	}
+	assert.Equal(t, []string{"daily", "weekly"}, completionCandidates([]string{"restore"}, "", "local", list))
+	assert.Equal(t, "local", listed)
+	assert.Equal(t, []string{"default.t1", "system.numbers"}, completionCandidates([]string{"restore", "--tables"}, "def", "", list))
+	assert.Equal(t, []string{"default.t1", "system.numbers"}, completionCandidates([]string{"restore", "-t"}, "", "local", list))
+	assert.Equal(t, []string{"default.t1", "system.numbers"}, completionCandidates([]string{"restore", "--tables", "="}, "", "local", list))
+	assert.Equal(t, []string{"--tables=default.t1", "--tables=system.numbers"}, completionCandidates([]string{"restore"}, "--tables=", "local", list))
+	assert.Equal(t, []string{"local", "remote"}, completionCandidates([]string{"delete"}, "", "location", list))
+
+	listed = ""
+	assert.Nil(t, completionCandidates([]string{"create"}, "", "", list))
+	assert.Nil(t, completionCandidates([]string{"restore"}, "--sch", "local", list))
+	assert.Empty(t, listed, "nothing shall be listed for flags and arguments without candidates")
+}
+
+func TestWithCompletionTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { completionTimeout = timeout }(completionTimeout)
+	completionTimeout = 50 * time.Millisecond
+	assert.Equal(t, []string{"daily"}, withCompletionTimeout(func() ([]string, error) { return []string{"daily"}, nil }))
+	assert.Nil(t, withCompletionTimeout(func() ([]string, error) { return []string{"daily"}, errors.New("can't connect to clickhouse") }))
+
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	assert.Nil(t, withCompletionTimeout(func() ([]string, error) {
+		<-release
+		return []string{"daily"}, nil
+	}))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "shell shall not hang on unreachable storage")
+}
+
+func TestCompletionKind(t *testing.T) {
+	assert.Equal(t, "remote", firstArgument("remote")(nil))
+	assert.Equal(t, "", firstArgument("remote")([]string{"daily"}))
+	assert.Equal(t, "location", locationArgument(nil))
+	assert.Equal(t, "local", locationArgument([]string{"local"}))
+	assert.Equal(t, "remote", locationArgument([]string{"remote"}))
+	assert.Equal(t, "", locationArgument([]string{"elsewhere"}))
+	assert.Equal(t, "", locationArgument([]string{"remote", "daily"}))
+}
+
+func TestPrintCompletionScript(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		var script bytes.Buffer
+		assert.NoError(t, printCompletionScript(&script, shell))
+		assert.Contains(t, script.String(), "--generate-bash-completion", shell)
+	}
+	assert.EqualError(t, printCompletionScript(&bytes.Buffer{}, "tcsh"), "'tcsh' shell is not supported, use one of: bash, zsh, fish")
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/logcli"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/backup"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/server"
@@ -27,6 +32,8 @@ func main() {
 	cliapp.UsageText = "clickhouse-backup <command> [-t, --tables=<db>.<table>] <backup_name>"
 	cliapp.Description = "Run as 'root' or 'clickhouse' user"
 	cliapp.Version = version
+	cliapp.EnableBashCompletion = true
+	backup.ToolVersion = version
 
 	cliapp.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -36,6 +43,13 @@ func main() {
 			EnvVar: "CLICKHOUSE_BACKUP_CONFIG",
 		},
 	}
+	cliapp.Before = func(c *cli.Context) error {
+		// server handles signals itself
+		if c.Args().First() != "server" {
+			cancelOnSignal()
+		}
+		return nil
+	}
 	cliapp.CommandNotFound = func(c *cli.Context, command string) {
 		fmt.Printf("Error. Unknown command: '%s'\n\n", command)
 		cli.ShowAppHelpAndExit(c, 1)
@@ -63,23 +77,64 @@ func main() {
 			),
 		},
 		{
-			Name:        "create",
-			Usage:       "Create new backup",
-			UsageText:   "clickhouse-backup create [-t, --tables=<db>.<table>] [--partitions=<partition_names>] [-s, --schema] [--rbac] [--configs] <backup_name>",
-			Description: "Create new backup",
+			Name:      "check_permissions",
+			Aliases:   []string{"check-permissions"},
+			Usage:     "Check grants and filesystem access which are required by create or restore, print GRANT statements for missing ones",
+			UsageText: "clickhouse-backup check_permissions [-t, --tables=<db>.<table>] [create|restore]",
 			Action: func(c *cli.Context) error {
-				return backup.CreateBackup(config.GetConfig(c), c.Args().First(), c.String("t"), c.StringSlice("partitions"), c.Bool("s"), c.Bool("rbac"), c.Bool("configs"), version)
+				operation := c.Args().First()
+				if operation == "" {
+					operation = "create"
+				}
+				return backup.CheckPermissions(config.GetConfig(c), operation, strings.Join(c.StringSlice("t"), ","))
 			},
 			Flags: append(cliapp.Flags,
-				cli.StringFlag{
+				cli.StringSliceFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+					Usage:  "table name patterns, the first matched MergeTree table is used to check FREEZE",
+				},
+			),
+		},
+		{
+			Name:         "create",
+			Usage:        "Create new backup",
+			UsageText:    "clickhouse-backup create [-t, --tables=<db>.<table>] [--partitions=<partition_names>|<db>.<table>:<partition_names>] [-s, --schema] [--rbac] [--configs] [--dr] [--skip-configs] [--skip-rbac] [--skip-data] [--list-only] [--sequential] [--include-detached] [--changed-since=<backup_name>] [--timeout-per-table=<duration>] [--timeout=<duration>] [--backup-name-template=<template>] <backup_name>",
+			Description:  "Create new backup",
+			BashComplete: completeBackups(firstArgument("")),
+			Action: func(c *cli.Context) error {
+				if c.Bool("list-only") {
+					return backup.PrintBackupPlan(config.GetConfig(c), strings.Join(c.StringSlice("t"), ","), c.Bool("s"))
+				}
+				cfg := config.GetConfig(c)
+				if c.Bool("sequential") {
+					cfg.General.CreateConcurrency = 1
+					cfg.ClickHouse.FreezeConcurrency = 1
+				}
+				setTimeouts(cfg, c)
+				if template := c.String("backup-name-template"); template != "" {
+					cfg.General.BackupNameTemplate = template
+				}
+				options, err := backup.ParseCreateOptions(c)
+				if err != nil {
+					return err
+				}
+				schemaOnly, rbac, configs := options.Schema, options.RBAC, options.Configs
+				if c.Bool("dr") {
+					schemaOnly, rbac, configs = backup.NewDRComponents(c.Bool("skip-configs"), c.Bool("skip-rbac"), false, schemaOnly || c.Bool("skip-data")).CreateOptions()
+				}
+				return backup.CreateBackup(cfg, c.Args().First(), options.Tables, options.Partitions, schemaOnly, rbac, configs, options.IncludeDetached, options.ChangedSince, version, backup.NewOperationID())
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringSliceFlag{
 					Name:   "table, tables, t",
 					Hidden: false,
-					Usage:  "table name patterns, separated by comma, allow ? and * as wildcard",
+					Usage:  "table name patterns, separated by comma or passed multiple times, allow ? and * as wildcard, pattern with ! prefix excludes tables",
 				},
 				cli.StringSliceFlag{
 					Name:   "partitions",
 					Hidden: false,
-					Usage:  "partition names, separated by comma",
+					Usage:  "partition IDs, separated by comma, use db.table:id1,id2 to limit partitions only for matched tables",
 				},
 				cli.BoolFlag{
 					Name:   "schema, s",
@@ -96,27 +151,96 @@ func main() {
 					Hidden: false,
 					Usage:  "Backup ClickHouse server configuration files only",
 				},
+				cli.BoolFlag{
+					Name:   "dr",
+					Hidden: false,
+					Usage:  "Backup everything required for disaster recovery: schema, data, RBAC objects and configuration files",
+				},
+				cli.BoolFlag{
+					Name:   "skip-configs",
+					Hidden: false,
+					Usage:  "Skip configuration files when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-rbac",
+					Hidden: false,
+					Usage:  "Skip RBAC related objects when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-data",
+					Hidden: false,
+					Usage:  "Skip table data when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "sequential",
+					Hidden: false,
+					Usage:  "Freeze and copy tables one by one, ignore create_concurrency and freeze_concurrency",
+				},
+				cli.BoolFlag{
+					Name:   "include-detached",
+					Hidden: false,
+					Usage:  "Backup parts from 'detached' folder of each table, they are restored only by restore --include-detached",
+				},
+				cli.StringFlag{
+					Name:   "changed-since",
+					Hidden: false,
+					Usage:  "Local backup name, tables which have the same parts as in it are not frozen, their parts are linked from it and are required from it on upload",
+				},
+				cli.StringFlag{
+					Name:   "timeout-per-table",
+					Hidden: false,
+					Usage:  "Maximum time to freeze or upload one table, like 30m, overrides timeout_per_table config option",
+				},
+				cli.StringFlag{
+					Name:   "timeout",
+					Hidden: false,
+					Usage:  "Maximum time to process all tables, like 6h, overrides run_timeout config option",
+				},
+				cli.StringFlag{
+					Name:   "backup-name-template",
+					Hidden: false,
+					Usage:  "Template of backup name when <backup_name> isn't passed, like {cluster}-{shard}-{timestamp:20060102-150405}, overrides backup_name_template config option",
+				},
+				cli.BoolFlag{
+					Name:   "list-only, dry-run",
+					Hidden: false,
+					Usage:  "Print tables, estimated sizes and disks which will be backed up, without freeze and create backup",
+				},
 			),
 		},
 		{
-			Name:        "create_remote",
-			Usage:       "Create and upload",
-			UsageText:   "clickhouse-backup create_remote [-t, --tables=<db>.<table>] [--partitions=<partition_names>] [--diff-from=<local_backup_name>] [--diff-from-remote=<local_backup_name>] [--schema] [--rbac] [--configs] <backup_name>",
-			Description: "Create and upload",
+			Name:         "create_remote",
+			Usage:        "Create and upload",
+			UsageText:    "clickhouse-backup create_remote [-t, --tables=<db>.<table>] [--partitions=<partition_names>|<db>.<table>:<partition_names>] [--diff-from=<local_backup_name>] [--diff-from-remote=<local_backup_name>] [--schema] [--rbac] [--configs] [--dr] [--skip-configs] [--skip-rbac] [--skip-data] [--sequential] [--include-detached] [--delete-source] [--delete-local-after-upload] [--timeout-per-table=<duration>] [--timeout=<duration>] [--backup-name-template=<template>] <backup_name>",
+			Description:  "Create and upload",
+			BashComplete: completeBackups(firstArgument("")),
 			Action: func(c *cli.Context) error {
-				b := backup.NewBackuper(config.GetConfig(c))
-				return b.CreateToRemote(c.Args().First(), c.String("diff-from"), c.String("diff-from-remote"), c.String("t"), c.StringSlice("partitions"), c.Bool("s"), c.Bool("rbac"), c.Bool("configs"), version)
+				cfg := config.GetConfig(c)
+				if c.Bool("sequential") {
+					cfg.General.CreateConcurrency = 1
+					cfg.ClickHouse.FreezeConcurrency = 1
+				}
+				setTimeouts(cfg, c)
+				if template := c.String("backup-name-template"); template != "" {
+					cfg.General.BackupNameTemplate = template
+				}
+				schemaOnly, rbac, configs := c.Bool("s"), c.Bool("rbac"), c.Bool("configs")
+				if c.Bool("dr") {
+					schemaOnly, rbac, configs = backup.NewDRComponents(c.Bool("skip-configs"), c.Bool("skip-rbac"), false, schemaOnly || c.Bool("skip-data")).CreateOptions()
+				}
+				b := backup.NewBackuper(cfg)
+				return b.CreateToRemote(c.Args().First(), c.String("diff-from"), c.String("diff-from-remote"), strings.Join(c.StringSlice("t"), ","), c.StringSlice("partitions"), schemaOnly, rbac, configs, c.Bool("include-detached"), c.Bool("delete-source"), c.Bool("delete-local-after-upload"), version)
 			},
 			Flags: append(cliapp.Flags,
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:   "table, tables, t",
-					Usage:  "table name patterns, separated by comma, allow ? and * as wildcard",
+					Usage:  "table name patterns, separated by comma or passed multiple times, allow ? and * as wildcard, pattern with ! prefix excludes tables",
 					Hidden: false,
 				},
 				cli.StringSliceFlag{
 					Name:   "partitions",
 					Hidden: false,
-					Usage:  "partition names, separated by comma",
+					Usage:  "partition IDs, separated by comma, use db.table:id1,id2 to limit partitions only for matched tables",
 				},
 				cli.StringFlag{
 					Name:   "diff-from",
@@ -126,7 +250,7 @@ func main() {
 				cli.StringFlag{
 					Name:   "diff-from-remote",
 					Hidden: false,
-					Usage:  "remote backup name which used to upload current backup as differential",
+					Usage:  "remote backup name which used to upload current backup as differential, use latest to choose the most recent remote backup",
 				},
 				cli.BoolFlag{
 					Name:   "schema, s",
@@ -143,15 +267,83 @@ func main() {
 					Hidden: false,
 					Usage:  "Backup ClickHouse server configuration files only",
 				},
+				cli.BoolFlag{
+					Name:   "dr",
+					Hidden: false,
+					Usage:  "Backup everything required for disaster recovery: schema, data, RBAC objects and configuration files",
+				},
+				cli.BoolFlag{
+					Name:   "skip-configs",
+					Hidden: false,
+					Usage:  "Skip configuration files when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-rbac",
+					Hidden: false,
+					Usage:  "Skip RBAC related objects when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-data",
+					Hidden: false,
+					Usage:  "Skip table data when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "sequential",
+					Hidden: false,
+					Usage:  "Freeze and copy tables one by one, ignore create_concurrency and freeze_concurrency",
+				},
+				cli.BoolFlag{
+					Name:   "include-detached",
+					Hidden: false,
+					Usage:  "Backup parts from 'detached' folder of each table, they are restored only by restore --include-detached",
+				},
+				cli.StringFlag{
+					Name:   "timeout-per-table",
+					Hidden: false,
+					Usage:  "Maximum time to freeze or upload one table, like 30m, overrides timeout_per_table config option",
+				},
+				cli.StringFlag{
+					Name:   "timeout",
+					Hidden: false,
+					Usage:  "Maximum time to process all tables, like 6h, overrides run_timeout config option",
+				},
+				cli.StringFlag{
+					Name:   "backup-name-template",
+					Hidden: false,
+					Usage:  "Template of backup name when <backup_name> isn't passed, like {cluster}-{shard}-{timestamp:20060102-150405}, overrides backup_name_template config option",
+				},
+				cli.BoolFlag{
+					Name:   "delete-source",
+					Hidden: false,
+					Usage:  "Delete local data of each table right after it was uploaded, local metadata is kept",
+				},
+				cli.BoolFlag{
+					Name:   "delete-local-after-upload",
+					Hidden: false,
+					Usage:  "Remove whole local backup from all disks after successful upload, local backup is kept when upload fails",
+				},
 			),
 		},
 		{
-			Name:      "upload",
-			Usage:     "Upload backup to remote storage",
-			UsageText: "clickhouse-backup upload [-t, --tables=<db>.<table>] [--partitions=<partition_names>] [-s, --schema] [--diff-from=<local_backup_name>] [--diff-from-remote=<remote_backup_name>] <backup_name>",
+			Name:         "upload",
+			Usage:        "Upload backup to remote storage",
+			UsageText:    "clickhouse-backup upload [-t, --tables=<db>.<table>] [--partitions=<partition_names>] [-s, --schema] [--diff-from=<local_backup_name>] [--diff-from-remote=<remote_backup_name>] [--delete-source] [--delete-local-after-upload] [--resume] [--timeout-per-table=<duration>] [--timeout=<duration>] <backup_name>",
+			BashComplete: completeBackups(firstArgument("local")),
 			Action: func(c *cli.Context) error {
-				b := backup.NewBackuper(config.GetConfig(c))
-				return b.Upload(c.Args().First(), c.String("diff-from"), c.String("diff-from-remote"), c.String("t"), c.StringSlice("partitions"), c.Bool("s"))
+				cfg := config.GetConfig(c)
+				setTimeouts(cfg, c)
+				options, err := backup.ParseUploadOptions(c, c.Args().First())
+				if err != nil {
+					return err
+				}
+				b := backup.NewBackuper(cfg)
+				upload := func() error {
+					return b.Upload(c.Args().First(), options.DiffFrom, options.DiffFromRemote, options.Tables, options.Partitions, options.Schema, options.DeleteSource, options.Resume)
+				}
+				if c.Bool("delete-local-after-upload") && c.Args().First() != "" {
+					return backup.RemoveLocalAfter(cfg, c.Args().First(), "upload", upload)
+				}
+				return upload()
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -162,89 +354,226 @@ func main() {
 				cli.StringFlag{
 					Name:   "diff-from-remote",
 					Hidden: false,
-					Usage:  "remote backup name which used to upload current backup as differential",
+					Usage:  "remote backup name which used to upload current backup as differential, use latest to choose the most recent remote backup",
 				},
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:   "table, tables, t",
-					Usage:  "table name patterns, separated by comma, allow ? and * as wildcard",
+					Usage:  "table name patterns, separated by comma or passed multiple times, allow ? and * as wildcard, pattern with ! prefix excludes tables",
 					Hidden: false,
 				},
 				cli.StringSliceFlag{
 					Name:   "partitions",
 					Hidden: false,
-					Usage:  "partition names, separated by comma",
+					Usage:  "partition IDs, separated by comma, use db.table:id1,id2 to limit partitions only for matched tables",
 				},
 				cli.BoolFlag{
 					Name:   "schema, s",
 					Hidden: false,
 					Usage:  "Upload schemas only",
 				},
+				cli.BoolFlag{
+					Name:   "delete-source",
+					Hidden: false,
+					Usage:  "Delete local data of each table right after it was uploaded, local metadata is kept",
+				},
+				cli.BoolFlag{
+					Name:   "delete-local-after-upload",
+					Hidden: false,
+					Usage:  "Remove whole local backup from all disks after successful upload, local backup is kept when upload fails",
+				},
+				cli.BoolFlag{
+					Name:   "resume",
+					Hidden: false,
+					Usage:  "Continue interrupted upload of the same backup, tables which metadata and archives already exist on remote storage are not uploaded again",
+				},
+				cli.StringFlag{
+					Name:   "timeout-per-table",
+					Hidden: false,
+					Usage:  "Maximum time to freeze or upload one table, like 30m, overrides timeout_per_table config option",
+				},
+				cli.StringFlag{
+					Name:   "timeout",
+					Hidden: false,
+					Usage:  "Maximum time to process all tables, like 6h, overrides run_timeout config option",
+				},
 			),
 		},
 		{
 			Name:      "list",
 			Usage:     "Print list of backups",
-			UsageText: "clickhouse-backup list [all|local|remote] [latest|penult]",
+			UsageText: "clickhouse-backup list [--detailed] [--sort=name|date|size] [--reverse] [--relative] [--newer-than=<duration|date>] [--older-than=<duration|date>] [--storage-path=<path>] [all|local|remote] [<name_prefix>] [latest|penult]",
 			Action: func(c *cli.Context) error {
 				cfg := config.GetConfig(c)
+				if err := setStoragePath(cfg, c); err != nil {
+					return err
+				}
+				window, err := backup.ParseBackupDateWindow(c.String("newer-than"), c.String("older-than"), time.Now())
+				if err != nil {
+					return err
+				}
+				namePrefix, format := "", c.Args().Get(1)
+				if !isListFormat(format) {
+					namePrefix, format = format, c.Args().Get(2)
+				}
+				if c.Bool("detailed") && (format == "" || format == "all") {
+					format = "detailed"
+				}
 				switch c.Args().Get(0) {
 				case "local":
-					return backup.PrintLocalBackups(cfg, c.Args().Get(1))
+					return backup.PrintLocalBackups(cfg, namePrefix, format, c.String("sort"), c.Bool("reverse"), c.Bool("relative"), window)
 				case "remote":
-					return backup.PrintRemoteBackups(cfg, c.Args().Get(1))
+					return backup.PrintRemoteBackups(cfg, namePrefix, format, c.String("sort"), c.Bool("reverse"), c.Bool("relative"), window)
 				case "all", "":
-					return backup.PrintAllBackups(cfg, c.Args().Get(1))
+					return backup.PrintAllBackups(cfg, namePrefix, format, c.String("sort"), c.Bool("reverse"), c.Bool("relative"), window)
 				default:
 					log.Errorf("Unknown command '%s'\n", c.Args().Get(0))
 					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
 				}
 				return nil
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.BoolFlag{
+					Name:   "detailed",
+					Hidden: false,
+					Usage:  "Print clickhouse-server version, timezone and UUID which was used to create each backup",
+				},
+				cli.StringFlag{
+					Name:   "sort",
+					Hidden: false,
+					Usage:  "Sort backups by name, date or size, default is date",
+				},
+				cli.BoolFlag{
+					Name:   "reverse",
+					Hidden: false,
+					Usage:  "Print backups in descending order of --sort",
+				},
+				cli.BoolFlag{
+					Name:   "relative",
+					Hidden: false,
+					Usage:  "Print backup age relative to now, like '3 hours ago', next to backup date",
+				},
+				cli.StringFlag{
+					Name:   "newer-than",
+					Hidden: false,
+					Usage:  "Print only backups created after this date, duration before now like '7d' or '12h', or RFC3339 date like '2006-01-02T15:04:05Z', latest and penult are chosen among them",
+				},
+				cli.StringFlag{
+					Name:   "older-than",
+					Hidden: false,
+					Usage:  "Print only backups created before this date, duration before now like '30d' or RFC3339 date",
+				},
+				cli.StringFlag{
+					Name:   "storage-path",
+					Hidden: false,
+					Usage:  "Override path of remote storage from config, e.g. to list backups which were moved to other prefix of the same bucket",
+				},
+			),
 		},
 		{
-			Name:      "download",
-			Usage:     "Download backup from remote storage",
-			UsageText: "clickhouse-backup download [-t, --tables=<db>.<table>] [--partitions=<partition_names>] [-s, --schema] <backup_name>",
+			Name:      "metadata",
+			Usage:     "Print or change metadata.json of backup",
+			UsageText: "clickhouse-backup metadata [--remote] [--set=<field>=<value>] [--force] <backup_name>",
 			Action: func(c *cli.Context) error {
-				b := backup.NewBackuper(config.GetConfig(c))
-				return b.Download(c.Args().First(), c.String("t"), c.StringSlice("partitions"), c.Bool("s"))
+				return backup.PrintBackupMetadata(config.GetConfig(c), c.Args().First(), c.Bool("remote"), c.StringSlice("set"), c.Bool("force"))
 			},
 			Flags: append(cliapp.Flags,
-				cli.StringFlag{
+				cli.BoolFlag{
+					Name:   "remote",
+					Hidden: false,
+					Usage:  "Use backup from remote storage instead of local one",
+				},
+				cli.StringSliceFlag{
+					Name:   "set",
+					Hidden: false,
+					Usage:  "Change field before print, could be passed multiple times, editable fields: required_backup, tags",
+				},
+				cli.BoolFlag{
+					Name:   "force",
+					Hidden: false,
+					Usage:  "Allow changes which could make backup unusable, like clear required_backup or point it to absent backup",
+				},
+			),
+		},
+		{
+			Name:         "download",
+			Usage:        "Download backup from remote storage",
+			UsageText:    "clickhouse-backup download [-t, --tables=<db>.<table>] [--partitions=<partition_names>] [-s, --schema] [--force-default-disk] [--to=<dir>] [--storage-path=<path>] <backup_name>",
+			BashComplete: completeBackups(firstArgument("remote")),
+			Action: func(c *cli.Context) error {
+				cfg := config.GetConfig(c)
+				if err := setStoragePath(cfg, c); err != nil {
+					return err
+				}
+				b := backup.NewBackuper(cfg)
+				options := backup.ParseDownloadOptions(c)
+				return b.Download(c.Args().First(), options.Tables, options.Partitions, options.Schema, options.ForceDefaultDisk, c.String("to"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringSliceFlag{
 					Name:   "table, tables, t",
-					Usage:  "table name patterns, separated by comma, allow ? and * as wildcard",
+					Usage:  "table name patterns, separated by comma or passed multiple times, allow ? and * as wildcard, pattern with ! prefix excludes tables",
 					Hidden: false,
 				},
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:   "partitions",
 					Hidden: false,
-					Usage:  "partition names, separated by comma",
+					Usage:  "partition IDs, separated by comma, use db.table:id1,id2 to limit partitions only for matched tables",
 				},
 				cli.BoolFlag{
 					Name:   "schema, s",
 					Hidden: false,
 					Usage:  "Download schema only",
 				},
+				cli.BoolFlag{
+					Name:   "force-default-disk",
+					Hidden: false,
+					Usage:  "Restore parts from disks which are not found in system.disks and disk_mapping to 'default' disk",
+				},
+				cli.StringFlag{
+					Name:   "to",
+					Hidden: false,
+					Usage:  "Download backup into <dir>/backup/<backup_name> instead of ClickHouse data path, ClickHouse is not required, parts of all disks are placed into this directory",
+				},
+				cli.StringFlag{
+					Name:   "storage-path",
+					Hidden: false,
+					Usage:  "Override path of remote storage from config, e.g. to download backups which were moved to other prefix of the same bucket",
+				},
 			),
 		},
 		{
-			Name:      "restore",
-			Usage:     "Create schema and restore data from backup",
-			UsageText: "clickhouse-backup restore  [-t, --tables=<db>.<table>] [--partitions=<partitions_names>] [-s, --schema] [-d, --data] [--rm, --drop] [--rbac] [--configs] <backup_name>",
+			Name:         "restore",
+			Usage:        "Create schema and restore data from backup",
+			UsageText:    "clickhouse-backup restore  [-t, --tables=<db>.<table>] [--partitions=<partitions_names>] [-s, --schema] [-d, --data] [--rm, --drop, --drop-table] [--skip-existing] [--attach-only, --no-drop] [--rbac] [--configs] [--dr] [--skip-configs] [--skip-rbac] [--skip-schema] [--skip-data] [--force-default-disk] [--include-detached] [--verify-rows] [--replica-sync] [--delete-local-after-restore] <backup_name>",
+			BashComplete: completeBackups(firstArgument("local")),
 			Action: func(c *cli.Context) error {
-				return backup.Restore(config.GetConfig(c), c.Args().First(), c.String("t"), c.StringSlice("partitions"), c.Bool("s"), c.Bool("d"), c.Bool("rm"), c.Bool("rbac"), c.Bool("configs"))
+				cfg := config.GetConfig(c)
+				options, err := backup.ParseRestoreOptions(c)
+				if err != nil {
+					return err
+				}
+				restore := func() error {
+					if c.Bool("dr") {
+						components := backup.NewDRComponents(c.Bool("skip-configs"), c.Bool("skip-rbac"), c.Bool("skip-schema"), c.Bool("skip-data"))
+						return backup.RestoreDR(cfg, c.Args().First(), options.Tables, options.Partitions, options.Rm, options.SkipExisting, options.ForceDefaultDisk, components, backup.NewOperationID())
+					}
+					return backup.Restore(cfg, c.Args().First(), options, backup.NewOperationID())
+				}
+				if c.Bool("delete-local-after-restore") && c.Args().First() != "" {
+					return backup.RemoveLocalAfter(cfg, c.Args().First(), "restore", restore)
+				}
+				return restore()
 			},
 			Flags: append(cliapp.Flags,
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:   "table, tables, t",
-					Usage:  "table name patterns, separated by comma, allow ? and * as wildcard",
+					Usage:  "table name patterns, separated by comma or passed multiple times, allow ? and * as wildcard, pattern with ! prefix excludes tables",
 					Hidden: false,
 				},
 				cli.StringSliceFlag{
 					Name:   "partitions",
 					Hidden: false,
-					Usage:  "partition names, separated by comma",
+					Usage:  "partition IDs, separated by comma, use db.table:id1,id2 to limit partitions only for matched tables",
 				},
 				cli.BoolFlag{
 					Name:   "schema, s",
@@ -257,10 +586,20 @@ func main() {
 					Usage:  "Restore data only",
 				},
 				cli.BoolFlag{
-					Name:   "rm, drop",
+					Name:   "rm, drop, drop-table",
 					Hidden: false,
 					Usage:  "Drop table before restore",
 				},
+				cli.BoolFlag{
+					Name:   "skip-existing",
+					Hidden: false,
+					Usage:  "Create only tables which don't exist, existing tables are kept as is, by default restore fails when any table already exists",
+				},
+				cli.BoolFlag{
+					Name:   "attach-only, no-drop",
+					Hidden: false,
+					Usage:  "Attach parts into existing tables without schema restore, table structure shall be the same as in backup, already existing parts will skip",
+				},
 				cli.BoolFlag{
 					Name:   "rbac, restore-rbac, do-restore-rbac",
 					Hidden: false,
@@ -271,26 +610,96 @@ func main() {
 					Hidden: false,
 					Usage:  "Restore CONFIG related files only",
 				},
+				cli.BoolFlag{
+					Name:   "dr",
+					Hidden: false,
+					Usage:  "Restore configuration files, RBAC objects, schema and data in this order, restart clickhouse-server after configs and RBAC",
+				},
+				cli.BoolFlag{
+					Name:   "skip-configs",
+					Hidden: false,
+					Usage:  "Skip configuration files when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-rbac",
+					Hidden: false,
+					Usage:  "Skip RBAC related objects when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-schema",
+					Hidden: false,
+					Usage:  "Skip schema when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-data",
+					Hidden: false,
+					Usage:  "Skip table data when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "force-default-disk",
+					Hidden: false,
+					Usage:  "Restore parts from disks which are not found in system.disks and disk_mapping to 'default' disk",
+				},
+				cli.BoolFlag{
+					Name:   "include-detached",
+					Hidden: false,
+					Usage:  "Restore detached parts from backup into 'detached' folder of each table, they are not attached",
+				},
+				cli.BoolFlag{
+					Name:   "verify-rows",
+					Hidden: false,
+					Usage:  "Compare SELECT count() of each restored table with rows count recorded during create, fail when they are different",
+				},
+				cli.BoolFlag{
+					Name:   "replica-sync",
+					Hidden: false,
+					Usage:  "Create schema and fetch data of replicated tables from replica where data was restored by SYSTEM SYNC REPLICA, data from backup is not attached",
+				},
+				cli.BoolFlag{
+					Name:   "delete-local-after-restore",
+					Hidden: false,
+					Usage:  "Remove local backup from all disks after successful restore, like restore_remote does for downloaded backup, local backup is kept when restore fails",
+				},
 			),
 		},
 		{
-			Name:      "restore_remote",
-			Usage:     "Download and restore",
-			UsageText: "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] [--partitions=<partitions_names>] [--rm, --drop] [--rbac] [--configs] [--skip-rbac] [--skip-configs] <backup_name>",
+			Name:         "restore_remote",
+			Aliases:      []string{"restore-remote"},
+			Usage:        "Download and restore, downloaded local backup is removed after restore",
+			UsageText:    "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] [--partitions=<partitions_names>] [--rm, --drop, --drop-table] [--skip-existing] [--attach-only, --no-drop] [--rbac] [--configs] [--dr] [--skip-configs] [--skip-rbac] [--skip-schema] [--skip-data] [--force-default-disk] [--include-detached] [--verify-rows] [--replica-sync] [--keep] <backup_name>",
+			BashComplete: completeBackups(firstArgument("remote")),
 			Action: func(c *cli.Context) error {
 				b := backup.NewBackuper(config.GetConfig(c))
-				return b.RestoreFromRemote(c.Args().First(), c.String("t"), c.StringSlice("partitions"), c.Bool("s"), c.Bool("d"), c.Bool("rm"), c.Bool("rbac"), c.Bool("configs"))
+				if c.Bool("dr") {
+					components := backup.NewDRComponents(c.Bool("skip-configs"), c.Bool("skip-rbac"), c.Bool("skip-schema"), c.Bool("skip-data"))
+					return b.RestoreDRFromRemote(c.Args().First(), strings.Join(c.StringSlice("t"), ","), c.StringSlice("partitions"), c.Bool("rm"), c.Bool("skip-existing"), c.Bool("force-default-disk"), c.Bool("keep"), components)
+				}
+				return b.RestoreFromRemote(c.Args().First(), backup.RestoreOptions{
+					Tables:           strings.Join(c.StringSlice("t"), ","),
+					Partitions:       c.StringSlice("partitions"),
+					Schema:           c.Bool("s"),
+					Data:             c.Bool("d"),
+					Rm:               c.Bool("rm"),
+					SkipExisting:     c.Bool("skip-existing"),
+					AttachOnly:       c.Bool("attach-only"),
+					RBAC:             c.Bool("rbac"),
+					Configs:          c.Bool("configs"),
+					ForceDefaultDisk: c.Bool("force-default-disk"),
+					IncludeDetached:  c.Bool("include-detached"),
+					VerifyRows:       c.Bool("verify-rows"),
+					ReplicaSync:      c.Bool("replica-sync"),
+				}, c.Bool("keep"))
 			},
 			Flags: append(cliapp.Flags,
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:   "table, tables, t",
-					Usage:  "table name patterns, separated by comma, allow ? and * as wildcard",
+					Usage:  "table name patterns, separated by comma or passed multiple times, allow ? and * as wildcard, pattern with ! prefix excludes tables",
 					Hidden: false,
 				},
 				cli.StringSliceFlag{
 					Name:   "partitions",
 					Hidden: false,
-					Usage:  "partition names, separated by comma",
+					Usage:  "partition IDs, separated by comma, use db.table:id1,id2 to limit partitions only for matched tables",
 				},
 				cli.BoolFlag{
 					Name:   "schema, s",
@@ -303,10 +712,20 @@ func main() {
 					Usage:  "Restore data only",
 				},
 				cli.BoolFlag{
-					Name:   "rm, drop",
+					Name:   "rm, drop, drop-table",
 					Hidden: false,
 					Usage:  "Drop table before restore",
 				},
+				cli.BoolFlag{
+					Name:   "skip-existing",
+					Hidden: false,
+					Usage:  "Create only tables which don't exist, existing tables are kept as is, by default restore fails when any table already exists",
+				},
+				cli.BoolFlag{
+					Name:   "attach-only, no-drop",
+					Hidden: false,
+					Usage:  "Attach parts into existing tables without schema restore, table structure shall be the same as in backup, already existing parts will skip",
+				},
 				cli.BoolFlag{
 					Name:   "rbac, restore-rbac, do-restore-rbac",
 					Hidden: false,
@@ -317,14 +736,94 @@ func main() {
 					Hidden: false,
 					Usage:  "Restore CONFIG related files only",
 				},
+				cli.BoolFlag{
+					Name:   "dr",
+					Hidden: false,
+					Usage:  "Restore configuration files, RBAC objects, schema and data in this order, restart clickhouse-server after configs and RBAC",
+				},
+				cli.BoolFlag{
+					Name:   "skip-configs",
+					Hidden: false,
+					Usage:  "Skip configuration files when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-rbac",
+					Hidden: false,
+					Usage:  "Skip RBAC related objects when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-schema",
+					Hidden: false,
+					Usage:  "Skip schema when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "skip-data",
+					Hidden: false,
+					Usage:  "Skip table data when --dr is used",
+				},
+				cli.BoolFlag{
+					Name:   "force-default-disk",
+					Hidden: false,
+					Usage:  "Restore parts from disks which are not found in system.disks and disk_mapping to 'default' disk",
+				},
+				cli.BoolFlag{
+					Name:   "include-detached",
+					Hidden: false,
+					Usage:  "Restore detached parts from backup into 'detached' folder of each table, they are not attached",
+				},
+				cli.BoolFlag{
+					Name:   "verify-rows",
+					Hidden: false,
+					Usage:  "Compare SELECT count() of each restored table with rows count recorded during create, fail when they are different",
+				},
+				cli.BoolFlag{
+					Name:   "replica-sync",
+					Hidden: false,
+					Usage:  "Create schema and fetch data of replicated tables from replica where data was restored by SYSTEM SYNC REPLICA, data from backup is not attached",
+				},
+				cli.BoolFlag{
+					Name:   "keep",
+					Hidden: false,
+					Usage:  "Keep downloaded local backup after restore",
+				},
 			),
 		},
 		{
-			Name:      "delete",
-			Usage:     "Delete specific backup",
-			UsageText: "clickhouse-backup delete <local|remote> <backup_name>",
+			Name:      "flatten",
+			Aliases:   []string{"consolidate"},
+			Usage:     "Copy incremental remote backup with all required backups into new self-contained remote backup",
+			UsageText: "clickhouse-backup flatten <backup_name> [<new_backup_name>]",
+			Description: "Parts are copied from remote to remote storage without local disk, new backup name is <backup_name>_full by default,\n" +
+				"   interrupted flatten could be continued by the same command, already copied tables are skipped",
+			Action: func(c *cli.Context) error {
+				backupName := c.Args().Get(0)
+				if backupName == "" {
+					log.Errorf("backup name is not defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				newBackupName := c.Args().Get(1)
+				if newBackupName == "" {
+					newBackupName = backupName + "_full"
+				}
+				return backup.NewBackuper(config.GetConfig(c)).Flatten(backupName, newBackupName)
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:         "delete",
+			Usage:        "Delete specific backup",
+			UsageText:    "clickhouse-backup delete <local|remote> <backup_name>\n   clickhouse-backup delete [--pattern=<glob>] [--older-than=<duration>] [--confirm] remote",
+			BashComplete: completeBackups(locationArgument),
 			Action: func(c *cli.Context) error {
 				cfg := config.GetConfig(c)
+				if c.String("pattern") != "" || c.String("older-than") != "" {
+					if c.Args().Get(0) != "remote" || c.Args().Get(1) != "" {
+						log.Errorf("--pattern and --older-than could be used only with 'remote' and without backup name")
+						cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+					}
+					_, err := backup.RemoveBackupsRemote(cfg, c.String("pattern"), c.String("older-than"), confirmDelete(c.Bool("confirm")))
+					return err
+				}
 				if c.Args().Get(1) == "" {
 					log.Errorf("Backup name must be defined")
 					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
@@ -340,29 +839,138 @@ func main() {
 				}
 				return nil
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "pattern",
+					Hidden: false,
+					Usage:  "Delete all remote backups which names match glob pattern, like 'test-*'",
+				},
+				cli.StringFlag{
+					Name:   "older-than",
+					Hidden: false,
+					Usage:  "Delete all remote backups created earlier than duration ago, like '30d' or '12h'",
+				},
+				cli.BoolFlag{
+					Name:   "confirm",
+					Hidden: false,
+					Usage:  "Delete backups matched by --pattern and --older-than without interactive confirmation",
+				},
+			),
 		},
 		{
 			Name:  "default-config",
 			Usage: "Print default config",
-			Action: func(*cli.Context) error {
-				return config.PrintConfig(nil)
+			Action: func(c *cli.Context) error {
+				return config.PrintConfig(config.DefaultConfig(), c.String("format"))
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "format, f",
+					Value:  "yaml",
+					Hidden: false,
+					Usage:  "Output format, yaml or json",
+				},
+			),
 		},
 		{
 			Name:  "print-config",
-			Usage: "Print current config",
+			Usage: "Print current config merged from defaults, config file and environment variables, passwords and credentials are redacted",
 			Action: func(c *cli.Context) error {
-				return config.PrintConfig(c)
+				return config.PrintConfig(config.GetConfig(c), c.String("format"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "format, f",
+					Value:  "yaml",
+					Hidden: false,
+					Usage:  "Output format, yaml or json",
+				},
+			),
+		},
+		{
+			Name:      "check-config",
+			Usage:     "Check config for unknown keys, mutually exclusive options and wrong compression settings, `--connect` also tests clickhouse and remote storage",
+			UsageText: "clickhouse-backup check-config [--connect]",
+			Action: func(c *cli.Context) error {
+				return checkConfig(config.GetConfigPath(c), c.Bool("connect"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.BoolFlag{
+					Name:   "connect",
+					Hidden: false,
+					Usage:  "Also connect to clickhouse and remote storage, write, stat, read and delete small test object, print result of each check",
+				},
+			),
+		},
+		{
+			Name:      "config",
+			Usage:     "Check config, `config validate` is alias of `check-config --connect`",
+			UsageText: "clickhouse-backup config validate",
+			Subcommands: []cli.Command{
+				{
+					Name:      "validate",
+					Usage:     "Alias of `check-config --connect`, check config, then test clickhouse and remote storage",
+					UsageText: "clickhouse-backup config validate",
+					Action: func(c *cli.Context) error {
+						return checkConfig(config.GetConfigPath(c), true)
+					},
+					Flags: cliapp.Flags,
+				},
 			},
-			Flags: cliapp.Flags,
 		},
 		{
-			Name:  "clean",
-			Usage: "Remove data in 'shadow' folder from all `path` folders available from `system.disks`",
+			Name:      "clean",
+			Usage:     "Remove data in 'shadow' folder from all `path` folders available from `system.disks`, skipped when any backup is locked by running operation",
+			UsageText: "clickhouse-backup clean [--remove-broken]",
 			Action: func(c *cli.Context) error {
-				return backup.Clean(config.GetConfig(c))
+				removed, err := backup.Clean(config.GetConfig(c), c.Bool("remove-broken"))
+				for _, removedPath := range removed {
+					fmt.Println(removedPath)
+				}
+				return err
+			},
+			Flags: append(cliapp.Flags,
+				cli.BoolFlag{
+					Name:   "remove-broken",
+					Hidden: false,
+					Usage:  "Remove local backups without metadata.json or which metadata.json can't be read or parsed, legacy backups with .sql schemas are kept, backups locked by running operations are skipped",
+				},
+			),
+		},
+		{
+			Name:      "gc",
+			Aliases:   []string{"prune_orphans", "prune-orphans"},
+			Usage:     "Delete remote objects which don't belong to any backup, like leftovers of failed uploads and unreferenced shared parts",
+			UsageText: "clickhouse-backup gc [--min-age=<duration>] [--dry-run]",
+			Description: "Objects of broken backups, unknown objects of backups without manifest and all shared parts when any backup is broken are retained and reported,\n" +
+				"   use `delete remote <backup_name>` for broken backups which are abandoned",
+			Action: func(c *cli.Context) error {
+				found, err := backup.RemoveOrphansRemote(config.GetConfig(c), c.String("min-age"), c.Bool("dry-run"))
+				for _, line := range found {
+					fmt.Println(line)
+				}
+				return err
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "min-age",
+					Value:  "24h",
+					Hidden: false,
+					Usage:  "Keep objects modified later than duration ago, they could belong to upload which is running right now",
+				},
+				cli.BoolFlag{
+					Name:   "dry-run",
+					Hidden: false,
+					Usage:  "Only print orphaned objects, nothing is deleted",
+				},
+			),
+		},
+		{
+			Name:      "completion",
+			Usage:     "Print shell completion script, backup names and tables are completed from clickhouse and remote storage",
+			UsageText: "source <(clickhouse-backup completion bash|zsh), clickhouse-backup completion fish | source",
+			Action: func(c *cli.Context) error {
+				return printCompletionScript(os.Stdout, c.Args().First())
 			},
 			Flags: cliapp.Flags,
 		},
@@ -376,6 +984,87 @@ func main() {
 		},
 	}
 	if err := cliapp.Run(os.Args); err != nil {
-		log.Fatal(err.Error())
+		log.Error(err.Error())
+		os.Exit(backup.ExitCode(err))
+	}
+}
+
+// isListFormat - second argument of `list` is format, otherwise it is prefix of backup names
+func isListFormat(arg string) bool {
+	switch arg {
+	case "", "all", "detailed", "latest", "last", "l", "penult", "prev", "previous", "p":
+		return true
+	}
+	return false
+}
+
+// setTimeouts - override timeout_per_table and run_timeout config options by command flags
+func setTimeouts(cfg *config.Config, c *cli.Context) {
+	if timeout := c.String("timeout-per-table"); timeout != "" {
+		cfg.General.TimeoutPerTable = timeout
+	}
+	if timeout := c.String("timeout"); timeout != "" {
+		cfg.General.RunTimeout = timeout
+	}
+}
+
+// setStoragePath - override path of remote storage by --storage-path flag
+func setStoragePath(cfg *config.Config, c *cli.Context) error {
+	if storagePath := c.String("storage-path"); storagePath != "" {
+		return cfg.SetRemotePath(storagePath)
+	}
+	return nil
+}
+
+// confirmDelete - print backups which will be deleted, ask for confirmation when --confirm isn't passed and stdin is terminal
+func confirmDelete(confirmed bool) func(backupNames []string) bool {
+	return func(backupNames []string) bool {
+		fmt.Printf("%d backups will be deleted:\n", len(backupNames))
+		for _, backupName := range backupNames {
+			fmt.Println("  " + backupName)
+		}
+		if confirmed {
+			return true
+		}
+		if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+			log.Errorf("use --confirm to delete backups without interactive confirmation")
+			return false
+		}
+		fmt.Print("Delete these backups? [y/N]: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+// cancelOnSignal - first SIGINT or SIGTERM cancels running create or upload, they clean up and exit with backup.ExitCodeCancelled,
+// process exits right away when nothing could be cancelled or signal is repeated
+func cancelOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if backup.CancelOperations() {
+			log.Warn("cancel running operation, send signal again to terminate immediately")
+			<-signals
+		}
+		os.Exit(backup.ExitCodeCancelled)
+	}()
+}
+
+// checkConfig - print each problem of config, when connect is true and config has no problems test clickhouse and remote storage,
+// used by `check-config` and `config validate`
+func checkConfig(configPath string, connect bool) error {
+	problems := config.CheckConfig(configPath)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in config %s", len(problems), configPath)
+	}
+	if connect {
+		return backup.ValidateConfig(configPath)
 	}
+	log.Infof("config %s is valid", configPath)
+	return nil
 }
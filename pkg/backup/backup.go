@@ -1,15 +1,17 @@
 package backup
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
-	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
@@ -20,6 +22,8 @@ import (
 	apexLog "github.com/apex/log"
 	"github.com/google/uuid"
 	"github.com/otiai10/copy"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -48,50 +52,82 @@ func addTable(tables []clickhouse.Table, table clickhouse.Table) []clickhouse.Ta
 	return append(tables, table)
 }
 
-func filterTablesByPattern(tables []clickhouse.Table, tablePattern string) []clickhouse.Table {
-	if tablePattern == "" {
-		return tables
-	}
-	tablePatterns := strings.Split(tablePattern, ",")
+func filterTablesByPattern(tables []clickhouse.Table, tablePattern string, skipTables []string) []clickhouse.Table {
+	tp := common.NewTablePattern(tablePattern, skipTables)
 	var result []clickhouse.Table
+	var tableNames []string
 	for _, t := range tables {
-		for _, pattern := range tablePatterns {
-			tableName := fmt.Sprintf("%s.%s", t.Database, t.Name)
-			if matched, _ := filepath.Match(strings.Trim(pattern, " \t\n\r"), tableName); matched {
-				result = addTable(result, t)
-			} else {
-				apexLog.Debugf("%s not matched with %s", tableName, pattern)
-			}
+		tableName := fmt.Sprintf("%s.%s", t.Database, t.Name)
+		if tp.Match(t.Database, t.Name) {
+			result = addTable(result, t)
+			tableNames = append(tableNames, tableName)
+		} else {
+			apexLog.Debugf("%s not matched with %s", tableName, tablePattern)
 		}
 	}
+	logMatchedTables(tablePattern, tableNames)
 	return result
 }
 
+// serverInfoGetter - part of clickhouse.ClickHouse which describe clickhouse-server
+type serverInfoGetter interface {
+	GetVersionDescribe() string
+	GetTimezone() string
+	GetServerUUID() string
+}
+
+// fillServerInfo - save clickhouse-server version, timezone and UUID into backup metadata
+func fillServerInfo(ch serverInfoGetter, backupMetadata *metadata.BackupMetadata) {
+	backupMetadata.ClickHouseVersion = ch.GetVersionDescribe()
+	backupMetadata.ClickHouseTimezone = ch.GetTimezone()
+	backupMetadata.ClickHouseServerUUID = ch.GetServerUUID()
+}
+
 // NewBackupName - return default backup name
 func NewBackupName() string {
 	return time.Now().UTC().Format(TimeFormatForBackup)
 }
 
 // CreateBackup - create new backup of all tables matched by tablePattern
-// If backupName is empty string will use default backup name
-func CreateBackup(cfg *config.Config, backupName, tablePattern string, partitions []string, schemaOnly, rbacOnly, configsOnly bool, version string) error {
+// If backupName is empty string will use name from general.backup_name_template or default backup name
+// when includeDetached is true, parts from `detached` folder of each table are backed up too, they are restored only by `restore --include-detached`
+func CreateBackup(cfg *config.Config, backupName, tablePattern string, partitions []string, schemaOnly, rbacOnly, configsOnly, includeDetached bool, changedSince, version, operationID string) error {
+	return createBackup(cfg, backupName, tablePattern, partitions, schemaOnly, rbacOnly, configsOnly, includeDetached, changedSince, version, operationID, nil)
+}
+
+// CreateBackup - the same as CreateBackup function, stats of tables are available by TableStats while backup is created
+func (b *Backuper) CreateBackup(backupName, tablePattern string, partitions []string, schemaOnly, rbacOnly, configsOnly, includeDetached bool, changedSince, version string) error {
+	return createBackup(b.cfg, backupName, tablePattern, partitions, schemaOnly, rbacOnly, configsOnly, includeDetached, changedSince, version, b.OperationID, b.tableStats)
+}
+
+func createBackup(cfg *config.Config, backupName, tablePattern string, partitions []string, schemaOnly, rbacOnly, configsOnly, includeDetached bool, changedSince, version, operationID string, tableStats *tableStatsRecorder) (err error) {
 
 	startBackup := time.Now()
 	doBackupData := !schemaOnly
 	if backupName == "" {
-		backupName = NewBackupName()
+		if backupName, err = ResolveBackupName(cfg, false); err != nil {
+			return err
+		}
+	}
+	defer func() { logBackupOperation(cfg, "create", backupName, startBackup, err) }()
+	log := operationLog(operationID, backupName, "create")
+	if err := (CreateOptions{Partitions: partitions, Schema: schemaOnly, IncludeDetached: includeDetached, ChangedSince: changedSince}).Validate(); err != nil {
+		return err
+	}
+	timeouts, err := newTableTimeouts(cfg)
+	if err != nil {
+		return err
 	}
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "create",
-	})
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
 	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer ch.Close()
+	if err := checkOperationPermissions(cfg, ch, "create", tablePattern, doBackupData); err != nil {
+		return err
+	}
 
 	allDatabases, err := ch.GetDatabases()
 	if err != nil {
@@ -102,7 +138,7 @@ func CreateBackup(cfg *config.Config, backupName, tablePattern string, partition
 	if err != nil {
 		return fmt.Errorf("can't get tables from clickhouse: %v", err)
 	}
-	tables := filterTablesByPattern(allTables, tablePattern)
+	tables := filterTablesByPattern(allTables, tablePattern, cfg.ClickHouse.SkipTables)
 	i := 0
 	for _, table := range tables {
 		if table.Skip {
@@ -113,11 +149,25 @@ func CreateBackup(cfg *config.Config, backupName, tablePattern string, partition
 	if i == 0 && !cfg.General.AllowEmptyBackups {
 		return fmt.Errorf("no tables for backup")
 	}
+	var estimate *SizeEstimate
+	if doBackupData {
+		if partsSize, err := ch.GetPartsSize(); err != nil {
+			log.Warnf("can't estimate backup size: %v", err)
+		} else {
+			tablesEstimate := estimateBackupSize(tables, partsSize)
+			estimate = &tablesEstimate
+			log.WithField("estimated_size", utils.FormatBytes(estimate.Size)).Infof("%d tables with data", len(estimate.Tables))
+		}
+	}
 
 	disks, err := ch.GetDisks()
 	if err != nil {
 		return err
 	}
+	objectDiskTables := map[metadata.TableTitle][]string{}
+	if doBackupData {
+		objectDiskTables = findObjectDiskTables(tables, disks, cfg.ClickHouse.ObjectDisks, log)
+	}
 	// Create backup dir on all clickhouse disks
 	for _, disk := range disks {
 		if err := filesystemhelper.Mkdir(path.Join(disk.Path, "backup"), ch); err != nil {
@@ -130,8 +180,27 @@ func CreateBackup(cfg *config.Config, backupName, tablePattern string, partition
 	}
 	backupPath := path.Join(defaultPath, "backup", backupName)
 	if _, err := os.Stat(path.Join(backupPath, "metadata.json")); err == nil || !os.IsNotExist(err) {
-		return fmt.Errorf("'%s' medatata.json already exists", backupName)
+		return fmt.Errorf("'%s' medatata.json already exists: %w", backupName, ErrBackupIsAlreadyExists)
+	}
+	unchangedTables := map[metadata.TableTitle]metadata.TableMetadata{}
+	if changedSince != "" {
+		if unchangedTables, err = findUnchangedTables(ch, defaultPath, changedSince, tablePattern, cfg.ClickHouse.SkipTables, tables); err != nil {
+			return err
+		}
+		log.Infof("%d tables are unchanged since '%s', their parts will be linked without FREEZE", len(unchangedTables), changedSince)
+	}
+	var projectedSize uint64
+	if estimate != nil {
+		projectedSize = estimate.Size
 	}
+	if err := freeLocalSpace(cfg, disks, path.Join(defaultPath, "backup"), backupName, projectedSize); err != nil {
+		return err
+	}
+	unlock, err := lockBackup(path.Join(defaultPath, "backup"), backupName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
 		if err = filesystemhelper.Mkdir(backupPath, ch); err != nil {
 			log.Errorf("can't create directory %s: %v", backupPath, err)
@@ -142,71 +211,236 @@ func CreateBackup(cfg *config.Config, backupName, tablePattern string, partition
 	for _, disk := range disks {
 		diskMap[disk.Name] = disk.Path
 	}
+	// cleanShadow removes whole shadow folder, including FREEZE results of concurrent create and other tools,
+	// so it is skipped when any other backup is locked by running operation, it is still unsafe when other tools use FREEZE
+	if cfg.General.CleanShadowBeforeBackup {
+		removed, err := cleanShadowUnlocked(disks, path.Join(defaultPath, "backup"), backupName)
+		if err != nil {
+			return err
+		}
+		log.Infof("removed %d stale items from shadow before FREEZE", len(removed))
+	}
 	var backupDataSize, backupMetadataSize uint64
 
-	var tableMetas []metadata.TableTitle
-	partitionsToBackupMap := filesystemhelper.CreatePartitionsToBackupMap(partitions)
-	for _, table := range tables {
-		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
+	partitionsToBackup := filesystemhelper.CreatePartitionsToBackupMap(partitions)
+	// up to clickhouse.freeze_concurrency FREEZE queries run in parallel by separate connections to clickhouse, shadow of frozen tables is moved into backup
+	// by up to general.create_concurrency tables concurrently, each table is frozen with own name, so shadow of each table is moved into backup separately,
+	// the greater of them bounds tables in progress, so next tables are frozen while frozen tables wait for copy
+	log.Debugf("prepare table concurrent semaphore with concurrency=%d freeze_concurrency=%d len(tables)=%d", cfg.General.CreateConcurrency, cfg.ClickHouse.FreezeConcurrency, len(tables))
+	var freezeNames []string
+	var freezeNamesLock sync.Mutex
+	// runTable doesn't wait table after failure of other table, cleanup shall wait running FREEZE and moving of shadow
+	var runningTables sync.WaitGroup
+	freezeLimit := semaphore.NewWeighted(int64(cfg.ClickHouse.FreezeConcurrency))
+	copyLimit := semaphore.NewWeighted(int64(cfg.General.CreateConcurrency))
+	tablesInProgress := int64(cfg.General.CreateConcurrency)
+	if int64(cfg.ClickHouse.FreezeConcurrency) > tablesInProgress {
+		tablesInProgress = int64(cfg.ClickHouse.FreezeConcurrency)
+	}
+	s := semaphore.NewWeighted(tablesInProgress)
+	runCtx, cancelRun := timeouts.runContext()
+	defer cancelRun()
+	g, groupCtx := errgroup.WithContext(runCtx)
+	// failed table cancels ctx before releasing its slot, so queued tables are not started between release and cancel of errgroup
+	ctx, cancelTables := context.WithCancel(groupCtx)
+	defer cancelTables()
+	createdTables := make([]*metadata.TableTitle, len(tables))
+	createdTableStats := make([]*metadata.TableStats, len(tables))
+	for i, table := range tables {
 		if table.Skip {
 			continue
 		}
-		var realSize map[string]int64
-		var disksToPartsMap map[string][]metadata.Part
-		if doBackupData {
-			log.Debug("create data")
-			shadowBackupUUID := strings.ReplaceAll(uuid.New().String(), "-", "")
-			disksToPartsMap, realSize, err = AddTableToBackup(ch, backupName, shadowBackupUUID, disks, &table, partitionsToBackupMap)
-			if err != nil {
-				log.Error(err.Error())
-				if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
-					log.Error(removeBackupErr.Error())
+		if err := s.Acquire(ctx, 1); err != nil {
+			log.Errorf("can't acquire semaphore during Create: %v", err)
+			break
+		}
+		idx := i
+		table := table
+		g.Go(func() error {
+			defer s.Release(1)
+			log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
+			var dataSize, metadataSize uint64
+			stats := metadata.TableStats{Database: table.Database, Table: table.Name}
+			runningTables.Add(1)
+			// results are written only by this function and read only after it was finished in time
+			err := timeouts.runTable(ctx, func(ctx context.Context) error {
+				defer runningTables.Done()
+				var realSize map[string]int64
+				var disksToPartsMap, metadataDetachedParts map[string][]metadata.Part
+				var rows *uint64
+				var objectDiskKeys map[string][]string
+				var dataSkipReason, freezeName string
+				var err error
+				partitionsToBackupMap := partitionsToBackup.ForTable(table.Database, table.Name)
+				objectDisks := objectDiskTables[metadata.TableTitle{Database: table.Database, Table: table.Name}]
+				if len(objectDisks) > 0 && cfg.ClickHouse.ObjectDisks == "skip" {
+					dataSkipReason = objectDisksSkipReason(objectDisks)
+					log.Warnf("%s, skip data", dataSkipReason)
+				} else if reference, isUnchanged := unchangedTables[metadata.TableTitle{Database: table.Database, Table: table.Name}]; isUnchanged {
+					log.Debugf("unchanged since '%s', link parts", changedSince)
+					if err = acquireLimit(ctx, copyLimit); err != nil {
+						return err
+					}
+					startCopy := time.Now()
+					disksToPartsMap, realSize, err = linkUnchangedTable(disks, changedSince, backupName, reference)
+					releaseLimit(copyLimit)
+					if err != nil {
+						log.Error(err.Error())
+						return err
+					}
+					stats.CopyMs = time.Since(startCopy).Milliseconds()
+					rows = reference.Rows
+					for _, size := range realSize {
+						dataSize += uint64(size)
+					}
+				} else if doBackupData {
+					log.Debug("create data")
+					shadowBackupUUID := strings.ReplaceAll(uuid.New().String(), "-", "")
+					if isDataBackupEngine(table.Engine) {
+						freezeNamesLock.Lock()
+						freezeNames = append(freezeNames, shadowBackupUUID)
+						freezeNamesLock.Unlock()
+					}
+					disksToPartsMap, realSize, err = AddTableToBackup(ctx, ch, backupName, shadowBackupUUID, disks, &table, partitionsToBackupMap, &stats, log, freezeLimit, copyLimit)
+					if err != nil {
+						log.Error(err.Error())
+						return err
+					}
+					if isDataBackupEngine(table.Engine) {
+						freezeName = shadowBackupUUID
+					}
+					if isDataBackupEngine(table.Engine) {
+						rows = countBackupRows(ch, table, disksToPartsMap, log)
+					}
+					if len(objectDisks) > 0 {
+						if objectDiskKeys, err = backupObjectDiskKeys(backupName, disks, table, objectDisks, log); err != nil {
+							log.Error(err.Error())
+							return err
+						}
+					}
+					if includeDetached {
+						detachedParts, detachedSize, err := addTableDetachedToBackup(backupName, disks, &table)
+						if err != nil {
+							log.Error(err.Error())
+							return err
+						}
+						for disk, size := range detachedSize {
+							if realSize == nil {
+								realSize = map[string]int64{}
+							}
+							realSize[disk] += size
+						}
+						metadataDetachedParts = detachedParts
+					}
+					// more precise data size calculation
+					for _, size := range realSize {
+						dataSize += uint64(size)
+					}
 				}
-				// fix corner cases after https://github.com/AlexAkulov/clickhouse-backup/issues/379
-				if cleanShadowErr := Clean(cfg); cleanShadowErr != nil {
-					log.Error(cleanShadowErr.Error())
+				// table which exceeded timeout_per_table during FREEZE shall not get metadata
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				var tableStatsMetadata *metadata.TableStats
+				if doBackupData {
+					stats.UncompressedSize = dataSize
+					tableStats.set(stats)
+					tableStatsMetadata = &stats
+				}
+				log.Debug("create metadata")
+				metadataSize, err = createMetadata(ch, backupPath, metadata.TableMetadata{
+					Table:          table.Name,
+					Database:       table.Database,
+					Query:          table.CreateTableQuery,
+					TotalBytes:     table.TotalBytes,
+					Size:           realSize,
+					Parts:          disksToPartsMap,
+					MetadataOnly:   schemaOnly || isMetadataOnlyTable(disksToPartsMap, metadataDetachedParts),
+					DetachedParts:  metadataDetachedParts,
+					Partitions:     tablePartitionsList(partitionsToBackupMap, doBackupData),
+					Rows:           rows,
+					ObjectDisks:    objectDisks,
+					DataSkipReason: dataSkipReason,
+					ObjectDiskKeys: objectDiskKeys,
+					FreezeName:     freezeName,
+					Stats:          tableStatsMetadata,
+				})
+				if err != nil {
+					log.Error(err.Error())
+				}
+				return err
+			})
+			if err != nil {
+				if err = timeouts.checkTableError(log, err); err != nil {
+					cancelTables()
 				}
 				return err
 			}
-			// more precise data size calculation
-			for _, size := range realSize {
-				backupDataSize += uint64(size)
+			atomic.AddUint64(&backupDataSize, dataSize)
+			atomic.AddUint64(&backupMetadataSize, metadataSize)
+			createdTables[idx] = &metadata.TableTitle{
+				Database: table.Database,
+				Table:    table.Name,
 			}
-		}
-		log.Debug("create metadata")
-		metadataSize, err := createMetadata(ch, backupPath, metadata.TableMetadata{
-			Table:        table.Name,
-			Database:     table.Database,
-			Query:        table.CreateTableQuery,
-			TotalBytes:   table.TotalBytes,
-			Size:         realSize,
-			Parts:        disksToPartsMap,
-			MetadataOnly: schemaOnly,
+			if doBackupData {
+				createdTableStats[idx] = &stats
+			}
+			log.Infof("done")
+			return nil
 		})
-		if err != nil {
+	}
+	err = g.Wait()
+	if runErr := timeouts.runError(runCtx); runErr != nil {
+		err = runErr
+	}
+	if err != nil {
+		// table which is frozen after failure of other table shall be unfrozen too, each step of table checks ctx and clickhouse queries are bounded by timeout
+		runningTables.Wait()
+		cleanupFailedBackup(cfg, backupPath, log, func() error {
 			if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
 				log.Error(removeBackupErr.Error())
 			}
-			return err
-		}
-		backupMetadataSize += metadataSize
-		tableMetas = append(tableMetas, metadata.TableTitle{
-			Database: table.Database,
-			Table:    table.Name,
+			// tables which were frozen before failure of other table shall be unfrozen too
+			releaseFreezeNames(ch, freezeNames, log)
+			if doBackupData {
+				// fix corner cases after https://github.com/AlexAkulov/clickhouse-backup/issues/379
+				_, cleanShadowErr := cleanShadowUnlocked(disks, path.Join(defaultPath, "backup"), backupName)
+				return cleanShadowErr
+			}
+			return nil
 		})
-		log.Infof("done")
+		return err
+	}
+	var tableMetas []metadata.TableTitle
+	for _, tableTitle := range createdTables {
+		if tableTitle != nil {
+			tableMetas = append(tableMetas, *tableTitle)
+		}
+	}
+	var backupTableStats []metadata.TableStats
+	for _, stats := range createdTableStats {
+		if stats != nil {
+			backupTableStats = append(backupTableStats, *stats)
+		}
 	}
 	backupRBACSize, backupConfigSize := uint64(0), uint64(0)
+	var rbacObjects []metadata.RBACObject
 
-	if rbacOnly {
-		if backupRBACSize, err = createRBACBackup(ch, backupPath, disks); err != nil {
+	if rbacOnly && cfg.General.RBACBackupMode == "sql" {
+		if rbacObjects, err = ch.GetRBACObjects(); err != nil {
+			log.Errorf("error during do RBAC backup: %v", err)
+		} else {
+			log.WithField("objects", len(rbacObjects)).Info("done RBAC backup into metadata.json")
+		}
+	} else if rbacOnly {
+		if backupRBACSize, err = createRBACBackup(ch, backupPath, disks, log); err != nil {
 			log.Errorf("error during do RBAC backup: %v", err)
 		} else {
 			log.WithField("size", utils.FormatBytes(backupRBACSize)).Info("done createRBACBackup")
 		}
 	}
 	if configsOnly {
-		if backupConfigSize, err = createConfigBackup(cfg, backupPath); err != nil {
+		if backupConfigSize, err = createConfigBackup(cfg, backupPath, log); err != nil {
 			log.Errorf("error during do CONFIG backup: %v", err)
 		} else {
 			log.WithField("size", utils.FormatBytes(backupConfigSize)).Info("done createConfigBackup")
@@ -220,44 +454,72 @@ func CreateBackup(cfg *config.Config, backupName, tablePattern string, partition
 		ClickhouseBackupVersion: version,
 		CreationDate:            time.Now().UTC(),
 		// Tags: ,
-		ClickHouseVersion: ch.GetVersionDescribe(),
-		DataSize:          backupDataSize,
-		MetadataSize:      backupMetadataSize,
-		RBACSize:          backupRBACSize,
-		ConfigSize:        backupConfigSize,
+		DataSize:     backupDataSize,
+		MetadataSize: backupMetadataSize,
+		RBACSize:     backupRBACSize,
+		ConfigSize:   backupConfigSize,
 		// CompressedSize: ,
-		Tables:    tableMetas,
-		Databases: []metadata.DatabasesMeta{},
+		Tables:      tableMetas,
+		Databases:   []metadata.DatabasesMeta{},
+		SchemaOnly:  schemaOnly,
+		TableStats:  backupTableStats,
+		RBACObjects: rbacObjects,
+	}
+	if len(unchangedTables) > 0 {
+		backupMetadata.RequiredBackup = changedSince
 	}
+	fillServerInfo(ch, &backupMetadata)
 	for _, database := range allDatabases {
 		backupMetadata.Databases = append(backupMetadata.Databases, metadata.DatabasesMeta(database))
 	}
 	content, err := json.MarshalIndent(&backupMetadata, "", "\t")
 	if err != nil {
-		_ = RemoveBackupLocal(cfg, backupName)
+		cleanupFailedBackup(cfg, backupPath, log, func() error { return RemoveBackupLocal(cfg, backupName) })
 		return fmt.Errorf("can't marshal backup metafile json: %v", err)
 	}
 	backupMetaFile := path.Join(defaultPath, "backup", backupName, "metadata.json")
-	if err := ioutil.WriteFile(backupMetaFile, content, 0640); err != nil {
-		_ = RemoveBackupLocal(cfg, backupName)
+	if err := utils.WriteFileAtomic(backupMetaFile, content, 0640); err != nil {
+		cleanupFailedBackup(cfg, backupPath, log, func() error { return RemoveBackupLocal(cfg, backupName) })
 		return err
 	}
 	if err := filesystemhelper.Chown(backupMetaFile, ch); err != nil {
 		log.Warnf("can't chown %s: %v", backupMetaFile, err)
 	}
-	log.WithField("duration", utils.HumanizeDuration(time.Since(startBackup))).Info("done")
+	if estimate != nil {
+		log.WithFields(apexLog.Fields{
+			"size":           utils.FormatBytes(backupDataSize),
+			"estimated_size": utils.FormatBytes(estimate.Size),
+		}).Info("backup data size")
+	}
+	if doBackupData && cfg.General.EstimateCompressibility {
+		logCompressibility(disks, backupName, cfg.GetCompressionFormat(), log)
+	}
+	log.WithFields(tableStatsFields(backupTableStats, createDuration, uncompressedSize)).
+		WithField("duration", utils.HumanizeDuration(time.Since(startBackup))).
+		Info("done")
 
 	// Clean
 	if err := RemoveOldBackupsLocal(cfg, true); err != nil {
 		return err
 	}
-	return nil
+	return freeLocalSpace(cfg, disks, path.Join(defaultPath, "backup"), backupName, 0)
 }
 
-func createConfigBackup(cfg *config.Config, backupPath string) (uint64, error) {
+// cleanupFailedBackup - run cleanup of failed backup, when keep_failed_backups is enabled cleanup is skipped and path of kept backup is logged
+func cleanupFailedBackup(cfg *config.Config, backupPath string, log *apexLog.Entry, cleanup func() error) {
+	if cfg.General.KeepFailedBackups {
+		log.Warnf("keep_failed_backups is enabled, failed backup is kept in %s", backupPath)
+		return
+	}
+	if err := cleanup(); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func createConfigBackup(cfg *config.Config, backupPath string, log *apexLog.Entry) (uint64, error) {
 	backupConfigSize := uint64(0)
 	configBackupPath := path.Join(backupPath, "configs")
-	apexLog.Debugf("copy %s -> %s", cfg.ClickHouse.ConfigDir, configBackupPath)
+	log.Debugf("copy %s -> %s", cfg.ClickHouse.ConfigDir, configBackupPath)
 	copyErr := copy.Copy(cfg.ClickHouse.ConfigDir, configBackupPath, copy.Options{
 		Skip: func(src string) (bool, error) {
 			if fileInfo, err := os.Stat(src); err == nil {
@@ -269,14 +531,14 @@ func createConfigBackup(cfg *config.Config, backupPath string) (uint64, error) {
 	return backupConfigSize, copyErr
 }
 
-func createRBACBackup(ch *clickhouse.ClickHouse, backupPath string, disks []clickhouse.Disk) (uint64, error) {
+func createRBACBackup(ch *clickhouse.ClickHouse, backupPath string, disks []clickhouse.Disk, log *apexLog.Entry) (uint64, error) {
 	rbacDataSize := uint64(0)
 	rbacBackup := path.Join(backupPath, "access")
 	accessPath, err := ch.GetAccessManagementPath(disks)
 	if err != nil {
 		return 0, err
 	}
-	apexLog.Debugf("copy %s -> %s", accessPath, rbacBackup)
+	log.Debugf("copy %s -> %s", accessPath, rbacBackup)
 	copyErr := copy.Copy(accessPath, rbacBackup, copy.Options{
 		Skip: func(src string) (bool, error) {
 			if fileInfo, err := os.Stat(src); err == nil {
@@ -288,34 +550,63 @@ func createRBACBackup(ch *clickhouse.ClickHouse, backupPath string, disks []clic
 	return rbacDataSize, copyErr
 }
 
-func AddTableToBackup(ch *clickhouse.ClickHouse, backupName, shadowBackupUUID string, diskList []clickhouse.Disk, table *clickhouse.Table, partitionsToBackupMap common.EmptyMap) (map[string][]metadata.Part, map[string]int64, error) {
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "create",
-		"table":     fmt.Sprintf("%s.%s", table.Database, table.Name),
-	})
+// tablePartitionsList - sorted partition IDs which are saved to table metadata when table data is backed up only for these partitions
+func tablePartitionsList(partitionsToBackupMap common.EmptyMap, doBackupData bool) []string {
+	if !doBackupData || len(partitionsToBackupMap) == 0 {
+		return nil
+	}
+	partitions := make([]string, 0, len(partitionsToBackupMap))
+	for partition := range partitionsToBackupMap {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+	return partitions
+}
+
+// AddTableToBackup - freeze table and move its shadow into backup, stop before FREEZE and before each disk when ctx is done,
+// so remaining tables of concurrent create aren't processed after failure of one table,
+// FREEZE is bounded by freezeLimit and moving of shadow by copyLimit independently, nil limit doesn't bound
+func AddTableToBackup(ctx context.Context, ch *clickhouse.ClickHouse, backupName, shadowBackupUUID string, diskList []clickhouse.Disk, table *clickhouse.Table, partitionsToBackupMap common.EmptyMap, stats *metadata.TableStats, log *apexLog.Entry, freezeLimit, copyLimit *semaphore.Weighted) (map[string][]metadata.Part, map[string]int64, error) {
 	if backupName == "" {
 		return nil, nil, fmt.Errorf("backupName is not defined")
 	}
 
 	// backup data
-	if !strings.HasSuffix(table.Engine, "MergeTree") && table.Engine != "MaterializedMySQL" && table.Engine != "MaterializedPostreSQL" {
+	if !isDataBackupEngine(table.Engine) {
 		log.WithField("engine", table.Engine).Debug("skip table backup")
 		return nil, nil, nil
 	}
-	if err := ch.FreezeTable(table, shadowBackupUUID); err != nil {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := acquireLimit(ctx, freezeLimit); err != nil {
+		return nil, nil, err
+	}
+	startFreeze := time.Now()
+	err := ch.FreezeTable(table, shadowBackupUUID, partitionsToBackupMap)
+	releaseLimit(freezeLimit)
+	if err != nil {
 		return nil, nil, err
 	}
+	stats.FreezeMs = time.Since(startFreeze).Milliseconds()
 	log.Debug("freezed")
-	realSize := map[string]int64{}
-	disksToPartsMap := map[string][]metadata.Part{}
+	if err := acquireLimit(ctx, copyLimit); err != nil {
+		return nil, nil, err
+	}
+	defer releaseLimit(copyLimit)
+	startCopy := time.Now()
+	defer func() { stats.CopyMs = time.Since(startCopy).Milliseconds() }()
+	disksToPartsMap, realSize := emptyTableParts(diskList, table)
 	for _, disk := range diskList {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
 		shadowPath := path.Join(disk.Path, "shadow", shadowBackupUUID)
 		if _, err := os.Stat(shadowPath); err != nil && os.IsNotExist(err) {
 			continue
 		}
 		backupPath := path.Join(disk.Path, "backup", backupName)
-		encodedTablePath := path.Join(common.TablePathEncode(table.Database), common.TablePathEncode(table.Name))
+		encodedTablePath := common.TablePath(table.Database, table.Name)
 		backupShadowPath := path.Join(backupPath, "shadow", encodedTablePath, disk.Name)
 		if err := filesystemhelper.MkdirAll(backupShadowPath, ch); err != nil && !os.IsExist(err) {
 			return nil, nil, err
@@ -338,22 +629,80 @@ func AddTableToBackup(ch *clickhouse.ClickHouse, backupName, shadowBackupUUID st
 	return disksToPartsMap, realSize, nil
 }
 
+// acquireLimit - acquire one slot of limit, nil limit is not bounded
+func acquireLimit(ctx context.Context, limit *semaphore.Weighted) error {
+	if limit == nil {
+		return nil
+	}
+	return limit.Acquire(ctx, 1)
+}
+
+func releaseLimit(limit *semaphore.Weighted) {
+	if limit != nil {
+		limit.Release(1)
+	}
+}
+
+// addTableDetachedToBackup - hardlink parts from `detached` folder of table on each disk into `detached` folder of backup,
+// return detached parts and their size only for disks which have detached parts
+func addTableDetachedToBackup(backupName string, diskList []clickhouse.Disk, table *clickhouse.Table) (map[string][]metadata.Part, map[string]int64, error) {
+	detachedParts := map[string][]metadata.Part{}
+	detachedSize := map[string]int64{}
+	diskPaths := map[string]string{}
+	for _, disk := range diskList {
+		diskPaths[disk.Name] = disk.Path
+	}
+	for disk, dataPath := range clickhouse.GetDisksByPaths(diskList, table.DataPaths) {
+		if disk == "unknown" {
+			continue
+		}
+		backupDetachedPath := path.Join(diskPaths[disk], "backup", backupName, "detached", common.TablePath(table.Database, table.Name), disk)
+		parts, size, err := filesystemhelper.LinkDetached(path.Join(dataPath, "detached"), backupDetachedPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't backup detached parts of '%s.%s': %v", table.Database, table.Name, err)
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		detachedParts[disk] = parts
+		detachedSize[disk] = size
+	}
+	if len(detachedParts) == 0 {
+		return nil, nil, nil
+	}
+	return detachedParts, detachedSize, nil
+}
+
+// emptyTableParts - empty parts list and zero size for each disk which contains table data,
+// FREEZE doesn't create shadow for table without parts, but its disks shall be kept in metadata
+func emptyTableParts(diskList []clickhouse.Disk, table *clickhouse.Table) (map[string][]metadata.Part, map[string]int64) {
+	disksToPartsMap := map[string][]metadata.Part{}
+	realSize := map[string]int64{}
+	for disk := range clickhouse.GetDisksByPaths(diskList, table.DataPaths) {
+		if disk == "unknown" {
+			continue
+		}
+		disksToPartsMap[disk] = []metadata.Part{}
+		realSize[disk] = 0
+	}
+	return disksToPartsMap, realSize
+}
+
 //
 func createMetadata(ch *clickhouse.ClickHouse, backupPath string, table metadata.TableMetadata) (uint64, error) {
 	metadataPath := path.Join(backupPath, "metadata")
 	if err := filesystemhelper.Mkdir(metadataPath, ch); err != nil {
 		return 0, err
 	}
-	metadataDatabasePath := path.Join(metadataPath, common.TablePathEncode(table.Database))
-	if err := filesystemhelper.Mkdir(metadataDatabasePath, ch); err != nil {
+	metadataFile := path.Join(metadataPath, common.TableMetadataPath(table.Database, table.Table))
+	if err := filesystemhelper.Mkdir(path.Dir(metadataFile), ch); err != nil {
 		return 0, err
 	}
-	metadataFile := path.Join(metadataDatabasePath, fmt.Sprintf("%s.json", common.TablePathEncode(table.Table)))
 	metadataBody, err := json.MarshalIndent(&table, "", " ")
 	if err != nil {
 		return 0, fmt.Errorf("can't marshal %s: %v", MetaFileName, err)
 	}
-	if err := ioutil.WriteFile(metadataFile, metadataBody, 0644); err != nil {
+	if err := utils.WriteFileAtomic(metadataFile, metadataBody, 0644); err != nil {
 		return 0, fmt.Errorf("can't create %s: %v", MetaFileName, err)
 	}
 	if err := filesystemhelper.Chown(metadataFile, ch); err != nil {
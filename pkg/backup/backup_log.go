@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// ToolVersion - version of clickhouse-backup which is written into backup_log_table, it is set on startup
+var ToolVersion = "unknown"
+
+// backupLogWriter - part of clickhouse.ClickHouse which writes backup_log_table
+type backupLogWriter interface {
+	CreateBackupLogTable(table string) error
+	InsertBackupLog(table string, row clickhouse.BackupLogRow) error
+}
+
+// logBackupOperation - write finished create, upload, download, restore or delete into backup_log_table,
+// sizes are taken from local backup metadata when it exists, failures are logged and don't fail the operation
+func logBackupOperation(cfg *config.Config, operation, backupName string, start time.Time, operationErr error) {
+	if cfg.General.BackupLogTable == "" {
+		return
+	}
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": operation,
+	})
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		log.Warnf("can't write %s: can't connect to clickhouse: %v", cfg.General.BackupLogTable, err)
+		return
+	}
+	defer ch.Close()
+	row := newBackupLogRow(operation, backupName, start, time.Now(), operationErr)
+	if defaultDataPath, err := ch.GetDefaultPath(); err == nil && backupName != "" {
+		row.DataSize, row.MetadataSize = localBackupSizes(path.Join(defaultDataPath, "backup", backupName))
+	}
+	writeBackupLog(ch, cfg.General.BackupLogTable, row, log)
+}
+
+func newBackupLogRow(operation, backupName string, start, finish time.Time, operationErr error) clickhouse.BackupLogRow {
+	row := clickhouse.BackupLogRow{
+		Start:      start,
+		Finish:     finish,
+		DurationMs: uint64(finish.Sub(start).Milliseconds()),
+		Operation:  operation,
+		BackupName: backupName,
+		Status:     "success",
+		Version:    ToolVersion,
+	}
+	if operationErr != nil {
+		row.Status = "error"
+		row.Error = operationErr.Error()
+	}
+	row.Host, _ = os.Hostname()
+	return row
+}
+
+// localBackupSizes - data and metadata sizes from metadata.json of local backup, zero when backup is absent
+func localBackupSizes(backupPath string) (uint64, uint64) {
+	body, err := ioutil.ReadFile(path.Join(backupPath, "metadata.json"))
+	if err != nil {
+		return 0, 0
+	}
+	var backupMetadata metadata.BackupMetadata
+	if err := json.Unmarshal(body, &backupMetadata); err != nil {
+		return 0, 0
+	}
+	return backupMetadata.DataSize, backupMetadata.MetadataSize
+}
+
+func writeBackupLog(ch backupLogWriter, table string, row clickhouse.BackupLogRow, log *apexLog.Entry) {
+	if err := ch.CreateBackupLogTable(table); err != nil {
+		log.Warnf("can't create %s: %v", table, err)
+		return
+	}
+	if err := ch.InsertBackupLog(table, row); err != nil {
+		log.Warnf("can't write %s: %v", table, err)
+	}
+}
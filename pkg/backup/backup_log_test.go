@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackupLog - records inserted rows, createErr and insertErr fail corresponding queries
+type fakeBackupLog struct {
+	createErr error
+	insertErr error
+	rows      []clickhouse.BackupLogRow
+}
+
+func (f *fakeBackupLog) CreateBackupLogTable(table string) error {
+	return f.createErr
+}
+
+func (f *fakeBackupLog) InsertBackupLog(table string, row clickhouse.BackupLogRow) error {
+	if f.insertErr != nil {
+		return f.insertErr
+	}
+	f.rows = append(f.rows, row)
+	return nil
+}
+
+func TestBackupLog(t *testing.T) {
+	start := time.Now().Add(-2 * time.Second)
+	row := newBackupLogRow("upload", "backup1", start, start.Add(1500*time.Millisecond), fmt.Errorf("can't upload"))
+	assert.Equal(t, "error", row.Status)
+	assert.Equal(t, "can't upload", row.Error)
+	assert.Equal(t, uint64(1500), row.DurationMs)
+	assert.Equal(t, ToolVersion, row.Version)
+	assert.NotEmpty(t, row.Host)
+	assert.Equal(t, "success", newBackupLogRow("create", "backup1", start, start, nil).Status)
+
+	backupPath := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(backupPath, "metadata.json"), []byte(`{"backup_name":"backup1","data_size":100,"metadata_size":10}`), 0644))
+	dataSize, metadataSize := localBackupSizes(backupPath)
+	assert.Equal(t, uint64(100), dataSize)
+	assert.Equal(t, uint64(10), metadataSize)
+	dataSize, metadataSize = localBackupSizes(path.Join(backupPath, "absent"))
+	assert.Zero(t, dataSize+metadataSize)
+
+	out := &bytes.Buffer{}
+	log := (&apexLog.Logger{Handler: text.New(out), Level: apexLog.InfoLevel}).WithField("test", t.Name())
+	ch := &fakeBackupLog{}
+	writeBackupLog(ch, "default.backup_log", row, log)
+	assert.Equal(t, []clickhouse.BackupLogRow{row}, ch.rows)
+	assert.Empty(t, out.String())
+
+	writeBackupLog(&fakeBackupLog{createErr: fmt.Errorf("code: 497, message: Not enough privileges")}, "default.backup_log", row, log)
+	assert.Contains(t, out.String(), "can't create default.backup_log: code: 497")
+	writeBackupLog(&fakeBackupLog{insertErr: fmt.Errorf("code: 60, message: Table doesn't exist")}, "default.backup_log", row, log)
+	assert.Contains(t, out.String(), "can't write default.backup_log: code: 60")
+}
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+)
+
+// editableMetadataFields - fields of metadata.json which could be changed by `metadata --set`
+var editableMetadataFields = []string{"required_backup", "tags"}
+
+// PrintBackupMetadata - print metadata.json of local or remote backup, fields passed as `name=value` are validated and saved before print,
+// changes which could make backup unusable are allowed only when force is true
+func PrintBackupMetadata(cfg *config.Config, backupName string, remote bool, fields []string, force bool) error {
+	if backupName == "" {
+		return fmt.Errorf("backup name is required")
+	}
+	if remote {
+		return printBackupMetadataRemote(cfg, backupName, fields, force)
+	}
+	return printBackupMetadataLocal(cfg, backupName, fields, force)
+}
+
+func printBackupMetadataLocal(cfg *config.Config, backupName string, fields []string, force bool) error {
+	backupList, err := GetLocalBackups(cfg)
+	if err != nil {
+		return err
+	}
+	backupNames := make([]string, 0, len(backupList))
+	var backup *BackupLocal
+	for i := range backupList {
+		backupNames = append(backupNames, backupList[i].BackupName)
+		if backupList[i].BackupName == backupName {
+			backup = &backupList[i]
+		}
+	}
+	if backup == nil {
+		return fmt.Errorf("'%s' is not found on local storage: %w", backupName, ErrBackupNotFound)
+	}
+	if backup.Legacy {
+		return fmt.Errorf("'%s' is legacy backup, it doesn't have metadata.json", backupName)
+	}
+	if backup.Broken != "" {
+		return fmt.Errorf("'%s' is %s", backupName, backup.Broken)
+	}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
+	}
+	defer ch.Close()
+	defaultPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		unlock, err := lockBackup(path.Join(defaultPath, "backup"), backupName)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return showBackupMetadata(os.Stdout, &backup.BackupMetadata, fields, backupNames, force, func(backupMetadata metadata.BackupMetadata) error {
+		return backupMetadata.Save(path.Join(defaultPath, "backup", backupName, "metadata.json"))
+	})
+}
+
+func printBackupMetadataRemote(cfg *config.Config, backupName string, fields []string, force bool) error {
+	if cfg.General.RemoteStorage == "none" {
+		return fmt.Errorf("remote storage is 'none'")
+	}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	if err != nil {
+		return err
+	}
+	if err := bd.Connect(); err != nil {
+		return fmt.Errorf("can't connect to remote storage: %w", err)
+	}
+	backupList, err := bd.BackupList(true, backupName)
+	if err != nil {
+		return err
+	}
+	backupNames := make([]string, 0, len(backupList))
+	var backup *new_storage.Backup
+	for i := range backupList {
+		backupNames = append(backupNames, backupList[i].BackupName)
+		if backupList[i].BackupName == backupName {
+			backup = &backupList[i]
+		}
+	}
+	if backup == nil {
+		return fmt.Errorf("'%s' is not found on remote storage: %w", backupName, new_storage.ErrNotFound)
+	}
+	if backup.Legacy {
+		return fmt.Errorf("'%s' is legacy backup, it doesn't have metadata.json", backupName)
+	}
+	if backup.Broken != "" {
+		return fmt.Errorf("'%s' is %s", backupName, backup.Broken)
+	}
+	return showBackupMetadata(os.Stdout, &backup.BackupMetadata, fields, backupNames, force, bd.PutBackupMetadata)
+}
+
+// showBackupMetadata - apply fields to backup metadata and save it when fields are passed, then print metadata.json in readable form
+func showBackupMetadata(w io.Writer, backupMetadata *metadata.BackupMetadata, fields []string, backupNames []string, force bool, save func(metadata.BackupMetadata) error) error {
+	if len(fields) > 0 {
+		if err := setBackupMetadataFields(backupMetadata, fields, backupNames, force); err != nil {
+			return err
+		}
+		if err := save(*backupMetadata); err != nil {
+			return fmt.Errorf("can't save metadata.json: %v", err)
+		}
+		apexLog.WithField("backup", backupMetadata.BackupName).Infof("metadata.json is changed: %s", strings.Join(fields, ", "))
+	}
+	body, err := json.MarshalIndent(backupMetadata, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal metadata.json: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(body))
+	return err
+}
+
+// setBackupMetadataFields - change fields passed as `name=value`, backupNames are backups in the same location which could be required,
+// clearing required_backup and pointing it to absent backup require force
+func setBackupMetadataFields(backupMetadata *metadata.BackupMetadata, fields []string, backupNames []string, force bool) error {
+	for _, field := range fields {
+		nameValue := strings.SplitN(field, "=", 2)
+		if len(nameValue) != 2 {
+			return fmt.Errorf("'%s' shall be in name=value format", field)
+		}
+		name, value := strings.TrimSpace(nameValue[0]), strings.TrimSpace(nameValue[1])
+		switch name {
+		case "required_backup":
+			if value == backupMetadata.BackupName {
+				return fmt.Errorf("'%s' can't require itself", value)
+			}
+			if value == "" && backupMetadata.RequiredBackup != "" && !force {
+				return fmt.Errorf("clearing required_backup makes parts from '%s' unavailable for download, use --force", backupMetadata.RequiredBackup)
+			}
+			if value != "" && !force {
+				found := false
+				for _, backupName := range backupNames {
+					if backupName == value {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return fmt.Errorf("required backup '%s' is not found, use --force", value)
+				}
+			}
+			backupMetadata.RequiredBackup = value
+		case "tags":
+			backupMetadata.Tags = value
+		default:
+			return fmt.Errorf("'%s' field can't be changed, editable fields: %s", name, strings.Join(editableMetadataFields, ", "))
+		}
+	}
+	return nil
+}
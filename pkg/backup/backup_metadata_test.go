@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShowBackupMetadata(t *testing.T) {
+	backupMetadata := metadata.BackupMetadata{BackupName: "increment", RequiredBackup: "old_full", DataFormat: "tar"}
+	saves := 0
+	save := func(metadata.BackupMetadata) error {
+		saves++
+		return nil
+	}
+	out := &bytes.Buffer{}
+	assert.NoError(t, showBackupMetadata(out, &backupMetadata, nil, nil, false, save))
+	assert.Equal(t, 0, saves, "print shall not save metadata")
+	var printed metadata.BackupMetadata
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &printed))
+	assert.Equal(t, backupMetadata, printed)
+	assert.Contains(t, out.String(), "\t\"required_backup\": \"old_full\"\n")
+
+	// fix required backup after rename
+	out.Reset()
+	assert.NoError(t, showBackupMetadata(out, &backupMetadata, []string{"required_backup=new_full", "tags = type=manual"}, []string{"new_full", "increment"}, false, func(saved metadata.BackupMetadata) error {
+		assert.Equal(t, "new_full", saved.RequiredBackup)
+		return save(saved)
+	}))
+	assert.Equal(t, 1, saves)
+	assert.Equal(t, "new_full", backupMetadata.RequiredBackup)
+	assert.Equal(t, "type=manual", backupMetadata.Tags)
+	assert.Contains(t, out.String(), "\t\"required_backup\": \"new_full\"\n")
+
+	assert.EqualError(t, showBackupMetadata(out, &backupMetadata, []string{"tags=x"}, nil, false, func(metadata.BackupMetadata) error {
+		return errors.New("read-only")
+	}), "can't save metadata.json: read-only")
+}
+
+func TestSetBackupMetadataFields(t *testing.T) {
+	backupNames := []string{"full", "increment"}
+	for _, tc := range []struct {
+		field    string
+		force    bool
+		expected string
+		err      string
+	}{
+		{field: "required_backup=full", expected: "full"},
+		{field: "required_backup=absent", err: "required backup 'absent' is not found, use --force"},
+		{field: "required_backup=absent", force: true, expected: "absent"},
+		{field: "required_backup=", err: "clearing required_backup makes parts from 'old_full' unavailable for download, use --force"},
+		{field: "required_backup=", force: true, expected: ""},
+		{field: "required_backup=increment", force: true, err: "'increment' can't require itself"},
+		{field: "data_format=none", force: true, err: "'data_format' field can't be changed, editable fields: required_backup, tags"},
+		{field: "required_backup", err: "'required_backup' shall be in name=value format"},
+	} {
+		backupMetadata := metadata.BackupMetadata{BackupName: "increment", RequiredBackup: "old_full"}
+		err := setBackupMetadataFields(&backupMetadata, []string{tc.field}, backupNames, tc.force)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			assert.Equal(t, "old_full", backupMetadata.RequiredBackup, "metadata shall not be changed on error")
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, backupMetadata.RequiredBackup, tc.field)
+	}
+}
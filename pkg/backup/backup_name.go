@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+)
+
+// backupNameTokenRE - `{token}` or `{token:layout}` in general.backup_name_template
+var backupNameTokenRE = regexp.MustCompile(`{(\w+)(?::([^{}]*))?}`)
+
+// ResolveBackupName - return name for backup which is created without explicit name, general.backup_name_template is expanded when it is defined,
+// numeric suffix is added when expanded name is already used by local backup or by remote backup when checkRemote is true
+func ResolveBackupName(cfg *config.Config, checkRemote bool) (string, error) {
+	template := cfg.General.BackupNameTemplate
+	if template == "" {
+		return NewBackupName(), nil
+	}
+	values := map[string]string{}
+	if strings.Contains(template, "{cluster") || strings.Contains(template, "{shard") {
+		ch := &clickhouse.ClickHouse{
+			Config: &cfg.ClickHouse,
+		}
+		if err := ch.Connect(); err != nil {
+			return "", fmt.Errorf("can't connect to clickhouse: %w", err)
+		}
+		macros, err := ch.GetMacros()
+		ch.Close()
+		if err != nil {
+			return "", fmt.Errorf("can't get system.macros: %v", err)
+		}
+		for _, macro := range []string{"cluster", "shard"} {
+			if value, ok := macros[macro]; ok {
+				values[macro] = value
+			}
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		values["hostname"] = hostname
+	}
+	backupName, err := expandBackupNameTemplate(template, values, time.Now())
+	if err != nil {
+		return "", err
+	}
+	usedNames := map[string]bool{}
+	localBackups, err := GetLocalBackups(cfg)
+	if err != nil {
+		return "", err
+	}
+	for _, localBackup := range localBackups {
+		usedNames[localBackup.BackupName] = true
+	}
+	if checkRemote && cfg.General.RemoteStorage != "none" {
+		bd, err := new_storage.NewBackupDestination(cfg)
+		if err != nil {
+			return "", err
+		}
+		if err := bd.Connect(); err != nil {
+			return "", fmt.Errorf("can't connect to remote storage: %w", err)
+		}
+		remoteBackups, err := bd.BackupList(false, "")
+		if err != nil {
+			return "", err
+		}
+		for _, remoteBackup := range remoteBackups {
+			usedNames[remoteBackup.BackupName] = true
+		}
+	}
+	return uniqueBackupName(backupName, usedNames), nil
+}
+
+// expandBackupNameTemplate - replace `{cluster}`, `{shard}`, `{hostname}` by values and `{timestamp}` or `{timestamp:<layout>}` by now in UTC formatted by Go time layout
+func expandBackupNameTemplate(template string, values map[string]string, now time.Time) (string, error) {
+	var expandErr error
+	backupName := backupNameTokenRE.ReplaceAllStringFunc(template, func(token string) string {
+		match := backupNameTokenRE.FindStringSubmatch(token)
+		name, layout := match[1], match[2]
+		if name == "timestamp" {
+			if layout == "" {
+				layout = TimeFormatForBackup
+			}
+			return now.UTC().Format(layout)
+		}
+		if layout != "" {
+			expandErr = fmt.Errorf("backup_name_template token %s doesn't support format", token)
+			return token
+		}
+		value, ok := values[name]
+		switch {
+		case name != "cluster" && name != "shard" && name != "hostname":
+			expandErr = fmt.Errorf("unknown backup_name_template token %s, use one of {cluster}, {shard}, {hostname}, {timestamp}, {timestamp:<layout>}", token)
+		case (!ok || value == "") && name == "hostname":
+			expandErr = fmt.Errorf("can't expand backup_name_template token %s, hostname is unknown", token)
+		case !ok || value == "":
+			expandErr = fmt.Errorf("can't expand backup_name_template token %s, '%s' is not defined in system.macros", token, name)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	if backupName == "" || backupName == "." || backupName == ".." || strings.ContainsAny(backupName, "/\\{}") {
+		return "", fmt.Errorf("backup_name_template '%s' expanded to invalid backup name '%s'", template, backupName)
+	}
+	return backupName, nil
+}
+
+// uniqueBackupName - add `-2`, `-3`... suffix to backupName while it is used
+func uniqueBackupName(backupName string, usedNames map[string]bool) string {
+	if !usedNames[backupName] {
+		return backupName
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", backupName, i)
+		if !usedNames[candidate] {
+			return candidate
+		}
+	}
+}
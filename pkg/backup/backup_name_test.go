@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandBackupNameTemplate(t *testing.T) {
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.FixedZone("MSK", 3*3600))
+	values := map[string]string{"cluster": "prod", "shard": "02", "hostname": "ch-1"}
+	for template, expected := range map[string]string{
+		"{cluster}-{shard}-{timestamp:20060102-150405}": "prod-02-20220304-020607",
+		"{hostname}_{timestamp}":                        "ch-1_2022-03-04T02-06-07",
+		"daily-{timestamp:2006-01-02}":                  "daily-2022-03-04",
+		"static":                                        "static",
+	} {
+		backupName, err := expandBackupNameTemplate(template, values, now)
+		assert.NoError(t, err, template)
+		assert.Equal(t, expected, backupName, template)
+	}
+	for template, expectedErr := range map[string]string{
+		"{cluster}-{replica}":         "unknown backup_name_template token {replica}, use one of {cluster}, {shard}, {hostname}, {timestamp}, {timestamp:<layout>}",
+		"{shard}-{timestamp}":         "can't expand backup_name_template token {shard}, 'shard' is not defined in system.macros",
+		"{hostname:upper}":            "backup_name_template token {hostname:upper} doesn't support format",
+		"{timestamp:2006/01/02}":      "backup_name_template '{timestamp:2006/01/02}' expanded to invalid backup name '2022/03/04'",
+		"{cluster}-{timestamp:2006}}": "backup_name_template '{cluster}-{timestamp:2006}}' expanded to invalid backup name 'prod-2022}'",
+	} {
+		_, err := expandBackupNameTemplate(template, map[string]string{"cluster": "prod", "hostname": "ch-1"}, now)
+		assert.EqualError(t, err, expectedErr, template)
+	}
+}
+
+func TestUniqueBackupName(t *testing.T) {
+	assert.Equal(t, "prod-02-20220304", uniqueBackupName("prod-02-20220304", map[string]bool{"prod-02-20220303": true}))
+	assert.Equal(t, "prod-02-20220304-2", uniqueBackupName("prod-02-20220304", map[string]bool{"prod-02-20220304": true}))
+	assert.Equal(t, "prod-02-20220304-3", uniqueBackupName("prod-02-20220304", map[string]bool{"prod-02-20220304": true, "prod-02-20220304-2": true}))
+}
@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClickHouse - ClickHouse HTTP interface with MergeTree tables on one local disk, FREEZE creates shadow with one part of table and lasts freezeDelay,
+// FREEZE of failTable fails immediately, parallel FREEZE queries are counted
+type fakeClickHouse struct {
+	sync.Mutex
+	diskPath    string
+	tables      []string
+	failTable   string
+	freezeDelay time.Duration
+	queries     []string
+	started     []string
+	frozen      []string
+	unfrozen    []string
+	running     int
+	maxRunning  int
+}
+
+var freezeQueryRE = regexp.MustCompile("ALTER TABLE `default`.`(\\w+)` FREEZE WITH NAME '(\\w+)'")
+var showCreateQueryRE = regexp.MustCompile("SHOW CREATE TABLE `default`.`(\\w+)`")
+var unfreezeQueryRE = regexp.MustCompile("SYSTEM UNFREEZE WITH NAME '(\\w+)'")
+
+func (ch *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	query := string(body)
+	ch.Lock()
+	ch.queries = append(ch.queries, query)
+	ch.Unlock()
+	switch {
+	case strings.Contains(query, "VERSION_INTEGER"):
+		_, _ = w.Write([]byte(`{"meta":[{"name":"value","type":"String"}],"data":[["22003001"]]}`))
+	case strings.Contains(query, "VERSION_DESCRIBE"):
+		_, _ = w.Write([]byte(`{"meta":[{"name":"value","type":"String"}],"data":[["v22.3.1.1-lts"]]}`))
+	case strings.HasPrefix(query, "SELECT * FROM system.disks"):
+		_, _ = fmt.Fprintf(w, `{"meta":[{"name":"name","type":"String"},{"name":"path","type":"String"},{"name":"type","type":"String"}],"data":[["default","%s","local"]]}`, ch.diskPath)
+	case strings.Contains(query, "FROM system.tables WHERE is_temporary = 0"):
+		var rows []string
+		for _, table := range ch.tables {
+			rows = append(rows, fmt.Sprintf(`["default","%s","MergeTree"]`, table))
+		}
+		_, _ = fmt.Fprintf(w, `{"meta":[{"name":"database","type":"String"},{"name":"name","type":"String"},{"name":"engine","type":"String"}],"data":[%s]}`, strings.Join(rows, ","))
+	case showCreateQueryRE.MatchString(query):
+		table := showCreateQueryRE.FindStringSubmatch(query)[1]
+		_, _ = fmt.Fprintf(w, `{"meta":[{"name":"statement","type":"String"}],"data":[["CREATE TABLE default.%s (id UInt64) ENGINE = MergeTree ORDER BY id"]]}`, table)
+	case freezeQueryRE.MatchString(query):
+		match := freezeQueryRE.FindStringSubmatch(query)
+		ch.Lock()
+		ch.started = append(ch.started, match[1])
+		ch.running++
+		if ch.running > ch.maxRunning {
+			ch.maxRunning = ch.running
+		}
+		ch.Unlock()
+		if match[1] == ch.failTable {
+			ch.Lock()
+			ch.running--
+			ch.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Code: 999. DB::Exception: FREEZE failed"))
+			return
+		}
+		time.Sleep(ch.freezeDelay)
+		ch.Lock()
+		ch.running--
+		ch.Unlock()
+		partPath := path.Join(ch.diskPath, "shadow", match[2], "data", "default", match[1], "all_1_1_0")
+		_ = os.MkdirAll(partPath, 0750)
+		_ = ioutil.WriteFile(path.Join(partPath, "checksums.txt"), []byte(match[1]), 0640)
+		ch.Lock()
+		ch.frozen = append(ch.frozen, match[2])
+		ch.Unlock()
+	case unfreezeQueryRE.MatchString(query):
+		ch.Lock()
+		ch.unfrozen = append(ch.unfrozen, unfreezeQueryRE.FindStringSubmatch(query)[1])
+		ch.Unlock()
+	default:
+		_, _ = w.Write([]byte(`{"meta":[],"data":[]}`))
+	}
+}
+
+// fakeClickHouseConfig - config with clickhouse served by ch through HTTP interface
+func fakeClickHouseConfig(t *testing.T, ch *fakeClickHouse) *config.Config {
+	server := httptest.NewServer(ch)
+	t.Cleanup(server.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	portNumber, _ := strconv.Atoi(port)
+	cfg := config.DefaultConfig()
+	cfg.ClickHouse.Host = host
+	cfg.ClickHouse.Port = uint(portNumber)
+	cfg.ClickHouse.Protocol = "http"
+	cfg.ClickHouse.Timeout = "5s"
+	cfg.General.RemoteStorage = "none"
+	return cfg
+}
+
+func TestCreateBackupConcurrency(t *testing.T) {
+	ch := &fakeClickHouse{diskPath: t.TempDir(), tables: []string{"t0", "t1", "t2", "t3", "t4", "t5"}, freezeDelay: 50 * time.Millisecond}
+	cfg := fakeClickHouseConfig(t, ch)
+	cfg.General.CreateConcurrency = 1
+	cfg.ClickHouse.FreezeConcurrency = 3
+	assert.NoError(t, CreateBackup(cfg, "parallel_freeze", "", nil, false, false, false, false, "", "test", ""))
+	assert.Equal(t, 3, ch.maxRunning, "FREEZE is bounded by freeze_concurrency, not by create_concurrency")
+	for _, table := range ch.tables {
+		_, err := os.Stat(path.Join(ch.diskPath, "backup", "parallel_freeze", "shadow", "default", table, "default", "all_1_1_0", "checksums.txt"))
+		assert.NoError(t, err, "shadow of %s shall be moved into backup", table)
+	}
+
+	ch = &fakeClickHouse{diskPath: t.TempDir(), tables: []string{"t0", "t1", "t2", "t3"}, freezeDelay: 50 * time.Millisecond}
+	cfg = fakeClickHouseConfig(t, ch)
+	cfg.General.CreateConcurrency = 3
+	cfg.ClickHouse.FreezeConcurrency = 1
+	assert.NoError(t, CreateBackup(cfg, "sequential_freeze", "", nil, false, false, false, false, "", "test", ""))
+	assert.Equal(t, 1, ch.maxRunning, "FREEZE is bounded by freeze_concurrency when create_concurrency is greater")
+}
+
+// TestCreateBackupFreezeFailure - all tables frozen before FREEZE failure are unfrozen and partially created backup is removed
+func TestCreateBackupFreezeFailure(t *testing.T) {
+	ch := &fakeClickHouse{diskPath: t.TempDir(), tables: []string{"t0", "t1", "t2", "t3", "t4", "t5"}, failTable: "t1", freezeDelay: 50 * time.Millisecond}
+	cfg := fakeClickHouseConfig(t, ch)
+	cfg.General.CreateConcurrency = 1
+	cfg.ClickHouse.FreezeConcurrency = 3
+	err := CreateBackup(cfg, "failed_freeze", "", nil, false, false, false, false, "", "test", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "FREEZE failed")
+	assert.NotEmpty(t, ch.frozen, "tables are frozen concurrently with failed table")
+	assert.Subset(t, ch.unfrozen, ch.frozen)
+	assert.NoDirExists(t, path.Join(ch.diskPath, "backup", "failed_freeze"))
+	shadow, err := os.ReadDir(path.Join(ch.diskPath, "shadow"))
+	assert.NoError(t, err)
+	assert.Empty(t, shadow)
+}
+
+// TestCreateBackupTableFailure - after failure of one table of concurrent create queued tables are not started,
+// tables which are in progress are unfrozen and partially created backup is removed
+func TestCreateBackupTableFailure(t *testing.T) {
+	ch := &fakeClickHouse{diskPath: t.TempDir(), tables: []string{"t0", "t1", "t2", "t3", "t4", "t5"}, failTable: "t0", freezeDelay: 50 * time.Millisecond}
+	cfg := fakeClickHouseConfig(t, ch)
+	cfg.General.CreateConcurrency = 2
+	cfg.ClickHouse.FreezeConcurrency = 2
+	err := CreateBackup(cfg, "failed_table", "", nil, false, false, false, false, "", "test", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "FREEZE failed")
+	assert.ElementsMatch(t, []string{"t0", "t1"}, ch.started, "queued tables shall not be started after failure")
+	assert.Len(t, ch.frozen, 1)
+	assert.Subset(t, ch.unfrozen, ch.frozen)
+	assert.NoDirExists(t, path.Join(ch.diskPath, "backup", "failed_table"))
+	shadow, err := os.ReadDir(path.Join(ch.diskPath, "shadow"))
+	assert.NoError(t, err)
+	assert.Empty(t, shadow)
+}
+
+var registerMemoryBackend sync.Once
+
+// memoryBackend - storage of `remote_storage: memory_test`, backends can't be unregistered, so it is registered once and replaced by useMemoryBackend
+var memoryBackend *listingStorage
+
+// useMemoryBackend - set `remote_storage: memory_test` which keeps files in returned storage
+func useMemoryBackend(t *testing.T, cfg *config.Config) *listingStorage {
+	registerMemoryBackend.Do(func() {
+		new_storage.RegisterBackend("memory_test", func(cfg *config.Config) (new_storage.RemoteStorage, error) {
+			return memoryBackend, nil
+		})
+	})
+	// list of remote backups is cached in TMPDIR
+	t.Setenv("TMPDIR", t.TempDir())
+	memoryBackend = &listingStorage{memoryStorage: memoryStorage{files: map[string][]byte{}}}
+	cfg.General.RemoteStorage = "memory_test"
+	return memoryBackend
+}
+
+// TestSchemaOnlyBackup - `create --schema` writes tables without data, upload, download and restore of schema-only backup skip data without --schema
+func TestSchemaOnlyBackup(t *testing.T) {
+	ch := &fakeClickHouse{diskPath: t.TempDir(), tables: []string{"t0", "t1"}}
+	cfg := fakeClickHouseConfig(t, ch)
+	storage := useMemoryBackend(t, cfg)
+	backupPath := path.Join(ch.diskPath, "backup", "schema")
+	assert.NoError(t, CreateBackup(cfg, "schema", "", nil, true, false, false, false, "", "test", ""))
+	assert.Empty(t, ch.started, "tables are not frozen")
+	backupMetadata := metadata.BackupMetadata{}
+	assert.NoError(t, backupMetadata.Load(path.Join(backupPath, "metadata.json")))
+	assert.True(t, backupMetadata.SchemaOnly)
+	assert.Zero(t, backupMetadata.DataSize)
+	for _, table := range ch.tables {
+		tableMetadata := metadata.TableMetadata{}
+		_, err := tableMetadata.Load(path.Join(backupPath, "metadata", common.TableMetadataPath("default", table)))
+		assert.NoError(t, err)
+		assert.True(t, tableMetadata.MetadataOnly, table)
+	}
+
+	// part which is listed in table metadata of schema-only backup is not uploaded
+	writeDetachedPart(t, path.Join(backupPath, "shadow", common.TablePath("default", "t0"), "default", "all_1_1_0"), "data")
+	tableMetadataPath := path.Join(backupPath, "metadata", common.TableMetadataPath("default", "t0"))
+	tableMetadata := metadata.TableMetadata{}
+	_, err := tableMetadata.Load(tableMetadataPath)
+	assert.NoError(t, err)
+	tableMetadata.MetadataOnly = false
+	tableMetadata.Parts = map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}
+	_, err = tableMetadata.Save(tableMetadataPath, false)
+	assert.NoError(t, err)
+	assert.NoError(t, NewBackuper(cfg).Upload("schema", "", "", "", nil, false, false, false))
+	assert.Contains(t, storage.files, "schema/metadata.json")
+	assert.Contains(t, storage.files, "schema/metadata/"+common.TableMetadataPath("default", "t0"))
+	for _, key := range storage.puts {
+		assert.NotContains(t, key, "/shadow/", "data of schema-only backup shall not be uploaded")
+	}
+	remoteMetadata := metadata.BackupMetadata{}
+	assert.NoError(t, json.Unmarshal(storage.files["schema/metadata.json"], &remoteMetadata))
+	assert.True(t, remoteMetadata.SchemaOnly)
+
+	assert.NoError(t, RemoveBackupLocal(cfg, "schema"))
+	assert.NoError(t, NewBackuper(cfg).Download("schema", "", nil, false, false, ""))
+	downloadedMetadata := metadata.BackupMetadata{}
+	assert.NoError(t, downloadedMetadata.Load(path.Join(backupPath, "metadata.json")))
+	assert.True(t, downloadedMetadata.SchemaOnly)
+	assert.NoDirExists(t, path.Join(backupPath, "shadow"))
+
+	assert.EqualError(t, Restore(cfg, "schema", RestoreOptions{Data: true}, ""), "'schema' is schema-only backup, it doesn't contain data for restore")
+	ch.queries = nil
+	assert.NoError(t, Restore(cfg, "schema", RestoreOptions{}, ""))
+	created := 0
+	for _, query := range ch.queries {
+		if strings.HasPrefix(query, "CREATE TABLE") {
+			created++
+		}
+		assert.NotContains(t, query, "ATTACH PART", "data of schema-only backup shall not be restored")
+	}
+	assert.Equal(t, len(ch.tables), created)
+}
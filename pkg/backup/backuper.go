@@ -2,9 +2,14 @@ package backup
 
 import (
 	"fmt"
+	"path/filepath"
+
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/progressbar"
+	apexLog "github.com/apex/log"
 )
 
 type Backuper struct {
@@ -14,6 +19,11 @@ type Backuper struct {
 	Version         string
 	DiskToPathMap   map[string]string
 	DefaultDataPath string
+	hashCache       *filesystemhelper.FileHashCache
+	progress        *progressbar.Tracker
+	// OperationID - attached to logs of Upload and Download, returned by API to find logs of the operation
+	OperationID string
+	tableStats  *tableStatsRecorder
 }
 
 func (b *Backuper) init() error {
@@ -31,15 +41,33 @@ func (b *Backuper) init() error {
 		diskMap[disk.Name] = disk.Path
 	}
 	b.DiskToPathMap = diskMap
-	if b.cfg.General.RemoteStorage != "none" {
-		b.dst, err = new_storage.NewBackupDestination(b.cfg)
-		if err != nil {
-			return err
-		}
-		if err := b.dst.Connect(); err != nil {
-			return fmt.Errorf("can't connect to %s: %v", b.dst.Kind(), err)
-		}
+	return b.initRemoteStorage()
+}
+
+// initDownloadTo - `download --to` places backup into directory instead of ClickHouse data path, so ClickHouse is not required,
+// paths of disks are set by disks of downloaded tables
+func (b *Backuper) initDownloadTo(to string) error {
+	var err error
+	if b.DefaultDataPath, err = filepath.Abs(to); err != nil {
+		return err
+	}
+	b.DiskToPathMap = map[string]string{}
+	return b.initRemoteStorage()
+}
+
+func (b *Backuper) initRemoteStorage() error {
+	if b.cfg.General.RemoteStorage == "none" {
+		return nil
+	}
+	var err error
+	b.dst, err = new_storage.NewBackupDestination(b.cfg)
+	if err != nil {
+		return err
+	}
+	if err := b.dst.Connect(); err != nil {
+		return fmt.Errorf("can't connect to %s: %w", b.dst.Kind(), err)
 	}
+	b.dst.SetProgressTracker(b.progress)
 	return nil
 }
 
@@ -47,8 +75,31 @@ func NewBackuper(cfg *config.Config) *Backuper {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
-	return &Backuper{
-		cfg: cfg,
-		ch:  ch,
+	b := &Backuper{
+		cfg:         cfg,
+		ch:          ch,
+		progress:    progressbar.NewTracker(),
+		OperationID: NewOperationID(),
+		tableStats:  newTableStatsRecorder(),
 	}
+	progressbar.ForceShow = cfg.General.ForceProgressBar
+	if cfg.General.DiffCompareMode == "hash" {
+		b.hashCache = filesystemhelper.NewFileHashCache()
+	}
+	return b
+}
+
+// logger - contextual logger with `operation_id` for nested steps of Upload and Download
+func (b *Backuper) logger() *apexLog.Entry {
+	return apexLog.WithField("operation_id", b.OperationID)
+}
+
+// Progress - return aggregate progress of current upload or download, empty string when nothing is transferred
+func (b *Backuper) Progress() string {
+	return b.progress.String()
+}
+
+// ProgressBytes - transferred and total bytes of current upload or download
+func (b *Backuper) ProgressBytes() (int64, int64) {
+	return b.progress.Progress()
 }
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// activePartsGetter - part of clickhouse.ClickHouse which enough to find tables changed since reference backup
+type activePartsGetter interface {
+	GetActiveParts() ([]clickhouse.ActivePart, error)
+}
+
+// findUnchangedTables - tables which data wasn't changed since local backup `changedSince`, they are backed up without FREEZE
+func findUnchangedTables(ch activePartsGetter, defaultPath, changedSince, tablePattern string, skipTables []string, tables []clickhouse.Table) (map[metadata.TableTitle]metadata.TableMetadata, error) {
+	referencePath := path.Join(defaultPath, "backup", changedSince)
+	if _, err := os.Stat(path.Join(referencePath, "metadata.json")); err != nil {
+		return nil, fmt.Errorf("can't find local backup '%s' for --changed-since: %v", changedSince, err)
+	}
+	reference, err := getTableListByPatternLocal(path.Join(referencePath, "metadata"), tablePattern, skipTables, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't read tables of '%s': %v", changedSince, err)
+	}
+	activeParts, err := ch.GetActiveParts()
+	if err != nil {
+		return nil, err
+	}
+	return unchangedTables(reference, tables, activeParts), nil
+}
+
+// unchangedTables - tables from reference backup with the same create query and the same active parts on the same disks as now,
+// part name contains block numbers and mutation version, so any INSERT, merge, mutation or move to other disk changes the set of parts,
+// tables with partial, detached, object disks or skipped data in reference backup are always backed up again
+func unchangedTables(reference ListOfTables, tables []clickhouse.Table, activeParts []clickhouse.ActivePart) map[metadata.TableTitle]metadata.TableMetadata {
+	current := map[metadata.TableTitle]map[string]map[string]struct{}{}
+	for _, part := range activeParts {
+		title := metadata.TableTitle{Database: part.Database, Table: part.Table}
+		if current[title] == nil {
+			current[title] = map[string]map[string]struct{}{}
+		}
+		if current[title][part.Disk] == nil {
+			current[title][part.Disk] = map[string]struct{}{}
+		}
+		current[title][part.Disk][part.Name] = struct{}{}
+	}
+	queries := map[metadata.TableTitle]string{}
+	for _, table := range tables {
+		if !table.Skip && isDataBackupEngine(table.Engine) {
+			queries[metadata.TableTitle{Database: table.Database, Table: table.Name}] = table.CreateTableQuery
+		}
+	}
+	unchanged := map[metadata.TableTitle]metadata.TableMetadata{}
+	for _, table := range reference {
+		title := metadata.TableTitle{Database: table.Database, Table: table.Table}
+		if query, exists := queries[title]; !exists || query != table.Query {
+			continue
+		}
+		if table.MetadataOnly || table.DataSkipReason != "" || len(table.Partitions) > 0 || len(table.DetachedParts) > 0 || len(table.ObjectDisks) > 0 {
+			continue
+		}
+		if isSameActiveParts(table.Parts, current[title]) {
+			unchanged[title] = table
+		}
+	}
+	return unchanged
+}
+
+// isSameActiveParts - each part of backup is active on the same disk and there are no other active parts
+func isSameActiveParts(backupParts map[string][]metadata.Part, activeParts map[string]map[string]struct{}) bool {
+	backupPartsCount, activePartsCount := 0, 0
+	for disk, parts := range backupParts {
+		for _, part := range parts {
+			if _, isActive := activeParts[disk][part.Name]; !isActive {
+				return false
+			}
+			backupPartsCount++
+		}
+	}
+	for _, names := range activeParts {
+		activePartsCount += len(names)
+	}
+	return backupPartsCount == activePartsCount
+}
+
+// linkUnchangedTable - hardlink parts of table from reference backup instead of FREEZE, parts are marked as required,
+// so upload skips them and download takes them from reference backup
+func linkUnchangedTable(diskList []clickhouse.Disk, changedSince, backupName string, reference metadata.TableMetadata) (map[string][]metadata.Part, map[string]int64, error) {
+	diskPaths := map[string]string{}
+	for _, disk := range diskList {
+		diskPaths[disk.Name] = disk.Path
+	}
+	dbAndTablePath := common.TablePath(reference.Database, reference.Table)
+	disksToPartsMap := map[string][]metadata.Part{}
+	for disk, parts := range reference.Parts {
+		diskPath, exists := diskPaths[disk]
+		if !exists {
+			return nil, nil, fmt.Errorf("disk '%s' of '%s' isn't found", disk, changedSince)
+		}
+		disksToPartsMap[disk] = make([]metadata.Part, 0, len(parts))
+		for _, part := range parts {
+			existsPath := path.Join(diskPath, "backup", changedSince, "shadow", dbAndTablePath, disk, part.Name)
+			newPath := path.Join(diskPath, "backup", backupName, "shadow", dbAndTablePath, disk, part.Name)
+			if err := makePartHardlinks(existsPath, newPath); err != nil {
+				return nil, nil, fmt.Errorf("can't link part %s from '%s': %v", part.Name, changedSince, err)
+			}
+			part.Required = true
+			disksToPartsMap[disk] = append(disksToPartsMap[disk], part)
+		}
+	}
+	realSize := map[string]int64{}
+	for disk, size := range reference.Size {
+		realSize[disk] = size
+	}
+	return disksToPartsMap, realSize, nil
+}
@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeActivePartsGetter struct {
+	parts []clickhouse.ActivePart
+	err   error
+}
+
+func (f *fakeActivePartsGetter) GetActiveParts() ([]clickhouse.ActivePart, error) {
+	return f.parts, f.err
+}
+
+func TestUnchangedTables(t *testing.T) {
+	query := "CREATE TABLE db.t UUID '1' (id UInt64) ENGINE = MergeTree ORDER BY id"
+	reference := func(modify func(*metadata.TableMetadata)) ListOfTables {
+		table := metadata.TableMetadata{Database: "db", Table: "t", Query: query, Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+			"hdd":     {{Name: "all_3_3_0"}},
+		}}
+		if modify != nil {
+			modify(&table)
+		}
+		return ListOfTables{table}
+	}
+	tables := []clickhouse.Table{{Database: "db", Name: "t", Engine: "MergeTree", CreateTableQuery: query}}
+	activeParts := func(names ...string) []clickhouse.ActivePart {
+		parts := make([]clickhouse.ActivePart, len(names))
+		for i, name := range names {
+			parts[i] = clickhouse.ActivePart{Database: "db", Table: "t", Disk: "default", Name: name}
+		}
+		return append(parts, clickhouse.ActivePart{Database: "db", Table: "t", Disk: "hdd", Name: "all_3_3_0"}, clickhouse.ActivePart{Database: "db", Table: "other", Disk: "default", Name: "all_9_9_0"})
+	}
+	for name, tc := range map[string]struct {
+		reference   ListOfTables
+		tables      []clickhouse.Table
+		activeParts []clickhouse.ActivePart
+		unchanged   bool
+	}{
+		"same parts":        {reference(nil), tables, activeParts("all_2_2_0", "all_1_1_0"), true},
+		"new part":          {reference(nil), tables, activeParts("all_1_1_0", "all_2_2_0", "all_4_4_0"), false},
+		"merged parts":      {reference(nil), tables, activeParts("all_1_2_1"), false},
+		"mutated part":      {reference(nil), tables, activeParts("all_1_1_0_5", "all_2_2_0_5"), false},
+		"moved to disk":     {reference(nil), tables, append(activeParts("all_1_1_0"), clickhouse.ActivePart{Database: "db", Table: "t", Disk: "hdd", Name: "all_2_2_0"}), false},
+		"recreated table":   {reference(nil), []clickhouse.Table{{Database: "db", Name: "t", Engine: "MergeTree", CreateTableQuery: "CREATE TABLE db.t UUID '2' (id UInt64) ENGINE = MergeTree ORDER BY id"}}, activeParts("all_1_1_0", "all_2_2_0"), false},
+		"skipped table":     {reference(nil), []clickhouse.Table{{Database: "db", Name: "t", Engine: "MergeTree", CreateTableQuery: query, Skip: true}}, activeParts("all_1_1_0", "all_2_2_0"), false},
+		"partial reference": {reference(func(t *metadata.TableMetadata) { t.Partitions = []string{"all"} }), tables, activeParts("all_1_1_0", "all_2_2_0"), false},
+		"detached reference": {reference(func(t *metadata.TableMetadata) {
+			t.DetachedParts = map[string][]metadata.Part{"default": {{Name: "broken"}}}
+		}), tables, activeParts("all_1_1_0", "all_2_2_0"), false},
+		"schema reference": {reference(func(t *metadata.TableMetadata) { t.MetadataOnly = true }), tables, activeParts("all_1_1_0", "all_2_2_0"), false},
+		"dropped table":    {reference(nil), nil, activeParts("all_1_1_0", "all_2_2_0"), false},
+	} {
+		unchanged := unchangedTables(tc.reference, tc.tables, tc.activeParts)
+		_, isUnchanged := unchanged[metadata.TableTitle{Database: "db", Table: "t"}]
+		assert.Equal(t, tc.unchanged, isUnchanged, name)
+		assert.LessOrEqual(t, len(unchanged), 1, name)
+	}
+}
+
+func TestFindUnchangedTables(t *testing.T) {
+	defaultPath := t.TempDir()
+	backupName, referenceName := "incremental", "full"
+	rows := uint64(10)
+	reference := metadata.TableMetadata{
+		Database: "db", Table: "t", Query: "CREATE TABLE db.t",
+		Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0", Size: 4}}},
+		Size:  map[string]int64{"default": 4},
+		Rows:  &rows,
+	}
+	referencePath := path.Join(defaultPath, "backup", referenceName)
+	partPath := path.Join(referencePath, "shadow", common.TablePath("db", "t"), "default", "all_1_1_0")
+	assert.NoError(t, os.MkdirAll(partPath, 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte("data"), 0640))
+	metadataFile := path.Join(referencePath, "metadata", common.TableMetadataPath("db", "t"))
+	assert.NoError(t, os.MkdirAll(path.Dir(metadataFile), 0750))
+	body, err := json.Marshal(reference)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(metadataFile, body, 0640))
+	assert.NoError(t, ioutil.WriteFile(path.Join(referencePath, "metadata.json"), []byte("{}"), 0640))
+	tables := []clickhouse.Table{{Database: "db", Name: "t", Engine: "MergeTree", CreateTableQuery: "CREATE TABLE db.t"}}
+	ch := &fakeActivePartsGetter{parts: []clickhouse.ActivePart{{Database: "db", Table: "t", Disk: "default", Name: "all_1_1_0"}}}
+
+	unchanged, err := findUnchangedTables(ch, defaultPath, referenceName, "*.*", nil, tables)
+	assert.NoError(t, err)
+	assert.Len(t, unchanged, 1)
+	parts, size, err := linkUnchangedTable([]clickhouse.Disk{{Name: "default", Path: defaultPath}}, referenceName, backupName, unchanged[metadata.TableTitle{Database: "db", Table: "t"}])
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_1_1_0", Size: 4, Required: true}}}, parts)
+	assert.Equal(t, map[string]int64{"default": 4}, size)
+	data, err := ioutil.ReadFile(path.Join(defaultPath, "backup", backupName, "shadow", common.TablePath("db", "t"), "default", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.False(t, reference.Parts["default"][0].Required, "reference metadata shall not be changed")
+
+	_, _, err = linkUnchangedTable([]clickhouse.Disk{{Name: "hdd", Path: defaultPath}}, referenceName, backupName, reference)
+	assert.EqualError(t, err, "disk 'default' of 'full' isn't found")
+	ch.err = fmt.Errorf("timeout")
+	_, err = findUnchangedTables(ch, defaultPath, referenceName, "*.*", nil, tables)
+	assert.EqualError(t, err, "timeout")
+	_, err = findUnchangedTables(ch, defaultPath, "absent", "*.*", nil, tables)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can't find local backup 'absent' for --changed-since")
+}
+
+func TestCheckRequiredBackupConflict(t *testing.T) {
+	assert.NoError(t, checkRequiredBackupConflict(&metadata.BackupMetadata{BackupName: "b"}, "a"))
+	assert.NoError(t, checkRequiredBackupConflict(&metadata.BackupMetadata{BackupName: "b", RequiredBackup: "a"}, "a"))
+	assert.EqualError(t, checkRequiredBackupConflict(&metadata.BackupMetadata{BackupName: "b", RequiredBackup: "a"}, "c"), "'b' was created with --changed-since 'a' and can't be uploaded as increment of 'c'")
+}
@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/google/uuid"
+)
+
+// permissionsSystemTables - system tables which are read by create and restore
+var permissionsSystemTables = []string{"databases", "tables", "parts", "disks", "macros"}
+
+// permissionsChecker - part of clickhouse.ClickHouse which is used to check permissions of clickhouse user
+type permissionsChecker interface {
+	Select(dest interface{}, query string, args ...interface{}) error
+	Query(query string, args ...interface{}) (sql.Result, error)
+	GetDisks() ([]clickhouse.Disk, error)
+}
+
+// permissionCheck - result of check for one capability, Fix is GRANT statement or command which gives missing capability
+type permissionCheck struct {
+	Capability string
+	Err        error
+	Fix        string
+}
+
+type permissionsReport []permissionCheck
+
+// failed - checks which found missing capability
+func (report permissionsReport) failed() permissionsReport {
+	var failed permissionsReport
+	for _, check := range report {
+		if check.Err != nil {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// print - print result of each check, failed checks are printed with error and fix
+func (report permissionsReport) print(w io.Writer) {
+	for _, check := range report {
+		if check.Err == nil {
+			fmt.Fprintf(w, "OK      %s\n", check.Capability)
+			continue
+		}
+		fmt.Fprintf(w, "FAILED  %s: %v\n", check.Capability, check.Err)
+		if check.Fix != "" {
+			fmt.Fprintf(w, "        fix: %s\n", check.Fix)
+		}
+	}
+}
+
+// asError - nil when all checks passed, otherwise error which contains all failed checks with fixes
+func (report permissionsReport) asError(user, operation string) error {
+	failed := report.failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	out := &strings.Builder{}
+	failed.print(out)
+	return fmt.Errorf("clickhouse user '%s' doesn't have %d capabilities required by %s:\n%s", user, len(failed), operation, strings.TrimRight(out.String(), "\n"))
+}
+
+func isAccessDenied(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "code: 497")
+}
+
+// permissionsUser - clickhouse user which is used in GRANT statements of report
+func permissionsUser(cfg *config.ClickHouseConfig) string {
+	if cfg.Username == "" {
+		return "default"
+	}
+	return cfg.Username
+}
+
+// checkPermissions - check access to system tables and filesystem of each disk, FREEZE of the first table matched by tablePattern is checked when freeze is true
+func checkPermissions(ch permissionsChecker, user, tablePattern string, skipTables []string, freeze bool) permissionsReport {
+	var report permissionsReport
+	systemTablesAvailable := true
+	for _, table := range permissionsSystemTables {
+		var rows []int
+		err := ch.Select(&rows, fmt.Sprintf("SELECT 1 FROM system.%s LIMIT 1", table))
+		// system.disks is absent in old clickhouse versions, data path is read from system.settings
+		if err != nil && strings.Contains(err.Error(), "code: 60") {
+			continue
+		}
+		check := permissionCheck{Capability: fmt.Sprintf("SELECT ON system.%s", table), Err: err}
+		if isAccessDenied(err) {
+			check.Fix = fmt.Sprintf("GRANT SELECT ON system.%s TO `%s`", table, user)
+		}
+		if err != nil {
+			systemTablesAvailable = false
+		}
+		report = append(report, check)
+	}
+	if !systemTablesAvailable {
+		return report
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return append(report, permissionCheck{Capability: "read clickhouse disks", Err: err})
+	}
+	for _, disk := range disks {
+		report = append(report, checkDiskPermissions(disk))
+	}
+	if freeze {
+		report = append(report, checkFreezePermissions(ch, user, tablePattern, skipTables, disks)...)
+	}
+	return report
+}
+
+// checkDiskPermissions - `backup` folder of disk shall be writable, disk path shall be writable when `backup` folder is absent
+func checkDiskPermissions(disk clickhouse.Disk) permissionCheck {
+	checkPath := path.Join(disk.Path, "backup")
+	if _, err := os.Stat(checkPath); os.IsNotExist(err) {
+		checkPath = disk.Path
+	}
+	check := permissionCheck{
+		Capability: fmt.Sprintf("write to %s on disk '%s'", checkPath, disk.Name),
+		Fix:        fmt.Sprintf("run clickhouse-backup as the same user as clickhouse-server or `chown -R clickhouse:clickhouse %s`", disk.Path),
+	}
+	tmpPath, err := ioutil.TempDir(checkPath, ".check_permissions_")
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	check.Err = os.Remove(tmpPath)
+	return check
+}
+
+// checkFreezePermissions - FREEZE the first MergeTree table matched by tablePattern and remove its shadow folder on each disk
+func checkFreezePermissions(ch permissionsChecker, user, tablePattern string, skipTables []string, disks []clickhouse.Disk) permissionsReport {
+	var tables []clickhouse.Table
+	if err := ch.Select(&tables, "SELECT database, name FROM system.tables WHERE engine LIKE '%MergeTree' AND database != 'system'"); err != nil {
+		return permissionsReport{{Capability: "read MergeTree tables for FREEZE", Err: err}}
+	}
+	tp := common.NewTablePattern(tablePattern, skipTables)
+	for _, table := range tables {
+		if !tp.Match(table.Database, table.Name) {
+			continue
+		}
+		shadowName := "check_permissions_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+		check := permissionCheck{Capability: fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE", table.Database, table.Name)}
+		_, check.Err = ch.Query(fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE WITH NAME '%s'", table.Database, table.Name, shadowName))
+		if isAccessDenied(check.Err) {
+			check.Fix = fmt.Sprintf("GRANT ALTER FREEZE PARTITION ON *.* TO `%s`", user)
+		}
+		report := permissionsReport{check}
+		for _, disk := range disks {
+			shadowPath := path.Join(disk.Path, "shadow", shadowName)
+			if _, err := os.Stat(shadowPath); os.IsNotExist(err) {
+				continue
+			}
+			report = append(report, permissionCheck{
+				Capability: fmt.Sprintf("remove %s on disk '%s'", shadowPath, disk.Name),
+				Err:        os.RemoveAll(shadowPath),
+				Fix:        fmt.Sprintf("run clickhouse-backup as the same user as clickhouse-server or `chown -R clickhouse:clickhouse %s`", path.Join(disk.Path, "shadow")),
+			})
+		}
+		return report
+	}
+	return nil
+}
+
+// checkOperationPermissions - pre-flight check which is run before create and restore, missing capabilities are returned as one error
+func checkOperationPermissions(cfg *config.Config, ch *clickhouse.ClickHouse, operation, tablePattern string, freeze bool) error {
+	user := permissionsUser(&cfg.ClickHouse)
+	return checkPermissions(ch, user, tablePattern, cfg.ClickHouse.SkipTables, freeze).asError(user, operation)
+}
+
+// CheckPermissions - print result of each check which is required by create or restore, return error when any capability is missing
+func CheckPermissions(cfg *config.Config, operation, tablePattern string) error {
+	if operation != "create" && operation != "restore" {
+		return fmt.Errorf("'%s' operation is undefined, use create or restore", operation)
+	}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
+	}
+	defer ch.Close()
+	user := permissionsUser(&cfg.ClickHouse)
+	report := checkPermissions(ch, user, tablePattern, cfg.ClickHouse.SkipTables, operation == "create")
+	report.print(os.Stdout)
+	if failed := report.failed(); len(failed) > 0 {
+		return fmt.Errorf("clickhouse user '%s' doesn't have %d capabilities required by %s", user, len(failed), operation)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePermissionsChecker - deny queries which contain any of denied strings, FREEZE creates shadow folder on disk
+type fakePermissionsChecker struct {
+	denied  []string
+	disks   []clickhouse.Disk
+	tables  []clickhouse.Table
+	queries []string
+}
+
+func (f *fakePermissionsChecker) deny(query string) error {
+	f.queries = append(f.queries, query)
+	for _, denied := range f.denied {
+		if strings.Contains(query, denied) {
+			return fmt.Errorf("code: 497, message: backup: Not enough privileges")
+		}
+	}
+	return nil
+}
+
+func (f *fakePermissionsChecker) Select(dest interface{}, query string, args ...interface{}) error {
+	if err := f.deny(query); err != nil {
+		return err
+	}
+	if tables, ok := dest.(*[]clickhouse.Table); ok {
+		*tables = f.tables
+	}
+	return nil
+}
+
+func (f *fakePermissionsChecker) Query(query string, args ...interface{}) (sql.Result, error) {
+	if err := f.deny(query); err != nil {
+		return nil, err
+	}
+	name := query[strings.Index(query, "WITH NAME '")+len("WITH NAME '") : len(query)-1]
+	return nil, os.MkdirAll(path.Join(f.disks[0].Path, "shadow", name, "data"), 0750)
+}
+
+func (f *fakePermissionsChecker) GetDisks() ([]clickhouse.Disk, error) {
+	return f.disks, nil
+}
+
+func TestCheckPermissions(t *testing.T) {
+	diskPath := t.TempDir()
+	ch := &fakePermissionsChecker{
+		disks:  []clickhouse.Disk{{Name: "default", Path: diskPath}},
+		tables: []clickhouse.Table{{Database: "system", Name: "skipped"}, {Database: "default", Name: "t1"}},
+	}
+	report := checkPermissions(ch, "backup", "", []string{"system.*"}, true)
+	assert.Empty(t, report.failed())
+	assert.True(t, strings.HasPrefix(ch.queries[len(ch.queries)-1], "ALTER TABLE `default`.`t1` FREEZE WITH NAME 'check_permissions_"), "the first table matched by pattern shall be frozen")
+	shadowItems, err := os.ReadDir(path.Join(diskPath, "shadow"))
+	assert.NoError(t, err)
+	assert.Empty(t, shadowItems, "shadow of check shall be removed")
+	backupItems, err := os.ReadDir(diskPath)
+	assert.NoError(t, err)
+	assert.Len(t, backupItems, 1, "only shadow shall be left on disk")
+
+	ch = &fakePermissionsChecker{disks: ch.disks, tables: ch.tables, denied: []string{"system.parts", "FREEZE"}}
+	report = checkPermissions(ch, "backup", "", nil, true)
+	assert.Len(t, report.failed(), 1, "disks and FREEZE shall not be checked without access to system tables")
+	assert.EqualError(t, report.asError("backup", "create"), "clickhouse user 'backup' doesn't have 1 capabilities required by create:\n"+
+		"FAILED  SELECT ON system.parts: code: 497, message: backup: Not enough privileges\n"+
+		"        fix: GRANT SELECT ON system.parts TO `backup`")
+
+	ch.denied = []string{"FREEZE"}
+	report = checkPermissions(ch, "backup", "", nil, true)
+	failed := report.failed()
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "GRANT ALTER FREEZE PARTITION ON *.* TO `backup`", failed[0].Fix)
+	assert.Empty(t, checkPermissions(ch, "backup", "", nil, false).failed(), "FREEZE shall not be checked for restore")
+
+	if os.Getuid() != 0 {
+		assert.NoError(t, os.Chmod(diskPath, 0500))
+		defer os.Chmod(diskPath, 0750)
+		failed = checkPermissions(ch, "backup", "", nil, false).failed()
+		assert.Len(t, failed, 1)
+		assert.Contains(t, failed[0].Fix, "chown -R clickhouse:clickhouse "+diskPath)
+	}
+}
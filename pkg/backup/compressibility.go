@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+const (
+	// compressibilitySampleFiles - count of random part files which are sampled by general.estimate_compressibility
+	compressibilitySampleFiles = 16
+	// compressibilitySampleBytes - max bytes which are read from each sampled file
+	compressibilitySampleBytes = 1024 * 1024
+	// incompressibleRatio - data with lower ratio gets almost nothing from compression
+	incompressibleRatio = 1.2
+)
+
+// CompressibilityEstimate - ratio of sampled data size to its size after fast compression
+type CompressibilityEstimate struct {
+	Files          int
+	SampleSize     int64
+	CompressedSize int64
+	Ratio          float64
+}
+
+// Recommendation - advice for compression_format of backup with such data
+func (e CompressibilityEstimate) Recommendation(format string) string {
+	switch {
+	case e.Ratio < incompressibleRatio && format != "none" && format != "tar":
+		return fmt.Sprintf("data is ~%.1fx compressible, consider compression_format none", e.Ratio)
+	case e.Ratio >= incompressibleRatio && (format == "none" || format == "tar"):
+		return fmt.Sprintf("data is ~%.1fx compressible, consider compression_format lz4 or zstd", e.Ratio)
+	default:
+		return fmt.Sprintf("data is ~%.1fx compressible, compression_format %s fits it", e.Ratio, format)
+	}
+}
+
+// backupPartFiles - files of parts in shadow of backup on all disks
+func backupPartFiles(disks []clickhouse.Disk, backupName string) ([]string, error) {
+	var files []string
+	for _, disk := range disks {
+		shadowPath := path.Join(disk.Path, "backup", backupName, "shadow")
+		err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && filePath == shadowPath {
+					return nil
+				}
+				return err
+			}
+			if info.Mode().IsRegular() && info.Size() > 0 {
+				files = append(files, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't list part files on disk %s: %v", disk.Name, err)
+		}
+	}
+	return files, nil
+}
+
+// estimateCompressibility - compress first sampleBytes of up to sampleFiles random files by fast deflate
+func estimateCompressibility(files []string, sampleFiles int, sampleBytes int64, rnd *rand.Rand) (CompressibilityEstimate, error) {
+	sample := append([]string{}, files...)
+	rnd.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+	if len(sample) > sampleFiles {
+		sample = sample[:sampleFiles]
+	}
+	compressed := &countingWriter{}
+	compressor, err := flate.NewWriter(compressed, flate.BestSpeed)
+	if err != nil {
+		return CompressibilityEstimate{}, err
+	}
+	estimate := CompressibilityEstimate{Files: len(sample)}
+	for _, filePath := range sample {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return CompressibilityEstimate{}, fmt.Errorf("can't open %s: %v", filePath, err)
+		}
+		n, err := io.Copy(compressor, io.LimitReader(f, sampleBytes))
+		_ = f.Close()
+		if err != nil {
+			return CompressibilityEstimate{}, fmt.Errorf("can't read %s: %v", filePath, err)
+		}
+		estimate.SampleSize += n
+	}
+	if err := compressor.Close(); err != nil {
+		return CompressibilityEstimate{}, err
+	}
+	estimate.CompressedSize = compressed.n
+	if estimate.SampleSize == 0 || estimate.CompressedSize == 0 {
+		return CompressibilityEstimate{}, fmt.Errorf("no data to sample")
+	}
+	estimate.Ratio = float64(estimate.SampleSize) / float64(estimate.CompressedSize)
+	return estimate, nil
+}
+
+// logCompressibility - log estimate of compressibility of created backup, failure of estimate doesn't fail backup
+func logCompressibility(disks []clickhouse.Disk, backupName, format string, log *apexLog.Entry) {
+	files, err := backupPartFiles(disks, backupName)
+	if err == nil {
+		var estimate CompressibilityEstimate
+		if estimate, err = estimateCompressibility(files, compressibilitySampleFiles, compressibilitySampleBytes, rand.New(rand.NewSource(time.Now().UnixNano()))); err == nil {
+			log.WithFields(apexLog.Fields{
+				"sampled_files": estimate.Files,
+				"sample_size":   utils.FormatBytes(uint64(estimate.SampleSize)),
+			}).Info(estimate.Recommendation(format))
+			return
+		}
+	}
+	log.Warnf("can't estimate compressibility: %v", err)
+}
+
+// countingWriter - discards written data and counts its size
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
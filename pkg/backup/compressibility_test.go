@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateCompressibility(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	diskPath := t.TempDir()
+	writeParts := func(table string, content func(i int) []byte) {
+		partPath := path.Join(diskPath, "backup", table, "shadow", "default", table, "default", "all_1_1_0")
+		assert.NoError(t, os.MkdirAll(partPath, 0750))
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, ioutil.WriteFile(path.Join(partPath, string(rune('a'+i))+".bin"), content(i), 0640))
+		}
+	}
+	writeParts("compressible", func(i int) []byte {
+		return bytes.Repeat([]byte("2022-01-01 00:00:00\tclickhouse-backup\n"), 10000)
+	})
+	writeParts("incompressible", func(i int) []byte {
+		data := make([]byte, 64*1024)
+		rnd.Read(data)
+		return data
+	})
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}, {Name: "empty", Path: t.TempDir()}}
+
+	files, err := backupPartFiles(disks, "compressible")
+	assert.NoError(t, err)
+	assert.Len(t, files, 4)
+	estimate, err := estimateCompressibility(files, 2, 64*1024, rnd)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, estimate.Files)
+	assert.Equal(t, int64(2*64*1024), estimate.SampleSize, "only sampleBytes of each file shall be read")
+	assert.Greater(t, estimate.Ratio, 10.0)
+	assert.Regexp(t, `^data is ~\d+\.\dx compressible, consider compression_format lz4 or zstd$`, estimate.Recommendation("tar"))
+	assert.Regexp(t, `^data is ~\d+\.\dx compressible, compression_format zstd fits it$`, estimate.Recommendation("zstd"))
+
+	files, err = backupPartFiles(disks, "incompressible")
+	assert.NoError(t, err)
+	estimate, err = estimateCompressibility(files, 16, 1024*1024, rnd)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, estimate.Files)
+	assert.Less(t, estimate.Ratio, incompressibleRatio)
+	assert.Equal(t, "data is ~1.0x compressible, consider compression_format none", estimate.Recommendation("gzip"))
+	assert.Equal(t, "data is ~1.0x compressible, compression_format tar fits it", estimate.Recommendation("tar"))
+
+	files, err = backupPartFiles(disks, "absent")
+	assert.NoError(t, err)
+	_, err = estimateCompressibility(files, 16, 1024*1024, rnd)
+	assert.EqualError(t, err, "no data to sample")
+}
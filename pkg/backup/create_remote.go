@@ -2,14 +2,24 @@ package backup
 
 import "fmt"
 
-func (b *Backuper) CreateToRemote(backupName, diffFrom, diffFromRemote, tablePattern string, partitions []string, schemaOnly, rbac, backupConfig bool, version string) error {
+// CreateToRemote - create and upload backup, when deleteLocal is true, local backup is removed after successful upload
+func (b *Backuper) CreateToRemote(backupName, diffFrom, diffFromRemote, tablePattern string, partitions []string, schemaOnly, rbac, backupConfig, includeDetached, deleteSource, deleteLocal bool, version string) error {
 	if backupName == "" {
-		backupName = NewBackupName()
+		var err error
+		if backupName, err = ResolveBackupName(b.cfg, true); err != nil {
+			return err
+		}
 	}
-	if err := CreateBackup(b.cfg, backupName, tablePattern, partitions, schemaOnly, rbac, backupConfig, version); err != nil {
+	if err := b.CreateBackup(backupName, tablePattern, partitions, schemaOnly, rbac, backupConfig, includeDetached, "", version); err != nil {
 		return err
 	}
-	if err := b.Upload(backupName, diffFrom, diffFromRemote, tablePattern, partitions, schemaOnly); err != nil {
+	upload := func() error {
+		return b.Upload(backupName, diffFrom, diffFromRemote, tablePattern, partitions, schemaOnly, deleteSource, false)
+	}
+	if deleteLocal {
+		return RemoveLocalAfter(b.cfg, backupName, "create_remote", upload)
+	}
+	if err := upload(); err != nil {
 		return err
 	}
 	if err := RemoveOldBackupsLocal(b.cfg, false); err != nil {
@@ -1,52 +1,236 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
 
 	apexLog "github.com/apex/log"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
-// Clean - removed all data in shadow folder
-func Clean(cfg *config.Config) error {
+// Clean - removed all data in shadow folder unless any backup is locked by running operation, local backups without metadata.json or with broken metadata.json are removed when removeBroken is true,
+// legacy backups with `.sql` schemas are kept,
+// incomplete S3 multipart uploads are aborted when s3.abort_incomplete_uploads_after is set, return list of removed paths
+func Clean(cfg *config.Config, removeBroken bool) ([]string, error) {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
 	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+		return nil, fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer ch.Close()
 
 	disks, err := ch.GetDisks()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defaultPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	removed, err := cleanShadowUnlocked(disks, path.Join(defaultPath, "backup"), "")
+	if err != nil {
+		return removed, err
+	}
+	if removeBroken {
+		removedBackups, err := removeBrokenBackupsLocal(path.Join(defaultPath, "backup"), disks)
+		removed = append(removed, removedBackups...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	if cfg.General.RemoteStorage == "s3" && cfg.S3.AbortIncompleteUploadsAfter != "" {
+		abortedUploads, err := abortIncompleteUploads(cfg)
+		return append(removed, abortedUploads...), err
+	}
+	return removed, nil
+}
+
+// abortIncompleteUploads - abort S3 multipart uploads which were initiated earlier than s3.abort_incomplete_uploads_after ago, return aborted uploads with their size
+func abortIncompleteUploads(cfg *config.Config) ([]string, error) {
+	gracePeriod, err := time.ParseDuration(cfg.S3.AbortIncompleteUploadsAfter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3.abort_incomplete_uploads_after: %v", err)
+	}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to remote storage: %w", err)
+	}
+	s3Storage, ok := bd.RemoteStorage.(*new_storage.S3)
+	if !ok {
+		return nil, nil
+	}
+	aborted, err := s3Storage.AbortIncompleteUploads(time.Now().Add(-gracePeriod))
+	var removed []string
+	var reclaimed int64
+	for _, upload := range aborted {
+		reclaimed += upload.Size
+		removed = append(removed, fmt.Sprintf("s3://%s/%s (multipart upload %s, %s)", cfg.S3.Bucket, path.Join(cfg.S3.Path, upload.Key), upload.UploadID, utils.FormatBytes(uint64(upload.Size))))
+	}
+	apexLog.Infof("aborted %d incomplete multipart uploads older than %s, reclaimed %s", len(aborted), gracePeriod, utils.FormatBytes(uint64(reclaimed)))
+	return removed, err
+}
+
+// RemoveOrphansRemote - delete remote objects which don't belong to any backup, objects modified later than minAge ago and ambiguous objects are kept,
+// nothing is deleted when dryRun is true, return found orphans with their size and retained objects with reason
+func RemoveOrphansRemote(cfg *config.Config, minAge string, dryRun bool) ([]string, error) {
+	if cfg.General.RemoteStorage == "none" {
+		return nil, fmt.Errorf("remote_storage is 'none'")
+	}
+	age, err := utils.ParseDuration(minAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid min-age: %v", err)
+	}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to remote storage: %w", err)
+	}
+	return removeOrphans(bd, age, dryRun, time.Now())
+}
+
+func removeOrphans(bd *new_storage.BackupDestination, minAge time.Duration, dryRun bool, now time.Time) ([]string, error) {
+	orphans, err := bd.FindOrphans(minAge, now)
+	if err != nil {
+		return nil, err
+	}
+	var report []string
+	for _, retained := range orphans.Retained {
+		apexLog.WithField("prefix", retained.Prefix).Warnf("%d objects (%s) are retained: %s", retained.Count, utils.FormatBytes(uint64(retained.Size)), retained.Reason)
+		report = append(report, fmt.Sprintf("retained %s (%d objects, %s): %s", retained.Prefix, retained.Count, utils.FormatBytes(uint64(retained.Size)), retained.Reason))
+	}
+	for _, object := range orphans.Objects {
+		report = append(report, fmt.Sprintf("%s (%s)", object.Key, utils.FormatBytes(uint64(object.Size))))
 	}
+	if dryRun {
+		apexLog.Infof("found %d orphaned objects, %s could be reclaimed, nothing is deleted because of dry run", len(orphans.Objects), utils.FormatBytes(uint64(orphans.Size)))
+		return report, nil
+	}
+	if err := bd.DeleteOrphans(orphans); err != nil {
+		return report, fmt.Errorf("can't delete orphaned objects: %v", err)
+	}
+	apexLog.Infof("deleted %d orphaned objects, reclaimed %s", len(orphans.Objects), utils.FormatBytes(uint64(orphans.Size)))
+	return report, nil
+}
+
+// cleanShadowUnlocked - cleanShadow when no backup except exceptName is locked by running operation,
+// otherwise shadow contains FREEZE results of running create, they are kept and cleaning is skipped with warning
+func cleanShadowUnlocked(disks []clickhouse.Disk, backupsPath, exceptName string) ([]string, error) {
+	if locked := lockedBackups(backupsPath, exceptName); len(locked) > 0 {
+		apexLog.Warnf("skip cleaning shadow, backups %s are locked by running operations", strings.Join(locked, ", "))
+		return nil, nil
+	}
+	return cleanShadow(disks)
+}
+
+// cleanShadow - remove content of shadow folder on all disks
+func cleanShadow(disks []clickhouse.Disk) ([]string, error) {
+	var removed []string
 	for _, disk := range disks {
 		shadowDir := path.Join(disk.Path, "shadow")
 		apexLog.Infof("Clean %s", shadowDir)
-		if err := cleanDir(shadowDir); err != nil {
-			return fmt.Errorf("can't clean '%s': %v", shadowDir, err)
+		removedItems, err := cleanDir(shadowDir)
+		removed = append(removed, removedItems...)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("can't clean '%s': %v", shadowDir, err)
 		}
 	}
-	return nil
+	return removed, nil
 }
 
-func cleanDir(dirName string) error {
-	if items, err := os.ReadDir(dirName); err != nil {
-		return err
-	} else {
-		for _, item := range items {
-			_ = os.RemoveAll(item.Name())
+func cleanDir(dirName string) ([]string, error) {
+	items, err := os.ReadDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, item := range items {
+		itemPath := path.Join(dirName, item.Name())
+		if err := os.RemoveAll(itemPath); err != nil {
+			return removed, err
 		}
+		removed = append(removed, itemPath)
 	}
-	return nil
+	return removed, nil
+}
+
+// brokenBackupsLocal - return names of local backups which metadata.json can't be read or parsed, and of folders without metadata.json
+// like half-created backups, folder without metadata.json is legacy backup only when its `metadata` folder contains `.sql` files
+func brokenBackupsLocal(backupsPath string) ([]string, error) {
+	items, err := os.ReadDir(backupsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var broken []string
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		var backupMetadata metadata.BackupMetadata
+		if err := backupMetadata.Load(path.Join(backupsPath, item.Name(), "metadata.json")); err != nil {
+			if os.IsNotExist(err) && isLegacyBackupLocal(path.Join(backupsPath, item.Name())) {
+				continue
+			}
+			apexLog.Debugf("'%s' is broken: %v", item.Name(), err)
+			broken = append(broken, item.Name())
+		}
+	}
+	return broken, nil
+}
+
+// isLegacyBackupLocal - backups created before metadata.json was introduced keep schema of tables in metadata/<db>/<table>.sql
+func isLegacyBackupLocal(backupPath string) bool {
+	schemas, err := filepath.Glob(path.Join(backupPath, "metadata", "*", "*.sql"))
+	return err == nil && len(schemas) > 0
+}
+
+// removeBrokenBackupsLocal - remove broken backups from all disks, skip backups locked by running operations
+func removeBrokenBackupsLocal(backupsPath string, disks []clickhouse.Disk) ([]string, error) {
+	broken, err := brokenBackupsLocal(backupsPath)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, backupName := range broken {
+		if pid, locked := backupLockOwner(backupsPath, backupName); locked {
+			apexLog.Warnf("'%s' is locked by running operation with pid %d, skip", backupName, pid)
+			continue
+		}
+		for _, disk := range disks {
+			backupPath := path.Join(disk.Path, "backup", backupName)
+			if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+				continue
+			}
+			apexLog.Infof("remove broken backup %s", backupPath)
+			if err := os.RemoveAll(backupPath); err != nil {
+				return removed, fmt.Errorf("can't remove '%s': %v", backupPath, err)
+			}
+			removed = append(removed, backupPath)
+		}
+	}
+	return removed, nil
 }
 
 func RemoveOldBackupsLocal(cfg *config.Config, keepLastBackup bool) error {
@@ -70,8 +254,9 @@ func RemoveOldBackupsLocal(cfg *config.Config, keepLastBackup bool) error {
 	return nil
 }
 
-func RemoveBackupLocal(cfg *config.Config, backupName string) error {
+func RemoveBackupLocal(cfg *config.Config, backupName string) (err error) {
 	start := time.Now()
+	defer func() { logBackupOperation(cfg, "delete local", backupName, start, err) }()
 	backupList, err := GetLocalBackups(cfg)
 	if err != nil {
 		return err
@@ -80,7 +265,7 @@ func RemoveBackupLocal(cfg *config.Config, backupName string) error {
 		Config: &cfg.ClickHouse,
 	}
 	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer ch.Close()
 
@@ -90,26 +275,42 @@ func RemoveBackupLocal(cfg *config.Config, backupName string) error {
 	}
 	for _, backup := range backupList {
 		if backup.BackupName == backupName {
-			for _, disk := range disks {
-				apexLog.WithField("path", path.Join(disk.Path, "backup")).Debugf("remove '%s'", backupName)
-				err := os.RemoveAll(path.Join(disk.Path, "backup", backupName))
-				if err != nil {
-					return err
-				}
+			removed, err := removeBackupFromDisks(disks, backupName)
+			if err != nil {
+				return err
 			}
 			apexLog.WithField("operation", "delete").
 				WithField("location", "local").
 				WithField("backup", backupName).
+				WithField("removed", strings.Join(removed, ", ")).
 				WithField("duration", utils.HumanizeDuration(time.Since(start))).
 				Info("done")
 			return nil
 		}
 	}
-	return fmt.Errorf("'%s' is not found on local storage", backupName)
+	return fmt.Errorf("'%s' is not found on local storage: %w", backupName, ErrBackupNotFound)
 }
 
-func RemoveBackupRemote(cfg *config.Config, backupName string) error {
+// removeBackupFromDisks - remove backupName folder from `backup` folder of each disk, return removed paths
+func removeBackupFromDisks(disks []clickhouse.Disk, backupName string) ([]string, error) {
+	var removed []string
+	for _, disk := range disks {
+		backupPath := path.Join(disk.Path, "backup", backupName)
+		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+			continue
+		}
+		apexLog.WithField("path", path.Join(disk.Path, "backup")).Debugf("remove '%s'", backupName)
+		if err := os.RemoveAll(backupPath); err != nil {
+			return removed, err
+		}
+		removed = append(removed, backupPath)
+	}
+	return removed, nil
+}
+
+func RemoveBackupRemote(cfg *config.Config, backupName string) (err error) {
 	start := time.Now()
+	defer func() { logBackupOperation(cfg, "delete remote", backupName, start, err) }()
 	if cfg.General.RemoteStorage == "none" {
 		fmt.Println("RemoveBackupRemote aborted: RemoteStorage set to \"none\"")
 		return nil
@@ -121,14 +322,18 @@ func RemoveBackupRemote(cfg *config.Config, backupName string) error {
 	}
 	err = bd.Connect()
 	if err != nil {
-		return fmt.Errorf("can't connect to remote storage: %v", err)
+		return fmt.Errorf("can't connect to remote storage: %w", err)
 	}
-	backupList, err := bd.BackupList(true, backupName)
+	// metadata of all backups is required to find backups which reference parts of deleted backup
+	backupList, err := bd.BackupList(true, "")
 	if err != nil {
 		return err
 	}
 	for _, backup := range backupList {
 		if backup.BackupName == backupName {
+			if referencedBy := new_storage.ReferencedBy(backupList, backupName); len(referencedBy) > 0 {
+				return fmt.Errorf("parts of '%s' are referenced by %s, delete them first or make them self-contained by `flatten`", backupName, strings.Join(referencedBy, ", "))
+			}
 			if err := bd.RemoveBackup(backup); err != nil {
 				return err
 			}
@@ -141,5 +346,156 @@ func RemoveBackupRemote(cfg *config.Config, backupName string) error {
 			return nil
 		}
 	}
-	return fmt.Errorf("'%s' is not found on remote storage", backupName)
+	return fmt.Errorf("'%s' is not found on remote storage: %w", backupName, new_storage.ErrNotFound)
+}
+
+// RemoveBackupsRemote - delete remote backups which names match pattern and which are created earlier than olderThan ago, backups are resolved by one listing,
+// confirm gets names of matched backups and nothing is deleted when it returns false, return names of deleted backups
+func RemoveBackupsRemote(cfg *config.Config, pattern, olderThan string, confirm func(backupNames []string) bool) ([]string, error) {
+	if pattern == "" && olderThan == "" {
+		return nil, fmt.Errorf("pattern or older-than must be defined")
+	}
+	var age time.Duration
+	if olderThan != "" {
+		var err error
+		if age, err = utils.ParseDuration(olderThan); err != nil {
+			return nil, fmt.Errorf("invalid older-than: %v", err)
+		}
+	}
+	if cfg.General.RemoteStorage == "none" {
+		fmt.Println("RemoveBackupsRemote aborted: RemoteStorage set to \"none\"")
+		return nil, nil
+	}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to remote storage: %w", err)
+	}
+	backupList, err := bd.BackupList(true, "")
+	if err != nil {
+		return nil, err
+	}
+	backupsToDelete, err := selectBackupsToDelete(backupList, pattern, age, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(backupsToDelete) == 0 {
+		apexLog.Infof("no remote backups match pattern '%s' and older-than '%s'", pattern, olderThan)
+		return nil, nil
+	}
+	backupNames := make([]string, len(backupsToDelete))
+	for i, backup := range backupsToDelete {
+		backupNames[i] = backup.BackupName
+	}
+	if !confirm(backupNames) {
+		return nil, fmt.Errorf("deletion of %d backups is not confirmed: %s", len(backupNames), strings.Join(backupNames, ", "))
+	}
+	return removeBackupsRemote(cfg, bd, backupsToDelete)
+}
+
+// selectBackupsToDelete - backups which match pattern and are older than olderThan, empty pattern and zero olderThan don't filter,
+// base backup of incremental backup which is kept and backups with parts referenced by kept backup are kept too, result is sorted by creation date
+func selectBackupsToDelete(backups []new_storage.Backup, pattern string, olderThan time.Duration, now time.Time) ([]new_storage.Backup, error) {
+	if pattern != "" {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+	selected := map[string]bool{}
+	for _, backup := range backups {
+		if pattern != "" {
+			if matched, _ := filepath.Match(pattern, backup.BackupName); !matched {
+				continue
+			}
+		}
+		if olderThan > 0 && (backup.GetDate().IsZero() || now.Sub(backup.GetDate()) < olderThan) {
+			continue
+		}
+		selected[backup.BackupName] = true
+	}
+	// kept base backup could be required by other base backup, so repeat until nothing is excluded
+	for excluded := true; excluded; {
+		excluded = false
+		for _, backup := range backups {
+			if !selected[backup.BackupName] && backup.RequiredBackup != "" && selected[backup.RequiredBackup] {
+				apexLog.Warnf("'%s' is required by incremental backup '%s' which is kept, skip", backup.RequiredBackup, backup.BackupName)
+				delete(selected, backup.RequiredBackup)
+				excluded = true
+			}
+			if selected[backup.BackupName] {
+				continue
+			}
+			for _, referenced := range backup.ReferencedBackups {
+				if selected[referenced] {
+					apexLog.Warnf("parts of '%s' are referenced by '%s' which is kept, skip", referenced, backup.BackupName)
+					delete(selected, referenced)
+					excluded = true
+				}
+			}
+		}
+	}
+	var result []new_storage.Backup
+	for _, backup := range backups {
+		if selected[backup.BackupName] {
+			result = append(result, backup)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].GetDate().Before(result[j].GetDate())
+	})
+	return result, nil
+}
+
+// removeBackupsRemote - delete backups by delete_concurrency parallel goroutines, backups with shared parts are deleted one by one after others,
+// because each of them checks references of shared parts in remaining backups
+func removeBackupsRemote(cfg *config.Config, bd *new_storage.BackupDestination, backups []new_storage.Backup) ([]string, error) {
+	var deleted, failed []string
+	var lock sync.Mutex
+	removeBackup := func(backup new_storage.Backup) {
+		start := time.Now()
+		err := bd.RemoveBackup(backup)
+		logBackupOperation(cfg, "delete remote", backup.BackupName, start, err)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			apexLog.WithField("backup", backup.BackupName).Errorf("can't delete: %v", err)
+			failed = append(failed, fmt.Sprintf("%s: %v", backup.BackupName, err))
+			return
+		}
+		apexLog.WithFields(apexLog.Fields{
+			"backup":    backup.BackupName,
+			"location":  "remote",
+			"operation": "delete",
+			"duration":  utils.HumanizeDuration(time.Since(start)),
+		}).Info("done")
+		deleted = append(deleted, backup.BackupName)
+	}
+	var withSharedParts []new_storage.Backup
+	s := semaphore.NewWeighted(int64(cfg.General.DeleteConcurrency))
+	g := errgroup.Group{}
+	for _, backup := range backups {
+		if len(backup.SharedParts) > 0 {
+			withSharedParts = append(withSharedParts, backup)
+			continue
+		}
+		if err := s.Acquire(context.Background(), 1); err != nil {
+			return deleted, err
+		}
+		backup := backup
+		g.Go(func() error {
+			defer s.Release(1)
+			removeBackup(backup)
+			return nil
+		})
+	}
+	_ = g.Wait()
+	for _, backup := range withSharedParts {
+		removeBackup(backup)
+	}
+	if len(failed) > 0 {
+		return deleted, fmt.Errorf("can't delete %d of %d backups: %s", len(failed), len(backups), strings.Join(failed, "; "))
+	}
+	return deleted, nil
 }
@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanShadow(t *testing.T) {
+	diskPath := t.TempDir()
+	shadowPath := path.Join(diskPath, "shadow")
+	assert.NoError(t, os.MkdirAll(path.Join(shadowPath, "1", "data"), 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(shadowPath, "increment.txt"), []byte("1"), 0640))
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}, {Name: "empty", Path: t.TempDir()}}
+
+	removed, err := cleanShadow(disks)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{path.Join(shadowPath, "1"), path.Join(shadowPath, "increment.txt")}, removed)
+	items, err := os.ReadDir(shadowPath)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+
+	// FREEZE results of running create are kept, lock of current backup doesn't prevent cleaning
+	backupsPath := path.Join(diskPath, "backup")
+	assert.NoError(t, os.MkdirAll(path.Join(shadowPath, "running_create_freeze"), 0750))
+	assert.NoError(t, os.MkdirAll(backupsPath, 0750))
+	unlock, err := lockBackup(backupsPath, "running")
+	assert.NoError(t, err)
+	removed, err = cleanShadowUnlocked(disks, backupsPath, "")
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.DirExists(t, path.Join(shadowPath, "running_create_freeze"))
+	removed, err = cleanShadowUnlocked(disks, backupsPath, "running")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(shadowPath, "running_create_freeze")}, removed)
+	unlock()
+}
+
+func TestRemoveBrokenBackupsLocal(t *testing.T) {
+	diskPath := t.TempDir()
+	secondDiskPath := t.TempDir()
+	backupsPath := path.Join(diskPath, "backup")
+	for _, name := range []string{"good", "half_created", "bad_metadata", "locked"} {
+		assert.NoError(t, os.MkdirAll(path.Join(backupsPath, name, "metadata"), 0750))
+	}
+	assert.NoError(t, os.MkdirAll(path.Join(backupsPath, "legacy", "metadata", "default"), 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(backupsPath, "legacy", "metadata", "default", "t.sql"), []byte("ATTACH TABLE t (id UInt64) ENGINE = Log"), 0640))
+	assert.NoError(t, os.MkdirAll(path.Join(backupsPath, "unreadable", "metadata.json"), 0750))
+	assert.NoError(t, os.MkdirAll(path.Join(secondDiskPath, "backup", "half_created", "shadow"), 0750))
+	assert.NoError(t, os.MkdirAll(path.Join(secondDiskPath, "backup", "legacy", "shadow"), 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(backupsPath, "good", "metadata.json"), []byte(`{"backup_name":"good"}`), 0640))
+	assert.NoError(t, ioutil.WriteFile(path.Join(backupsPath, "bad_metadata", "metadata.json"), []byte(`{"backup_name":`), 0640))
+	unlock, err := lockBackup(backupsPath, "locked")
+	assert.NoError(t, err)
+	defer unlock()
+
+	broken, err := brokenBackupsLocal(backupsPath)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"half_created", "bad_metadata", "unreadable", "locked"}, broken)
+
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}, {Name: "second", Path: secondDiskPath}}
+	removed, err := removeBrokenBackupsLocal(backupsPath, disks)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		path.Join(backupsPath, "half_created"),
+		path.Join(secondDiskPath, "backup", "half_created"),
+		path.Join(backupsPath, "bad_metadata"),
+		path.Join(backupsPath, "unreadable"),
+	}, removed)
+	assert.DirExists(t, path.Join(backupsPath, "good"))
+	// half-created backup without metadata.json is kept while create holds its lock
+	assert.DirExists(t, path.Join(backupsPath, "locked"))
+
+	// legacy backup with `.sql` schemas is listed by GetLocalBackups and shall be kept on all disks
+	assert.DirExists(t, path.Join(backupsPath, "legacy"))
+	assert.DirExists(t, path.Join(secondDiskPath, "backup", "legacy"))
+}
+
+func TestLockBackup(t *testing.T) {
+	backupsPath := t.TempDir()
+	unlock, err := lockBackup(backupsPath, "test")
+	assert.NoError(t, err)
+	_, err = lockBackup(backupsPath, "test")
+	assert.ErrorIs(t, err, ErrBackupLocked)
+	unlock()
+	_, locked := backupLockOwner(backupsPath, "test")
+	assert.False(t, locked)
+
+	// lock of finished process is stale
+	assert.NoError(t, ioutil.WriteFile(backupLockPath(backupsPath, "stale"), []byte("2147483646"), 0640))
+	_, locked = backupLockOwner(backupsPath, "stale")
+	assert.False(t, locked)
+	unlock, err = lockBackup(backupsPath, "stale")
+	assert.NoError(t, err, "stale lock shall be replaced")
+	pid, locked := backupLockOwner(backupsPath, "stale")
+	assert.True(t, locked)
+	assert.Equal(t, os.Getpid(), pid)
+	unlock()
+
+	// empty lock is being created by another process, empty lock of crashed process is stale
+	emptyLock := backupLockPath(backupsPath, "empty")
+	assert.NoError(t, ioutil.WriteFile(emptyLock, nil, 0640))
+	_, err = lockBackup(backupsPath, "empty")
+	assert.ErrorIs(t, err, ErrBackupLocked)
+	assert.NoError(t, os.Chtimes(emptyLock, time.Now().Add(-2*staleLockAge), time.Now().Add(-2*staleLockAge)))
+	unlock, err = lockBackup(backupsPath, "empty")
+	assert.NoError(t, err)
+	unlock()
+}
+
+func TestSelectBackupsToDelete(t *testing.T) {
+	now := time.Now()
+	remoteBackup := func(name, requiredBackup string, age time.Duration) new_storage.Backup {
+		return new_storage.Backup{BackupMetadata: metadata.BackupMetadata{BackupName: name, RequiredBackup: requiredBackup, CreationDate: now.Add(-age)}}
+	}
+	day := 24 * time.Hour
+	backups := []new_storage.Backup{
+		remoteBackup("test-2", "", 10*day),
+		remoteBackup("test-1", "", 40*day),
+		remoteBackup("prod-base", "", 50*day),
+		remoteBackup("prod-incr1", "prod-base", 45*day),
+		remoteBackup("prod-incr2", "prod-incr1", 1*day),
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "test-broken"}, Broken: "broken (can't stat metadata.json)"},
+	}
+	names := func(backups []new_storage.Backup) []string {
+		var result []string
+		for _, b := range backups {
+			result = append(result, b.BackupName)
+		}
+		return result
+	}
+
+	selected, err := selectBackupsToDelete(backups, "test-*", 0, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test-broken", "test-1", "test-2"}, names(selected))
+	selected, err = selectBackupsToDelete(backups, "test-*", 30*day, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test-1"}, names(selected), "backups without date aren't older than anything")
+	// prod-incr2 is kept, so whole chain is kept
+	selected, err = selectBackupsToDelete(backups, "prod-*", 30*day, now)
+	assert.NoError(t, err)
+	assert.Empty(t, selected)
+	selected, err = selectBackupsToDelete(backups, "", 0, now)
+	assert.NoError(t, err)
+	assert.Len(t, selected, len(backups))
+	_, err = selectBackupsToDelete(backups, "test-[", 0, now)
+	assert.Error(t, err)
+
+	olderThan, err := utils.ParseDuration("1d12h")
+	assert.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, olderThan)
+	_, err = utils.ParseDuration("d")
+	assert.Error(t, err)
+}
+
+func TestRemoveBackupsRemote(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.General.DeleteConcurrency = 2
+	storage := &memoryStorage{files: map[string][]byte{}}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	bd.RemoteStorage = storage
+	var backups []new_storage.Backup
+	for _, name := range []string{"test-1", "test-2", "test-3"} {
+		storage.files[name+".tar"] = []byte(name)
+		backups = append(backups, new_storage.Backup{BackupMetadata: metadata.BackupMetadata{BackupName: name}, Legacy: true, FileExtension: "tar"})
+	}
+	storage.files["prod.tar"] = []byte("prod")
+
+	deleted, err := removeBackupsRemote(cfg, bd, backups)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"test-1", "test-2", "test-3"}, deleted)
+	assert.Equal(t, map[string][]byte{"prod.tar": []byte("prod")}, storage.files)
+
+	_, err = RemoveBackupsRemote(cfg, "", "", nil)
+	assert.EqualError(t, err, "pattern or older-than must be defined")
+	_, err = RemoveBackupsRemote(cfg, "", "30days", nil)
+	assert.Error(t, err)
+}
+
+func TestLockedBackups(t *testing.T) {
+	backupsPath := t.TempDir()
+	assert.Empty(t, lockedBackups(backupsPath, ""))
+	unlockOwn, err := lockBackup(backupsPath, "own")
+	assert.NoError(t, err)
+	defer unlockOwn()
+	unlockOther, err := lockBackup(backupsPath, "other")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(backupLockPath(backupsPath, "stale"), []byte("2147483646"), 0640))
+	assert.Equal(t, []string{fmt.Sprintf("'other' (pid %d)", os.Getpid())}, lockedBackups(backupsPath, "own"))
+	unlockOther()
+	assert.Empty(t, lockedBackups(backupsPath, "own"))
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeDetachedPart(t *testing.T, partPath string, content string) {
+	assert.NoError(t, os.MkdirAll(partPath, 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte(content), 0640))
+}
+
+func TestAddTableDetachedToBackup(t *testing.T) {
+	localPath := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: localPath}}
+	table := clickhouse.Table{Database: "default", Name: "t", DataPaths: []string{path.Join(localPath, "data", "default", "t") + "/"}}
+	empty := clickhouse.Table{Database: "default", Name: "empty", DataPaths: []string{path.Join(localPath, "data", "default", "empty") + "/"}}
+	writeDetachedPart(t, path.Join(localPath, "data", "default", "t", "detached", "broken_all_1_1_0"), "broken")
+	writeDetachedPart(t, path.Join(localPath, "data", "default", "t", "detached", "ignored_all_2_2_0"), "ignored data")
+
+	parts, size, err := addTableDetachedToBackup("test_backup", disks, &table)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "broken_all_1_1_0", Size: 6}, {Name: "ignored_all_2_2_0", Size: 12}}}, parts)
+	assert.Equal(t, map[string]int64{"default": 18}, size)
+	assert.FileExists(t, path.Join(localPath, "backup", "test_backup", "detached", "default", "t", "default", "broken_all_1_1_0", "data.bin"))
+	assert.FileExists(t, path.Join(localPath, "data", "default", "t", "detached", "broken_all_1_1_0", "data.bin"), "detached parts shall be kept in table")
+
+	parts, size, err = addTableDetachedToBackup("test_backup", disks, &empty)
+	assert.NoError(t, err)
+	assert.Nil(t, parts)
+	assert.Nil(t, size)
+}
+
+func TestDetachedPartsUploadDownload(t *testing.T) {
+	for _, compression := range []string{"tar", "none"} {
+		localPath := t.TempDir()
+		cfg := config.DefaultConfig()
+		cfg.General.RemoteStorage = "s3"
+		cfg.S3.CompressionFormat = compression
+		storage := &memoryStorage{files: map[string][]byte{}}
+		dst, err := new_storage.NewBackupDestination(cfg)
+		assert.NoError(t, err)
+		dst.RemoteStorage = storage
+		b := &Backuper{
+			cfg:             cfg,
+			dst:             dst,
+			DiskToPathMap:   map[string]string{"default": localPath},
+			DefaultDataPath: localPath,
+		}
+		writeDetachedPart(t, path.Join(localPath, "backup", "test_backup", "detached", "default", "t", "default", "broken_all_1_1_0"), "broken")
+		table := metadata.TableMetadata{
+			Database:      "default",
+			Table:         "t",
+			Parts:         map[string][]metadata.Part{"default": {}},
+			Size:          map[string]int64{"default": 6},
+			DetachedParts: map[string][]metadata.Part{"default": {{Name: "broken_all_1_1_0", Size: 6}}},
+		}
+		_, _, err = b.uploadTable(context.Background(), "test_backup", &table, false, true)
+		assert.NoError(t, err)
+		_, err = os.Stat(path.Join(localPath, "backup", "test_backup", "detached", "default", "t", "default"))
+		assert.True(t, os.IsNotExist(err), "uploaded detached parts shall be deleted with --delete-source")
+		if compression == "none" {
+			assert.Contains(t, storage.files, "test_backup/detached/default/t/default/broken_all_1_1_0/data.bin")
+			continue
+		}
+		assert.Contains(t, storage.files, "test_backup/detached/default/t/default.tar")
+
+		b.DiskToPathMap = map[string]string{"default": t.TempDir()}
+		assert.NoError(t, b.downloadTableDetached(metadata.BackupMetadata{BackupName: "test_backup", DataFormat: compression}, table))
+		content, err := ioutil.ReadFile(path.Join(b.DiskToPathMap["default"], "backup", "test_backup", "detached", "default", "t", "default", "broken_all_1_1_0", "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, "broken", string(content))
+	}
+}
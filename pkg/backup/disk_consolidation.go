@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// diskConsolidationMap - disks from disk_mapping which are absent in system.disks and have the same path as existing disk, parts from these disks shall be restored to existing disk
+func diskConsolidationMap(disks []clickhouse.Disk) map[string]string {
+	consolidation := map[string]string{}
+	for _, mappedDisk := range disks {
+		if !mappedDisk.MappedOnly {
+			continue
+		}
+		for _, disk := range disks {
+			if !disk.MappedOnly && path.Clean(disk.Path) == path.Clean(mappedDisk.Path) {
+				consolidation[mappedDisk.Name] = disk.Name
+				break
+			}
+		}
+	}
+	return consolidation
+}
+
+// consolidateTableDisks - move downloaded parts of consolidated disks to the shadow folder of target disk and update table metadata
+func consolidateTableDisks(backupName string, table *metadata.TableMetadata, consolidation, diskToPath map[string]string) error {
+	dbAndTableDir := common.TablePath(table.Database, table.Table)
+	for srcDisk, dstDisk := range consolidation {
+		parts, exists := table.Parts[srcDisk]
+		if !exists {
+			continue
+		}
+		srcDir := path.Join(diskToPath[srcDisk], "backup", backupName, "shadow", dbAndTableDir, srcDisk)
+		dstDir := path.Join(diskToPath[dstDisk], "backup", backupName, "shadow", dbAndTableDir, dstDisk)
+		if err := os.MkdirAll(dstDir, 0750); err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err := os.Rename(path.Join(srcDir, part.Name), path.Join(dstDir, part.Name)); err != nil {
+				return fmt.Errorf("can't move part '%s' from disk '%s' to disk '%s': %v", part.Name, srcDisk, dstDisk, err)
+			}
+		}
+		if err := os.Remove(srcDir); err != nil && !os.IsNotExist(err) {
+			apexLog.Warnf("can't remove %s: %v", srcDir, err)
+		}
+	}
+	mergeTableDisks(table, consolidation)
+	return nil
+}
+
+// mergeTableDisks - move parts, files and size of consolidated disks to target disks in table metadata
+func mergeTableDisks(table *metadata.TableMetadata, consolidation map[string]string) {
+	for srcDisk, dstDisk := range consolidation {
+		if parts, exists := table.Parts[srcDisk]; exists {
+			table.Parts[dstDisk] = append(table.Parts[dstDisk], parts...)
+			delete(table.Parts, srcDisk)
+		}
+		if files, exists := table.Files[srcDisk]; exists {
+			table.Files[dstDisk] = append(table.Files[dstDisk], files...)
+			delete(table.Files, srcDisk)
+		}
+		if size, exists := table.Size[srcDisk]; exists {
+			table.Size[dstDisk] += size
+			delete(table.Size, srcDisk)
+		}
+	}
+}
+
+// resolveBackupDisks - check that all disks used by tables of backup are present in system.disks or disk_mapping, return error with all missing disks before any data is processed, when forceDefaultDisk is true missing disks are mapped to the path of `default` disk
+func resolveBackupDisks(disks []clickhouse.Disk, tables []metadata.TableMetadata, forceDefaultDisk bool) ([]clickhouse.Disk, error) {
+	knownDisks := map[string]string{}
+	availableDisks := make([]string, 0, len(disks))
+	for _, disk := range disks {
+		knownDisks[disk.Name] = disk.Path
+		availableDisks = append(availableDisks, disk.Name)
+	}
+	missingDisks := map[string][]string{}
+	for _, table := range tables {
+		for disk, parts := range table.Parts {
+			// disk without parts doesn't require anything on destination, table could be empty
+			if len(parts) == 0 {
+				continue
+			}
+			if _, exists := knownDisks[disk]; !exists {
+				missingDisks[disk] = append(missingDisks[disk], fmt.Sprintf("%s.%s", table.Database, table.Table))
+			}
+		}
+	}
+	if len(missingDisks) == 0 {
+		return disks, nil
+	}
+	missingDiskNames := make([]string, 0, len(missingDisks))
+	for disk := range missingDisks {
+		missingDiskNames = append(missingDiskNames, disk)
+	}
+	sort.Strings(missingDiskNames)
+	defaultPath, defaultExists := knownDisks["default"]
+	if !forceDefaultDisk || !defaultExists {
+		sort.Strings(availableDisks)
+		missing := make([]string, 0, len(missingDiskNames))
+		for _, disk := range missingDiskNames {
+			sort.Strings(missingDisks[disk])
+			missing = append(missing, fmt.Sprintf("disk '%s' used by %s", disk, strings.Join(missingDisks[disk], ", ")))
+		}
+		return nil, fmt.Errorf("backup requires disks which are not found in system.disks and disk_mapping: %s; available disks: %s; add missing disks to disk_mapping config or use --force-default-disk", strings.Join(missing, "; "), strings.Join(availableDisks, ", "))
+	}
+	resolvedDisks := append([]clickhouse.Disk{}, disks...)
+	for _, disk := range missingDiskNames {
+		apexLog.Warnf("disk '%s' is not found in system.disks and disk_mapping, its parts will be restored to disk 'default'", disk)
+		resolvedDisks = append(resolvedDisks, clickhouse.Disk{
+			Name:       disk,
+			Path:       defaultPath,
+			Type:       "local",
+			MappedOnly: true,
+		})
+	}
+	return resolvedDisks, nil
+}
+
+// consolidateBackupDisks - move parts from consolidated disks of local backup to target disks and save changed table metadata, tables could be filtered by partitions so full table metadata is loaded from local backup
+func consolidateBackupDisks(backupName, defaultDataPath string, tables []metadata.TableMetadata, disks []clickhouse.Disk) error {
+	consolidation := diskConsolidationMap(disks)
+	if len(consolidation) == 0 {
+		return nil
+	}
+	diskToPath := map[string]string{}
+	for _, disk := range disks {
+		diskToPath[disk.Name] = disk.Path
+	}
+	consolidatedSize := map[string]int64{}
+	for i := range tables {
+		if tables[i].MetadataOnly {
+			continue
+		}
+		metadataLocalFile := path.Join(defaultDataPath, "backup", backupName, "metadata", common.TableMetadataPath(tables[i].Database, tables[i].Table))
+		tableMetadata := metadata.TableMetadata{}
+		if _, err := tableMetadata.Load(metadataLocalFile); err != nil {
+			return err
+		}
+		consolidated := false
+		for srcDisk := range consolidation {
+			if _, exists := tableMetadata.Parts[srcDisk]; exists {
+				consolidated = true
+				consolidatedSize[srcDisk] += tableMetadata.Size[srcDisk]
+			}
+		}
+		if !consolidated {
+			mergeTableDisks(&tables[i], consolidation)
+			continue
+		}
+		if err := consolidateTableDisks(backupName, &tableMetadata, consolidation, diskToPath); err != nil {
+			return err
+		}
+		if _, err := tableMetadata.Save(metadataLocalFile, false); err != nil {
+			return err
+		}
+		mergeTableDisks(&tables[i], consolidation)
+	}
+	srcDisks := make([]string, 0, len(consolidation))
+	for srcDisk := range consolidation {
+		srcDisks = append(srcDisks, srcDisk)
+	}
+	sort.Strings(srcDisks)
+	for _, srcDisk := range srcDisks {
+		dstDisk := consolidation[srcDisk]
+		apexLog.Warnf("parts from disk '%s' (%s) are consolidated into disk '%s', make sure %s has enough free space", srcDisk, utils.FormatBytes(uint64(consolidatedSize[srcDisk])), dstDisk, diskToPath[dstDisk])
+	}
+	return nil
+}
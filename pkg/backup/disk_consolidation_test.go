@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskConsolidationMap(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/"},
+		{Name: "hdd1", Path: "/var/lib/clickhouse", MappedOnly: true},
+		{Name: "hdd2", Path: "/var/lib/clickhouse/", MappedOnly: true},
+		{Name: "hdd3", Path: "/mnt/hdd3", MappedOnly: true},
+	}
+	assert.Equal(t, map[string]string{"hdd1": "default", "hdd2": "default"}, diskConsolidationMap(disks))
+	assert.Empty(t, diskConsolidationMap(disks[:1]))
+}
+
+func TestConsolidateTableDisks(t *testing.T) {
+	diskPath := t.TempDir()
+	diskToPath := map[string]string{"default": diskPath, "hdd1": diskPath, "hdd2": diskPath}
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}},
+			"hdd1":    {{Name: "all_2_2_0"}},
+			"hdd2":    {{Name: "all_3_3_0"}, {Name: "all_4_4_0"}},
+		},
+		Size: map[string]int64{"default": 1, "hdd1": 2, "hdd2": 3},
+	}
+	shadowPath := path.Join(diskPath, "backup", "backup1", "shadow", "db", "t")
+	for disk, parts := range table.Parts {
+		for _, part := range parts {
+			assert.NoError(t, os.MkdirAll(path.Join(shadowPath, disk, part.Name), 0750))
+		}
+	}
+
+	err := consolidateTableDisks("backup1", &table, map[string]string{"hdd1": "default", "hdd2": "default"}, diskToPath)
+	assert.NoError(t, err)
+	assert.Len(t, table.Parts, 1)
+	assert.Len(t, table.Parts["default"], 4)
+	assert.Equal(t, map[string]int64{"default": 6}, table.Size)
+	for _, part := range table.Parts["default"] {
+		assert.DirExists(t, path.Join(shadowPath, "default", part.Name))
+	}
+	assert.NoDirExists(t, path.Join(shadowPath, "hdd1"))
+	assert.NoDirExists(t, path.Join(shadowPath, "hdd2"))
+
+	table.Parts["hdd1"] = []metadata.Part{{Name: "all_5_5_0"}}
+	assert.Error(t, consolidateTableDisks("backup1", &table, map[string]string{"hdd1": "default"}, diskToPath))
+}
+
+func TestResolveBackupDisks(t *testing.T) {
+	disks := []clickhouse.Disk{{Name: "default", Path: "/var/lib/clickhouse"}, {Name: "hot", Path: "/mnt/hot"}}
+	tables := []metadata.TableMetadata{
+		{Database: "db", Table: "t1", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}, "cold": {{Name: "all_2_2_0"}}}},
+		{Database: "db", Table: "t2", Parts: map[string][]metadata.Part{"cold": {{Name: "all_1_1_0"}}, "archive": {{Name: "all_2_2_0"}}}},
+		{Database: "db", Table: "t3", Parts: map[string][]metadata.Part{"hot": {{Name: "all_1_1_0"}}}},
+	}
+
+	resolved, err := resolveBackupDisks(disks, tables[2:], false)
+	assert.NoError(t, err)
+	assert.Equal(t, disks, resolved)
+
+	_, err = resolveBackupDisks(disks, tables, false)
+	assert.EqualError(t, err, "backup requires disks which are not found in system.disks and disk_mapping: disk 'archive' used by db.t2; disk 'cold' used by db.t1, db.t2; available disks: default, hot; add missing disks to disk_mapping config or use --force-default-disk")
+
+	resolved, err = resolveBackupDisks(disks, tables, true)
+	assert.NoError(t, err)
+	assert.Len(t, resolved, 4)
+	assert.Equal(t, map[string]string{"archive": "default", "cold": "default"}, diskConsolidationMap(resolved))
+
+	_, err = resolveBackupDisks(disks[1:], tables, true)
+	assert.Error(t, err)
+}
+
+func TestConsolidateBackupDisksFilteredTable(t *testing.T) {
+	diskPath := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}, {Name: "cold", Path: diskPath, MappedOnly: true}}
+	full := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Parts:    map[string][]metadata.Part{"cold": {{Name: "1_1_1_0"}, {Name: "2_2_2_0"}}},
+		Size:     map[string]int64{"cold": 2},
+	}
+	metadataFile := path.Join(diskPath, "backup", "backup1", "metadata", "db", "t.json")
+	_, err := full.Save(metadataFile, false)
+	assert.NoError(t, err)
+	for _, part := range full.Parts["cold"] {
+		assert.NoError(t, os.MkdirAll(path.Join(diskPath, "backup", "backup1", "shadow", "db", "t", "cold", part.Name), 0750))
+	}
+	filtered := []metadata.TableMetadata{{Database: "db", Table: "t", Parts: map[string][]metadata.Part{"cold": {{Name: "2_2_2_0"}}}}}
+
+	assert.NoError(t, consolidateBackupDisks("backup1", diskPath, filtered, disks))
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "2_2_2_0"}}}, filtered[0].Parts)
+	saved := metadata.TableMetadata{}
+	_, err = saved.Load(metadataFile)
+	assert.NoError(t, err)
+	assert.Len(t, saved.Parts["default"], 2)
+	assert.DirExists(t, path.Join(diskPath, "backup", "backup1", "shadow", "db", "t", "default", "1_1_1_0"))
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	apexLog "github.com/apex/log"
+)
+
+// distributedArgRe - one argument of Distributed engine, quoted string, identifier or function call without arguments like currentDatabase()
+const distributedArgRe = "('[^']*'|\"[^\"]*\"|`[^`]*`|[^,\\s()]+(?:\\(\\))?)"
+
+// distributedEngineRe - match first three arguments of Distributed engine: cluster, database and table
+var distributedEngineRe = regexp.MustCompile(`(?i)ENGINE\s*=\s*Distributed\s*\(\s*` + distributedArgRe + `\s*,\s*` + distributedArgRe + `\s*,\s*` + distributedArgRe)
+
+// distributedEngine - arguments of Distributed table engine
+type distributedEngine struct {
+	Cluster  string
+	Database string
+	Table    string
+	// clusterStart, clusterEnd - position of cluster argument in create query, including quotes
+	clusterStart int
+	clusterEnd   int
+}
+
+// parseDistributedEngine - extract cluster, database and table from create query of Distributed table, return false for other engines
+func parseDistributedEngine(query string) (distributedEngine, bool) {
+	match := distributedEngineRe.FindStringSubmatchIndex(query)
+	if match == nil {
+		return distributedEngine{}, false
+	}
+	return distributedEngine{
+		Cluster:      unquoteIdentifier(query[match[2]:match[3]]),
+		Database:     unquoteIdentifier(query[match[4]:match[5]]),
+		Table:        unquoteIdentifier(query[match[6]:match[7]]),
+		clusterStart: match[2],
+		clusterEnd:   match[3],
+	}, true
+}
+
+func unquoteIdentifier(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"' || s[0] == '`') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// validateDistributedTables - check clusters of Distributed tables exist in destination system.clusters,
+// cluster is replaced by replacementCluster when it is defined, otherwise all tables with missing clusters are reported in one error
+func validateDistributedTables(tables ListOfTables, clusters []string, replacementCluster string) error {
+	existingClusters := make(map[string]struct{}, len(clusters))
+	for _, cluster := range clusters {
+		existingClusters[cluster] = struct{}{}
+	}
+	var missing []string
+	for i := range tables {
+		engine, isDistributed := parseDistributedEngine(tables[i].Query)
+		if !isDistributed {
+			continue
+		}
+		if strings.Contains(engine.Cluster, "{") {
+			// cluster defined via macros is resolved by clickhouse-server during CREATE
+			continue
+		}
+		if _, exists := existingClusters[engine.Cluster]; exists {
+			continue
+		}
+		if replacementCluster != "" {
+			apexLog.Warnf("cluster '%s' of `%s`.`%s` not found in system.clusters, replaced with '%s'", engine.Cluster, tables[i].Database, tables[i].Table, replacementCluster)
+			tables[i].Query = tables[i].Query[:engine.clusterStart] + "'" + replacementCluster + "'" + tables[i].Query[engine.clusterEnd:]
+			continue
+		}
+		missing = append(missing, fmt.Sprintf("cluster '%s' used by `%s`.`%s` -> `%s`.`%s`", engine.Cluster, tables[i].Database, tables[i].Table, engine.Database, engine.Table))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("distributed tables reference clusters which are not found in system.clusters: %s; available clusters: %s; set restore_distributed_cluster config option to remap them", strings.Join(missing, "; "), strings.Join(clusters, ", "))
+	}
+	return nil
+}
+
+// hasDistributedTables - return true when any table uses Distributed engine
+func hasDistributedTables(tables ListOfTables) bool {
+	for _, table := range tables {
+		if _, isDistributed := parseDistributedEngine(table.Query); isDistributed {
+			return true
+		}
+	}
+	return false
+}
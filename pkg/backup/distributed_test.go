@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDistributedEngine(t *testing.T) {
+	engine, ok := parseDistributedEngine("CREATE TABLE default.events_all (id UInt64) ENGINE = Distributed('prod', 'default', 'events', rand())")
+	assert.True(t, ok)
+	assert.Equal(t, "prod", engine.Cluster)
+	assert.Equal(t, "default", engine.Database)
+	assert.Equal(t, "events", engine.Table)
+
+	engine, ok = parseDistributedEngine("CREATE TABLE default.events_all (id UInt64) ENGINE=Distributed(`{cluster}`,currentDatabase(),events)")
+	assert.True(t, ok)
+	assert.Equal(t, "{cluster}", engine.Cluster)
+	assert.Equal(t, "currentDatabase()", engine.Database)
+	assert.Equal(t, "events", engine.Table)
+
+	_, ok = parseDistributedEngine("CREATE TABLE default.events (id UInt64) ENGINE = MergeTree ORDER BY id")
+	assert.False(t, ok)
+}
+
+func TestValidateDistributedTables(t *testing.T) {
+	newTables := func() ListOfTables {
+		return ListOfTables{
+			{Database: "default", Table: "events", Query: "CREATE TABLE default.events (id UInt64) ENGINE = MergeTree ORDER BY id"},
+			{Database: "default", Table: "events_all", Query: "CREATE TABLE default.events_all (id UInt64) ENGINE = Distributed('old_cluster', 'default', 'events', rand())"},
+			{Database: "default", Table: "events_macro", Query: "CREATE TABLE default.events_macro (id UInt64) ENGINE = Distributed('{cluster}', 'default', 'events')"},
+			{Database: "default", Table: "events_local", Query: "CREATE TABLE default.events_local (id UInt64) ENGINE = Distributed('new_cluster', 'default', 'events')"},
+		}
+	}
+	clusters := []string{"new_cluster", "test_shard_localhost"}
+	assert.True(t, hasDistributedTables(newTables()))
+	assert.False(t, hasDistributedTables(newTables()[:1]))
+
+	err := validateDistributedTables(newTables(), clusters, "")
+	assert.EqualError(t, err, "distributed tables reference clusters which are not found in system.clusters: cluster 'old_cluster' used by `default`.`events_all` -> `default`.`events`; available clusters: new_cluster, test_shard_localhost; set restore_distributed_cluster config option to remap them")
+
+	tables := newTables()
+	assert.NoError(t, validateDistributedTables(tables, clusters, "new_cluster"))
+	assert.Equal(t, "CREATE TABLE default.events_all (id UInt64) ENGINE = Distributed('new_cluster', 'default', 'events', rand())", tables[1].Query)
+	assert.Equal(t, newTables()[2].Query, tables[2].Query)
+	assert.Equal(t, newTables()[3].Query, tables[3].Query)
+}
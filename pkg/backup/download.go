@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
@@ -28,13 +30,12 @@ import (
 
 var (
 	ErrBackupIsAlreadyExists = errors.New("backup is already exists")
+	// ErrBackupNotFound - backup is absent on local storage, absent remote backup is new_storage.ErrNotFound
+	ErrBackupNotFound = errors.New("backup is not found")
 )
 
-func legacyDownload(cfg *config.Config, defaultDataPath, backupName string) error {
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "download_legacy",
-	})
+func legacyDownload(cfg *config.Config, defaultDataPath, backupName string, log *apexLog.Entry) error {
+	log = log.WithField("operation", "download_legacy")
 	bd, err := legacyStorage.NewBackupDestination(cfg)
 	if err != nil {
 		return err
@@ -50,34 +51,42 @@ func legacyDownload(cfg *config.Config, defaultDataPath, backupName string) erro
 	return nil
 }
 
-func (b *Backuper) Download(backupName string, tablePattern string, partitions []string, schemaOnly bool) error {
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "download",
-	})
+// Download - download remote backup into `backup` folder of ClickHouse data path, or into `<to>/backup` without ClickHouse when `to` is set
+func (b *Backuper) Download(backupName string, tablePattern string, partitions []string, schemaOnly, forceDefaultDisk bool, to string) (err error) {
+	log := operationLog(b.OperationID, backupName, "download")
 	if b.cfg.General.RemoteStorage == "none" {
 		return fmt.Errorf("remote storage is 'none'")
 	}
 	if backupName == "" {
-		_ = PrintRemoteBackups(b.cfg, "all")
+		_ = PrintRemoteBackups(b.cfg, "", "all", "", false, false, BackupDateWindow{})
 		return fmt.Errorf("select backup for download")
 	}
-	localBackups, err := GetLocalBackups(b.cfg)
-	if err != nil {
-		return err
-	}
-	for i := range localBackups {
-		if backupName == localBackups[i].BackupName {
+	startDownload := time.Now()
+	defer func() { logBackupOperation(b.cfg, "download", backupName, startDownload, err) }()
+	if to != "" {
+		if err := b.initDownloadTo(to); err != nil {
+			return err
+		}
+		if _, err := os.Stat(path.Join(b.DefaultDataPath, "backup", backupName)); err == nil {
 			return ErrBackupIsAlreadyExists
 		}
-	}
-	startDownload := time.Now()
-	if err := b.ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
-	}
-	defer b.ch.Close()
-	if err := b.init(); err != nil {
-		return err
+	} else {
+		localBackups, err := GetLocalBackups(b.cfg)
+		if err != nil {
+			return err
+		}
+		for i := range localBackups {
+			if backupName == localBackups[i].BackupName {
+				return ErrBackupIsAlreadyExists
+			}
+		}
+		if err := b.ch.Connect(); err != nil {
+			return fmt.Errorf("can't connect to clickhouse: %w", err)
+		}
+		defer b.ch.Close()
+		if err := b.init(); err != nil {
+			return err
+		}
 	}
 	remoteBackups, err := b.dst.BackupList(true, backupName)
 	if err != nil {
@@ -93,7 +102,7 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 		}
 	}
 	if !found {
-		return fmt.Errorf("'%s' is not found on remote storage", backupName)
+		return fmt.Errorf("'%s' is not found on remote storage: %w", backupName, new_storage.ErrNotFound)
 	}
 	//look https://github.com/AlexAkulov/clickhouse-backup/discussions/266 need download legacy before check for empty backup
 	if remoteBackup.Legacy {
@@ -104,16 +113,20 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 			return fmt.Errorf("'%s' is old format backup and doesn't supports download of schema only", backupName)
 		}
 		log.Warnf("'%s' is old-format backup", backupName)
-		return legacyDownload(b.cfg, b.DefaultDataPath, backupName)
+		return legacyDownload(b.cfg, b.DefaultDataPath, backupName, log)
 	}
 	if len(remoteBackup.Tables) == 0 && !b.cfg.General.AllowEmptyBackups {
 		return fmt.Errorf("'%s' is empty backup", backupName)
 	}
-	tablesForDownload := parseTablePatternForDownload(remoteBackup.Tables, tablePattern)
+	if remoteBackup.SchemaOnly && !schemaOnly {
+		log.Info("schema-only backup, data download will be skipped")
+		schemaOnly = true
+	}
+	tablesForDownload := parseTablePatternForDownload(remoteBackup.Tables, tablePattern, b.cfg.ClickHouse.SkipTables)
 	tableMetadataForDownload := make([]metadata.TableMetadata, len(tablesForDownload))
 
 	if !schemaOnly && !b.cfg.General.DownloadByPart && remoteBackup.RequiredBackup != "" {
-		err := b.Download(remoteBackup.RequiredBackup, tablePattern, partitions, schemaOnly)
+		err := b.Download(remoteBackup.RequiredBackup, tablePattern, partitions, schemaOnly, forceDefaultDisk, to)
 		if err != nil && err != ErrBackupIsAlreadyExists {
 			return err
 		}
@@ -125,6 +138,11 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 	if err != nil {
 		return err
 	}
+	unlock, err := lockBackup(path.Join(b.DefaultDataPath, "backup"), backupName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	partitionsToDownloadMap := filesystemhelper.CreatePartitionsToBackupMap(partitions)
 
 	log.Debugf("prepare table METADATA concurrent semaphore with concurrency=%d len(tableMetadataForDownload)=%d", b.cfg.General.DownloadConcurrency, len(tableMetadataForDownload))
@@ -140,7 +158,7 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 		tableTitle := t
 		g.Go(func() error {
 			defer s.Release(1)
-			downloadedMetadata, size, err := b.downloadTableMetadata(backupName, log, tableTitle, schemaOnly, partitionsToDownloadMap)
+			downloadedMetadata, size, err := b.downloadTableMetadata(backupName, log, tableTitle, schemaOnly, partitionsToDownloadMap.ForTable(tableTitle.Database, tableTitle.Table))
 			if err != nil {
 				return err
 			}
@@ -150,16 +168,25 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return fmt.Errorf("one of Download Metadata go-routine return error: %v", err)
+		return fmt.Errorf("one of Download Metadata go-routine return error: %w", err)
 	}
 	if !schemaOnly {
-		for _, t := range tableMetadataForDownload {
-			for disk := range t.Parts {
-				if _, diskExists := b.DiskToPathMap[disk]; !diskExists {
-					return fmt.Errorf("table '%s.%s' require disk '%s' that not found in clickhouse table system.disks, you can add nonexistent disks to disk_mapping config", t.Database, t.Table, disk)
-				}
+		var disks []clickhouse.Disk
+		if to != "" {
+			disks = downloadToDisks(b.DefaultDataPath, tableMetadataForDownload)
+		} else {
+			if disks, err = b.ch.GetDisks(); err != nil {
+				return err
+			}
+			if disks, err = resolveBackupDisks(disks, tableMetadataForDownload, forceDefaultDisk); err != nil {
+				return err
 			}
 		}
+		for _, disk := range disks {
+			b.DiskToPathMap[disk.Name] = disk.Path
+		}
+		b.progress.Start(!b.cfg.General.DisableProgressBar, downloadProgressTotal(remoteBackup.BackupMetadata, tableMetadataForDownload))
+		defer b.progress.Finish()
 		log.Debugf("prepare table SHADOW concurrent semaphore with concurrency=%d len(tableMetadataForDownload)=%d", b.cfg.General.DownloadConcurrency, len(tableMetadataForDownload))
 		s := semaphore.NewWeighted(int64(b.cfg.General.DownloadConcurrency))
 		g, ctx := errgroup.WithContext(context.Background())
@@ -190,17 +217,22 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 			})
 		}
 		if err := g.Wait(); err != nil {
-			return fmt.Errorf("one of Download go-routine return error: %v", err)
+			return fmt.Errorf("one of Download go-routine return error: %w", err)
+		}
+		if to == "" {
+			if err := consolidateBackupDisks(backupName, b.DefaultDataPath, tableMetadataForDownload, disks); err != nil {
+				return fmt.Errorf("can't consolidate disks: %w", err)
+			}
 		}
 	}
 	rbacSize, err := b.downloadRBACData(remoteBackup)
 	if err != nil {
-		return fmt.Errorf("download RBAC error: %v", err)
+		return fmt.Errorf("download RBAC error: %w", err)
 	}
 
 	configSize, err := b.downloadConfigData(remoteBackup)
 	if err != nil {
-		return fmt.Errorf("download CONFIGS error: %v", err)
+		return fmt.Errorf("download CONFIGS error: %w", err)
 	}
 
 	backupMetadata := remoteBackup.BackupMetadata
@@ -212,6 +244,7 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 	backupMetadata.RequiredBackup = ""
 	backupMetadata.ConfigSize = configSize
 	backupMetadata.RBACSize = rbacSize
+	backupMetadata.SchemaOnly = schemaOnly
 
 	backupMetafileLocalPath := path.Join(b.DefaultDataPath, "backup", backupName, "metadata.json")
 	if err := backupMetadata.Save(backupMetafileLocalPath); err != nil {
@@ -224,8 +257,30 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 	return nil
 }
 
+// downloadToDisks - all disks of downloaded tables are placed into `download --to` directory, disk folders of each table keep parts apart
+func downloadToDisks(to string, tables []metadata.TableMetadata) []clickhouse.Disk {
+	names := map[string]bool{}
+	for _, table := range tables {
+		for disk := range table.Parts {
+			names[disk] = true
+		}
+		for disk := range table.Files {
+			names[disk] = true
+		}
+		for disk := range table.DetachedParts {
+			names[disk] = true
+		}
+	}
+	disks := make([]clickhouse.Disk, 0, len(names))
+	for name := range names {
+		disks = append(disks, clickhouse.Disk{Name: name, Path: to})
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Name < disks[j].Name })
+	return disks
+}
+
 func (b *Backuper) downloadTableMetadataIfNotExists(backupName string, log *apexLog.Entry, tableTitle metadata.TableTitle) (*metadata.TableMetadata, error) {
-	metadataLocalFile := path.Join(b.DefaultDataPath, "backup", backupName, "metadata", common.TablePathEncode(tableTitle.Database), fmt.Sprintf("%s.json", common.TablePathEncode(tableTitle.Table)))
+	metadataLocalFile := path.Join(b.DefaultDataPath, "backup", backupName, "metadata", common.TableMetadataPath(tableTitle.Database, tableTitle.Table))
 	tm := &metadata.TableMetadata{}
 	if _, err := tm.Load(metadataLocalFile); err == nil {
 		return tm, nil
@@ -237,7 +292,7 @@ func (b *Backuper) downloadTableMetadataIfNotExists(backupName string, log *apex
 func (b *Backuper) downloadTableMetadata(backupName string, log *apexLog.Entry, tableTitle metadata.TableTitle, schemaOnly bool, partitionsFilter common.EmptyMap) (*metadata.TableMetadata, uint64, error) {
 	start := time.Now()
 	size := uint64(0)
-	remoteTableMetadata := path.Join(backupName, "metadata", common.TablePathEncode(tableTitle.Database), fmt.Sprintf("%s.json", common.TablePathEncode(tableTitle.Table)))
+	remoteTableMetadata := path.Join(backupName, "metadata", common.TableMetadataPath(tableTitle.Database, tableTitle.Table))
 	tmReader, err := b.dst.GetFileReader(remoteTableMetadata)
 	if err != nil {
 		return nil, 0, err
@@ -256,7 +311,7 @@ func (b *Backuper) downloadTableMetadata(backupName string, log *apexLog.Entry,
 	}
 	filterPartsByPartitionsFilter(tableMetadata, partitionsFilter)
 	// save metadata
-	metadataLocalFile := path.Join(b.DefaultDataPath, "backup", backupName, "metadata", common.TablePathEncode(tableTitle.Database), fmt.Sprintf("%s.json", common.TablePathEncode(tableTitle.Table)))
+	metadataLocalFile := path.Join(b.DefaultDataPath, "backup", backupName, "metadata", common.TableMetadataPath(tableTitle.Database, tableTitle.Table))
 	size, err = tableMetadata.Save(metadataLocalFile, schemaOnly)
 	if err != nil {
 		return nil, 0, err
@@ -282,7 +337,7 @@ func (b *Backuper) downloadBackupRelatedDir(remoteBackup new_storage.Backup, pre
 	localDir := path.Join(b.DefaultDataPath, "backup", remoteBackup.BackupName, prefix)
 	remoteFileInfo, err := b.dst.StatFile(remoteFile)
 	if err != nil {
-		apexLog.Debugf("%s not exists on remote storage, skip download", remoteFile)
+		b.logger().Debugf("%s not exists on remote storage, skip download", remoteFile)
 		return 0, nil
 	}
 	if err = b.dst.CompressedStreamDownload(remoteFile, localDir); err != nil {
@@ -292,34 +347,84 @@ func (b *Backuper) downloadBackupRelatedDir(remoteBackup new_storage.Backup, pre
 }
 
 func (b *Backuper) downloadTableData(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata) error {
-	dbAndTableDir := path.Join(common.TablePathEncode(table.Database), common.TablePathEncode(table.Table))
+	dbAndTableDir := common.TablePath(table.Database, table.Table)
 
 	s := semaphore.NewWeighted(int64(b.cfg.General.DownloadConcurrency))
 	g, ctx := errgroup.WithContext(context.Background())
 
 	if remoteBackup.DataFormat != "directory" {
+		dst := b.tableDestination(table)
 		capacity := 0
 		for disk := range table.Files {
 			capacity += len(table.Files[disk])
 		}
-		apexLog.Debugf("start downloadTableData %s.%s with concurrency=%d len(table.Files[...])=%d", table.Database, table.Table, b.cfg.General.DownloadConcurrency, capacity)
+		b.logger().Debugf("start downloadTableData %s.%s with concurrency=%d len(table.Files[...])=%d", table.Database, table.Table, b.cfg.General.DownloadConcurrency, capacity)
 
 		for disk := range table.Files {
 			backupPath := b.DiskToPathMap[disk]
 			tableLocalDir := path.Join(backupPath, "backup", remoteBackup.BackupName, "shadow", dbAndTableDir, disk)
 			for _, archiveFile := range table.Files[disk] {
 				if err := s.Acquire(ctx, 1); err != nil {
-					apexLog.Errorf("can't acquire semaphore during downloadTableData: %v", err)
+					b.logger().Errorf("can't acquire semaphore during downloadTableData: %v", err)
 					break
 				}
-				tableRemoteFile := path.Join(remoteBackup.BackupName, "shadow", common.TablePathEncode(table.Database), common.TablePathEncode(table.Table), archiveFile)
+				tableRemoteFile := path.Join(remoteBackup.BackupName, "shadow", common.TablePath(table.Database, table.Table), archiveFile)
+				var tableRemoteParts []string
+				for _, archivePart := range table.ArchiveParts[archiveFile] {
+					tableRemoteParts = append(tableRemoteParts, path.Join(path.Dir(tableRemoteFile), archivePart))
+				}
 				g.Go(func() error {
-					apexLog.Debugf("start download from %s", tableRemoteFile)
+					b.logger().Debugf("start download from %s", tableRemoteFile)
 					defer s.Release(1)
-					if err := b.dst.CompressedStreamDownload(tableRemoteFile, tableLocalDir); err != nil {
+					if len(tableRemoteParts) > 0 {
+						if err := dst.CompressedStreamDownloadParts(tableRemoteParts, tableLocalDir); err != nil {
+							return err
+						}
+					} else if err := dst.CompressedStreamDownload(tableRemoteFile, tableLocalDir); err != nil {
 						return err
 					}
-					apexLog.Debugf("finish download from %s", tableRemoteFile)
+					b.logger().Debugf("finish download from %s", tableRemoteFile)
+					return nil
+				})
+			}
+		}
+		for disk, parts := range table.Parts {
+			for _, part := range parts {
+				if part.RefKey != "" {
+					if err := s.Acquire(ctx, 1); err != nil {
+						b.logger().Errorf("can't acquire semaphore during downloadTableData: %v", err)
+						break
+					}
+					// archive of referenced part contains part folder as archives of this table do
+					refKey := part.RefKey
+					tableLocalDir := path.Join(b.DiskToPathMap[disk], "backup", remoteBackup.BackupName, "shadow", dbAndTableDir, disk)
+					g.Go(func() error {
+						defer s.Release(1)
+						b.logger().Debugf("start download from %s", refKey)
+						if err := dst.CompressedStreamDownload(refKey, tableLocalDir); err != nil {
+							return err
+						}
+						b.logger().Debugf("finish download from %s", refKey)
+						return nil
+					})
+					continue
+				}
+				if part.SharedKey == "" {
+					continue
+				}
+				if err := s.Acquire(ctx, 1); err != nil {
+					b.logger().Errorf("can't acquire semaphore during downloadTableData: %v", err)
+					break
+				}
+				sharedKey := part.SharedKey
+				partLocalDir := path.Join(b.DiskToPathMap[disk], "backup", remoteBackup.BackupName, "shadow", dbAndTableDir, disk, part.Name)
+				g.Go(func() error {
+					defer s.Release(1)
+					b.logger().Debugf("start download from %s", sharedKey)
+					if err := dst.CompressedStreamDownload(sharedKey, partLocalDir); err != nil {
+						return err
+					}
+					b.logger().Debugf("finish download from %s", sharedKey)
 					return nil
 				})
 			}
@@ -329,28 +434,32 @@ func (b *Backuper) downloadTableData(remoteBackup metadata.BackupMetadata, table
 		for disk := range table.Parts {
 			capacity += len(table.Parts[disk])
 		}
-		apexLog.Debugf("start downloadTableData %s.%s with concurrency=%d len(table.Parts[...])=%d", table.Database, table.Table, b.cfg.General.DownloadConcurrency, capacity)
+		b.logger().Debugf("start downloadTableData %s.%s with concurrency=%d len(table.Parts[...])=%d", table.Database, table.Table, b.cfg.General.DownloadConcurrency, capacity)
 		for disk := range table.Parts {
+			// remote path is absent for disk without parts
+			if len(table.Parts[disk]) == 0 {
+				continue
+			}
 			if err := s.Acquire(ctx, 1); err != nil {
-				apexLog.Errorf("can't acquire semaphore during downloadTableData: %v", err)
+				b.logger().Errorf("can't acquire semaphore during downloadTableData: %v", err)
 				break
 			}
 			tableRemotePath := path.Join(remoteBackup.BackupName, "shadow", dbAndTableDir, disk)
 			diskPath := b.DiskToPathMap[disk]
 			tableLocalDir := path.Join(diskPath, "backup", remoteBackup.BackupName, "shadow", dbAndTableDir, disk)
 			g.Go(func() error {
-				apexLog.Debugf("start download from %s to %s", tableLocalDir, tableRemotePath)
+				b.logger().Debugf("start download from %s to %s", tableLocalDir, tableRemotePath)
 				defer s.Release(1)
-				if err := b.dst.DownloadPath(0, tableRemotePath, tableLocalDir); err != nil {
+				if err := b.dst.DownloadPath(tableRemotePath, tableLocalDir); err != nil {
 					return err
 				}
-				apexLog.Debugf("finish download from %s to %s", tableLocalDir, tableRemotePath)
+				b.logger().Debugf("finish download from %s to %s", tableLocalDir, tableRemotePath)
 				return nil
 			})
 		}
 	}
 	if err := g.Wait(); err != nil {
-		return fmt.Errorf("one of downloadTableData go-routine return error: %v", err)
+		return fmt.Errorf("one of downloadTableData go-routine return error: %w", err)
 	}
 
 	err := b.downloadDiffParts(remoteBackup, table, dbAndTableDir)
@@ -358,11 +467,45 @@ func (b *Backuper) downloadTableData(remoteBackup metadata.BackupMetadata, table
 		return err
 	}
 
+	return b.downloadTableDetached(remoteBackup, table)
+}
+
+// downloadTableDetached - download detached parts of table uploaded by uploadTableDetached
+func (b *Backuper) downloadTableDetached(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata) error {
+	baseRemotePath := path.Join(remoteBackup.BackupName, "detached", common.TablePath(table.Database, table.Table))
+	for disk := range table.DetachedParts {
+		diskPath, exists := b.DiskToPathMap[disk]
+		if !exists {
+			b.logger().Warnf("disk '%s' is not found, skip download detached parts of '%s.%s'", disk, table.Database, table.Table)
+			continue
+		}
+		localPath := path.Join(diskPath, "backup", remoteBackup.BackupName, "detached", common.TablePath(table.Database, table.Table), disk)
+		if remoteBackup.DataFormat == "directory" {
+			if err := b.dst.DownloadPath(path.Join(baseRemotePath, disk), localPath); err != nil {
+				return fmt.Errorf("can't download detached parts: %w", err)
+			}
+			continue
+		}
+		archiveName := detachedArchiveName(disk, tableArchiveExtension(table, config.ArchiveExtensions[remoteBackup.DataFormat]))
+		var remoteParts []string
+		for _, archivePart := range table.ArchiveParts[archiveName] {
+			remoteParts = append(remoteParts, path.Join(baseRemotePath, archivePart))
+		}
+		var err error
+		if len(remoteParts) > 0 {
+			err = b.tableDestination(table).CompressedStreamDownloadParts(remoteParts, localPath)
+		} else {
+			err = b.tableDestination(table).CompressedStreamDownload(path.Join(baseRemotePath, path.Base(archiveName)), localPath)
+		}
+		if err != nil {
+			return fmt.Errorf("can't download detached parts: %w", err)
+		}
+	}
 	return nil
 }
 
 func (b *Backuper) downloadDiffParts(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata, dbAndTableDir string) error {
-	log := apexLog.WithField("operation", "downloadDiffParts")
+	log := b.logger().WithField("operation", "downloadDiffParts")
 	log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).Debugf("start")
 	start := time.Now()
 	s := semaphore.NewWeighted(int64(b.cfg.General.DownloadConcurrency))
@@ -383,7 +526,7 @@ func (b *Backuper) downloadDiffParts(remoteBackup metadata.BackupMetadata, table
 			existsPath := path.Join(b.DiskToPathMap[disk], "backup", remoteBackup.RequiredBackup, "shadow", dbAndTableDir, disk, part.Name)
 			_, err := os.Stat(existsPath)
 			if err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("%s stat return error: %v", existsPath, err)
+				return fmt.Errorf("%s stat return error: %w", existsPath, err)
 			}
 			if err != nil && os.IsNotExist(err) {
 				if err := s.Acquire(ctx, 1); err != nil {
@@ -406,19 +549,19 @@ func (b *Backuper) downloadDiffParts(remoteBackup metadata.BackupMetadata, table
 						}
 					}
 					if err = makePartHardlinks(existsPath, newPath); err != nil {
-						return fmt.Errorf("can't to add link to exists part %s -> %s error: %v", newPath, existsPath, err)
+						return fmt.Errorf("can't to add link to exists part %s -> %s error: %w", newPath, existsPath, err)
 					}
 					return nil
 				})
 			} else {
 				if err = makePartHardlinks(existsPath, newPath); err != nil {
-					return fmt.Errorf("can't to add exists part: %v", err)
+					return fmt.Errorf("can't to add exists part: %w", err)
 				}
 			}
 		}
 	}
 	if err := g.Wait(); err != nil {
-		return fmt.Errorf("one of downloadDiffParts go-routine return error: %v", err)
+		return fmt.Errorf("one of downloadDiffParts go-routine return error: %w", err)
 	}
 	log.WithField("duration", utils.HumanizeDuration(time.Since(start))).Debug("finish")
 	return nil
@@ -427,7 +570,7 @@ func (b *Backuper) downloadDiffParts(remoteBackup metadata.BackupMetadata, table
 func (b *Backuper) downloadDiffRemoteFile(diffRemoteFilesLock *sync.Mutex, diffRemoteFilesCache map[string]*sync.Mutex, tableRemoteFile string, tableLocalDir string) error {
 	diffRemoteFilesLock.Lock()
 	namedLock, isCached := diffRemoteFilesCache[tableRemoteFile]
-	log := apexLog.WithField("operation", "downloadDiffRemoteFile")
+	log := b.logger().WithField("operation", "downloadDiffRemoteFile")
 	if isCached {
 		log.Debugf("wait download begin %s", tableRemoteFile)
 		namedLock.Lock()
@@ -447,7 +590,7 @@ func (b *Backuper) downloadDiffRemoteFile(diffRemoteFilesLock *sync.Mutex, diffR
 			}
 		} else {
 			// remoteFile could be a directory
-			if err := b.dst.DownloadPath(0, tableRemoteFile, tableLocalDir); err != nil {
+			if err := b.dst.DownloadPath(tableRemoteFile, tableLocalDir); err != nil {
 				log.Warnf("DownloadPath %s -> %s return error: %v", tableRemoteFile, tableLocalDir, err)
 				return err
 			}
@@ -461,7 +604,7 @@ func (b *Backuper) downloadDiffRemoteFile(diffRemoteFilesLock *sync.Mutex, diffR
 func (b *Backuper) checkNewPath(newPath string, part metadata.Part) error {
 	info, err := os.Stat(newPath)
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("%s stat return error: %v", newPath, err)
+		return fmt.Errorf("%s stat return error: %w", newPath, err)
 	}
 	if os.IsNotExist(err) && !part.Required {
 		return fmt.Errorf("%s not found after download backup", newPath)
@@ -485,6 +628,20 @@ func (b *Backuper) findDiffBackupFilesRemote(backup metadata.BackupMetadata, tab
 		return nil, err
 	}
 
+	// part in RequiredBackup could be uploaded as content-addressed archive or could be referenced from other backup
+	for _, requiredParts := range requiredTable.Parts {
+		for _, requiredPart := range requiredParts {
+			if requiredPart.Name == part.Name && requiredPart.SharedKey != "" {
+				partLocalDir := path.Join(b.DiskToPathMap[disk], "backup", requiredBackup.BackupName, "shadow", common.TablePath(table.Database, table.Table), disk, part.Name)
+				return map[string]string{requiredPart.SharedKey: partLocalDir}, nil
+			}
+			if requiredPart.Name == part.Name && requiredPart.RefKey != "" {
+				tableLocalDir := path.Join(b.DiskToPathMap[disk], "backup", requiredBackup.BackupName, "shadow", common.TablePath(table.Database, table.Table), disk)
+				return map[string]string{requiredPart.RefKey: tableLocalDir}, nil
+			}
+		}
+	}
+
 	// recursive find if part in RequiredBackup also Required
 	tableRemoteFiles, found, err := b.findDiffRecursive(requiredBackup, log, table, requiredTable, part, disk)
 	if found {
@@ -512,9 +669,9 @@ func (b *Backuper) findDiffBackupFilesRemote(backup metadata.BackupMetadata, tab
 	for requiredDisk, requiredParts := range requiredTable.Parts {
 		for _, requiredPart := range requiredParts {
 			if part.Name == requiredPart.Name {
-				localTableDir := path.Join(b.DiskToPathMap[disk], "backup", requiredBackup.BackupName, "shadow", common.TablePathEncode(table.Database), common.TablePathEncode(table.Table), disk)
+				localTableDir := path.Join(b.DiskToPathMap[disk], "backup", requiredBackup.BackupName, "shadow", common.TablePath(table.Database, table.Table), disk)
 				for _, remoteFile := range requiredTable.Files[requiredDisk] {
-					remoteFile = path.Join(requiredBackup.BackupName, "shadow", common.TablePathEncode(table.Database), common.TablePathEncode(table.Table), remoteFile)
+					remoteFile = path.Join(requiredBackup.BackupName, "shadow", common.TablePath(table.Database, table.Table), remoteFile)
 					tableRemoteFiles[remoteFile] = localTableDir
 				}
 			}
@@ -553,7 +710,7 @@ func (b *Backuper) findDiffRecursive(requiredBackup *metadata.BackupMetadata, lo
 }
 
 func (b *Backuper) findDiffOnePart(requiredBackup *metadata.BackupMetadata, table metadata.TableMetadata, localDisk, remoteDisk string, part metadata.Part) (map[string]string, error, bool) {
-	apexLog.WithFields(apexLog.Fields{"database": table.Database, "table": table.Table, "part": part.Name}).Debugf("findDiffOnePart")
+	b.logger().WithFields(apexLog.Fields{"database": table.Database, "table": table.Table, "part": part.Name}).Debugf("findDiffOnePart")
 	tableRemoteFiles := make(map[string]string)
 	// find same disk and part name archive
 	if requiredBackup.DataFormat != "directory" {
@@ -572,16 +729,16 @@ func (b *Backuper) findDiffOnePart(requiredBackup *metadata.BackupMetadata, tabl
 }
 
 func (b *Backuper) findDiffOnePartDirectory(requiredBackup *metadata.BackupMetadata, table metadata.TableMetadata, localDisk, remoteDisk string, part metadata.Part) (string, string, error) {
-	apexLog.WithFields(apexLog.Fields{"database": table.Database, "table": table.Table, "part": part.Name}).Debugf("findDiffOnePartDirectory")
-	dbAndTableDir := path.Join(common.TablePathEncode(table.Database), common.TablePathEncode(table.Table))
+	b.logger().WithFields(apexLog.Fields{"database": table.Database, "table": table.Table, "part": part.Name}).Debugf("findDiffOnePartDirectory")
+	dbAndTableDir := common.TablePath(table.Database, table.Table)
 	tableRemotePath := path.Join(requiredBackup.BackupName, "shadow", dbAndTableDir, remoteDisk, part.Name)
 	tableRemoteFile := path.Join(tableRemotePath, "checksums.txt")
 	return b.findDiffFileExist(requiredBackup, tableRemoteFile, tableRemotePath, localDisk, dbAndTableDir, part)
 }
 
 func (b *Backuper) findDiffOnePartArchive(requiredBackup *metadata.BackupMetadata, table metadata.TableMetadata, localDisk, remoteDisk string, part metadata.Part) (string, string, error) {
-	apexLog.WithFields(apexLog.Fields{"database": table.Database, "table": table.Table, "part": part.Name}).Debugf("findDiffOnePartArchive")
-	dbAndTableDir := path.Join(common.TablePathEncode(table.Database), common.TablePathEncode(table.Table))
+	b.logger().WithFields(apexLog.Fields{"database": table.Database, "table": table.Table, "part": part.Name}).Debugf("findDiffOnePartArchive")
+	dbAndTableDir := common.TablePath(table.Database, table.Table)
 	remoteExt := config.ArchiveExtensions[requiredBackup.DataFormat]
 	tableRemotePath := path.Join(requiredBackup.BackupName, "shadow", dbAndTableDir, fmt.Sprintf("%s_%s.%s", remoteDisk, part.Name, remoteExt))
 	tableRemoteFile := tableRemotePath
@@ -592,7 +749,7 @@ func (b *Backuper) findDiffFileExist(requiredBackup *metadata.BackupMetadata, ta
 	//apexLog.WithFields(apexLog.Fields{"tableRemoteFile": tableRemoteFile, "tableRemotePath": tableRemotePath, "part": part.Name}).Debugf("findDiffFileExist start")
 	_, err := b.dst.StatFile(tableRemoteFile)
 	if err != nil {
-		apexLog.WithFields(apexLog.Fields{"tableRemoteFile": tableRemoteFile, "tableRemotePath": tableRemotePath, "part": part.Name}).Debugf("findDiffFileExist not found")
+		b.logger().WithFields(apexLog.Fields{"tableRemoteFile": tableRemoteFile, "tableRemotePath": tableRemotePath, "part": part.Name}).Debugf("findDiffFileExist not found")
 		return "", "", err
 	}
 	if tableLocalDir, diskExists := b.DiskToPathMap[localDisk]; !diskExists {
@@ -603,7 +760,7 @@ func (b *Backuper) findDiffFileExist(requiredBackup *metadata.BackupMetadata, ta
 		} else {
 			tableLocalDir = path.Join(tableLocalDir, "backup", requiredBackup.BackupName, "shadow", dbAndTableDir, localDisk)
 		}
-		apexLog.WithFields(apexLog.Fields{"tableRemoteFile": tableRemoteFile, "tableRemotePath": tableRemotePath, "part": part.Name}).Debugf("findDiffFileExist found")
+		b.logger().WithFields(apexLog.Fields{"tableRemoteFile": tableRemoteFile, "tableRemotePath": tableRemotePath, "part": part.Name}).Debugf("findDiffFileExist found")
 		return tableRemotePath, tableLocalDir, nil
 	}
 }
@@ -642,10 +799,27 @@ func makePartHardlinks(exists, new string) error {
 	for _, f := range files {
 		existsF := path.Join(exists, f)
 		newF := path.Join(new, f)
-		if err := os.Link(existsF, newF); err != nil {
+		if err := filesystemhelper.HardlinkOrCopy(existsF, newF); err != nil {
 			apexLog.Warnf("makePartHardlinks::Link %s -> %s: %v", newF, existsF, err)
 			return err
 		}
 	}
 	return nil
 }
+
+// downloadProgressTotal - bytes which will be read from remote storage, archives size is estimated from compression ratio of the whole backup
+func downloadProgressTotal(backup metadata.BackupMetadata, tables []metadata.TableMetadata) int64 {
+	var total int64
+	for _, table := range tables {
+		if table.MetadataOnly {
+			continue
+		}
+		for _, size := range table.Size {
+			total += size
+		}
+	}
+	if backup.DataFormat != "directory" && backup.DataSize > 0 && backup.CompressedSize > 0 {
+		total = int64(float64(total) * float64(backup.CompressedSize) / float64(backup.DataSize))
+	}
+	return total
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+// objectsServer - S3 API with ListObjectsV2, GetObject and HeadObject for objects from memory
+type objectsServer struct {
+	objects map[string][]byte
+}
+
+func (s *objectsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	if r.URL.Query().Get("list-type") != "2" {
+		body, exists := s.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>"))
+			return
+		}
+		http.ServeContent(w, r, key, time.Now(), bytes.NewReader(body))
+		return
+	}
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := &strings.Builder{}
+	_, _ = fmt.Fprintf(result, "<ListBucketResult><Name>bucket</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>", prefix)
+	commonPrefixes := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			if commonPrefix := key[:len(prefix)+i+1]; !commonPrefixes[commonPrefix] {
+				commonPrefixes[commonPrefix] = true
+				_, _ = fmt.Fprintf(result, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", commonPrefix)
+			}
+			continue
+		}
+		_, _ = fmt.Fprintf(result, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2022-01-01T00:00:00.000Z</LastModified></Contents>", key, len(s.objects[key]))
+	}
+	_, _ = w.Write([]byte(result.String() + "</ListBucketResult>"))
+}
+
+// downloadToConfig - config with S3 served from memory with backupName of one table on two disks, ClickHouse is not reachable
+func downloadToConfig(t *testing.T, backupName string) *config.Config {
+	tableMetadata, err := json.Marshal(metadata.TableMetadata{
+		Database: "default",
+		Table:    "t",
+		Query:    "CREATE TABLE default.t (id UInt64) ENGINE = MergeTree ORDER BY id",
+		Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}, "hdd": {{Name: "all_2_2_0"}}},
+	})
+	assert.NoError(t, err)
+	backupMetadata, err := json.Marshal(metadata.BackupMetadata{
+		BackupName: backupName,
+		Tables:     []metadata.TableTitle{{Database: "default", Table: "t"}},
+		DataFormat: "directory",
+	})
+	assert.NoError(t, err)
+	tablePath := path.Join("prefix", backupName, "shadow", common.TablePath("default", "t"))
+	server := &objectsServer{objects: map[string][]byte{
+		path.Join("prefix", backupName, "metadata.json"):                                      backupMetadata,
+		path.Join("prefix", backupName, "metadata", common.TableMetadataPath("default", "t")): tableMetadata,
+		path.Join(tablePath, "default", "all_1_1_0", "data.bin"):                              []byte("default disk data"),
+		path.Join(tablePath, "hdd", "all_2_2_0", "data.bin"):                                  []byte("hdd disk data"),
+	}}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+
+	cfg := config.DefaultConfig()
+	cfg.ClickHouse.Host = "127.0.0.1"
+	cfg.ClickHouse.Port = 1
+	cfg.ClickHouse.Timeout = "100ms"
+	cfg.General.RemoteStorage = "s3"
+	cfg.General.DisableProgressBar = true
+	cfg.S3.Bucket = "bucket"
+	cfg.S3.Path = "prefix"
+	cfg.S3.Endpoint = srv.URL
+	cfg.S3.Region = "us-east-1"
+	cfg.S3.AccessKey = "access"
+	cfg.S3.SecretKey = "secret"
+	cfg.S3.ForcePathStyle = true
+	cfg.S3.DisableSSL = true
+	cfg.S3.CompressionFormat = "none"
+	return cfg
+}
+
+// TestDownloadTo - backup is downloaded into directory with parts of all disks without ClickHouse, which is not reachable in this test
+func TestDownloadTo(t *testing.T) {
+	backupName := fmt.Sprintf("download_to_%d", time.Now().UnixNano())
+	cfg := downloadToConfig(t, backupName)
+	to := t.TempDir()
+	assert.NoError(t, NewBackuper(cfg).Download(backupName, "", nil, false, false, to))
+	localBackupPath := path.Join(to, "backup", backupName)
+	for file, body := range map[string]string{
+		path.Join("shadow", common.TablePath("default", "t"), "default", "all_1_1_0", "data.bin"): "default disk data",
+		path.Join("shadow", common.TablePath("default", "t"), "hdd", "all_2_2_0", "data.bin"):     "hdd disk data",
+	} {
+		content, err := ioutil.ReadFile(path.Join(localBackupPath, file))
+		assert.NoError(t, err, file)
+		assert.Equal(t, body, string(content), file)
+	}
+	_, err := os.Stat(path.Join(localBackupPath, "metadata", common.TableMetadataPath("default", "t")))
+	assert.NoError(t, err)
+	var downloaded metadata.BackupMetadata
+	body, err := ioutil.ReadFile(path.Join(localBackupPath, "metadata.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(body, &downloaded))
+	assert.Equal(t, backupName, downloaded.BackupName)
+
+	assert.Equal(t, ErrBackupIsAlreadyExists, NewBackuper(cfg).Download(backupName, "", nil, false, false, to))
+	assert.Error(t, NewBackuper(cfg).Download(backupName, "", nil, false, false, ""), "download without --to requires clickhouse")
+}
+
+// TestStoragePath - backups moved to other prefix are listed and downloaded when path is overridden by --storage-path
+func TestStoragePath(t *testing.T) {
+	backupName := fmt.Sprintf("storage_path_%d", time.Now().UnixNano())
+	cfg := downloadToConfig(t, backupName)
+	cfg.S3.Path = "relocated"
+	backups, err := GetRemoteBackups(cfg, true)
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+	to := t.TempDir()
+	assert.Error(t, NewBackuper(cfg).Download(backupName, "", nil, false, false, to))
+
+	assert.NoError(t, cfg.SetRemotePath("prefix"))
+	backups, err = GetRemoteBackups(cfg, true)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	assert.Equal(t, backupName, backups[0].BackupName)
+	assert.NoError(t, NewBackuper(cfg).Download(backupName, "", nil, false, false, to))
+	content, err := ioutil.ReadFile(path.Join(to, "backup", backupName, "shadow", common.TablePath("default", "t"), "hdd", "all_2_2_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hdd disk data", string(content))
+}
@@ -0,0 +1,154 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+const (
+	drStepConfigs = "configs"
+	drStepRBAC    = "rbac"
+	drStepRestart = "restart"
+	drStepSchema  = "schema"
+	drStepData    = "data"
+)
+
+// waitClickHouseTimeout - how long wait clickhouse-server after restart_command
+const waitClickHouseTimeout = 180 * time.Second
+
+// DRComponents - parts of disaster recovery backup, each part could be skipped independently
+type DRComponents struct {
+	Configs bool
+	RBAC    bool
+	Schema  bool
+	Data    bool
+}
+
+// NewDRComponents - all components except skipped ones
+func NewDRComponents(skipConfigs, skipRBAC, skipSchema, skipData bool) DRComponents {
+	return DRComponents{
+		Configs: !skipConfigs,
+		RBAC:    !skipRBAC,
+		Schema:  !skipSchema,
+		Data:    !skipData,
+	}
+}
+
+// CreateOptions - return schemaOnly, rbac and configs arguments for CreateBackup, schema is always backed up cause data can't be restored without it
+func (c DRComponents) CreateOptions() (schemaOnly, rbac, configs bool) {
+	return !c.Data, c.RBAC, c.Configs
+}
+
+// restoreSteps - configs and RBAC are applied first and require restart clickhouse-server, then schema shall be created before attach data
+func (c DRComponents) restoreSteps() []string {
+	var steps []string
+	if c.Configs {
+		steps = append(steps, drStepConfigs)
+	}
+	if c.RBAC {
+		steps = append(steps, drStepRBAC)
+	}
+	if c.Configs || c.RBAC {
+		steps = append(steps, drStepRestart)
+	}
+	if c.Schema {
+		steps = append(steps, drStepSchema)
+	}
+	if c.Data {
+		steps = append(steps, drStepData)
+	}
+	return steps
+}
+
+// runDRSteps - run actions in steps order, stop on first error
+func runDRSteps(steps []string, actions map[string]func() error, log *apexLog.Entry) error {
+	for _, step := range steps {
+		action, ok := actions[step]
+		if !ok {
+			return fmt.Errorf("unknown restore step '%s'", step)
+		}
+		log.WithField("step", step).Info("restore")
+		if err := action(); err != nil {
+			return fmt.Errorf("can't restore %s: %v", step, err)
+		}
+	}
+	return nil
+}
+
+// RestoreDR - restore configs, RBAC, schema and data from backupName in this order
+func RestoreDR(cfg *config.Config, backupName string, tablePattern string, partitions []string, dropTable, skipExisting, forceDefaultDisk bool, components DRComponents, operationID string) error {
+	log := operationLog(operationID, backupName, "restore_dr")
+	if backupName == "" {
+		_ = PrintLocalBackups(cfg, "", "all", "", false, false, BackupDateWindow{})
+		return fmt.Errorf("select backup for restore")
+	}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
+	}
+	defer ch.Close()
+	defaultDataPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	backupMetadata := metadata.BackupMetadata{}
+	if err := backupMetadata.Load(path.Join(defaultDataPath, "backup", backupName, "metadata.json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if backupMetadata.SchemaOnly && components.Data {
+		log.Info("schema-only backup, data restore will be skipped")
+		components.Data = false
+	}
+	actions := map[string]func() error{
+		drStepConfigs: func() error {
+			return restoreConfigs(ch, backupName, log)
+		},
+		drStepRBAC: func() error {
+			_, err := restoreRBAC(ch, backupName, backupMetadata.RBACObjects, log)
+			return err
+		},
+		drStepRestart: func() error {
+			if err := restartClickHouse(ch, log); err != nil {
+				return err
+			}
+			return waitClickHouse(ch, waitClickHouseTimeout)
+		},
+		drStepSchema: func() error {
+			return Restore(cfg, backupName, RestoreOptions{Tables: tablePattern, Partitions: partitions, Schema: true, Rm: dropTable, SkipExisting: skipExisting}, operationID)
+		},
+		drStepData: func() error {
+			return Restore(cfg, backupName, RestoreOptions{Tables: tablePattern, Partitions: partitions, Data: true, ForceDefaultDisk: forceDefaultDisk}, operationID)
+		},
+	}
+	if err := runDRSteps(components.restoreSteps(), actions, log); err != nil {
+		return err
+	}
+	log.Info("done")
+	return nil
+}
+
+// waitClickHouse - reconnect until clickhouse-server is available after restart
+func waitClickHouse(ch *clickhouse.ClickHouse, timeout time.Duration) error {
+	ch.Close()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := ch.Connect()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("clickhouse-server is not available after restart: %v", err)
+		}
+		apexLog.Debugf("wait clickhouse-server after restart: %v", err)
+		time.Sleep(5 * time.Second)
+	}
+}
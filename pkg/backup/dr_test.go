@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func recordDRActions(calls *[]string, failStep string) map[string]func() error {
+	actions := map[string]func() error{}
+	for _, step := range []string{drStepConfigs, drStepRBAC, drStepRestart, drStepSchema, drStepData} {
+		step := step
+		actions[step] = func() error {
+			*calls = append(*calls, step)
+			if step == failStep {
+				return fmt.Errorf("%s failed", step)
+			}
+			return nil
+		}
+	}
+	return actions
+}
+
+func TestDRRestoreOrder(t *testing.T) {
+	var calls []string
+	components := NewDRComponents(false, false, false, false)
+	assert.NoError(t, runDRSteps(components.restoreSteps(), recordDRActions(&calls, ""), apexLog.WithField("operation", "restore_dr")))
+	assert.Equal(t, []string{"configs", "rbac", "restart", "schema", "data"}, calls)
+}
+
+func TestDRPartialRestore(t *testing.T) {
+	testCases := []struct {
+		components DRComponents
+		expected   []string
+	}{
+		{NewDRComponents(true, false, false, false), []string{"rbac", "restart", "schema", "data"}},
+		{NewDRComponents(false, true, false, false), []string{"configs", "restart", "schema", "data"}},
+		{NewDRComponents(true, true, false, false), []string{"schema", "data"}},
+		{NewDRComponents(true, true, false, true), []string{"schema"}},
+		{NewDRComponents(true, true, true, false), []string{"data"}},
+		{NewDRComponents(false, false, true, true), []string{"configs", "rbac", "restart"}},
+		{NewDRComponents(true, true, true, true), nil},
+	}
+	for _, tc := range testCases {
+		var calls []string
+		assert.NoError(t, runDRSteps(tc.components.restoreSteps(), recordDRActions(&calls, ""), apexLog.WithField("operation", "restore_dr")))
+		assert.Equal(t, tc.expected, calls, "%+v", tc.components)
+	}
+}
+
+func TestDRRestoreStopsOnError(t *testing.T) {
+	var calls []string
+	err := runDRSteps(NewDRComponents(false, false, false, false).restoreSteps(), recordDRActions(&calls, drStepRBAC), apexLog.WithField("operation", "restore_dr"))
+	assert.EqualError(t, err, "can't restore rbac: rbac failed")
+	assert.Equal(t, []string{"configs", "rbac"}, calls)
+}
+
+func TestDRCreateOptions(t *testing.T) {
+	schemaOnly, rbac, configs := NewDRComponents(false, false, false, false).CreateOptions()
+	assert.Equal(t, []bool{false, true, true}, []bool{schemaOnly, rbac, configs})
+	schemaOnly, rbac, configs = NewDRComponents(true, false, false, true).CreateOptions()
+	assert.Equal(t, []bool{true, true, false}, []bool{schemaOnly, rbac, configs})
+}
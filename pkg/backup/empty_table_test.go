@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// strictWalkStorage - memoryStorage which fails on walk of absent path like SFTP and FTP do
+type strictWalkStorage struct {
+	memoryStorage
+	walks []string
+}
+
+func (s *strictWalkStorage) Walk(prefix string, recursive bool, fn func(new_storage.RemoteFile) error) error {
+	s.walks = append(s.walks, prefix)
+	s.Lock()
+	defer s.Unlock()
+	for key := range s.files {
+		if strings.HasPrefix(key, prefix+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: no such file or directory", prefix)
+}
+
+func emptyTestTables(diskPath, hddPath string) (clickhouse.Disk, clickhouse.Disk, []clickhouse.Table) {
+	defaultDisk := clickhouse.Disk{Name: "default", Path: diskPath, Type: "local"}
+	hddDisk := clickhouse.Disk{Name: "hdd", Path: hddPath, Type: "local"}
+	return defaultDisk, hddDisk, []clickhouse.Table{
+		{Database: "default", Name: "empty", Engine: "MergeTree", DataPaths: []string{path.Join(diskPath, "data/default/empty")}, CreateTableQuery: "CREATE TABLE default.empty (id UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "default", Name: "empty_hdd", Engine: "MergeTree", DataPaths: []string{path.Join(hddPath, "data/default/empty_hdd")}, CreateTableQuery: "CREATE TABLE default.empty_hdd (id UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'hdd'"},
+	}
+}
+
+func TestEmptyTableParts(t *testing.T) {
+	defaultDisk, hddDisk, tables := emptyTestTables("/var/lib/clickhouse/", "/mnt/hdd/")
+	disks := []clickhouse.Disk{defaultDisk, hddDisk}
+	parts, size := emptyTableParts(disks, &tables[0])
+	assert.Equal(t, map[string][]metadata.Part{"default": {}}, parts)
+	assert.Equal(t, map[string]int64{"default": 0}, size)
+	parts, size = emptyTableParts(disks, &tables[1])
+	assert.Equal(t, map[string][]metadata.Part{"hdd": {}}, parts)
+	assert.Equal(t, map[string]int64{"hdd": 0}, size)
+	body, err := json.Marshal(metadata.TableMetadata{Database: "default", Table: "empty_hdd", Parts: parts, Size: size})
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"parts":{"hdd":[]}`)
+
+	parts, size = emptyTableParts(disks, &clickhouse.Table{Database: "default", Name: "view", Engine: "View"})
+	assert.Empty(t, parts)
+	assert.Empty(t, size)
+}
+
+// TestEmptyTablesBackupRestore - empty tables on default and non-default disk pass upload, download and restore with schema only
+func TestEmptyTablesBackupRestore(t *testing.T) {
+	diskPath, hddPath := t.TempDir(), t.TempDir()
+	defaultDisk, hddDisk, chTables := emptyTestTables(diskPath, hddPath)
+	backupPath := path.Join(diskPath, "backup", "backup1")
+	for i := range chTables {
+		parts, size := emptyTableParts([]clickhouse.Disk{defaultDisk, hddDisk}, &chTables[i])
+		assert.True(t, isMetadataOnlyTable(parts, nil), "create shall mark empty table as metadata only")
+		body, err := json.Marshal(metadata.TableMetadata{
+			Database:     chTables[i].Database,
+			Table:        chTables[i].Name,
+			Query:        chTables[i].CreateTableQuery,
+			Parts:        parts,
+			Size:         size,
+			MetadataOnly: true,
+		})
+		assert.NoError(t, err)
+		metadataFile := path.Join(backupPath, "metadata", common.TableMetadataPath(chTables[i].Database, chTables[i].Name))
+		assert.NoError(t, os.MkdirAll(path.Dir(metadataFile), 0750))
+		assert.NoError(t, ioutil.WriteFile(metadataFile, body, 0640))
+	}
+	tables, err := getTableListByPatternLocal(path.Join(backupPath, "metadata"), "*", nil, false, nil)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 2)
+
+	for _, format := range []string{"tar", "none"} {
+		cfg := config.DefaultConfig()
+		cfg.General.RemoteStorage = "sftp"
+		cfg.SFTP.CompressionFormat = format
+		storage := &strictWalkStorage{memoryStorage: memoryStorage{files: map[string][]byte{}}}
+		dst, err := new_storage.NewBackupDestination(cfg)
+		assert.NoError(t, err)
+		dst.RemoteStorage = storage
+		b := &Backuper{
+			cfg:           cfg,
+			dst:           dst,
+			DiskToPathMap: map[string]string{"default": diskPath, "hdd": hddPath},
+		}
+		uploaded, dataSize, _, err := b.uploadTables("backup1", append(ListOfTables{}, tables...), false, false, tableTimeouts{})
+		assert.NoError(t, err)
+		assert.Len(t, uploaded, 2)
+		assert.Equal(t, int64(0), dataSize)
+		assert.Len(t, storage.files, 2, "only metadata shall be uploaded for empty tables")
+
+		// download to host without hdd disk
+		b.DiskToPathMap = map[string]string{"default": diskPath}
+		remoteBackup := metadata.BackupMetadata{BackupName: "backup2", DataFormat: format}
+		if format == "none" {
+			remoteBackup.DataFormat = "directory"
+		}
+		for _, table := range uploaded {
+			assert.Contains(t, storage.files, path.Join("backup1", "metadata", common.TableMetadataPath(table.Database, table.Table)))
+			assert.NoError(t, b.downloadTableData(remoteBackup, table))
+			// downloaded metadata keeps the flag, so restore creates the table from schema and skips data
+			downloadedFile := path.Join(t.TempDir(), "table.json")
+			_, err := table.Save(downloadedFile, false)
+			assert.NoError(t, err)
+			var downloaded metadata.TableMetadata
+			_, err = downloaded.Load(downloadedFile)
+			assert.NoError(t, err)
+			assert.True(t, downloaded.MetadataOnly)
+		}
+		assert.Empty(t, storage.walks)
+		_, err = os.Stat(path.Join(diskPath, "backup", "backup2"))
+		assert.True(t, os.IsNotExist(err))
+
+		disks, err := resolveBackupDisks([]clickhouse.Disk{defaultDisk}, uploaded, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []clickhouse.Disk{defaultDisk}, disks)
+		for _, table := range uploaded {
+			assert.False(t, tableHasParts(table))
+			assert.NoError(t, filesystemhelper.CopyData("backup1", table, disks, []string{path.Join(diskPath, "data", table.Database, table.Table)}, nil))
+		}
+	}
+
+	ch := &fakeSchemaRestorer{existing: map[string]bool{}}
+	assert.NoError(t, restoreTablesSchema(config.DefaultConfig(), ch, tables, 21008000, false, false, apexLog.WithField("test", t.Name())))
+	assert.Equal(t, []string{chTables[0].CreateTableQuery, chTables[1].CreateTableQuery}, ch.queries)
+}
+
+func TestTableHasParts(t *testing.T) {
+	assert.False(t, tableHasParts(metadata.TableMetadata{}))
+	assert.False(t, tableHasParts(metadata.TableMetadata{Parts: map[string][]metadata.Part{"default": {}, "hdd": nil}}))
+	assert.True(t, tableHasParts(metadata.TableMetadata{Parts: map[string][]metadata.Part{"default": {}, "hdd": {{Name: "all_1_1_0"}}}}))
+
+	assert.True(t, isMetadataOnlyTable(nil, nil))
+	assert.True(t, isMetadataOnlyTable(map[string][]metadata.Part{"default": {}}, map[string][]metadata.Part{"default": nil}))
+	assert.False(t, isMetadataOnlyTable(map[string][]metadata.Part{"default": {}, "hdd": {{Name: "all_1_1_0"}}}, nil))
+	assert.False(t, isMetadataOnlyTable(map[string][]metadata.Part{"default": {}}, map[string][]metadata.Part{"default": {{Name: "broken_all_1_1_0"}}}), "detached parts are backed up as data")
+}
+
+func TestPrintEmptyTables(t *testing.T) {
+	defaultDisk, hddDisk, tables := emptyTestTables("/var/lib/clickhouse/", "/mnt/hdd/")
+	out := &bytes.Buffer{}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.DiscardEmptyColumns)
+	printTablesList(w, tables, []clickhouse.Disk{defaultDisk, hddDisk}, nil, "skip", false)
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "default.empty      0B  default  \ndefault.empty_hdd  0B  hdd      \n", out.String())
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+)
+
+// sizeEstimator - part of clickhouse.ClickHouse which enough to estimate backup size
+type sizeEstimator interface {
+	tablesLister
+	GetPartsSize() ([]clickhouse.PartsSize, error)
+}
+
+// TableSizeEstimate - expected size of table data in backup, Disks contains size on each disk
+type TableSizeEstimate struct {
+	Database string            `json:"database"`
+	Table    string            `json:"table"`
+	Disks    map[string]uint64 `json:"disks"`
+	Size     uint64            `json:"size"`
+}
+
+// SizeEstimate - expected size of data which `create` would freeze now, calculated from active parts in system.parts
+type SizeEstimate struct {
+	Tables []TableSizeEstimate `json:"tables"`
+	Size   uint64              `json:"size"`
+}
+
+// table - estimate of one table, false when table data isn't backed up
+func (e *SizeEstimate) table(database, table string) (TableSizeEstimate, bool) {
+	for _, t := range e.Tables {
+		if t.Database == database && t.Table == table {
+			return t, true
+		}
+	}
+	return TableSizeEstimate{}, false
+}
+
+// isDataBackupEngine - data is frozen only for these engines, other tables are saved as schema
+func isDataBackupEngine(engine string) bool {
+	return strings.HasSuffix(engine, "MergeTree") || engine == "MaterializedMySQL" || engine == "MaterializedPostreSQL"
+}
+
+// estimateBackupSize - sum parts size of tables which data would be backed up, skipped tables are excluded
+func estimateBackupSize(tables []clickhouse.Table, partsSize []clickhouse.PartsSize) SizeEstimate {
+	estimate := SizeEstimate{Tables: []TableSizeEstimate{}}
+	for _, table := range tables {
+		if table.Skip || !isDataBackupEngine(table.Engine) {
+			continue
+		}
+		tableEstimate := TableSizeEstimate{Database: table.Database, Table: table.Name, Disks: map[string]uint64{}}
+		for _, parts := range partsSize {
+			if parts.Database == table.Database && parts.Table == table.Name {
+				tableEstimate.Disks[parts.Disk] += parts.Size
+				tableEstimate.Size += parts.Size
+			}
+		}
+		estimate.Tables = append(estimate.Tables, tableEstimate)
+		estimate.Size += tableEstimate.Size
+	}
+	return estimate
+}
+
+func getSizeEstimate(ch sizeEstimator, tablePattern string, skipTables []string) (SizeEstimate, error) {
+	allTables, err := ch.GetTables(tablePattern)
+	if err != nil {
+		return SizeEstimate{}, fmt.Errorf("can't get tables from clickhouse: %v", err)
+	}
+	partsSize, err := ch.GetPartsSize()
+	if err != nil {
+		return SizeEstimate{}, err
+	}
+	return estimateBackupSize(filterTablesByPattern(allTables, tablePattern, skipTables), partsSize), nil
+}
+
+// EstimateBackupSize - expected size of data which `create` would backup for tables matched by tablePattern, nothing is frozen
+func EstimateBackupSize(cfg *config.Config, tablePattern string) (SizeEstimate, error) {
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return SizeEstimate{}, fmt.Errorf("can't connect to clickhouse: %w", err)
+	}
+	defer ch.Close()
+	return getSizeEstimate(ch, tablePattern, cfg.ClickHouse.SkipTables)
+}
@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateBackupSize(t *testing.T) {
+	tables := []clickhouse.Table{
+		{Database: "default", Name: "events", Engine: "ReplicatedMergeTree"},
+		{Database: "default", Name: "log", Engine: "Log"},
+		{Database: "default", Name: "skipped", Engine: "MergeTree", Skip: true},
+		{Database: "default", Name: "empty", Engine: "MergeTree"},
+	}
+	partsSize := []clickhouse.PartsSize{
+		{Database: "default", Table: "events", Disk: "default", Size: 100},
+		{Database: "default", Table: "events", Disk: "hdd", Size: 50},
+		{Database: "default", Table: "skipped", Disk: "default", Size: 1000},
+		{Database: "other", Table: "events", Disk: "default", Size: 1000},
+	}
+	estimate := estimateBackupSize(tables, partsSize)
+	assert.Equal(t, SizeEstimate{
+		Tables: []TableSizeEstimate{
+			{Database: "default", Table: "events", Disks: map[string]uint64{"default": 100, "hdd": 50}, Size: 150},
+			{Database: "default", Table: "empty", Disks: map[string]uint64{}, Size: 0},
+		},
+		Size: 150,
+	}, estimate)
+
+	ch := &fakeTablesLister{diskPath: t.TempDir()}
+	estimate, err := getSizeEstimate(ch, "default.*", []string{"default.tmp_*"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2048), estimate.Size)
+	assert.Len(t, estimate.Tables, 1)
+}
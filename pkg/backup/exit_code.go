@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"errors"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+)
+
+// exit codes are part of CLI contract, values shall never change, new codes are appended
+const (
+	ExitCodeError         = 1
+	ExitCodeNotFound      = 3
+	ExitCodeAccessDenied  = 4
+	ExitCodeTransient     = 5
+	ExitCodeRemoteStorage = 6
+	ExitCodeClickHouse    = 7
+	ExitCodeAlreadyExists = 8
+	ExitCodeLocked        = 9
+	ExitCodeCancelled     = 10
+)
+
+// ExitCode - allow scripts distinguish missing backups, wrong credentials, unavailable clickhouse or remote storage and failures which could be retried
+func ExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrCancelled):
+		return ExitCodeCancelled
+	case errors.Is(err, ErrBackupLocked):
+		return ExitCodeLocked
+	case errors.Is(err, ErrBackupIsAlreadyExists):
+		return ExitCodeAlreadyExists
+	case errors.Is(err, ErrBackupNotFound), errors.Is(err, new_storage.ErrNotFound):
+		return ExitCodeNotFound
+	case errors.Is(err, new_storage.ErrUnauthorized):
+		return ExitCodeAccessDenied
+	case errors.Is(err, new_storage.ErrTransient):
+		return ExitCodeTransient
+	case errors.Is(err, clickhouse.ErrConnection):
+		return ExitCodeClickHouse
+	case errors.Is(err, new_storage.ErrRemoteStorage):
+		return ExitCodeRemoteStorage
+	}
+	return ExitCodeError
+}
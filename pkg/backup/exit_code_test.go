@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestExitCode - exit codes are used by wrapper scripts, literal values protect them from renumbering
+func TestExitCode(t *testing.T) {
+	for expected, err := range map[int]error{
+		1:  errors.New("can't parse config"),
+		3:  fmt.Errorf("'daily' is not found on remote storage: %w", new_storage.ErrNotFound),
+		4:  fmt.Errorf("can't connect to s3: %w", fmt.Errorf("%w: InvalidAccessKeyId", new_storage.ErrUnauthorized)),
+		5:  fmt.Errorf("one of upload go-routine return error: %w", fmt.Errorf("%w: SlowDown", new_storage.ErrTransient)),
+		6:  fmt.Errorf("can't connect to remote storage: %w", fmt.Errorf("%w: no such host", new_storage.ErrRemoteStorage)),
+		7:  fmt.Errorf("can't connect to clickhouse: %w", fmt.Errorf("%w: connection refused", clickhouse.ErrConnection)),
+		8:  fmt.Errorf("'daily' medatata.json already exists: %w", ErrBackupIsAlreadyExists),
+		9:  fmt.Errorf("'daily' is locked by running operation with pid 42: %w", ErrBackupLocked),
+		10: fmt.Errorf("one of upload go-routine return error: %w", ErrCancelled),
+	} {
+		assert.Equal(t, expected, ExitCode(err), err.Error())
+	}
+	assert.Equal(t, 3, ExitCode(fmt.Errorf("'daily' is not found on local storage: %w", ErrBackupNotFound)))
+}
+
+// TestExitCodeOfDataTransfer - errors of remote storage during upload and download of table data keep their exit code
+func TestExitCodeOfDataTransfer(t *testing.T) {
+	for expected, storageErr := range map[int]error{
+		4: fmt.Errorf("%w: InvalidAccessKeyId", new_storage.ErrUnauthorized),
+		5: fmt.Errorf("%w: SlowDown", new_storage.ErrTransient),
+		6: fmt.Errorf("%w: InvalidObjectState", new_storage.ErrRemoteStorage),
+	} {
+		localPath := t.TempDir()
+		cfg := config.DefaultConfig()
+		cfg.General.RemoteStorage = "s3"
+		cfg.S3.CompressionFormat = "tar"
+		storage := &recordingStorage{
+			localPath: localPath,
+			sizes:     map[string]int64{},
+			failKey:   "test_backup/shadow/default/events/default_all_1_1_0.tar",
+			failErr:   storageErr,
+		}
+		dst, err := new_storage.NewBackupDestination(cfg)
+		assert.NoError(t, err)
+		dst.RemoteStorage = storage
+		b := &Backuper{cfg: cfg, dst: dst, DiskToPathMap: map[string]string{"default": localPath}}
+		partPath := path.Join(localPath, "backup", "test_backup", "shadow", "default", "events", "default", "all_1_1_0")
+		assert.NoError(t, os.MkdirAll(partPath, 0750))
+		assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte("data"), 0640))
+		timeouts, err := newTableTimeouts(cfg)
+		assert.NoError(t, err)
+
+		tables := ListOfTables{{Database: "default", Table: "events", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}}
+		_, _, _, err = b.uploadTables("test_backup", tables, false, false, timeouts)
+		assert.Error(t, err)
+		assert.Equal(t, expected, ExitCode(err), "upload: %v", err)
+
+		err = b.downloadTableData(
+			metadata.BackupMetadata{BackupName: "test_backup", DataFormat: "tar"},
+			metadata.TableMetadata{Database: "default", Table: "events", Files: map[string][]string{"default": {"default_all_1_1_0.tar"}}},
+		)
+		assert.Error(t, err)
+		assert.Equal(t, expected, ExitCode(err), "download: %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+
+	apexLog "github.com/apex/log"
+)
+
+// flattener - resolve parts of incremental backup through its increment chain, table metadata of chain backups is read from remote storage once
+type flattener struct {
+	b             *Backuper
+	backupName    string
+	newBackupName string
+	chain         map[string]new_storage.Backup
+	tables        map[string]*metadata.TableMetadata
+}
+
+// Flatten - create self-contained remote backup newBackupName from incremental backup backupName, parts are streamed from backups of increment chain
+// into new archives from remote to remote without local disk, tables which were flattened by interrupted run are skipped,
+// metadata.json is uploaded last, so new backup is broken until all tables are flattened
+func (b *Backuper) Flatten(backupName, newBackupName string) (err error) {
+	if backupName == "" || newBackupName == "" {
+		return fmt.Errorf("backup name and new backup name must be defined")
+	}
+	if backupName == newBackupName {
+		return fmt.Errorf("new backup name must differ from '%s'", backupName)
+	}
+	if b.cfg.General.RemoteStorage == "none" {
+		return fmt.Errorf("remote storage is 'none'")
+	}
+	if b.cfg.GetCompressionFormat() == "none" {
+		return fmt.Errorf("flatten doesn't support compression_format: none")
+	}
+	start := time.Now()
+	defer func() { logBackupOperation(b.cfg, "flatten", newBackupName, start, err) }()
+	if err := b.initRemoteStorage(); err != nil {
+		return err
+	}
+	return b.flatten(backupName, newBackupName, start)
+}
+
+func (b *Backuper) flatten(backupName, newBackupName string, start time.Time) error {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "flatten",
+	})
+	remoteBackups, err := b.dst.BackupList(true, "")
+	if err != nil {
+		return err
+	}
+	f := &flattener{
+		b:             b,
+		backupName:    backupName,
+		newBackupName: newBackupName,
+		chain:         map[string]new_storage.Backup{},
+		tables:        map[string]*metadata.TableMetadata{},
+	}
+	for _, remoteBackup := range remoteBackups {
+		f.chain[remoteBackup.BackupName] = remoteBackup
+	}
+	if newBackup, exists := f.chain[newBackupName]; exists && newBackup.Broken == "" {
+		return fmt.Errorf("'%s' already exists on remote storage: %w", newBackupName, ErrBackupIsAlreadyExists)
+	}
+	if err := f.checkChain(); err != nil {
+		return err
+	}
+	head := f.chain[backupName]
+	if head.RequiredBackup == "" {
+		log.Warnf("'%s' is not incremental, it will be copied", backupName)
+	}
+
+	newBackup := head.BackupMetadata
+	newBackup.BackupName = newBackupName
+	newBackup.CreationDate = time.Now().UTC()
+	newBackup.DataFormat = b.cfg.GetCompressionFormat()
+	newBackup.RequiredBackup = ""
+	newBackup.SharedParts = nil
+	newBackup.ReferencedBackups = nil
+	newBackup.CompressedSize = 0
+	newBackup.MetadataSize = 0
+	for i, title := range head.Tables {
+		tableStart := time.Now()
+		table, err := f.tableMetadata(backupName, title)
+		if err != nil {
+			return err
+		}
+		tableLog := log.WithFields(apexLog.Fields{
+			"table":    fmt.Sprintf("%s.%s", title.Database, title.Table),
+			"progress": fmt.Sprintf("%d/%d", i+1, len(head.Tables)),
+		})
+		flatTable, dataSize, metadataSize, err := b.remoteUploadedTable(newBackupName, *table, false)
+		if err != nil {
+			return err
+		}
+		if flatTable != nil {
+			tableLog.Info("already flattened, skip")
+		} else {
+			if flatTable, dataSize, err = f.flattenTable(*table); err != nil {
+				return fmt.Errorf("can't flatten %s.%s: %v", title.Database, title.Table, err)
+			}
+			if metadataSize, err = b.uploadTableMetadata(newBackupName, *flatTable); err != nil {
+				return fmt.Errorf("can't upload metadata of %s.%s: %v", title.Database, title.Table, err)
+			}
+			tableLog.WithFields(apexLog.Fields{
+				"size":     utils.FormatBytes(uint64(dataSize)),
+				"duration": utils.HumanizeDuration(time.Since(tableStart)),
+			}).Info("done")
+		}
+		newBackup.CompressedSize += uint64(dataSize)
+		newBackup.MetadataSize += uint64(metadataSize)
+	}
+	for _, prefix := range []string{"access", "configs"} {
+		size, err := f.copyBackupRelatedArchive(prefix)
+		if err != nil {
+			return err
+		}
+		newBackup.CompressedSize += uint64(size)
+	}
+	if err := b.dst.PutBackupMetadata(newBackup); err != nil {
+		return err
+	}
+	log.WithFields(apexLog.Fields{
+		"new_backup": newBackupName,
+		"size":       utils.FormatBytes(newBackup.CompressedSize),
+		"duration":   utils.HumanizeDuration(time.Since(start)),
+	}).Info("done")
+	return nil
+}
+
+// checkChain - all backups of increment chain shall exist and contain archives
+func (f *flattener) checkChain() error {
+	for name, depth := f.backupName, 0; name != ""; name, depth = f.chain[name].RequiredBackup, depth+1 {
+		chainBackup, exists := f.chain[name]
+		switch {
+		case !exists:
+			return fmt.Errorf("'%s' from increment chain of '%s' is not found on remote storage: %w", name, f.backupName, new_storage.ErrNotFound)
+		case depth > len(f.chain):
+			return fmt.Errorf("increment chain of '%s' is cyclic", f.backupName)
+		case chainBackup.Legacy:
+			return fmt.Errorf("'%s' is old format backup and can't be flattened", name)
+		case chainBackup.Broken != "":
+			return fmt.Errorf("'%s' is %s and can't be flattened", name, chainBackup.Broken)
+		case chainBackup.DataFormat == "directory":
+			return fmt.Errorf("'%s' is uploaded without compression and can't be flattened", name)
+		}
+	}
+	return nil
+}
+
+// tableMetadata - read table metadata of chain backup from remote storage
+func (f *flattener) tableMetadata(backupName string, title metadata.TableTitle) (*metadata.TableMetadata, error) {
+	remoteTableMetadata := path.Join(backupName, "metadata", common.TableMetadataPath(title.Database, title.Table))
+	if table, isCached := f.tables[remoteTableMetadata]; isCached {
+		return table, nil
+	}
+	r, err := f.b.dst.GetFileReader(remoteTableMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", remoteTableMetadata, err)
+	}
+	body, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %v", remoteTableMetadata, err)
+	}
+	var table metadata.TableMetadata
+	if err := json.Unmarshal(body, &table); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", remoteTableMetadata, err)
+	}
+	f.tables[remoteTableMetadata] = &table
+	return &table, nil
+}
+
+// flattenTable - copy all parts of table into one new archive for each disk, return metadata of flattened table and size of its archives
+func (f *flattener) flattenTable(table metadata.TableMetadata) (*metadata.TableMetadata, int64, error) {
+	flatTable := table
+	flatTable.IncrementOf = ""
+	flatTable.Files = nil
+	flatTable.ArchiveParts = nil
+	flatTable.ArchiveSizes = nil
+	flatTable.CompressionFormat = ""
+	if format, _ := f.b.cfg.GetTableCompression(table.Database, table.Table); format != "" {
+		flatTable.CompressionFormat = format
+	}
+	flatTable.Parts = map[string][]metadata.Part{}
+	disks := make([]string, 0, len(table.Parts))
+	for disk, parts := range table.Parts {
+		flatParts := make([]metadata.Part, len(parts))
+		for i, part := range parts {
+			part.Required = false
+			part.SharedKey = ""
+			part.RefBackup = ""
+			part.RefKey = ""
+			flatParts[i] = part
+		}
+		flatTable.Parts[disk] = flatParts
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+	if table.MetadataOnly {
+		return &flatTable, 0, nil
+	}
+	dst := f.b.tableDestination(flatTable)
+	extension := tableArchiveExtension(flatTable, f.b.cfg.GetArchiveExtension())
+	baseRemotePath := path.Join(f.newBackupName, "shadow", common.TablePath(table.Database, table.Table))
+	var dataSize int64
+	addArchive := func(archiveName string, remoteParts []string, size int64) {
+		if flatTable.ArchiveSizes == nil {
+			flatTable.ArchiveSizes = map[string]int64{}
+		}
+		flatTable.ArchiveSizes[archiveName] = size
+		for _, remotePart := range remoteParts {
+			if flatTable.ArchiveParts == nil {
+				flatTable.ArchiveParts = map[string][]string{}
+			}
+			flatTable.ArchiveParts[archiveName] = append(flatTable.ArchiveParts[archiveName], path.Base(remotePart))
+		}
+		dataSize += size
+	}
+	for _, disk := range disks {
+		if len(table.Parts[disk]) == 0 {
+			continue
+		}
+		sources, err := f.partSources(table, disk)
+		if err != nil {
+			return nil, 0, err
+		}
+		fileName := fmt.Sprintf("%s_1.%s", disk, extension)
+		remoteParts, size, copied, err := dst.CompressedStreamCopy(sources, path.Join(baseRemotePath, fileName))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, part := range table.Parts[disk] {
+			if copied[part.Name] == 0 {
+				return nil, 0, fmt.Errorf("part %s is not found in archives of increment chain", part.Name)
+			}
+		}
+		if flatTable.Files == nil {
+			flatTable.Files = map[string][]string{}
+		}
+		flatTable.Files[disk] = []string{fileName}
+		addArchive(fileName, remoteParts, size)
+	}
+	// detached parts are uploaded completely by each backup
+	baseRemoteDetachedPath := path.Join(f.backupName, "detached", common.TablePath(table.Database, table.Table))
+	for disk := range table.DetachedParts {
+		sourceArchive := detachedArchiveName(disk, tableArchiveExtension(table, config.ArchiveExtensions[f.chain[f.backupName].DataFormat]))
+		keys := []string{path.Join(baseRemoteDetachedPath, path.Base(sourceArchive))}
+		if len(table.ArchiveParts[sourceArchive]) > 0 {
+			keys = nil
+			for _, archivePart := range table.ArchiveParts[sourceArchive] {
+				keys = append(keys, path.Join(baseRemoteDetachedPath, archivePart))
+			}
+		}
+		archiveName := detachedArchiveName(disk, extension)
+		remotePath := path.Join(f.newBackupName, "detached", common.TablePath(table.Database, table.Table), path.Base(archiveName))
+		remoteParts, size, _, err := dst.CompressedStreamCopy([]new_storage.ArchiveSource{{Keys: keys}}, remotePath)
+		if err != nil {
+			return nil, 0, fmt.Errorf("can't copy detached parts: %v", err)
+		}
+		addArchive(archiveName, remoteParts, size)
+	}
+	return &flatTable, dataSize, nil
+}
+
+// partSources - archives of increment chain which contain parts of table on disk, each archive is read once for all its parts
+func (f *flattener) partSources(table metadata.TableMetadata, disk string) ([]new_storage.ArchiveSource, error) {
+	var sources []new_storage.ArchiveSource
+	sourceIndex := map[string]int{}
+	title := metadata.TableTitle{Database: table.Database, Table: table.Table}
+	for _, part := range table.Parts[disk] {
+		archives, prefix, err := f.findPart(title, disk, part.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, keys := range archives {
+			id := prefix + ":" + keys[0]
+			i, exists := sourceIndex[id]
+			if !exists {
+				i = len(sources)
+				sourceIndex[id] = i
+				sources = append(sources, new_storage.ArchiveSource{Keys: keys, Prefix: prefix, Parts: map[string]bool{}})
+			}
+			sources[i].Parts[part.Name] = true
+		}
+	}
+	return sources, nil
+}
+
+// findPart - walk increment chain from flattened backup to backup which contains data of part, return keys of archives which could contain part,
+// prefix is part name for content-addressed archive of shared part
+func (f *flattener) findPart(title metadata.TableTitle, disk, partName string) ([][]string, string, error) {
+	for backupName := f.backupName; backupName != ""; backupName = f.chain[backupName].RequiredBackup {
+		table, err := f.tableMetadata(backupName, title)
+		if err != nil {
+			if errors.Is(err, new_storage.ErrNotFound) {
+				return nil, "", fmt.Errorf("%s.%s is not found in '%s' required by increment chain", title.Database, title.Table, backupName)
+			}
+			return nil, "", err
+		}
+		partDisk, part, found := findTablePart(table, disk, partName)
+		if !found {
+			return nil, "", fmt.Errorf("part %s is not found in '%s' required by increment chain", partName, backupName)
+		}
+		if part.SharedKey != "" {
+			return [][]string{{part.SharedKey}}, partName, nil
+		}
+		if part.RefKey != "" {
+			return [][]string{{part.RefKey}}, "", nil
+		}
+		if part.Required {
+			continue
+		}
+		return f.partArchives(backupName, table, partDisk, partName), "", nil
+	}
+	return nil, "", fmt.Errorf("part %s is not found in increment chain", partName)
+}
+
+// findTablePart - part with partName on disk, other disks are checked when part was moved between disks
+func findTablePart(table *metadata.TableMetadata, disk, partName string) (string, metadata.Part, bool) {
+	for _, part := range table.Parts[disk] {
+		if part.Name == partName {
+			return disk, part, true
+		}
+	}
+	for partDisk, parts := range table.Parts {
+		for _, part := range parts {
+			if part.Name == partName {
+				return partDisk, part, true
+			}
+		}
+	}
+	return "", metadata.Part{}, false
+}
+
+// partArchives - keys of archives of disk which could contain part, archive uploaded by `upload_by_part` is used when it exists
+func (f *flattener) partArchives(backupName string, table *metadata.TableMetadata, disk, partName string) [][]string {
+	extension := tableArchiveExtension(*table, config.ArchiveExtensions[f.chain[backupName].DataFormat])
+	baseRemotePath := path.Join(backupName, "shadow", common.TablePath(table.Database, table.Table))
+	archiveKeys := func(archiveFile string) []string {
+		if len(table.ArchiveParts[archiveFile]) == 0 {
+			return []string{path.Join(baseRemotePath, archiveFile)}
+		}
+		var keys []string
+		for _, archivePart := range table.ArchiveParts[archiveFile] {
+			keys = append(keys, path.Join(baseRemotePath, archivePart))
+		}
+		return keys
+	}
+	partArchive := fmt.Sprintf("%s_%s.%s", disk, common.TablePathEncode(partName), extension)
+	var archives [][]string
+	for _, archiveFile := range table.Files[disk] {
+		if archiveFile == partArchive {
+			return [][]string{archiveKeys(archiveFile)}
+		}
+		archives = append(archives, archiveKeys(archiveFile))
+	}
+	return archives
+}
+
+// copyBackupRelatedArchive - copy `access` or `configs` archive of flattened backup, return size of copied archive, 0 when it is absent
+func (f *flattener) copyBackupRelatedArchive(prefix string) (int64, error) {
+	sourceKey := path.Join(f.backupName, fmt.Sprintf("%s.%s", prefix, config.ArchiveExtensions[f.chain[f.backupName].DataFormat]))
+	if _, err := f.b.dst.StatFile(sourceKey); errors.Is(err, new_storage.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	remotePath := path.Join(f.newBackupName, fmt.Sprintf("%s.%s", prefix, f.b.cfg.GetArchiveExtension()))
+	_, size, _, err := f.b.dst.CompressedStreamCopy([]new_storage.ArchiveSource{{Keys: []string{sourceKey}}}, remotePath)
+	if err != nil {
+		return 0, fmt.Errorf("can't copy %s: %v", sourceKey, err)
+	}
+	return size, nil
+}
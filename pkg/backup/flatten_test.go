@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// listingStorage - memoryStorage which lists backups by Walk and records keys of PutFile calls
+type listingStorage struct {
+	memoryStorage
+	puts []string
+}
+
+func (s *listingStorage) Walk(prefix string, recursive bool, fn func(new_storage.RemoteFile) error) error {
+	s.Lock()
+	files := map[string]int64{}
+	for key, body := range s.files {
+		files[key] = int64(len(body))
+	}
+	s.Unlock()
+	prefix = strings.Trim(prefix, "/")
+	folders := map[string]bool{}
+	for key, size := range files {
+		if prefix != "" && !strings.HasPrefix(key, prefix+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+		if !recursive {
+			name = strings.SplitN(name, "/", 2)[0]
+			if folders[name] {
+				continue
+			}
+			folders[name] = true
+		}
+		if err := fn(recordingFile{name: name, size: size}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *listingStorage) PutFile(key string, r io.ReadCloser) error {
+	s.Lock()
+	s.puts = append(s.puts, key)
+	s.Unlock()
+	return s.memoryStorage.PutFile(key, r)
+}
+
+func TestFlatten(t *testing.T) {
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	baseName, incrementName, fullName := "base_"+suffix, "increment_"+suffix, "full_"+suffix
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.General.UploadConcurrency = 1
+	cfg.General.DownloadConcurrency = 1
+	storage := &listingStorage{memoryStorage: memoryStorage{files: map[string][]byte{}}}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:             cfg,
+		dst:             dst,
+		DiskToPathMap:   map[string]string{"default": localPath},
+		DefaultDataPath: localPath,
+	}
+	timeouts, err := newTableTimeouts(cfg)
+	assert.NoError(t, err)
+	title := metadata.TableTitle{Database: "default", Table: "events"}
+	shadowPath := func(backupName string) string {
+		return path.Join(localPath, "backup", backupName, "shadow", common.TablePath(title.Database, title.Table), "default")
+	}
+	upload := func(backupName, requiredBackup string, parts []metadata.Part) {
+		table := metadata.TableMetadata{Database: title.Database, Table: title.Table, Parts: map[string][]metadata.Part{"default": parts}}
+		_, _, _, err := b.uploadTables(backupName, ListOfTables{table}, false, false, timeouts)
+		assert.NoError(t, err)
+		assert.NoError(t, dst.PutBackupMetadata(metadata.BackupMetadata{
+			BackupName: backupName, DataFormat: "tar", RequiredBackup: requiredBackup, Tables: []metadata.TableTitle{title}, CreationDate: time.Now(),
+		}))
+	}
+	writeDetachedPart(t, path.Join(shadowPath(baseName), "all_1_1_0"), "first part")
+	upload(baseName, "", []metadata.Part{{Name: "all_1_1_0"}})
+	writeDetachedPart(t, path.Join(shadowPath(incrementName), "all_2_2_0"), "second part")
+	upload(incrementName, baseName, []metadata.Part{{Name: "all_1_1_0", Required: true}, {Name: "all_2_2_0"}})
+
+	assert.NoError(t, b.flatten(incrementName, fullName, time.Now()))
+	remoteBackups, err := dst.BackupList(true, fullName)
+	assert.NoError(t, err)
+	var full *new_storage.Backup
+	for i := range remoteBackups {
+		if remoteBackups[i].BackupName == fullName {
+			full = &remoteBackups[i]
+		}
+	}
+	if assert.NotNil(t, full) {
+		assert.Empty(t, full.RequiredBackup)
+		assert.Empty(t, full.Broken)
+		assert.Equal(t, []metadata.TableTitle{title}, full.Tables)
+	}
+	var fullTable metadata.TableMetadata
+	assert.NoError(t, json.Unmarshal(storage.files[path.Join(fullName, "metadata", common.TableMetadataPath(title.Database, title.Table))], &fullTable))
+	assert.Equal(t, map[string][]string{"default": {"default_1.tar"}}, fullTable.Files)
+	assert.Equal(t, []metadata.Part{{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}, fullTable.Parts["default"])
+
+	// flattened backup is downloaded without its increment chain
+	downloadPath := t.TempDir()
+	b.DiskToPathMap = map[string]string{"default": downloadPath}
+	assert.NoError(t, b.downloadTableData(full.BackupMetadata, fullTable))
+	for part, content := range map[string]string{"all_1_1_0": "first part", "all_2_2_0": "second part"} {
+		body, err := ioutil.ReadFile(path.Join(downloadPath, "backup", fullName, "shadow", common.TablePath(title.Database, title.Table), "default", part, "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	}
+
+	// interrupted flatten is resumed, already flattened tables are not copied again
+	resumedName := "resumed_" + suffix
+	for key, body := range storage.files {
+		if strings.HasPrefix(key, fullName+"/") && key != path.Join(fullName, "metadata.json") {
+			storage.files[resumedName+strings.TrimPrefix(key, fullName)] = body
+		}
+	}
+	storage.puts = nil
+	assert.NoError(t, b.flatten(incrementName, resumedName, time.Now()))
+	assert.Equal(t, []string{path.Join(resumedName, "metadata.json")}, storage.puts)
+
+	assert.EqualError(t, b.flatten(incrementName, fullName, time.Now()), fmt.Sprintf("'%s' already exists on remote storage: backup is already exists", fullName))
+	for key := range storage.files {
+		if strings.HasPrefix(key, baseName+"/") {
+			delete(storage.files, key)
+		}
+	}
+	assert.ErrorIs(t, b.flatten(incrementName, "broken_"+suffix, time.Now()), new_storage.ErrNotFound)
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupFailedBackup(t *testing.T) {
+	cfg := config.DefaultConfig()
+	log := apexLog.WithField("test", t.Name())
+	cleanups := 0
+	cleanup := func() error {
+		cleanups++
+		return errors.New("cleanup error is logged only")
+	}
+	cleanupFailedBackup(cfg, "/var/lib/clickhouse/backup/failed", log, cleanup)
+	assert.Equal(t, 1, cleanups)
+	cfg.General.KeepFailedBackups = true
+	cleanupFailedBackup(cfg, "/var/lib/clickhouse/backup/failed", log, cleanup)
+	assert.Equal(t, 1, cleanups, "failed backup shall be kept")
+}
+
+// failingStorage - memoryStorage which fails upload of keys with failPrefix
+type failingStorage struct {
+	memoryStorage
+	failPrefix string
+}
+
+func (s *failingStorage) PutFile(key string, r io.ReadCloser) error {
+	if s.failPrefix != "" && strings.HasPrefix(key, s.failPrefix) {
+		return errors.New("upload failed")
+	}
+	return s.memoryStorage.PutFile(key, r)
+}
+
+func TestUploadTablesKeepFailedBackups(t *testing.T) {
+	for _, tc := range []struct {
+		failPrefix  string
+		keepFailed  bool
+		expectKept  bool
+		expectError bool
+	}{
+		{failPrefix: "", keepFailed: true, expectKept: false},
+		{failPrefix: "", keepFailed: false, expectKept: false},
+		{failPrefix: "test_backup/shadow/default/broken/", keepFailed: true, expectKept: true, expectError: true},
+		{failPrefix: "test_backup/shadow/default/broken/", keepFailed: false, expectKept: false, expectError: true},
+	} {
+		localPath := t.TempDir()
+		cfg := config.DefaultConfig()
+		cfg.General.RemoteStorage = "s3"
+		cfg.General.UploadConcurrency = 1
+		cfg.General.KeepFailedBackups = tc.keepFailed
+		cfg.S3.CompressionFormat = "tar"
+		storage := &failingStorage{memoryStorage: memoryStorage{files: map[string][]byte{}}, failPrefix: tc.failPrefix}
+		dst, err := new_storage.NewBackupDestination(cfg)
+		assert.NoError(t, err)
+		dst.RemoteStorage = storage
+		b := &Backuper{
+			cfg:             cfg,
+			dst:             dst,
+			DiskToPathMap:   map[string]string{"default": localPath},
+			DefaultDataPath: localPath,
+		}
+		var tables ListOfTables
+		for _, name := range []string{"ok", "broken"} {
+			partPath := path.Join(localPath, "backup", "test_backup", "shadow", "default", name, "default", "all_1_1_0")
+			assert.NoError(t, os.MkdirAll(partPath, 0750))
+			assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte(name), 0640))
+			tables = append(tables, metadata.TableMetadata{
+				Database: "default",
+				Table:    name,
+				Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+			})
+		}
+		_, _, _, err = b.uploadTables("test_backup", tables, false, true, tableTimeouts{failOnTable: true})
+		if tc.expectError {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		_, err = os.Stat(path.Join(localPath, "backup", "test_backup", "shadow", "default", "ok", "default", "all_1_1_0", "data.bin"))
+		if tc.expectKept {
+			assert.NoError(t, err, "local data of uploaded table shall be kept after failed upload")
+		} else {
+			assert.True(t, os.IsNotExist(err), "local data of uploaded table shall be deleted")
+		}
+	}
+}
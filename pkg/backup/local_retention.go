@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// localSpace - total and available bytes of filesystems which contain local disks, each filesystem is counted once
+type localSpace struct {
+	Total uint64
+	Free  uint64
+}
+
+// getLocalSpace - statfs of each disk path, disks which path doesn't exist are skipped
+func getLocalSpace(disks []clickhouse.Disk) (localSpace, error) {
+	var space localSpace
+	devices := map[uint64]struct{}{}
+	for _, disk := range disks {
+		info, err := os.Stat(disk.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return space, err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if _, exists := devices[uint64(stat.Dev)]; exists {
+				continue
+			}
+			devices[uint64(stat.Dev)] = struct{}{}
+		}
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(disk.Path, &fs); err != nil {
+			return space, fmt.Errorf("can't get free space of disk '%s': %v", disk.Name, err)
+		}
+		space.Total += uint64(fs.Blocks) * uint64(fs.Bsize)
+		space.Free += uint64(fs.Bavail) * uint64(fs.Bsize)
+	}
+	return space, nil
+}
+
+// localBackupSize - size of backup from its metadata.json, legacy and broken backups have zero size
+func localBackupSize(backup BackupLocal) uint64 {
+	return backup.DataSize + backup.MetadataSize
+}
+
+// backupsToFreeSpace - oldest local backups which shall be deleted, so local backups with new backup of projectedSize take no more than maxSize
+// and at least minFreePercent of disks stays free, protected backups and backups required by remaining ones are never deleted.
+// Parts of backup are hardlinks which are shared with tables and other backups, so freed space is an upper bound.
+// Error is returned when limits are exceeded even after deletion of all allowed backups, returned backups are still the best effort
+func backupsToFreeSpace(backups []BackupLocal, space localSpace, projectedSize uint64, maxSize int64, minFreePercent int, isProtected func(string) bool) ([]BackupLocal, error) {
+	remaining := make([]BackupLocal, len(backups))
+	copy(remaining, backups)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].CreationDate.Before(remaining[j].CreationDate)
+	})
+	var usedSize, freed uint64
+	for _, backup := range remaining {
+		usedSize += localBackupSize(backup)
+	}
+	exceeded := func() string {
+		if maxSize > 0 && usedSize+projectedSize > uint64(maxSize) {
+			return fmt.Sprintf("local backups take %s with new backup, max_local_backup_size_bytes is %s", utils.FormatBytes(usedSize+projectedSize), utils.FormatBytes(uint64(maxSize)))
+		}
+		if minFreePercent > 0 && space.Total > 0 {
+			free := space.Free + freed
+			if free < projectedSize {
+				free = 0
+			} else {
+				free -= projectedSize
+			}
+			if free*100 < uint64(minFreePercent)*space.Total {
+				return fmt.Sprintf("%s of %s is free with new backup, min_free_space_percent is %d", utils.FormatBytes(free), utils.FormatBytes(space.Total), minFreePercent)
+			}
+		}
+		return ""
+	}
+	var toDelete []BackupLocal
+	for reason := exceeded(); reason != ""; reason = exceeded() {
+		required := map[string]struct{}{}
+		for _, backup := range remaining {
+			if backup.RequiredBackup != "" {
+				required[backup.RequiredBackup] = struct{}{}
+			}
+		}
+		oldest := -1
+		for i, backup := range remaining {
+			if _, isRequired := required[backup.BackupName]; !isRequired && !isProtected(backup.BackupName) {
+				oldest = i
+				break
+			}
+		}
+		if oldest < 0 {
+			return toDelete, fmt.Errorf("%s, there are no more local backups which can be deleted", reason)
+		}
+		usedSize -= localBackupSize(remaining[oldest])
+		freed += localBackupSize(remaining[oldest])
+		toDelete = append(toDelete, remaining[oldest])
+		remaining = append(remaining[:oldest], remaining[oldest+1:]...)
+	}
+	return toDelete, nil
+}
+
+// freeLocalSpace - delete oldest local backups according to max_local_backup_size_bytes and min_free_space_percent,
+// backups locked by running operations and currentBackup are kept. Before create projectedSize is the estimated size of new backup
+// and nothing is deleted when limits can't be satisfied, after create projectedSize is 0 and as many backups as allowed are deleted
+func freeLocalSpace(cfg *config.Config, disks []clickhouse.Disk, backupsPath, currentBackup string, projectedSize uint64) error {
+	if cfg.General.MaxLocalBackupSizeBytes <= 0 && cfg.General.MinFreeSpacePercent <= 0 {
+		return nil
+	}
+	space, err := getLocalSpace(disks)
+	if err != nil {
+		return err
+	}
+	backupList, err := GetLocalBackups(cfg)
+	if err != nil {
+		return err
+	}
+	isProtected := func(backupName string) bool {
+		if backupName == currentBackup {
+			return true
+		}
+		_, locked := backupLockOwner(backupsPath, backupName)
+		return locked
+	}
+	backupsToDelete, planErr := backupsToFreeSpace(backupList, space, projectedSize, cfg.General.MaxLocalBackupSizeBytes, cfg.General.MinFreeSpacePercent, isProtected)
+	if planErr != nil && projectedSize > 0 {
+		return fmt.Errorf("not enough space for new backup of %s: %v", utils.FormatBytes(projectedSize), planErr)
+	}
+	for _, backup := range backupsToDelete {
+		apexLog.WithField("size", utils.FormatBytes(localBackupSize(backup))).Infof("delete local backup '%s' to satisfy max_local_backup_size_bytes and min_free_space_percent", backup.BackupName)
+		if err := RemoveBackupLocal(cfg, backup.BackupName); err != nil {
+			return err
+		}
+	}
+	if planErr != nil {
+		apexLog.Warnf("can't free local space: %v", planErr)
+	}
+	return nil
+}
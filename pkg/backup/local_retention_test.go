@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupsToFreeSpace(t *testing.T) {
+	now := time.Now()
+	localBackup := func(name string, age time.Duration, size uint64, requiredBackup string) BackupLocal {
+		return BackupLocal{BackupMetadata: metadata.BackupMetadata{BackupName: name, CreationDate: now.Add(-age), DataSize: size, RequiredBackup: requiredBackup}}
+	}
+	backups := []BackupLocal{
+		localBackup("new", time.Hour, 100, ""),
+		localBackup("old", 3*time.Hour, 100, ""),
+		localBackup("base", 4*time.Hour, 100, ""),
+		localBackup("changed", 2*time.Hour, 10, "base"),
+	}
+	names := func(backups []BackupLocal) []string {
+		result := make([]string, len(backups))
+		for i, backup := range backups {
+			result[i] = backup.BackupName
+		}
+		return result
+	}
+	notProtected := func(string) bool { return false }
+	space := localSpace{Total: 1000, Free: 500}
+
+	toDelete, err := backupsToFreeSpace(backups, space, 100, 410, 0, notProtected)
+	assert.NoError(t, err)
+	assert.Empty(t, toDelete, "310 + 100 of new backup fit into limit")
+
+	toDelete, err = backupsToFreeSpace(backups, space, 100, 300, 0, notProtected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old", "changed"}, names(toDelete), "base is required by changed, old is the oldest of others")
+
+	toDelete, err = backupsToFreeSpace(backups, space, 100, 210, 0, notProtected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old", "changed", "base"}, names(toDelete), "base can be deleted after changed")
+
+	toDelete, err = backupsToFreeSpace(backups, space, 0, 0, 60, notProtected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old"}, names(toDelete))
+	toDelete, err = backupsToFreeSpace(backups, space, 100, 0, 60, notProtected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old", "changed", "base"}, names(toDelete))
+
+	toDelete, err = backupsToFreeSpace(backups, space, 100, 150, 0, func(backupName string) bool { return backupName == "old" })
+	assert.EqualError(t, err, "local backups take 200B with new backup, max_local_backup_size_bytes is 150B, there are no more local backups which can be deleted")
+	assert.Equal(t, []string{"changed", "base", "new"}, names(toDelete))
+	_, err = backupsToFreeSpace(backups, space, 900, 0, 10, notProtected)
+	assert.EqualError(t, err, "0B of 1000B is free with new backup, min_free_space_percent is 10, there are no more local backups which can be deleted")
+}
+
+func TestGetLocalSpace(t *testing.T) {
+	dir := t.TempDir()
+	single, err := getLocalSpace([]clickhouse.Disk{{Name: "default", Path: dir}})
+	assert.NoError(t, err)
+	assert.Greater(t, single.Total, uint64(0))
+	assert.LessOrEqual(t, single.Free, single.Total)
+	space, err := getLocalSpace([]clickhouse.Disk{{Name: "default", Path: dir}, {Name: "same_fs", Path: t.TempDir()}, {Name: "absent", Path: dir + "/absent"}})
+	assert.NoError(t, err)
+	assert.Equal(t, single.Total, space.Total, "filesystem shall be counted once")
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	apexLog "github.com/apex/log"
+)
+
+// ErrBackupLocked - backup is used by another running create, upload or download
+var ErrBackupLocked = errors.New("backup is locked")
+
+// staleLockAge - lock file without PID older than this is left by crashed process
+const staleLockAge = time.Minute
+
+// backupLockPath - lock file placed near backup directory, so it doesn't look like a part of backup and isn't uploaded
+func backupLockPath(backupsPath, backupName string) string {
+	return path.Join(backupsPath, backupName+".lock")
+}
+
+// lockBackup - create <backup_name>.lock with PID of current process, return function which removes lock,
+// lock file is created exclusively, lock of finished process is removed and creation is retried once
+func lockBackup(backupsPath, backupName string) (func(), error) {
+	lockFile := backupLockPath(backupsPath, backupName)
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if os.IsExist(err) {
+		if pid, locked := backupLockOwner(backupsPath, backupName); locked {
+			return nil, fmt.Errorf("'%s' is locked by running operation with pid %d: %w", backupName, pid, ErrBackupLocked)
+		} else if pid == 0 && isFreshLock(lockFile) {
+			// lock was just created by another process which didn't write its PID yet
+			return nil, fmt.Errorf("'%s' is locked by running operation: %w", backupName, ErrBackupLocked)
+		}
+		apexLog.Warnf("remove stale lock %s", lockFile)
+		if err := os.Remove(lockFile); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("can't remove stale lock %s: %v", lockFile, err)
+		}
+		f, err = os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("'%s' is locked by running operation: %w", backupName, ErrBackupLocked)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't create lock %s: %v", lockFile, err)
+	}
+	_, err = f.WriteString(strconv.Itoa(os.Getpid()))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(lockFile)
+		return nil, fmt.Errorf("can't write lock %s: %v", lockFile, err)
+	}
+	return func() {
+		if err := os.Remove(lockFile); err != nil && !os.IsNotExist(err) {
+			apexLog.Warnf("can't remove lock %s: %v", lockFile, err)
+		}
+	}, nil
+}
+
+// isFreshLock - lock without valid PID is treated as being created during staleLockAge
+func isFreshLock(lockFile string) bool {
+	info, err := os.Stat(lockFile)
+	return err == nil && time.Since(info.ModTime()) < staleLockAge
+}
+
+// backupLockOwner - return PID of process which holds backup lock, locks of finished processes are ignored
+func backupLockOwner(backupsPath, backupName string) (int, bool) {
+	body, err := ioutil.ReadFile(backupLockPath(backupsPath, backupName))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	if pid == os.Getpid() {
+		return pid, true
+	}
+	err = syscall.Kill(pid, 0)
+	return pid, err == nil || err == syscall.EPERM
+}
+
+// lockedBackups - return names and owner PIDs of backups which locks are held by running operations, except backup with exceptName
+func lockedBackups(backupsPath, exceptName string) []string {
+	lockFiles, err := filepath.Glob(path.Join(backupsPath, "*.lock"))
+	if err != nil {
+		return nil
+	}
+	var locked []string
+	for _, lockFile := range lockFiles {
+		backupName := strings.TrimSuffix(filepath.Base(lockFile), ".lock")
+		if backupName == exceptName {
+			continue
+		}
+		if pid, isLocked := backupLockOwner(backupsPath, backupName); isLocked {
+			locked = append(locked, fmt.Sprintf("'%s' (pid %d)", backupName, pid))
+		}
+	}
+	return locked
+}
@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// isObjectDisk - parts on s3, hdfs and other remote disks are local stubs which reference remote objects, FREEZE doesn't copy these objects,
+// type is empty in system.disks of old clickhouse versions which have only local disks
+func isObjectDisk(disk clickhouse.Disk) bool {
+	return disk.Type != "" && disk.Type != "local"
+}
+
+// tableObjectDisks - sorted names of object disks which contain table data
+func tableObjectDisks(disks []clickhouse.Disk, table clickhouse.Table) []string {
+	objectDisks := map[string]bool{}
+	for _, disk := range disks {
+		objectDisks[disk.Name] = isObjectDisk(disk)
+	}
+	var result []string
+	for disk := range clickhouse.GetDisksByPaths(disks, table.DataPaths) {
+		if objectDisks[disk] {
+			result = append(result, disk)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// findObjectDiskTables - tables with data on object disks, each of them is reported because its data can't be backed up
+func findObjectDiskTables(tables []clickhouse.Table, disks []clickhouse.Disk, objectDisksMode string, log *apexLog.Entry) map[metadata.TableTitle][]string {
+	result := map[metadata.TableTitle][]string{}
+	for _, table := range tables {
+		if table.Skip || !isDataBackupEngine(table.Engine) {
+			continue
+		}
+		objectDisks := tableObjectDisks(disks, table)
+		if len(objectDisks) == 0 {
+			continue
+		}
+		result[metadata.TableTitle{Database: table.Database, Table: table.Name}] = objectDisks
+		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
+		if objectDisksMode == "metadata" {
+			log.Warnf("data is stored on object disk %s, backup will contain only local stubs of parts and keys of remote objects, remote objects are not copied", quoteNames(objectDisks))
+		} else {
+			log.Warnf("data is stored on object disk %s, only schema will be backed up, set `object_disks: metadata` to backup local stubs of parts", quoteNames(objectDisks))
+		}
+	}
+	return result
+}
+
+// objectDisksSkipReason - DataSkipReason for tables which data is skipped by `object_disks: skip`
+func objectDisksSkipReason(objectDisks []string) string {
+	return fmt.Sprintf("data is stored on object disk %s", quoteNames(objectDisks))
+}
+
+func quoteNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = "'" + name + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// readObjectDiskStub - remote object keys referenced by local stub of object disk, stub contains version,
+// `objects_count<TAB>total_size`, `object_size<TAB>object_key` for each object, then ref_count and read_only flag
+func readObjectDiskStub(stubPath string) ([]string, error) {
+	body, err := ioutil.ReadFile(stubPath)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(body), "\n"), "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("%s is not object disk stub", stubPath)
+	}
+	if version, err := strconv.Atoi(lines[0]); err != nil || version < 1 || version > 4 {
+		return nil, fmt.Errorf("%s is not object disk stub, unknown version '%s'", stubPath, lines[0])
+	}
+	header := strings.Fields(lines[1])
+	if len(header) != 2 {
+		return nil, fmt.Errorf("%s is not object disk stub, wrong objects header '%s'", stubPath, lines[1])
+	}
+	count, err := strconv.Atoi(header[0])
+	if err != nil || count < 0 || len(lines) < 2+count {
+		return nil, fmt.Errorf("%s is not object disk stub, wrong objects count '%s'", stubPath, header[0])
+	}
+	keys := make([]string, 0, count)
+	for _, line := range lines[2 : 2+count] {
+		object := strings.SplitN(line, "\t", 2)
+		if len(object) != 2 || object[1] == "" {
+			return nil, fmt.Errorf("%s is not object disk stub, wrong object '%s'", stubPath, line)
+		}
+		keys = append(keys, object[1])
+	}
+	return keys, nil
+}
+
+// backupObjectDiskKeys - remote keys referenced by stubs of table parts which were backed up from each object disk,
+// files which aren't stubs are kept in backup and ignored here
+func backupObjectDiskKeys(backupName string, disks []clickhouse.Disk, table clickhouse.Table, objectDisks []string, log *apexLog.Entry) (map[string][]string, error) {
+	diskPaths := map[string]string{}
+	for _, disk := range disks {
+		diskPaths[disk.Name] = disk.Path
+	}
+	result := map[string][]string{}
+	for _, disk := range objectDisks {
+		backupShadowPath := path.Join(diskPaths[disk], "backup", backupName, "shadow", common.TablePath(table.Database, table.Name), disk)
+		var keys []string
+		err := filepath.Walk(backupShadowPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && filePath == backupShadowPath {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			stubKeys, err := readObjectDiskStub(filePath)
+			if err != nil {
+				log.Debugf("skip %v", err)
+				return nil
+			}
+			keys = append(keys, stubKeys...)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't read object disk '%s' stubs: %v", disk, err)
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			result[disk] = keys
+		}
+	}
+	return result, nil
+}
+
+// checkRestoreObjectDisks - data of tables from object disks isn't contained in backup, restore refuses it instead of attaching empty parts
+func checkRestoreObjectDisks(tables ListOfTables) error {
+	var refused []string
+	for _, table := range tables {
+		if table.DataSkipReason != "" {
+			refused = append(refused, fmt.Sprintf("'%s.%s' (%s)", table.Database, table.Table, table.DataSkipReason))
+		} else if len(table.ObjectDisks) > 0 {
+			refused = append(refused, fmt.Sprintf("'%s.%s' (only stubs of object disk %s)", table.Database, table.Table, quoteNames(table.ObjectDisks)))
+		}
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("can't restore data of %s, backup doesn't contain it, restore these tables with `--schema` or exclude them by `--tables`", strings.Join(refused, ", "))
+	}
+	return nil
+}
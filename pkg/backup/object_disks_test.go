@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectDiskTables(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/", Type: "local"},
+		{Name: "s3", Path: "/var/lib/clickhouse/disks/s3/", Type: "s3"},
+	}
+	tables := []clickhouse.Table{
+		{Database: "default", Name: "local", Engine: "MergeTree", DataPaths: []string{"/var/lib/clickhouse/store/123/"}},
+		{Database: "default", Name: "tiered", Engine: "MergeTree", DataPaths: []string{"/var/lib/clickhouse/store/456/", "/var/lib/clickhouse/disks/s3/store/456/"}, TotalBytes: 1024},
+		{Database: "default", Name: "skipped", Engine: "MergeTree", DataPaths: []string{"/var/lib/clickhouse/disks/s3/store/789/"}, Skip: true},
+	}
+	log := apexLog.WithField("test", t.Name())
+	assert.Equal(t, map[metadata.TableTitle][]string{{Database: "default", Table: "tiered"}: {"s3"}}, findObjectDiskTables(tables, disks, "skip", log))
+	assert.Empty(t, tableObjectDisks([]clickhouse.Disk{{Name: "default", Path: "/var/lib/clickhouse/"}}, tables[1]), "old clickhouse versions have only local disks")
+
+	estimate := estimateBackupSize(tables, nil)
+	for mode, note := range map[string]string{"skip": "schema only", "metadata": "stubs only"} {
+		out := &bytes.Buffer{}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.DiscardEmptyColumns)
+		printTablesList(w, tables[1:2], disks, &estimate, mode, false)
+		assert.NoError(t, w.Flush())
+		assert.Contains(t, out.String(), note+", data is stored on object disk 's3'")
+	}
+}
+
+func TestBackupObjectDiskKeys(t *testing.T) {
+	diskPath := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "s3", Path: diskPath, Type: "s3"}}
+	table := clickhouse.Table{Database: "default", Name: "t"}
+	partPath := path.Join(diskPath, "backup", "backup1", "shadow", common.TablePath(table.Database, table.Name), "s3", "all_1_1_0")
+	assert.NoError(t, os.MkdirAll(partPath, 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte("3\n2\t300\n100\tabc/data1\n200\tabc/data2\n0\n0\n"), 0640))
+	assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "columns.txt"), []byte("3\n1\t10\n10\tabc/columns\n1\n0\n"), 0640))
+	assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "frozen_metadata.txt"), []byte("garbage"), 0640))
+
+	keys, err := backupObjectDiskKeys("backup1", disks, table, []string{"s3"}, apexLog.WithField("test", t.Name()))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"s3": {"abc/columns", "abc/data1", "abc/data2"}}, keys)
+
+	keys, err = backupObjectDiskKeys("backup2", disks, table, []string{"s3"}, apexLog.WithField("test", t.Name()))
+	assert.NoError(t, err)
+	assert.Empty(t, keys, "table without parts on object disk")
+
+	_, err = readObjectDiskStub(path.Join(partPath, "frozen_metadata.txt"))
+	assert.Error(t, err)
+}
+
+func TestCheckRestoreObjectDisks(t *testing.T) {
+	assert.NoError(t, checkRestoreObjectDisks(ListOfTables{{Database: "default", Table: "local"}}))
+	err := checkRestoreObjectDisks(ListOfTables{
+		{Database: "default", Table: "local"},
+		{Database: "default", Table: "skipped", ObjectDisks: []string{"s3"}, DataSkipReason: "data is stored on object disk 's3'"},
+		{Database: "default", Table: "stubs", ObjectDisks: []string{"s3"}},
+	})
+	assert.EqualError(t, err, "can't restore data of 'default.skipped' (data is stored on object disk 's3'), 'default.stubs' (only stubs of object disk 's3'), backup doesn't contain it, restore these tables with `--schema` or exclude them by `--tables`")
+}
@@ -0,0 +1,22 @@
+package backup
+
+import (
+	"strings"
+
+	apexLog "github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+// NewOperationID - short random id, which is attached as `operation_id` field to each log line of one create, upload, download or restore
+func NewOperationID() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+}
+
+// operationLog - contextual logger of operation, loggers of nested steps shall be derived from it to keep `operation_id`
+func operationLog(operationID, backupName, operation string) *apexLog.Entry {
+	return apexLog.WithFields(apexLog.Fields{
+		"operation_id": operationID,
+		"backup":       backupName,
+		"operation":    operation,
+	})
+}
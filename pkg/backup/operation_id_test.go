@@ -0,0 +1,32 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOperationIDInLogs - each log line of download on default log level has operation_id of Backuper
+func TestOperationIDInLogs(t *testing.T) {
+	logger := apexLog.Log.(*apexLog.Logger)
+	defer func(handler apexLog.Handler, level apexLog.Level) {
+		logger.Handler, logger.Level = handler, level
+	}(logger.Handler, logger.Level)
+	handler := memory.New()
+	apexLog.SetHandler(handler)
+	apexLog.SetLevel(apexLog.InfoLevel)
+	backupName := fmt.Sprintf("operation_id_%d", time.Now().UnixNano())
+	b := NewBackuper(downloadToConfig(t, backupName))
+	assert.Len(t, b.OperationID, 8)
+	assert.NotEqual(t, b.OperationID, NewBackuper(b.cfg).OperationID)
+	assert.NoError(t, b.Download(backupName, "", nil, false, false, t.TempDir()))
+
+	assert.Len(t, handler.Entries, 3)
+	for _, entry := range handler.Entries {
+		assert.Equal(t, b.OperationID, entry.Fields.Get("operation_id"), entry.Message)
+	}
+}
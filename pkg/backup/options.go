@@ -0,0 +1,250 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OptionsSource - values of command options by CLI flag name, *cli.Context implements it for CLI, API implements it for query arguments and JSON body
+type OptionsSource interface {
+	String(name string) string
+	StringSlice(name string) []string
+	Bool(name string) bool
+}
+
+// stringOption - value of the first of alias names which is set
+func stringOption(src OptionsSource, names ...string) string {
+	for _, name := range names {
+		if value := src.String(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// sliceOption - values of the first of alias names which is set, CLI returns the same values for each alias
+func sliceOption(src OptionsSource, names ...string) []string {
+	for _, name := range names {
+		if values := src.StringSlice(name); len(values) > 0 {
+			return values
+		}
+	}
+	return nil
+}
+
+func boolOption(src OptionsSource, names ...string) bool {
+	for _, name := range names {
+		if src.Bool(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// optionsArgs - CLI flags which reproduce options, used in command of API status
+type optionsArgs []string
+
+func (a *optionsArgs) string(name, value string) {
+	if value != "" {
+		*a = append(*a, fmt.Sprintf("--%s=%q", name, value))
+	}
+}
+
+func (a *optionsArgs) bool(name string, value bool) {
+	if value {
+		*a = append(*a, "--"+name)
+	}
+}
+
+// CreateOptions - options of `create` which are parsed the same way from CLI flags and API query arguments
+type CreateOptions struct {
+	Tables          string   `json:"tables,omitempty"`
+	Partitions      []string `json:"partitions,omitempty"`
+	Schema          bool     `json:"schema,omitempty"`
+	RBAC            bool     `json:"rbac,omitempty"`
+	Configs         bool     `json:"configs,omitempty"`
+	IncludeDetached bool     `json:"include_detached,omitempty"`
+	ChangedSince    string   `json:"changed_since,omitempty"`
+}
+
+// ParseCreateOptions - read and validate options of `create`
+func ParseCreateOptions(src OptionsSource) (CreateOptions, error) {
+	o := CreateOptions{
+		Tables:          strings.Join(sliceOption(src, "tables", "table", "t"), ","),
+		Partitions:      sliceOption(src, "partitions"),
+		Schema:          boolOption(src, "schema", "s"),
+		RBAC:            boolOption(src, "rbac", "backup-rbac", "do-backup-rbac"),
+		Configs:         boolOption(src, "configs", "backup-configs", "do-backup-configs"),
+		IncludeDetached: boolOption(src, "include-detached"),
+		ChangedSince:    stringOption(src, "changed-since"),
+	}
+	return o, o.Validate()
+}
+
+// Validate - check combination of options
+func (o CreateOptions) Validate() error {
+	if o.ChangedSince != "" && (o.Schema || len(o.Partitions) > 0 || o.IncludeDetached) {
+		return fmt.Errorf("--changed-since can't be used with --schema, --partitions or --include-detached")
+	}
+	return nil
+}
+
+// Args - CLI flags of options
+func (o CreateOptions) Args() string {
+	var args optionsArgs
+	args.string("tables", o.Tables)
+	args.string("partitions", strings.Join(o.Partitions, ","))
+	args.bool("schema", o.Schema)
+	args.bool("rbac", o.RBAC)
+	args.bool("configs", o.Configs)
+	args.bool("include-detached", o.IncludeDetached)
+	args.string("changed-since", o.ChangedSince)
+	return strings.Join(args, " ")
+}
+
+// UploadOptions - options of `upload` which are parsed the same way from CLI flags and API query arguments
+type UploadOptions struct {
+	Tables         string   `json:"tables,omitempty"`
+	Partitions     []string `json:"partitions,omitempty"`
+	Schema         bool     `json:"schema,omitempty"`
+	DiffFrom       string   `json:"diff_from,omitempty"`
+	DiffFromRemote string   `json:"diff_from_remote,omitempty"`
+	DeleteSource   bool     `json:"delete_source,omitempty"`
+	Resume         bool     `json:"resume,omitempty"`
+}
+
+// ParseUploadOptions - read and validate options of `upload` of backupName
+func ParseUploadOptions(src OptionsSource, backupName string) (UploadOptions, error) {
+	o := UploadOptions{
+		Tables:         strings.Join(sliceOption(src, "tables", "table", "t"), ","),
+		Partitions:     sliceOption(src, "partitions"),
+		Schema:         boolOption(src, "schema", "s"),
+		DiffFrom:       stringOption(src, "diff-from"),
+		DiffFromRemote: stringOption(src, "diff-from-remote"),
+		DeleteSource:   boolOption(src, "delete-source"),
+		Resume:         boolOption(src, "resume"),
+	}
+	return o, o.Validate(backupName)
+}
+
+// Validate - check combination of options
+func (o UploadOptions) Validate(backupName string) error {
+	if backupName != "" && (backupName == o.DiffFrom || backupName == o.DiffFromRemote) {
+		return fmt.Errorf("you cannot upload diff from the same backup")
+	}
+	if o.DiffFrom != "" && o.DiffFromRemote != "" {
+		return fmt.Errorf("choose setup only `--diff-from-remote` or `--diff-from`, not both")
+	}
+	return nil
+}
+
+// Args - CLI flags of options
+func (o UploadOptions) Args() string {
+	var args optionsArgs
+	args.string("diff-from", o.DiffFrom)
+	args.string("diff-from-remote", o.DiffFromRemote)
+	args.string("tables", o.Tables)
+	args.string("partitions", strings.Join(o.Partitions, ","))
+	args.bool("schema", o.Schema)
+	args.bool("delete-source", o.DeleteSource)
+	args.bool("resume", o.Resume)
+	return strings.Join(args, " ")
+}
+
+// DownloadOptions - options of `download` which are parsed the same way from CLI flags and API query arguments
+type DownloadOptions struct {
+	Tables           string   `json:"tables,omitempty"`
+	Partitions       []string `json:"partitions,omitempty"`
+	Schema           bool     `json:"schema,omitempty"`
+	ForceDefaultDisk bool     `json:"force_default_disk,omitempty"`
+}
+
+// ParseDownloadOptions - read options of `download`, any combination of them is valid
+func ParseDownloadOptions(src OptionsSource) DownloadOptions {
+	return DownloadOptions{
+		Tables:           strings.Join(sliceOption(src, "tables", "table", "t"), ","),
+		Partitions:       sliceOption(src, "partitions"),
+		Schema:           boolOption(src, "schema", "s"),
+		ForceDefaultDisk: boolOption(src, "force-default-disk"),
+	}
+}
+
+// Args - CLI flags of options
+func (o DownloadOptions) Args() string {
+	var args optionsArgs
+	args.string("tables", o.Tables)
+	args.string("partitions", strings.Join(o.Partitions, ","))
+	args.bool("schema", o.Schema)
+	args.bool("force-default-disk", o.ForceDefaultDisk)
+	return strings.Join(args, " ")
+}
+
+// RestoreOptions - options of `restore` which are parsed the same way from CLI flags and API query arguments
+type RestoreOptions struct {
+	Tables           string   `json:"tables,omitempty"`
+	Partitions       []string `json:"partitions,omitempty"`
+	Schema           bool     `json:"schema,omitempty"`
+	Data             bool     `json:"data,omitempty"`
+	Rm               bool     `json:"rm,omitempty"`
+	SkipExisting     bool     `json:"skip_existing,omitempty"`
+	AttachOnly       bool     `json:"attach_only,omitempty"`
+	RBAC             bool     `json:"rbac,omitempty"`
+	Configs          bool     `json:"configs,omitempty"`
+	ForceDefaultDisk bool     `json:"force_default_disk,omitempty"`
+	IncludeDetached  bool     `json:"include_detached,omitempty"`
+	VerifyRows       bool     `json:"verify_rows,omitempty"`
+	ReplicaSync      bool     `json:"replica_sync,omitempty"`
+}
+
+// ParseRestoreOptions - read and validate options of `restore`
+func ParseRestoreOptions(src OptionsSource) (RestoreOptions, error) {
+	o := RestoreOptions{
+		Tables:           strings.Join(sliceOption(src, "tables", "table", "t"), ","),
+		Partitions:       sliceOption(src, "partitions"),
+		Schema:           boolOption(src, "schema", "s"),
+		Data:             boolOption(src, "data", "d"),
+		Rm:               boolOption(src, "rm", "drop", "drop-table"),
+		SkipExisting:     boolOption(src, "skip-existing"),
+		AttachOnly:       boolOption(src, "attach-only", "no-drop"),
+		RBAC:             boolOption(src, "rbac", "restore-rbac", "do-restore-rbac"),
+		Configs:          boolOption(src, "configs", "restore-configs", "do-restore-configs"),
+		ForceDefaultDisk: boolOption(src, "force-default-disk"),
+		IncludeDetached:  boolOption(src, "include-detached"),
+		VerifyRows:       boolOption(src, "verify-rows"),
+		ReplicaSync:      boolOption(src, "replica-sync"),
+	}
+	return o, o.Validate()
+}
+
+// Validate - check combination of options
+func (o RestoreOptions) Validate() error {
+	if o.Rm && o.SkipExisting {
+		return fmt.Errorf("`--drop-table` can't be used together with `--skip-existing`")
+	}
+	if o.AttachOnly && (o.Schema || o.Rm || o.SkipExisting) {
+		return fmt.Errorf("`--attach-only` can't be used together with `--schema`, `--rm` or `--skip-existing`")
+	}
+	if o.ReplicaSync && (o.Schema || o.Data || o.AttachOnly) {
+		return fmt.Errorf("`--replica-sync` can't be used together with `--schema`, `--data` or `--attach-only`")
+	}
+	return nil
+}
+
+// Args - CLI flags of options
+func (o RestoreOptions) Args() string {
+	var args optionsArgs
+	args.string("tables", o.Tables)
+	args.string("partitions", strings.Join(o.Partitions, ","))
+	args.bool("schema", o.Schema)
+	args.bool("data", o.Data)
+	args.bool("rm", o.Rm)
+	args.bool("skip-existing", o.SkipExisting)
+	args.bool("attach-only", o.AttachOnly)
+	args.bool("rbac", o.RBAC)
+	args.bool("configs", o.Configs)
+	args.bool("force-default-disk", o.ForceDefaultDisk)
+	args.bool("include-detached", o.IncludeDetached)
+	args.bool("verify-rows", o.VerifyRows)
+	args.bool("replica-sync", o.ReplicaSync)
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapOptions - OptionsSource of test, keys are flag names
+type mapOptions map[string][]string
+
+func (m mapOptions) String(name string) string {
+	if len(m[name]) == 0 {
+		return ""
+	}
+	return m[name][0]
+}
+
+func (m mapOptions) StringSlice(name string) []string {
+	return m[name]
+}
+
+func (m mapOptions) Bool(name string) bool {
+	return len(m[name]) > 0 && m[name][0] == "true"
+}
+
+func TestParseCreateOptions(t *testing.T) {
+	options, err := ParseCreateOptions(mapOptions{"t": {"db.a", "db.b"}, "partitions": {"db.a:1,2"}, "do-backup-rbac": {"true"}})
+	assert.NoError(t, err)
+	assert.Equal(t, CreateOptions{Tables: "db.a,db.b", Partitions: []string{"db.a:1,2"}, RBAC: true}, options)
+	assert.Equal(t, `--tables="db.a,db.b" --partitions="db.a:1,2" --rbac`, options.Args())
+	options, err = ParseCreateOptions(mapOptions{"changed-since": {"base"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `--changed-since="base"`, options.Args())
+
+	_, err = ParseCreateOptions(mapOptions{"schema": {"true"}, "changed-since": {"base"}})
+	assert.EqualError(t, err, "--changed-since can't be used with --schema, --partitions or --include-detached")
+	options, err = ParseCreateOptions(mapOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", options.Args())
+}
+
+func TestParseUploadOptions(t *testing.T) {
+	options, err := ParseUploadOptions(mapOptions{"tables": {"db.*"}, "diff-from": {"base"}, "resume": {"true"}}, "increment")
+	assert.NoError(t, err)
+	assert.Equal(t, UploadOptions{Tables: "db.*", DiffFrom: "base", Resume: true}, options)
+	assert.Equal(t, `--diff-from="base" --tables="db.*" --resume`, options.Args())
+
+	_, err = ParseUploadOptions(mapOptions{"diff-from": {"base"}, "diff-from-remote": {"base"}}, "increment")
+	assert.EqualError(t, err, "choose setup only `--diff-from-remote` or `--diff-from`, not both")
+	_, err = ParseUploadOptions(mapOptions{"diff-from-remote": {"increment"}}, "increment")
+	assert.EqualError(t, err, "you cannot upload diff from the same backup")
+}
+
+func TestParseDownloadOptions(t *testing.T) {
+	options := ParseDownloadOptions(mapOptions{"table": {"db.t"}, "s": {"true"}, "force-default-disk": {"true"}})
+	assert.Equal(t, DownloadOptions{Tables: "db.t", Schema: true, ForceDefaultDisk: true}, options)
+	assert.Equal(t, `--tables="db.t" --schema --force-default-disk`, options.Args())
+}
+
+func TestParseRestoreOptions(t *testing.T) {
+	options, err := ParseRestoreOptions(mapOptions{"tables": {"db.t"}, "drop-table": {"true"}, "d": {"true"}, "verify-rows": {"true"}})
+	assert.NoError(t, err)
+	assert.Equal(t, RestoreOptions{Tables: "db.t", Data: true, Rm: true, VerifyRows: true}, options)
+	assert.Equal(t, `--tables="db.t" --data --rm --verify-rows`, options.Args())
+
+	for expectedErr, flags := range map[string]mapOptions{
+		"`--drop-table` can't be used together with `--skip-existing`":                         {"rm": {"true"}, "skip-existing": {"true"}},
+		"`--attach-only` can't be used together with `--schema`, `--rm` or `--skip-existing`":  {"no-drop": {"true"}, "schema": {"true"}},
+		"`--replica-sync` can't be used together with `--schema`, `--data` or `--attach-only`": {"replica-sync": {"true"}, "attach-only": {"true"}},
+	} {
+		_, err := ParseRestoreOptions(flags)
+		assert.EqualError(t, err, expectedErr)
+	}
+}
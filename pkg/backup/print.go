@@ -11,6 +11,7 @@ import (
 	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
@@ -18,32 +19,214 @@ import (
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
 )
 
-func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format string) error {
+// backupServerInfo - return clickhouse-server version, timezone and UUID which was used for create backup, legacy backups don't contain it
+func backupServerInfo(backupMetadata metadata.BackupMetadata) string {
+	info := []string{backupMetadata.ClickHouseVersion, backupMetadata.ClickHouseTimezone, backupMetadata.ClickHouseServerUUID}
+	for i := range info {
+		if info[i] == "" {
+			info[i] = "unknown"
+		}
+	}
+	return strings.Join(info, "\t")
+}
+
+// BackupDatesMaxDifference - `list remote` shows upload date of backup when it differs from creation date more than this value, for example after copy between buckets
+const BackupDatesMaxDifference = 24 * time.Hour
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// backupAge - human-friendly age of backup printed by `list --relative`, e.g. "3 hours ago" or "5 days ago"
+func backupAge(age time.Duration) string {
+	if age < 0 {
+		return "in the future"
+	}
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, unit := range units {
+		if n := int(age / unit.duration); n > 0 {
+			if n == 1 {
+				return fmt.Sprintf("1 %s ago", unit.name)
+			}
+			return fmt.Sprintf("%d %ss ago", n, unit.name)
+		}
+	}
+	return "just now"
+}
+
+// formatBackupDate - absolute date of backup, relative age is added after it when relative is true
+func formatBackupDate(date time.Time, relative bool) string {
+	formatted := date.Format("02/01/2006 15:04:05")
+	if relative {
+		formatted += " (" + backupAge(time.Since(date)) + ")"
+	}
+	return formatted
+}
+
+// backupSortInfo - fields of local or remote backup which are used by `list --sort`
+type backupSortInfo struct {
+	name string
+	date time.Time
+	size uint64
+}
+
+// checkBackupSortKey - validate `list --sort` value, empty value means sort by date
+func checkBackupSortKey(sortBy string) error {
+	switch sortBy {
+	case "", "date", "name", "size":
+		return nil
+	}
+	return fmt.Errorf("'%s' sort is undefined, use name, date or size", sortBy)
+}
+
+// backupsOrder - indexes of backups sorted by sortBy key in ascending order, descending when reverse is true, backups with equal keys keep their order
+func backupsOrder(backups []backupSortInfo, sortBy string, reverse bool) []int {
+	order := make([]int, len(backups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := backups[order[i]], backups[order[j]]
+		if reverse {
+			a, b = b, a
+		}
+		switch sortBy {
+		case "name":
+			return a.name < b.name
+		case "size":
+			return a.size < b.size
+		default:
+			return a.date.Before(b.date)
+		}
+	})
+	return order
+}
+
+// BackupDateWindow - `list --newer-than` and `--older-than` bounds, zero bound isn't checked
+type BackupDateWindow struct {
+	NewerThan time.Time
+	OlderThan time.Time
+}
+
+// ParseBackupDateWindow - each bound is duration before now, like `7d` or `12h`, or RFC3339 date, empty bound isn't checked
+func ParseBackupDateWindow(newerThan, olderThan string, now time.Time) (BackupDateWindow, error) {
+	var window BackupDateWindow
+	var err error
+	if window.NewerThan, err = parseBackupDateBound("newer-than", newerThan, now); err != nil {
+		return window, err
+	}
+	if window.OlderThan, err = parseBackupDateBound("older-than", olderThan, now); err != nil {
+		return window, err
+	}
+	if !window.NewerThan.IsZero() && !window.OlderThan.IsZero() && !window.NewerThan.Before(window.OlderThan) {
+		return window, fmt.Errorf("--newer-than=%s shall be earlier than --older-than=%s", newerThan, olderThan)
+	}
+	return window, nil
+}
+
+func parseBackupDateBound(flag, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	age, err := utils.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("--%s=%s is neither duration like 7d or 12h nor RFC3339 date like 2006-01-02T15:04:05Z", flag, value)
+	}
+	return now.Add(-age), nil
+}
+
+// contains - date is strictly after NewerThan and strictly before OlderThan
+func (window BackupDateWindow) contains(date time.Time) bool {
+	if !window.NewerThan.IsZero() && !date.After(window.NewerThan) {
+		return false
+	}
+	return window.OlderThan.IsZero() || date.Before(window.OlderThan)
+}
+
+// filterRemoteBackupsByDate - keep backups which dates are inside window, order is kept
+func filterRemoteBackupsByDate(backupList []new_storage.Backup, window BackupDateWindow) []new_storage.Backup {
+	filtered := make([]new_storage.Backup, 0, len(backupList))
+	for _, backup := range backupList {
+		if window.contains(backup.GetDate()) {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
+}
+
+// filterLocalBackupsByDate - keep backups which creation dates are inside window, order is kept
+func filterLocalBackupsByDate(backupList []BackupLocal, window BackupDateWindow) []BackupLocal {
+	filtered := make([]BackupLocal, 0, len(backupList))
+	for _, backup := range backupList {
+		if window.contains(backup.CreationDate) {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
+}
+
+// backupSize - size which is printed by `list`, compressed size is used when it is known
+func backupSize(backupMetadata metadata.BackupMetadata) uint64 {
+	if backupMetadata.CompressedSize > 0 {
+		return backupMetadata.CompressedSize + backupMetadata.MetadataSize
+	}
+	return backupMetadata.DataSize + backupMetadata.MetadataSize
+}
+
+// printBackupsRemote - print remote backups inside window in format with age relative to now when relative is true, `latest` and `penult` are chosen by date inside window, full list is sorted by sortBy
+func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format, sortBy string, reverse, relative bool, window BackupDateWindow) error {
+	if err := checkBackupSortKey(sortBy); err != nil {
+		return err
+	}
+	backupList = filterRemoteBackupsByDate(backupList, window)
 	switch format {
 	case "latest", "last", "l":
 		if len(backupList) < 1 {
 			return fmt.Errorf("no backups found")
 		}
-		fmt.Println(backupList[len(backupList)-1].BackupName)
+		fmt.Fprintln(w, backupList[len(backupList)-1].BackupName)
 	case "penult", "prev", "previous", "p":
 		if len(backupList) < 2 {
 			return fmt.Errorf("no penult backup is found")
 		}
-		fmt.Println(backupList[len(backupList)-2].BackupName)
-	case "all", "":
+		fmt.Fprintln(w, backupList[len(backupList)-2].BackupName)
+	case "all", "", "detailed":
 		// if len(backupList) == 0 {
 		// 	fmt.Println("no backups found")
 		// }
-		for _, backup := range backupList {
-			size := utils.FormatBytes(backup.DataSize + backup.MetadataSize)
-			if backup.CompressedSize > 0 {
-				size = utils.FormatBytes(backup.CompressedSize + backup.MetadataSize)
-			}
+		sortInfo := make([]backupSortInfo, len(backupList))
+		for i, backup := range backupList {
+			sortInfo[i] = backupSortInfo{name: backup.BackupName, date: backup.GetDate(), size: backupSize(backup.BackupMetadata)}
+		}
+		for _, i := range backupsOrder(sortInfo, sortBy, reverse) {
+			backup := backupList[i]
+			size := utils.FormatBytes(backupSize(backup.BackupMetadata))
 			description := backup.DataFormat
-			uploadDate := backup.UploadDate.Format("02/01/2006 15:04:05")
+			if backup.SchemaOnly {
+				description = "schema-only"
+			}
+			backupDate := formatBackupDate(backup.GetDate(), relative)
 			if backup.Legacy {
 				description = "old-format"
 			}
+			if !backup.Legacy && !backup.CreationDate.IsZero() && !backup.UploadDate.IsZero() && absDuration(backup.UploadDate.Sub(backup.CreationDate)) > BackupDatesMaxDifference {
+				description += ", uploaded " + backup.UploadDate.Format("02/01/2006 15:04:05")
+			}
 			required := ""
 			if backup.RequiredBackup != "" {
 				required = "+" + backup.RequiredBackup
@@ -52,7 +235,10 @@ func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format str
 				description = backup.Broken
 				size = "???"
 			}
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, uploadDate, "remote", required, description)
+			if format == "detailed" {
+				description += "\t" + backupServerInfo(backup.BackupMetadata)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, backupDate, "remote", required, description)
 		}
 	default:
 		return fmt.Errorf("'%s' undefined", format)
@@ -60,29 +246,39 @@ func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format str
 	return nil
 }
 
-func printBackupsLocal(w io.Writer, backupList []BackupLocal, format string) error {
+// printBackupsLocal - print local backups inside window in format with age relative to now when relative is true, `latest` and `penult` are chosen by date inside window, full list is sorted by sortBy
+func printBackupsLocal(w io.Writer, backupList []BackupLocal, format, sortBy string, reverse, relative bool, window BackupDateWindow) error {
+	if err := checkBackupSortKey(sortBy); err != nil {
+		return err
+	}
+	backupList = filterLocalBackupsByDate(backupList, window)
 	switch format {
 	case "latest", "last", "l":
 		if len(backupList) < 1 {
 			return fmt.Errorf("no backups found")
 		}
-		fmt.Println(backupList[len(backupList)-1].BackupName)
+		fmt.Fprintln(w, backupList[len(backupList)-1].BackupName)
 	case "penult", "prev", "previous", "p":
 		if len(backupList) < 2 {
 			return fmt.Errorf("no penult backup is found")
 		}
-		fmt.Println(backupList[len(backupList)-2].BackupName)
-	case "all", "":
+		fmt.Fprintln(w, backupList[len(backupList)-2].BackupName)
+	case "all", "", "detailed":
 		// if len(backupList) == 0 {
 		// 	fmt.Println("no backups found")
 		// }
-		for _, backup := range backupList {
-			size := utils.FormatBytes(backup.DataSize + backup.MetadataSize)
-			if backup.CompressedSize > 0 {
-				size = utils.FormatBytes(backup.CompressedSize + backup.MetadataSize)
-			}
+		sortInfo := make([]backupSortInfo, len(backupList))
+		for i, backup := range backupList {
+			sortInfo[i] = backupSortInfo{name: backup.BackupName, date: backup.CreationDate, size: backupSize(backup.BackupMetadata)}
+		}
+		for _, i := range backupsOrder(sortInfo, sortBy, reverse) {
+			backup := backupList[i]
+			size := utils.FormatBytes(backupSize(backup.BackupMetadata))
 			description := backup.DataFormat
-			creationDate := backup.CreationDate.Format("02/01/2006 15:04:05")
+			if backup.SchemaOnly {
+				description = "schema-only"
+			}
+			creationDate := formatBackupDate(backup.CreationDate, relative)
 			if backup.Legacy {
 				size = "???"
 			}
@@ -94,6 +290,9 @@ func printBackupsLocal(w io.Writer, backupList []BackupLocal, format string) err
 				description = backup.Broken
 				size = "???"
 			}
+			if format == "detailed" {
+				description += "\t" + backupServerInfo(backup.BackupMetadata)
+			}
 			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, creationDate, "local", required, description)
 		}
 	default:
@@ -102,15 +301,29 @@ func printBackupsLocal(w io.Writer, backupList []BackupLocal, format string) err
 	return nil
 }
 
-// PrintLocalBackups - print all backups stored locally
-func PrintLocalBackups(cfg *config.Config, format string) error {
+// PrintLocalBackups - print backups stored locally which names start with namePrefix and dates are inside window sorted by sortBy
+func PrintLocalBackups(cfg *config.Config, namePrefix, format, sortBy string, reverse, relative bool, window BackupDateWindow) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.DiscardEmptyColumns)
 	defer w.Flush()
 	backupList, err := GetLocalBackups(cfg)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return printBackupsLocal(w, backupList, format)
+	return printBackupsLocal(w, filterLocalBackupsByPrefix(backupList, namePrefix), format, sortBy, reverse, relative, window)
+}
+
+// filterLocalBackupsByPrefix - keep backups which names start with namePrefix, order is kept
+func filterLocalBackupsByPrefix(backupList []BackupLocal, namePrefix string) []BackupLocal {
+	if namePrefix == "" {
+		return backupList
+	}
+	filtered := make([]BackupLocal, 0, len(backupList))
+	for _, backup := range backupList {
+		if strings.HasPrefix(backup.BackupName, namePrefix) {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
 }
 
 // GetLocalBackups - return slice of all backups stored locally
@@ -164,7 +377,14 @@ func GetLocalBackups(cfg *config.Config) ([]BackupLocal, error) {
 		}
 		var backupMetadata metadata.BackupMetadata
 		if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
-			return nil, err
+			result = append(result, BackupLocal{
+				BackupMetadata: metadata.BackupMetadata{
+					BackupName:   name,
+					CreationDate: info.ModTime(),
+				},
+				Broken: "broken (bad metadata.json)",
+			})
+			continue
 		}
 		result = append(result, BackupLocal{
 			BackupMetadata: backupMetadata,
@@ -177,34 +397,38 @@ func GetLocalBackups(cfg *config.Config) ([]BackupLocal, error) {
 	return result, nil
 }
 
-func PrintAllBackups(cfg *config.Config, format string) error {
+// PrintAllBackups - print backups stored locally and on remote storage which names start with namePrefix and dates are inside window, each list is sorted by sortBy
+func PrintAllBackups(cfg *config.Config, namePrefix, format, sortBy string, reverse, relative bool, window BackupDateWindow) error {
+	if err := checkBackupSortKey(sortBy); err != nil {
+		return err
+	}
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.DiscardEmptyColumns)
 	defer w.Flush()
 	localBackups, err := GetLocalBackups(cfg)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	printBackupsLocal(w, localBackups, format)
+	printBackupsLocal(w, filterLocalBackupsByPrefix(localBackups, namePrefix), format, sortBy, reverse, relative, window)
 
 	if cfg.General.RemoteStorage != "none" {
-		remoteBackups, err := GetRemoteBackups(cfg, true)
+		remoteBackups, err := GetRemoteBackupsByPrefix(cfg, namePrefix, true)
 		if err != nil {
 			return err
 		}
-		printBackupsRemote(w, remoteBackups, format)
+		printBackupsRemote(w, remoteBackups, format, sortBy, reverse, relative, window)
 	}
 	return nil
 }
 
-// PrintRemoteBackups - print all backups stored on remote storage
-func PrintRemoteBackups(cfg *config.Config, format string) error {
+// PrintRemoteBackups - print backups stored on remote storage which names start with namePrefix and dates are inside window sorted by sortBy, other backups aren't parsed
+func PrintRemoteBackups(cfg *config.Config, namePrefix, format, sortBy string, reverse, relative bool, window BackupDateWindow) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.DiscardEmptyColumns)
 	defer w.Flush()
-	backupList, err := GetRemoteBackups(cfg, true)
+	backupList, err := GetRemoteBackupsByPrefix(cfg, namePrefix, true)
 	if err != nil {
 		return err
 	}
-	return printBackupsRemote(w, backupList, format)
+	return printBackupsRemote(w, backupList, format, sortBy, reverse, relative, window)
 }
 
 func getLocalBackup(cfg *config.Config, backupName string) (*BackupLocal, error) {
@@ -220,11 +444,16 @@ func getLocalBackup(cfg *config.Config, backupName string) (*BackupLocal, error)
 			return &backup, nil
 		}
 	}
-	return nil, fmt.Errorf("backup '%s' is not found", backupName)
+	return nil, fmt.Errorf("backup '%s' is not found: %w", backupName, ErrBackupNotFound)
 }
 
 // GetRemoteBackups - get all backups stored on remote storage
 func GetRemoteBackups(cfg *config.Config, parseMetadata bool) ([]new_storage.Backup, error) {
+	return GetRemoteBackupsByPrefix(cfg, "", parseMetadata)
+}
+
+// GetRemoteBackupsByPrefix - get backups stored on remote storage which names start with namePrefix
+func GetRemoteBackupsByPrefix(cfg *config.Config, namePrefix string, parseMetadata bool) ([]new_storage.Backup, error) {
 	if cfg.General.RemoteStorage == "none" {
 		return nil, fmt.Errorf("remote_storage is 'none'")
 	}
@@ -235,14 +464,14 @@ func GetRemoteBackups(cfg *config.Config, parseMetadata bool) ([]new_storage.Bac
 	if err := bd.Connect(); err != nil {
 		return []new_storage.Backup{}, err
 	}
-	backupList, err := bd.BackupList(parseMetadata, "")
+	backupList, err := bd.BackupListByPrefix(namePrefix, parseMetadata, "")
 	if err != nil {
 		return []new_storage.Backup{}, err
 	}
 	// ugly hack to fix https://github.com/AlexAkulov/clickhouse-backup/issues/309
 	if parseMetadata == false && len(backupList) > 0 {
 		lastBackup := backupList[len(backupList)-1]
-		backupList, err = bd.BackupList(true, lastBackup.BackupName)
+		backupList, err = bd.BackupListByPrefix(namePrefix, true, lastBackup.BackupName)
 		if err != nil {
 			return []new_storage.Backup{}, err
 		}
@@ -257,7 +486,7 @@ func GetTables(cfg *config.Config) ([]clickhouse.Table, error) {
 	}
 
 	if err := ch.Connect(); err != nil {
-		return []clickhouse.Table{}, fmt.Errorf("can't connect to clickhouse: %v", err)
+		return []clickhouse.Table{}, fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer ch.Close()
 
@@ -286,8 +515,24 @@ func PrintTables(cfg *config.Config, printAll bool) error {
 	if err != nil {
 		return err
 	}
+	partsSize, err := ch.GetPartsSize()
+	if err != nil {
+		return err
+	}
+	estimate := estimateBackupSize(allTables, partsSize)
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.DiscardEmptyColumns)
-	for _, table := range allTables {
+	printTablesList(w, allTables, disks, &estimate, cfg.ClickHouse.ObjectDisks, printAll)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d tables with data, estimated backup size %s\n", len(estimate.Tables), utils.FormatBytes(estimate.Size))
+	return nil
+}
+
+// printTablesList - print table size from system.tables and disks, estimated backup size is printed for tables which data would be backed up
+// when estimate is not nil, other tables are marked as schema only, tables on object disks are marked according to objectDisksMode
+func printTablesList(w io.Writer, tables []clickhouse.Table, disks []clickhouse.Disk, estimate *SizeEstimate, objectDisksMode string, printAll bool) {
+	for _, table := range tables {
 		if table.Skip && !printAll {
 			continue
 		}
@@ -295,12 +540,77 @@ func PrintTables(cfg *config.Config, printAll bool) error {
 		for disk := range clickhouse.GetDisksByPaths(disks, table.DataPaths) {
 			tableDisks = append(tableDisks, disk)
 		}
+		note := ""
 		if table.Skip {
-			fmt.Fprintf(w, "%s.%s\t%s\t%v\tskip\n", table.Database, table.Name, utils.FormatBytes(table.TotalBytes), strings.Join(tableDisks, ","))
-			continue
+			note = "skip"
+		} else if estimate != nil {
+			note = "schema only"
+			if tableEstimate, ok := estimate.table(table.Database, table.Name); ok {
+				note = "backup " + utils.FormatBytes(tableEstimate.Size)
+				if objectDisks := tableObjectDisks(disks, table); len(objectDisks) > 0 {
+					note = "schema only, " + objectDisksSkipReason(objectDisks)
+					if objectDisksMode == "metadata" {
+						note = "stubs only, " + objectDisksSkipReason(objectDisks)
+					}
+				}
+			}
 		}
-		fmt.Fprintf(w, "%s.%s\t%s\t%v\t\n", table.Database, table.Name, utils.FormatBytes(table.TotalBytes), strings.Join(tableDisks, ","))
+		fmt.Fprintf(w, "%s.%s\t%s\t%v\t%s\n", table.Database, table.Name, utils.FormatBytes(table.TotalBytes), strings.Join(tableDisks, ","), note)
 	}
-	w.Flush()
-	return nil
+}
+
+// tablesLister - part of clickhouse.ClickHouse which enough to show backup plan
+type tablesLister interface {
+	GetTables(tablePattern string) ([]clickhouse.Table, error)
+	GetDisks() ([]clickhouse.Disk, error)
+}
+
+// PrintBackupPlan - print tables, estimated sizes and disks which `create` would backup, nothing is frozen or written
+func PrintBackupPlan(cfg *config.Config, tablePattern string, schemaOnly bool) error {
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
+	}
+	defer ch.Close()
+	return printBackupPlan(os.Stdout, ch, tablePattern, cfg.ClickHouse.SkipTables, cfg.ClickHouse.ObjectDisks, schemaOnly)
+}
+
+func printBackupPlan(out io.Writer, ch sizeEstimator, tablePattern string, skipTables []string, objectDisksMode string, schemaOnly bool) error {
+	allTables, err := ch.GetTables(tablePattern)
+	if err != nil {
+		return fmt.Errorf("can't get tables from clickhouse: %v", err)
+	}
+	tables := filterTablesByPattern(allTables, tablePattern, skipTables)
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	var estimate *SizeEstimate
+	if !schemaOnly {
+		partsSize, err := ch.GetPartsSize()
+		if err != nil {
+			return err
+		}
+		tablesEstimate := estimateBackupSize(tables, partsSize)
+		estimate = &tablesEstimate
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.DiscardEmptyColumns)
+	printTablesList(w, tables, disks, estimate, objectDisksMode, false)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	tablesCount := 0
+	for _, table := range tables {
+		if !table.Skip {
+			tablesCount++
+		}
+	}
+	if schemaOnly {
+		_, err = fmt.Fprintf(out, "%d tables, schema only\n", tablesCount)
+	} else {
+		_, err = fmt.Fprintf(out, "%d tables, estimated size %s\n", tablesCount, utils.FormatBytes(estimate.Size))
+	}
+	return err
 }
@@ -0,0 +1,197 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTablesLister - record all calls, doesn't allow anything except read tables and disks
+type fakeTablesLister struct {
+	calls    []string
+	diskPath string
+}
+
+func (f *fakeTablesLister) GetTables(tablePattern string) ([]clickhouse.Table, error) {
+	f.calls = append(f.calls, "GetTables")
+	return []clickhouse.Table{
+		{Database: "default", Name: "events", Engine: "MergeTree", DataPaths: []string{path.Join(f.diskPath, "data/default/events")}, TotalBytes: 2048},
+		{Database: "default", Name: "tmp_events", Engine: "MergeTree", DataPaths: []string{path.Join(f.diskPath, "data/default/tmp_events")}, TotalBytes: 1024},
+		{Database: "system", Name: "parts", Skip: true},
+	}, nil
+}
+
+func (f *fakeTablesLister) GetDisks() ([]clickhouse.Disk, error) {
+	f.calls = append(f.calls, "GetDisks")
+	return []clickhouse.Disk{{Name: "default", Path: f.diskPath, Type: "local"}}, nil
+}
+
+func (f *fakeTablesLister) GetPartsSize() ([]clickhouse.PartsSize, error) {
+	f.calls = append(f.calls, "GetPartsSize")
+	return []clickhouse.PartsSize{
+		{Database: "default", Table: "events", Disk: "default", Size: 2048},
+		{Database: "default", Table: "tmp_events", Disk: "default", Size: 1024},
+	}, nil
+}
+
+func TestPrintBackupPlan(t *testing.T) {
+	ch := &fakeTablesLister{diskPath: t.TempDir()}
+	out := &bytes.Buffer{}
+	assert.NoError(t, printBackupPlan(out, ch, "default.*,!default.tmp_*", []string{"system.*"}, "skip", false))
+	assert.Equal(t, "default.events  2.00KiB  default  backup 2.00KiB\n1 tables, estimated size 2.00KiB\n", out.String())
+	// no FREEZE and no filesystem writes
+	assert.Equal(t, []string{"GetTables", "GetDisks", "GetPartsSize"}, ch.calls)
+	files, err := ioutil.ReadDir(ch.diskPath)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestPrintBackupsRemoteDates(t *testing.T) {
+	created := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	backupList := []new_storage.Backup{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "copied", CreationDate: created, DataFormat: "tar"}, UploadDate: created.Add(72 * time.Hour)},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "regular", CreationDate: created, DataFormat: "tar"}, UploadDate: created.Add(time.Hour)},
+	}
+	out := &bytes.Buffer{}
+	assert.NoError(t, printBackupsRemote(out, backupList, "all", "", false, false, BackupDateWindow{}))
+	assert.Equal(t, "copied\t0B\t01/03/2022 10:00:00\tremote\t\ttar, uploaded 04/03/2022 10:00:00\n"+
+		"regular\t0B\t01/03/2022 10:00:00\tremote\t\ttar\n", out.String())
+}
+
+func TestPrintBackupsSort(t *testing.T) {
+	created := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	remoteList := []new_storage.Backup{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "b_middle", CreationDate: created, DataSize: 300, CompressedSize: 100}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "c_newest", CreationDate: created.Add(time.Hour), DataSize: 50}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "a_oldest", CreationDate: created.Add(-time.Hour), DataSize: 1000}},
+	}
+	localList := make([]BackupLocal, len(remoteList))
+	for i := range remoteList {
+		localList[i] = BackupLocal{BackupMetadata: remoteList[i].BackupMetadata}
+	}
+	printedNames := func(out *bytes.Buffer) []string {
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			names = append(names, strings.Split(line, "\t")[0])
+		}
+		return names
+	}
+	for _, tc := range []struct {
+		sortBy   string
+		reverse  bool
+		expected []string
+	}{
+		{"", false, []string{"a_oldest", "b_middle", "c_newest"}},
+		{"date", false, []string{"a_oldest", "b_middle", "c_newest"}},
+		{"date", true, []string{"c_newest", "b_middle", "a_oldest"}},
+		{"name", false, []string{"a_oldest", "b_middle", "c_newest"}},
+		{"name", true, []string{"c_newest", "b_middle", "a_oldest"}},
+		{"size", false, []string{"c_newest", "b_middle", "a_oldest"}},
+		{"size", true, []string{"a_oldest", "b_middle", "c_newest"}},
+	} {
+		out := &bytes.Buffer{}
+		assert.NoError(t, printBackupsRemote(out, remoteList, "all", tc.sortBy, tc.reverse, false, BackupDateWindow{}))
+		assert.Equal(t, tc.expected, printedNames(out), "remote sort=%s reverse=%v", tc.sortBy, tc.reverse)
+		out.Reset()
+		assert.NoError(t, printBackupsLocal(out, localList, "all", tc.sortBy, tc.reverse, false, BackupDateWindow{}))
+		assert.Equal(t, tc.expected, printedNames(out), "local sort=%s reverse=%v", tc.sortBy, tc.reverse)
+	}
+	assert.Equal(t, "b_middle", remoteList[0].BackupName, "backup list shall not be changed")
+	assert.EqualError(t, printBackupsRemote(&bytes.Buffer{}, remoteList, "all", "unknown", false, false, BackupDateWindow{}), "'unknown' sort is undefined, use name, date or size")
+	assert.EqualError(t, printBackupsLocal(&bytes.Buffer{}, localList, "all", "unknown", false, false, BackupDateWindow{}), "'unknown' sort is undefined, use name, date or size")
+}
+
+func TestBackupAge(t *testing.T) {
+	for age, expected := range map[time.Duration]string{
+		-time.Minute:              "in the future",
+		30 * time.Second:          "just now",
+		time.Minute:               "1 minute ago",
+		59 * time.Minute:          "59 minutes ago",
+		3*time.Hour + time.Minute: "3 hours ago",
+		25 * time.Hour:            "1 day ago",
+		5 * 24 * time.Hour:        "5 days ago",
+		65 * 24 * time.Hour:       "2 months ago",
+		800 * 24 * time.Hour:      "2 years ago",
+	} {
+		assert.Equal(t, expected, backupAge(age), age.String())
+	}
+
+	created := time.Now().Add(-5*24*time.Hour - time.Hour)
+	backup := metadata.BackupMetadata{BackupName: "backup", CreationDate: created}
+	out := &bytes.Buffer{}
+	assert.NoError(t, printBackupsLocal(out, []BackupLocal{{BackupMetadata: backup}}, "all", "", false, true, BackupDateWindow{}))
+	assert.Contains(t, out.String(), created.Format("02/01/2006 15:04:05")+" (5 days ago)\tlocal")
+	out.Reset()
+	assert.NoError(t, printBackupsRemote(out, []new_storage.Backup{{BackupMetadata: backup}}, "all", "", false, false, BackupDateWindow{}))
+	assert.Contains(t, out.String(), created.Format("02/01/2006 15:04:05")+"\tremote")
+}
+
+func TestParseBackupDateWindow(t *testing.T) {
+	now := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+	window, err := ParseBackupDateWindow("7d", "2022-03-09T00:00:00Z", now)
+	assert.NoError(t, err)
+	assert.Equal(t, BackupDateWindow{NewerThan: time.Date(2022, 3, 3, 12, 0, 0, 0, time.UTC), OlderThan: time.Date(2022, 3, 9, 0, 0, 0, 0, time.UTC)}, window)
+	window, err = ParseBackupDateWindow("", "", now)
+	assert.NoError(t, err)
+	assert.True(t, window.contains(time.Time{}), "empty window contains any date")
+
+	_, err = ParseBackupDateWindow("yesterday", "", now)
+	assert.EqualError(t, err, "--newer-than=yesterday is neither duration like 7d or 12h nor RFC3339 date like 2006-01-02T15:04:05Z")
+	_, err = ParseBackupDateWindow("1d", "7d", now)
+	assert.EqualError(t, err, "--newer-than=1d shall be earlier than --older-than=7d")
+}
+
+func TestPrintBackupsDateWindow(t *testing.T) {
+	created := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	var remoteList []new_storage.Backup
+	var localList []BackupLocal
+	for day := 1; day <= 5; day++ {
+		backup := metadata.BackupMetadata{BackupName: fmt.Sprintf("day%d", day), CreationDate: created.AddDate(0, 0, day-1)}
+		remoteList = append(remoteList, new_storage.Backup{BackupMetadata: backup})
+		localList = append(localList, BackupLocal{BackupMetadata: backup})
+	}
+	for _, tc := range []struct {
+		window   BackupDateWindow
+		format   string
+		expected string
+	}{
+		// bounds are exclusive
+		{BackupDateWindow{NewerThan: created.AddDate(0, 0, 1)}, "all", "day3 day4 day5"},
+		{BackupDateWindow{OlderThan: created.AddDate(0, 0, 1)}, "all", "day1"},
+		{BackupDateWindow{NewerThan: created, OlderThan: created.AddDate(0, 0, 4)}, "all", "day2 day3 day4"},
+		{BackupDateWindow{NewerThan: created.AddDate(0, 0, 1).Add(-time.Second), OlderThan: created.AddDate(0, 0, 1).Add(time.Second)}, "all", "day2"},
+		{BackupDateWindow{OlderThan: created.AddDate(0, 0, 3)}, "latest", "day3"},
+		{BackupDateWindow{OlderThan: created.AddDate(0, 0, 3)}, "penult", "day2"},
+		{BackupDateWindow{NewerThan: created.AddDate(0, 0, 2), OlderThan: created.AddDate(0, 0, 4)}, "latest", "day4"},
+		{BackupDateWindow{}, "latest", "day5"},
+	} {
+		for kind, printList := range map[string]func(out *bytes.Buffer) error{
+			"remote": func(out *bytes.Buffer) error {
+				return printBackupsRemote(out, remoteList, tc.format, "", false, false, tc.window)
+			},
+			"local": func(out *bytes.Buffer) error {
+				return printBackupsLocal(out, localList, tc.format, "", false, false, tc.window)
+			},
+		} {
+			out := &bytes.Buffer{}
+			assert.NoError(t, printList(out))
+			var names []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				names = append(names, strings.Split(line, "\t")[0])
+			}
+			assert.Equal(t, tc.expected, strings.Join(names, " "), "%s %s %+v", kind, tc.format, tc.window)
+		}
+	}
+	window := BackupDateWindow{NewerThan: created.AddDate(0, 0, 3)}
+	assert.EqualError(t, printBackupsRemote(&bytes.Buffer{}, remoteList, "penult", "", false, false, window), "no penult backup is found")
+	assert.EqualError(t, printBackupsLocal(&bytes.Buffer{}, localList, "latest", "", false, false, BackupDateWindow{NewerThan: created.AddDate(0, 0, 4)}), "no backups found")
+}
@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"fmt"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	apexLog "github.com/apex/log"
+)
+
+// RemoveLocalAfter - run operation which uses local backupName and remove the local backup from all disks only when operation succeeded,
+// it is used by `upload --delete-local-after-upload` and `restore --delete-local-after-restore`
+func RemoveLocalAfter(cfg *config.Config, backupName, operation string, run func() error) error {
+	return removeLocalAfter(run, func() error {
+		return RemoveBackupLocal(cfg, backupName)
+	}, apexLog.WithFields(apexLog.Fields{"backup": backupName, "operation": operation}))
+}
+
+// removeLocalAfter - failed operation keeps local backup, so the operation could be repeated without create or download
+func removeLocalAfter(run, removeLocal func() error, log *apexLog.Entry) error {
+	if err := run(); err != nil {
+		log.Warn("operation failed, local backup is kept")
+		return err
+	}
+	if err := removeLocal(); err != nil {
+		return fmt.Errorf("operation succeeded, but can't remove local backup: %v", err)
+	}
+	log.Info("local backup removed")
+	return nil
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveLocalAfter(t *testing.T) {
+	log := apexLog.WithField("operation", "upload")
+	diskPath, secondDiskPath := t.TempDir(), t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}, {Name: "hdd", Path: secondDiskPath}, {Name: "empty", Path: t.TempDir()}}
+	for _, backupPath := range []string{
+		path.Join(diskPath, "backup", "uploaded", "metadata"),
+		path.Join(diskPath, "backup", "uploaded_2", "metadata"),
+		path.Join(diskPath, "backup", "failed", "metadata"),
+		path.Join(secondDiskPath, "backup", "uploaded", "shadow"),
+	} {
+		assert.NoError(t, os.MkdirAll(backupPath, 0750))
+	}
+	var removed []string
+	removeLocal := func(backupName string) func() error {
+		return func() (err error) {
+			removed, err = removeBackupFromDisks(disks, backupName)
+			return err
+		}
+	}
+
+	assert.NoError(t, removeLocalAfter(func() error { return nil }, removeLocal("uploaded"), log))
+	assert.Equal(t, []string{path.Join(diskPath, "backup", "uploaded"), path.Join(secondDiskPath, "backup", "uploaded")}, removed)
+	assert.NoDirExists(t, path.Join(diskPath, "backup", "uploaded"))
+	assert.NoDirExists(t, path.Join(secondDiskPath, "backup", "uploaded"))
+	assert.DirExists(t, path.Join(diskPath, "backup", "uploaded_2"), "backup with the same prefix shall be kept")
+
+	removed = nil
+	assert.EqualError(t, removeLocalAfter(func() error { return fmt.Errorf("can't upload") }, removeLocal("failed"), log), "can't upload")
+	assert.DirExists(t, path.Join(diskPath, "backup", "failed"), "local backup shall be kept after failed operation")
+	assert.Empty(t, removed)
+
+	err := removeLocalAfter(func() error { return nil }, func() error { return fmt.Errorf("permission denied") }, log)
+	assert.EqualError(t, err, "operation succeeded, but can't remove local backup: permission denied")
+}
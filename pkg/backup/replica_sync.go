@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// replicaSyncPollInterval - pause between SYSTEM SYNC REPLICA queries while rows count of table is less than in backup
+var replicaSyncPollInterval = 10 * time.Second
+
+// replicaSyncer - part of clickhouse.ClickHouse which is used by `restore --replica-sync`
+type replicaSyncer interface {
+	rowsCounter
+	SyncReplica(database, table string) error
+}
+
+// replicasChecker - part of clickhouse.ClickHouse which detects replicas of table during data restore
+type replicasChecker interface {
+	rowsCounter
+	GetReplicaStatus(database, table string) (clickhouse.ReplicaStatus, error)
+}
+
+func isReplicatedEngine(engine string) bool {
+	return strings.HasPrefix(engine, "Replicated")
+}
+
+// RestoreReplicaSync - data of replicated tables isn't attached, it is fetched from replica where backup data was restored,
+// schema shall be created before, by RestoreSchema or by `restore_schema_on_cluster`
+func RestoreReplicaSync(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, tablePattern string, partitionsToRestore common.TablePartitions, log *apexLog.Entry) error {
+	startRestore := time.Now()
+	defaultDataPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	backup, err := getLocalBackup(cfg, backupName)
+	if err != nil {
+		return fmt.Errorf("can't restore: %v", err)
+	}
+	if backup.Legacy {
+		return fmt.Errorf("`--replica-sync` doesn't support legacy backups")
+	}
+	metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
+	tablesForRestore, err := getTableListByPatternLocal(metadataPath, tablePattern, cfg.ClickHouse.SkipTables, false, partitionsToRestore)
+	if err != nil {
+		return err
+	}
+	chTables, err := ch.GetTables(tablePattern)
+	if err != nil {
+		return err
+	}
+	engines := map[metadata.TableTitle]string{}
+	for _, table := range chTables {
+		engines[metadata.TableTitle{Database: table.Database, Table: table.Name}] = table.Engine
+	}
+	var timeout time.Duration
+	if cfg.ClickHouse.SyncReplicaTimeout != "" {
+		if timeout, err = time.ParseDuration(cfg.ClickHouse.SyncReplicaTimeout); err != nil {
+			return err
+		}
+	}
+	if err := syncReplicas(ch, tablesForRestore, engines, partitionsToRestore, timeout, log); err != nil {
+		return err
+	}
+	log.WithField("duration", utils.HumanizeDuration(time.Since(startRestore))).Info("done")
+	return nil
+}
+
+// syncReplicas - SYSTEM SYNC REPLICA is repeated for each table until its rows count reaches rows count from backup,
+// tables which aren't replicated can't get data this way, so nothing is synced when backup contains data of such tables
+func syncReplicas(ch replicaSyncer, tables ListOfTables, engines map[metadata.TableTitle]string, partitionsToRestore common.TablePartitions, timeout time.Duration, log *apexLog.Entry) error {
+	var tablesWithData ListOfTables
+	var notReplicated []string
+	for _, table := range tables {
+		if !tableHasParts(table) {
+			continue
+		}
+		tablesWithData = append(tablesWithData, table)
+		if !isReplicatedEngine(engines[metadata.TableTitle{Database: table.Database, Table: table.Table}]) {
+			notReplicated = append(notReplicated, fmt.Sprintf("'%s.%s'", table.Database, table.Table))
+		}
+	}
+	if len(notReplicated) > 0 {
+		return fmt.Errorf("%s is not replicated, `--replica-sync` can't restore its data, restore it without `--replica-sync` or exclude it by `--tables`", strings.Join(notReplicated, ", "))
+	}
+	for i, table := range tablesWithData {
+		log := log.WithFields(apexLog.Fields{
+			"table":    fmt.Sprintf("%s.%s", table.Database, table.Table),
+			"progress": fmt.Sprintf("%d/%d", i+1, len(tablesWithData)),
+		})
+		expectedRows := table.Rows
+		if expectedRows != nil && len(partitionsToRestore.ForTable(table.Database, table.Table)) > 0 {
+			log.Info("only some partitions were restored, skip rows verification")
+			expectedRows = nil
+		}
+		if err := syncReplica(ch, table, expectedRows, timeout, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncReplica(ch replicaSyncer, table metadata.TableMetadata, expectedRows *uint64, timeout time.Duration, log *apexLog.Entry) error {
+	start := time.Now()
+	for {
+		if err := ch.SyncReplica(table.Database, table.Table); err != nil {
+			return fmt.Errorf("can't sync replica of '%s.%s': %v", table.Database, table.Table, err)
+		}
+		rows, err := ch.GetRowsCount(table.Database, table.Table)
+		if err != nil {
+			return fmt.Errorf("can't count rows in '%s.%s': %v", table.Database, table.Table, err)
+		}
+		switch {
+		case expectedRows == nil:
+			log.Infof("replica synced, %d rows, rows count is not recorded in backup, skip verification", rows)
+			return nil
+		case rows == *expectedRows:
+			log.Infof("replica synced, %d rows", rows)
+			return nil
+		case rows > *expectedRows:
+			log.Warnf("replica synced, %d rows is more than %d rows in backup, table contained data before restore", rows, *expectedRows)
+			return nil
+		}
+		if timeout > 0 && time.Since(start)+replicaSyncPollInterval > timeout {
+			return fmt.Errorf("'%s.%s' has %d rows after %s, expected %d, check that backup data was restored on another replica", table.Database, table.Table, rows, utils.HumanizeDuration(time.Since(start)), *expectedRows)
+		}
+		log.Infof("%d of %d rows replicated, sync again in %s", rows, *expectedRows, replicaSyncPollInterval)
+		time.Sleep(replicaSyncPollInterval)
+	}
+}
+
+// warnReplicatedDuplicates - parts attached on one replica are replicated to others, so attaching them where other replicas already hold data could duplicate rows
+func warnReplicatedDuplicates(ch replicasChecker, table metadata.TableMetadata, engine string, log *apexLog.Entry) {
+	if !isReplicatedEngine(engine) {
+		return
+	}
+	status, err := ch.GetReplicaStatus(table.Database, table.Table)
+	if err != nil {
+		log.Warnf("can't check replicas: %v", err)
+		return
+	}
+	if status.TotalReplicas < 2 {
+		return
+	}
+	rows, err := ch.GetRowsCount(table.Database, table.Table)
+	if err != nil {
+		log.Warnf("can't count rows: %v", err)
+		return
+	}
+	if rows > 0 {
+		log.Warnf("table has %d replicas and already contains %d rows, attached parts will be replicated and could duplicate existing data, restore data on one replica and use `restore --replica-sync` on others", status.TotalReplicas, rows)
+	}
+}
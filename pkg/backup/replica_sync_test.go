@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeReplica - rows of each table grow by step after each SYSTEM SYNC REPLICA until they reach total
+type fakeReplica struct {
+	rows     map[string]uint64
+	total    map[string]uint64
+	step     uint64
+	syncs    map[string]int
+	replicas uint64
+}
+
+func (f *fakeReplica) SyncReplica(database, table string) error {
+	f.syncs[database+"."+table]++
+	name := database + "." + table
+	f.rows[name] += f.step
+	if f.rows[name] > f.total[name] {
+		f.rows[name] = f.total[name]
+	}
+	return nil
+}
+
+func (f *fakeReplica) GetRowsCount(database, table string) (uint64, error) {
+	return f.rows[database+"."+table], nil
+}
+
+func (f *fakeReplica) GetReplicaStatus(database, table string) (clickhouse.ReplicaStatus, error) {
+	return clickhouse.ReplicaStatus{TotalReplicas: f.replicas, ActiveReplicas: f.replicas}, nil
+}
+
+func TestSyncReplicas(t *testing.T) {
+	defer func(interval time.Duration) { replicaSyncPollInterval = interval }(replicaSyncPollInterval)
+	replicaSyncPollInterval = time.Millisecond
+	rows := func(n uint64) *uint64 { return &n }
+	withParts := map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}
+	tables := ListOfTables{
+		{Database: "default", Table: "t1", Parts: withParts, Rows: rows(30)},
+		{Database: "default", Table: "t2", Parts: withParts},
+		{Database: "default", Table: "empty"},
+	}
+	engines := map[metadata.TableTitle]string{
+		{Database: "default", Table: "t1"}:    "ReplicatedMergeTree",
+		{Database: "default", Table: "t2"}:    "ReplicatedReplacingMergeTree",
+		{Database: "default", Table: "empty"}: "MergeTree",
+	}
+	log := apexLog.WithField("test", t.Name())
+
+	ch := &fakeReplica{rows: map[string]uint64{}, total: map[string]uint64{"default.t1": 30, "default.t2": 5}, step: 10, syncs: map[string]int{}}
+	assert.NoError(t, syncReplicas(ch, tables, engines, nil, time.Minute, log))
+	assert.Equal(t, map[string]int{"default.t1": 3, "default.t2": 1}, ch.syncs, "sync is repeated until rows converge, tables without recorded rows and without parts are synced once or skipped")
+
+	ch = &fakeReplica{rows: map[string]uint64{}, total: map[string]uint64{"default.t1": 10}, step: 10, syncs: map[string]int{}}
+	err := syncReplicas(ch, tables[:1], engines, nil, 5*time.Millisecond, log)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "'default.t1' has 10 rows after")
+	assert.Contains(t, err.Error(), "expected 30, check that backup data was restored on another replica")
+
+	ch = &fakeReplica{rows: map[string]uint64{}, total: map[string]uint64{"default.t1": 10}, step: 10, syncs: map[string]int{}}
+	assert.NoError(t, syncReplicas(ch, tables[:1], engines, common.TablePartitions{"default.t1": {"202201": {}}}, time.Minute, log))
+	assert.Equal(t, 1, ch.syncs["default.t1"], "rows of partial restore are not verified")
+
+	err = syncReplicas(ch, ListOfTables{{Database: "default", Table: "local", Parts: withParts}}, engines, nil, time.Minute, log)
+	assert.EqualError(t, err, "'default.local' is not replicated, `--replica-sync` can't restore its data, restore it without `--replica-sync` or exclude it by `--tables`")
+}
+
+func TestWarnReplicatedDuplicates(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := (&apexLog.Logger{Handler: text.New(out), Level: apexLog.InfoLevel}).WithField("test", t.Name())
+	table := metadata.TableMetadata{Database: "default", Table: "t"}
+
+	warnReplicatedDuplicates(&fakeReplica{rows: map[string]uint64{"default.t": 100}, replicas: 3}, table, "MergeTree", log)
+	warnReplicatedDuplicates(&fakeReplica{rows: map[string]uint64{"default.t": 100}, replicas: 1}, table, "ReplicatedMergeTree", log)
+	warnReplicatedDuplicates(&fakeReplica{rows: map[string]uint64{}, replicas: 3}, table, "ReplicatedMergeTree", log)
+	assert.Empty(t, out.String())
+
+	warnReplicatedDuplicates(&fakeReplica{rows: map[string]uint64{"default.t": 100}, replicas: 3}, table, "ReplicatedMergeTree", log)
+	assert.Contains(t, out.String(), "table has 3 replicas and already contains 100 rows")
+}
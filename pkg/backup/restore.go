@@ -2,6 +2,7 @@ package backup
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -24,37 +26,57 @@ import (
 	"github.com/yargevad/filepathx"
 )
 
-// Restore - restore tables matched by tablePattern from backupName
-func Restore(cfg *config.Config, backupName string, tablePattern string, partitions []string, schemaOnly, dataOnly, dropTable, rbacOnly, configsOnly bool) error {
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "restore",
-	})
-	doRestoreData := !schemaOnly || dataOnly
+// Restore - restore tables matched by options.Tables from backupName
+// existing tables are dropped when options.Rm is true, kept when options.SkipExisting is true, otherwise restore fails when any table already exists,
+// when options.IncludeDetached is true, detached parts from backup are placed into `detached` folder of tables without attach
+func Restore(cfg *config.Config, backupName string, options RestoreOptions, operationID string) (err error) {
+	defer func(start time.Time) { logBackupOperation(cfg, "restore", backupName, start, err) }(time.Now())
+	log := operationLog(operationID, backupName, "restore")
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	if options.AttachOnly {
+		options.Data = true
+	}
+	doRestoreData := !options.Schema || options.Data
 
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
 	if backupName == "" {
-		_ = PrintLocalBackups(cfg, "all")
+		_ = PrintLocalBackups(cfg, "", "all", "", false, false, BackupDateWindow{})
 		return fmt.Errorf("select backup for restore")
 	}
 	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer ch.Close()
+	if err := checkOperationPermissions(cfg, ch, "restore", options.Tables, false); err != nil {
+		return err
+	}
 	defaultDataPath, err := ch.GetDefaultPath()
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
 	}
 	backupMetafileLocalPath := path.Join(defaultDataPath, "backup", backupName, "metadata.json")
 	backupMetadataBody, err := ioutil.ReadFile(backupMetafileLocalPath)
+	var rbacObjects []metadata.RBACObject
 	if err == nil {
 		backupMetadata := metadata.BackupMetadata{}
 		if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
 			return err
 		}
-		if schemaOnly || doRestoreData {
+		rbacObjects = backupMetadata.RBACObjects
+		if backupMetadata.SchemaOnly {
+			if options.Data {
+				return fmt.Errorf("'%s' is schema-only backup, it doesn't contain data for restore", backupName)
+			}
+			if !options.Schema {
+				log.Info("schema-only backup, data restore will be skipped")
+			}
+			options.Schema = true
+		}
+		if options.Schema || doRestoreData {
 			for _, database := range backupMetadata.Databases {
 				if err := ch.CreateDatabaseFromQuery(database.Query); err != nil {
 					return err
@@ -63,7 +85,7 @@ func Restore(cfg *config.Config, backupName string, tablePattern string, partiti
 		}
 		if len(backupMetadata.Tables) == 0 {
 			log.Warnf("'%s' doesn't contains tables for restore", backupName)
-			if (!rbacOnly) && (!configsOnly) {
+			if (!options.RBAC) && (!options.Configs) {
 				return nil
 			}
 		}
@@ -71,14 +93,15 @@ func Restore(cfg *config.Config, backupName string, tablePattern string, partiti
 		return err
 	}
 	needRestart := false
-	if rbacOnly {
-		if err := restoreRBAC(ch, backupName); err != nil {
+	if options.RBAC {
+		restored, err := restoreRBAC(ch, backupName, rbacObjects, log)
+		if err != nil {
 			return err
 		}
-		needRestart = true
+		needRestart = restored
 	}
-	if configsOnly {
-		if err := restoreConfigs(ch, backupName); err != nil {
+	if options.Configs {
+		if err := restoreConfigs(ch, backupName, log); err != nil {
 			return err
 		}
 		needRestart = true
@@ -86,32 +109,26 @@ func Restore(cfg *config.Config, backupName string, tablePattern string, partiti
 
 	if needRestart {
 		log.Warnf("%s contains `access` or `configs` directory, so we need exec %s", backupName, ch.Config.RestartCommand)
-		cmd, err := shellwords.Parse(ch.Config.RestartCommand)
-		if err != nil {
-			return err
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
-		log.Infof("run %s", ch.Config.RestartCommand)
-		var out []byte
-		if len(cmd) > 1 {
-			out, err = exec.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
-		} else {
-			out, err = exec.CommandContext(ctx, cmd[0]).CombinedOutput()
-		}
-		cancel()
-		log.Debug(string(out))
-		return err
+		return restartClickHouse(ch, log)
+	}
+	if options.RBAC {
+		log.Info("done")
+		return nil
 	}
 
-	if schemaOnly || (schemaOnly == dataOnly) {
+	if options.Schema || (options.Schema == options.Data) {
 
-		if err := RestoreSchema(cfg, ch, backupName, tablePattern, dropTable); err != nil {
+		if err := RestoreSchema(cfg, ch, backupName, options.Tables, options.Rm, options.SkipExisting, log); err != nil {
 			return err
 		}
 	}
-	if dataOnly || (schemaOnly == dataOnly) {
-		partitionsToRestore := filesystemhelper.CreatePartitionsToBackupMap(partitions)
-		if err := RestoreData(cfg, ch, backupName, tablePattern, partitionsToRestore); err != nil {
+	if options.Data || (options.Schema == options.Data) {
+		partitionsToRestore := filesystemhelper.CreatePartitionsToBackupMap(options.Partitions)
+		if options.ReplicaSync {
+			if err := RestoreReplicaSync(cfg, ch, backupName, options.Tables, partitionsToRestore, log); err != nil {
+				return err
+			}
+		} else if err := RestoreData(cfg, ch, backupName, options.Tables, partitionsToRestore, options.AttachOnly, options.ForceDefaultDisk, options.IncludeDetached, options.VerifyRows, log); err != nil {
 			return err
 		}
 	}
@@ -119,49 +136,77 @@ func Restore(cfg *config.Config, backupName string, tablePattern string, partiti
 	return nil
 }
 
-// restoreRBAC - copy backup_name>/rbac folder to access_data_path
-func restoreRBAC(ch *clickhouse.ClickHouse, backupName string) error {
-	accessPath, err := ch.GetAccessManagementPath(nil)
+// restartClickHouse - exec restart_command, required to apply restored RBAC objects and configs
+func restartClickHouse(ch *clickhouse.ClickHouse, log *apexLog.Entry) error {
+	cmd, err := shellwords.Parse(ch.Config.RestartCommand)
 	if err != nil {
 		return err
 	}
-	if err = restoreBackupRelatedDir(ch, backupName, "access", accessPath); err == nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
+	log.Infof("run %s", ch.Config.RestartCommand)
+	var out []byte
+	if len(cmd) > 1 {
+		out, err = exec.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
+	} else {
+		out, err = exec.CommandContext(ctx, cmd[0]).CombinedOutput()
+	}
+	cancel()
+	log.Debug(string(out))
+	return err
+}
+
+// restoreRBAC - create access entities saved by `rbac_backup_mode: sql` and copy backup_name>/access folder to access_data_path,
+// return true when folder was copied, clickhouse-server shall be restarted to apply it
+func restoreRBAC(ch *clickhouse.ClickHouse, backupName string, objects []metadata.RBACObject, log *apexLog.Entry) (bool, error) {
+	if len(objects) > 0 {
+		created, err := ch.CreateRBACObjects(objects)
+		if err != nil {
+			return false, err
+		}
+		log.WithField("created", strings.Join(created, ", ")).Infof("restored %d of %d access entities", len(created), len(objects))
+	}
+	accessPath, err := ch.GetAccessManagementPath(nil)
+	if err != nil {
+		return false, err
+	}
+	if err = restoreBackupRelatedDir(ch, backupName, "access", accessPath, log); err == nil {
 		markFile := path.Join(accessPath, "need_rebuild_lists.mark")
-		apexLog.Infof("create %s for properly rebuild RBAC after restart clickhouse-server", markFile)
+		log.Infof("create %s for properly rebuild RBAC after restart clickhouse-server", markFile)
 		file, err := os.Create(markFile)
 		if err != nil {
-			return err
+			return false, err
 		}
 		_ = file.Close()
 		_ = filesystemhelper.Chown(markFile, ch)
 		listFilesPattern := path.Join(accessPath, "*.list")
-		apexLog.Infof("remove %s for properly rebuild RBAC after restart clickhouse-server", listFilesPattern)
+		log.Infof("remove %s for properly rebuild RBAC after restart clickhouse-server", listFilesPattern)
 		if listFiles, err := filepathx.Glob(listFilesPattern); err != nil {
-			return err
+			return false, err
 		} else {
 			for _, f := range listFiles {
 				if err := os.Remove(f); err != nil {
-					return err
+					return false, err
 				}
 			}
 		}
+		return true, nil
 	}
 	if !os.IsNotExist(err) {
-		return err
+		return false, err
 	}
-	return nil
+	return false, nil
 }
 
 // restoreConfigs - copy backup_name/configs folder to /etc/clickhouse-server/
-func restoreConfigs(ch *clickhouse.ClickHouse, backupName string) error {
-	if err := restoreBackupRelatedDir(ch, backupName, "configs", ch.Config.ConfigDir); err != nil && os.IsNotExist(err) {
+func restoreConfigs(ch *clickhouse.ClickHouse, backupName string, log *apexLog.Entry) error {
+	if err := restoreBackupRelatedDir(ch, backupName, "configs", ch.Config.ConfigDir, log); err != nil && os.IsNotExist(err) {
 		return nil
 	} else {
 		return err
 	}
 }
 
-func restoreBackupRelatedDir(ch *clickhouse.ClickHouse, backupName, backupPrefixDir, destinationDir string) error {
+func restoreBackupRelatedDir(ch *clickhouse.ClickHouse, backupName, backupPrefixDir, destinationDir string, log *apexLog.Entry) error {
 	defaultDataPath, err := ch.GetDefaultPath()
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
@@ -175,7 +220,7 @@ func restoreBackupRelatedDir(ch *clickhouse.ClickHouse, backupName, backupPrefix
 	if !info.IsDir() {
 		return fmt.Errorf("%s is not a dir", srcBackupDir)
 	}
-	apexLog.Debugf("copy %s -> %s", srcBackupDir, destinationDir)
+	log.Debugf("copy %s -> %s", srcBackupDir, destinationDir)
 	copyOptions := copy.Options{OnDirExists: func(src, dest string) copy.DirExistsAction {
 		return copy.Merge
 	}}
@@ -197,11 +242,7 @@ func restoreBackupRelatedDir(ch *clickhouse.ClickHouse, backupName, backupPrefix
 }
 
 // RestoreSchema - restore schemas matched by tablePattern from backupName
-func RestoreSchema(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, tablePattern string, dropTable bool) error {
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "restore",
-	})
+func RestoreSchema(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, tablePattern string, dropTable, skipExisting bool, log *apexLog.Entry) error {
 
 	defaultDataPath, err := ch.GetDefaultPath()
 	if err != nil {
@@ -222,16 +263,85 @@ func RestoreSchema(cfg *config.Config, ch *clickhouse.ClickHouse, backupName str
 	if tablePattern == "" {
 		tablePattern = "*"
 	}
-	tablesForRestore, err := getTableListByPatternLocal(metadataPath, tablePattern, dropTable, nil)
+	tablesForRestore, err := getTableListByPatternLocal(metadataPath, tablePattern, cfg.ClickHouse.SkipTables, dropTable, nil)
 	if err != nil {
 		return err
 	}
 	if len(tablesForRestore) == 0 {
 		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
 	}
+	if cfg.General.RestoreSchemaRewrite {
+		backupVersion := 0
+		backupMetadataBody, err := ioutil.ReadFile(path.Join(defaultDataPath, "backup", backupName, "metadata.json"))
+		if err == nil {
+			backupMetadata := metadata.BackupMetadata{}
+			if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
+				return err
+			}
+			backupVersion = clickhouse.ParseVersionDescribe(backupMetadata.ClickHouseVersion)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		for i, schema := range tablesForRestore {
+			var applied []string
+			tablesForRestore[i].Query, applied = rewriteSchema(schema.Query, backupVersion, version)
+			logSchemaRewrites(log, schema.Database, schema.Table, applied)
+		}
+	}
 
-	if dropErr := dropExistsTables(cfg, ch, tablesForRestore, version, log); dropErr != nil {
-		return dropErr
+	if hasDistributedTables(tablesForRestore) {
+		clusters, err := ch.GetClusters()
+		if err != nil {
+			return fmt.Errorf("can't get clusters: %v", err)
+		}
+		if err := validateDistributedTables(tablesForRestore, clusters, cfg.General.RestoreDistributedCluster); err != nil {
+			return err
+		}
+	}
+	return restoreTablesSchema(cfg, ch, tablesForRestore, version, dropTable, skipExisting, log)
+}
+
+// schemaRestorer - part of clickhouse.ClickHouse which enough to restore tables schema
+type schemaRestorer interface {
+	TableExists(database, name string) (bool, error)
+	CreateDatabase(database string) error
+	CreateTable(table clickhouse.Table, query string, dropTable bool, onCluster string, version int) error
+	DropTable(table clickhouse.Table, query string, onCluster string, version int) error
+}
+
+// restoreTablesSchema - drop existing tables when dropTable, create only absent tables when skipExisting, otherwise return error when any table exists
+func restoreTablesSchema(cfg *config.Config, ch schemaRestorer, tablesForRestore ListOfTables, version int, dropTable, skipExisting bool, log *apexLog.Entry) error {
+	if dropTable {
+		for _, schema := range tablesForRestore {
+			if len(schema.Partitions) > 0 {
+				log.Warnf("`%s`.`%s` backup contains only partitions %s, other partitions are lost after drop", schema.Database, schema.Table, strings.Join(schema.Partitions, ","))
+			}
+		}
+		if dropErr := dropExistsTables(cfg, ch, tablesForRestore, version, log); dropErr != nil {
+			return dropErr
+		}
+	} else {
+		var existingTables []string
+		for _, schema := range tablesForRestore {
+			exists, err := ch.TableExists(schema.Database, schema.Table)
+			if err != nil {
+				return fmt.Errorf("can't check table `%s`.`%s` exists: %v", schema.Database, schema.Table, err)
+			}
+			if exists {
+				existingTables = append(existingTables, fmt.Sprintf("`%s`.`%s`", schema.Database, schema.Table))
+			}
+		}
+		if len(existingTables) > 0 && !skipExisting {
+			return fmt.Errorf("tables already exist: %s; use --drop-table to replace them or --skip-existing to keep them", strings.Join(existingTables, ", "))
+		}
+		if skipExisting {
+			if len(existingTables) > 0 {
+				log.Infof("skip existing tables: %s", strings.Join(existingTables, ", "))
+			}
+			for i := range tablesForRestore {
+				tablesForRestore[i].Query = createIfNotExists(tablesForRestore[i].Query)
+			}
+		}
 	}
 
 	if restoreErr := createTables(cfg, ch, tablesForRestore, version, log); restoreErr != nil {
@@ -240,7 +350,19 @@ func RestoreSchema(cfg *config.Config, ch *clickhouse.ClickHouse, backupName str
 	return nil
 }
 
-func createTables(cfg *config.Config, ch *clickhouse.ClickHouse, tablesForRestore ListOfTables, version int, log *apexLog.Entry) error {
+var createQueryRe = regexp.MustCompile(`^(?i)((?:CREATE|ATTACH)\s+(?:TEMPORARY\s+)?(?:MATERIALIZED\s+|LIVE\s+|WINDOW\s+)?(?:TABLE|VIEW|DICTIONARY))\s+`)
+var ifNotExistsRe = regexp.MustCompile(`^(?i)IF\s+NOT\s+EXISTS\s`)
+
+// createIfNotExists - add IF NOT EXISTS into CREATE query, query is returned as is when it already contains IF NOT EXISTS
+func createIfNotExists(query string) string {
+	loc := createQueryRe.FindStringSubmatchIndex(query)
+	if loc == nil || ifNotExistsRe.MatchString(query[loc[1]:]) {
+		return query
+	}
+	return query[:loc[3]] + " IF NOT EXISTS " + query[loc[1]:]
+}
+
+func createTables(cfg *config.Config, ch schemaRestorer, tablesForRestore ListOfTables, version int, log *apexLog.Entry) error {
 	totalRetries := len(tablesForRestore)
 	restoreRetries := 0
 	var restoreErr error
@@ -286,7 +408,7 @@ func createTables(cfg *config.Config, ch *clickhouse.ClickHouse, tablesForRestor
 	return nil
 }
 
-func dropExistsTables(cfg *config.Config, ch *clickhouse.ClickHouse, tablesForDrop ListOfTables, version int, log *apexLog.Entry) error {
+func dropExistsTables(cfg *config.Config, ch schemaRestorer, tablesForDrop ListOfTables, version int, log *apexLog.Entry) error {
 	var dropErr error
 	dropRetries := 0
 	totalRetries := len(tablesForDrop)
@@ -321,13 +443,11 @@ func dropExistsTables(cfg *config.Config, ch *clickhouse.ClickHouse, tablesForDr
 	return nil
 }
 
-// RestoreData - restore data for tables matched by tablePattern from backupName
-func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, tablePattern string, partitionsToRestore common.EmptyMap) error {
+// RestoreData - restore data for tables matched by tablePattern from backupName,
+// when attachOnly is true, table structure shall be the same as in backup and parts which already exist in table will skip,
+// when includeDetached is true, detached parts are copied to `detached` folder after attach of regular parts
+func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, tablePattern string, partitionsToRestore common.TablePartitions, attachOnly, forceDefaultDisk, includeDetached, verifyRows bool, log *apexLog.Entry) error {
 	startRestore := time.Now()
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "restore",
-	})
 	defaultDataPath, err := ch.GetDefaultPath()
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
@@ -344,7 +464,7 @@ func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName strin
 		tablesForRestore, err = ch.GetBackupTablesLegacy(backupName)
 	} else {
 		metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
-		tablesForRestore, err = getTableListByPatternLocal(metadataPath, tablePattern, false, partitionsToRestore)
+		tablesForRestore, err = getTableListByPatternLocal(metadataPath, tablePattern, cfg.ClickHouse.SkipTables, false, partitionsToRestore)
 	}
 	if err != nil {
 		return err
@@ -353,6 +473,9 @@ func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName strin
 		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
 	}
 	log.Debugf("found %d tables with data in backup", len(tablesForRestore))
+	if err := checkRestoreObjectDisks(tablesForRestore); err != nil {
+		return err
+	}
 	chTables, err := ch.GetTables(tablePattern)
 	if err != nil {
 		return err
@@ -361,15 +484,12 @@ func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName strin
 	if err != nil {
 		return err
 	}
-	diskMap := map[string]string{}
-	for _, disk := range disks {
-		diskMap[disk.Name] = disk.Path
+	if disks, err = resolveBackupDisks(disks, tablesForRestore, forceDefaultDisk); err != nil {
+		return err
 	}
-	for _, t := range tablesForRestore {
-		for disk := range t.Parts {
-			if _, ok := diskMap[disk]; !ok {
-				return fmt.Errorf("table '%s.%s' require disk '%s' that not found in clickhouse, you can add nonexistent disks to disk_mapping config", t.Database, t.Table, disk)
-			}
+	if !backup.Legacy {
+		if err := consolidateBackupDisks(backupName, defaultDataPath, tablesForRestore, disks); err != nil {
+			return fmt.Errorf("can't consolidate disks: %v", err)
 		}
 	}
 	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{}
@@ -382,6 +502,10 @@ func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName strin
 
 	var missingTables []string
 	for _, restoreTable := range tablesForRestore {
+		// table without data has nothing to restore, its schema is restored by restore schema step
+		if isMetadataOnlyTable(restoreTable.Parts, restoreTable.DetachedParts) {
+			continue
+		}
 		found := false
 		for _, chTable := range chTables {
 			if (restoreTable.Database == chTable.Database) && (restoreTable.Table == chTable.Name) {
@@ -396,22 +520,121 @@ func RestoreData(cfg *config.Config, ch *clickhouse.ClickHouse, backupName strin
 	if len(missingTables) > 0 {
 		return fmt.Errorf("%s is not created. Restore schema first or create missing tables manually", strings.Join(missingTables, ", "))
 	}
+	if attachOnly {
+		var mismatchedTables []string
+		for _, table := range tablesForRestore {
+			dstTable := dstTablesMap[metadata.TableTitle{Database: table.Database, Table: table.Table}]
+			if table.Query != "" && tableStructureHash(table.Query) != tableStructureHash(dstTable.CreateTableQuery) {
+				log.Debugf("backup: %s, existing: %s", table.Query, dstTable.CreateTableQuery)
+				mismatchedTables = append(mismatchedTables, fmt.Sprintf("'%s.%s'", table.Database, table.Table))
+			}
+		}
+		if len(mismatchedTables) > 0 {
+			return fmt.Errorf("%s structure is different from backup, can't attach parts", strings.Join(mismatchedTables, ", "))
+		}
+	}
 
 	for _, table := range tablesForRestore {
 		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table))
-		dstTableDataPaths := dstTablesMap[metadata.TableTitle{
+		dstTable := dstTablesMap[metadata.TableTitle{
 			Database: table.Database,
-			Table:    table.Table}].DataPaths
-		if err := filesystemhelper.CopyData(backupName, table, disks, dstTableDataPaths, ch); err != nil {
-			return fmt.Errorf("can't restore '%s.%s': %v", table.Database, table.Table, err)
+			Table:    table.Table}]
+		dstTableDataPaths := dstTable.DataPaths
+		if !tableHasParts(table) {
+			log.Info("table has no parts, skip data restore")
+		} else {
+			if len(table.Partitions) > 0 {
+				log.Infof("backup contains only partitions %s", strings.Join(table.Partitions, ","))
+			}
+			if attachOnly {
+				if table, err = filterExistingParts(ch, table, dstTable, log); err != nil {
+					return err
+				}
+			} else {
+				warnReplicatedDuplicates(ch, table, dstTable.Engine, log)
+			}
+			if err := filesystemhelper.CopyData(backupName, table, disks, dstTableDataPaths, ch); err != nil {
+				return fmt.Errorf("can't restore '%s.%s': %v", table.Database, table.Table, err)
+			}
+			log.Debugf("copied data to 'detached'")
+			if err := ch.AttachPartitions(table, disks); err != nil {
+				return fmt.Errorf("can't attach partitions for table '%s.%s': %v", table.Database, table.Table, err)
+			}
+			log.Debugf("attached parts")
 		}
-		log.Debugf("copied data to 'detached'")
-		if err := ch.AttachPartitions(table, disks); err != nil {
-			return fmt.Errorf("can't attach partitions for table '%s.%s': %v", table.Database, table.Table, err)
+		// detached parts are copied after attach, so they can't be mixed with regular parts in `detached` folder
+		if includeDetached && len(table.DetachedParts) > 0 {
+			if err := filesystemhelper.CopyDetached(backupName, table, disks, dstTableDataPaths, ch); err != nil {
+				return fmt.Errorf("can't restore detached parts of '%s.%s': %v", table.Database, table.Table, err)
+			}
+			log.Debugf("copied detached parts to 'detached'")
 		}
-		log.Debugf("attached parts")
 		log.Info("done")
 	}
+	if verifyRows {
+		if err := verifyRestoredRows(ch, tablesForRestore, partitionsToRestore, log); err != nil {
+			return err
+		}
+	}
 	log.WithField("duration", utils.HumanizeDuration(time.Since(startRestore))).Info("done")
 	return nil
 }
+
+var createTablePrefixRE = regexp.MustCompile("(?is)^\\s*(CREATE|ATTACH)\\s+TABLE\\s+(IF\\s+NOT\\s+EXISTS\\s+)?(`[^`]+`|[^\\s.(]+)(\\.(`[^`]+`|[^\\s(]+))?(\\s+UUID\\s+'[^']+')?(\\s+ON\\s+CLUSTER\\s+\\S+)?")
+var whitespaceRE = regexp.MustCompile("\\s+")
+var separatorRE = regexp.MustCompile("\\s*([(),])\\s*")
+
+// tableStructureHash - return hash of table DDL without table name, UUID and ON CLUSTER clause
+func tableStructureHash(query string) string {
+	structure := createTablePrefixRE.ReplaceAllString(query, "")
+	structure = strings.TrimSpace(whitespaceRE.ReplaceAllString(structure, " "))
+	structure = separatorRE.ReplaceAllString(structure, "$1")
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(structure)))
+}
+
+// tableHasParts - false for empty tables and tables without data like views, schema of such tables is restored, data is not
+func tableHasParts(table metadata.TableMetadata) bool {
+	for _, parts := range table.Parts {
+		if len(parts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isMetadataOnlyTable - table without parts and detached parts is backed up as MetadataOnly, so download skips its data and restore creates it from schema only
+func isMetadataOnlyTable(parts, detachedParts map[string][]metadata.Part) bool {
+	for _, disksParts := range []map[string][]metadata.Part{parts, detachedParts} {
+		for _, p := range disksParts {
+			if len(p) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// partNamesGetter - part of clickhouse.ClickHouse which enough to list active parts of table
+type partNamesGetter interface {
+	GetPartNames(database, table string) (common.EmptyMap, error)
+}
+
+// filterExistingParts - remove parts which already exist in destination table from backup table metadata
+func filterExistingParts(ch partNamesGetter, table metadata.TableMetadata, dstTable clickhouse.Table, log *apexLog.Entry) (metadata.TableMetadata, error) {
+	existingParts, err := ch.GetPartNames(dstTable.Database, dstTable.Name)
+	if err != nil {
+		return table, err
+	}
+	filteredParts := make(map[string][]metadata.Part, len(table.Parts))
+	for disk, parts := range table.Parts {
+		for _, part := range parts {
+			if _, exists := existingParts[part.Name]; exists {
+				log.WithField("part", part.Name).Info("part already exists, skip")
+				continue
+			}
+			filteredParts[disk] = append(filteredParts[disk], part)
+		}
+	}
+	table.Parts = filteredParts
+	return table, nil
+}
@@ -1,8 +1,64 @@
 package backup
 
-func (b *Backuper) RestoreFromRemote(backupName string, tablePattern string, partitions []string, schemaOnly, dataOnly, dropTable, rbacOnly, configsOnly bool) error {
-	if err := b.Download(backupName, tablePattern, partitions, schemaOnly); err != nil {
+import (
+	"fmt"
+
+	apexLog "github.com/apex/log"
+)
+
+// restoreRemoteSteps - restore_remote downloads backup, restores it and removes downloaded local copy,
+// steps are separate to reuse Download, Restore and RemoveBackupLocal as is
+type restoreRemoteSteps struct {
+	download    func() error
+	restore     func() error
+	removeLocal func() error
+}
+
+// run - local copy is removed only after successful restore, so failed restore can be repeated by `restore` without download
+func (s restoreRemoteSteps) run(keep bool, log *apexLog.Entry) error {
+	if err := s.download(); err != nil {
+		return err
+	}
+	if err := s.restore(); err != nil {
+		if !keep {
+			log.Warn("restore failed, downloaded local backup is kept")
+		}
 		return err
 	}
-	return Restore(b.cfg, backupName, tablePattern, partitions, schemaOnly, dataOnly, dropTable, rbacOnly, configsOnly)
+	if keep {
+		return nil
+	}
+	if err := s.removeLocal(); err != nil {
+		return fmt.Errorf("backup is restored, but can't remove downloaded local backup: %v", err)
+	}
+	log.Info("downloaded local backup removed")
+	return nil
+}
+
+func (b *Backuper) RestoreFromRemote(backupName string, options RestoreOptions, keep bool) error {
+	return restoreRemoteSteps{
+		download: func() error {
+			return b.Download(backupName, options.Tables, options.Partitions, options.Schema, options.ForceDefaultDisk, "")
+		},
+		restore: func() error {
+			return Restore(b.cfg, backupName, options, b.OperationID)
+		},
+		removeLocal: func() error {
+			return RemoveBackupLocal(b.cfg, backupName)
+		},
+	}.run(keep, operationLog(b.OperationID, backupName, "restore_remote"))
+}
+
+func (b *Backuper) RestoreDRFromRemote(backupName string, tablePattern string, partitions []string, dropTable, skipExisting, forceDefaultDisk, keep bool, components DRComponents) error {
+	return restoreRemoteSteps{
+		download: func() error {
+			return b.Download(backupName, tablePattern, partitions, !components.Data, forceDefaultDisk, "")
+		},
+		restore: func() error {
+			return RestoreDR(b.cfg, backupName, tablePattern, partitions, dropTable, skipExisting, forceDefaultDisk, components, b.OperationID)
+		},
+		removeLocal: func() error {
+			return RemoveBackupLocal(b.cfg, backupName)
+		},
+	}.run(keep, operationLog(b.OperationID, backupName, "restore_remote"))
 }
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRestoreRemote - restore_remote steps over memoryStorage as remote storage, local directory as downloaded backup
+// and fakeRowsCounter as ClickHouse where restore puts rows from downloaded metadata
+func fakeRestoreRemote(remote *memoryStorage, ch *fakeRowsCounter, backupPath string, restoreErr error) restoreRemoteSteps {
+	return restoreRemoteSteps{
+		download: func() error {
+			r, err := remote.GetFileReader("test/metadata/db/t.json")
+			if err != nil {
+				return err
+			}
+			body, err := ioutil.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(path.Join(backupPath, "metadata", "db"), 0750); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path.Join(backupPath, "metadata", "db", "t.json"), body, 0640)
+		},
+		restore: func() error {
+			if restoreErr != nil {
+				return restoreErr
+			}
+			var table metadata.TableMetadata
+			if _, err := table.Load(path.Join(backupPath, "metadata", "db", "t.json")); err != nil {
+				return err
+			}
+			ch.rows[table.Database+"."+table.Table] = *table.Rows
+			return nil
+		},
+		removeLocal: func() error {
+			return os.RemoveAll(backupPath)
+		},
+	}
+}
+
+func TestRestoreRemote(t *testing.T) {
+	log := apexLog.WithField("operation", "restore_remote")
+	remote := &memoryStorage{files: map[string][]byte{
+		"test/metadata/db/t.json": []byte(`{"database":"db","table":"t","rows":10}`),
+	}}
+
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep=%v", keep), func(t *testing.T) {
+			backupPath := path.Join(t.TempDir(), "test")
+			ch := &fakeRowsCounter{rows: map[string]uint64{}}
+			assert.NoError(t, fakeRestoreRemote(remote, ch, backupPath, nil).run(keep, log))
+			assert.Equal(t, map[string]uint64{"db.t": 10}, ch.rows)
+			_, err := os.Stat(backupPath)
+			assert.Equal(t, keep, err == nil, "local backup shall be kept only with --keep")
+		})
+	}
+
+	t.Run("failed restore keeps local backup", func(t *testing.T) {
+		backupPath := path.Join(t.TempDir(), "test")
+		ch := &fakeRowsCounter{rows: map[string]uint64{}}
+		err := fakeRestoreRemote(remote, ch, backupPath, fmt.Errorf("can't create table")).run(false, log)
+		assert.EqualError(t, err, "can't create table")
+		assert.Empty(t, ch.rows)
+		assert.FileExists(t, path.Join(backupPath, "metadata", "db", "t.json"))
+	})
+
+	t.Run("failed download skips restore", func(t *testing.T) {
+		steps := restoreRemoteSteps{
+			download:    func() error { return ErrBackupIsAlreadyExists },
+			restore:     func() error { t.Fatal("restore after failed download"); return nil },
+			removeLocal: func() error { t.Fatal("local backup removed after failed download"); return nil },
+		}
+		assert.Equal(t, ErrBackupIsAlreadyExists, steps.run(false, log))
+	})
+}
@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSchemaRestorer - clickhouse with pre-existing tables, record all executed DDL
+type fakeSchemaRestorer struct {
+	existing map[string]bool
+	queries  []string
+}
+
+func (f *fakeSchemaRestorer) TableExists(database, name string) (bool, error) {
+	return f.existing[database+"."+name], nil
+}
+
+func (f *fakeSchemaRestorer) CreateDatabase(database string) error {
+	return nil
+}
+
+func (f *fakeSchemaRestorer) CreateTable(table clickhouse.Table, query string, dropTable bool, onCluster string, version int) error {
+	f.queries = append(f.queries, query)
+	return nil
+}
+
+func (f *fakeSchemaRestorer) DropTable(table clickhouse.Table, query string, onCluster string, version int) error {
+	f.queries = append(f.queries, "DROP TABLE "+table.Database+"."+table.Name)
+	delete(f.existing, table.Database+"."+table.Name)
+	return nil
+}
+
+func restoreTestTables() ListOfTables {
+	return ListOfTables{
+		{Database: "default", Table: "events", Query: "CREATE TABLE default.events (id UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "default", Table: "users", Query: "CREATE TABLE default.users (id UInt64) ENGINE = MergeTree ORDER BY id"},
+	}
+}
+
+func TestRestoreTablesSchemaModes(t *testing.T) {
+	cfg := config.DefaultConfig()
+	log := apexLog.WithField("test", t.Name())
+
+	ch := &fakeSchemaRestorer{existing: map[string]bool{"default.events": true}}
+	err := restoreTablesSchema(cfg, ch, restoreTestTables(), 21008000, false, false, log)
+	assert.EqualError(t, err, "tables already exist: `default`.`events`; use --drop-table to replace them or --skip-existing to keep them")
+	assert.Empty(t, ch.queries)
+
+	ch = &fakeSchemaRestorer{existing: map[string]bool{"default.events": true}}
+	assert.NoError(t, restoreTablesSchema(cfg, ch, restoreTestTables(), 21008000, true, false, log))
+	assert.Equal(t, []string{
+		"DROP TABLE default.events",
+		"DROP TABLE default.users",
+		"CREATE TABLE default.events (id UInt64) ENGINE = MergeTree ORDER BY id",
+		"CREATE TABLE default.users (id UInt64) ENGINE = MergeTree ORDER BY id",
+	}, ch.queries)
+
+	ch = &fakeSchemaRestorer{existing: map[string]bool{"default.events": true}}
+	assert.NoError(t, restoreTablesSchema(cfg, ch, restoreTestTables(), 21008000, false, true, log))
+	assert.Equal(t, []string{
+		"CREATE TABLE IF NOT EXISTS default.events (id UInt64) ENGINE = MergeTree ORDER BY id",
+		"CREATE TABLE IF NOT EXISTS default.users (id UInt64) ENGINE = MergeTree ORDER BY id",
+	}, ch.queries)
+	assert.True(t, ch.existing["default.events"])
+}
+
+func TestCreateIfNotExists(t *testing.T) {
+	assert.Equal(t, "CREATE MATERIALIZED VIEW IF NOT EXISTS default.mv TO default.t AS SELECT 1", createIfNotExists("CREATE MATERIALIZED VIEW default.mv TO default.t AS SELECT 1"))
+	assert.Equal(t, "CREATE DICTIONARY IF NOT EXISTS default.d (id UInt64) PRIMARY KEY id", createIfNotExists("CREATE DICTIONARY default.d (id UInt64) PRIMARY KEY id"))
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS default.t (id UInt64)", createIfNotExists("CREATE TABLE IF NOT EXISTS default.t (id UInt64)"))
+	assert.Equal(t, "ATTACH TABLE IF NOT EXISTS default.t (id UInt64)", createIfNotExists("ATTACH TABLE default.t (id UInt64)"))
+}
+
+func TestTableStructureHash(t *testing.T) {
+	base := tableStructureHash("CREATE TABLE default.events (id UInt64, name String) ENGINE = MergeTree ORDER BY id")
+	testCases := []struct {
+		name  string
+		query string
+		same  bool
+	}{
+		{"attach", "ATTACH TABLE default.events (id UInt64, name String) ENGINE = MergeTree ORDER BY id", true},
+		{"other database and table", "CREATE TABLE `other_db`.`other_events` (id UInt64, name String) ENGINE = MergeTree ORDER BY id", true},
+		{"if not exists, uuid and on cluster", "CREATE TABLE IF NOT EXISTS db.events UUID 'f3c1a8e2-5b1e-4b0e-9d4a-0c2b6e0f1a2b' ON CLUSTER '{cluster}' (id UInt64, name String) ENGINE = MergeTree ORDER BY id", true},
+		{"whitespace", "  CREATE TABLE default.events\n(\n    id UInt64 ,\n    name String\n)\nENGINE = MergeTree\nORDER BY id\n", true},
+		{"lowercase keywords", "attach table default.events (id UInt64, name String) ENGINE = MergeTree ORDER BY id", true},
+		{"other column type", "CREATE TABLE default.events (id UInt32, name String) ENGINE = MergeTree ORDER BY id", false},
+		{"other column order", "CREATE TABLE default.events (name String, id UInt64) ENGINE = MergeTree ORDER BY id", false},
+		{"other engine", "CREATE TABLE default.events (id UInt64, name String) ENGINE = ReplacingMergeTree ORDER BY id", false},
+	}
+	for _, tc := range testCases {
+		if tc.same {
+			assert.Equal(t, base, tableStructureHash(tc.query), tc.name)
+		} else {
+			assert.NotEqual(t, base, tableStructureHash(tc.query), tc.name)
+		}
+	}
+}
+
+// fakePartNames - active parts of destination tables
+type fakePartNames map[string]common.EmptyMap
+
+func (f fakePartNames) GetPartNames(database, table string) (common.EmptyMap, error) {
+	parts, ok := f[database+"."+table]
+	if !ok {
+		return nil, fmt.Errorf("table %s.%s doesn't exist", database, table)
+	}
+	return parts, nil
+}
+
+func TestFilterExistingParts(t *testing.T) {
+	ch := fakePartNames{"default.events": {"all_1_1_0": {}, "all_3_3_0": {}}}
+	table := metadata.TableMetadata{
+		Database: "default",
+		Table:    "events",
+		Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+			"hdd":     {{Name: "all_3_3_0"}},
+		},
+	}
+	log := apexLog.WithField("test", "filter_existing_parts")
+	filtered, err := filterExistingParts(ch, table, clickhouse.Table{Database: "default", Name: "events"}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_2_2_0"}}}, filtered.Parts)
+	assert.Len(t, table.Parts["default"], 2, "source metadata shall not be changed")
+
+	_, err = filterExistingParts(ch, table, clickhouse.Table{Database: "default", Name: "missing"}, log)
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"regexp"
+	"strings"
+
+	apexLog "github.com/apex/log"
+)
+
+// schemaRewriteRule - remove table setting which incompatible with clickhouse-server since sinceVersion
+type schemaRewriteRule struct {
+	setting      string
+	sinceVersion int
+}
+
+// schemaRewriteRules - deprecated MergeTree settings, which could break CREATE TABLE on newer clickhouse-server versions
+var schemaRewriteRules = []schemaRewriteRule{
+	{setting: "in_memory_parts_enable_wal", sinceVersion: 23005000},
+	{setting: "write_ahead_log_max_bytes", sinceVersion: 23005000},
+	{setting: "min_rows_for_compact_part", sinceVersion: 23005000},
+	{setting: "min_bytes_for_compact_part", sinceVersion: 23005000},
+	{setting: "check_delay_period", sinceVersion: 23002000},
+	{setting: "min_relative_delay_to_yield_insert", sinceVersion: 23002000},
+	{setting: "replicated_max_parallel_sends", sinceVersion: 23002000},
+	{setting: "replicated_max_parallel_sends_for_table", sinceVersion: 23002000},
+}
+
+var tableSettingsRE = regexp.MustCompile(`(?s)\sSETTINGS\s+(.+)$`)
+
+// rewriteSchema - apply schemaRewriteRules which relevant for restore backup created on backupVersion to serverVersion,
+// backupVersion equal 0 means unknown version, and all rules relevant for serverVersion will apply
+func rewriteSchema(query string, backupVersion, serverVersion int) (string, []string) {
+	var applied []string
+	for _, rule := range schemaRewriteRules {
+		if serverVersion < rule.sinceVersion || (backupVersion != 0 && backupVersion >= rule.sinceVersion) {
+			continue
+		}
+		var removed bool
+		if query, removed = removeTableSetting(query, rule.setting); removed {
+			applied = append(applied, "remove setting "+rule.setting)
+		}
+	}
+	return query, applied
+}
+
+// removeTableSetting - remove setting from SETTINGS clause of CREATE TABLE query, SETTINGS clause shall be the last clause of query
+func removeTableSetting(query, setting string) (string, bool) {
+	match := tableSettingsRE.FindStringSubmatchIndex(query)
+	if match == nil {
+		return query, false
+	}
+	settings := strings.Split(query[match[2]:match[3]], ",")
+	keptSettings := make([]string, 0, len(settings))
+	removed := false
+	for _, s := range settings {
+		name := strings.TrimSpace(strings.SplitN(s, "=", 2)[0])
+		if name == setting {
+			removed = true
+			continue
+		}
+		keptSettings = append(keptSettings, strings.TrimSpace(s))
+	}
+	if !removed {
+		return query, false
+	}
+	if len(keptSettings) == 0 {
+		return query[:match[0]], true
+	}
+	return query[:match[2]] + strings.Join(keptSettings, ", "), true
+}
+
+// logSchemaRewrites - show each rewrite of table schema which was applied during restore
+func logSchemaRewrites(log *apexLog.Entry, database, table string, applied []string) {
+	for _, rewrite := range applied {
+		log.WithField("table", database+"."+table).Infof("schema rewrite: %s", rewrite)
+	}
+}
@@ -0,0 +1,33 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteSchema(t *testing.T) {
+	query := "CREATE TABLE default.t1 (id UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, in_memory_parts_enable_wal = 0, min_rows_for_compact_part = 0"
+	backupVersion := clickhouse.ParseVersionDescribe("v21.8.10.19-lts")
+	assert.Equal(t, 21008010, backupVersion)
+
+	rewritten, applied := rewriteSchema(query, backupVersion, 23008001)
+	assert.Equal(t, "CREATE TABLE default.t1 (id UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192", rewritten)
+	assert.Equal(t, []string{"remove setting in_memory_parts_enable_wal", "remove setting min_rows_for_compact_part"}, applied)
+
+	// the same version, nothing to rewrite
+	rewritten, applied = rewriteSchema(query, 23008001, 23008001)
+	assert.Equal(t, query, rewritten)
+	assert.Empty(t, applied)
+
+	// old server version, nothing to rewrite
+	rewritten, applied = rewriteSchema(query, backupVersion, 22003000)
+	assert.Equal(t, query, rewritten)
+	assert.Empty(t, applied)
+
+	// SETTINGS clause removed when no settings left, unknown backup version
+	rewritten, applied = rewriteSchema("CREATE TABLE default.t2 (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/t2', '{replica}') ORDER BY id SETTINGS check_delay_period = 60", 0, 23008001)
+	assert.Equal(t, "CREATE TABLE default.t2 (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/t2', '{replica}') ORDER BY id", rewritten)
+	assert.Equal(t, []string{"remove setting check_delay_period"}, applied)
+}
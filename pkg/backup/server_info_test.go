@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeServerInfo struct{}
+
+func (fakeServerInfo) GetVersionDescribe() string { return "21.8.10.19" }
+func (fakeServerInfo) GetTimezone() string        { return "Europe/Moscow" }
+func (fakeServerInfo) GetServerUUID() string {
+	return "8c4a0b5e-8b2a-4b5e-9b1a-3c8f0f2a1d7e"
+}
+
+func TestFillServerInfoRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_info")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backupMetadata := metadata.BackupMetadata{BackupName: "test"}
+	fillServerInfo(fakeServerInfo{}, &backupMetadata)
+	assert.Equal(t, "21.8.10.19", backupMetadata.ClickHouseVersion)
+	assert.Equal(t, "Europe/Moscow", backupMetadata.ClickHouseTimezone)
+	assert.Equal(t, "8c4a0b5e-8b2a-4b5e-9b1a-3c8f0f2a1d7e", backupMetadata.ClickHouseServerUUID)
+
+	metadataFile := path.Join(dir, "metadata.json")
+	assert.NoError(t, backupMetadata.Save(metadataFile))
+	var loaded metadata.BackupMetadata
+	assert.NoError(t, loaded.Load(metadataFile))
+	assert.Equal(t, backupMetadata, loaded)
+	assert.Equal(t, "21.8.10.19\tEurope/Moscow\t8c4a0b5e-8b2a-4b5e-9b1a-3c8f0f2a1d7e", backupServerInfo(loaded))
+}
+
+func TestPrintBackupsLocalDetailed(t *testing.T) {
+	legacy := BackupLocal{BackupMetadata: metadata.BackupMetadata{BackupName: "legacy"}, Legacy: true}
+	current := BackupLocal{BackupMetadata: metadata.BackupMetadata{BackupName: "current", DataFormat: "tar"}}
+	fillServerInfo(fakeServerInfo{}, &current.BackupMetadata)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, printBackupsLocal(out, []BackupLocal{legacy, current}, "detailed", "", false, false, BackupDateWindow{}))
+	assert.Contains(t, out.String(), "legacy\t???\t")
+	assert.Contains(t, out.String(), "\tunknown\tunknown\tunknown\n")
+	assert.Contains(t, out.String(), "\ttar\t21.8.10.19\tEurope/Moscow\t8c4a0b5e-8b2a-4b5e-9b1a-3c8f0f2a1d7e\n")
+
+	out.Reset()
+	assert.NoError(t, printBackupsLocal(out, []BackupLocal{current}, "all", "", false, false, BackupDateWindow{}))
+	assert.NotContains(t, out.String(), "Europe/Moscow")
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableCompression(t *testing.T) {
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.General.UploadConcurrency = 1
+	cfg.General.DownloadConcurrency = 1
+	cfg.General.TableCompression = map[string]string{"default.texts": "gzip/9"}
+	storage := &memoryStorage{files: map[string][]byte{}}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:             cfg,
+		dst:             dst,
+		DiskToPathMap:   map[string]string{"default": localPath},
+		DefaultDataPath: localPath,
+	}
+	var tables ListOfTables
+	for _, name := range []string{"images", "texts"} {
+		writeDetachedPart(t, path.Join(localPath, "backup", "test_backup", "shadow", common.TablePath("default", name), "default", "all_1_1_0"), "data of "+name)
+		tables = append(tables, metadata.TableMetadata{
+			Database: "default",
+			Table:    name,
+			Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+		})
+	}
+	timeouts, err := newTableTimeouts(cfg)
+	assert.NoError(t, err)
+	uploaded, _, _, err := b.uploadTables("test_backup", tables, false, false, timeouts)
+	assert.NoError(t, err)
+
+	archives := map[string][]byte{}
+	for key, body := range storage.files {
+		if strings.HasPrefix(key, "test_backup/shadow/") {
+			archives[key] = body
+		}
+	}
+	assert.Len(t, archives, 2)
+	assert.Contains(t, archives, "test_backup/shadow/default/images/default_all_1_1_0.tar", "table without override uses global format")
+	gzipArchive := archives["test_backup/shadow/default/texts/default_all_1_1_0.tar.gz"]
+	assert.Equal(t, []byte{0x1f, 0x8b}, gzipArchive[:2], "archive of overridden table shall be compressed by gzip")
+	var remoteTable metadata.TableMetadata
+	assert.NoError(t, json.Unmarshal(storage.files["test_backup/metadata/default/texts.json"], &remoteTable))
+	assert.Equal(t, "gzip", remoteTable.CompressionFormat)
+
+	// reader is selected by format from table metadata, even when override was removed from config
+	cfg.General.TableCompression = nil
+	downloadPath := t.TempDir()
+	b.DiskToPathMap = map[string]string{"default": downloadPath}
+	remoteBackup := metadata.BackupMetadata{BackupName: "test_backup", DataFormat: "tar"}
+	for _, table := range uploaded {
+		assert.NoError(t, b.downloadTableData(remoteBackup, table))
+		body, err := ioutil.ReadFile(path.Join(downloadPath, "backup", "test_backup", "shadow", common.TablePath("default", table.Table), "default", "all_1_1_0", "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, "data of "+table.Table, string(body))
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
 	"io"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -15,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
 )
 
 type ListOfTables []metadata.TableMetadata
@@ -35,13 +35,25 @@ func addTableToListIfNotExists(tables ListOfTables, table metadata.TableMetadata
 	return append(tables, table)
 }
 
-func getTableListByPatternLocal(metadataPath string, tablePattern string, dropTable bool, partitionsFilter common.EmptyMap) (ListOfTables, error) {
-	result := ListOfTables{}
-	tablePatterns := []string{"*"}
+// logMatchedTables - show effective list of tables which tablePattern was resolved to
+func logMatchedTables(tablePattern string, tableNames []string) {
+	if tablePattern == "" {
+		tablePattern = "*"
+	}
+	apexLog.Debugf("tables pattern '%s' matched %d tables: %s", tablePattern, len(tableNames), strings.Join(tableNames, ", "))
+}
 
-	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
+func (lt ListOfTables) names() []string {
+	names := make([]string, len(lt))
+	for i := range lt {
+		names[i] = fmt.Sprintf("%s.%s", lt[i].Database, lt[i].Table)
 	}
+	return names
+}
+
+func getTableListByPatternLocal(metadataPath string, tablePattern string, skipTables []string, dropTable bool, partitionsFilter common.TablePartitions) (ListOfTables, error) {
+	result := ListOfTables{}
+	tp := common.NewTablePattern(tablePattern, skipTables)
 	if err := filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -52,103 +64,85 @@ func getTableListByPatternLocal(metadataPath string, tablePattern string, dropTa
 			return nil
 		}
 		p := filepath.ToSlash(filePath)
-		legacy := false
-		if strings.HasSuffix(p, ".sql") {
-			legacy = true
-			p = strings.TrimSuffix(p, ".sql")
-		} else {
-			p = strings.TrimSuffix(p, ".json")
+		legacy := strings.HasSuffix(p, ".sql")
+		database, table, err := common.ParseTablePath(strings.TrimPrefix(p, metadataPath))
+		if err != nil {
+			return nil
 		}
-		p = strings.Trim(strings.TrimPrefix(p, metadataPath), "/")
-		parts := strings.Split(p, "/")
-		if len(parts) != 2 {
+		if !tp.Match(database, table) {
 			return nil
 		}
-		database, _ := url.PathUnescape(parts[0])
-		table, _ := url.PathUnescape(parts[1])
-		tableName := fmt.Sprintf("%s.%s", database, table)
-		for _, p := range tablePatterns {
-			if matched, _ := filepath.Match(strings.Trim(p, " \t\r\n"), tableName); !matched {
-				continue
-			}
-			data, err := ioutil.ReadFile(filePath)
-			if err != nil {
-				return err
-			}
-			if legacy {
-				result = addTableToListIfNotExists(result, metadata.TableMetadata{
-					Database: database,
-					Table:    table,
-					Query:    strings.Replace(string(data), "ATTACH", "CREATE", 1),
-					// Path:     filePath,
-				})
-				return nil
-			}
-			var t metadata.TableMetadata
-			if err := json.Unmarshal(data, &t); err != nil {
-				return err
-			}
-			filterPartsByPartitionsFilter(t, partitionsFilter)
-			result = addTableToListIfNotExists(result, t)
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if legacy {
+			result = addTableToListIfNotExists(result, metadata.TableMetadata{
+				Database: database,
+				Table:    table,
+				Query:    strings.Replace(string(data), "ATTACH", "CREATE", 1),
+				// Path:     filePath,
+			})
 			return nil
 		}
+		var t metadata.TableMetadata
+		if err := json.Unmarshal(data, &t); err != nil {
+			return err
+		}
+		filterPartsByPartitionsFilter(t, partitionsFilter.ForTable(t.Database, t.Table))
+		result = addTableToListIfNotExists(result, t)
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 	result.Sort(dropTable)
+	logMatchedTables(tablePattern, result.names())
 	return result, nil
 }
 
 func filterPartsByPartitionsFilter(tableMetadata metadata.TableMetadata, partitionsFilter common.EmptyMap) {
 	if len(partitionsFilter) > 0 {
 		for disk, parts := range tableMetadata.Parts {
-			for i, part := range parts {
-				if !filesystemhelper.IsPartInPartition(part.Name, partitionsFilter) {
-					parts = append(parts[:i], parts[i+1:]...)
+			filtered := make([]metadata.Part, 0, len(parts))
+			for _, part := range parts {
+				if filesystemhelper.IsPartInPartition(part.Name, partitionsFilter) {
+					filtered = append(filtered, part)
 				}
 			}
-			tableMetadata.Parts[disk] = parts
+			tableMetadata.Parts[disk] = filtered
 		}
 	}
 }
 
 func getTableListByPatternRemote(b *Backuper, remoteBackupMetadata *metadata.BackupMetadata, tablePattern string, dropTable bool) (ListOfTables, error) {
 	result := ListOfTables{}
-	tablePatterns := []string{"*"}
-
-	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
-	}
+	tp := common.NewTablePattern(tablePattern, b.cfg.ClickHouse.SkipTables)
 	metadataPath := path.Join(remoteBackupMetadata.BackupName, "metadata")
 	for _, t := range remoteBackupMetadata.Tables {
-		tableName := fmt.Sprintf("%s.%s", t.Database, t.Table)
-		for _, p := range tablePatterns {
-			if matched, _ := filepath.Match(strings.Trim(p, " \t\r\n"), tableName); !matched {
-				continue
-			}
-			tmReader, err := b.dst.GetFileReader(path.Join(metadataPath, common.TablePathEncode(t.Database), fmt.Sprintf("%s.json", common.TablePathEncode(t.Table))))
-			if err != nil {
-				return nil, err
-			}
-			data, err := io.ReadAll(tmReader)
-			if err != nil {
-				return nil, err
-			}
-			err = tmReader.Close()
-			if err != nil {
-				return nil, err
-			}
+		if !tp.Match(t.Database, t.Table) {
+			continue
+		}
+		tmReader, err := b.dst.GetFileReader(path.Join(metadataPath, common.TableMetadataPath(t.Database, t.Table)))
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(tmReader)
+		if err != nil {
+			return nil, err
+		}
+		err = tmReader.Close()
+		if err != nil {
+			return nil, err
+		}
 
-			var t metadata.TableMetadata
-			if err = json.Unmarshal(data, &t); err != nil {
-				return nil, err
-			}
-			result = addTableToListIfNotExists(result, t)
-			break
+		var t metadata.TableMetadata
+		if err = json.Unmarshal(data, &t); err != nil {
+			return nil, err
 		}
+		result = addTableToListIfNotExists(result, t)
 	}
 	result.Sort(dropTable)
+	logMatchedTables(tablePattern, result.names())
 	return result, nil
 }
 
@@ -183,20 +177,16 @@ func getOrderByEngine(query string, dropTable bool) int64 {
 	return 0
 }
 
-func parseTablePatternForDownload(tables []metadata.TableTitle, tablePattern string) []metadata.TableTitle {
-	tablePatterns := []string{"*"}
-	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
-	}
+func parseTablePatternForDownload(tables []metadata.TableTitle, tablePattern string, skipTables []string) []metadata.TableTitle {
+	tp := common.NewTablePattern(tablePattern, skipTables)
 	var result []metadata.TableTitle
+	var tableNames []string
 	for _, t := range tables {
-		for _, pattern := range tablePatterns {
-			tableName := fmt.Sprintf("%s.%s", t.Database, t.Table)
-			if matched, _ := filepath.Match(strings.Trim(pattern, " \t\r\n"), tableName); matched {
-				result = append(result, t)
-				break
-			}
+		if tp.Match(t.Database, t.Table) {
+			result = append(result, t)
+			tableNames = append(tableNames, fmt.Sprintf("%s.%s", t.Database, t.Table))
 		}
 	}
+	logMatchedTables(tablePattern, tableNames)
 	return result
 }
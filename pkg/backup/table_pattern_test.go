@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStorage - remote storage which keeps uploaded files in memory
+type memoryStorage struct {
+	sync.Mutex
+	files map[string][]byte
+}
+
+func (s *memoryStorage) Kind() string   { return "memory" }
+func (s *memoryStorage) Connect() error { return nil }
+func (s *memoryStorage) StatFile(key string) (new_storage.RemoteFile, error) {
+	s.Lock()
+	defer s.Unlock()
+	body, exists := s.files[key]
+	if !exists {
+		return nil, new_storage.ErrNotFound
+	}
+	return recordingFile{name: key, size: int64(len(body))}, nil
+}
+func (s *memoryStorage) DeleteFile(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, key)
+	return nil
+}
+func (s *memoryStorage) Walk(prefix string, recursive bool, fn func(new_storage.RemoteFile) error) error {
+	return nil
+}
+func (s *memoryStorage) GetFileReader(key string) (io.ReadCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+	body, exists := s.files[key]
+	if !exists {
+		return nil, new_storage.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+func (s *memoryStorage) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.files[key] = body
+	return nil
+}
+
+func TestSpecialTableNamesRoundTrip(t *testing.T) {
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.S3.CompressionFormat = "tar"
+	storage := &memoryStorage{files: map[string][]byte{}}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:             cfg,
+		dst:             dst,
+		DefaultDataPath: localPath,
+		DiskToPathMap:   map[string]string{"default": localPath},
+	}
+	names := []metadata.TableTitle{
+		{Database: "db.with.dots", Table: "table/with/slash"},
+		{Database: "db.with.dots", Table: "a+b"},
+		{Database: "default", Table: "a%2Eb"},
+		{Database: "default", Table: "a.b"},
+		{Database: "база", Table: "таблица-😀"},
+	}
+	for _, name := range names {
+		partPath := path.Join(localPath, "backup", "test_backup", "shadow", common.TablePath(name.Database, name.Table), "default", "all_1_1_0")
+		assert.NoError(t, os.MkdirAll(partPath, 0750))
+		assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte(name.Database+"."+name.Table), 0640))
+		table := metadata.TableMetadata{
+			Database: name.Database,
+			Table:    name.Table,
+			Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+		}
+		_, _, err := b.uploadTable(context.Background(), "test_backup", &table, false, true)
+		assert.NoError(t, err)
+	}
+	var keys []string
+	for key := range storage.files {
+		keys = append(keys, key)
+		assert.NotContains(t, strings.TrimPrefix(key, "test_backup/"), "..")
+	}
+	sort.Strings(keys)
+	assert.Len(t, keys, len(names)*2, "each table shall have own data and metadata keys: %v", keys)
+
+	assert.NoError(t, os.RemoveAll(path.Join(localPath, "backup")))
+	remoteBackup := metadata.BackupMetadata{BackupName: "test_backup", DataFormat: "tar", Tables: names}
+	for _, name := range parseTablePatternForDownload(names, "", nil) {
+		tableMetadata, _, err := b.downloadTableMetadata("test_backup", apexLog.WithField("operation", "test"), name, false, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, name.Database, tableMetadata.Database)
+		assert.Equal(t, name.Table, tableMetadata.Table)
+		assert.NoError(t, b.downloadTableData(remoteBackup, *tableMetadata))
+		data, err := ioutil.ReadFile(path.Join(localPath, "backup", "test_backup", "shadow", common.TablePath(name.Database, name.Table), "default", "all_1_1_0", "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, name.Database+"."+name.Table, string(data))
+	}
+
+	tables, err := getTableListByPatternLocal(path.Join(localPath, "backup", "test_backup", "metadata"), "db.with.dots.*", nil, false, nil)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"db.with.dots.table/with/slash", "db.with.dots.a+b"}, tables.names())
+	tables, err = getTableListByPatternRemote(b, &remoteBackup, "*", false)
+	assert.NoError(t, err)
+	assert.Len(t, tables, len(names))
+}
+
+func TestPartitionsScopedBackupMetadata(t *testing.T) {
+	backupPath := path.Join(t.TempDir(), "test_backup")
+	assert.NoError(t, os.MkdirAll(backupPath, 0750))
+	uid, gid := os.Getuid(), os.Getgid()
+	ch := &clickhouse.ClickHouse{}
+	ch.SetUid(&uid)
+	ch.SetGid(&gid)
+	partitions := filesystemhelper.CreatePartitionsToBackupMap([]string{"default.t1:202302,202301"})
+	parts := map[string][]metadata.Part{"default": {{Name: "202301_1_1_0"}, {Name: "202302_2_2_0"}, {Name: "202303_3_3_0"}}}
+	for _, table := range []string{"t1", "t2"} {
+		_, err := createMetadata(ch, backupPath, metadata.TableMetadata{
+			Database:   "default",
+			Table:      table,
+			Parts:      parts,
+			Partitions: tablePartitionsList(partitions.ForTable("default", table), true),
+		})
+		assert.NoError(t, err)
+	}
+	assert.Nil(t, tablePartitionsList(partitions.ForTable("default", "t1"), false), "schema only backup shall not record partitions")
+
+	tables, err := getTableListByPatternLocal(path.Join(backupPath, "metadata"), "*", nil, false, nil)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 2)
+	for _, table := range tables {
+		if table.Table == "t1" {
+			assert.Equal(t, []string{"202301", "202302"}, table.Partitions)
+		} else {
+			assert.Empty(t, table.Partitions)
+		}
+	}
+
+	tables, err = getTableListByPatternLocal(path.Join(backupPath, "metadata"), "*", nil, false, filesystemhelper.CreatePartitionsToBackupMap([]string{"default.t1:202301,202303"}))
+	assert.NoError(t, err)
+	for _, table := range tables {
+		var names []string
+		for _, part := range table.Parts["default"] {
+			names = append(names, part.Name)
+		}
+		if table.Table == "t1" {
+			assert.Equal(t, []string{"202301_1_1_0", "202303_3_3_0"}, names)
+		} else {
+			assert.Equal(t, []string{"202301_1_1_0", "202302_2_2_0", "202303_3_3_0"}, names, "restore filter for other table shall not change parts")
+		}
+	}
+
+	_, err = tables[0].Save(path.Join(backupPath, "saved.json"), false)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadFile(path.Join(backupPath, "saved.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"partitions"`)
+}
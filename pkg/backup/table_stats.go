@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// tableStatsTopN - count of the slowest and the largest tables in `done` log line of create and upload
+const tableStatsTopN = 3
+
+// tableStatsRecorder - stats of tables of running create and upload, they are returned by /backup/status while command is running
+type tableStatsRecorder struct {
+	sync.Mutex
+	tables map[metadata.TableTitle]metadata.TableStats
+	order  []metadata.TableTitle
+}
+
+func newTableStatsRecorder() *tableStatsRecorder {
+	return &tableStatsRecorder{tables: map[metadata.TableTitle]metadata.TableStats{}}
+}
+
+// set - publish current stats of table, upload keeps stats of create of the same table
+func (r *tableStatsRecorder) set(stats metadata.TableStats) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	title := metadata.TableTitle{Database: stats.Database, Table: stats.Table}
+	if _, exists := r.tables[title]; !exists {
+		r.order = append(r.order, title)
+	}
+	r.tables[title] = stats
+}
+
+// list - stats of tables in order of their first set
+func (r *tableStatsRecorder) list() []metadata.TableStats {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	stats := make([]metadata.TableStats, len(r.order))
+	for i, title := range r.order {
+		stats[i] = r.tables[title]
+	}
+	return stats
+}
+
+// TableStats - stats of tables processed by current create or upload
+func (b *Backuper) TableStats() []metadata.TableStats {
+	return b.tableStats.list()
+}
+
+// uploadTableStats - stats of create of table from its local metadata with duration and size of upload,
+// uncompressed size of backups created before stats were added is calculated from size of table on disks
+func uploadTableStats(table metadata.TableMetadata, duration time.Duration, uploadedBytes int64) *metadata.TableStats {
+	stats := metadata.TableStats{Database: table.Database, Table: table.Table}
+	if table.Stats != nil {
+		stats = *table.Stats
+	}
+	if stats.UncompressedSize == 0 {
+		for _, size := range table.Size {
+			stats.UncompressedSize += uint64(size)
+		}
+	}
+	stats.UploadMs = duration.Milliseconds()
+	stats.CompressedSize = uint64(uploadedBytes)
+	return &stats
+}
+
+// collectTableStats - stats of tables which have them for metadata.json
+func collectTableStats(tables ListOfTables) []metadata.TableStats {
+	var stats []metadata.TableStats
+	for _, table := range tables {
+		if table.Stats != nil {
+			stats = append(stats, *table.Stats)
+		}
+	}
+	return stats
+}
+
+// tableStatsFields - the slowest and the largest tables for `done` log line, empty when there are no stats
+func tableStatsFields(stats []metadata.TableStats, duration, size func(metadata.TableStats) int64) apexLog.Fields {
+	fields := apexLog.Fields{}
+	if slowest := topTables(stats, duration, formatMs); slowest != "" {
+		fields["slowest_tables"] = slowest
+	}
+	if largest := topTables(stats, size, formatSize); largest != "" {
+		fields["largest_tables"] = largest
+	}
+	return fields
+}
+
+// topTables - `db.table (value)` of tableStatsTopN tables with the biggest non-zero value
+func topTables(stats []metadata.TableStats, value func(metadata.TableStats) int64, format func(int64) string) string {
+	sorted := make([]metadata.TableStats, 0, len(stats))
+	for _, s := range stats {
+		if value(s) > 0 {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return value(sorted[i]) > value(sorted[j])
+	})
+	if len(sorted) > tableStatsTopN {
+		sorted = sorted[:tableStatsTopN]
+	}
+	top := make([]string, len(sorted))
+	for i, s := range sorted {
+		top[i] = fmt.Sprintf("%s.%s (%s)", s.Database, s.Table, format(value(s)))
+	}
+	return strings.Join(top, ", ")
+}
+
+func formatMs(ms int64) string {
+	return utils.HumanizeDuration(time.Duration(ms) * time.Millisecond)
+}
+
+func formatSize(size int64) string {
+	return utils.FormatBytes(uint64(size))
+}
+
+func createDuration(s metadata.TableStats) int64 {
+	return s.FreezeMs + s.CopyMs
+}
+
+func uploadDuration(s metadata.TableStats) int64 {
+	return s.UploadMs
+}
+
+func uncompressedSize(s metadata.TableStats) int64 {
+	return int64(s.UncompressedSize)
+}
+
+func compressedSize(s metadata.TableStats) int64 {
+	return int64(s.CompressedSize)
+}
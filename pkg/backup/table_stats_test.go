@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableStatsRecorder(t *testing.T) {
+	r := newTableStatsRecorder()
+	r.set(metadata.TableStats{Database: "db", Table: "b", FreezeMs: 10})
+	r.set(metadata.TableStats{Database: "db", Table: "a", FreezeMs: 20})
+	r.set(metadata.TableStats{Database: "db", Table: "b", FreezeMs: 10, UploadMs: 30})
+	assert.Equal(t, []metadata.TableStats{
+		{Database: "db", Table: "b", FreezeMs: 10, UploadMs: 30},
+		{Database: "db", Table: "a", FreezeMs: 20},
+	}, r.list())
+
+	var disabled *tableStatsRecorder
+	disabled.set(metadata.TableStats{Database: "db", Table: "a"})
+	assert.Nil(t, disabled.list())
+}
+
+func TestTableStatsFields(t *testing.T) {
+	stats := []metadata.TableStats{
+		{Database: "db", Table: "a", FreezeMs: 1000, CopyMs: 500, UncompressedSize: 1024},
+		{Database: "db", Table: "b", FreezeMs: 30000, UncompressedSize: 10},
+		{Database: "db", Table: "c", CopyMs: 2000, UncompressedSize: 1024 * 1024},
+		{Database: "db", Table: "d", FreezeMs: 100},
+		{Database: "db", Table: "empty"},
+	}
+	assert.Equal(t, apexLog.Fields{
+		"slowest_tables": "db.b (30s), db.c (2s), db.a (1.5s)",
+		"largest_tables": "db.c (1.00MiB), db.a (1.00KiB), db.b (10B)",
+	}, tableStatsFields(stats, createDuration, uncompressedSize))
+	assert.Equal(t, apexLog.Fields{}, tableStatsFields(stats, uploadDuration, compressedSize))
+	assert.Equal(t, apexLog.Fields{}, tableStatsFields(nil, createDuration, uncompressedSize))
+}
+
+func TestUploadTableStats(t *testing.T) {
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.S3.CompressionFormat = "tar"
+	storage := &recordingStorage{localPath: localPath, sizes: map[string]int64{}}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:           cfg,
+		dst:           dst,
+		DiskToPathMap: map[string]string{"default": localPath},
+		tableStats:    newTableStatsRecorder(),
+	}
+	var tables []metadata.TableMetadata
+	for _, name := range []string{"created", "old"} {
+		partPath := path.Join(localPath, "backup", "test_backup", "shadow", "default", name, "default", "all_1_1_0")
+		assert.NoError(t, os.MkdirAll(partPath, 0750))
+		assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte(name), 0640))
+		tables = append(tables, metadata.TableMetadata{
+			Database: "default",
+			Table:    name,
+			Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+			Size:     map[string]int64{"default": 7},
+		})
+	}
+	// table from backup which was created before stats were added has no stats
+	tables[0].Stats = &metadata.TableStats{Database: "default", Table: "created", FreezeMs: 5, CopyMs: 6, UncompressedSize: 4}
+	for i := range tables {
+		uploadedBytes, _, err := b.uploadTable(context.Background(), "test_backup", &tables[i], false, false)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(uploadedBytes), tables[i].Stats.CompressedSize)
+		assert.Equal(t, storage.sizes["test_backup/shadow/default/"+tables[i].Table+"/default_all_1_1_0.tar"], uploadedBytes)
+	}
+	assert.Equal(t, int64(5), tables[0].Stats.FreezeMs, "stats of create shall be kept")
+	assert.Equal(t, int64(6), tables[0].Stats.CopyMs)
+	assert.Equal(t, uint64(4), tables[0].Stats.UncompressedSize)
+	assert.Equal(t, uint64(7), tables[1].Stats.UncompressedSize, "uncompressed size shall be taken from table size")
+	assert.Equal(t, []metadata.TableStats{*tables[0].Stats, *tables[1].Stats}, b.TableStats())
+	assert.Equal(t, []metadata.TableStats{*tables[0].Stats, *tables[1].Stats}, collectTableStats(append(ListOfTables(tables), metadata.TableMetadata{Table: "without_stats"})))
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	apexLog "github.com/apex/log"
+)
+
+// ErrTableTimeout - table wasn't processed during timeout_per_table
+var ErrTableTimeout = errors.New("timeout_per_table exceeded")
+
+// ErrCancelled - create or upload was interrupted by CancelOperations
+var ErrCancelled = errors.New("operation is cancelled")
+
+// operationsCtx - parent of run contexts, it is cancelled by CancelOperations, runningOperations counts run contexts which aren't released yet
+var operationsCtx, cancelOperations = context.WithCancel(context.Background())
+var runningOperations int32
+
+// CancelOperations - cancel running and further create and upload, they stop copying tables, clean up and return ErrCancelled,
+// return false when nothing which could be cancelled is running
+func CancelOperations() bool {
+	cancelOperations()
+	return atomic.LoadInt32(&runningOperations) > 0
+}
+
+// tableTimeouts - parsed timeout_per_table and run_timeout, zero means no timeout
+type tableTimeouts struct {
+	perTable    time.Duration
+	run         time.Duration
+	failOnTable bool
+}
+
+func newTableTimeouts(cfg *config.Config) (tableTimeouts, error) {
+	perTable, err := time.ParseDuration(cfg.General.TimeoutPerTable)
+	if err != nil {
+		return tableTimeouts{}, fmt.Errorf("can't parse timeout_per_table: %v", err)
+	}
+	run, err := time.ParseDuration(cfg.General.RunTimeout)
+	if err != nil {
+		return tableTimeouts{}, fmt.Errorf("can't parse run_timeout: %v", err)
+	}
+	return tableTimeouts{perTable: perTable, run: run, failOnTable: cfg.General.FailOnTableTimeout}, nil
+}
+
+// runContext - context for whole create or upload with run_timeout deadline, it is done by CancelOperations too
+func (t tableTimeouts) runContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(operationsCtx)
+	if t.run > 0 {
+		ctx, cancel = context.WithTimeout(operationsCtx, t.run)
+	}
+	atomic.AddInt32(&runningOperations, 1)
+	return ctx, func() {
+		cancel()
+		atomic.AddInt32(&runningOperations, -1)
+	}
+}
+
+// runError - error when run_timeout was exceeded or operation was cancelled before all tables were processed
+func (t tableTimeouts) runError(runCtx context.Context) error {
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("run_timeout %s exceeded", t.run)
+	}
+	if operationsCtx.Err() != nil && runCtx.Err() != nil {
+		return ErrCancelled
+	}
+	return nil
+}
+
+// runTable - run f for one table with timeout_per_table deadline, when deadline exceeded return ErrTableTimeout without waiting f,
+// f keeps running in background until blocked clickhouse or remote storage call returns, so f shall check ctx before each next step
+func (t tableTimeouts) runTable(ctx context.Context, f func(ctx context.Context) error) error {
+	tableCtx, cancel := ctx, context.CancelFunc(func() {})
+	if t.perTable > 0 {
+		tableCtx, cancel = context.WithTimeout(ctx, t.perTable)
+	}
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- f(tableCtx)
+	}()
+	select {
+	case err := <-done:
+		// f could fail by cancelled tableCtx before select noticed it
+		if err == nil || tableCtx.Err() == nil {
+			return err
+		}
+	case <-tableCtx.Done():
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w after %s", ErrTableTimeout, t.perTable)
+}
+
+// checkTableError - skip table timeout error when fail_on_table_timeout is disabled, timed out table shall be excluded from backup by caller
+func (t tableTimeouts) checkTableError(log *apexLog.Entry, err error) error {
+	if errors.Is(err, ErrTableTimeout) && !t.failOnTable {
+		log.Errorf("%v, table is excluded from backup", err)
+		return nil
+	}
+	return err
+}
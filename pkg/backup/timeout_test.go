@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTableTimeout(t *testing.T) {
+	timeouts := tableTimeouts{perTable: 50 * time.Millisecond, failOnTable: true}
+	assert.NoError(t, timeouts.runTable(context.Background(), func(ctx context.Context) error { return nil }))
+	assert.EqualError(t, timeouts.runTable(context.Background(), func(ctx context.Context) error { return errors.New("broken table") }), "broken table")
+
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	err := timeouts.runTable(context.Background(), func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrTableTimeout))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "stuck table shall be abandoned")
+	assert.Equal(t, err, timeouts.checkTableError(apexLog.WithField("table", "default.slow"), err))
+	timeouts.failOnTable = false
+	assert.NoError(t, timeouts.checkTableError(apexLog.WithField("table", "default.slow"), err))
+
+	// table which fails by own context right at the deadline is timed out too
+	err = timeouts.runTable(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.True(t, errors.Is(err, ErrTableTimeout))
+
+	// cancelled run is not a table timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = timeouts.runTable(ctx, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	timeouts = tableTimeouts{run: 50 * time.Millisecond}
+	runCtx, cancelRun := timeouts.runContext()
+	defer cancelRun()
+	assert.NoError(t, timeouts.runError(runCtx))
+	<-runCtx.Done()
+	assert.EqualError(t, timeouts.runError(runCtx), "run_timeout 50ms exceeded")
+}
+
+func TestCancelOperations(t *testing.T) {
+	defer func() { operationsCtx, cancelOperations = context.WithCancel(context.Background()) }()
+	timeouts := tableTimeouts{perTable: time.Minute}
+	runCtx, cancelRun := timeouts.runContext()
+	assert.NoError(t, timeouts.runError(runCtx))
+	assert.True(t, CancelOperations())
+	err := timeouts.runTable(runCtx, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, ErrCancelled, timeouts.runError(runCtx))
+	cancelRun()
+	assert.False(t, CancelOperations(), "nothing is running after run context is released")
+}
+
+func TestNewTableTimeouts(t *testing.T) {
+	cfg := config.DefaultConfig()
+	timeouts, err := newTableTimeouts(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, tableTimeouts{failOnTable: true}, timeouts)
+	cfg.General.TimeoutPerTable = "1m"
+	cfg.General.RunTimeout = "bad"
+	_, err = newTableTimeouts(cfg)
+	assert.Error(t, err)
+}
+
+// slowStorage - memoryStorage where upload of keys with slowPrefix blocks until release is closed
+type slowStorage struct {
+	memoryStorage
+	slowPrefix string
+	release    chan struct{}
+}
+
+func (s *slowStorage) PutFile(key string, r io.ReadCloser) error {
+	if strings.HasPrefix(key, s.slowPrefix) {
+		<-s.release
+	}
+	return s.memoryStorage.PutFile(key, r)
+}
+
+func (s *slowStorage) exists(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, exists := s.files[key]
+	return exists
+}
+
+func TestUploadTablesTimeout(t *testing.T) {
+	for _, failOnTable := range []bool{false, true} {
+		localPath := t.TempDir()
+		cfg := config.DefaultConfig()
+		cfg.General.RemoteStorage = "s3"
+		cfg.General.UploadConcurrency = 2
+		cfg.S3.CompressionFormat = "tar"
+		storage := &slowStorage{memoryStorage: memoryStorage{files: map[string][]byte{}}, slowPrefix: "test_backup/shadow/default/slow/", release: make(chan struct{})}
+		dst, err := new_storage.NewBackupDestination(cfg)
+		assert.NoError(t, err)
+		dst.RemoteStorage = storage
+		b := &Backuper{
+			cfg:           cfg,
+			dst:           dst,
+			DiskToPathMap: map[string]string{"default": localPath},
+		}
+		var tables ListOfTables
+		for _, name := range []string{"slow", "fast"} {
+			partPath := path.Join(localPath, "backup", "test_backup", "shadow", "default", name, "default", "all_1_1_0")
+			assert.NoError(t, os.MkdirAll(partPath, 0750))
+			assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte(name), 0640))
+			tables = append(tables, metadata.TableMetadata{
+				Database: "default",
+				Table:    name,
+				Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+			})
+		}
+		timeouts := tableTimeouts{perTable: 100 * time.Millisecond, failOnTable: failOnTable}
+		start := time.Now()
+		uploaded, _, _, err := b.uploadTables("test_backup", tables, false, true, timeouts)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "stuck table shall not stall whole upload")
+		if failOnTable {
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), ErrTableTimeout.Error())
+		} else {
+			assert.NoError(t, err)
+			assert.Len(t, uploaded, 1)
+			assert.Equal(t, "fast", uploaded[0].Table)
+			assert.True(t, storage.exists("test_backup/metadata/default/fast.json"))
+		}
+		// abandoned table shall not get metadata and shall keep local data after stuck upload continues
+		close(storage.release)
+		assert.Never(t, func() bool {
+			return storage.exists("test_backup/metadata/default/slow.json")
+		}, 200*time.Millisecond, 10*time.Millisecond)
+		_, err = os.Stat(path.Join(localPath, "backup", "test_backup", "shadow", "default", "slow", "default", "all_1_1_0", "data.bin"))
+		assert.NoError(t, err)
+	}
+}
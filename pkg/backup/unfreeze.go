@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	apexLog "github.com/apex/log"
+)
+
+// minSystemUnfreezeVersion - SYSTEM UNFREEZE WITH NAME is available since ClickHouse 22.1
+const minSystemUnfreezeVersion = 22001000
+
+type unfreezer interface {
+	GetVersion() (int, error)
+	Query(query string, args ...interface{}) (sql.Result, error)
+}
+
+// releaseFreezes - ClickHouse keeps bookkeeping of FREEZE WITH NAME until SYSTEM UNFREEZE, it is issued for each freeze name of uploaded tables,
+// failures don't fail upload, server could be too old or have `enable_system_unfreeze` disabled
+func releaseFreezes(ch unfreezer, tables ListOfTables, log *apexLog.Entry) {
+	var freezeNames []string
+	for _, table := range tables {
+		if table.FreezeName != "" {
+			freezeNames = append(freezeNames, table.FreezeName)
+		}
+	}
+	releaseFreezeNames(ch, freezeNames, log)
+}
+
+// releaseFreezeNames - SYSTEM UNFREEZE for each unique freeze name, it is used directly when create failed and tables metadata is not written
+func releaseFreezeNames(ch unfreezer, freezeNames []string, log *apexLog.Entry) {
+	unique := map[string]bool{}
+	for _, name := range freezeNames {
+		unique[name] = true
+	}
+	if len(unique) == 0 {
+		return
+	}
+	version, err := ch.GetVersion()
+	if err != nil {
+		log.Warnf("can't get clickhouse version, skip SYSTEM UNFREEZE: %v", err)
+		return
+	}
+	if version < minSystemUnfreezeVersion {
+		log.Debugf("clickhouse version %d doesn't support SYSTEM UNFREEZE, skip it", version)
+		return
+	}
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := ch.Query(fmt.Sprintf("SYSTEM UNFREEZE WITH NAME '%s'", name)); err != nil {
+			log.Warnf("can't release freeze '%s', SYSTEM UNFREEZE failed: %v", name, err)
+			return
+		}
+	}
+	log.Debugf("%d freezes released", len(names))
+}
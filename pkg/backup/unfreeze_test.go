@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUnfreezer - records queries, queries fail when err is set
+type fakeUnfreezer struct {
+	version int
+	err     error
+	queries []string
+}
+
+func (f *fakeUnfreezer) GetVersion() (int, error) {
+	return f.version, nil
+}
+
+func (f *fakeUnfreezer) Query(query string, args ...interface{}) (sql.Result, error) {
+	f.queries = append(f.queries, query)
+	return nil, f.err
+}
+
+func TestReleaseFreezes(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "default", Table: "t2", FreezeName: "uuid2"},
+		{Database: "default", Table: "t1", FreezeName: "uuid1"},
+		{Database: "default", Table: "schema_only", MetadataOnly: true},
+	}
+	log := apexLog.WithField("test", t.Name())
+
+	ch := &fakeUnfreezer{version: 22003001}
+	releaseFreezes(ch, tables, log)
+	assert.Equal(t, []string{"SYSTEM UNFREEZE WITH NAME 'uuid1'", "SYSTEM UNFREEZE WITH NAME 'uuid2'"}, ch.queries)
+
+	ch = &fakeUnfreezer{version: 21008001}
+	releaseFreezes(ch, tables, log)
+	assert.Empty(t, ch.queries, "old clickhouse doesn't support SYSTEM UNFREEZE")
+
+	ch = &fakeUnfreezer{version: 22003001}
+	releaseFreezes(ch, ListOfTables{{Database: "default", Table: "t", MetadataOnly: true}}, log)
+	assert.Empty(t, ch.queries, "backup without data has no freezes")
+
+	ch = &fakeUnfreezer{version: 22003001, err: fmt.Errorf("code: 344, message: Support for SYSTEM UNFREEZE query is disabled")}
+	releaseFreezes(ch, append(tables, metadata.TableMetadata{Database: "default", Table: "t3", FreezeName: "uuid3"}), log)
+	assert.Equal(t, []string{"SYSTEM UNFREEZE WITH NAME 'uuid1'"}, ch.queries, "disabled SYSTEM UNFREEZE is tried once")
+}
+
+func TestReleaseFreezeNamesAfterFailedCreate(t *testing.T) {
+	log := apexLog.WithField("test", t.Name())
+	ch := &fakeUnfreezer{version: 22003001}
+	// tables frozen in parallel before failure of other table, table which failed after FREEZE is released too
+	releaseFreezeNames(ch, []string{"uuid3", "uuid1", "uuid2", "uuid1"}, log)
+	assert.Equal(t, []string{"SYSTEM UNFREEZE WITH NAME 'uuid1'", "SYSTEM UNFREEZE WITH NAME 'uuid2'", "SYSTEM UNFREEZE WITH NAME 'uuid3'"}, ch.queries)
+
+	ch = &fakeUnfreezer{version: 22003001}
+	releaseFreezeNames(ch, nil, log)
+	assert.Empty(t, ch.queries, "nothing was frozen before failure")
+}
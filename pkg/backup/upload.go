@@ -9,8 +9,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,50 +20,83 @@ import (
 	"golang.org/x/sync/semaphore"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
-	apexLog "github.com/apex/log"
 	"github.com/yargevad/filepathx"
 )
 
-func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern string, partitions []string, schemaOnly bool) error {
+// Upload - upload local backup to remote storage, when deleteSource is true, local data of each table is deleted right after the table was uploaded,
+// when resume is true, tables which were completely uploaded by interrupted upload of the same backup are skipped
+func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern string, partitions []string, schemaOnly, deleteSource, resume bool) (err error) {
+	startUpload := time.Now()
+	defer func() { logBackupOperation(b.cfg, "upload", backupName, startUpload, err) }()
 	if err := b.validateUploadParams(backupName, diffFrom, diffFromRemote); err != nil {
 		return err
 	}
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "upload",
-	})
-	startUpload := time.Now()
+	log := operationLog(b.OperationID, backupName, "upload")
+	timeouts, err := newTableTimeouts(b.cfg)
+	if err != nil {
+		return err
+	}
 	if err := b.ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+		return fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer b.ch.Close()
 	if err := b.init(); err != nil {
 		return err
 	}
 	if _, err := getLocalBackup(b.cfg, backupName); err != nil {
-		return fmt.Errorf("can't upload: %v", err)
+		return fmt.Errorf("can't upload: %w", err)
 	}
+	// lock protects backup from deletion by min_free_space_percent and max_local_backup_size_bytes of concurrent create
+	unlock, err := lockBackup(path.Join(b.DefaultDataPath, "backup"), backupName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	backupType := "full"
+	if diffFrom != "" || diffFromRemote != "" {
+		backupType = "incremental"
+	}
+	b.dst.SetObjectTags(map[string]string{
+		"created-by":  "clickhouse-backup",
+		"backup-name": backupName,
+		"backup-type": backupType,
+	})
 	remoteBackups, err := b.dst.BackupList(false, "")
 	if err != nil {
 		return err
 	}
 	for i := range remoteBackups {
 		if backupName == remoteBackups[i].BackupName {
-			return fmt.Errorf("'%s' already exists on remote", backupName)
+			// interrupted upload leaves backup without metadata.json
+			if resume && remoteBackups[i].Broken != "" {
+				log.Infof("resume upload of '%s' which is %s", backupName, remoteBackups[i].Broken)
+				continue
+			}
+			return fmt.Errorf("'%s' already exists on remote: %w", backupName, ErrBackupIsAlreadyExists)
 		}
 	}
 	backupMetadata, err := b.ReadBackupMetadataLocal(backupName)
 	if err != nil {
 		return err
 	}
+	// backup created by `create --changed-since` contains parts which are uploaded only as part of its required backup
+	if backupMetadata.RequiredBackup != "" && diffFrom == "" && diffFromRemote == "" && !isUploadedBackup(remoteBackups, backupMetadata.RequiredBackup) {
+		return fmt.Errorf("'%s' requires parts from '%s' which isn't uploaded to remote storage, upload it first", backupName, backupMetadata.RequiredBackup)
+	}
+	if backupMetadata.SchemaOnly && !schemaOnly {
+		log.Info("schema-only backup, data upload will be skipped")
+		schemaOnly = true
+	}
 	var tablesForUpload ListOfTables
 	partitionsToUploadMap := filesystemhelper.CreatePartitionsToBackupMap(partitions)
 	if len(backupMetadata.Tables) != 0 {
 		metadataPath := path.Join(b.DefaultDataPath, "backup", backupName, "metadata")
-		tablesForUpload, err = getTableListByPatternLocal(metadataPath, tablePattern, false, partitionsToUploadMap)
+		tablesForUpload, err = getTableListByPatternLocal(metadataPath, tablePattern, b.cfg.ClickHouse.SkipTables, false, partitionsToUploadMap)
 		if err != nil {
 			return err
 		}
@@ -80,57 +115,57 @@ func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern str
 		}
 	}
 
-	compressedDataSize := int64(0)
-	metadataSize := int64(0)
-
-	log.Debugf("prepare table concurrent semaphore with concurrency=%d len(tablesForUpload)=%d", b.cfg.General.UploadConcurrency, len(tablesForUpload))
-	s := semaphore.NewWeighted(int64(b.cfg.General.UploadConcurrency))
-	g, ctx := errgroup.WithContext(context.Background())
-
-	for i, table := range tablesForUpload {
-		if err := s.Acquire(ctx, 1); err != nil {
-			log.Errorf("can't acquire semaphore during Upload: %v", err)
-			break
-		}
-		start := time.Now()
-		if !schemaOnly {
+	if !schemaOnly {
+		for i := range tablesForUpload {
 			if diffTable, diffExists := tablesForUploadFromDiff[metadata.TableTitle{
-				Database: table.Database,
-				Table:    table.Table,
+				Database: tablesForUpload[i].Database,
+				Table:    tablesForUpload[i].Table,
 			}]; diffExists {
 				checkLocalPart := diffFrom != "" && diffFromRemote == ""
-				b.markDuplicatedParts(backupMetadata, &diffTable, &table, checkLocalPart)
+				b.markDuplicatedParts(backupMetadata, &diffTable, &tablesForUpload[i], checkLocalPart)
 			}
 		}
-		idx := i
-		g.Go(func() error {
-			defer s.Release(1)
-			var uploadedBytes int64
-			if !schemaOnly {
-				var files map[string][]string
-				var err error
-				files, uploadedBytes, err = b.uploadTableData(backupName, tablesForUpload[idx])
-				if err != nil {
+	}
+	allTablesForUpload := tablesForUpload
+	resumedTables := map[metadata.TableTitle]metadata.TableMetadata{}
+	var resumedDataSize, resumedMetadataSize int64
+	if resume {
+		if resumedTables, tablesForUpload, resumedDataSize, resumedMetadataSize, err = b.splitUploadedTables(backupName, tablesForUpload, schemaOnly); err != nil {
+			return err
+		}
+		log.Infof("%d tables were uploaded before, %d tables left", len(resumedTables), len(tablesForUpload))
+		if deleteSource && !schemaOnly {
+			for _, table := range resumedTables {
+				if err := b.deleteTableLocalData(backupName, table); err != nil {
 					return err
 				}
-				atomic.AddInt64(&compressedDataSize, uploadedBytes)
-				tablesForUpload[idx].Files = files
 			}
-			tableMetadataSize, err := b.uploadTableMetadata(backupName, tablesForUpload[idx])
-			if err != nil {
+		}
+	}
+	if b.cfg.General.ReferenceParts && !schemaOnly && b.cfg.General.UploadByPart && b.cfg.GetCompressionFormat() != "none" {
+		backupList, err := b.dst.BackupList(true, "")
+		if err != nil {
+			return err
+		}
+		references := newPartReferences(backupList, backupName)
+		for i := range tablesForUpload {
+			if err := b.referenceParts(references, &tablesForUpload[i]); err != nil {
 				return err
 			}
-			atomic.AddInt64(&metadataSize, tableMetadataSize)
-			log.
-				WithField("table", fmt.Sprintf("%s.%s", tablesForUpload[idx].Database, tablesForUpload[idx].Table)).
-				WithField("duration", utils.HumanizeDuration(time.Since(start))).
-				WithField("size", utils.FormatBytes(uint64(uploadedBytes+tableMetadataSize))).
-				Info("done")
-			return nil
-		})
+		}
 	}
-	if err := g.Wait(); err != nil {
-		return fmt.Errorf("one of upload go-routine return error: %v", err)
+	if !schemaOnly {
+		b.progress.Start(!b.cfg.General.DisableProgressBar, uploadProgressTotal(tablesForUpload))
+		defer b.progress.Finish()
+	}
+	tablesForUpload, compressedDataSize, metadataSize, err := b.uploadTables(backupName, tablesForUpload, schemaOnly, deleteSource, timeouts)
+	if err != nil {
+		return err
+	}
+	if resume {
+		tablesForUpload = mergeUploadedTables(allTablesForUpload, resumedTables, tablesForUpload)
+		compressedDataSize += resumedDataSize
+		metadataSize += resumedMetadataSize
 	}
 
 	// upload rbac for backup
@@ -145,6 +180,8 @@ func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern str
 
 	// upload metadata for backup
 	backupMetadata.CompressedSize = uint64(compressedDataSize)
+	backupMetadata.SharedParts = sharedPartKeys(tablesForUpload)
+	backupMetadata.ReferencedBackups = referencedBackups(tablesForUpload)
 	backupMetadata.MetadataSize = uint64(metadataSize)
 	tt := make([]metadata.TableTitle, len(tablesForUpload))
 	for i := range tablesForUpload {
@@ -154,6 +191,12 @@ func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern str
 		}
 	}
 	backupMetadata.Tables = tt
+	backupMetadata.TableStats = collectTableStats(tablesForUpload)
+	if schemaOnly {
+		backupMetadata.SchemaOnly = true
+		backupMetadata.DataSize = 0
+		backupMetadata.TableStats = nil
+	}
 	if b.cfg.GetCompressionFormat() != "none" {
 		backupMetadata.DataFormat = b.cfg.GetCompressionFormat()
 	} else {
@@ -166,22 +209,103 @@ func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern str
 	remoteBackupMetaFile := path.Join(backupName, "metadata.json")
 	if err = b.dst.PutFile(remoteBackupMetaFile,
 		ioutil.NopCloser(bytes.NewReader(newBackupMetadataBody))); err != nil {
-		return fmt.Errorf("can't upload: %v", err)
+		return fmt.Errorf("can't upload: %w", err)
 	}
-	log.
+	if err = b.dst.PutManifest(backupName); err != nil {
+		return err
+	}
+	summary := tableStatsFields(backupMetadata.TableStats, uploadDuration, compressedSize)
+	if transferred, ratio := b.progress.Transferred(); transferred > 0 {
+		summary["transferred"] = utils.FormatBytes(uint64(transferred))
+		summary["compression_ratio"] = fmt.Sprintf("%.2f", ratio)
+	}
+	log.WithFields(summary).
 		WithField("duration", utils.HumanizeDuration(time.Since(startUpload))).
 		WithField("size", utils.FormatBytes(uint64(compressedDataSize)+uint64(metadataSize)+uint64(len(newBackupMetadataBody))+backupMetadata.RBACSize+backupMetadata.ConfigSize)).
 		Info("done")
+	releaseFreezes(b.ch, allTablesForUpload, log)
 
 	// Clean
 	if err = b.dst.RemoveOldBackups(b.cfg.General.BackupsToKeepRemote); err != nil {
-		return fmt.Errorf("can't remove old backups on remote storage: %v", err)
+		return fmt.Errorf("can't remove old backups on remote storage: %w", err)
 	}
 	return nil
 }
 
+// uploadTables - upload data and metadata of tables concurrently, return uploaded tables,
+// tables which exceeded timeout_per_table are not returned when fail_on_table_timeout is disabled
+func (b *Backuper) uploadTables(backupName string, tablesForUpload ListOfTables, schemaOnly, deleteSource bool, timeouts tableTimeouts) (ListOfTables, int64, int64, error) {
+	log := operationLog(b.OperationID, backupName, "upload")
+	compressedDataSize := int64(0)
+	metadataSize := int64(0)
+
+	log.Debugf("prepare table concurrent semaphore with concurrency=%d len(tablesForUpload)=%d", b.cfg.General.UploadConcurrency, len(tablesForUpload))
+	s := semaphore.NewWeighted(int64(b.cfg.General.UploadConcurrency))
+	runCtx, cancelRun := timeouts.runContext()
+	defer cancelRun()
+	g, ctx := errgroup.WithContext(runCtx)
+	// keep_failed_backups postpones deletion of local data until all tables are uploaded, so failed upload leaves local backup intact
+	deleteAfterUpload := deleteSource && !schemaOnly && b.cfg.General.KeepFailedBackups
+	uploaded := make([]bool, len(tablesForUpload))
+	for i := range tablesForUpload {
+		if err := s.Acquire(ctx, 1); err != nil {
+			log.Errorf("can't acquire semaphore during Upload: %v", err)
+			break
+		}
+		start := time.Now()
+		idx := i
+		g.Go(func() error {
+			defer s.Release(1)
+			log := log.WithField("table", fmt.Sprintf("%s.%s", tablesForUpload[idx].Database, tablesForUpload[idx].Table))
+			// abandoned upload of timed out table keeps changing own copy only
+			table := tablesForUpload[idx]
+			var uploadedBytes, tableMetadataSize int64
+			err := timeouts.runTable(ctx, func(ctx context.Context) error {
+				var err error
+				uploadedBytes, tableMetadataSize, err = b.uploadTable(ctx, backupName, &table, schemaOnly, deleteSource && !deleteAfterUpload)
+				return err
+			})
+			if err != nil {
+				return timeouts.checkTableError(log, err)
+			}
+			tablesForUpload[idx] = table
+			uploaded[idx] = true
+			atomic.AddInt64(&compressedDataSize, uploadedBytes)
+			atomic.AddInt64(&metadataSize, tableMetadataSize)
+			log.
+				WithField("duration", utils.HumanizeDuration(time.Since(start))).
+				WithField("size", utils.FormatBytes(uint64(uploadedBytes+tableMetadataSize))).
+				Info("done")
+			return nil
+		})
+	}
+	err := g.Wait()
+	if runErr := timeouts.runError(runCtx); runErr != nil {
+		err = runErr
+	}
+	if err != nil {
+		cleanupFailedBackup(b.cfg, path.Join(b.DefaultDataPath, "backup", backupName), log, func() error { return nil })
+		return nil, 0, 0, fmt.Errorf("one of upload go-routine return error: %w", err)
+	}
+	var uploadedTables ListOfTables
+	for i := range tablesForUpload {
+		if uploaded[i] {
+			uploadedTables = append(uploadedTables, tablesForUpload[i])
+			if deleteAfterUpload {
+				if err := b.deleteTableLocalData(backupName, tablesForUpload[i]); err != nil {
+					return nil, 0, 0, err
+				}
+			}
+		}
+	}
+	return uploadedTables, compressedDataSize, metadataSize, nil
+}
+
 func (b *Backuper) getTablesForUploadDiffLocal(diffFrom string, backupMetadata *metadata.BackupMetadata, tablePattern string) (tablesForUploadFromDiff map[metadata.TableTitle]metadata.TableMetadata, err error) {
 	tablesForUploadFromDiff = make(map[metadata.TableTitle]metadata.TableMetadata)
+	if err := checkRequiredBackupConflict(backupMetadata, diffFrom); err != nil {
+		return nil, err
+	}
 	diffFromBackup, err := b.ReadBackupMetadataLocal(diffFrom)
 	if err != nil {
 		return nil, err
@@ -190,7 +314,7 @@ func (b *Backuper) getTablesForUploadDiffLocal(diffFrom string, backupMetadata *
 		backupMetadata.RequiredBackup = diffFrom
 		metadataPath := path.Join(b.DefaultDataPath, "backup", diffFrom, "metadata")
 		// empty partitionsToBackupMap, cause we can not filter
-		diffTablesList, err := getTableListByPatternLocal(metadataPath, tablePattern, false, common.EmptyMap{})
+		diffTablesList, err := getTableListByPatternLocal(metadataPath, tablePattern, b.cfg.ClickHouse.SkipTables, false, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -220,9 +344,21 @@ func (b *Backuper) getTablesForUploadDiffRemote(diffFromRemote string, backupMet
 			break
 		}
 	}
+	if diffRemoteMetadata == nil && isLatestBackupAlias(diffFromRemote) {
+		if backupList, err = b.dst.BackupList(true, ""); err != nil {
+			return nil, err
+		}
+		if diffRemoteMetadata = latestRemoteBackup(backupList, backupMetadata.BackupName); diffRemoteMetadata != nil {
+			b.logger().Infof("use '%s' as diff-from-remote", diffRemoteMetadata.BackupName)
+			diffFromRemote = diffRemoteMetadata.BackupName
+		}
+	}
 	if diffRemoteMetadata == nil {
 		return nil, fmt.Errorf("%s not found on remote storage", diffFromRemote)
 	}
+	if err := checkRequiredBackupConflict(backupMetadata, diffFromRemote); err != nil {
+		return nil, err
+	}
 
 	if len(diffRemoteMetadata.Tables) != 0 {
 		backupMetadata.RequiredBackup = diffFromRemote
@@ -240,23 +376,58 @@ func (b *Backuper) getTablesForUploadDiffRemote(diffFromRemote string, backupMet
 	return tablesForUploadFromDiff, nil
 }
 
+// checkRequiredBackupConflict - parts of backup created by `create --changed-since` are required from its reference backup, so it can be an increment only of the same backup
+func checkRequiredBackupConflict(backupMetadata *metadata.BackupMetadata, diffFrom string) error {
+	if backupMetadata.RequiredBackup != "" && backupMetadata.RequiredBackup != diffFrom {
+		return fmt.Errorf("'%s' was created with --changed-since '%s' and can't be uploaded as increment of '%s'", backupMetadata.BackupName, backupMetadata.RequiredBackup, diffFrom)
+	}
+	return nil
+}
+
+// isUploadedBackup - backup exists on remote storage and its upload was finished
+func isUploadedBackup(backupList []new_storage.Backup, backupName string) bool {
+	for _, backup := range backupList {
+		if backup.BackupName == backupName && backup.Broken == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isLatestBackupAlias - `latest` and `last` refer to the most recent backup, the same as in `list` command
+func isLatestBackupAlias(backupName string) bool {
+	return backupName == "latest" || backupName == "last"
+}
+
+// latestRemoteBackup - return most recent remote backup which could be used as diff-from-remote source
+func latestRemoteBackup(backupList []new_storage.Backup, exclude string) *metadata.BackupMetadata {
+	var latest *metadata.BackupMetadata
+	for i := range backupList {
+		backup := &backupList[i]
+		if backup.Legacy || backup.Broken != "" || backup.BackupName == exclude {
+			continue
+		}
+		if latest == nil || backup.CreationDate.After(latest.CreationDate) {
+			latest = &backup.BackupMetadata
+		}
+	}
+	return latest
+}
+
 func (b *Backuper) validateUploadParams(backupName string, diffFrom string, diffFromRemote string) error {
 	if b.cfg.General.RemoteStorage == "none" {
 		return fmt.Errorf("general->remote_storage shall not be \"none\", change you config or use REMOTE_STORAGE environment variable")
 	}
 	if backupName == "" {
-		_ = PrintLocalBackups(b.cfg, "all")
+		_ = PrintLocalBackups(b.cfg, "", "all", "", false, false, BackupDateWindow{})
 		return fmt.Errorf("select backup for upload")
 	}
-	if backupName == diffFrom || backupName == diffFromRemote {
-		return fmt.Errorf("you cannot upload diff from the same backup")
+	if err := (UploadOptions{DiffFrom: diffFrom, DiffFromRemote: diffFromRemote}).Validate(backupName); err != nil {
+		return err
 	}
 	if diffFromRemote != "" && b.cfg.General.UploadByPart == false {
 		return fmt.Errorf("`--diff-from-remote` require `upload_by_part` equal true in `general` config section")
 	}
-	if diffFrom != "" && diffFromRemote != "" {
-		return fmt.Errorf("choose setup only `--diff-from-remote` or `--diff-from`, not both")
-	}
 	if b.cfg.GetCompressionFormat() == "none" && !b.cfg.General.UploadByPart {
 		return fmt.Errorf("%s->`compression_format`=%s incompatible with general->upload_by_part=%v", b.cfg.General.RemoteStorage, b.cfg.GetCompressionFormat(), b.cfg.General.UploadByPart)
 	}
@@ -286,123 +457,396 @@ func (b *Backuper) uploadAndArchiveBackupRelatedDir(localBackupRelatedDir, local
 	var localFiles []string
 	var err error
 	if localFiles, err = filepathx.Glob(localFilesGlobPattern); err != nil || localFiles == nil || len(localFiles) == 0 {
-		return 0, fmt.Errorf("list %s return list=%v with err=%v", localFilesGlobPattern, localFiles, err)
+		return 0, fmt.Errorf("list %s return list=%v with err=%w", localFilesGlobPattern, localFiles, err)
 	}
 	for i := range localFiles {
 		localFiles[i] = strings.Replace(localFiles[i], localBackupRelatedDir, "", 1)
 	}
 
 	if err := b.dst.CompressedStreamUpload(localBackupRelatedDir, localFiles, remoteFile); err != nil {
-		return 0, fmt.Errorf("can't RBAC upload: %v", err)
+		return 0, fmt.Errorf("can't RBAC upload: %w", err)
 	}
 	remoteUploaded, err := b.dst.StatFile(remoteFile)
 	if err != nil {
-		return 0, fmt.Errorf("can't check uploaded %s file: %v", remoteFile, err)
+		return 0, fmt.Errorf("can't check uploaded %s file: %w", remoteFile, err)
 	}
 	return uint64(remoteUploaded.Size()), nil
 }
 
-func (b *Backuper) uploadTableData(backupName string, table metadata.TableMetadata) (map[string][]string, int64, error) {
-	dbAndTablePath := path.Join(common.TablePathEncode(table.Database), common.TablePathEncode(table.Table))
+func (b *Backuper) uploadTableData(backupName string, table metadata.TableMetadata) (map[string][]string, map[string][]string, map[string]int64, int64, error) {
+	dbAndTablePath := common.TablePath(table.Database, table.Table)
 	metadataFiles := map[string][]string{}
+	archiveParts := map[string][]string{}
+	archiveSizes := map[string]int64{}
+	var archivePartsLock sync.Mutex
 	capacity := 0
 	for disk := range table.Parts {
 		capacity += len(table.Parts[disk])
 	}
-	apexLog.Debugf("start uploadTableData %s.%s with concurrency=%d len(table.Parts[...])=%d", table.Database, table.Table, b.cfg.General.UploadConcurrency, capacity)
+	b.logger().Debugf("start uploadTableData %s.%s with concurrency=%d len(table.Parts[...])=%d", table.Database, table.Table, b.cfg.General.UploadConcurrency, capacity)
+	dst := b.tableDestination(table)
+	archiveExtension := tableArchiveExtension(table, b.cfg.GetArchiveExtension())
 	s := semaphore.NewWeighted(int64(b.cfg.General.UploadConcurrency))
 	g, ctx := errgroup.WithContext(context.Background())
 	var uploadedBytes int64
 	for disk := range table.Parts {
 		backupPath := path.Join(b.DiskToPathMap[disk], "backup", backupName, "shadow", dbAndTablePath, disk)
-		parts, err := b.splitPartFiles(backupPath, table.Parts[disk])
+		diskParts := table.Parts[disk]
+		if b.cfg.General.DedupParts && b.cfg.GetCompressionFormat() != "none" {
+			var sharedParts []int
+			diskParts, sharedParts = splitSharedParts(table.Parts[disk])
+			for _, i := range sharedParts {
+				if err := s.Acquire(ctx, 1); err != nil {
+					b.logger().Errorf("can't acquire semaphore during Upload: %v", err)
+					break
+				}
+				// SharedKey is saved into table.Parts which share underlying arrays with caller, so it will be written into table metadata
+				part := &table.Parts[disk][i]
+				part.SharedKey = new_storage.SharedPartKey(part.HashOfAllFiles, archiveExtension)
+				partPath := path.Join(backupPath, part.Name)
+				g.Go(func() error {
+					defer s.Release(1)
+					partFiles, err := listPartFiles(partPath)
+					if err != nil {
+						return err
+					}
+					uploaded, remoteSize, err := dst.CompressedStreamUploadShared(partPath, partFiles, part.SharedKey)
+					if err != nil {
+						return fmt.Errorf("can't upload shared part %s: %w", part.SharedKey, err)
+					}
+					if !uploaded {
+						b.logger().Debugf("part %s already exists as %s, skip upload", partPath, part.SharedKey)
+					}
+					atomic.AddInt64(&uploadedBytes, remoteSize)
+					return nil
+				})
+			}
+		}
+		parts, err := b.splitPartFiles(backupPath, diskParts)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, nil, 0, err
 		}
 		for partSuffix, partFiles := range parts {
 			if err := s.Acquire(ctx, 1); err != nil {
-				apexLog.Errorf("can't acquire semaphore during Upload: %v", err)
+				b.logger().Errorf("can't acquire semaphore during Upload: %v", err)
 				break
 			}
-			baseRemoteDataPath := path.Join(backupName, "shadow", common.TablePathEncode(table.Database), common.TablePathEncode(table.Table))
+			baseRemoteDataPath := path.Join(backupName, "shadow", common.TablePath(table.Database, table.Table))
 			if b.cfg.GetCompressionFormat() == "none" {
 				localPath := path.Join(backupPath, partSuffix)
 				remotePath := path.Join(baseRemoteDataPath, disk, partSuffix)
+				localFiles := partFiles
 				g.Go(func() error {
 					defer s.Release(1)
-					apexLog.Debugf("start upload %d files to %s", len(partFiles), remotePath)
-					if err := b.dst.UploadPath(0, localPath, partFiles, remotePath); err != nil {
-						apexLog.Errorf("UploadPath return error: %v", err)
-						return fmt.Errorf("can't upload: %v", err)
+					b.logger().Debugf("start upload %d files to %s", len(localFiles), remotePath)
+					if err := b.dst.UploadPath(localPath, localFiles, remotePath); err != nil {
+						b.logger().Errorf("UploadPath return error: %v", err)
+						return fmt.Errorf("can't upload: %w", err)
 					}
-					apexLog.Debugf("finish upload %d files to %s", len(partFiles), remotePath)
+					b.logger().Debugf("finish upload %d files to %s", len(localFiles), remotePath)
 					return nil
 				})
 			} else {
-				fileName := fmt.Sprintf("%s_%s.%s", disk, common.TablePathEncode(partSuffix), b.cfg.GetArchiveExtension())
+				fileName := fmt.Sprintf("%s_%s.%s", disk, common.TablePathEncode(partSuffix), archiveExtension)
 				metadataFiles[disk] = append(metadataFiles[disk], fileName)
 				remoteDataFile := path.Join(baseRemoteDataPath, fileName)
 				localFiles := partFiles
 				g.Go(func() error {
 					defer s.Release(1)
-					apexLog.Debugf("start upload %d files to %s", len(localFiles), remoteDataFile)
-					if err := b.dst.CompressedStreamUpload(backupPath, localFiles, remoteDataFile); err != nil {
-						apexLog.Errorf("CompressedStreamUpload return error: %v", err)
-						return fmt.Errorf("can't upload: %v", err)
-					}
-					remoteFile, err := b.dst.StatFile(remoteDataFile)
+					b.logger().Debugf("start upload %d files to %s", len(localFiles), remoteDataFile)
+					remoteParts, remoteSize, err := dst.CompressedStreamUploadParts(backupPath, localFiles, remoteDataFile)
 					if err != nil {
-						return fmt.Errorf("can't check uploaded file: %v", err)
+						b.logger().Errorf("CompressedStreamUploadParts return error: %v", err)
+						return fmt.Errorf("can't upload: %w", err)
 					}
-					atomic.AddInt64(&uploadedBytes, remoteFile.Size())
-					apexLog.Debugf("finish upload to %s", remoteDataFile)
+					archivePartsLock.Lock()
+					for _, remotePart := range remoteParts {
+						archiveParts[fileName] = append(archiveParts[fileName], path.Base(remotePart))
+					}
+					archiveSizes[fileName] = remoteSize
+					archivePartsLock.Unlock()
+					atomic.AddInt64(&uploadedBytes, remoteSize)
+					b.logger().Debugf("finish upload to %s", remoteDataFile)
 					return nil
 				})
 			}
 		}
 	}
 	if err := g.Wait(); err != nil {
-		return nil, 0, fmt.Errorf("one of uploadTableData go-routine return error: %v", err)
+		return nil, nil, nil, 0, fmt.Errorf("one of uploadTableData go-routine return error: %w", err)
+	}
+	b.logger().Debugf("finish uploadTableData %s.%s with concurrency=%d len(table.Parts[...])=%d metadataFiles=%v, uploadedBytes=%v", table.Database, table.Table, b.cfg.General.UploadConcurrency, capacity, metadataFiles, uploadedBytes)
+	if len(archiveParts) == 0 {
+		archiveParts = nil
+	}
+	if len(archiveSizes) == 0 {
+		archiveSizes = nil
+	}
+	return metadataFiles, archiveParts, archiveSizes, uploadedBytes, nil
+}
+
+// uploadTable - upload data and metadata of one table, when deleteSource is true, local data of table is deleted only after successful upload,
+// local table metadata is kept, it is required for restore schema and for upload again
+func (b *Backuper) uploadTable(ctx context.Context, backupName string, table *metadata.TableMetadata, schemaOnly, deleteSource bool) (int64, int64, error) {
+	var uploadedBytes int64
+	if !schemaOnly {
+		if format, _ := b.cfg.GetTableCompression(table.Database, table.Table); format != "" {
+			table.CompressionFormat = format
+		}
+		startUpload := time.Now()
+		files, archiveParts, archiveSizes, remoteSize, err := b.uploadTableData(backupName, *table)
+		if err != nil {
+			return 0, 0, err
+		}
+		uploadedBytes = remoteSize
+		table.Files = files
+		table.ArchiveParts = archiveParts
+		table.ArchiveSizes = archiveSizes
+		if len(table.DetachedParts) > 0 {
+			detachedArchiveParts, detachedArchiveSizes, detachedSize, err := b.uploadTableDetached(backupName, *table)
+			if err != nil {
+				return 0, 0, err
+			}
+			uploadedBytes += detachedSize
+			for archive, remoteParts := range detachedArchiveParts {
+				if table.ArchiveParts == nil {
+					table.ArchiveParts = map[string][]string{}
+				}
+				table.ArchiveParts[archive] = remoteParts
+			}
+			for archive, size := range detachedArchiveSizes {
+				if table.ArchiveSizes == nil {
+					table.ArchiveSizes = map[string]int64{}
+				}
+				table.ArchiveSizes[archive] = size
+			}
+		}
+		table.Stats = uploadTableStats(*table, time.Since(startUpload), uploadedBytes)
+		b.tableStats.set(*table.Stats)
+	}
+	// table which exceeded timeout_per_table is excluded from backup, so it shall not get metadata and shall keep local data
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
 	}
-	apexLog.Debugf("finish uploadTableData %s.%s with concurrency=%d len(table.Parts[...])=%d metadataFiles=%v, uploadedBytes=%v", table.Database, table.Table, b.cfg.General.UploadConcurrency, capacity, metadataFiles, uploadedBytes)
-	return metadataFiles, uploadedBytes, nil
+	tableMetadataSize, err := b.uploadTableMetadata(backupName, *table)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	if deleteSource && !schemaOnly {
+		if err := b.deleteTableLocalData(backupName, *table); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uploadedBytes, tableMetadataSize, nil
+}
+
+// uploadTableDetached - upload detached parts of table, each disk is uploaded as one archive `detached/<table>/<disk>.<ext>` or as directory for `none` compression,
+// return names of archive parts for archives which were split by max_archive_size and sizes of archives, they are keyed by archive name with `detached/` prefix
+func (b *Backuper) uploadTableDetached(backupName string, table metadata.TableMetadata) (map[string][]string, map[string]int64, int64, error) {
+	baseRemotePath := path.Join(backupName, "detached", common.TablePath(table.Database, table.Table))
+	archiveParts := map[string][]string{}
+	archiveSizes := map[string]int64{}
+	var uploadedBytes int64
+	for disk, parts := range table.DetachedParts {
+		localPath := path.Join(b.DiskToPathMap[disk], "backup", backupName, "detached", common.TablePath(table.Database, table.Table), disk)
+		var localFiles []string
+		for _, part := range parts {
+			partFiles, err := listPartFiles(path.Join(localPath, part.Name))
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			for _, partFile := range partFiles {
+				localFiles = append(localFiles, path.Join(part.Name, partFile))
+			}
+		}
+		if b.cfg.GetCompressionFormat() == "none" {
+			if err := b.dst.UploadPath(localPath, localFiles, path.Join(baseRemotePath, disk)); err != nil {
+				return nil, nil, 0, fmt.Errorf("can't upload detached parts: %w", err)
+			}
+			continue
+		}
+		archiveName := detachedArchiveName(disk, tableArchiveExtension(table, b.cfg.GetArchiveExtension()))
+		remoteParts, remoteSize, err := b.tableDestination(table).CompressedStreamUploadParts(localPath, localFiles, path.Join(baseRemotePath, path.Base(archiveName)))
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("can't upload detached parts: %w", err)
+		}
+		for _, remotePart := range remoteParts {
+			archiveParts[archiveName] = append(archiveParts[archiveName], path.Base(remotePart))
+		}
+		archiveSizes[archiveName] = remoteSize
+		uploadedBytes += remoteSize
+	}
+	return archiveParts, archiveSizes, uploadedBytes, nil
+}
+
+// tableDestination - remote storage which compresses archives of table by format from general.table_compression, other tables use global compression
+func (b *Backuper) tableDestination(table metadata.TableMetadata) *new_storage.BackupDestination {
+	if table.CompressionFormat == "" {
+		return b.dst
+	}
+	_, level := b.cfg.GetTableCompression(table.Database, table.Table)
+	return b.dst.WithCompression(table.CompressionFormat, level)
+}
+
+// tableArchiveExtension - extension of table archives, defaultExtension is used when compression format wasn't overridden for table
+func tableArchiveExtension(table metadata.TableMetadata, defaultExtension string) string {
+	if table.CompressionFormat == "" {
+		return defaultExtension
+	}
+	return config.ArchiveExtensions[table.CompressionFormat]
+}
+
+// detachedArchiveName - key of detached parts archive in table ArchiveParts, `detached/` prefix separates it from archives of table.Files
+func detachedArchiveName(disk, extension string) string {
+	return path.Join("detached", fmt.Sprintf("%s.%s", disk, extension))
+}
+
+// deleteTableLocalData - remove data of uploaded table from local backup on all disks
+func (b *Backuper) deleteTableLocalData(backupName string, table metadata.TableMetadata) error {
+	dbAndTablePath := common.TablePath(table.Database, table.Table)
+	for disk := range table.DetachedParts {
+		detachedLocalDir := path.Join(b.DiskToPathMap[disk], "backup", backupName, "detached", dbAndTablePath, disk)
+		if err := os.RemoveAll(detachedLocalDir); err != nil {
+			return fmt.Errorf("can't delete uploaded detached parts %s: %w", detachedLocalDir, err)
+		}
+		_ = os.Remove(path.Dir(detachedLocalDir))
+	}
+	for disk := range table.Parts {
+		tableLocalDir := path.Join(b.DiskToPathMap[disk], "backup", backupName, "shadow", dbAndTablePath, disk)
+		if err := os.RemoveAll(tableLocalDir); err != nil {
+			return fmt.Errorf("can't delete uploaded data %s: %w", tableLocalDir, err)
+		}
+		// table folder is shared between disks with the same path, so it is removed only when empty
+		_ = os.Remove(path.Dir(tableLocalDir))
+		b.logger().WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).Debugf("delete uploaded data %s", tableLocalDir)
+	}
+	return nil
+}
+
+// splitSharedParts - return parts which shall be uploaded as usual and indexes of parts which could be uploaded as content-addressed archives, they have checksums.txt hash,
+// aren't required from diff backup and aren't referenced from other backup
+func splitSharedParts(parts []metadata.Part) ([]metadata.Part, []int) {
+	var regularParts []metadata.Part
+	var sharedParts []int
+	for i := range parts {
+		if !parts[i].Required && parts[i].RefKey == "" && parts[i].HashOfAllFiles != "" {
+			sharedParts = append(sharedParts, i)
+			continue
+		}
+		regularParts = append(regularParts, parts[i])
+	}
+	return regularParts, sharedParts
+}
+
+// listPartFiles - return regular files of part relative to partPath
+func listPartFiles(partPath string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(partPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		files = append(files, strings.TrimPrefix(filePath, partPath+"/"))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list files in %s: %w", partPath, err)
+	}
+	return files, nil
+}
+
+// sharedPartKeys - return sorted unique keys of content-addressed archives referenced by tables
+func sharedPartKeys(tables ListOfTables) []string {
+	keys := map[string]struct{}{}
+	for _, table := range tables {
+		for _, parts := range table.Parts {
+			for _, part := range parts {
+				if part.SharedKey != "" {
+					keys[part.SharedKey] = struct{}{}
+				}
+			}
+		}
+	}
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	if len(result) == 0 {
+		return nil
+	}
+	return result
 }
 
 func (b *Backuper) uploadTableMetadata(backupName string, table metadata.TableMetadata) (int64, error) {
 	tableMetafile := table
 	content, err := json.MarshalIndent(&tableMetafile, "", "\t")
 	if err != nil {
-		return 0, fmt.Errorf("can't marshal json: %v", err)
+		return 0, fmt.Errorf("can't marshal json: %w", err)
 	}
-	remoteTableMetaFile := path.Join(backupName, "metadata", common.TablePathEncode(table.Database), fmt.Sprintf("%s.%s", common.TablePathEncode(table.Table), "json"))
+	remoteTableMetaFile := path.Join(backupName, "metadata", common.TableMetadataPath(table.Database, table.Table))
 	if err := b.dst.PutFile(remoteTableMetaFile,
 		ioutil.NopCloser(bytes.NewReader(content))); err != nil {
-		return 0, fmt.Errorf("can't upload: %v", err)
+		return 0, fmt.Errorf("can't upload: %w", err)
 	}
 	return int64(len(content)), nil
 }
 
+// uploadProgressTotal - bytes which will be read from local disks during upload, parts required from diff backup and referenced parts are skipped
+func uploadProgressTotal(tables ListOfTables) int64 {
+	var total int64
+	for _, table := range tables {
+		if table.MetadataOnly {
+			continue
+		}
+		for _, size := range table.Size {
+			total += size
+		}
+		for _, parts := range table.Parts {
+			for _, part := range parts {
+				if part.Required || part.RefKey != "" {
+					total -= part.Size
+				}
+			}
+		}
+	}
+	if total < 0 {
+		return 0
+	}
+	return total
+}
+
 func (b *Backuper) markDuplicatedParts(backup *metadata.BackupMetadata, existsTable *metadata.TableMetadata, newTable *metadata.TableMetadata, checkLocal bool) {
 	for disk, newParts := range newTable.Parts {
 		if _, diskExists := existsTable.Parts[disk]; diskExists {
 			if len(existsTable.Parts[disk]) == 0 {
 				continue
 			}
-			existsPartsMap := common.EmptyMap{}
+			existsPartsMap := map[string]metadata.Part{}
 			for _, p := range existsTable.Parts[disk] {
-				existsPartsMap[p.Name] = struct{}{}
+				existsPartsMap[p.Name] = p
 			}
 			for i := range newParts {
-				if _, partExists := existsPartsMap[newParts[i].Name]; !partExists {
+				existsPart, partExists := existsPartsMap[newParts[i].Name]
+				if !partExists {
+					continue
+				}
+				if !checkLocal && !isSamePart(existsPart, newParts[i], b.cfg.General.DiffCompareMode == "hash") {
+					b.logger().Debugf("part '%s' on disk '%s' has different size or content in '%s'", newParts[i].Name, disk, backup.RequiredBackup)
 					continue
 				}
 				if checkLocal {
-					dbAndTablePath := path.Join(common.TablePathEncode(existsTable.Database), common.TablePathEncode(existsTable.Table))
+					dbAndTablePath := common.TablePath(existsTable.Database, existsTable.Table)
 					existsPath := path.Join(b.DiskToPathMap[disk], "backup", backup.RequiredBackup, "shadow", dbAndTablePath, disk, newParts[i].Name)
 					newPath := path.Join(b.DiskToPathMap[disk], "backup", backup.BackupName, "shadow", dbAndTablePath, disk, newParts[i].Name)
 
-					if err := filesystemhelper.IsDuplicatedParts(existsPath, newPath); err != nil {
-						apexLog.Debugf("part '%s' and '%s' must be the same: %v", existsPath, newPath, err)
+					if err := filesystemhelper.IsDuplicatedParts(existsPath, newPath, b.hashCache); err != nil {
+						b.logger().Debugf("part '%s' and '%s' must be the same: %v", existsPath, newPath, err)
 						continue
 					}
 				}
@@ -412,6 +856,20 @@ func (b *Backuper) markDuplicatedParts(backup *metadata.BackupMetadata, existsTa
 	}
 }
 
+// isSamePart - compare part from remote backup manifest with local part, size and checksums.txt hash are compared only when both backups contain it
+func isSamePart(existsPart, newPart metadata.Part, compareHash bool) bool {
+	if existsPart.Name != newPart.Name {
+		return false
+	}
+	if existsPart.Size > 0 && newPart.Size > 0 && existsPart.Size != newPart.Size {
+		return false
+	}
+	if compareHash && existsPart.HashOfAllFiles != "" && newPart.HashOfAllFiles != "" && existsPart.HashOfAllFiles != newPart.HashOfAllFiles {
+		return false
+	}
+	return true
+}
+
 func (b *Backuper) ReadBackupMetadataLocal(backupName string) (*metadata.BackupMetadata, error) {
 	backupMetadataPath := path.Join(b.DefaultDataPath, "backup", backupName, "metadata.json")
 	backupMetadataBody, err := ioutil.ReadFile(backupMetadataPath)
@@ -439,7 +897,7 @@ func (b *Backuper) splitPartFiles(basePath string, parts []metadata.Part) (map[s
 func (b *Backuper) splitFilesByName(basePath string, parts []metadata.Part) (map[string][]string, error) {
 	result := map[string][]string{}
 	for i := range parts {
-		if parts[i].Required {
+		if parts[i].Required || parts[i].RefKey != "" {
 			continue
 		}
 		var files []string
@@ -456,7 +914,7 @@ func (b *Backuper) splitFilesByName(basePath string, parts []metadata.Part) (map
 			return nil
 		})
 		if err != nil {
-			apexLog.Warnf("filepath.Walk return error: %v", err)
+			b.logger().Warnf("filepath.Walk return error: %v", err)
 		}
 		result[parts[i].Name] = files
 	}
@@ -493,7 +951,7 @@ func (b *Backuper) splitFilesBySize(basePath string, parts []metadata.Part) (map
 			return nil
 		})
 		if err != nil {
-			apexLog.Warnf("filepath.Walk return error: %v", err)
+			b.logger().Warnf("filepath.Walk return error: %v", err)
 		}
 	}
 	if len(files) > 0 {
@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+)
+
+// partReferences - finished remote backups which archives could be referenced by parts with the same name and checksum instead of upload them again
+type partReferences struct {
+	backups []metadata.BackupMetadata
+}
+
+// newPartReferences - backups from backupList except backupName, legacy, broken, schema-only and uncompressed backups, the newest backups are checked first
+func newPartReferences(backupList []new_storage.Backup, backupName string) *partReferences {
+	r := &partReferences{}
+	for _, backup := range backupList {
+		if backup.BackupName == backupName || backup.Legacy || backup.Broken != "" || backup.SchemaOnly || backup.DataFormat == "" || backup.DataFormat == "directory" {
+			continue
+		}
+		r.backups = append(r.backups, backup.BackupMetadata)
+	}
+	sort.SliceStable(r.backups, func(i, j int) bool {
+		return r.backups[i].CreationDate.After(r.backups[j].CreationDate)
+	})
+	return r
+}
+
+// referenceParts - set RefBackup and RefKey of parts which were uploaded by other backup as separate archive with the same name and checksum, such parts are not uploaded,
+// reference of other backup is copied as is, so RefKey is always archive of backup which uploaded the part and references are resolved transitively during upload,
+// parts required from diff backup and content-addressed parts are not referenced
+func (b *Backuper) referenceParts(references *partReferences, table *metadata.TableMetadata) error {
+	title := metadata.TableTitle{Database: table.Database, Table: table.Table}
+	archiveExtension := tableArchiveExtension(*table, b.cfg.GetArchiveExtension())
+	uploaded := map[string]metadata.Part{}
+	for _, backup := range references.backups {
+		if !containsTableTitle(backup.Tables, title) {
+			continue
+		}
+		remoteTable, err := b.readRemoteTableMetadata(backup.BackupName, title)
+		if err != nil {
+			return err
+		}
+		for disk, parts := range remoteTable.Parts {
+			files := map[string]bool{}
+			for _, file := range remoteTable.Files[disk] {
+				files[file] = true
+			}
+			for _, part := range parts {
+				key := path.Join(part.Name, part.HashOfAllFiles)
+				if _, exists := uploaded[key]; exists || part.HashOfAllFiles == "" || part.Required || part.SharedKey != "" {
+					continue
+				}
+				// archive of other compression format can't be downloaded as archive of this table
+				if part.RefKey != "" {
+					if strings.HasSuffix(part.RefKey, "."+archiveExtension) {
+						uploaded[key] = metadata.Part{RefBackup: part.RefBackup, RefKey: part.RefKey}
+					}
+					continue
+				}
+				fileName := fmt.Sprintf("%s_%s.%s", disk, common.TablePathEncode(part.Name), archiveExtension)
+				if files[fileName] {
+					uploaded[key] = metadata.Part{RefBackup: backup.BackupName, RefKey: path.Join(backup.BackupName, "shadow", common.TablePath(table.Database, table.Table), fileName)}
+				}
+			}
+		}
+	}
+	referenced := 0
+	for disk := range table.Parts {
+		for i := range table.Parts[disk] {
+			part := &table.Parts[disk][i]
+			if part.Required || part.HashOfAllFiles == "" {
+				continue
+			}
+			if ref, exists := uploaded[path.Join(part.Name, part.HashOfAllFiles)]; exists {
+				part.RefBackup, part.RefKey = ref.RefBackup, ref.RefKey
+				referenced++
+			}
+		}
+	}
+	if referenced > 0 {
+		b.logger().WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).Infof("%d parts are referenced from other backups and will not be uploaded", referenced)
+	}
+	return nil
+}
+
+// readRemoteTableMetadata - table metadata of other remote backup
+func (b *Backuper) readRemoteTableMetadata(backupName string, title metadata.TableTitle) (*metadata.TableMetadata, error) {
+	remoteTableMetadata := path.Join(backupName, "metadata", common.TableMetadataPath(title.Database, title.Table))
+	r, err := b.dst.GetFileReader(remoteTableMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", remoteTableMetadata, err)
+	}
+	body, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %v", remoteTableMetadata, err)
+	}
+	var table metadata.TableMetadata
+	if err := json.Unmarshal(body, &table); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", remoteTableMetadata, err)
+	}
+	return &table, nil
+}
+
+func containsTableTitle(tables []metadata.TableTitle, title metadata.TableTitle) bool {
+	for _, t := range tables {
+		if t == title {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedBackups - return sorted unique names of backups which archives are referenced by parts of tables
+func referencedBackups(tables ListOfTables) []string {
+	names := map[string]struct{}{}
+	for _, table := range tables {
+		for _, parts := range table.Parts {
+			for _, part := range parts {
+				if part.RefBackup != "" {
+					names[part.RefBackup] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReferenceParts - backups reference parts with the same checksum uploaded by other backups, download resolves references,
+// backups with referenced parts are kept by delete and retention
+func TestReferenceParts(t *testing.T) {
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.General.ReferenceParts = true
+	cfg.S3.CompressionFormat = "tar"
+	storage := &putRecordingStorage{memoryStorage: &memoryStorage{files: map[string][]byte{}}}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:             cfg,
+		dst:             dst,
+		DiskToPathMap:   map[string]string{"default": localPath},
+		DefaultDataPath: localPath,
+	}
+	timeouts, err := newTableTimeouts(cfg)
+	assert.NoError(t, err)
+	now := time.Now()
+	var remoteBackups []new_storage.Backup
+	// upload local backup with parts which have checksums, return uploaded table and remote backup with metadata which upload writes into metadata.json
+	upload := func(backupName string, parts map[string]string) metadata.TableMetadata {
+		table := metadata.TableMetadata{Database: "default", Table: "t", Parts: map[string][]metadata.Part{}}
+		for name, hash := range parts {
+			writeDetachedPart(t, path.Join(localPath, "backup", backupName, "shadow", common.TablePath("default", "t"), "default", name), "data of "+name)
+			table.Parts["default"] = append(table.Parts["default"], metadata.Part{Name: name, HashOfAllFiles: hash})
+		}
+		tables := ListOfTables{table}
+		assert.NoError(t, b.referenceParts(newPartReferences(remoteBackups, backupName), &tables[0]))
+		uploaded, _, _, err := b.uploadTables(backupName, tables, false, false, timeouts)
+		assert.NoError(t, err)
+		remoteBackups = append(remoteBackups, new_storage.Backup{BackupMetadata: metadata.BackupMetadata{
+			BackupName:        backupName,
+			CreationDate:      now.Add(time.Duration(len(remoteBackups)) * time.Minute),
+			Tables:            []metadata.TableTitle{{Database: "default", Table: "t"}},
+			DataFormat:        "tar",
+			ReferencedBackups: referencedBackups(uploaded),
+		}})
+		return uploaded[0]
+	}
+	partRefs := func(table metadata.TableMetadata) map[string]string {
+		refs := map[string]string{}
+		for _, part := range table.Parts["default"] {
+			refs[part.Name] = part.RefBackup
+		}
+		return refs
+	}
+
+	upload("full", map[string]string{"all_1_1_0": "aaa", "all_2_2_0": "bbb"})
+	storage.puts = nil
+	second := upload("second", map[string]string{"all_1_1_0": "aaa", "all_2_2_0": "changed", "all_3_3_0": "ccc"})
+	assert.Equal(t, map[string]string{"all_1_1_0": "full", "all_2_2_0": "", "all_3_3_0": ""}, partRefs(second), "part with other checksum is uploaded")
+	assert.NotContains(t, storage.puts, "second/shadow/default/t/default_all_1_1_0.tar")
+	assert.Contains(t, storage.puts, "second/shadow/default/t/default_all_3_3_0.tar")
+	assert.Equal(t, []string{"full"}, remoteBackups[1].ReferencedBackups)
+
+	// reference of `second` is resolved to `full` which uploaded the part
+	storage.puts = nil
+	third := upload("third", map[string]string{"all_1_1_0": "aaa", "all_3_3_0": "ccc"})
+	assert.Equal(t, map[string]string{"all_1_1_0": "full", "all_3_3_0": "second"}, partRefs(third))
+	assert.Equal(t, []string{"full", "second"}, remoteBackups[2].ReferencedBackups)
+	for _, key := range storage.puts {
+		assert.NotContains(t, key, "third/shadow/", "all parts of third are referenced")
+	}
+
+	downloadPath := t.TempDir()
+	d := &Backuper{cfg: cfg, dst: dst, DiskToPathMap: map[string]string{"default": downloadPath}}
+	assert.NoError(t, d.downloadTableData(remoteBackups[2].BackupMetadata, third))
+	for _, part := range []string{"all_1_1_0", "all_3_3_0"} {
+		content, err := ioutil.ReadFile(path.Join(downloadPath, "backup", "third", "shadow", common.TablePath("default", "t"), "default", part, "data.bin"))
+		assert.NoError(t, err, part)
+		assert.Equal(t, "data of "+part, string(content))
+	}
+
+	assert.Equal(t, []string{"second", "third"}, new_storage.ReferencedBy(remoteBackups, "full"))
+	assert.Equal(t, []string{"third"}, new_storage.ReferencedBy(remoteBackups, "second"))
+	assert.Empty(t, new_storage.ReferencedBy(remoteBackups, "third"))
+	selected, err := selectBackupsToDelete(remoteBackups, "", 30*time.Second, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, selected, "full and second are referenced by third which is kept")
+	assert.Empty(t, new_storage.GetBackupsToDelete(append([]new_storage.Backup{}, remoteBackups...), 1))
+}
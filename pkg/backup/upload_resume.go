@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+)
+
+// tableRemoteArchives - remote keys of all archives declared in table metadata keyed by archive name, split archive has key of each part,
+// shared parts are keyed by their remote key, archives are absent for `none` compression which uploads directories
+func tableRemoteArchives(backupName string, table metadata.TableMetadata, archiveExtension string) map[string][]string {
+	keys := map[string][]string{}
+	baseRemoteDataPath := path.Join(backupName, "shadow", common.TablePath(table.Database, table.Table))
+	for _, files := range table.Files {
+		for _, archiveFile := range files {
+			if archiveParts, ok := table.ArchiveParts[archiveFile]; ok {
+				for _, archivePart := range archiveParts {
+					keys[archiveFile] = append(keys[archiveFile], path.Join(baseRemoteDataPath, archivePart))
+				}
+				continue
+			}
+			keys[archiveFile] = []string{path.Join(baseRemoteDataPath, archiveFile)}
+		}
+	}
+	if archiveExtension != "" {
+		baseRemoteDetachedPath := path.Join(backupName, "detached", common.TablePath(table.Database, table.Table))
+		for disk := range table.DetachedParts {
+			archiveName := detachedArchiveName(disk, archiveExtension)
+			if archiveParts, ok := table.ArchiveParts[archiveName]; ok {
+				for _, archivePart := range archiveParts {
+					keys[archiveName] = append(keys[archiveName], path.Join(baseRemoteDetachedPath, archivePart))
+				}
+				continue
+			}
+			keys[archiveName] = []string{path.Join(baseRemoteDetachedPath, path.Base(archiveName))}
+		}
+	}
+	for _, parts := range table.Parts {
+		for _, part := range parts {
+			if part.SharedKey != "" {
+				keys[part.SharedKey] = []string{part.SharedKey}
+			}
+		}
+	}
+	return keys
+}
+
+// remoteUploadedTable - table metadata from remote storage and size of its archives, nil when table upload wasn't finished:
+// metadata is uploaded after all archives, so table is complete when its metadata and all archives declared in it exist,
+// archives of metadata with recorded sizes shall also have the same size, partially written file could remain on SFTP and FTP
+func (b *Backuper) remoteUploadedTable(backupName string, table metadata.TableMetadata, schemaOnly bool) (*metadata.TableMetadata, int64, int64, error) {
+	log := b.logger().WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table))
+	r, err := b.dst.GetFileReader(path.Join(backupName, "metadata", common.TableMetadataPath(table.Database, table.Table)))
+	if errors.Is(err, new_storage.ErrNotFound) {
+		log.Debug("metadata is absent on remote storage, table will be uploaded")
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	body, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var remoteTable metadata.TableMetadata
+	if err := json.Unmarshal(body, &remoteTable); err != nil {
+		log.Warnf("can't parse remote metadata, table will be uploaded again: %v", err)
+		return nil, 0, 0, nil
+	}
+	if schemaOnly {
+		return &remoteTable, 0, int64(len(body)), nil
+	}
+	var dataSize int64
+	for archive, keys := range tableRemoteArchives(backupName, remoteTable, tableArchiveExtension(remoteTable, b.cfg.GetArchiveExtension())) {
+		var archiveSize int64
+		for _, key := range keys {
+			remoteFile, err := b.dst.StatFile(key)
+			if errors.Is(err, new_storage.ErrNotFound) {
+				log.Infof("%s is absent on remote storage, table will be uploaded again", key)
+				return nil, 0, 0, nil
+			}
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			archiveSize += remoteFile.Size()
+		}
+		if expectedSize, ok := remoteTable.ArchiveSizes[archive]; ok && archiveSize != expectedSize {
+			log.Infof("%s has %d bytes on remote storage, expected %d, table will be uploaded again", archive, archiveSize, expectedSize)
+			return nil, 0, 0, nil
+		}
+		dataSize += archiveSize
+	}
+	return &remoteTable, dataSize, int64(len(body)), nil
+}
+
+// splitUploadedTables - tables which were completely uploaded by interrupted upload are returned with remote metadata, other tables shall be uploaded
+func (b *Backuper) splitUploadedTables(backupName string, tables ListOfTables, schemaOnly bool) (map[metadata.TableTitle]metadata.TableMetadata, ListOfTables, int64, int64, error) {
+	uploaded := map[metadata.TableTitle]metadata.TableMetadata{}
+	var pending ListOfTables
+	var dataSize, metadataSize int64
+	for _, table := range tables {
+		remoteTable, tableDataSize, tableMetadataSize, err := b.remoteUploadedTable(backupName, table, schemaOnly)
+		if err != nil {
+			return nil, nil, 0, 0, fmt.Errorf("can't check uploaded '%s.%s': %v", table.Database, table.Table, err)
+		}
+		if remoteTable == nil {
+			pending = append(pending, table)
+			continue
+		}
+		uploaded[metadata.TableTitle{Database: table.Database, Table: table.Table}] = *remoteTable
+		dataSize += tableDataSize
+		metadataSize += tableMetadataSize
+	}
+	return uploaded, pending, dataSize, metadataSize, nil
+}
+
+// mergeUploadedTables - tables from previous upload and tables uploaded now in order of tables list, tables which weren't uploaded are skipped
+func mergeUploadedTables(tables ListOfTables, resumed map[metadata.TableTitle]metadata.TableMetadata, uploaded ListOfTables) ListOfTables {
+	uploadedNow := map[metadata.TableTitle]metadata.TableMetadata{}
+	for _, table := range uploaded {
+		uploadedNow[metadata.TableTitle{Database: table.Database, Table: table.Table}] = table
+	}
+	var result ListOfTables
+	for _, table := range tables {
+		title := metadata.TableTitle{Database: table.Database, Table: table.Table}
+		if resumedTable, ok := resumed[title]; ok {
+			result = append(result, resumedTable)
+		} else if uploadedTable, ok := uploadedNow[title]; ok {
+			result = append(result, uploadedTable)
+		}
+	}
+	return result
+}
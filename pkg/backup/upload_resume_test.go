@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// putRecordingStorage - memoryStorage which records keys of uploaded files
+type putRecordingStorage struct {
+	*memoryStorage
+	puts []string
+}
+
+func (s *putRecordingStorage) PutFile(key string, r io.ReadCloser) error {
+	s.puts = append(s.puts, key)
+	return s.memoryStorage.PutFile(key, r)
+}
+
+func TestUploadResume(t *testing.T) {
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.General.UploadConcurrency = 1
+	storage := &putRecordingStorage{memoryStorage: &memoryStorage{files: map[string][]byte{}}}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:             cfg,
+		dst:             dst,
+		DiskToPathMap:   map[string]string{"default": localPath},
+		DefaultDataPath: localPath,
+	}
+	var tables ListOfTables
+	for _, name := range []string{"t1", "t2", "t3", "t4"} {
+		writeDetachedPart(t, path.Join(localPath, "backup", "test_backup", "shadow", common.TablePath("default", name), "default", "all_1_1_0"), "data of "+name)
+		tables = append(tables, metadata.TableMetadata{
+			Database: "default",
+			Table:    name,
+			Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+			Size:     map[string]int64{"default": 10},
+		})
+	}
+	timeouts, err := newTableTimeouts(cfg)
+	assert.NoError(t, err)
+
+	// upload died after 3 tables, archive of t2 was lost and metadata of t3 wasn't uploaded
+	_, _, _, err = b.uploadTables("test_backup", append(ListOfTables{}, tables[:3]...), false, false, timeouts)
+	assert.NoError(t, err)
+	for key := range storage.files {
+		if strings.HasPrefix(key, "test_backup/shadow/default/t2/") {
+			delete(storage.files, key)
+		}
+	}
+	delete(storage.files, "test_backup/metadata/default/t3.json")
+	storage.puts = nil
+
+	resumed, pending, dataSize, metadataSize, err := b.splitUploadedTables("test_backup", tables, false)
+	assert.NoError(t, err)
+	assert.Len(t, resumed, 1)
+	assert.NotEmpty(t, resumed[metadata.TableTitle{Database: "default", Table: "t1"}].Files, "resumed table shall keep archives from remote metadata")
+	assert.Greater(t, dataSize, int64(0))
+	assert.Greater(t, metadataSize, int64(0))
+	var pendingNames []string
+	for _, table := range pending {
+		pendingNames = append(pendingNames, table.Table)
+	}
+	assert.Equal(t, []string{"t2", "t3", "t4"}, pendingNames)
+
+	uploaded, _, _, err := b.uploadTables("test_backup", pending, false, false, timeouts)
+	assert.NoError(t, err)
+	for _, key := range storage.puts {
+		assert.False(t, strings.Contains(key, "/t1"), "%s of completed table shall not be uploaded again", key)
+	}
+	assert.Contains(t, storage.puts, "test_backup/metadata/default/t4.json")
+	merged := mergeUploadedTables(tables, resumed, uploaded)
+	var mergedNames []string
+	for _, table := range merged {
+		mergedNames = append(mergedNames, table.Table)
+		assert.NotEmpty(t, table.Files)
+	}
+	assert.Equal(t, []string{"t1", "t2", "t3", "t4"}, mergedNames)
+	assert.NotEmpty(t, merged[3].ArchiveSizes, "sizes of uploaded archives shall be recorded in metadata")
+
+	// archive of t3 was truncated after upload, so t3 is uploaded again
+	for key, body := range storage.files {
+		if strings.HasPrefix(key, "test_backup/shadow/default/t3/") {
+			storage.files[key] = body[:len(body)/2]
+		}
+	}
+	resumed, pending, _, _, err = b.splitUploadedTables("test_backup", tables, false)
+	assert.NoError(t, err)
+	assert.Len(t, resumed, 3)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "t3", pending[0].Table)
+}
@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkDuplicatedPartsRemoteManifest(t *testing.T) {
+	// synthetic manifest of previous remote backup, only metadata is available, no local data
+	remoteTable := metadata.TableMetadata{
+		Database: "default",
+		Table:    "events",
+		Parts: map[string][]metadata.Part{
+			"default": {
+				{Name: "all_1_1_0", Size: 100, HashOfAllFiles: "aaa"},
+				{Name: "all_2_2_0", Size: 200, HashOfAllFiles: "bbb"},
+				{Name: "all_3_3_0", Size: 300, HashOfAllFiles: "ccc"},
+				{Name: "all_4_4_0"},
+			},
+		},
+	}
+	newTable := func() metadata.TableMetadata {
+		return metadata.TableMetadata{
+			Database: "default",
+			Table:    "events",
+			Parts: map[string][]metadata.Part{
+				"default": {
+					{Name: "all_1_1_0", Size: 100, HashOfAllFiles: "aaa"},
+					{Name: "all_2_2_0", Size: 201, HashOfAllFiles: "bbb"},
+					{Name: "all_3_3_0", Size: 300, HashOfAllFiles: "ddd"},
+					{Name: "all_4_4_0", Size: 400, HashOfAllFiles: "eee"},
+					{Name: "all_5_5_0", Size: 500, HashOfAllFiles: "fff"},
+				},
+			},
+		}
+	}
+	required := func(table metadata.TableMetadata) []string {
+		var names []string
+		for _, p := range table.Parts["default"] {
+			if p.Required {
+				names = append(names, p.Name)
+			}
+		}
+		return names
+	}
+	backupMetadata := &metadata.BackupMetadata{BackupName: "increment", RequiredBackup: "full"}
+
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+	table := newTable()
+	b.markDuplicatedParts(backupMetadata, &remoteTable, &table, false)
+	assert.Equal(t, []string{"all_1_1_0", "all_3_3_0", "all_4_4_0"}, required(table))
+
+	cfg.General.DiffCompareMode = "hash"
+	table = newTable()
+	b.markDuplicatedParts(backupMetadata, &remoteTable, &table, false)
+	assert.Equal(t, []string{"all_1_1_0", "all_4_4_0"}, required(table))
+}
+
+func TestLatestRemoteBackup(t *testing.T) {
+	now := time.Now()
+	backupList := []new_storage.Backup{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "old", CreationDate: now.Add(-2 * time.Hour)}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "previous", CreationDate: now.Add(-time.Hour)}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "broken", CreationDate: now.Add(-time.Minute)}, Broken: "broken (bad metadata.json)"},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "legacy"}, Legacy: true},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "current", CreationDate: now}},
+	}
+	latest := latestRemoteBackup(backupList, "current")
+	assert.NotNil(t, latest)
+	assert.Equal(t, "previous", latest.BackupName)
+	assert.Nil(t, latestRemoteBackup(backupList[2:4], ""))
+	assert.True(t, isLatestBackupAlias("latest"))
+	assert.False(t, isLatestBackupAlias("2021-10-01T00-00-00"))
+}
+
+func TestProgressTotal(t *testing.T) {
+	tables := ListOfTables{
+		{
+			Database: "default",
+			Table:    "events",
+			Size:     map[string]int64{"default": 300, "hdd": 200},
+			Parts: map[string][]metadata.Part{
+				"default": {{Name: "all_1_1_0", Size: 100, Required: true}, {Name: "all_2_2_0", Size: 200}},
+				"hdd":     {{Name: "all_3_3_0", Size: 200}},
+			},
+		},
+		{Database: "default", Table: "view", MetadataOnly: true, Size: map[string]int64{"default": 1000}},
+	}
+	assert.Equal(t, int64(400), uploadProgressTotal(tables))
+	assert.Equal(t, int64(500), downloadProgressTotal(metadata.BackupMetadata{DataFormat: "directory"}, tables))
+	assert.Equal(t, int64(250), downloadProgressTotal(metadata.BackupMetadata{DataFormat: "tar", DataSize: 1000, CompressedSize: 500}, tables))
+}
+
+func TestSplitSharedParts(t *testing.T) {
+	parts := []metadata.Part{
+		{Name: "all_1_1_0", HashOfAllFiles: "aaa", Required: true},
+		{Name: "all_2_2_0", HashOfAllFiles: "bbb"},
+		{Name: "all_3_3_0"},
+	}
+	regularParts, sharedParts := splitSharedParts(parts)
+	assert.Equal(t, []int{1}, sharedParts)
+	assert.Equal(t, []metadata.Part{parts[0], parts[2]}, regularParts)
+
+	parts[1].SharedKey = new_storage.SharedPartKey("bbb", "tar")
+	tables := ListOfTables{
+		{Database: "default", Table: "events", Parts: map[string][]metadata.Part{"default": parts}},
+		{Database: "default", Table: "copy", Parts: map[string][]metadata.Part{"default": {{Name: "all_2_2_0", SharedKey: parts[1].SharedKey}}}},
+	}
+	assert.Equal(t, []string{".shared/bb/bbb.tar"}, sharedPartKeys(tables))
+	assert.Nil(t, sharedPartKeys(ListOfTables{}))
+}
+
+// recordingStorage - remote storage which records uploaded keys and local data of tables which exist at the moment of each upload,
+// upload and stat of failKey fail with failErr when it is set
+type recordingStorage struct {
+	events    []string
+	sizes     map[string]int64
+	failKey   string
+	failErr   error
+	localPath string
+}
+
+type recordingFile struct {
+	name string
+	size int64
+}
+
+func (f recordingFile) Size() int64             { return f.size }
+func (f recordingFile) Name() string            { return f.name }
+func (f recordingFile) LastModified() time.Time { return time.Time{} }
+
+func (s *recordingStorage) Kind() string   { return "recording" }
+func (s *recordingStorage) Connect() error { return nil }
+func (s *recordingStorage) StatFile(key string) (new_storage.RemoteFile, error) {
+	if key == s.failKey && s.failErr != nil {
+		return nil, s.failErr
+	}
+	size, exists := s.sizes[key]
+	if !exists {
+		return nil, new_storage.ErrNotFound
+	}
+	return recordingFile{name: key, size: size}, nil
+}
+func (s *recordingStorage) DeleteFile(key string) error { return nil }
+func (s *recordingStorage) Walk(prefix string, recursive bool, fn func(new_storage.RemoteFile) error) error {
+	return nil
+}
+func (s *recordingStorage) GetFileReader(key string) (io.ReadCloser, error) {
+	return nil, new_storage.ErrNotFound
+}
+func (s *recordingStorage) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if key == s.failKey && s.failErr != nil {
+		return s.failErr
+	}
+	if key == s.failKey {
+		return fmt.Errorf("upload %s failed", key)
+	}
+	tables, _ := filepath.Glob(path.Join(s.localPath, "backup", "test_backup", "shadow", "default", "*"))
+	for i := range tables {
+		tables[i] = path.Base(tables[i])
+	}
+	s.events = append(s.events, fmt.Sprintf("put %s, local tables %v", key, tables))
+	s.sizes[key] = int64(len(body))
+	return nil
+}
+
+func TestUploadDeleteSource(t *testing.T) {
+	localPath := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "s3"
+	cfg.S3.CompressionFormat = "tar"
+	storage := &recordingStorage{localPath: localPath, sizes: map[string]int64{}, failKey: "test_backup/shadow/default/third/default_all_1_1_0.tar"}
+	dst, err := new_storage.NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	dst.RemoteStorage = storage
+	b := &Backuper{
+		cfg:           cfg,
+		dst:           dst,
+		DiskToPathMap: map[string]string{"default": localPath},
+	}
+	var tables []metadata.TableMetadata
+	for _, name := range []string{"first", "second", "third"} {
+		partPath := path.Join(localPath, "backup", "test_backup", "shadow", "default", name, "default", "all_1_1_0")
+		assert.NoError(t, os.MkdirAll(partPath, 0750))
+		assert.NoError(t, ioutil.WriteFile(path.Join(partPath, "data.bin"), []byte(name), 0640))
+		tables = append(tables, metadata.TableMetadata{
+			Database: "default",
+			Table:    name,
+			Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+		})
+	}
+	for i := range tables[:2] {
+		_, _, err := b.uploadTable(context.Background(), "test_backup", &tables[i], false, true)
+		assert.NoError(t, err)
+	}
+	_, _, err = b.uploadTable(context.Background(), "test_backup", &tables[2], false, true)
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"put test_backup/shadow/default/first/default_all_1_1_0.tar, local tables [first second third]",
+		"put test_backup/metadata/default/first.json, local tables [first second third]",
+		"put test_backup/shadow/default/second/default_all_1_1_0.tar, local tables [second third]",
+		"put test_backup/metadata/default/second.json, local tables [second third]",
+	}, storage.events)
+	// failed table keeps local data
+	_, err = os.Stat(path.Join(localPath, "backup", "test_backup", "shadow", "default", "third", "default", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+}
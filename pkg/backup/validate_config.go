@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	apexLog "github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+// validateObjectPrefix - test object is written into the root of remote storage path and is removed after check
+const validateObjectPrefix = ".clickhouse-backup-validate-"
+
+// ValidateConfig - load config, connect to clickhouse, check access to its data paths, connect to remote storage, write, stat, read and delete small test object, print result of each check
+func ValidateConfig(configPath string) error {
+	cfg, err := config.LoadConfig(configPath)
+	report := permissionsReport{{Capability: fmt.Sprintf("load config %s", configPath), Err: err}}
+	if err == nil {
+		report = append(report, validateClickHouse(cfg)...)
+		if cfg.General.RemoteStorage == "none" {
+			apexLog.Info("remote_storage is 'none', remote storage checks are skipped")
+		} else {
+			report = append(report, validateRemoteStorage(cfg)...)
+		}
+	}
+	report.print(os.Stdout)
+	if failed := report.failed(); len(failed) > 0 {
+		return fmt.Errorf("%d of %d config checks failed", len(failed), len(report))
+	}
+	return nil
+}
+
+func validateClickHouse(cfg *config.Config) permissionsReport {
+	check := permissionCheck{Capability: fmt.Sprintf("connect to clickhouse %s:%d", cfg.ClickHouse.Host, cfg.ClickHouse.Port)}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if check.Err = ch.Connect(); check.Err != nil {
+		return permissionsReport{check}
+	}
+	defer ch.Close()
+	return append(permissionsReport{check}, checkDataPaths(ch)...)
+}
+
+// checkDataPaths - `backup` folder of each clickhouse disk shall be writable, the same as check_permissions does
+func checkDataPaths(ch permissionsChecker) permissionsReport {
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return permissionsReport{{Capability: "read clickhouse disks", Err: err}}
+	}
+	var report permissionsReport
+	for _, disk := range disks {
+		report = append(report, checkDiskPermissions(disk))
+	}
+	return report
+}
+
+func validateRemoteStorage(cfg *config.Config) permissionsReport {
+	check := permissionCheck{Capability: fmt.Sprintf("connect to %s remote storage", cfg.General.RemoteStorage)}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	if err == nil {
+		err = bd.Connect()
+	}
+	if check.Err = err; err != nil {
+		return permissionsReport{check}
+	}
+	key := validateObjectPrefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+	return append(permissionsReport{check}, checkRemoteStorageAccess(bd, key)...)
+}
+
+// checkRemoteStorageAccess - write, stat, read and delete object with key, the object is removed even when stat or read failed
+func checkRemoteStorageAccess(rs new_storage.RemoteStorage, key string) permissionsReport {
+	body := []byte("clickhouse-backup config validate " + key)
+	write := permissionCheck{Capability: fmt.Sprintf("write %s", key)}
+	write.Err = rs.PutFile(key, ioutil.NopCloser(bytes.NewReader(body)))
+	if write.Err != nil {
+		// partially written object could be left
+		_ = rs.DeleteFile(key)
+		return permissionsReport{write}
+	}
+	stat := permissionCheck{Capability: fmt.Sprintf("stat %s", key)}
+	file, err := rs.StatFile(key)
+	if err == nil && file.Size() != int64(len(body)) {
+		err = fmt.Errorf("size is %d instead of %d written bytes", file.Size(), len(body))
+	}
+	stat.Err = err
+	read := permissionCheck{Capability: fmt.Sprintf("read %s", key)}
+	r, err := rs.GetFileReader(key)
+	if err == nil {
+		var readBody []byte
+		readBody, err = ioutil.ReadAll(r)
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && !bytes.Equal(readBody, body) {
+			err = fmt.Errorf("read %d bytes which differ from %d written bytes", len(readBody), len(body))
+		}
+	}
+	read.Err = err
+	remove := permissionCheck{Capability: fmt.Sprintf("delete %s", key), Err: rs.DeleteFile(key)}
+	return permissionsReport{write, stat, read, remove}
+}
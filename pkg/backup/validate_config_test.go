@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenStorage - memoryStorage which fails PutFile, StatFile, GetFileReader or DeleteFile, corrupt changes read content
+type brokenStorage struct {
+	memoryStorage
+	putErr, statErr, getErr, deleteErr error
+	corrupt                            bool
+	deleted                            []string
+}
+
+func (s *brokenStorage) PutFile(key string, r io.ReadCloser) error {
+	if s.putErr != nil {
+		// object is written partially
+		s.files[key] = []byte("partial")
+		return s.putErr
+	}
+	return s.memoryStorage.PutFile(key, r)
+}
+
+func (s *brokenStorage) StatFile(key string) (new_storage.RemoteFile, error) {
+	if s.statErr != nil {
+		return nil, s.statErr
+	}
+	return s.memoryStorage.StatFile(key)
+}
+
+func (s *brokenStorage) GetFileReader(key string) (io.ReadCloser, error) {
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	if s.corrupt {
+		return ioutil.NopCloser(strings.NewReader("corrupted")), nil
+	}
+	return s.memoryStorage.GetFileReader(key)
+}
+
+func (s *brokenStorage) DeleteFile(key string) error {
+	s.deleted = append(s.deleted, key)
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	return s.memoryStorage.DeleteFile(key)
+}
+
+func TestCheckRemoteStorageAccess(t *testing.T) {
+	key := validateObjectPrefix + "test"
+	for name, tc := range map[string]struct {
+		storage  *brokenStorage
+		expected []string
+	}{
+		"success":       {&brokenStorage{}, []string{"OK      write " + key, "OK      stat " + key, "OK      read " + key, "OK      delete " + key}},
+		"write failed":  {&brokenStorage{putErr: fmt.Errorf("access denied")}, []string{"FAILED  write " + key + ": access denied"}},
+		"stat failed":   {&brokenStorage{statErr: fmt.Errorf("forbidden")}, []string{"OK      write " + key, "FAILED  stat " + key + ": forbidden", "OK      read " + key, "OK      delete " + key}},
+		"read failed":   {&brokenStorage{getErr: fmt.Errorf("timeout")}, []string{"OK      write " + key, "OK      stat " + key, "FAILED  read " + key + ": timeout", "OK      delete " + key}},
+		"read corrupt":  {&brokenStorage{corrupt: true}, []string{"OK      write " + key, "OK      stat " + key, "FAILED  read " + key + ": read 9 bytes which differ from 66 written bytes", "OK      delete " + key}},
+		"delete failed": {&brokenStorage{deleteErr: fmt.Errorf("object lock")}, []string{"OK      write " + key, "OK      stat " + key, "OK      read " + key, "FAILED  delete " + key + ": object lock"}},
+	} {
+		tc.storage.files = map[string][]byte{}
+		out := &strings.Builder{}
+		checkRemoteStorageAccess(tc.storage, key).print(out)
+		assert.Equal(t, strings.Join(tc.expected, "\n")+"\n", out.String(), name)
+		assert.Equal(t, []string{key}, tc.storage.deleted, "%s: test object shall be always deleted", name)
+		if tc.storage.deleteErr == nil {
+			assert.Empty(t, tc.storage.files, name)
+		}
+	}
+}
+
+func TestCheckDataPaths(t *testing.T) {
+	writable, readOnly := t.TempDir(), t.TempDir()
+	assert.NoError(t, os.Chmod(readOnly, 0500))
+	defer os.Chmod(readOnly, 0700)
+	report := checkDataPaths(&fakePermissionsChecker{disks: []clickhouse.Disk{{Name: "default", Path: writable}, {Name: "ro", Path: readOnly}}})
+	assert.Len(t, report, 2)
+	assert.NoError(t, report[0].Err)
+	if os.Geteuid() != 0 {
+		assert.Error(t, report[1].Err, "read-only disk path shall fail")
+	}
+	entries, err := os.ReadDir(writable)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "test folder shall be removed")
+}
+
+func TestValidateConfigLoadFailed(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte("general:\n  remote_storage: unknown\n"), 0640))
+	assert.EqualError(t, ValidateConfig(configPath), "1 of 1 config checks failed")
+}
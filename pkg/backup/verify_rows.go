@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// partsRowsCounter - part of clickhouse.ClickHouse which counts rows in frozen parts during create
+type partsRowsCounter interface {
+	GetPartsRows(database, table string, partNames []string) (uint64, error)
+}
+
+// countBackupRows - rows in parts which were frozen for backup, nil when rows can't be counted, backup is not failed in this case
+func countBackupRows(ch partsRowsCounter, table clickhouse.Table, parts map[string][]metadata.Part, log *apexLog.Entry) *uint64 {
+	var partNames []string
+	for _, diskParts := range parts {
+		for _, part := range diskParts {
+			partNames = append(partNames, part.Name)
+		}
+	}
+	rows, err := ch.GetPartsRows(table.Database, table.Name, partNames)
+	if err != nil {
+		log.Warnf("can't count rows in backup parts, `restore --verify-rows` will skip this table: %v", err)
+		return nil
+	}
+	return &rows
+}
+
+// rowsCounter - part of clickhouse.ClickHouse which counts rows in restored tables
+type rowsCounter interface {
+	GetRowsCount(database, table string) (uint64, error)
+}
+
+// verifyRestoredRows - compare SELECT count() of each restored table with rows count recorded during create,
+// tables without recorded rows and tables restored with --partitions are skipped
+func verifyRestoredRows(ch rowsCounter, tables ListOfTables, partitionsToRestore common.TablePartitions, log *apexLog.Entry) error {
+	var discrepancies []string
+	for _, table := range tables {
+		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table))
+		if table.Rows == nil {
+			log.Debug("rows count is not recorded in backup, skip verification")
+			continue
+		}
+		if len(partitionsToRestore.ForTable(table.Database, table.Table)) > 0 {
+			log.Info("only some partitions were restored, skip rows verification")
+			continue
+		}
+		rows, err := ch.GetRowsCount(table.Database, table.Table)
+		if err != nil {
+			return fmt.Errorf("can't count rows in '%s.%s': %v", table.Database, table.Table, err)
+		}
+		if rows != *table.Rows {
+			log.Warnf("restored %d rows, backup contains %d rows", rows, *table.Rows)
+			discrepancies = append(discrepancies, fmt.Sprintf("'%s.%s' has %d rows, expected %d", table.Database, table.Table, rows, *table.Rows))
+			continue
+		}
+		log.Debugf("%d rows verified", rows)
+	}
+	if len(discrepancies) > 0 {
+		return fmt.Errorf("rows verification failed for %d tables: %s", len(discrepancies), strings.Join(discrepancies, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRowsCounter - rows of tables by `db.table` name, parts rows by part name
+type fakeRowsCounter struct {
+	rows      map[string]uint64
+	partsRows map[string]uint64
+	counted   []string
+}
+
+func (f *fakeRowsCounter) GetRowsCount(database, table string) (uint64, error) {
+	name := database + "." + table
+	f.counted = append(f.counted, name)
+	rows, ok := f.rows[name]
+	if !ok {
+		return 0, fmt.Errorf("code: 60, message: Table %s doesn't exist", name)
+	}
+	return rows, nil
+}
+
+func (f *fakeRowsCounter) GetPartsRows(database, table string, partNames []string) (uint64, error) {
+	var rows uint64
+	for _, name := range partNames {
+		rows += f.partsRows[name]
+	}
+	return rows, nil
+}
+
+func rowsPtr(rows uint64) *uint64 {
+	return &rows
+}
+
+func TestCountBackupRows(t *testing.T) {
+	ch := &fakeRowsCounter{partsRows: map[string]uint64{"all_1_1_0": 10, "all_2_2_0": 5, "all_3_3_0": 100}}
+	parts := map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}, "hdd": {{Name: "all_2_2_0"}}}
+	log := apexLog.WithField("test", t.Name())
+	assert.Equal(t, rowsPtr(15), countBackupRows(ch, clickhouse.Table{Database: "default", Name: "t"}, parts, log))
+	assert.Equal(t, rowsPtr(0), countBackupRows(ch, clickhouse.Table{Database: "default", Name: "empty"}, nil, log))
+}
+
+func TestVerifyRestoredRows(t *testing.T) {
+	log := apexLog.WithField("test", t.Name())
+	ch := &fakeRowsCounter{rows: map[string]uint64{"default.matched": 100, "default.lost": 90, "default.partial": 1, "default.legacy": 7}}
+	tables := ListOfTables{
+		{Database: "default", Table: "matched", Rows: rowsPtr(100)},
+		{Database: "default", Table: "legacy"},
+		{Database: "default", Table: "partial", Rows: rowsPtr(50)},
+	}
+	assert.NoError(t, verifyRestoredRows(ch, tables, common.TablePartitions{"default.partial": {"202201": {}}}, log))
+	assert.Equal(t, []string{"default.matched"}, ch.counted)
+
+	tables = append(tables, metadata.TableMetadata{Database: "default", Table: "lost", Rows: rowsPtr(100)})
+	err := verifyRestoredRows(ch, tables, nil, log)
+	assert.EqualError(t, err, "rows verification failed for 2 tables: 'default.partial' has 1 rows, expected 50, 'default.lost' has 90 rows, expected 100")
+
+	err = verifyRestoredRows(ch, ListOfTables{{Database: "default", Table: "absent", Rows: rowsPtr(1)}}, nil, log)
+	assert.EqualError(t, err, "can't count rows in 'default.absent': code: 60, message: Table default.absent doesn't exist")
+}
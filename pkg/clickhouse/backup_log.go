@@ -0,0 +1,60 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BackupLogRow - one operation from backup_log_table
+type BackupLogRow struct {
+	Start        time.Time `db:"start"`
+	Finish       time.Time `db:"finish"`
+	DurationMs   uint64    `db:"duration_ms"`
+	Operation    string    `db:"operation"`
+	BackupName   string    `db:"backup_name"`
+	Status       string    `db:"status"`
+	Error        string    `db:"error"`
+	DataSize     uint64    `db:"data_size"`
+	MetadataSize uint64    `db:"metadata_size"`
+	Host         string    `db:"host"`
+	Version      string    `db:"version"`
+}
+
+// backupLogColumns - columns of backup_log_table in order of its DDL
+const backupLogColumns = "start, finish, duration_ms, operation, backup_name, status, error, data_size, metadata_size, host, version"
+
+// QuoteTableName - `db.table` -> "`db`.`table`", table without database is created in current database
+func QuoteTableName(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return fmt.Sprintf("`%s`.`%s`", name[:i], name[i+1:])
+	}
+	return fmt.Sprintf("`%s`", name)
+}
+
+// CreateBackupLogTable - create backup_log_table if it doesn't exist
+func (ch *ClickHouse) CreateBackupLogTable(table string) error {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"start DateTime, finish DateTime, duration_ms UInt64, operation String, backup_name String, status String, error String, "+
+		"data_size UInt64, metadata_size UInt64, host String, version String"+
+		") ENGINE = MergeTree PARTITION BY toYYYYMM(start) ORDER BY (host, start)", QuoteTableName(table))
+	_, err := ch.Query(query)
+	return err
+}
+
+// InsertBackupLog - INSERT ... SELECT is executed as single query, so it doesn't require batch mode of native protocol and works over http
+func (ch *ClickHouse) InsertBackupLog(table string, row BackupLogRow) error {
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT toDateTime(?), toDateTime(?), ?, ?, ?, ?, ?, ?, ?, ?, ?", QuoteTableName(table), backupLogColumns)
+	_, err := ch.Query(query, row.Start.Unix(), row.Finish.Unix(), row.DurationMs, row.Operation, row.BackupName, row.Status, row.Error, row.DataSize, row.MetadataSize, row.Host, row.Version)
+	return err
+}
+
+// GetBackupLog - last operations of host from backup_log_table, sorted by start
+func (ch *ClickHouse) GetBackupLog(table, host string, limit int) ([]BackupLogRow, error) {
+	var rows []BackupLogRow
+	query := fmt.Sprintf("SELECT %s FROM (SELECT %s FROM %s WHERE host = ? ORDER BY start DESC LIMIT %d) ORDER BY start", backupLogColumns, backupLogColumns, QuoteTableName(table), limit)
+	if err := ch.Select(&rows, query, host); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
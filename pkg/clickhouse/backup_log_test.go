@@ -0,0 +1,62 @@
+package clickhouse
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupLog(t *testing.T) {
+	assert.Equal(t, "`default`.`backup_log`", QuoteTableName("default.backup_log"))
+	assert.Equal(t, "`backup_log`", QuoteTableName("backup_log"))
+
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		queries = append(queries, string(body))
+		switch {
+		case string(body) == "SELECT 1":
+			_, _ = w.Write([]byte(`{"meta":[{"name":"1","type":"UInt8"}],"data":[[1]]}`))
+		case strings.HasPrefix(string(body), "SELECT start"):
+			_, _ = w.Write([]byte(`{"meta":[{"name":"start","type":"DateTime"},{"name":"finish","type":"DateTime"},{"name":"duration_ms","type":"UInt64"},
+				{"name":"operation","type":"String"},{"name":"backup_name","type":"String"},{"name":"status","type":"String"},{"name":"error","type":"String"},
+				{"name":"data_size","type":"UInt64"},{"name":"metadata_size","type":"UInt64"},{"name":"host","type":"String"},{"name":"version","type":"String"}],
+				"data":[["2022-03-01 10:20:30","2022-03-01 10:20:35","5000","upload","backup1","error","can't upload","100","10","host1","1.3.1"]]}`))
+		}
+	}))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	portNumber, _ := strconv.Atoi(port)
+	ch := &ClickHouse{Config: &config.ClickHouseConfig{Host: host, Port: uint(portNumber), Protocol: "http", Timeout: "5s"}}
+	assert.NoError(t, ch.Connect())
+	defer ch.Close()
+
+	queries = nil
+	assert.NoError(t, ch.CreateBackupLogTable("default.backup_log"))
+	assert.Contains(t, queries[0], "CREATE TABLE IF NOT EXISTS `default`.`backup_log` (start DateTime, finish DateTime, duration_ms UInt64")
+	start := time.Unix(1646130030, 0)
+	assert.NoError(t, ch.InsertBackupLog("default.backup_log", BackupLogRow{
+		Start: start, Finish: start.Add(5 * time.Second), DurationMs: 5000, Operation: "create", BackupName: "backup1", Status: "error", Error: "can't freeze 'default.t'",
+		DataSize: 100, MetadataSize: 10, Host: "host1", Version: "1.3.1",
+	}))
+	assert.Equal(t, "INSERT INTO `default`.`backup_log` (start, finish, duration_ms, operation, backup_name, status, error, data_size, metadata_size, host, version) "+
+		"SELECT toDateTime(1646130030), toDateTime(1646130035), 5000, 'create', 'backup1', 'error', 'can\\'t freeze \\'default.t\\'', 100, 10, 'host1', '1.3.1'", queries[1])
+
+	rows, err := ch.GetBackupLog("default.backup_log", "host1", 1000)
+	assert.NoError(t, err)
+	assert.Contains(t, queries[2], "FROM `default`.`backup_log` WHERE host = 'host1' ORDER BY start DESC LIMIT 1000) ORDER BY start")
+	assert.Len(t, rows, 1)
+	assert.Equal(t, "upload", rows[0].Operation)
+	assert.Equal(t, "can't upload", rows[0].Error)
+	assert.Equal(t, uint64(5000), rows[0].DurationMs)
+	assert.Equal(t, "2022-03-01 10:20:35", rows[0].Finish.Format("2006-01-02 15:04:05"))
+}
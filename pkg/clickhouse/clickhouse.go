@@ -1,6 +1,7 @@
 package clickhouse
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -8,13 +9,13 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/apex/log"
 
@@ -25,12 +26,16 @@ import (
 
 // ClickHouse - provide
 type ClickHouse struct {
-	Config  *config.ClickHouseConfig
-	conn    *sqlx.DB
-	uid     *int
-	gid     *int
-	disks   []Disk
-	version int
+	Config        *config.ClickHouseConfig
+	conn          *sqlx.DB
+	uid           *int
+	gid           *int
+	disks         []Disk
+	version       int
+	queryTimeout  time.Duration
+	freezeTimeout time.Duration
+	// syncReplicaTimeout - limit of one SYSTEM SYNC REPLICA query during `restore --replica-sync`
+	syncReplicaTimeout time.Duration
 }
 
 func (ch *ClickHouse) GetUid() *int {
@@ -55,13 +60,45 @@ func (ch *ClickHouse) Connect() error {
 	if err != nil {
 		return err
 	}
+	if ch.queryTimeout, err = parseQueryTimeout(ch.Config.QueryTimeout); err != nil {
+		return err
+	}
+	if ch.freezeTimeout, err = parseQueryTimeout(ch.Config.FreezeTimeout); err != nil {
+		return err
+	}
+	if ch.syncReplicaTimeout, err = parseQueryTimeout(ch.Config.SyncReplicaTimeout); err != nil {
+		return err
+	}
+	if ch.Config.Protocol == "http" {
+		return ch.connectHTTP(timeout)
+	}
 
-	timeoutSeconds := fmt.Sprintf("%d", int(timeout.Seconds()))
+	connectTimeoutSeconds := fmt.Sprintf("%d", int(timeout.Seconds()))
+	// socket shall not be closed by timeout before query_timeout, freeze_timeout and sync_replica_timeout
+	for _, queryTimeout := range []time.Duration{ch.queryTimeout, ch.freezeTimeout, ch.syncReplicaTimeout} {
+		if queryTimeout > timeout {
+			timeout = queryTimeout
+		}
+	}
+	params, err := ch.nativeParams(connectTimeoutSeconds, fmt.Sprintf("%d", int(timeout.Seconds())))
+	if err != nil {
+		return err
+	}
+	connectionString := fmt.Sprintf("tcp://%v:%v?%s", ch.Config.Host, ch.Config.Port, params.Encode())
+	if err = ch.openDB(settingsDriverName, connectionString); err != nil {
+		return err
+	}
+	return wrapConnectError(ch.Config, ch.conn.Ping())
+}
+
+// nativeParams - DSN parameters of native protocol connection, plaintext is used unless `secure` is set,
+// tls.Config with tls_ca, tls_cert and tls_key is registered in driver and referenced by `tls_config` parameter
+func (ch *ClickHouse) nativeParams(connectTimeoutSeconds, timeoutSeconds string) (url.Values, error) {
 	params := url.Values{}
 	params.Add("username", ch.Config.Username)
 	params.Add("password", ch.Config.Password)
 	params.Add("database", "system")
-	params.Add("connect_timeout", timeoutSeconds)
+	params.Add("connect_timeout", connectTimeoutSeconds)
 	params.Add("receive_timeout", timeoutSeconds)
 	params.Add("send_timeout", timeoutSeconds)
 	params.Add("timeout", timeoutSeconds)
@@ -75,18 +112,38 @@ func (ch *ClickHouse) Connect() error {
 	if ch.Config.Secure {
 		params.Add("secure", "true")
 		params.Add("skip_verify", strconv.FormatBool(ch.Config.SkipVerify))
+		tlsConfigName, err := registerTLSConfig(ch.Config)
+		if err != nil {
+			return nil, err
+		}
+		params.Add("tls_config", tlsConfigName)
 	}
 	if !ch.Config.LogSQLQueries {
 		params.Add("log_queries", "0")
 	}
-	connectionString := fmt.Sprintf("tcp://%v:%v?%s", ch.Config.Host, ch.Config.Port, params.Encode())
-	if ch.conn, err = sqlx.Open("clickhouse", connectionString); err != nil {
+	settingsParams(params, ch.Config.Settings)
+	return params, nil
+}
+
+// openDB - connections aren't kept idle, so each query opens new connection and `settings` are applied by SET right before each FREEZE, CREATE or ATTACH
+func (ch *ClickHouse) openDB(driverName, dsn string) error {
+	conn, err := sqlx.Open(driverName, dsn)
+	if err != nil {
 		return err
 	}
-	ch.conn.SetMaxOpenConns(1)
+	ch.conn = conn
+	ch.conn.SetMaxOpenConns(ch.maxOpenConns())
 	ch.conn.SetConnMaxLifetime(0)
 	ch.conn.SetMaxIdleConns(0)
-	return ch.conn.Ping()
+	return nil
+}
+
+// maxOpenConns - up to freeze_concurrency FREEZE queries are executed in parallel by separate connections, settings are applied on each connection
+func (ch *ClickHouse) maxOpenConns() int {
+	if ch.Config.FreezeConcurrency > 1 {
+		return ch.Config.FreezeConcurrency
+	}
+	return 1
 }
 
 // GetDisks - return data from system.disks table
@@ -119,9 +176,10 @@ func (ch *ClickHouse) GetDisks() ([]Disk, error) {
 	}
 	for k, v := range dm {
 		disks = append(disks, Disk{
-			Name: k,
-			Path: v,
-			Type: "local",
+			Name:       k,
+			Path:       v,
+			Type:       "local",
+			MappedOnly: true,
 		})
 	}
 	return disks, nil
@@ -198,7 +256,7 @@ func (ch *ClickHouse) GetTables(tablePattern string) ([]Table, error) {
 	}
 	for i, t := range tables {
 		for _, filter := range ch.Config.SkipTables {
-			if matched, _ := filepath.Match(strings.Trim(filter, " \t\r\n"), fmt.Sprintf("%s.%s", t.Database, t.Name)); matched {
+			if common.MatchTable(strings.Trim(filter, " \t\r\n"), t.Database, t.Name) {
 				t.Skip = true
 				break
 			}
@@ -254,8 +312,13 @@ func (ch *ClickHouse) prepareAllTablesSQL(tablePattern string, err error, skipDa
 
 	allTablesSQL += "  FROM system.tables WHERE is_temporary = 0"
 	if tablePattern != "" {
-		replacer := strings.NewReplacer(".", "\\.", ",", "|", "*", ".*", "?", ".", " ", "")
-		allTablesSQL += fmt.Sprintf(" AND match(concat(database,'.',name),'%s') ", replacer.Replace(tablePattern))
+		// exclude patterns applied after select, see common.TablePattern
+		replacer := strings.NewReplacer(".", "\\.", "*", ".*", "?", ".", " ", "")
+		var includePatterns []string
+		for _, pattern := range common.NewTablePattern(tablePattern, nil).Include() {
+			includePatterns = append(includePatterns, replacer.Replace(pattern))
+		}
+		allTablesSQL += fmt.Sprintf(" AND match(concat(database,'.',name),'%s') ", strings.Join(includePatterns, "|"))
 	}
 	if len(skipDatabases) > 0 {
 		allTablesSQL += fmt.Sprintf(" AND database NOT IN ('%s')", strings.Join(skipDatabases, "','"))
@@ -301,6 +364,42 @@ func (ch *ClickHouse) getTableSizeFromParts(table Table) uint64 {
 	return 0
 }
 
+// GetPartsSize - return sum of bytes_on_disk of active parts for each table and disk, versions before 19.15 have only `default` disk
+func (ch *ClickHouse) GetPartsSize() ([]PartsSize, error) {
+	version, err := ch.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+	disk := "disk_name"
+	if version < 19015000 {
+		disk = "'default'"
+	}
+	var partsSize []PartsSize
+	query := fmt.Sprintf("SELECT database, table, %s AS disk, sum(bytes_on_disk) AS size FROM system.parts WHERE active GROUP BY database, table, disk", disk)
+	if err := ch.Select(&partsSize, query); err != nil {
+		return nil, fmt.Errorf("can't get parts size from system.parts: %v", err)
+	}
+	return partsSize, nil
+}
+
+// GetActiveParts - return names of active parts of all tables, versions before 19.15 have only `default` disk
+func (ch *ClickHouse) GetActiveParts() ([]ActivePart, error) {
+	version, err := ch.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+	disk := "disk_name"
+	if version < 19015000 {
+		disk = "'default'"
+	}
+	var parts []ActivePart
+	query := fmt.Sprintf("SELECT database, table, %s AS disk, name FROM system.parts WHERE active", disk)
+	if err := ch.Select(&parts, query); err != nil {
+		return nil, fmt.Errorf("can't get active parts from system.parts: %v", err)
+	}
+	return parts, nil
+}
+
 func (ch *ClickHouse) fixVariousVersions(t Table) Table {
 	// versions before 19.15 contain data_path in a different column
 	if t.DataPath != "" {
@@ -342,6 +441,40 @@ func (ch *ClickHouse) GetVersion() (int, error) {
 	return ch.version, err
 }
 
+// GetTimezone - return server timezone, empty string when it can't be detected
+func (ch *ClickHouse) GetTimezone() string {
+	var result []string
+	if err := ch.Select(&result, "SELECT timezone()"); err != nil || len(result) == 0 {
+		return ""
+	}
+	return result[0]
+}
+
+// GetServerUUID - return server UUID, empty string when clickhouse-server doesn't support serverUUID()
+func (ch *ClickHouse) GetServerUUID() string {
+	var result []string
+	if err := ch.Select(&result, "SELECT toString(serverUUID())"); err != nil || len(result) == 0 {
+		return ""
+	}
+	return result[0]
+}
+
+// GetMacros - return substitutions of system.macros by macro name
+func (ch *ClickHouse) GetMacros() (map[string]string, error) {
+	var rows []struct {
+		Macro        string `db:"macro"`
+		Substitution string `db:"substitution"`
+	}
+	if err := ch.Select(&rows, "SELECT macro, substitution FROM system.macros"); err != nil {
+		return nil, err
+	}
+	macros := make(map[string]string, len(rows))
+	for _, row := range rows {
+		macros[row.Macro] = row.Substitution
+	}
+	return macros, nil
+}
+
 func (ch *ClickHouse) GetVersionDescribe() string {
 	var result []string
 	query := "SELECT value FROM `system`.`build_options` where name='VERSION_DESCRIBE'"
@@ -351,9 +484,9 @@ func (ch *ClickHouse) GetVersionDescribe() string {
 	return result[0]
 }
 
-// FreezeTableOldWay - freeze all partitions in table one by one
+// FreezeTableOldWay - freeze all partitions in table one by one, only partitions from partitionsFilter are frozen when it is not empty
 // This way using for ClickHouse below v19.1
-func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string) error {
+func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string, partitionsFilter common.EmptyMap) error {
 	var partitions []struct {
 		PartitionID string `db:"partition_id"`
 	}
@@ -366,6 +499,9 @@ func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string) error {
 		withNameQuery = fmt.Sprintf("WITH NAME '%s'", name)
 	}
 	for _, item := range partitions {
+		if _, ok := partitionsFilter[item.PartitionID]; len(partitionsFilter) > 0 && !ok {
+			continue
+		}
 		log.Debugf("  partition '%v'", item.PartitionID)
 		query := fmt.Sprintf(
 			"ALTER TABLE `%v`.`%v` FREEZE PARTITION ID '%v' %s;",
@@ -382,7 +518,7 @@ func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string) error {
 				withNameQuery,
 			)
 		}
-		if _, err := ch.Query(query); err != nil {
+		if err := ch.freeze(query); err != nil {
 			if (strings.Contains(err.Error(), "code: 60") || strings.Contains(err.Error(), "code: 81")) && ch.Config.IgnoreNotExistsErrorDuringFreeze {
 				log.Warnf("can't freeze partition: %v", err)
 			} else {
@@ -393,9 +529,9 @@ func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string) error {
 	return nil
 }
 
-// FreezeTable - freeze all partitions for table
+// FreezeTable - freeze all partitions for table, only partitions from partitionsFilter are frozen when it is not empty
 // This way available for ClickHouse since v19.1
-func (ch *ClickHouse) FreezeTable(table *Table, name string) error {
+func (ch *ClickHouse) FreezeTable(table *Table, name string, partitionsFilter common.EmptyMap) error {
 	version, err := ch.GetVersion()
 	if err != nil {
 		return err
@@ -408,15 +544,15 @@ func (ch *ClickHouse) FreezeTable(table *Table, name string) error {
 			log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name)).Debugf("replica synced")
 		}
 	}
-	if version < 19001005 || ch.Config.FreezeByPart {
-		return ch.FreezeTableOldWay(table, name)
+	if version < 19001005 || ch.Config.FreezeByPart || len(partitionsFilter) > 0 {
+		return ch.FreezeTableOldWay(table, name, partitionsFilter)
 	}
 	withNameQuery := ""
 	if name != "" {
 		withNameQuery = fmt.Sprintf("WITH NAME '%s'", name)
 	}
 	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE %s;", table.Database, table.Name, withNameQuery)
-	if _, err := ch.Query(query); err != nil {
+	if err := ch.freeze(query); err != nil {
 		if (strings.Contains(err.Error(), "code: 60") || strings.Contains(err.Error(), "code: 81")) && ch.Config.IgnoreNotExistsErrorDuringFreeze {
 			log.Warnf("can't freeze table: %v", err)
 			return nil
@@ -443,6 +579,71 @@ func (ch *ClickHouse) AttachPartitions(table metadata.TableMetadata, disks []Dis
 	return nil
 }
 
+// GetPartNames - return names of active parts for table
+func (ch *ClickHouse) GetPartNames(database, table string) (common.EmptyMap, error) {
+	var partNames []string
+	if err := ch.Select(&partNames, "SELECT name FROM system.parts WHERE active AND database=? AND table=?", database, table); err != nil {
+		return nil, err
+	}
+	result := make(common.EmptyMap, len(partNames))
+	for _, name := range partNames {
+		result[name] = struct{}{}
+	}
+	return result, nil
+}
+
+// GetPartsRows - sum of rows in parts with partNames, inactive parts are counted too, so parts which were merged after FREEZE are found
+func (ch *ClickHouse) GetPartsRows(database, table string, partNames []string) (uint64, error) {
+	if len(partNames) == 0 {
+		return 0, nil
+	}
+	var rows []uint64
+	query := fmt.Sprintf("SELECT sum(rows) FROM (SELECT any(rows) AS rows FROM system.parts WHERE database=? AND table=? AND name IN ('%s') GROUP BY name)", strings.Join(partNames, "','"))
+	if err := ch.Select(&rows, query, database, table); err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return rows[0], nil
+}
+
+// GetRowsCount - result of SELECT count() for table
+func (ch *ClickHouse) GetRowsCount(database, table string) (uint64, error) {
+	var rows []uint64
+	if err := ch.Select(&rows, fmt.Sprintf("SELECT count() FROM `%s`.`%s`", database, table)); err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return rows[0], nil
+}
+
+// GetReplicaStatus - replicas of table, zero values for tables which are not replicated
+func (ch *ClickHouse) GetReplicaStatus(database, table string) (ReplicaStatus, error) {
+	var result []ReplicaStatus
+	query := "SELECT total_replicas, active_replicas FROM system.replicas WHERE database = ? AND table = ?"
+	if err := ch.Select(&result, query, database, table); err != nil {
+		return ReplicaStatus{}, err
+	}
+	if len(result) == 0 {
+		return ReplicaStatus{}, nil
+	}
+	return result[0], nil
+}
+
+// SyncReplica - wait until replica fetches parts from replication queue, limited by sync_replica_timeout instead of query_timeout
+func (ch *ClickHouse) SyncReplica(database, table string) error {
+	ctx, cancel := queryContext(ch.syncReplicaTimeout)
+	defer cancel()
+	_, err := ch.conn.ExecContext(ctx, ch.LogQuery(fmt.Sprintf("SYSTEM SYNC REPLICA `%s`.`%s`", database, table)))
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("sync_replica_timeout=%s exceeded: %v", ch.syncReplicaTimeout, err)
+	}
+	return err
+}
+
 func (ch *ClickHouse) ShowCreateTable(database, name string) string {
 	var result []struct {
 		Statement string `db:"statement"`
@@ -475,6 +676,24 @@ func (ch *ClickHouse) CreateDatabaseFromQuery(query string) error {
 	return err
 }
 
+// GetClusters - return cluster names from system.clusters
+func (ch *ClickHouse) GetClusters() ([]string, error) {
+	var clusters []string
+	if err := ch.Select(&clusters, "SELECT DISTINCT cluster FROM system.clusters ORDER BY cluster"); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// TableExists - check table, view or dictionary exists in system.tables
+func (ch *ClickHouse) TableExists(database, name string) (bool, error) {
+	var count []uint64
+	if err := ch.Select(&count, "SELECT count() FROM system.tables WHERE database = ? AND name = ?", database, name); err != nil {
+		return false, err
+	}
+	return len(count) > 0 && count[0] > 0, nil
+}
+
 // DropTable - drop ClickHouse table
 func (ch *ClickHouse) DropTable(table Table, query string, onCluster string, version int) error {
 	var isAtomic bool
@@ -682,7 +901,20 @@ func (ch *ClickHouse) GetPartitions(database, table string) (map[string][]metada
 }
 
 func (ch *ClickHouse) Query(query string, args ...interface{}) (sql.Result, error) {
-	return ch.conn.Exec(ch.LogQuery(query), args...)
+	ctx, cancel := queryContext(ch.queryTimeout)
+	defer cancel()
+	return ch.conn.ExecContext(ctx, ch.LogQuery(query), args...)
+}
+
+// freeze - execute FREEZE query which is limited by freeze_timeout instead of query_timeout
+func (ch *ClickHouse) freeze(query string) error {
+	ctx, cancel := queryContext(ch.freezeTimeout)
+	defer cancel()
+	_, err := ch.conn.ExecContext(ctx, ch.LogQuery(query))
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("freeze_timeout=%s exceeded: %v", ch.freezeTimeout, err)
+	}
+	return err
 }
 
 func (ch *ClickHouse) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
@@ -690,7 +922,25 @@ func (ch *ClickHouse) Queryx(query string, args ...interface{}) (*sqlx.Rows, err
 }
 
 func (ch *ClickHouse) Select(dest interface{}, query string, args ...interface{}) error {
-	return ch.conn.Select(dest, ch.LogQuery(query), args...)
+	ctx, cancel := queryContext(ch.queryTimeout)
+	defer cancel()
+	return ch.conn.SelectContext(ctx, dest, ch.LogQuery(query), args...)
+}
+
+// parseQueryTimeout - empty and zero timeout doesn't limit queries
+func parseQueryTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(timeout)
+}
+
+// queryContext - context for one query, it is cancelled after timeout when timeout is greater than zero
+func queryContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
 }
 
 func (ch *ClickHouse) LogQuery(query string) string {
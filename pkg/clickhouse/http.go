@@ -0,0 +1,390 @@
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	clickhouseDriver "github.com/ClickHouse/clickhouse-go"
+	"github.com/jmoiron/sqlx"
+)
+
+// connectHTTP - `protocol: http` connection, queries are sent to HTTP interface by the same sqlx methods as for native protocol
+func (ch *ClickHouse) connectHTTP(connectTimeout time.Duration) error {
+	connector, err := newHTTPConnector(ch.Config, connectTimeout)
+	if err != nil {
+		return err
+	}
+	ch.conn = sqlx.NewDb(sql.OpenDB(connector), "clickhouse")
+	ch.conn.SetMaxOpenConns(ch.maxOpenConns())
+	ch.conn.SetConnMaxLifetime(0)
+	ch.conn.SetMaxIdleConns(0)
+	return wrapConnectError(ch.Config, ch.conn.Ping())
+}
+
+// httpConnector - each query is separate POST request to ClickHouse HTTP interface, results are read in JSONCompact format,
+// `settings` from config are passed as URL parameters cause HTTP interface doesn't keep session between requests
+type httpConnector struct {
+	client   *http.Client
+	url      string
+	username string
+	password string
+}
+
+func newHTTPConnector(cfg *config.ClickHouseConfig, connectTimeout time.Duration) (*httpConnector, error) {
+	transport := &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{Timeout: connectTimeout}).DialContext,
+	}
+	scheme := "http"
+	if cfg.Secure {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+		transport.TLSHandshakeTimeout = connectTimeout
+		scheme = "https"
+	}
+	params := url.Values{}
+	params.Set("database", "system")
+	params.Set("default_format", "JSONCompact")
+	params.Set("output_format_json_quote_64bit_integers", "1")
+	if !cfg.LogSQLQueries {
+		params.Set("log_queries", "0")
+	}
+	for name, value := range cfg.Settings {
+		params.Set(name, value)
+	}
+	return &httpConnector{
+		client:   &http.Client{Transport: transport},
+		url:      fmt.Sprintf("%s://%s/?%s", scheme, net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)), params.Encode()),
+		username: cfg.Username,
+		password: cfg.Password,
+	}, nil
+}
+
+func (c *httpConnector) Connect(context.Context) (driver.Conn, error) {
+	return &httpConn{c}, nil
+}
+
+func (c *httpConnector) Driver() driver.Driver {
+	return httpDriver{}
+}
+
+type httpDriver struct{}
+
+func (httpDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("clickhouse http driver can be used only by connector")
+}
+
+type httpConn struct {
+	*httpConnector
+}
+
+func (c *httpConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepared statements are not supported by clickhouse protocol: http")
+}
+
+func (c *httpConn) Close() error {
+	return nil
+}
+
+func (c *httpConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported by clickhouse protocol: http")
+}
+
+func (c *httpConn) Ping(ctx context.Context) error {
+	_, err := c.ExecContext(ctx, "SELECT 1", nil)
+	return err
+}
+
+func (c *httpConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	body, err := c.post(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, body)
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *httpConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	body, err := c.post(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return readJSONCompact(body)
+}
+
+// sessionQueryRE - queries which change session, HTTP interface forgets session state after each request
+var sessionQueryRE = regexp.MustCompile(`(?i)^\s*(SET|USE)\s`)
+
+func (c *httpConn) post(ctx context.Context, query string, args []driver.NamedValue) (io.ReadCloser, error) {
+	if sessionQueryRE.MatchString(query) {
+		return nil, fmt.Errorf("`%s` requires session which clickhouse protocol: http doesn't keep between queries, use clickhouse `settings` in config or protocol: native", strings.TrimSpace(query))
+	}
+	query, err := bindHTTPArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, httpException(resp, string(message))
+	}
+	return resp.Body, nil
+}
+
+var httpExceptionRE = regexp.MustCompile(`^Code: (\d+)\. (?:DB::Exception: )?`)
+
+// httpException - ClickHouse errors are returned as clickhouse-go Exception, so error codes are checked in the same way for both protocols
+func httpException(resp *http.Response, message string) error {
+	message = strings.TrimSpace(message)
+	code, err := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code"))
+	if match := httpExceptionRE.FindStringSubmatch(message); match != nil {
+		if err != nil {
+			code, err = strconv.Atoi(match[1])
+		}
+		message = strings.TrimPrefix(message, match[0])
+	}
+	if err != nil {
+		return fmt.Errorf("clickhouse http interface returned %s: %s", resp.Status, message)
+	}
+	return &clickhouseDriver.Exception{Code: int32(code), Message: message}
+}
+
+// bindHTTPArgs - HTTP interface doesn't bind `?` placeholders, args are quoted into query, placeholders inside quotes are kept
+func bindHTTPArgs(query string, args []driver.NamedValue) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+	var result strings.Builder
+	var quote rune
+	escaped := false
+	argIndex := 0
+	for _, r := range query {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '\'' || r == '`' || r == '"'):
+			quote = r
+		case quote == 0 && r == '?':
+			if argIndex >= len(args) {
+				return "", fmt.Errorf("query has more placeholders than %d args", len(args))
+			}
+			literal, err := httpLiteral(args[argIndex].Value)
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(literal)
+			argIndex++
+			continue
+		}
+		result.WriteRune(r)
+	}
+	if argIndex != len(args) {
+		return "", fmt.Errorf("query has %d placeholders for %d args", argIndex, len(args))
+	}
+	return result.String(), nil
+}
+
+func httpLiteral(value driver.Value) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return quoteHTTPString(v), nil
+	case []byte:
+		return quoteHTTPString(string(v)), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		return quoteHTTPString(v.Format("2006-01-02 15:04:05")), nil
+	}
+	return "", fmt.Errorf("unsupported query arg type %T", value)
+}
+
+func quoteHTTPString(value string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(value, "\\", "\\\\"), "'", "\\'") + "'"
+}
+
+type jsonCompactColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type jsonCompactResult struct {
+	Meta []jsonCompactColumn `json:"meta"`
+	Data [][]json.RawMessage `json:"data"`
+}
+
+// readJSONCompact - convert JSONCompact result into driver values by column types, empty body is returned by queries without result
+func readJSONCompact(body io.Reader) (*httpRows, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	rows := &httpRows{}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return rows, nil
+	}
+	var result jsonCompactResult
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("can't parse clickhouse JSONCompact response: %v", err)
+	}
+	for _, column := range result.Meta {
+		rows.columns = append(rows.columns, column.Name)
+	}
+	for _, data := range result.Data {
+		if len(data) != len(result.Meta) {
+			return nil, fmt.Errorf("clickhouse JSONCompact row has %d values for %d columns", len(data), len(result.Meta))
+		}
+		row := make([]driver.Value, len(data))
+		for i := range data {
+			if row[i], err = httpValue(result.Meta[i].Type, data[i]); err != nil {
+				return nil, fmt.Errorf("can't parse column %s: %v", result.Meta[i].Name, err)
+			}
+		}
+		rows.data = append(rows.data, row)
+	}
+	return rows, nil
+}
+
+// unwrapHTTPType - Nullable and LowCardinality don't change JSON representation of values
+func unwrapHTTPType(typ string) string {
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		if strings.HasPrefix(typ, wrapper) && strings.HasSuffix(typ, ")") {
+			return unwrapHTTPType(typ[len(wrapper) : len(typ)-1])
+		}
+	}
+	return typ
+}
+
+// httpValue - value with the same Go type as clickhouse-go returns for native protocol, 64-bit integers are quoted in JSON
+func httpValue(typ string, raw json.RawMessage) (driver.Value, error) {
+	typ = unwrapHTTPType(typ)
+	if string(raw) == "null" {
+		return nil, nil
+	}
+	if strings.HasPrefix(typ, "Array(") && strings.HasSuffix(typ, ")") {
+		return httpArray(typ[len("Array("):len(typ)-1], raw)
+	}
+	text := string(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case typ == "UInt8" || typ == "UInt16" || typ == "UInt32" || typ == "UInt64":
+		return strconv.ParseUint(text, 10, 64)
+	case typ == "Int8" || typ == "Int16" || typ == "Int32" || typ == "Int64":
+		return strconv.ParseInt(text, 10, 64)
+	case typ == "Float32" || typ == "Float64":
+		return strconv.ParseFloat(text, 64)
+	case typ == "Bool":
+		return strconv.ParseBool(text)
+	case typ == "Date" || typ == "Date32":
+		return time.ParseInLocation("2006-01-02", text, time.Local)
+	case strings.HasPrefix(typ, "DateTime"):
+		return time.ParseInLocation("2006-01-02 15:04:05.999999999", text, time.Local)
+	}
+	return text, nil
+}
+
+// httpArray - arrays of strings and integers are returned as typed slices which sqlx scans into struct fields
+func httpArray(elementType string, raw json.RawMessage) (driver.Value, error) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(raw, &elements); err != nil {
+		return nil, err
+	}
+	values := make([]driver.Value, len(elements))
+	for i := range elements {
+		value, err := httpValue(elementType, elements[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	switch unwrapHTTPType(elementType) {
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		result := make([]uint64, len(values))
+		for i := range values {
+			result[i], _ = values[i].(uint64)
+		}
+		return result, nil
+	case "Int8", "Int16", "Int32", "Int64":
+		result := make([]int64, len(values))
+		for i := range values {
+			result[i], _ = values[i].(int64)
+		}
+		return result, nil
+	}
+	result := make([]string, len(values))
+	for i := range values {
+		result[i] = fmt.Sprint(values[i])
+	}
+	return result, nil
+}
+
+type httpRows struct {
+	columns []string
+	data    [][]driver.Value
+	current int
+}
+
+func (r *httpRows) Columns() []string {
+	return r.columns
+}
+
+func (r *httpRows) Close() error {
+	return nil
+}
+
+func (r *httpRows) Next(dest []driver.Value) error {
+	if r.current >= len(r.data) {
+		return io.EOF
+	}
+	copy(dest, r.data[r.current])
+	r.current++
+	return nil
+}
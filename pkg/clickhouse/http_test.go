@@ -0,0 +1,151 @@
+package clickhouse
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestHTTPProtocol(t *testing.T) {
+	var queries []string
+	responses := map[string]string{
+		"SELECT 1": `{"meta":[{"name":"1","type":"UInt8"}],"data":[[1]]}`,
+		"SELECT value FROM `system`.`build_options` where name='VERSION_INTEGER'": `{"meta":[{"name":"value","type":"String"}],"data":[["22003001"]]}`,
+		"SELECT * FROM system.disks;": `{"meta":[{"name":"name","type":"String"},{"name":"path","type":"String"},{"name":"free_space","type":"UInt64"},{"name":"type","type":"LowCardinality(String)"}],
+			"data":[["default","/var/lib/clickhouse/","18446744073709551615","local"]]}`,
+		"SELECT database, name, data_paths, total_bytes, modification_time FROM system.tables WHERE name = 'it\\'s'": `{"meta":[{"name":"database","type":"String"},{"name":"name","type":"String"},{"name":"data_paths","type":"Array(String)"},{"name":"total_bytes","type":"Nullable(UInt64)"},{"name":"modification_time","type":"DateTime"}],
+			"data":[["default","it's",["/var/lib/clickhouse/store/123/"],null,"2022-03-01 10:20:30"]]}`,
+		"ALTER TABLE `default`.`t` FREEZE WITH NAME 'backup'": "",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if username != "backup" || password != "secret" {
+			w.Header().Set("X-ClickHouse-Exception-Code", "516")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("Code: 516. DB::Exception: backup: Authentication failed. (AUTHENTICATION_FAILED)\n"))
+			return
+		}
+		assert.Equal(t, "JSONCompact", r.URL.Query().Get("default_format"))
+		assert.Equal(t, "system", r.URL.Query().Get("database"))
+		assert.Equal(t, "3600", r.URL.Query().Get("receive_timeout"))
+		body, _ := ioutil.ReadAll(r.Body)
+		queries = append(queries, string(body))
+		response, ok := responses[string(body)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("Code: 60. DB::Exception: Table default.missing doesn't exist. (UNKNOWN_TABLE)"))
+			return
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	portNumber, _ := strconv.Atoi(port)
+	newClickHouse := func(password string) *ClickHouse {
+		return &ClickHouse{Config: &config.ClickHouseConfig{
+			Host: host, Port: uint(portNumber), Protocol: "http", Username: "backup", Password: password, Timeout: "5s",
+			Settings: map[string]string{"receive_timeout": "3600"},
+		}}
+	}
+
+	err = newClickHouse("wrong").Connect()
+	assert.EqualError(t, err, "clickhouse authentication failed for user 'backup', check username and password: code: 516, message: backup: Authentication failed. (AUTHENTICATION_FAILED)")
+
+	ch := newClickHouse("secret")
+	assert.NoError(t, ch.Connect())
+	defer ch.Close()
+	disks, err := ch.GetDisks()
+	assert.NoError(t, err)
+	assert.Equal(t, []Disk{{Name: "default", Path: "/var/lib/clickhouse/", Type: "local"}}, disks)
+
+	var tables []struct {
+		Database         string    `db:"database"`
+		Name             string    `db:"name"`
+		DataPaths        []string  `db:"data_paths"`
+		TotalBytes       *uint64   `db:"total_bytes"`
+		ModificationTime time.Time `db:"modification_time"`
+	}
+	assert.NoError(t, ch.Select(&tables, "SELECT database, name, data_paths, total_bytes, modification_time FROM system.tables WHERE name = ?", "it's"))
+	assert.Len(t, tables, 1)
+	assert.Equal(t, []string{"/var/lib/clickhouse/store/123/"}, tables[0].DataPaths)
+	assert.Nil(t, tables[0].TotalBytes)
+	assert.Equal(t, time.Date(2022, 3, 1, 10, 20, 30, 0, time.Local), tables[0].ModificationTime)
+
+	_, err = ch.Query("ALTER TABLE `default`.`t` FREEZE WITH NAME 'backup'")
+	assert.NoError(t, err)
+	_, err = ch.Query("SELECT * FROM `default`.`missing`")
+	assert.EqualError(t, err, "code: 60, message: Table default.missing doesn't exist. (UNKNOWN_TABLE)")
+
+	queriesCount := len(queries)
+	_, err = ch.Query("SET max_threads = 1")
+	assert.EqualError(t, err, "`SET max_threads = 1` requires session which clickhouse protocol: http doesn't keep between queries, use clickhouse `settings` in config or protocol: native")
+	assert.Len(t, queries, queriesCount, "session queries are not sent")
+}
+
+func TestBindHTTPArgs(t *testing.T) {
+	query, err := bindHTTPArgs("SELECT '?', `a?` FROM t WHERE a = ? AND b = ? AND c = 'it\\'s?'", []driver.NamedValue{{Value: "x'y\\"}, {Value: int64(10)}})
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT '?', `a?` FROM t WHERE a = 'x\\'y\\\\' AND b = 10 AND c = 'it\\'s?'", query)
+	_, err = bindHTTPArgs("SELECT ?", []driver.NamedValue{{Value: int64(1)}, {Value: int64(2)}})
+	assert.EqualError(t, err, "query has 1 placeholders for 2 args")
+}
+
+func TestFreezeConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query := string(body)
+		switch {
+		case strings.Contains(query, "VERSION_INTEGER"):
+			_, _ = w.Write([]byte(`{"meta":[{"name":"value","type":"String"}],"data":[["22003001"]]}`))
+		case strings.Contains(query, "FREEZE"):
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+		default:
+			_, _ = w.Write([]byte(`{"meta":[{"name":"1","type":"UInt8"}],"data":[[1]]}`))
+		}
+	}))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	portNumber, _ := strconv.Atoi(port)
+	for freezeConcurrency, expected := range map[int]int{0: 1, 1: 1, 2: 2} {
+		ch := &ClickHouse{Config: &config.ClickHouseConfig{Host: host, Port: uint(portNumber), Protocol: "http", Timeout: "5s", FreezeConcurrency: freezeConcurrency}}
+		assert.NoError(t, ch.Connect())
+		_, err = ch.GetVersion()
+		assert.NoError(t, err)
+		maxRunning = 0
+		g := errgroup.Group{}
+		for i := 0; i < 6; i++ {
+			table := &Table{Database: "default", Name: fmt.Sprintf("t%d", i)}
+			g.Go(func() error {
+				return ch.FreezeTable(table, "backup_"+table.Name, nil)
+			})
+		}
+		assert.NoError(t, g.Wait())
+		assert.Equal(t, expected, maxRunning, "freeze_concurrency=%d", freezeConcurrency)
+		ch.Close()
+	}
+}
@@ -2,11 +2,11 @@ package clickhouse
 
 import (
 	"fmt"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 )
 
@@ -113,8 +113,8 @@ func (ch *ClickHouse) GetBackupTablesLegacy(backupName string) ([]metadata.Table
 				return nil
 			}
 
-			tDB, _ := url.PathUnescape(parts[dbNum])
-			tName, _ := url.PathUnescape(parts[tableNum])
+			tDB, _ := common.TablePathDecode(parts[dbNum])
+			tName, _ := common.TablePathDecode(parts[tableNum])
 			fullTableName := fmt.Sprintf("%s.%s", tDB, tName)
 
 			allparthash := allpartsBackup[fullTableName]
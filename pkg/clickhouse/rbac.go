@@ -0,0 +1,139 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/apex/log"
+)
+
+// rbacEntity - type of access entity and system table which lists entities of this type
+type rbacEntity struct {
+	Type  string
+	Table string
+}
+
+// rbacEntities - access entities in order of creation: users reference roles and settings profiles by DEFAULT ROLE and SETTINGS PROFILE,
+// quotas and row policies reference users and roles by TO clause
+var rbacEntities = []rbacEntity{
+	{"ROLE", "roles"},
+	{"SETTINGS PROFILE", "settings_profiles"},
+	{"USER", "users"},
+	{"QUOTA", "quotas"},
+	{"ROW POLICY", "row_policies"},
+}
+
+// rbacReadOnlyStorage - storage of entities from users.xml, they can't be created by SQL
+const rbacReadOnlyStorage = "users.xml"
+
+type rbacEntityName struct {
+	Name      string `db:"name"`
+	ShortName string `db:"short_name"`
+	Database  string `db:"database"`
+	Table     string `db:"table"`
+}
+
+// quoteRBACName - name of access entity in backquotes
+func quoteRBACName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+// getRBACNames - names of entities of type, entities from users.xml are skipped when withReadOnly is false
+func (ch *ClickHouse) getRBACNames(entity rbacEntity, withReadOnly bool) ([]rbacEntityName, error) {
+	columns := "name, name AS short_name, '' AS database, '' AS table"
+	if entity.Type == "ROW POLICY" {
+		columns = "name, short_name, database, table"
+	}
+	query := fmt.Sprintf("SELECT %s FROM system.%s", columns, entity.Table)
+	if !withReadOnly {
+		query += fmt.Sprintf(" WHERE storage != '%s'", rbacReadOnlyStorage)
+	}
+	var names []rbacEntityName
+	if err := ch.Select(&names, query+" ORDER BY name"); err != nil {
+		return nil, fmt.Errorf("can't get names of %s: %v", strings.ToLower(entity.Type), err)
+	}
+	return names, nil
+}
+
+// GetRBACObjects - SHOW CREATE of roles, settings profiles, users, quotas and row policies which are created by SQL, with SHOW GRANTS of roles and users,
+// entities from users.xml are skipped, result is ordered by rbacEntities
+func (ch *ClickHouse) GetRBACObjects() ([]metadata.RBACObject, error) {
+	var objects []metadata.RBACObject
+	for _, entity := range rbacEntities {
+		names, err := ch.getRBACNames(entity, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			target := quoteRBACName(name.ShortName)
+			if entity.Type == "ROW POLICY" {
+				target += fmt.Sprintf(" ON %s.%s", quoteRBACName(name.Database), quoteRBACName(name.Table))
+			}
+			var create []string
+			if err := ch.Select(&create, fmt.Sprintf("SHOW CREATE %s %s", entity.Type, target)); err != nil || len(create) == 0 {
+				return nil, fmt.Errorf("can't show create %s %s: %v", strings.ToLower(entity.Type), name.Name, err)
+			}
+			object := metadata.RBACObject{Type: entity.Type, Name: name.Name, Create: create[0]}
+			if entity.Type == "ROLE" || entity.Type == "USER" {
+				if err := ch.Select(&object.Grants, fmt.Sprintf("SHOW GRANTS FOR %s", target)); err != nil {
+					return nil, fmt.Errorf("can't show grants for %s %s: %v", strings.ToLower(entity.Type), name.Name, err)
+				}
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// CreateRBACObjects - create access entities which don't exist yet and apply their grants, existing entities are not changed,
+// statements are executed in order of rbacEntities with grants after all entities, failed statements are repeated while other statements succeed,
+// because entity could reference entity of the next type, like settings profile which is assigned to user, return names of created entities
+func (ch *ClickHouse) CreateRBACObjects(objects []metadata.RBACObject) ([]string, error) {
+	existing := map[string]bool{}
+	for _, entity := range rbacEntities {
+		names, err := ch.getRBACNames(entity, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			existing[entity.Type+" "+name.Name] = true
+		}
+	}
+	rank := map[string]int{}
+	for i, entity := range rbacEntities {
+		rank[entity.Type] = i
+	}
+	sorted := append([]metadata.RBACObject{}, objects...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank[sorted[i].Type] < rank[sorted[j].Type]
+	})
+	var created, statements, grants []string
+	for _, object := range sorted {
+		if existing[object.Type+" "+object.Name] {
+			log.Warnf("%s %s already exists, skip", strings.ToLower(object.Type), object.Name)
+			continue
+		}
+		statements = append(statements, object.Create)
+		grants = append(grants, object.Grants...)
+		created = append(created, fmt.Sprintf("%s %s", strings.ToLower(object.Type), object.Name))
+	}
+	statements = append(statements, grants...)
+	for len(statements) > 0 {
+		var failed []string
+		var lastErr error
+		for _, statement := range statements {
+			if _, err := ch.Query(statement); err != nil {
+				log.Debugf("%s failed, it will be repeated after other statements: %v", statement, err)
+				failed = append(failed, statement)
+				lastErr = err
+			}
+		}
+		if len(failed) == len(statements) {
+			return nil, fmt.Errorf("can't execute %d RBAC statements, the first one is `%s`: %v", len(failed), failed[0], lastErr)
+		}
+		statements = failed
+	}
+	return created, nil
+}
@@ -0,0 +1,114 @@
+package clickhouse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func rbacNamesResponse(rows ...[4]string) string {
+	data := make([]string, len(rows))
+	for i, row := range rows {
+		data[i] = fmt.Sprintf("[%q,%q,%q,%q]", row[0], row[1], row[2], row[3])
+	}
+	return `{"meta":[{"name":"name","type":"String"},{"name":"short_name","type":"String"},{"name":"database","type":"String"},{"name":"table","type":"String"}],` +
+		`"data":[` + strings.Join(data, ",") + `]}`
+}
+
+func stringsResponse(values ...string) string {
+	data := make([]string, len(values))
+	for i, value := range values {
+		data[i] = fmt.Sprintf("[%q]", value)
+	}
+	return `{"meta":[{"name":"statement","type":"String"}],"data":[` + strings.Join(data, ",") + `]}`
+}
+
+func TestRBACObjects(t *testing.T) {
+	const namesQuery = "SELECT name, name AS short_name, '' AS database, '' AS table FROM system.%s"
+	responses := map[string]string{
+		"SELECT 1": `{"meta":[{"name":"1","type":"UInt8"}],"data":[[1]]}`,
+		fmt.Sprintf(namesQuery, "roles") + " WHERE storage != 'users.xml' ORDER BY name":                               rbacNamesResponse([4]string{"admin", "admin"}),
+		fmt.Sprintf(namesQuery, "settings_profiles") + " WHERE storage != 'users.xml' ORDER BY name":                   rbacNamesResponse([4]string{"readonly", "readonly"}),
+		fmt.Sprintf(namesQuery, "users") + " WHERE storage != 'users.xml' ORDER BY name":                               rbacNamesResponse([4]string{"alice", "alice"}),
+		fmt.Sprintf(namesQuery, "quotas") + " WHERE storage != 'users.xml' ORDER BY name":                              rbacNamesResponse(),
+		"SELECT name, short_name, database, table FROM system.row_policies WHERE storage != 'users.xml' ORDER BY name": rbacNamesResponse([4]string{"filter ON db.t", "filter", "db", "t"}),
+		"SHOW CREATE ROLE `admin`":                                                        stringsResponse("CREATE ROLE admin"),
+		"SHOW GRANTS FOR `admin`":                                                         stringsResponse("GRANT SELECT ON db.* TO admin"),
+		"SHOW CREATE SETTINGS PROFILE `readonly`":                                         stringsResponse("CREATE SETTINGS PROFILE readonly SETTINGS readonly = 1 TO alice"),
+		"SHOW CREATE USER `alice`":                                                        stringsResponse("CREATE USER alice IDENTIFIED WITH sha256_hash BY '0123' DEFAULT ROLE admin"),
+		"SHOW GRANTS FOR `alice`":                                                         stringsResponse("GRANT admin TO alice"),
+		"SHOW CREATE ROW POLICY `filter` ON `db`.`t`":                                     stringsResponse("CREATE ROW POLICY filter ON db.t FOR SELECT USING id = 1 TO admin"),
+		fmt.Sprintf(namesQuery, "roles") + " ORDER BY name":                               rbacNamesResponse(),
+		fmt.Sprintf(namesQuery, "settings_profiles") + " ORDER BY name":                   rbacNamesResponse(),
+		fmt.Sprintf(namesQuery, "users") + " ORDER BY name":                               rbacNamesResponse([4]string{"default", "default"}),
+		fmt.Sprintf(namesQuery, "quotas") + " ORDER BY name":                              rbacNamesResponse(),
+		"SELECT name, short_name, database, table FROM system.row_policies ORDER BY name": rbacNamesResponse(),
+	}
+	var executed []string
+	created := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query := string(body)
+		if response, ok := responses[query]; ok {
+			_, _ = w.Write([]byte(response))
+			return
+		}
+		// statements fail until user or role from TO clause exists
+		if to := strings.Index(query, " TO "); to >= 0 && !created[strings.Fields(query[to+4:])[0]] {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("Code: 192. DB::Exception: There is no user or role. (UNKNOWN_USER)"))
+			return
+		}
+		executed = append(executed, query)
+		for _, entity := range rbacEntities {
+			if prefix := "CREATE " + entity.Type + " "; strings.HasPrefix(query, prefix) {
+				created[strings.Fields(strings.TrimPrefix(query, prefix))[0]] = true
+			}
+		}
+	}))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	portNumber, _ := strconv.Atoi(port)
+	ch := &ClickHouse{Config: &config.ClickHouseConfig{Host: host, Port: uint(portNumber), Protocol: "http", Timeout: "5s"}}
+	assert.NoError(t, ch.Connect())
+	defer ch.Close()
+
+	objects, err := ch.GetRBACObjects()
+	assert.NoError(t, err)
+	assert.Equal(t, []metadata.RBACObject{
+		{Type: "ROLE", Name: "admin", Create: "CREATE ROLE admin", Grants: []string{"GRANT SELECT ON db.* TO admin"}},
+		{Type: "SETTINGS PROFILE", Name: "readonly", Create: "CREATE SETTINGS PROFILE readonly SETTINGS readonly = 1 TO alice"},
+		{Type: "USER", Name: "alice", Create: "CREATE USER alice IDENTIFIED WITH sha256_hash BY '0123' DEFAULT ROLE admin", Grants: []string{"GRANT admin TO alice"}},
+		{Type: "ROW POLICY", Name: "filter ON db.t", Create: "CREATE ROW POLICY filter ON db.t FOR SELECT USING id = 1 TO admin"},
+	}, objects)
+
+	// entities are created in backup order, existing user is skipped, profile waits for user
+	objects = append([]metadata.RBACObject{{Type: "USER", Name: "default", Create: "CREATE USER default"}}, objects...)
+	names, err := ch.CreateRBACObjects(objects)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"role admin", "settings profile readonly", "user alice", "row policy filter ON db.t"}, names)
+	assert.Equal(t, []string{
+		"CREATE ROLE admin",
+		"CREATE USER alice IDENTIFIED WITH sha256_hash BY '0123' DEFAULT ROLE admin",
+		"CREATE ROW POLICY filter ON db.t FOR SELECT USING id = 1 TO admin",
+		"GRANT SELECT ON db.* TO admin",
+		"GRANT admin TO alice",
+		"CREATE SETTINGS PROFILE readonly SETTINGS readonly = 1 TO alice",
+	}, executed)
+
+	executed = nil
+	_, err = ch.CreateRBACObjects([]metadata.RBACObject{{Type: "QUOTA", Name: "q", Create: "CREATE QUOTA q TO bob"}})
+	assert.EqualError(t, err, "can't execute 1 RBAC statements, the first one is `CREATE QUOTA q TO bob`: "+
+		"code: 192, message: There is no user or role. (UNKNOWN_USER)")
+	assert.Empty(t, executed)
+}
@@ -0,0 +1,95 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	clickhouseDriver "github.com/ClickHouse/clickhouse-go"
+)
+
+// settingsDriverName - clickhouse-go driver wrapped by settingsDriver
+const settingsDriverName = "clickhouse-backup"
+
+// settingsParamPrefix - DSN parameters with this prefix are `settings` from config, clickhouse-go ignores them
+const settingsParamPrefix = "setting_"
+
+func init() {
+	sql.Register(settingsDriverName, &settingsDriver{open: clickhouseDriver.Open})
+}
+
+// settingsDriver - clickhouse-go passes only settings which it knows from DSN and silently drops others,
+// so each setting is applied by SET on every new connection and unknown or invalid setting fails connection with server error,
+// open is clickhouse-go driver
+type settingsDriver struct {
+	open func(dsn string) (driver.Conn, error)
+}
+
+func (d *settingsDriver) Open(dsn string) (driver.Conn, error) {
+	dsn, settings, err := splitSettingsDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok && len(settings) > 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("clickhouse driver doesn't support settings")
+	}
+	for _, setting := range settings {
+		if _, err := execer.ExecContext(context.Background(), setting, nil); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("can't apply clickhouse setting `%s`: %v", strings.TrimPrefix(setting, "SET "), err)
+		}
+	}
+	return conn, nil
+}
+
+// settingsParams - DSN parameters for `settings` from config
+func settingsParams(params url.Values, settings map[string]string) {
+	for name, value := range settings {
+		params.Add(settingsParamPrefix+name, value)
+	}
+}
+
+// splitSettingsDSN - remove `settings` parameters from DSN and return SET queries for them sorted by setting name
+func splitSettingsDSN(dsn string) (string, []string, error) {
+	dsnURL, err := url.Parse(dsn)
+	if err != nil {
+		return "", nil, err
+	}
+	params := dsnURL.Query()
+	var names []string
+	for param := range params {
+		if strings.HasPrefix(param, settingsParamPrefix) {
+			names = append(names, strings.TrimPrefix(param, settingsParamPrefix))
+		}
+	}
+	sort.Strings(names)
+	settings := make([]string, 0, len(names))
+	for _, name := range names {
+		settings = append(settings, fmt.Sprintf("SET %s = %s", name, settingLiteral(params.Get(settingsParamPrefix+name))))
+		params.Del(settingsParamPrefix + name)
+	}
+	dsnURL.RawQuery = params.Encode()
+	return dsnURL.String(), settings, nil
+}
+
+// settingLiteral - numbers, booleans and quoted strings are passed as is, other values are quoted
+func settingLiteral(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	if value == "true" || value == "false" || (len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'")) {
+		return value
+	}
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(value, "\\", "\\\\"), "'", "\\'") + "'"
+}
@@ -0,0 +1,111 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitSettingsDSN(t *testing.T) {
+	params := url.Values{}
+	params.Add("username", "default")
+	settingsParams(params, map[string]string{
+		"receive_timeout":                 "3600",
+		"allow_experimental_object_type":  "1",
+		"join_algorithm":                  "partial_merge",
+		"distributed_product_mode":        "'local'",
+		"insert_deduplication_token_name": "it's",
+	})
+	dsn, settings, err := splitSettingsDSN("tcp://localhost:9000?" + params.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://localhost:9000?username=default", dsn)
+	assert.Equal(t, []string{
+		"SET allow_experimental_object_type = 1",
+		"SET distributed_product_mode = 'local'",
+		"SET insert_deduplication_token_name = 'it\\'s'",
+		"SET join_algorithm = 'partial_merge'",
+		"SET receive_timeout = 3600",
+	}, settings)
+
+	dsn, settings, err = splitSettingsDSN("tcp://localhost:9000?username=default")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://localhost:9000?username=default", dsn)
+	assert.Empty(t, settings)
+}
+
+func TestQueryContext(t *testing.T) {
+	ctx, cancel := queryContext(0)
+	_, hasDeadline := ctx.Deadline()
+	assert.False(t, hasDeadline)
+	cancel()
+
+	timeout, err := parseQueryTimeout("2h")
+	assert.NoError(t, err)
+	ctx, cancel = queryContext(timeout)
+	defer cancel()
+	_, hasDeadline = ctx.Deadline()
+	assert.True(t, hasDeadline)
+
+	timeout, err = parseQueryTimeout("")
+	assert.NoError(t, err)
+	assert.Zero(t, timeout)
+}
+
+// recordingConn - driver connection which records executed statements into shared log, each statement is prefixed by id of connection
+type recordingConn struct {
+	id  int
+	log *[]string
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare isn't supported")
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("begin isn't supported") }
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	*c.log = append(*c.log, fmt.Sprintf("%d: %s", c.id, query))
+	return driver.RowsAffected(0), nil
+}
+
+func TestSettingsAppliedBeforeEachStatement(t *testing.T) {
+	var statements []string
+	var openedDSN []string
+	sql.Register("clickhouse-backup-settings-test", &settingsDriver{open: func(dsn string) (driver.Conn, error) {
+		openedDSN = append(openedDSN, dsn)
+		return &recordingConn{id: len(openedDSN), log: &statements}, nil
+	}})
+	ch := &ClickHouse{Config: &config.ClickHouseConfig{
+		Settings: map[string]string{"max_execution_time": "3600", "lock_acquire_timeout": "600"},
+	}, version: 21008000}
+	params := url.Values{}
+	params.Add("username", "default")
+	settingsParams(params, ch.Config.Settings)
+	assert.NoError(t, ch.openDB("clickhouse-backup-settings-test", "tcp://localhost:9000?"+params.Encode()))
+	defer ch.Close()
+
+	assert.NoError(t, ch.FreezeTable(&Table{Database: "default", Name: "t1"}, "shadow1", nil))
+	assert.NoError(t, ch.CreateTable(Table{Database: "default", Name: "t1"}, "CREATE TABLE default.t1 (id UInt64) ENGINE=MergeTree() ORDER BY id", false, "", 21008000))
+	assert.NoError(t, ch.AttachPartitions(metadata.TableMetadata{Database: "default", Table: "t1", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}, []Disk{{Name: "default"}}))
+
+	assert.Equal(t, []string{
+		"1: SET lock_acquire_timeout = 600",
+		"1: SET max_execution_time = 3600",
+		"1: ALTER TABLE `default`.`t1` FREEZE WITH NAME 'shadow1';",
+		"2: SET lock_acquire_timeout = 600",
+		"2: SET max_execution_time = 3600",
+		"2: CREATE TABLE default.t1 (id UInt64) ENGINE=MergeTree() ORDER BY id",
+		"3: SET lock_acquire_timeout = 600",
+		"3: SET max_execution_time = 3600",
+		"3: ALTER TABLE `default`.`t1` ATTACH PART 'all_1_1_0'",
+	}, statements)
+	for _, dsn := range openedDSN {
+		assert.Equal(t, "tcp://localhost:9000?username=default", dsn, "settings shall not be passed to clickhouse-go")
+	}
+}
@@ -32,6 +32,8 @@ type Disk struct {
 	Name string `db:"name"`
 	Path string `db:"path"`
 	Type string `db:"type"`
+	// MappedOnly - disk is absent in system.disks and defined only in disk_mapping
+	MappedOnly bool `db:"-"`
 }
 
 // Database - Clickhouse system.databases struct
@@ -55,3 +57,25 @@ type partition struct {
 	ModificationTime                  time.Time `db:"modification_time"`
 	DataUncompressedBytes             int64     `db:"data_uncompressed_bytes"`
 }
+
+// ReplicaStatus - replicas of replicated table from system.replicas
+type ReplicaStatus struct {
+	TotalReplicas  uint64 `db:"total_replicas"`
+	ActiveReplicas uint64 `db:"active_replicas"`
+}
+
+// PartsSize - sum of bytes_on_disk of active parts from system.parts for one table on one disk
+type PartsSize struct {
+	Database string `db:"database"`
+	Table    string `db:"table"`
+	Disk     string `db:"disk"`
+	Size     uint64 `db:"size"`
+}
+
+// ActivePart - name of active part from system.parts for one table on one disk
+type ActivePart struct {
+	Database string `db:"database"`
+	Table    string `db:"table"`
+	Disk     string `db:"disk"`
+	Name     string `db:"name"`
+}
@@ -0,0 +1,123 @@
+package clickhouse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	clickhouseDriver "github.com/ClickHouse/clickhouse-go"
+)
+
+// authErrorCodes - UNKNOWN_USER, WRONG_PASSWORD, REQUIRED_PASSWORD, AUTHENTICATION_FAILED
+var authErrorCodes = map[int32]bool{192: true, 193: true, 194: true, 516: true}
+
+// newTLSConfig - build tls.Config for native protocol connection from tls_ca, tls_cert and tls_key,
+// ServerName is set to host for SNI and server certificate hostname verification
+func newTLSConfig(cfg *config.ClickHouseConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.Host,
+		InsecureSkipVerify: cfg.SkipVerify,
+	}
+	if cfg.TLSCa != "" {
+		caCert, err := ioutil.ReadFile(cfg.TLSCa)
+		if err != nil {
+			return nil, fmt.Errorf("can't read clickhouse tls_ca: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("can't parse clickhouse tls_ca %s: no PEM certificates found", cfg.TLSCa)
+		}
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load clickhouse tls_cert and tls_key: %v", err)
+		}
+		if err := checkCertificatePeriod(cfg.TLSCert, cert, time.Now()); err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// checkCertificatePeriod - server rejects expired client certificate only by TLS alert without reason, so validity period of tls_cert is checked before connect
+func checkCertificatePeriod(certFile string, cert tls.Certificate, now time.Time) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("can't parse clickhouse tls_cert %s: %v", certFile, err)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("clickhouse tls_cert %s expired at %s", certFile, leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("clickhouse tls_cert %s is not valid before %s", certFile, leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// registerTLSConfig - register tls.Config in clickhouse driver and return its name for `tls_config` DSN parameter
+func registerTLSConfig(cfg *config.ClickHouseConfig) (string, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("clickhouse-backup-%s", net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)))
+	if err := clickhouseDriver.RegisterTLSConfig(name, tlsConfig); err != nil {
+		return "", fmt.Errorf("can't register clickhouse tls config: %v", err)
+	}
+	return name, nil
+}
+
+// ErrConnection - Connect failed, clickhouse-server is unreachable, rejects credentials or TLS handshake
+var ErrConnection = errors.New("can't connect to clickhouse")
+
+// connectionError - keep message of failed Ping as is and mark it as ErrConnection
+type connectionError struct {
+	err error
+}
+
+func (e connectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e connectionError) Unwrap() error {
+	return e.err
+}
+
+func (e connectionError) Is(target error) bool {
+	return target == ErrConnection
+}
+
+// wrapConnectError - tell certificate problems from authentication problems in errors returned by Ping
+func wrapConnectError(cfg *config.ClickHouseConfig, err error) error {
+	if err == nil {
+		return nil
+	}
+	var exception *clickhouseDriver.Exception
+	if errors.As(err, &exception) && authErrorCodes[exception.Code] {
+		return connectionError{fmt.Errorf("clickhouse authentication failed for user '%s', check username and password: %v", cfg.Username, err)}
+	}
+	if isTLSError(err) {
+		return connectionError{fmt.Errorf("clickhouse TLS handshake with %s failed, check secure, skip_verify, tls_ca, tls_cert and tls_key: %v", net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)), err)}
+	}
+	return connectionError{err}
+}
+
+func isTLSError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) || errors.As(err, &recordHeader) {
+		return true
+	}
+	// alerts sent by server, e.g. when client certificate is required or rejected, are not exported by crypto/tls
+	return strings.Contains(err.Error(), "tls: ") || strings.Contains(err.Error(), "x509: ")
+}
@@ -0,0 +1,170 @@
+package clickhouse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	clickhouseDriver "github.com/ClickHouse/clickhouse-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCertificate(t, dir, "ca", &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test-ca"}, NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	writeTestCertificate(t, dir, "server", &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "localhost"}, DNSNames: []string{"localhost"}, NotAfter: notAfter, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca, caKey)
+	writeTestCertificate(t, dir, "client", &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "backup"}, NotAfter: notAfter, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(path.Join(dir, "server.crt"), path.Join(dir, "server.key"))
+	assert.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert})
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+	handshake := func(cfg *config.ClickHouseConfig) error {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", listener.Addr().String(), tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// client certificate is verified by server after client handshake is completed in TLS 1.3
+		_, err = conn.Read(make([]byte, 2))
+		return err
+	}
+
+	cfg := &config.ClickHouseConfig{Host: "localhost", Secure: true, TLSCa: path.Join(dir, "ca.crt"), TLSCert: path.Join(dir, "client.crt"), TLSKey: path.Join(dir, "client.key")}
+	assert.NoError(t, handshake(cfg))
+
+	withoutClientCert := &config.ClickHouseConfig{Host: "localhost", Secure: true, TLSCa: cfg.TLSCa}
+	err = handshake(withoutClientCert)
+	assert.Error(t, err)
+	assert.True(t, isTLSError(err), err)
+
+	wrongHost := &config.ClickHouseConfig{Host: "127.0.0.1", Secure: true, TLSCa: cfg.TLSCa, TLSCert: cfg.TLSCert, TLSKey: cfg.TLSKey}
+	err = handshake(wrongHost)
+	assert.Error(t, err)
+	assert.Contains(t, wrapConnectError(wrongHost, err).Error(), "TLS handshake")
+
+	wrongHost.SkipVerify = true
+	assert.NoError(t, handshake(wrongHost))
+
+	_, err = newTLSConfig(&config.ClickHouseConfig{Secure: true, TLSCa: path.Join(dir, "client.key")})
+	assert.EqualError(t, err, fmt.Sprintf("can't parse clickhouse tls_ca %s: no PEM certificates found", path.Join(dir, "client.key")))
+	_, err = newTLSConfig(&config.ClickHouseConfig{Secure: true, TLSCert: path.Join(dir, "client.crt"), TLSKey: path.Join(dir, "server.key")})
+	assert.Contains(t, err.Error(), "can't load clickhouse tls_cert and tls_key")
+
+	expiredAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	writeTestCertificate(t, dir, "expired", &x509.Certificate{SerialNumber: big.NewInt(4), Subject: pkix.Name{CommonName: "backup"}, NotAfter: expiredAt, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+	_, err = newTLSConfig(&config.ClickHouseConfig{Secure: true, TLSCert: path.Join(dir, "expired.crt"), TLSKey: path.Join(dir, "expired.key")})
+	assert.EqualError(t, err, fmt.Sprintf("clickhouse tls_cert %s expired at %s", path.Join(dir, "expired.crt"), expiredAt.Format(time.RFC3339)))
+	notBefore := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	writeTestCertificate(t, dir, "future", &x509.Certificate{SerialNumber: big.NewInt(5), Subject: pkix.Name{CommonName: "backup"}, NotBefore: notBefore, NotAfter: notBefore.Add(time.Hour), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+	_, err = newTLSConfig(&config.ClickHouseConfig{Secure: true, TLSCert: path.Join(dir, "future.crt"), TLSKey: path.Join(dir, "future.key")})
+	assert.EqualError(t, err, fmt.Sprintf("clickhouse tls_cert %s is not valid before %s", path.Join(dir, "future.crt"), notBefore.Format(time.RFC3339)))
+}
+
+func TestWrapConnectError(t *testing.T) {
+	cfg := &config.ClickHouseConfig{Username: "backup", Host: "localhost", Port: 9440}
+	assert.NoError(t, wrapConnectError(cfg, nil))
+	err := wrapConnectError(cfg, &clickhouseDriver.Exception{Code: 516, Message: "backup: Authentication failed"})
+	assert.EqualError(t, err, "clickhouse authentication failed for user 'backup', check username and password: code: 516, message: backup: Authentication failed")
+	err = wrapConnectError(cfg, x509.UnknownAuthorityError{})
+	assert.Contains(t, err.Error(), "clickhouse TLS handshake with localhost:9440 failed")
+	assert.ErrorIs(t, err, ErrConnection)
+	err = wrapConnectError(cfg, fmt.Errorf("dial tcp: connection refused"))
+	assert.EqualError(t, err, "dial tcp: connection refused")
+	assert.ErrorIs(t, err, ErrConnection)
+}
+
+func TestNativeParamsTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCertificate(t, dir, "ca", &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test-ca"}, NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	writeTestCertificate(t, dir, "client", &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "backup"}, NotAfter: notAfter, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+	caFile, certFile, keyFile := path.Join(dir, "ca.crt"), path.Join(dir, "client.crt"), path.Join(dir, "client.key")
+
+	for name, tc := range map[string]struct {
+		cfg          config.ClickHouseConfig
+		secure       bool
+		rootCAs      bool
+		certificates int
+	}{
+		"plaintext by default":        {cfg: config.ClickHouseConfig{}},
+		"tls files without secure":    {cfg: config.ClickHouseConfig{TLSCa: caFile, TLSCert: certFile, TLSKey: keyFile}},
+		"secure with system CA":       {cfg: config.ClickHouseConfig{Secure: true}, secure: true},
+		"secure without verification": {cfg: config.ClickHouseConfig{Secure: true, SkipVerify: true}, secure: true},
+		"secure with tls_ca":          {cfg: config.ClickHouseConfig{Secure: true, TLSCa: caFile}, secure: true, rootCAs: true},
+		"mutual TLS":                  {cfg: config.ClickHouseConfig{Secure: true, TLSCa: caFile, TLSCert: certFile, TLSKey: keyFile}, secure: true, rootCAs: true, certificates: 1},
+		"mutual TLS with system CA":   {cfg: config.ClickHouseConfig{Secure: true, TLSCert: certFile, TLSKey: keyFile}, secure: true, certificates: 1},
+	} {
+		tc.cfg.Host, tc.cfg.Port = "clickhouse.local", 9440
+		ch := &ClickHouse{Config: &tc.cfg}
+		params, err := ch.nativeParams("5", "300")
+		assert.NoError(t, err, name)
+		if !tc.secure {
+			for _, param := range []string{"secure", "skip_verify", "tls_config"} {
+				assert.Empty(t, params.Get(param), "%s: %s", name, param)
+			}
+			continue
+		}
+		assert.Equal(t, "true", params.Get("secure"), name)
+		assert.Equal(t, fmt.Sprint(tc.cfg.SkipVerify), params.Get("skip_verify"), name)
+		assert.Equal(t, "clickhouse-backup-clickhouse.local:9440", params.Get("tls_config"), name)
+
+		tlsConfig, err := newTLSConfig(&tc.cfg)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "clickhouse.local", tlsConfig.ServerName, name)
+		assert.Equal(t, tc.cfg.SkipVerify, tlsConfig.InsecureSkipVerify, name)
+		assert.Equal(t, tc.rootCAs, tlsConfig.RootCAs != nil, name)
+		assert.Len(t, tlsConfig.Certificates, tc.certificates, name)
+	}
+
+	_, err := (&ClickHouse{Config: &config.ClickHouseConfig{Secure: true, TLSCa: path.Join(dir, "absent.crt")}}).nativeParams("5", "300")
+	assert.Contains(t, err.Error(), "can't read clickhouse tls_ca")
+}
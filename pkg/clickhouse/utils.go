@@ -3,6 +3,8 @@ package clickhouse
 import (
 	"fmt"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/jmoiron/sqlx/reflectx"
@@ -58,3 +60,17 @@ func GetDisksByPaths(disks []Disk, dataPaths []string) map[string]string {
 	}
 	return result
 }
+
+var versionDescribeRE = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+
+// ParseVersionDescribe - convert VERSION_DESCRIBE value like `v21.8.10.19-lts` to VERSION_INTEGER format like 21008010, return 0 when version can't be parsed
+func ParseVersionDescribe(versionDescribe string) int {
+	matches := versionDescribeRE.FindStringSubmatch(strings.TrimSpace(versionDescribe))
+	if matches == nil {
+		return 0
+	}
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	patch, _ := strconv.Atoi(matches[3])
+	return major*1000000 + minor*1000 + patch
+}
@@ -2,3 +2,26 @@ package common
 
 // EmptyMap - like a python set, for less memory usage
 type EmptyMap map[string]struct{}
+
+// TablePartitions - partition IDs passed by `--partitions`, `db.table:id1,id2` is stored with `db.table` pattern as key,
+// partition IDs without table pattern are stored with empty key and apply to tables which are not matched by any pattern
+type TablePartitions map[string]EmptyMap
+
+// ForTable - partition IDs for table, IDs for all matched patterns are merged, empty result means all partitions
+func (tp TablePartitions) ForTable(database, table string) EmptyMap {
+	result := EmptyMap{}
+	for pattern, partitions := range tp {
+		if pattern != "" && MatchTable(pattern, database, table) {
+			for partition := range partitions {
+				result[partition] = struct{}{}
+			}
+		}
+	}
+	if len(result) > 0 {
+		return result
+	}
+	for partition := range tp[""] {
+		result[partition] = struct{}{}
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// TablePattern - parsed comma separated list of `db.table` patterns, `*` and `?` allowed as wildcard,
+// pattern with `!` prefix excludes matched tables
+type TablePattern struct {
+	include []string
+	exclude []string
+}
+
+// NewTablePattern - parse tablePattern, skipTables are added to exclude patterns, empty include list means all tables
+func NewTablePattern(tablePattern string, skipTables []string) TablePattern {
+	tp := TablePattern{}
+	for _, pattern := range strings.Split(tablePattern, ",") {
+		pattern = strings.Trim(pattern, " \t\r\n")
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "!") {
+			tp.exclude = append(tp.exclude, strings.TrimPrefix(pattern, "!"))
+		} else {
+			tp.include = append(tp.include, pattern)
+		}
+	}
+	for _, pattern := range skipTables {
+		if pattern = strings.Trim(pattern, " \t\r\n"); pattern != "" {
+			tp.exclude = append(tp.exclude, pattern)
+		}
+	}
+	if len(tp.include) == 0 {
+		tp.include = []string{"*"}
+	}
+	return tp
+}
+
+// Include - return include patterns
+func (tp TablePattern) Include() []string {
+	return tp.include
+}
+
+// Match - table shall match one of include patterns and shall not match any of exclude patterns
+func (tp TablePattern) Match(database, table string) bool {
+	included := false
+	for _, pattern := range tp.include {
+		if MatchTable(pattern, database, table) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range tp.exclude {
+		if MatchTable(pattern, database, table) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTable - case-sensitive match database and table separately, when pattern doesn't contain `.` then it matched with `db.table`,
+// names may contain `.` too, so each `.` in pattern is tried as separator between database and table
+func MatchTable(pattern, database, table string) bool {
+	if !strings.Contains(pattern, ".") {
+		return matchName(pattern, database+"."+table)
+	}
+	for i := range pattern {
+		if pattern[i] == '.' && matchName(pattern[:i], database) && matchName(pattern[i+1:], table) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName - filepath.Match which allows `*` and `?` to match `/`, it is a regular character in database and table names
+func matchName(pattern, name string) bool {
+	matched, _ := filepath.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(name, "/", "\x00"))
+	return matched
+}
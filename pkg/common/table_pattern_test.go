@@ -0,0 +1,41 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTablePatternMatch(t *testing.T) {
+	tp := NewTablePattern("prod_*.*, !prod_*.tmp_*", []string{"system.*"})
+	assert.True(t, tp.Match("prod_1", "events"))
+	assert.False(t, tp.Match("prod_1", "tmp_events"))
+	assert.False(t, tp.Match("dev", "events"))
+	assert.False(t, tp.Match("Prod_1", "events"))
+	assert.Equal(t, []string{"prod_*.*"}, tp.Include())
+
+	tp = NewTablePattern("", []string{"system.*"})
+	assert.True(t, tp.Match("default", "t1"))
+	assert.False(t, tp.Match("system", "parts"))
+
+	tp = NewTablePattern("!default.t?", nil)
+	assert.True(t, tp.Match("default", "t10"))
+	assert.False(t, tp.Match("default", "t1"))
+
+	tp = NewTablePattern("default.t*", nil)
+	assert.False(t, tp.Match("default_2", "t1"), "`*` in table part shall not match database")
+	assert.True(t, tp.Match("default", "t.with.dots"))
+}
+
+func TestTablePatternMatchSpecialNames(t *testing.T) {
+	tp := NewTablePattern("db.with.dots.*", nil)
+	assert.True(t, tp.Match("db.with.dots", "t1"))
+	assert.True(t, tp.Match("db", "with.dots.t1"))
+	assert.False(t, tp.Match("db.with", "t1"))
+
+	tp = NewTablePattern("default.*", nil)
+	assert.True(t, tp.Match("default", "table/with/slash"))
+	assert.True(t, NewTablePattern("", nil).Match("db.with.dots", "table/with/slash"))
+	assert.True(t, NewTablePattern("default.a/b", nil).Match("default", "a/b"))
+	assert.True(t, NewTablePattern("*.таблица", nil).Match("база", "таблица"))
+}
@@ -1,11 +1,67 @@
 package common
 
 import (
+	"fmt"
 	"net/url"
+	"path"
 	"strings"
 )
 
+const upperHex = "0123456789ABCDEF"
+
+// TablePathEncode - encode database or table name to single path segment for local paths and remote keys,
+// all bytes except letters, digits and `_~$&+:=@` are written as `%XX`, `%` itself is always escaped, so different names never collide,
+// output is the same as legacy url.PathEscape with escaped `.` and `-`, so existing backups stay readable
 func TablePathEncode(str string) string {
-	return strings.NewReplacer(".", "%2E", "-", "%2D").Replace(url.PathEscape(str))
+	var sb strings.Builder
+	sb.Grow(len(str))
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if shouldKeepInTablePath(c) {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(upperHex[c>>4])
+		sb.WriteByte(upperHex[c&15])
+	}
+	return sb.String()
+}
+
+func shouldKeepInTablePath(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("_~$&+:=@", c) >= 0
+}
+
+// TablePathDecode - decode path segment produced by TablePathEncode or by ClickHouse escapeForFileName
+func TablePathDecode(str string) (string, error) {
+	return url.PathUnescape(str)
+}
+
+// TablePath - relative `db/table` path which used for table data inside `shadow` folder, locally and on remote storage
+func TablePath(database, table string) string {
+	return path.Join(TablePathEncode(database), TablePathEncode(table))
+}
+
+// TableMetadataPath - relative `db/table.json` path which used for table metadata inside `metadata` folder, locally and on remote storage
+func TableMetadataPath(database, table string) string {
+	return path.Join(TablePathEncode(database), TablePathEncode(table)+".json")
+}
 
+// ParseTablePath - decode database and table names from relative `db/table` path, `.json` and `.sql` extensions are trimmed
+func ParseTablePath(p string) (database, table string, err error) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("'%s' is not a `db/table` path", p)
+	}
+	if database, err = TablePathDecode(parts[0]); err != nil {
+		return "", "", err
+	}
+	table = strings.TrimSuffix(strings.TrimSuffix(parts[1], ".json"), ".sql")
+	if table, err = TablePathDecode(table); err != nil {
+		return "", "", err
+	}
+	return database, table, nil
 }
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var nastyNames = []string{
+	"default", "db.with.dots", "table/with/slash", "a+b", "a b", "a%2Eb", "a.b", "a%b", "%2E", ".", "..", "-", "a-b",
+	"таблица", "表", "emoji😀", "`quoted`", "'single'", "\"double\"", "a:b@c=d&e$f~g", "a;b,c?d#e", "tab\tnew\nline", "\\back\\slash",
+}
+
+func TestTablePathEncodeDecode(t *testing.T) {
+	encoded := map[string]string{}
+	for _, name := range nastyNames {
+		e := TablePathEncode(name)
+		assert.NotContains(t, e, "/", name)
+		assert.NotContains(t, e, ".", name)
+		assert.Equal(t, strings.NewReplacer(".", "%2E", "-", "%2D").Replace(url.PathEscape(name)), e, "shall be compatible with legacy encoding")
+		decoded, err := TablePathDecode(e)
+		assert.NoError(t, err)
+		assert.Equal(t, name, decoded)
+		if other, exists := encoded[e]; exists {
+			t.Errorf("'%s' and '%s' are encoded to the same '%s'", name, other, e)
+		}
+		encoded[e] = name
+	}
+	assert.Equal(t, "a%252Eb", TablePathEncode("a%2Eb"))
+	assert.Equal(t, "a%2Eb", TablePathEncode("a.b"))
+	_, err := TablePathDecode("bad%2")
+	assert.Error(t, err)
+}
+
+func TestParseTablePath(t *testing.T) {
+	for _, database := range nastyNames {
+		for _, table := range nastyNames {
+			db, tbl, err := ParseTablePath(TableMetadataPath(database, table))
+			assert.NoError(t, err)
+			assert.Equal(t, database, db)
+			assert.Equal(t, table, tbl)
+			db, tbl, err = ParseTablePath("/" + TablePath(database, table))
+			assert.NoError(t, err)
+			assert.Equal(t, database, db)
+			assert.Equal(t, table, tbl)
+		}
+	}
+	_, _, err := ParseTablePath("db/table/part")
+	assert.Error(t, err)
+	_, _, err = ParseTablePath("db/bad%zz.json")
+	assert.Error(t, err)
+}
@@ -2,15 +2,25 @@ package config
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/urfave/cli"
 	"io/ioutil"
 	"math"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/logcli"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/logjson"
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/kelseyhightower/envconfig"
@@ -32,72 +42,145 @@ type Config struct {
 	FTP        FTPConfig        `yaml:"ftp" envconfig:"_"`
 	SFTP       SFTPConfig       `yaml:"sftp" envconfig:"_"`
 	AzureBlob  AzureBlobConfig  `yaml:"azblob" envconfig:"_"`
+	B2         B2Config         `yaml:"b2" envconfig:"_"`
 }
 
 // GeneralConfig - general setting section
 type GeneralConfig struct {
-	RemoteStorage          string `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
-	MaxFileSize            int64  `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
-	DisableProgressBar     bool   `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
-	BackupsToKeepLocal     int    `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
-	BackupsToKeepRemote    int    `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
-	LogLevel               string `yaml:"log_level" envconfig:"LOG_LEVEL"`
-	AllowEmptyBackups      bool   `yaml:"allow_empty_backups" envconfig:"ALLOW_EMPTY_BACKUPS"`
-	DownloadConcurrency    uint8  `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
-	UploadConcurrency      uint8  `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
-	RestoreSchemaOnCluster string `yaml:"restore_schema_on_cluster" envconfig:"RESTORE_SCHEMA_ON_CLUSTER"`
-	UploadByPart           bool   `yaml:"upload_by_part" envconfig:"UPLOAD_BY_PART"`
-	DownloadByPart         bool   `yaml:"download_by_part" envconfig:"DOWNLOAD_BY_PART"`
+	RemoteStorage             string `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
+	MaxFileSize               int64  `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
+	MaxArchiveSize            int64  `yaml:"max_archive_size" envconfig:"MAX_ARCHIVE_SIZE"`
+	DisableProgressBar        bool   `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
+	ForceProgressBar          bool   `yaml:"force_progress_bar" envconfig:"FORCE_PROGRESS_BAR"`
+	BackupsToKeepLocal        int    `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
+	BackupsToKeepRemote       int    `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
+	LogLevel                  string `yaml:"log_level" envconfig:"LOG_LEVEL"`
+	LogFormat                 string `yaml:"log_format" envconfig:"LOG_FORMAT"`
+	AllowEmptyBackups         bool   `yaml:"allow_empty_backups" envconfig:"ALLOW_EMPTY_BACKUPS"`
+	DownloadConcurrency       uint8  `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
+	UploadConcurrency         uint8  `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
+	CreateConcurrency         uint8  `yaml:"create_concurrency" envconfig:"CREATE_CONCURRENCY"`
+	DeleteConcurrency         uint8  `yaml:"delete_concurrency" envconfig:"DELETE_CONCURRENCY"`
+	RestoreSchemaOnCluster    string `yaml:"restore_schema_on_cluster" envconfig:"RESTORE_SCHEMA_ON_CLUSTER"`
+	RestoreDistributedCluster string `yaml:"restore_distributed_cluster" envconfig:"RESTORE_DISTRIBUTED_CLUSTER"`
+	UploadByPart              bool   `yaml:"upload_by_part" envconfig:"UPLOAD_BY_PART"`
+	DownloadByPart            bool   `yaml:"download_by_part" envconfig:"DOWNLOAD_BY_PART"`
+	DiffCompareMode           string `yaml:"diff_compare_mode" envconfig:"DIFF_COMPARE_MODE"`
+	VerifyUpload              bool   `yaml:"verify_upload" envconfig:"VERIFY_UPLOAD"`
+	RestoreSchemaRewrite      bool   `yaml:"restore_schema_rewrite" envconfig:"RESTORE_SCHEMA_REWRITE"`
+	CleanShadowBeforeBackup   bool   `yaml:"clean_shadow_before_backup" envconfig:"CLEAN_SHADOW_BEFORE_BACKUP"`
+	DedupParts                bool   `yaml:"dedup_parts" envconfig:"DEDUP_PARTS"`
+	ReferenceParts            bool   `yaml:"reference_parts" envconfig:"REFERENCE_PARTS"`
+	TimeoutPerTable           string `yaml:"timeout_per_table" envconfig:"TIMEOUT_PER_TABLE"`
+	RunTimeout                string `yaml:"run_timeout" envconfig:"RUN_TIMEOUT"`
+	FailOnTableTimeout        bool   `yaml:"fail_on_table_timeout" envconfig:"FAIL_ON_TABLE_TIMEOUT"`
+	KeepFailedBackups         bool   `yaml:"keep_failed_backups" envconfig:"KEEP_FAILED_BACKUPS"`
+	BackupManifest            bool   `yaml:"backup_manifest" envconfig:"BACKUP_MANIFEST"`
+	BackupLogTable            string `yaml:"backup_log_table" envconfig:"BACKUP_LOG_TABLE"`
+	BackupNameTemplate        string `yaml:"backup_name_template" envconfig:"BACKUP_NAME_TEMPLATE"`
+	// TableCompression - `db.table` patterns with `<format>` or `<format>/<level>` which override compression_format and compression_level of matched tables
+	TableCompression map[string]string `yaml:"table_compression" envconfig:"TABLE_COMPRESSION"`
+	// ProxyURL - default proxy_url of remote storage which doesn't have own one
+	ProxyURL string `yaml:"proxy_url" envconfig:"PROXY_URL"`
+	// PreserveFileOwnership - uid and gid from archive are set on downloaded files when clickhouse-backup runs as root
+	PreserveFileOwnership bool `yaml:"preserve_file_ownership" envconfig:"PRESERVE_FILE_OWNERSHIP"`
+	// EstimateCompressibility - `create` samples part files of backup and logs recommendation of compression_format
+	EstimateCompressibility bool `yaml:"estimate_compressibility" envconfig:"ESTIMATE_COMPRESSIBILITY"`
+	// MaxLocalBackupSizeBytes - `create` deletes the oldest local backups while local backups with new one take more, 0 means no limit
+	MaxLocalBackupSizeBytes int64 `yaml:"max_local_backup_size_bytes" envconfig:"MAX_LOCAL_BACKUP_SIZE_BYTES"`
+	// MinFreeSpacePercent - `create` deletes the oldest local backups while less percent of disks would be free with new backup, 0 means no limit
+	MinFreeSpacePercent int `yaml:"min_free_space_percent" envconfig:"MIN_FREE_SPACE_PERCENT"`
+	// RBACBackupMode - `files` copies access_management folder by `create --rbac`, `sql` saves SHOW CREATE of access entities into metadata.json
+	RBACBackupMode string `yaml:"rbac_backup_mode" envconfig:"RBAC_BACKUP_MODE"`
+	// TempDir - directory for temporary files, empty means system default temp dir which is often small tmpfs
+	TempDir string `yaml:"temp_dir" envconfig:"TEMP_DIR"`
 }
 
 // GCSConfig - GCS settings section
 type GCSConfig struct {
-	CredentialsFile   string `yaml:"credentials_file" envconfig:"GCS_CREDENTIALS_FILE"`
-	CredentialsJSON   string `yaml:"credentials_json" envconfig:"GCS_CREDENTIALS_JSON"`
-	Bucket            string `yaml:"bucket" envconfig:"GCS_BUCKET"`
-	Path              string `yaml:"path" envconfig:"GCS_PATH"`
-	CompressionLevel  int    `yaml:"compression_level" envconfig:"GCS_COMPRESSION_LEVEL"`
-	CompressionFormat string `yaml:"compression_format" envconfig:"GCS_COMPRESSION_FORMAT"`
-	Debug             bool   `yaml:"debug" envconfig:"GCS_DEBUG"`
-	Endpoint          string `yaml:"endpoint" envconfig:"GCS_ENDPOINT"`
+	CredentialsFile     string            `yaml:"credentials_file" envconfig:"GCS_CREDENTIALS_FILE"`
+	CredentialsJSON     string            `yaml:"credentials_json" envconfig:"GCS_CREDENTIALS_JSON"`
+	Bucket              string            `yaml:"bucket" envconfig:"GCS_BUCKET"`
+	Path                string            `yaml:"path" envconfig:"GCS_PATH"`
+	CompressionLevel    int               `yaml:"compression_level" envconfig:"GCS_COMPRESSION_LEVEL"`
+	CompressionFormat   string            `yaml:"compression_format" envconfig:"GCS_COMPRESSION_FORMAT"`
+	Debug               bool              `yaml:"debug" envconfig:"GCS_DEBUG"`
+	Endpoint            string            `yaml:"endpoint" envconfig:"GCS_ENDPOINT"`
+	ObjectTags          map[string]string `yaml:"object_tags" envconfig:"GCS_OBJECT_TAGS"`
+	ChunkSize           int               `yaml:"chunk_size" envconfig:"GCS_CHUNK_SIZE"`
+	MaxRetries          int               `yaml:"max_retries" envconfig:"GCS_MAX_RETRIES"`
+	RetryInitialBackoff string            `yaml:"retry_initial_backoff" envconfig:"GCS_RETRY_INITIAL_BACKOFF"`
+	RetryMaxBackoff     string            `yaml:"retry_max_backoff" envconfig:"GCS_RETRY_MAX_BACKOFF"`
+	KMSKeyName          string            `yaml:"kms_key_name" envconfig:"GCS_KMS_KEY_NAME"`
+
+	// endpoint behind internal CA, see s3.ca_cert
+	CACert                  string `yaml:"ca_cert" envconfig:"GCS_CA_CERT"`
+	DisableCertVerification bool   `yaml:"disable_cert_verification" envconfig:"GCS_DISABLE_CERT_VERIFICATION"`
+	ProxyURL                string `yaml:"proxy_url" envconfig:"GCS_PROXY_URL"`
 }
 
 // AzureBlobConfig - Azure Blob settings section
 type AzureBlobConfig struct {
-	EndpointSuffix        string `yaml:"endpoint_suffix" envconfig:"AZBLOB_ENDPOINT_SUFFIX"`
-	AccountName           string `yaml:"account_name" envconfig:"AZBLOB_ACCOUNT_NAME"`
-	AccountKey            string `yaml:"account_key" envconfig:"AZBLOB_ACCOUNT_KEY"`
-	SharedAccessSignature string `yaml:"sas" envconfig:"AZBLOB_SAS"`
-	UseManagedIdentity    bool   `yaml:"use_managed_identity" envconfig:"AZBLOB_USE_MANAGED_IDENTITY"`
-	Container             string `yaml:"container" envconfig:"AZBLOB_CONTAINER"`
-	Path                  string `yaml:"path" envconfig:"AZBLOB_PATH"`
-	CompressionLevel      int    `yaml:"compression_level" envconfig:"AZBLOB_COMPRESSION_LEVEL"`
-	CompressionFormat     string `yaml:"compression_format" envconfig:"AZBLOB_COMPRESSION_FORMAT"`
-	SSEKey                string `yaml:"sse_key" envconfig:"AZBLOB_SSE_KEY"`
-	BufferSize            int    `yaml:"buffer_size" envconfig:"AZBLOB_BUFFER_SIZE"`
-	MaxBuffers            int    `yaml:"buffer_count" envconfig:"AZBLOB_MAX_BUFFERS"`
+	EndpointSuffix            string `yaml:"endpoint_suffix" envconfig:"AZBLOB_ENDPOINT_SUFFIX"`
+	AccountName               string `yaml:"account_name" envconfig:"AZBLOB_ACCOUNT_NAME"`
+	AccountKey                string `yaml:"account_key" envconfig:"AZBLOB_ACCOUNT_KEY"`
+	AccountKeyFile            string `yaml:"account_key_file" envconfig:"AZBLOB_ACCOUNT_KEY_FILE"`
+	SharedAccessSignature     string `yaml:"sas" envconfig:"AZBLOB_SAS"`
+	SharedAccessSignatureFile string `yaml:"sas_file" envconfig:"AZBLOB_SAS_FILE"`
+	UseManagedIdentity        bool   `yaml:"use_managed_identity" envconfig:"AZBLOB_USE_MANAGED_IDENTITY"`
+	Container                 string `yaml:"container" envconfig:"AZBLOB_CONTAINER"`
+	Path                      string `yaml:"path" envconfig:"AZBLOB_PATH"`
+	CompressionLevel          int    `yaml:"compression_level" envconfig:"AZBLOB_COMPRESSION_LEVEL"`
+	CompressionFormat         string `yaml:"compression_format" envconfig:"AZBLOB_COMPRESSION_FORMAT"`
+	SSEKey                    string `yaml:"sse_key" envconfig:"AZBLOB_SSE_KEY"`
+	SSEKeyFile                string `yaml:"sse_key_file" envconfig:"AZBLOB_SSE_KEY_FILE"`
+	BufferSize                int    `yaml:"buffer_size" envconfig:"AZBLOB_BUFFER_SIZE"`
+	MaxBuffers                int    `yaml:"buffer_count" envconfig:"AZBLOB_MAX_BUFFERS"`
+
+	// endpoint behind internal CA, see s3.ca_cert
+	CACert                  string `yaml:"ca_cert" envconfig:"AZBLOB_CA_CERT"`
+	DisableCertVerification bool   `yaml:"disable_cert_verification" envconfig:"AZBLOB_DISABLE_CERT_VERIFICATION"`
+	ProxyURL                string `yaml:"proxy_url" envconfig:"AZBLOB_PROXY_URL"`
 }
 
 // S3Config - s3 settings section
 type S3Config struct {
-	AccessKey               string `yaml:"access_key" envconfig:"S3_ACCESS_KEY"`
-	SecretKey               string `yaml:"secret_key" envconfig:"S3_SECRET_KEY"`
-	Bucket                  string `yaml:"bucket" envconfig:"S3_BUCKET"`
-	Endpoint                string `yaml:"endpoint" envconfig:"S3_ENDPOINT"`
-	Region                  string `yaml:"region" envconfig:"S3_REGION"`
-	ACL                     string `yaml:"acl" envconfig:"S3_ACL"`
-	AssumeRoleARN           string `yaml:"assume_role_arn" envconfig:"S3_ASSUME_ROLE_ARN"`
-	ForcePathStyle          bool   `yaml:"force_path_style" envconfig:"S3_FORCE_PATH_STYLE"`
-	Path                    string `yaml:"path" envconfig:"S3_PATH"`
-	DisableSSL              bool   `yaml:"disable_ssl" envconfig:"S3_DISABLE_SSL"`
-	CompressionLevel        int    `yaml:"compression_level" envconfig:"S3_COMPRESSION_LEVEL"`
-	CompressionFormat       string `yaml:"compression_format" envconfig:"S3_COMPRESSION_FORMAT"`
-	SSE                     string `yaml:"sse" envconfig:"S3_SSE"`
-	DisableCertVerification bool   `yaml:"disable_cert_verification" envconfig:"S3_DISABLE_CERT_VERIFICATION"`
-	StorageClass            string `yaml:"storage_class" envconfig:"S3_STORAGE_CLASS"`
-	Concurrency             int    `yaml:"concurrency" envconfig:"S3_CONCURRENCY"`
-	PartSize                int64  `yaml:"part_size" envconfig:"S3_PART_SIZE"`
-	Debug                   bool   `yaml:"debug" envconfig:"S3_DEBUG"`
+	AccessKey               string            `yaml:"access_key" envconfig:"S3_ACCESS_KEY"`
+	AccessKeyFile           string            `yaml:"access_key_file" envconfig:"S3_ACCESS_KEY_FILE"`
+	SecretKey               string            `yaml:"secret_key" envconfig:"S3_SECRET_KEY"`
+	SecretKeyFile           string            `yaml:"secret_key_file" envconfig:"S3_SECRET_KEY_FILE"`
+	Bucket                  string            `yaml:"bucket" envconfig:"S3_BUCKET"`
+	Endpoint                string            `yaml:"endpoint" envconfig:"S3_ENDPOINT"`
+	Region                  string            `yaml:"region" envconfig:"S3_REGION"`
+	ACL                     string            `yaml:"acl" envconfig:"S3_ACL"`
+	AssumeRoleARN           string            `yaml:"assume_role_arn" envconfig:"S3_ASSUME_ROLE_ARN"`
+	ForcePathStyle          bool              `yaml:"force_path_style" envconfig:"S3_FORCE_PATH_STYLE"`
+	UseAccelerateEndpoint   bool              `yaml:"use_accelerate_endpoint" envconfig:"S3_USE_ACCELERATE_ENDPOINT"`
+	UseDualStack            bool              `yaml:"use_dualstack" envconfig:"S3_USE_DUALSTACK"`
+	Path                    string            `yaml:"path" envconfig:"S3_PATH"`
+	DisableSSL              bool              `yaml:"disable_ssl" envconfig:"S3_DISABLE_SSL"`
+	CompressionLevel        int               `yaml:"compression_level" envconfig:"S3_COMPRESSION_LEVEL"`
+	CompressionFormat       string            `yaml:"compression_format" envconfig:"S3_COMPRESSION_FORMAT"`
+	SSE                     string            `yaml:"sse" envconfig:"S3_SSE"`
+	DisableCertVerification bool              `yaml:"disable_cert_verification" envconfig:"S3_DISABLE_CERT_VERIFICATION"`
+	StorageClass            string            `yaml:"storage_class" envconfig:"S3_STORAGE_CLASS"`
+	Concurrency             int               `yaml:"concurrency" envconfig:"S3_CONCURRENCY"`
+	ListConcurrency         int               `yaml:"list_concurrency" envconfig:"S3_LIST_CONCURRENCY"`
+	PartSize                int64             `yaml:"part_size" envconfig:"S3_PART_SIZE"`
+	Debug                   bool              `yaml:"debug" envconfig:"S3_DEBUG"`
+	ObjectTags              map[string]string `yaml:"object_tags" envconfig:"S3_OBJECT_TAGS"`
+	// AbortIncompleteUploadsAfter - `clean` aborts multipart uploads which were initiated earlier than this duration ago, empty value disables it
+	AbortIncompleteUploadsAfter string `yaml:"abort_incomplete_uploads_after" envconfig:"S3_ABORT_INCOMPLETE_UPLOADS_AFTER"`
+	// CACert - path to PEM file or PEM content of CA which signed certificate of endpoint, it is trusted in addition to system CAs
+	CACert string `yaml:"ca_cert" envconfig:"S3_CA_CERT"`
+	// MaxIdleConns - idle connections to endpoint kept for reuse, shall be not less than concurrency of upload and download
+	MaxIdleConns int `yaml:"max_idle_conns" envconfig:"S3_MAX_IDLE_CONNS"`
+	// HTTPTimeout - timeout of whole http request including body, empty value disables it
+	HTTPTimeout string `yaml:"http_timeout" envconfig:"S3_HTTP_TIMEOUT"`
+	// ProxyURL - http://, https:// or socks5:// proxy with optional user:password, HTTP(S)_PROXY environment variables are ignored when it is set
+	ProxyURL string `yaml:"proxy_url" envconfig:"S3_PROXY_URL"`
+	// VerifyETag - compare ETag of archive uploaded by one request with MD5 of uploaded bytes, ETag of multipart upload and SSE-KMS object isn't MD5 and it is not compared
+	VerifyETag bool `yaml:"verify_etag" envconfig:"S3_VERIFY_ETAG"`
 }
 
 // COSConfig - cos settings section
@@ -105,11 +188,20 @@ type COSConfig struct {
 	RowURL            string `yaml:"url" envconfig:"COS_URL"`
 	Timeout           string `yaml:"timeout" envconfig:"COS_TIMEOUT"`
 	SecretID          string `yaml:"secret_id" envconfig:"COS_SECRET_ID"`
+	SecretIDFile      string `yaml:"secret_id_file" envconfig:"COS_SECRET_ID_FILE"`
 	SecretKey         string `yaml:"secret_key" envconfig:"COS_SECRET_KEY"`
+	SecretKeyFile     string `yaml:"secret_key_file" envconfig:"COS_SECRET_KEY_FILE"`
 	Path              string `yaml:"path" envconfig:"COS_PATH"`
 	CompressionFormat string `yaml:"compression_format" envconfig:"COS_COMPRESSION_FORMAT"`
+	PartSize          int64  `yaml:"part_size" envconfig:"COS_PART_SIZE"`
+	Concurrency       int    `yaml:"concurrency" envconfig:"COS_CONCURRENCY"`
 	CompressionLevel  int    `yaml:"compression_level" envconfig:"COS_COMPRESSION_LEVEL"`
 	Debug             bool   `yaml:"debug" envconfig:"COS_DEBUG"`
+
+	// endpoint behind internal CA, see s3.ca_cert
+	CACert                  string `yaml:"ca_cert" envconfig:"COS_CA_CERT"`
+	DisableCertVerification bool   `yaml:"disable_cert_verification" envconfig:"COS_DISABLE_CERT_VERIFICATION"`
+	ProxyURL                string `yaml:"proxy_url" envconfig:"COS_PROXY_URL"`
 }
 
 // FTPConfig - ftp settings section
@@ -118,12 +210,15 @@ type FTPConfig struct {
 	Timeout           string `yaml:"timeout" envconfig:"FTP_TIMEOUT"`
 	Username          string `yaml:"username" envconfig:"FTP_USERNAME"`
 	Password          string `yaml:"password" envconfig:"FTP_PASSWORD"`
+	PasswordFile      string `yaml:"password_file" envconfig:"FTP_PASSWORD_FILE"`
 	TLS               bool   `yaml:"tls" envconfig:"FTP_TLS"`
 	Path              string `yaml:"path" envconfig:"FTP_PATH"`
 	CompressionFormat string `yaml:"compression_format" envconfig:"FTP_COMPRESSION_FORMAT"`
 	CompressionLevel  int    `yaml:"compression_level" envconfig:"FTP_COMPRESSION_LEVEL"`
 	Concurrency       uint8  `yaml:"concurrency" envconfig:"FTP_CONCURRENCY"`
 	Debug             bool   `yaml:"debug" envconfig:"FTP_DEBUG"`
+	// ProxyURL - only socks5:// proxy is supported, it is used for control and data connections
+	ProxyURL string `yaml:"proxy_url" envconfig:"FTP_PROXY_URL"`
 }
 
 // SFTPConfig - sftp settings section
@@ -132,6 +227,7 @@ type SFTPConfig struct {
 	Port              uint   `yaml:"port" envconfig:"SFTP_PORT"`
 	Username          string `yaml:"username" envconfig:"SFTP_USERNAME"`
 	Password          string `yaml:"password" envconfig:"SFTP_PASSWORD"`
+	PasswordFile      string `yaml:"password_file" envconfig:"SFTP_PASSWORD_FILE"`
 	Key               string `yaml:"key" envconfig:"SFTP_KEY"`
 	Path              string `yaml:"path" envconfig:"SFTP_PATH"`
 	CompressionFormat string `yaml:"compression_format" envconfig:"SFTP_COMPRESSION_FORMAT"`
@@ -140,18 +236,43 @@ type SFTPConfig struct {
 	Debug             bool   `yaml:"debug" envconfig:"SFTP_DEBUG"`
 }
 
+// B2Config - Backblaze B2 settings section, native B2 API is used
+type B2Config struct {
+	KeyID              string `yaml:"key_id" envconfig:"B2_KEY_ID"`
+	ApplicationKey     string `yaml:"application_key" envconfig:"B2_APPLICATION_KEY"`
+	ApplicationKeyFile string `yaml:"application_key_file" envconfig:"B2_APPLICATION_KEY_FILE"`
+	Bucket             string `yaml:"bucket" envconfig:"B2_BUCKET"`
+	Endpoint           string `yaml:"endpoint" envconfig:"B2_ENDPOINT"`
+	Path               string `yaml:"path" envconfig:"B2_PATH"`
+	PartSize           int64  `yaml:"part_size" envconfig:"B2_PART_SIZE"`
+	CompressionFormat  string `yaml:"compression_format" envconfig:"B2_COMPRESSION_FORMAT"`
+	CompressionLevel   int    `yaml:"compression_level" envconfig:"B2_COMPRESSION_LEVEL"`
+	Debug              bool   `yaml:"debug" envconfig:"B2_DEBUG"`
+}
+
 // ClickHouseConfig - clickhouse settings section
 type ClickHouseConfig struct {
 	Username                         string            `yaml:"username" envconfig:"CLICKHOUSE_USERNAME"`
 	Password                         string            `yaml:"password" envconfig:"CLICKHOUSE_PASSWORD"`
+	PasswordFile                     string            `yaml:"password_file" envconfig:"CLICKHOUSE_PASSWORD_FILE"`
 	Host                             string            `yaml:"host" envconfig:"CLICKHOUSE_HOST"`
 	Port                             uint              `yaml:"port" envconfig:"CLICKHOUSE_PORT"`
+	Protocol                         string            `yaml:"protocol" envconfig:"CLICKHOUSE_PROTOCOL"`
 	DiskMapping                      map[string]string `yaml:"disk_mapping" envconfig:"CLICKHOUSE_DISK_MAPPING"`
 	SkipTables                       []string          `yaml:"skip_tables" envconfig:"CLICKHOUSE_SKIP_TABLES"`
 	Timeout                          string            `yaml:"timeout" envconfig:"CLICKHOUSE_TIMEOUT"`
+	QueryTimeout                     string            `yaml:"query_timeout" envconfig:"CLICKHOUSE_QUERY_TIMEOUT"`
+	FreezeTimeout                    string            `yaml:"freeze_timeout" envconfig:"CLICKHOUSE_FREEZE_TIMEOUT"`
+	SyncReplicaTimeout               string            `yaml:"sync_replica_timeout" envconfig:"CLICKHOUSE_SYNC_REPLICA_TIMEOUT"`
+	Settings                         map[string]string `yaml:"settings" envconfig:"CLICKHOUSE_SETTINGS"`
 	FreezeByPart                     bool              `yaml:"freeze_by_part" envconfig:"CLICKHOUSE_FREEZE_BY_PART"`
+	FreezeConcurrency                int               `yaml:"freeze_concurrency" envconfig:"CLICKHOUSE_FREEZE_CONCURRENCY"`
+	ObjectDisks                      string            `yaml:"object_disks" envconfig:"CLICKHOUSE_OBJECT_DISKS"`
 	Secure                           bool              `yaml:"secure" envconfig:"CLICKHOUSE_SECURE"`
 	SkipVerify                       bool              `yaml:"skip_verify" envconfig:"CLICKHOUSE_SKIP_VERIFY"`
+	TLSCa                            string            `yaml:"tls_ca" envconfig:"CLICKHOUSE_TLS_CA"`
+	TLSCert                          string            `yaml:"tls_cert" envconfig:"CLICKHOUSE_TLS_CERT"`
+	TLSKey                           string            `yaml:"tls_key" envconfig:"CLICKHOUSE_TLS_KEY"`
 	SyncReplicatedTables             bool              `yaml:"sync_replicated_tables" envconfig:"CLICKHOUSE_SYNC_REPLICATED_TABLES"`
 	LogSQLQueries                    bool              `yaml:"log_sql_queries" envconfig:"CLICKHOUSE_LOG_SQL_QUERIES"`
 	ConfigDir                        string            `yaml:"config_dir" envconfig:"CLICKHOUSE_CONFIG_DIR"`
@@ -166,11 +287,14 @@ type APIConfig struct {
 	EnablePprof             bool   `yaml:"enable_pprof" envconfig:"API_ENABLE_PPROF"`
 	Username                string `yaml:"username" envconfig:"API_USERNAME"`
 	Password                string `yaml:"password" envconfig:"API_PASSWORD"`
+	PasswordFile            string `yaml:"password_file" envconfig:"API_PASSWORD_FILE"`
 	Secure                  bool   `yaml:"secure" envconfig:"API_SECURE"`
 	CertificateFile         string `yaml:"certificate_file" envconfig:"API_CERTIFICATE_FILE"`
 	PrivateKeyFile          string `yaml:"private_key_file" envconfig:"API_PRIVATE_KEY_FILE"`
 	CreateIntegrationTables bool   `yaml:"create_integration_tables" envconfig:"API_CREATE_INTEGRATION_TABLES"`
 	AllowParallel           bool   `yaml:"allow_parallel" envconfig:"API_ALLOW_PARALLEL"`
+	// MaxParallelOperations - limit of operations which run at a time when allow_parallel is enabled, 0 means no limit
+	MaxParallelOperations int `yaml:"max_parallel_operations" envconfig:"API_MAX_PARALLEL_OPERATIONS"`
 }
 
 // ArchiveExtensions - list of availiable compression formats and associated file extensions
@@ -180,12 +304,31 @@ var ArchiveExtensions = map[string]string{
 	"bzip2":  "tar.bz2",
 	"gzip":   "tar.gz",
 	"sz":     "tar.sz",
+	"s2":     "tar.s2",
 	"xz":     "tar.xz",
 	"br":     "tar.br",
 	"brotli": "tar.br",
 	"zstd":   "tar.zstd",
 }
 
+var (
+	customRemoteStoragesLock sync.RWMutex
+	customRemoteStorages     = map[string]bool{}
+)
+
+// RegisterRemoteStorage - allow `remote_storage` which is registered by new_storage.RegisterBackend, such storages don't have config section and use tar archives
+func RegisterRemoteStorage(name string) {
+	customRemoteStoragesLock.Lock()
+	defer customRemoteStoragesLock.Unlock()
+	customRemoteStorages[name] = true
+}
+
+func isCustomRemoteStorage(name string) bool {
+	customRemoteStoragesLock.RLock()
+	defer customRemoteStoragesLock.RUnlock()
+	return customRemoteStorages[name]
+}
+
 func (cfg *Config) GetArchiveExtension() string {
 	switch cfg.General.RemoteStorage {
 	case "s3":
@@ -200,11 +343,48 @@ func (cfg *Config) GetArchiveExtension() string {
 		return ArchiveExtensions[cfg.SFTP.CompressionFormat]
 	case "azblob":
 		return ArchiveExtensions[cfg.AzureBlob.CompressionFormat]
+	case "b2":
+		return ArchiveExtensions[cfg.B2.CompressionFormat]
 	default:
+		if isCustomRemoteStorage(cfg.General.RemoteStorage) {
+			return ArchiveExtensions["tar"]
+		}
 		return ""
 	}
 }
 
+// GetTableCompression - compression format and level for archives of table from the longest pattern of general.table_compression which matches the table,
+// empty format is returned when no pattern matches, level is -1 when pattern doesn't define it
+func (cfg *Config) GetTableCompression(database, table string) (string, int) {
+	matchedPattern := ""
+	for pattern := range cfg.General.TableCompression {
+		if !common.MatchTable(pattern, database, table) {
+			continue
+		}
+		if len(pattern) > len(matchedPattern) || (len(pattern) == len(matchedPattern) && pattern < matchedPattern) {
+			matchedPattern = pattern
+		}
+	}
+	if matchedPattern == "" {
+		return "", -1
+	}
+	format, level, _ := parseTableCompression(cfg.General.TableCompression[matchedPattern])
+	return format, level
+}
+
+// parseTableCompression - `<format>` or `<format>/<level>`, `/` is used because envconfig splits map values by `:`
+func parseTableCompression(value string) (string, int, error) {
+	i := strings.Index(value, "/")
+	if i < 0 {
+		return value, -1, nil
+	}
+	level, err := strconv.Atoi(value[i+1:])
+	if err != nil || level < 0 {
+		return value[:i], -1, fmt.Errorf("invalid compression level '%s'", value[i+1:])
+	}
+	return value[:i], level, nil
+}
+
 func (cfg *Config) GetCompressionFormat() string {
 	switch cfg.General.RemoteStorage {
 	case "s3":
@@ -219,13 +399,79 @@ func (cfg *Config) GetCompressionFormat() string {
 		return cfg.SFTP.CompressionFormat
 	case "azblob":
 		return cfg.AzureBlob.CompressionFormat
+	case "b2":
+		return cfg.B2.CompressionFormat
 	case "none":
 		return "tar"
 	default:
+		if isCustomRemoteStorage(cfg.General.RemoteStorage) {
+			return "tar"
+		}
 		return "unknown"
 	}
 }
 
+// GetCompressionLevel - compression_level of current remote storage, 0 when remote storage doesn't have it
+func (cfg *Config) GetCompressionLevel() int {
+	switch cfg.General.RemoteStorage {
+	case "s3":
+		return cfg.S3.CompressionLevel
+	case "gcs":
+		return cfg.GCS.CompressionLevel
+	case "cos":
+		return cfg.COS.CompressionLevel
+	case "ftp":
+		return cfg.FTP.CompressionLevel
+	case "sftp":
+		return cfg.SFTP.CompressionLevel
+	case "azblob":
+		return cfg.AzureBlob.CompressionLevel
+	case "b2":
+		return cfg.B2.CompressionLevel
+	}
+	return 0
+}
+
+// remotePath - path option of current remote storage, nil when remote storage doesn't have it
+func (cfg *Config) remotePath() *string {
+	switch cfg.General.RemoteStorage {
+	case "s3":
+		return &cfg.S3.Path
+	case "gcs":
+		return &cfg.GCS.Path
+	case "cos":
+		return &cfg.COS.Path
+	case "ftp":
+		return &cfg.FTP.Path
+	case "sftp":
+		return &cfg.SFTP.Path
+	case "azblob":
+		return &cfg.AzureBlob.Path
+	case "b2":
+		return &cfg.B2.Path
+	}
+	return nil
+}
+
+// SetRemotePath - override path of current remote storage, e.g. to list and download backups which were moved to other prefix of the same bucket,
+// `..` elements are rejected cause they could point outside of bucket or root folder of remote storage
+func (cfg *Config) SetRemotePath(remotePath string) error {
+	pathOption := cfg.remotePath()
+	if pathOption == nil {
+		return fmt.Errorf("'%s' remote storage doesn't have path to override", cfg.General.RemoteStorage)
+	}
+	for _, element := range strings.Split(remotePath, "/") {
+		if element == ".." {
+			return fmt.Errorf("storage path '%s' can't contain '..'", remotePath)
+		}
+	}
+	*pathOption = remotePath
+	return nil
+}
+
+// WrapLogHandler - wraps log handler which is set by LoadConfig, API server uses it to stream logs of running operations
+var WrapLogHandler func(log.Handler) log.Handler
+
 // LoadConfig - load config from file + environment variables
 func LoadConfig(configLocation string) (*Config, error) {
 	cfg := DefaultConfig()
@@ -236,14 +482,165 @@ func LoadConfig(configLocation string) (*Config, error) {
 	if err := yaml.Unmarshal(configYaml, &cfg); err != nil {
 		return nil, fmt.Errorf("can't parse config file: %v", err)
 	}
+	if err := expandEnvValues(reflect.ValueOf(cfg).Elem(), ""); err != nil {
+		return nil, err
+	}
 	if err := envconfig.Process("", cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.readSecretFiles(); err != nil {
+		return nil, err
+	}
 	cfg.AzureBlob.Path = strings.TrimPrefix(cfg.AzureBlob.Path, "/")
+	cfg.inheritProxyURL()
 	log.SetLevelFromString(cfg.General.LogLevel)
+	var handler log.Handler = logcli.New(os.Stdout)
+	if cfg.General.LogFormat == "json" {
+		handler = logjson.New(os.Stdout)
+	}
+	if WrapLogHandler != nil {
+		handler = WrapLogHandler(handler)
+	}
+	log.SetHandler(handler)
 	return cfg, ValidateConfig(cfg)
 }
 
+// envVariableRe - `${VAR}` in string values of config file, `$${VAR}` is escaped literal `${VAR}`
+var envVariableRe = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv - replace `${VAR}` in value by environment variable, undefined variable is an error, so credential isn't replaced by empty string silently
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envVariableRe.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		variable, exists := os.LookupEnv(name)
+		if !exists && err == nil {
+			err = fmt.Errorf("environment variable %s is not defined, use $${%s} for literal value", name, name)
+		}
+		return variable
+	})
+	return expanded, err
+}
+
+// expandEnvValues - expandEnv in string values, string lists and string maps of config sections, error names the key of value
+func expandEnvValues(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		key := prefix + strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		field := v.Field(i)
+		var err error
+		switch {
+		case field.Kind() == reflect.Struct:
+			err = expandEnvValues(field, key+".")
+		case field.Kind() == reflect.String:
+			var expanded string
+			if expanded, err = expandEnv(field.String()); err == nil {
+				field.SetString(expanded)
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < field.Len() && err == nil; j++ {
+				var expanded string
+				if expanded, err = expandEnv(field.Index(j).String()); err == nil {
+					field.Index(j).SetString(expanded)
+				}
+			}
+		case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.String:
+			for _, mapKey := range field.MapKeys() {
+				var expanded string
+				if expanded, err = expandEnv(field.MapIndex(mapKey).String()); err != nil {
+					break
+				}
+				field.SetMapIndex(mapKey, reflect.ValueOf(expanded).Convert(field.Type().Elem()))
+			}
+		}
+		if err != nil {
+			if field.Kind() == reflect.Struct {
+				return err
+			}
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// secretFile - credential option and its `_file` option which contains path of file with credential, e.g. mounted kubernetes secret
+type secretFile struct {
+	key   string
+	value *string
+	file  *string
+}
+
+func (cfg *Config) secretFiles() []secretFile {
+	return []secretFile{
+		{"clickhouse.password", &cfg.ClickHouse.Password, &cfg.ClickHouse.PasswordFile},
+		{"api.password", &cfg.API.Password, &cfg.API.PasswordFile},
+		{"s3.access_key", &cfg.S3.AccessKey, &cfg.S3.AccessKeyFile},
+		{"s3.secret_key", &cfg.S3.SecretKey, &cfg.S3.SecretKeyFile},
+		{"cos.secret_id", &cfg.COS.SecretID, &cfg.COS.SecretIDFile},
+		{"cos.secret_key", &cfg.COS.SecretKey, &cfg.COS.SecretKeyFile},
+		{"azblob.account_key", &cfg.AzureBlob.AccountKey, &cfg.AzureBlob.AccountKeyFile},
+		{"azblob.sas", &cfg.AzureBlob.SharedAccessSignature, &cfg.AzureBlob.SharedAccessSignatureFile},
+		{"azblob.sse_key", &cfg.AzureBlob.SSEKey, &cfg.AzureBlob.SSEKeyFile},
+		{"b2.application_key", &cfg.B2.ApplicationKey, &cfg.B2.ApplicationKeyFile},
+		{"ftp.password", &cfg.FTP.Password, &cfg.FTP.PasswordFile},
+		{"sftp.password", &cfg.SFTP.Password, &cfg.SFTP.PasswordFile},
+	}
+}
+
+// readSecretFiles - set credentials from files of their `_file` options, leading and trailing whitespaces like newline at the end of file are trimmed
+func (cfg *Config) readSecretFiles() error {
+	for _, secret := range cfg.secretFiles() {
+		if *secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("%s and %s_file can't be defined together", secret.key, secret.key)
+		}
+		body, err := ioutil.ReadFile(*secret.file)
+		if err != nil {
+			return fmt.Errorf("can't read %s_file: %v", secret.key, err)
+		}
+		*secret.value = strings.TrimSpace(string(body))
+	}
+	return nil
+}
+
+// s3AccelerateBucketRe - S3 Transfer Acceleration requires DNS compatible bucket name without dots
+var s3AccelerateBucketRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// validateS3Endpoint - accelerate and dualstack endpoints are AWS endpoints, SDK ignores dualstack with custom endpoint, so such combinations are refused
+func validateS3Endpoint(cfg S3Config) error {
+	if cfg.UseAccelerateEndpoint {
+		if cfg.Endpoint != "" {
+			return fmt.Errorf("s3.use_accelerate_endpoint can't be used together with s3.endpoint")
+		}
+		if cfg.ForcePathStyle {
+			return fmt.Errorf("s3.use_accelerate_endpoint can't be used together with s3.force_path_style")
+		}
+		if !s3AccelerateBucketRe.MatchString(cfg.Bucket) {
+			return fmt.Errorf("s3.bucket '%s' is not compatible with s3.use_accelerate_endpoint, bucket name shall be DNS compatible and shall not contain dots", cfg.Bucket)
+		}
+	}
+	if cfg.UseDualStack && cfg.Endpoint != "" {
+		return fmt.Errorf("s3.use_dualstack can't be used together with s3.endpoint")
+	}
+	return nil
+}
+
+// checkWritableDir - create and remove temporary file in dir
+func checkWritableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".clickhouse-backup-check-")
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
+
 func ValidateConfig(cfg *Config) error {
 	if cfg.GetCompressionFormat() == "unknown" {
 		return fmt.Errorf("'%s' is unknown remote storage", cfg.General.RemoteStorage)
@@ -254,15 +651,105 @@ func ValidateConfig(cfg *Config) error {
 			cfg.FTP.Concurrency, cfg.General.DownloadConcurrency, cfg.General.UploadConcurrency,
 		)
 	}
+	if cfg.General.LogFormat != "text" && cfg.General.LogFormat != "json" {
+		return fmt.Errorf("'%s' is unknown log_format, use text or json", cfg.General.LogFormat)
+	}
+	if cfg.General.CreateConcurrency == 0 {
+		return fmt.Errorf("create_concurrency shall be great than 0")
+	}
+	if cfg.General.DeleteConcurrency == 0 {
+		return fmt.Errorf("delete_concurrency shall be great than 0")
+	}
 	if cfg.GetCompressionFormat() == "lz4" {
 		return fmt.Errorf("clickhouse already compressed data by lz4")
 	}
 	if _, ok := ArchiveExtensions[cfg.GetCompressionFormat()]; !ok && cfg.GetCompressionFormat() != "none" {
 		return fmt.Errorf("'%s' is unsupported compression format", cfg.GetCompressionFormat())
 	}
+	if len(cfg.General.TableCompression) > 0 && cfg.GetCompressionFormat() == "none" {
+		return fmt.Errorf("general.table_compression can't be used with compression_format: none, tables are uploaded as directories")
+	}
+	for pattern, value := range cfg.General.TableCompression {
+		format, _, err := parseTableCompression(value)
+		if err != nil {
+			return fmt.Errorf("invalid general.table_compression for '%s': %v", pattern, err)
+		}
+		if format == "lz4" {
+			return fmt.Errorf("invalid general.table_compression for '%s': clickhouse already compressed data by lz4", pattern)
+		}
+		if _, ok := ArchiveExtensions[format]; !ok {
+			return fmt.Errorf("invalid general.table_compression for '%s': '%s' is unsupported compression format", pattern, format)
+		}
+	}
+	if cfg.General.MaxLocalBackupSizeBytes < 0 {
+		return fmt.Errorf("max_local_backup_size_bytes shall be great or equal than 0")
+	}
+	if cfg.General.MinFreeSpacePercent < 0 || cfg.General.MinFreeSpacePercent >= 100 {
+		return fmt.Errorf("min_free_space_percent shall be between 0 and 99")
+	}
+	if cfg.General.RBACBackupMode != "files" && cfg.General.RBACBackupMode != "sql" {
+		return fmt.Errorf("'%s' is unknown rbac_backup_mode, select one of: files, sql", cfg.General.RBACBackupMode)
+	}
+	if cfg.General.DiffCompareMode != "inode" && cfg.General.DiffCompareMode != "hash" {
+		return fmt.Errorf("'%s' is unknown diff_compare_mode, select one of: inode, hash", cfg.General.DiffCompareMode)
+	}
+	if cfg.General.TempDir != "" {
+		if err := checkWritableDir(cfg.General.TempDir); err != nil {
+			return fmt.Errorf("invalid temp_dir: %v", err)
+		}
+	}
 	if _, err := time.ParseDuration(cfg.ClickHouse.Timeout); err != nil {
 		return err
 	}
+	if cfg.ClickHouse.QueryTimeout != "" {
+		if _, err := time.ParseDuration(cfg.ClickHouse.QueryTimeout); err != nil {
+			return fmt.Errorf("invalid clickhouse.query_timeout: %v", err)
+		}
+	}
+	if cfg.ClickHouse.FreezeConcurrency < 1 {
+		return fmt.Errorf("clickhouse.freeze_concurrency shall be great than 0")
+	}
+	if cfg.ClickHouse.FreezeTimeout != "" {
+		if _, err := time.ParseDuration(cfg.ClickHouse.FreezeTimeout); err != nil {
+			return fmt.Errorf("invalid clickhouse.freeze_timeout: %v", err)
+		}
+	}
+	if cfg.ClickHouse.SyncReplicaTimeout != "" {
+		if _, err := time.ParseDuration(cfg.ClickHouse.SyncReplicaTimeout); err != nil {
+			return fmt.Errorf("invalid clickhouse.sync_replica_timeout: %v", err)
+		}
+	}
+	if cfg.ClickHouse.Protocol != "native" && cfg.ClickHouse.Protocol != "http" {
+		return fmt.Errorf("'%s' is unknown clickhouse.protocol, select one of: native, http", cfg.ClickHouse.Protocol)
+	}
+	if cfg.ClickHouse.ObjectDisks != "skip" && cfg.ClickHouse.ObjectDisks != "metadata" {
+		return fmt.Errorf("'%s' is unknown clickhouse.object_disks, select one of: skip, metadata", cfg.ClickHouse.ObjectDisks)
+	}
+	if (cfg.ClickHouse.TLSCert == "") != (cfg.ClickHouse.TLSKey == "") {
+		return fmt.Errorf("clickhouse.tls_cert and clickhouse.tls_key must be defined together")
+	}
+	if !cfg.ClickHouse.Secure && (cfg.ClickHouse.TLSCa != "" || cfg.ClickHouse.TLSCert != "") {
+		return fmt.Errorf("clickhouse.tls_ca, clickhouse.tls_cert and clickhouse.tls_key require clickhouse.secure: true")
+	}
+	if _, err := time.ParseDuration(cfg.General.TimeoutPerTable); err != nil {
+		return fmt.Errorf("invalid timeout_per_table: %v", err)
+	}
+	if _, err := time.ParseDuration(cfg.General.RunTimeout); err != nil {
+		return fmt.Errorf("invalid run_timeout: %v", err)
+	}
+	if cfg.S3.AbortIncompleteUploadsAfter != "" {
+		if _, err := time.ParseDuration(cfg.S3.AbortIncompleteUploadsAfter); err != nil {
+			return fmt.Errorf("invalid s3.abort_incomplete_uploads_after: %v", err)
+		}
+	}
+	if cfg.S3.HTTPTimeout != "" {
+		if _, err := time.ParseDuration(cfg.S3.HTTPTimeout); err != nil {
+			return fmt.Errorf("invalid s3.http_timeout: %v", err)
+		}
+	}
+	if err := validateS3Endpoint(cfg.S3); err != nil {
+		return err
+	}
 	if _, err := time.ParseDuration(cfg.COS.Timeout); err != nil {
 		return err
 	}
@@ -295,19 +782,214 @@ func ValidateConfig(cfg *Config) error {
 	return nil
 }
 
-// PrintConfig - print default / current config to stdout
-func PrintConfig(ctx *cli.Context) error {
-	var cfg *Config
-	if ctx == nil {
-		cfg = DefaultConfig()
-	} else {
-		cfg = GetConfig(ctx)
+// compressionLevels - valid compression_level range of formats which use it, other formats ignore compression_level
+var compressionLevels = map[string][2]int{
+	"gzip":   {-2, 9},
+	"bzip2":  {0, 9},
+	"br":     {0, 11},
+	"brotli": {0, 11},
+}
+
+func checkCompressionLevel(format string, level int) error {
+	if levels, exists := compressionLevels[format]; exists && (level < levels[0] || level > levels[1]) {
+		return fmt.Errorf("%d is out of range %d..%d of '%s'", level, levels[0], levels[1], format)
+	}
+	return nil
+}
+
+// CheckConfig - problems of config file and merged config, unlike LoadConfig it reports all of them: unknown keys of config file,
+// error of ValidateConfig, mutually exclusive options and compression levels out of range, each problem names the key
+func CheckConfig(configLocation string) []error {
+	configYaml, err := ioutil.ReadFile(configLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return []error{fmt.Errorf("can't open config file: %v", err)}
+	}
+	fields := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(configYaml, &fields); err != nil {
+		return []error{fmt.Errorf("can't parse config file: %v", err)}
+	}
+	problems := unknownKeys(reflect.TypeOf(Config{}), fields, "")
+	cfg, err := LoadConfig(configLocation)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if cfg == nil {
+		return problems
+	}
+	return append(problems, checkOptions(cfg)...)
+}
+
+// unknownKeys - keys of config file section which don't match yaml fields of t, nested sections are checked recursively, keys of map options are arbitrary
+func unknownKeys(t reflect.Type, fields map[interface{}]interface{}, prefix string) []error {
+	known := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; name != "" && name != "-" {
+			known[name] = t.Field(i).Type
+		}
+	}
+	keys := make([]string, 0, len(fields))
+	values := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		keys = append(keys, fmt.Sprint(key))
+		values[fmt.Sprint(key)] = value
+	}
+	sort.Strings(keys)
+	var problems []error
+	for _, key := range keys {
+		fieldType, exists := known[key]
+		if !exists {
+			problems = append(problems, fmt.Errorf("unknown key '%s%s'", prefix, key))
+			continue
+		}
+		if section, isSection := values[key].(map[interface{}]interface{}); isSection && fieldType.Kind() == reflect.Struct {
+			problems = append(problems, unknownKeys(fieldType, section, prefix+key+".")...)
+		}
+	}
+	return problems
+}
+
+// checkOptions - options which are valid one by one but conflict with each other and compression levels which are out of range of compression format
+func checkOptions(cfg *Config) []error {
+	var problems []error
+	if cfg.AzureBlob.AccountKey != "" && cfg.AzureBlob.SharedAccessSignature != "" {
+		problems = append(problems, fmt.Errorf("azblob.account_key and azblob.sas are mutually exclusive, only azblob.account_key is used"))
+	}
+	if cfg.AzureBlob.UseManagedIdentity && (cfg.AzureBlob.AccountKey != "" || cfg.AzureBlob.SharedAccessSignature != "") {
+		problems = append(problems, fmt.Errorf("azblob.use_managed_identity can't be used together with azblob.account_key or azblob.sas"))
+	}
+	if cfg.GCS.CredentialsJSON != "" && cfg.GCS.CredentialsFile != "" {
+		problems = append(problems, fmt.Errorf("gcs.credentials_json and gcs.credentials_file are mutually exclusive, only gcs.credentials_json is used"))
+	}
+	if (cfg.S3.AccessKey == "") != (cfg.S3.SecretKey == "") {
+		problems = append(problems, fmt.Errorf("s3.access_key and s3.secret_key shall be defined together"))
+	}
+	if cfg.General.ReferenceParts && (!cfg.General.UploadByPart || cfg.GetCompressionFormat() == "none") {
+		problems = append(problems, fmt.Errorf("general.reference_parts requires general.upload_by_part and compression_format other than none, parts are always uploaded"))
+	}
+	if cfg.API.MaxParallelOperations > 0 && !cfg.API.AllowParallel {
+		problems = append(problems, fmt.Errorf("api.max_parallel_operations requires api.allow_parallel"))
+	}
+	if cfg.GetCompressionFormat() != "unknown" && cfg.General.RemoteStorage != "none" {
+		if err := checkCompressionLevel(cfg.GetCompressionFormat(), cfg.GetCompressionLevel()); err != nil {
+			problems = append(problems, fmt.Errorf("invalid %s.compression_level: %v", cfg.General.RemoteStorage, err))
+		}
+	}
+	patterns := make([]string, 0, len(cfg.General.TableCompression))
+	for pattern := range cfg.General.TableCompression {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		format, level, _ := parseTableCompression(cfg.General.TableCompression[pattern])
+		if level < 0 {
+			continue
+		}
+		if err := checkCompressionLevel(format, level); err != nil {
+			problems = append(problems, fmt.Errorf("invalid general.table_compression for '%s': %v", pattern, err))
+		}
+	}
+	return problems
+}
+
+// PrintConfig - print config with redacted credentials in yaml or json format
+func PrintConfig(cfg *Config, format string) error {
+	body, err := MarshalConfig(cfg.Redacted(), format)
+	if err != nil {
+		return err
 	}
-	yml, _ := yaml.Marshal(&cfg)
-	fmt.Print(string(yml))
+	fmt.Print(string(body))
 	return nil
 }
 
+// MarshalConfig - return config in yaml or json format, json uses the same field names as yaml
+func MarshalConfig(cfg *Config, format string) ([]byte, error) {
+	yml, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "", "yaml":
+		return yml, nil
+	case "json":
+		var fields interface{}
+		if err := yaml.Unmarshal(yml, &fields); err != nil {
+			return nil, err
+		}
+		body, err := json.MarshalIndent(jsonCompatible(fields), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(body, '\n'), nil
+	}
+	return nil, fmt.Errorf("'%s' is unknown config format, use yaml or json", format)
+}
+
+// jsonCompatible - convert map[interface{}]interface{} produced by yaml.v2 into map[string]interface{}
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return result
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonCompatible(v[i])
+		}
+	}
+	return value
+}
+
+const redactedValue = "******"
+
+// Redacted - return copy of config with masked passwords, keys and credentials, empty values stay empty to show they are not set
+func (cfg *Config) Redacted() *Config {
+	redacted := *cfg
+	secrets := []*string{
+		&redacted.ClickHouse.Password,
+		&redacted.API.Password,
+		&redacted.S3.AccessKey,
+		&redacted.S3.SecretKey,
+		&redacted.GCS.CredentialsJSON,
+		&redacted.COS.SecretID,
+		&redacted.COS.SecretKey,
+		&redacted.AzureBlob.AccountKey,
+		&redacted.AzureBlob.SharedAccessSignature,
+		&redacted.AzureBlob.SSEKey,
+		&redacted.B2.ApplicationKey,
+		&redacted.FTP.Password,
+		&redacted.SFTP.Password,
+	}
+	for _, secret := range secrets {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	for _, proxyURL := range redacted.proxyURLs() {
+		if u, err := url.Parse(*proxyURL); err == nil {
+			*proxyURL = u.Redacted()
+		} else if *proxyURL != "" {
+			*proxyURL = redactedValue
+		}
+	}
+	return &redacted
+}
+
+// proxyURLs - general.proxy_url and proxy_url of each remote storage which supports it
+func (cfg *Config) proxyURLs() []*string {
+	return []*string{&cfg.General.ProxyURL, &cfg.S3.ProxyURL, &cfg.GCS.ProxyURL, &cfg.AzureBlob.ProxyURL, &cfg.COS.ProxyURL, &cfg.FTP.ProxyURL}
+}
+
+// inheritProxyURL - general.proxy_url is used by remote storage which doesn't have own proxy_url
+func (cfg *Config) inheritProxyURL() {
+	for _, proxyURL := range cfg.proxyURLs() {
+		if *proxyURL == "" {
+			*proxyURL = cfg.General.ProxyURL
+		}
+	}
+}
+
 func DefaultConfig() *Config {
 	availableConcurrency := uint8(1)
 	if runtime.NumCPU() > 1 {
@@ -315,29 +997,53 @@ func DefaultConfig() *Config {
 	}
 	return &Config{
 		General: GeneralConfig{
-			RemoteStorage:          "none",
-			MaxFileSize:            1 * 1024 * 1024 * 1024, // 1GB
-			BackupsToKeepLocal:     0,
-			BackupsToKeepRemote:    0,
-			LogLevel:               "info",
-			DisableProgressBar:     true,
-			UploadConcurrency:      availableConcurrency,
-			DownloadConcurrency:    availableConcurrency,
-			RestoreSchemaOnCluster: "",
-			UploadByPart:           true,
-			DownloadByPart:         true,
+			RemoteStorage:             "none",
+			MaxFileSize:               1 * 1024 * 1024 * 1024, // 1GB
+			BackupsToKeepLocal:        0,
+			BackupsToKeepRemote:       0,
+			LogLevel:                  "info",
+			LogFormat:                 "text",
+			DisableProgressBar:        true,
+			UploadConcurrency:         availableConcurrency,
+			DownloadConcurrency:       availableConcurrency,
+			CreateConcurrency:         1,
+			DeleteConcurrency:         availableConcurrency,
+			RestoreSchemaOnCluster:    "",
+			RestoreDistributedCluster: "",
+			UploadByPart:              true,
+			DownloadByPart:            true,
+			DiffCompareMode:           "inode",
+			VerifyUpload:              true,
+			RestoreSchemaRewrite:      false,
+			CleanShadowBeforeBackup:   false,
+			DedupParts:                false,
+			ReferenceParts:            false,
+			TimeoutPerTable:           "0s",
+			RunTimeout:                "0s",
+			FailOnTableTimeout:        true,
+			KeepFailedBackups:         false,
+			BackupManifest:            false,
+			BackupLogTable:            "",
+			BackupNameTemplate:        "",
+			RBACBackupMode:            "files",
 		},
 		ClickHouse: ClickHouseConfig{
 			Username: "default",
 			Password: "",
 			Host:     "localhost",
 			Port:     9000,
+			Protocol: "native",
 			SkipTables: []string{
 				"system.*",
 				"INFORMATION_SCHEMA.*",
 				"information_schema.*",
 			},
 			Timeout:                          "5m",
+			QueryTimeout:                     "5m",
+			FreezeTimeout:                    "5m",
+			FreezeConcurrency:                1,
+			SyncReplicaTimeout:               "1h",
+			ObjectDisks:                      "skip",
 			SyncReplicatedTables:             false,
 			LogSQLQueries:                    false,
 			ConfigDir:                        "/etc/clickhouse-server/",
@@ -361,11 +1067,17 @@ func DefaultConfig() *Config {
 			DisableCertVerification: false,
 			StorageClass:            s3.StorageClassStandard,
 			Concurrency:             1,
+			ListConcurrency:         1,
 			PartSize:                0,
+			MaxIdleConns:            100,
 		},
 		GCS: GCSConfig{
-			CompressionLevel:  1,
-			CompressionFormat: "tar",
+			CompressionLevel:    1,
+			CompressionFormat:   "tar",
+			ChunkSize:           16 * 1024 * 1024,
+			MaxRetries:          3,
+			RetryInitialBackoff: "1s",
+			RetryMaxBackoff:     "30s",
 		},
 		COS: COSConfig{
 			RowURL:            "",
@@ -373,6 +1085,7 @@ func DefaultConfig() *Config {
 			SecretID:          "",
 			SecretKey:         "",
 			Path:              "",
+			Concurrency:       1,
 			CompressionFormat: "tar",
 			CompressionLevel:  1,
 		},
@@ -392,6 +1105,11 @@ func DefaultConfig() *Config {
 			CompressionLevel:  1,
 			Concurrency:       1,
 		},
+		B2: B2Config{
+			Endpoint:          "https://api.backblazeb2.com",
+			CompressionFormat: "tar",
+			CompressionLevel:  1,
+		},
 	}
 }
 
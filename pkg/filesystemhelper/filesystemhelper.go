@@ -1,12 +1,14 @@
 package filesystemhelper
 
 import (
+	"errors"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,8 +16,35 @@ import (
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	apexLog "github.com/apex/log"
+	"github.com/otiai10/copy"
 )
 
+// linkFile - os.Link, replaced in tests to simulate hardlink failures
+var linkFile = os.Link
+
+var crossDeviceWarning sync.Once
+
+// Hardlink - os.Link which explains EXDEV error, backup folder and ClickHouse data of the same disk can't be hardlinked when they are on different filesystems
+func Hardlink(oldname, newname string) error {
+	err := linkFile(oldname, newname)
+	if err != nil && errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("%w, `backup` folder shall be on the same filesystem as ClickHouse data of the disk, check mount points and `disk_mapping`", err)
+	}
+	return err
+}
+
+// HardlinkOrCopy - hardlink oldname to newname, file is copied when they are on different filesystems, so download doesn't fail after data was already transferred
+func HardlinkOrCopy(oldname, newname string) error {
+	err := linkFile(oldname, newname)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	crossDeviceWarning.Do(func() {
+		apexLog.Warnf("%v, files will be copied instead of hardlinks, it requires additional disk space, check mount points and `disk_mapping`", err)
+	})
+	return copy.Copy(oldname, newname)
+}
+
 // Chown - set permission on file to clickhouse user
 // This is necessary that the ClickHouse will be able to read parts files on restore
 func Chown(filename string, ch *clickhouse.ClickHouse) error {
@@ -124,7 +153,7 @@ func CopyData(backupName string, backupTable metadata.TableMetadata, disks []cli
 			} else if !info.IsDir() {
 				return fmt.Errorf("'%s' should be directory or absent", detachedPath)
 			}
-			dbAndTableDir := path.Join(common.TablePathEncode(backupTable.Database), common.TablePathEncode(backupTable.Table))
+			dbAndTableDir := common.TablePath(backupTable.Database, backupTable.Table)
 			partPath := path.Join(backupDisk.Path, "backup", backupName, "shadow", dbAndTableDir, backupDisk.Name, part.Name)
 			// Legacy backup support
 			if _, err := os.Stat(partPath); os.IsNotExist(err) {
@@ -145,7 +174,7 @@ func CopyData(backupName string, backupTable metadata.TableMetadata, disks []cli
 					return nil
 				}
 				log.Debugf("Link %s -> %s", filePath, dstFilePath)
-				if err := os.Link(filePath, dstFilePath); err != nil {
+				if err := Hardlink(filePath, dstFilePath); err != nil {
 					if !os.IsExist(err) {
 						return fmt.Errorf("failed to create hard link '%s' -> '%s': %w", filePath, dstFilePath, err)
 					}
@@ -160,14 +189,67 @@ func CopyData(backupName string, backupTable metadata.TableMetadata, disks []cli
 	return nil
 }
 
+// CopyDetached - link parts from `detached` folder of backup table to `detached` folder of restored table, parts are not attached,
+// part which already exists in destination `detached` folder is skipped
+func CopyDetached(backupName string, backupTable metadata.TableMetadata, disks []clickhouse.Disk, tableDataPaths []string, ch *clickhouse.ClickHouse) error {
+	dstDataPaths := clickhouse.GetDisksByPaths(disks, tableDataPaths)
+	log := apexLog.WithFields(apexLog.Fields{
+		"operation": "CopyDetached",
+		"table":     fmt.Sprintf("%s.%s", backupTable.Database, backupTable.Table),
+	})
+	dbAndTableDir := common.TablePath(backupTable.Database, backupTable.Table)
+	for _, backupDisk := range disks {
+		if len(backupTable.DetachedParts[backupDisk.Name]) == 0 {
+			continue
+		}
+		dstDataPath, exists := dstDataPaths[backupDisk.Name]
+		if !exists {
+			log.Warnf("table doesn't have data path on disk '%s', skip %d detached parts", backupDisk.Name, len(backupTable.DetachedParts[backupDisk.Name]))
+			continue
+		}
+		for _, part := range backupTable.DetachedParts[backupDisk.Name] {
+			detachedPath := filepath.Join(dstDataPath, "detached", part.Name)
+			if _, err := os.Stat(detachedPath); err == nil {
+				log.Warnf("'%s' already exists, skip detached part", detachedPath)
+				continue
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			partPath := path.Join(backupDisk.Path, "backup", backupName, "detached", dbAndTableDir, backupDisk.Name, part.Name)
+			if err := filepath.Walk(partPath, func(filePath string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				dstFilePath := filepath.Join(detachedPath, strings.Trim(strings.TrimPrefix(filePath, partPath), "/"))
+				if info.IsDir() {
+					return MkdirAll(dstFilePath, ch)
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				if err := Hardlink(filePath, dstFilePath); err != nil {
+					return fmt.Errorf("failed to create hard link '%s' -> '%s': %w", filePath, dstFilePath, err)
+				}
+				return Chown(dstFilePath, ch)
+			}); err != nil {
+				return fmt.Errorf("error during filepath.Walk for detached part '%s': %w", part.Name, err)
+			}
+			log.WithField("disk", backupDisk.Name).WithField("part", part.Name).Debug("copied to 'detached'")
+		}
+	}
+	return nil
+}
+
 func IsPartInPartition(partName string, partitionsBackupMap common.EmptyMap) bool {
 	_, ok := partitionsBackupMap[strings.Split(partName, "_")[0]]
 	return ok
 }
 
+// MoveShadow - move frozen parts from shadowPath to backupPartsPath, size of each part and sha256 of its checksums.txt are saved to describe part content for `upload --diff-from-remote`
 func MoveShadow(shadowPath, backupPartsPath string, partitionsBackupMap common.EmptyMap) ([]metadata.Part, int64, error) {
 	size := int64(0)
 	parts := []metadata.Part{}
+	partIndex := map[string]int{}
 	err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
 		relativePath := strings.Trim(strings.TrimPrefix(filePath, shadowPath), "/")
 		pathParts := strings.SplitN(relativePath, "/", 4)
@@ -181,6 +263,7 @@ func MoveShadow(shadowPath, backupPartsPath string, partitionsBackupMap common.E
 		}
 		dstFilePath := filepath.Join(backupPartsPath, pathParts[3])
 		if info.IsDir() {
+			partIndex[pathParts[3]] = len(parts)
 			parts = append(parts, metadata.Part{
 				Name: pathParts[3],
 			})
@@ -191,12 +274,65 @@ func MoveShadow(shadowPath, backupPartsPath string, partitionsBackupMap common.E
 			return nil
 		}
 		size += info.Size()
+		partName := strings.SplitN(pathParts[3], "/", 2)[0]
+		if i, exists := partIndex[partName]; exists {
+			parts[i].Size += info.Size()
+			if info.Name() == "checksums.txt" {
+				checksumsHash, err := hashFile(filePath)
+				if err != nil {
+					return err
+				}
+				parts[i].HashOfAllFiles = checksumsHash
+			}
+		}
 		return os.Rename(filePath, dstFilePath)
 	})
 	return parts, size, err
 }
 
-func IsDuplicatedParts(part1, part2 string) error {
+// LinkDetached - hardlink parts from `detached` folder of table to backupPartsPath, `detached` folder itself is kept as is,
+// all detached parts are linked regardless of partitions cause their names could have prefix like `broken_` or `ignored_`
+func LinkDetached(detachedPath, backupPartsPath string) ([]metadata.Part, int64, error) {
+	size := int64(0)
+	parts := []metadata.Part{}
+	partIndex := map[string]int{}
+	if _, err := os.Stat(detachedPath); os.IsNotExist(err) {
+		return parts, 0, nil
+	}
+	err := filepath.Walk(detachedPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath := strings.Trim(strings.TrimPrefix(filePath, detachedPath), "/")
+		if relativePath == "" {
+			return nil
+		}
+		partName := strings.SplitN(relativePath, "/", 2)[0]
+		dstFilePath := filepath.Join(backupPartsPath, relativePath)
+		if info.IsDir() {
+			if partName == relativePath {
+				partIndex[partName] = len(parts)
+				parts = append(parts, metadata.Part{
+					Name: partName,
+				})
+			}
+			return os.MkdirAll(dstFilePath, 0750)
+		}
+		i, exists := partIndex[partName]
+		if !exists || !info.Mode().IsRegular() {
+			apexLog.Debugf("'%s' is not a file of detached part, skipping", filePath)
+			return nil
+		}
+		size += info.Size()
+		parts[i].Size += info.Size()
+		return Hardlink(filePath, dstFilePath)
+	})
+	return parts, size, err
+}
+
+// IsDuplicatedParts - check that all files in part1 and part2 are the same files (hardlinks),
+// when hashCache is not nil then files with different inodes are compared by size and content hash
+func IsDuplicatedParts(part1, part2 string, hashCache *FileHashCache) error {
 	p1, err := os.Open(part1)
 	if err != nil {
 		return err
@@ -235,21 +371,49 @@ func IsDuplicatedParts(part1, part2 string) error {
 		if err != nil {
 			return err
 		}
-		if !os.SameFile(part1File, part2File) {
+		if os.SameFile(part1File, part2File) {
+			continue
+		}
+		if hashCache == nil {
 			return fmt.Errorf("file '%s' is different", f)
 		}
+		if part1File.Size() != part2File.Size() {
+			return fmt.Errorf("file '%s' is different, size %d != %d", f, part1File.Size(), part2File.Size())
+		}
+		hash1, err := hashCache.Hash(path.Join(part1, f), part1File)
+		if err != nil {
+			return err
+		}
+		hash2, err := hashCache.Hash(path.Join(part2, f), part2File)
+		if err != nil {
+			return err
+		}
+		if hash1 != hash2 {
+			return fmt.Errorf("file '%s' is different, hash %s != %s", f, hash1, hash2)
+		}
 	}
 	return nil
 }
 
-func CreatePartitionsToBackupMap(partitions []string) common.EmptyMap {
-	if len(partitions) == 0 {
-		return make(common.EmptyMap, 0)
-	} else {
-		partitionsMap := common.EmptyMap{}
-		for _, partition := range partitions {
-			partitionsMap[partition] = struct{}{}
+// CreatePartitionsToBackupMap - parse `--partitions` values separated by comma, `db.table:id1,id2` limits partitions only for tables matched by `db.table` pattern,
+// following IDs without `:` belong to the same table pattern until the end of value
+func CreatePartitionsToBackupMap(partitions []string) common.TablePartitions {
+	partitionsMap := common.TablePartitions{}
+	for _, value := range partitions {
+		tablePattern := ""
+		for _, partition := range strings.Split(value, ",") {
+			partition = strings.TrimSpace(partition)
+			if i := strings.LastIndex(partition, ":"); i >= 0 {
+				tablePattern, partition = partition[:i], partition[i+1:]
+			}
+			if partition == "" {
+				continue
+			}
+			if _, exists := partitionsMap[tablePattern]; !exists {
+				partitionsMap[tablePattern] = common.EmptyMap{}
+			}
+			partitionsMap[tablePattern][partition] = struct{}{}
 		}
-		return partitionsMap
 	}
+	return partitionsMap
 }
@@ -0,0 +1,148 @@
+package filesystemhelper
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func writePart(t *testing.T, partPath string, files map[string]string) {
+	assert.NoError(t, os.MkdirAll(partPath, 0755))
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(path.Join(partPath, name), []byte(content), 0644))
+	}
+}
+
+func TestIsDuplicatedParts(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{"data.bin": "some data", "checksums.txt": "checksums"}
+	existsPart := path.Join(tmpDir, "exists", "all_1_1_0")
+	copiedPart := path.Join(tmpDir, "copied", "all_1_1_0")
+	linkedPart := path.Join(tmpDir, "linked", "all_1_1_0")
+	changedPart := path.Join(tmpDir, "changed", "all_1_1_0")
+	writePart(t, existsPart, files)
+	writePart(t, copiedPart, files)
+	writePart(t, changedPart, map[string]string{"data.bin": "some DATA", "checksums.txt": "checksums"})
+	assert.NoError(t, os.MkdirAll(linkedPart, 0755))
+	for name := range files {
+		assert.NoError(t, os.Link(path.Join(existsPart, name), path.Join(linkedPart, name)))
+	}
+
+	// inode mode
+	assert.NoError(t, IsDuplicatedParts(existsPart, linkedPart, nil))
+	assert.Error(t, IsDuplicatedParts(existsPart, copiedPart, nil))
+	assert.Error(t, IsDuplicatedParts(existsPart, changedPart, nil))
+
+	// hash mode
+	hashCache := NewFileHashCache()
+	assert.NoError(t, IsDuplicatedParts(existsPart, linkedPart, hashCache))
+	assert.Equal(t, 0, hashCache.Len())
+	assert.NoError(t, IsDuplicatedParts(existsPart, copiedPart, hashCache))
+	assert.Equal(t, 4, hashCache.Len())
+	assert.Error(t, IsDuplicatedParts(existsPart, changedPart, hashCache))
+}
+
+func TestMoveShadowPartManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	shadowPath := path.Join(tmpDir, "shadow")
+	backupPath := path.Join(tmpDir, "backup")
+	assert.NoError(t, os.MkdirAll(backupPath, 0755))
+	writePart(t, path.Join(shadowPath, "data", "default", "events", "all_1_1_0"), map[string]string{"data.bin": "some data", "checksums.txt": "checksums"})
+	writePart(t, path.Join(shadowPath, "data", "default", "events", "all_2_2_0"), map[string]string{"data.bin": "other", "checksums.txt": "checksums"})
+
+	parts, size, err := MoveShadow(shadowPath, backupPath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(32), size)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, "all_1_1_0", parts[0].Name)
+	assert.Equal(t, int64(18), parts[0].Size)
+	assert.Equal(t, int64(14), parts[1].Size)
+	assert.NotEmpty(t, parts[0].HashOfAllFiles)
+	assert.Equal(t, parts[0].HashOfAllFiles, parts[1].HashOfAllFiles)
+	assert.FileExists(t, path.Join(backupPath, "all_1_1_0", "data.bin"))
+}
+
+func TestLinkAndCopyDetached(t *testing.T) {
+	tmpDir := t.TempDir()
+	detachedPath := path.Join(tmpDir, "data", "default", "events", "detached")
+	backupPath := path.Join(tmpDir, "backup", "test_backup", "detached", "default", "events", "default")
+	writePart(t, path.Join(detachedPath, "broken_all_1_1_0"), map[string]string{"data.bin": "broken", "checksums.txt": "checksums"})
+	writePart(t, path.Join(detachedPath, "ignored_all_2_2_0", "p.proj"), map[string]string{"data.bin": "projection"})
+	assert.NoError(t, ioutil.WriteFile(path.Join(detachedPath, "stray.txt"), []byte("not a part"), 0644))
+
+	parts, size, err := LinkDetached(detachedPath, backupPath)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(25), size)
+	assert.Equal(t, []metadata.Part{{Name: "broken_all_1_1_0", Size: 15}, {Name: "ignored_all_2_2_0", Size: 10}}, parts)
+	assert.FileExists(t, path.Join(backupPath, "ignored_all_2_2_0", "p.proj", "data.bin"))
+	assert.NoFileExists(t, path.Join(backupPath, "stray.txt"))
+
+	absentParts, absentSize, err := LinkDetached(path.Join(tmpDir, "absent"), backupPath)
+	assert.NoError(t, err)
+	assert.Empty(t, absentParts)
+	assert.Equal(t, int64(0), absentSize)
+
+	uid, gid := os.Getuid(), os.Getgid()
+	ch := &clickhouse.ClickHouse{}
+	ch.SetUid(&uid)
+	ch.SetGid(&gid)
+	restoredPath := path.Join(tmpDir, "restored", "data", "default", "events")
+	writePart(t, path.Join(restoredPath, "detached", "ignored_all_2_2_0"), map[string]string{"data.bin": "existing"})
+	table := metadata.TableMetadata{Database: "default", Table: "events", DetachedParts: map[string][]metadata.Part{"default": parts}}
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir}}
+	assert.NoError(t, CopyDetached("test_backup", table, disks, []string{restoredPath + "/"}, ch))
+	content, err := ioutil.ReadFile(path.Join(restoredPath, "detached", "broken_all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "broken", string(content))
+	content, err = ioutil.ReadFile(path.Join(restoredPath, "detached", "ignored_all_2_2_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "existing", string(content), "existing detached part shall be kept")
+}
+
+func TestCreatePartitionsToBackupMap(t *testing.T) {
+	assert.Empty(t, CreatePartitionsToBackupMap(nil).ForTable("default", "t1"))
+
+	partitions := CreatePartitionsToBackupMap([]string{"202201", "default.t1:202301,202302", "db?.*:all"})
+	assert.Equal(t, common.TablePartitions{
+		"":           {"202201": {}},
+		"default.t1": {"202301": {}, "202302": {}},
+		"db?.*":      {"all": {}},
+	}, partitions)
+	assert.Equal(t, common.EmptyMap{"202301": {}, "202302": {}}, partitions.ForTable("default", "t1"))
+	assert.Equal(t, common.EmptyMap{"all": {}}, partitions.ForTable("db1", "t1"))
+	assert.Equal(t, common.EmptyMap{"202201": {}}, partitions.ForTable("default", "t2"), "partitions without table shall be used for other tables")
+
+	partitions = CreatePartitionsToBackupMap([]string{"default.t1:202301", "202302"})
+	assert.Equal(t, common.EmptyMap{"202301": {}}, partitions.ForTable("default", "t1"))
+	assert.Equal(t, common.EmptyMap{"202302": {}}, partitions.ForTable("default", "t2"), "each value shall start without table")
+}
+
+func TestCrossDeviceHardlink(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldname, newname := path.Join(tmpDir, "data.bin"), path.Join(tmpDir, "copy.bin")
+	assert.NoError(t, ioutil.WriteFile(oldname, []byte("data"), 0640))
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	defer func() { linkFile = os.Link }()
+
+	err := Hardlink(oldname, newname)
+	assert.ErrorIs(t, err, syscall.EXDEV)
+	assert.Contains(t, err.Error(), "check mount points and `disk_mapping`")
+	assert.NoFileExists(t, newname)
+
+	assert.NoError(t, HardlinkOrCopy(oldname, newname))
+	content, err := ioutil.ReadFile(newname)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+	info, err := os.Stat(newname)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
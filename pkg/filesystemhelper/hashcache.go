@@ -0,0 +1,69 @@
+package filesystemhelper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type fileHashKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// FileHashCache - cache of file content hashes, allow to avoid re-reading the same file during compare parts by content
+type FileHashCache struct {
+	mu     sync.Mutex
+	hashes map[fileHashKey]string
+}
+
+func NewFileHashCache() *FileHashCache {
+	return &FileHashCache{
+		hashes: map[fileHashKey]string{},
+	}
+}
+
+// Hash - return sha256 of file content, file size and modification time are part of cache key, so changed file will read again
+func (c *FileHashCache) Hash(filePath string, info os.FileInfo) (string, error) {
+	key := fileHashKey{path: filePath, size: info.Size(), modTime: info.ModTime()}
+	c.mu.Lock()
+	hash, exists := c.hashes[key]
+	c.mu.Unlock()
+	if exists {
+		return hash, nil
+	}
+	hash, err := hashFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.hashes[key] = hash
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// Len - return count of cached hashes
+func (c *FileHashCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.hashes)
+}
+
+// hashFile - return sha256 of file content
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("can't calculate hash for %s: %v", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,63 @@
+// Package logjson implements a JSON handler which writes one object per line with fields on the top level.
+package logjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Default handler outputting to stderr.
+var Default = New(os.Stderr)
+
+// Handler implementation.
+type Handler struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// New handler.
+func New(w io.Writer) *Handler {
+	return &Handler{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// HandleLog implements log.Handler, `ts`, `lvl` and `msg` keys can't be overridden by fields, errors are written as strings.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	record := make(map[string]interface{}, len(e.Fields)+3)
+	for name, value := range e.Fields {
+		record[name] = jsonValue(value)
+	}
+	record["ts"] = e.Timestamp.Format(time.RFC3339Nano)
+	record["lvl"] = e.Level.String()
+	record["msg"] = e.Message
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.enc.Encode(record)
+}
+
+// jsonValue - encoding/json writes error and other values without exported fields as `{}`, so they are written by fmt
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, time.Time:
+		return v
+	case error:
+		return v.Error()
+	case json.Marshaler:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+	if _, err := json.Marshal(value); err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return value
+}
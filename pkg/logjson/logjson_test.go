@@ -0,0 +1,43 @@
+package logjson_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/logjson"
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.Now = func() time.Time {
+		return time.Unix(0, 0).UTC()
+	}
+}
+
+func Test(t *testing.T) {
+	var buf bytes.Buffer
+
+	log.SetHandler(logjson.New(&buf))
+	log.WithFields(log.Fields{"backup": "daily", "operation": "upload"}).WithField("table", "default.events").WithField("size", 1024).Info("done")
+	log.WithField("operation", "download").WithError(fmt.Errorf("can't download: timeout")).Error("failed")
+	log.WithField("msg", "field").WithField("elapsed", time.Second).Warn("message")
+
+	expected := []map[string]interface{}{
+		{"ts": "1970-01-01T00:00:00Z", "lvl": "info", "msg": "done", "backup": "daily", "operation": "upload", "table": "default.events", "size": float64(1024)},
+		{"ts": "1970-01-01T00:00:00Z", "lvl": "error", "msg": "failed", "operation": "download", "error": "can't download: timeout"},
+		{"ts": "1970-01-01T00:00:00Z", "lvl": "warn", "msg": "message", "elapsed": "1s"},
+	}
+	scanner := bufio.NewScanner(&buf)
+	var records []map[string]interface{}
+	for scanner.Scan() {
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	assert.Equal(t, expected, records)
+}
@@ -15,3 +15,11 @@ func (tm *TableMetadata) Load(location string) (uint64, error) {
 	}
 	return uint64(len(data)), nil
 }
+
+func (bm *BackupMetadata) Load(location string) error {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, bm)
+}
@@ -16,6 +16,8 @@ type BackupMetadata struct {
 	CreationDate            time.Time         `json:"creation_date"`
 	Tags                    string            `json:"tags,omitempty"` // "type=manual", "type=sheduled", "hostname": "", "shard="
 	ClickHouseVersion       string            `json:"clickhouse_version,omitempty"`
+	ClickHouseTimezone      string            `json:"clickhouse_timezone,omitempty"`
+	ClickHouseServerUUID    string            `json:"clickhouse_server_uuid,omitempty"`
 	DataSize                uint64            `json:"data_size,omitempty"`
 	MetadataSize            uint64            `json:"metadata_size"`
 	RBACSize                uint64            `json:"rbac_size,omitempty"`
@@ -25,6 +27,34 @@ type BackupMetadata struct {
 	Tables                  []TableTitle      `json:"tables"`
 	DataFormat              string            `json:"data_format"`
 	RequiredBackup          string            `json:"required_backup,omitempty"`
+	SchemaOnly              bool              `json:"schema_only,omitempty"`
+	SharedParts             []string          `json:"shared_parts,omitempty"` // remote keys of content-addressed part archives referenced by this backup
+	// ReferencedBackups - remote backups which contain archives of parts referenced by this backup instead of upload, they can't be deleted while this backup exists
+	ReferencedBackups []string `json:"referenced_backups,omitempty"`
+	// TableStats - durations and sizes of each table in backup, the same as `stats` in table metadata
+	TableStats []TableStats `json:"table_stats,omitempty"`
+	// RBACObjects - access entities created by SQL, they are saved by `create --rbac` with `rbac_backup_mode: sql`
+	RBACObjects []RBACObject `json:"rbac_objects,omitempty"`
+}
+
+// RBACObject - access entity with its SHOW CREATE statement, Grants are SHOW GRANTS of users and roles
+type RBACObject struct {
+	Type   string   `json:"type"` // ROLE, SETTINGS PROFILE, USER, QUOTA or ROW POLICY
+	Name   string   `json:"name"`
+	Create string   `json:"create"`
+	Grants []string `json:"grants,omitempty"`
+}
+
+// TableStats - durations of backup steps in milliseconds and sizes of table data,
+// archives are compressed while they are streamed into remote storage, so compression time is included into upload
+type TableStats struct {
+	Database         string `json:"database"`
+	Table            string `json:"table"`
+	FreezeMs         int64  `json:"freeze_ms,omitempty"`
+	CopyMs           int64  `json:"copy_ms,omitempty"`
+	UploadMs         int64  `json:"upload_ms,omitempty"`
+	UncompressedSize uint64 `json:"uncompressed_size,omitempty"`
+	CompressedSize   uint64 `json:"compressed_size,omitempty"`
 }
 
 type DatabasesMeta struct {
@@ -35,6 +65,12 @@ type DatabasesMeta struct {
 
 type TableMetadata struct {
 	Files map[string][]string `json:"files,omitempty"`
+	// ArchiveParts - names of sequentially numbered parts for archives from Files and detached parts archives which were split by max_archive_size
+	ArchiveParts map[string][]string `json:"archive_parts,omitempty"`
+	// ArchiveSizes - uploaded sizes of archives from Files and detached parts archives, size of split archive is the sum of its parts
+	ArchiveSizes map[string]int64 `json:"archive_sizes,omitempty"`
+	// CompressionFormat - format of table archives when it was overridden by general.table_compression, empty means DataFormat of backup
+	CompressionFormat string `json:"compression_format,omitempty"`
 	// Disks       map[string]string   `json:"disks"` // "default": "/var/lib/clickhouse"
 	Table       string            `json:"table"`
 	Database    string            `json:"database"`
@@ -47,7 +83,23 @@ type TableMetadata struct {
 	TotalBytes           uint64           `json:"total_bytes,omitempty"` // total table size
 	DependenciesTable    string           `json:"dependencies_table,omitempty"`
 	DependenciesDatabase string           `json:"dependencies_database,omitempty"`
-	MetadataOnly         bool             `json:"metadata_only"`
+	MetadataOnly         bool             `json:"metadata_only"` // schema only backup or table without parts, data of such table isn't uploaded or downloaded
+	// DetachedParts - parts from `detached` folder of table on each disk, they are backed up by `create --include-detached` and are not attached during restore
+	DetachedParts map[string][]Part `json:"detached_parts,omitempty"`
+	// Partitions - partition IDs passed by `create --partitions`, table data contains only these partitions when it is not empty
+	Partitions []string `json:"partitions,omitempty"`
+	// Rows - rows count in backed up parts, it is compared with SELECT count() by `restore --verify-rows`, nil for schema only tables and old backups
+	Rows *uint64 `json:"rows,omitempty"`
+	// ObjectDisks - disks with type other than `local` which contain table data, FREEZE copies only local stubs of parts from such disks
+	ObjectDisks []string `json:"object_disks,omitempty"`
+	// DataSkipReason - why table data isn't backed up, restore refuses data of such tables
+	DataSkipReason string `json:"data_skip_reason,omitempty"`
+	// ObjectDiskKeys - remote objects referenced by part stubs on each object disk, they are saved with `object_disks: metadata`
+	ObjectDiskKeys map[string][]string `json:"object_disk_keys,omitempty"`
+	// FreezeName - name of FREEZE WITH NAME which created table data, upload releases it by SYSTEM UNFREEZE
+	FreezeName string `json:"freeze_name,omitempty"`
+	// Stats - durations of create and upload of table and its sizes, nil for old backups
+	Stats *TableStats `json:"stats,omitempty"`
 }
 
 type Part struct {
@@ -55,11 +107,14 @@ type Part struct {
 	Name      string `json:"name"`
 	Required  bool   `json:"required,omitempty"`
 	// Path                              string    `json:"path"`              // TODO: make it relative? look like useless now, can be calculated from Name
-	HashOfAllFiles                    string     `json:"hash_of_all_files,omitempty"` // ???
+	HashOfAllFiles                    string     `json:"hash_of_all_files,omitempty"` // sha256 of checksums.txt, calculated during create
 	HashOfUncompressedFiles           string     `json:"hash_of_uncompressed_files,omitempty"`
 	UncompressedHashOfCompressedFiles string     `json:"uncompressed_hash_of_compressed_files,omitempty"` // ???
 	PartitionID                       string     `json:"partition_id,omitempty"`
 	ModificationTime                  *time.Time `json:"modification_time,omitempty"`
 	Size                              int64      `json:"size,omitempty"`
+	SharedKey                         string     `json:"shared_key,omitempty"` // remote key of content-addressed archive which contains this part
+	RefBackup                         string     `json:"ref_backup,omitempty"` // other remote backup which uploaded the same part with the same checksum
+	RefKey                            string     `json:"ref_key,omitempty"`    // remote key of archive of RefBackup which contains this part
 	// bytes_on_disk, data_compressed_bytes, data_uncompressed_bytes
 }
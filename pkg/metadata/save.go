@@ -3,9 +3,10 @@ package metadata
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
 )
 
 func (tm *TableMetadata) Save(location string, metadataOnly bool) (uint64, error) {
@@ -33,7 +34,15 @@ func (tm *TableMetadata) Save(location string, metadataOnly bool) (uint64, error
 		newTM.Parts = parts
 		newTM.Size = tm.Size
 		newTM.TotalBytes = tm.TotalBytes
-		newTM.MetadataOnly = false
+		// table without data keeps MetadataOnly from backup
+		newTM.MetadataOnly = tm.MetadataOnly
+		newTM.DetachedParts = tm.DetachedParts
+		newTM.Partitions = tm.Partitions
+		newTM.Rows = tm.Rows
+		newTM.ObjectDisks = tm.ObjectDisks
+		newTM.DataSkipReason = tm.DataSkipReason
+		newTM.ObjectDiskKeys = tm.ObjectDiskKeys
+		newTM.FreezeName = tm.FreezeName
 	}
 	if err := os.MkdirAll(path.Dir(location), 0750); err != nil {
 		return 0, err
@@ -42,7 +51,7 @@ func (tm *TableMetadata) Save(location string, metadataOnly bool) (uint64, error
 	if err != nil {
 		return 0, err
 	}
-	return uint64(len(body)), ioutil.WriteFile(location, body, 0640)
+	return uint64(len(body)), utils.WriteFileAtomic(location, body, 0640)
 }
 
 func (bm *BackupMetadata) Save(location string) error {
@@ -50,7 +59,7 @@ func (bm *BackupMetadata) Save(location string) error {
 	if err != nil {
 		return fmt.Errorf("can't marshall backup metadata: %v", err)
 	}
-	if err := ioutil.WriteFile(location, tbBody, 0640); err != nil {
+	if err := utils.WriteFileAtomic(location, tbBody, 0640); err != nil {
 		return fmt.Errorf("can't save backup metadata: %v", err)
 	}
 	return nil
@@ -0,0 +1,159 @@
+package new_storage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	apexLog "github.com/apex/log"
+	"github.com/djherbis/buffer"
+	"github.com/djherbis/nio/v3"
+	"github.com/mholt/archiver/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+// ArchiveSource - remote archive which entries are copied by CompressedStreamCopy
+type ArchiveSource struct {
+	// Keys - remote key of archive or sequentially numbered parts of split archive, compression format is detected by extension
+	Keys []string
+	// Prefix - prepended to names of entries, archive of shared part contains files of part without part folder
+	Prefix string
+	// Parts - top level folders which entries are copied, all entries are copied when it is nil
+	Parts map[string]bool
+}
+
+// CompressedStreamCopy - copy entries of source archives into new remotePath archive from remote to remote without local disk, only one entry is buffered,
+// new archive is split into parts by max_archive_size, return names of uploaded parts (nil for single archive), count of uploaded bytes and count of copied files of each top level folder
+func (bd *BackupDestination) CompressedStreamCopy(sources []ArchiveSource, remotePath string) ([]string, int64, map[string]int, error) {
+	var remoteParts []string
+	var uploadedBytes int64
+	var copied map[string]int
+	err := retryUpload(func() error {
+		copied = map[string]int{}
+		if bd.maxArchiveSize > 0 {
+			w := &archivePartsWriter{bd: bd, remotePath: remotePath, maxSize: bd.maxArchiveSize}
+			if err := bd.copyArchiveEntries(w, sources, copied); err != nil {
+				w.abort(err)
+				return err
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			uploadedBytes = 0
+			for i, partName := range w.parts {
+				if bd.verifyUpload {
+					if err := bd.verifyUploaded(partName, w.sizes[i], nil); err != nil {
+						return err
+					}
+				}
+				uploadedBytes += w.sizes[i]
+			}
+			remoteParts = w.parts
+			return nil
+		}
+		pipeReader, w := nio.Pipe(buffer.New(BufferSize))
+		body := &countingReadCloser{ReadCloser: pipeReader}
+		g := errgroup.Group{}
+		g.Go(func() error {
+			if err := bd.copyArchiveEntries(w, sources, copied); err != nil {
+				_ = w.CloseWithError(err)
+				return err
+			}
+			return w.Close()
+		})
+		g.Go(func() error {
+			err := bd.PutFile(remotePath, body)
+			if err != nil {
+				// unblock writer when PutFile returns before whole archive was read
+				_ = pipeReader.CloseWithError(err)
+			}
+			return err
+		})
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		uploadedBytes = body.count
+		remoteParts = nil
+		if bd.verifyUpload {
+			return bd.verifyUploaded(remotePath, uploadedBytes, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return remoteParts, uploadedBytes, copied, nil
+}
+
+// copyArchiveEntries - write regular files of sources into archive compressed by bd.compressionFormat
+func (bd *BackupDestination) copyArchiveEntries(w io.Writer, sources []ArchiveSource, copied map[string]int) error {
+	z, err := getArchiveWriter(bd.compressionFormat, bd.compressionLevel)
+	if err != nil {
+		return err
+	}
+	if err := z.Create(w); err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if len(source.Keys) == 0 {
+			continue
+		}
+		reader := &archivePartsReader{bd: bd, parts: source.Keys}
+		err := bd.copySourceEntries(z, reader, source, copied)
+		if closeErr := reader.Close(); closeErr != nil {
+			apexLog.Warnf("can't close archive reader of %s: %v", source.Keys[0], closeErr)
+		}
+		if err != nil {
+			_ = z.Close()
+			return fmt.Errorf("can't copy %s: %v", source.Keys[0], err)
+		}
+	}
+	return z.Close()
+}
+
+func (bd *BackupDestination) copySourceEntries(z archiver.Writer, reader io.Reader, source ArchiveSource, copied map[string]int) error {
+	r, err := getArchiveReader(strings.TrimPrefix(path.Ext(source.Keys[0]), "."))
+	if err != nil {
+		return err
+	}
+	if err := r.Open(reader, 0); err != nil {
+		return err
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			apexLog.Warnf("can't close getArchiveReader %v: %v", r, err)
+		}
+	}()
+	for {
+		file, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header, ok := file.Header.(*tar.Header)
+		if !ok {
+			return fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
+		}
+		name := strings.TrimPrefix(path.Join(source.Prefix, header.Name), "/")
+		folder := strings.SplitN(name, "/", 2)[0]
+		if header.Typeflag == tar.TypeReg && (source.Parts == nil || source.Parts[folder]) {
+			if err := z.Write(archiver.File{
+				FileInfo: archiver.FileInfo{
+					FileInfo:   header.FileInfo(),
+					CustomName: name,
+				},
+				ReadCloser: bd.newProgressReadCloser(file),
+			}); err != nil {
+				return err
+			}
+			copied[folder]++
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package new_storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+
+	apexLog "github.com/apex/log"
+	"github.com/djherbis/buffer"
+	"github.com/djherbis/nio/v3"
+)
+
+// archivePartName - return name of n-th archive part, `default_1.tar.lz4` -> `default_1.part0001.tar.lz4`
+func archivePartName(remotePath string, n int) string {
+	archiveExtension := ""
+	for _, ext := range config.ArchiveExtensions {
+		if strings.HasSuffix(remotePath, "."+ext) && len(ext) > len(archiveExtension) {
+			archiveExtension = ext
+		}
+	}
+	if archiveExtension == "" {
+		return fmt.Sprintf("%s.part%04d", remotePath, n)
+	}
+	return fmt.Sprintf("%s.part%04d.%s", strings.TrimSuffix(remotePath, "."+archiveExtension), n, archiveExtension)
+}
+
+// findArchiveParts - return names of sequentially numbered parts of remotePath archive which exist on remote storage
+func (bd *BackupDestination) findArchiveParts(remotePath string) []string {
+	var remoteParts []string
+	for n := 1; ; n++ {
+		partName := archivePartName(remotePath, n)
+		if _, err := bd.StatFile(partName); err != nil {
+			return remoteParts
+		}
+		remoteParts = append(remoteParts, partName)
+	}
+}
+
+// archivePartsWriter - split stream into parts not greater than maxSize, each part is uploaded by separate PutFile call
+type archivePartsWriter struct {
+	bd         *BackupDestination
+	remotePath string
+	maxSize    int64
+	parts      []string
+	sizes      []int64
+	current    *nio.PipeWriter
+	putErr     chan error
+}
+
+func (w *archivePartsWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.current == nil {
+			w.nextPart()
+		}
+		chunk := p
+		if rest := w.maxSize - w.sizes[len(w.sizes)-1]; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		n, err := w.current.Write(chunk)
+		written += n
+		w.sizes[len(w.sizes)-1] += int64(n)
+		w.bd.progress.AddTransferred(int64(n))
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+		if w.sizes[len(w.sizes)-1] >= w.maxSize {
+			if err := w.Close(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *archivePartsWriter) nextPart() {
+	partName := archivePartName(w.remotePath, len(w.parts)+1)
+	reader, writer := nio.Pipe(buffer.New(BufferSize))
+	w.parts = append(w.parts, partName)
+	w.sizes = append(w.sizes, 0)
+	w.current = writer
+	w.putErr = make(chan error, 1)
+	go func() {
+		err := w.bd.PutFile(partName, reader)
+		if err != nil {
+			// unblock writer when PutFile returns before whole part was read
+			_ = reader.CloseWithError(err)
+		}
+		w.putErr <- err
+	}()
+}
+
+// Close - finish upload of current part
+func (w *archivePartsWriter) Close() error {
+	if w.current == nil {
+		return nil
+	}
+	if err := w.current.Close(); err != nil {
+		apexLog.Warnf("can't close nio.Pipe writer %v", w.current)
+	}
+	w.current = nil
+	return <-w.putErr
+}
+
+// abort - interrupt upload of current part
+func (w *archivePartsWriter) abort(err error) {
+	if w.current == nil {
+		return
+	}
+	_ = w.current.CloseWithError(err)
+	w.current = nil
+	<-w.putErr
+}
+
+// CompressedStreamUploadParts - compress files into remotePath archive, when size of files is greater than max_archive_size compressed stream is split into sequentially numbered archive parts which are not greater than max_archive_size, return names of uploaded parts (nil for single archive) and count of uploaded bytes
+func (bd *BackupDestination) CompressedStreamUploadParts(baseLocalPath string, files []string, remotePath string) ([]string, int64, error) {
+	totalBytes, err := localFilesSize(baseLocalPath, files)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bd.maxArchiveSize <= 0 || totalBytes <= bd.maxArchiveSize {
+		if err := bd.CompressedStreamUpload(baseLocalPath, files, remotePath); err != nil {
+			return nil, 0, err
+		}
+		remoteFile, err := bd.StatFile(remotePath)
+		if err != nil {
+			return nil, 0, fmt.Errorf("can't check uploaded file: %v", err)
+		}
+		return nil, remoteFile.Size(), nil
+	}
+	var remoteParts []string
+	var uploadedBytes int64
+	err = retryUpload(func() error {
+		w := &archivePartsWriter{bd: bd, remotePath: remotePath, maxSize: bd.maxArchiveSize}
+		if err := bd.writeArchive(w, baseLocalPath, files); err != nil {
+			w.abort(err)
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		uploadedBytes = 0
+		for i, partName := range w.parts {
+			if bd.verifyUpload {
+				if err := bd.verifyUploaded(partName, w.sizes[i], nil); err != nil {
+					return err
+				}
+			}
+			uploadedBytes += w.sizes[i]
+		}
+		remoteParts = w.parts
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return remoteParts, uploadedBytes, nil
+}
+
+// archivePartsReader - read archive parts one by one, next part is opened only after previous one was read, GetFileReader blocks the ftp control channel
+type archivePartsReader struct {
+	bd      *BackupDestination
+	parts   []string
+	current io.ReadCloser
+}
+
+func (r *archivePartsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := r.bd.GetFileReader(r.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			r.parts = r.parts[1:]
+			r.current = reader
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			if err := r.Close(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *archivePartsReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// CompressedStreamDownloadParts - download archive parts in order and extract them as single archive into localPath
+func (bd *BackupDestination) CompressedStreamDownloadParts(remoteParts []string, localPath string) error {
+	if len(remoteParts) == 0 {
+		return fmt.Errorf("archive parts list is empty")
+	}
+	if err := os.MkdirAll(localPath, 0750); err != nil {
+		return err
+	}
+	for _, partName := range remoteParts {
+		if _, err := bd.StatFile(partName); err != nil {
+			return err
+		}
+	}
+	reader := &archivePartsReader{bd: bd, parts: remoteParts}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			apexLog.Warnf("can't close archive part reader: %v", err)
+		}
+	}()
+	return bd.extractArchive(reader, remoteParts[0], localPath)
+}
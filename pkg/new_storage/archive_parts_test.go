@@ -0,0 +1,101 @@
+package new_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/progressbar"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchivePartName(t *testing.T) {
+	assert.Equal(t, "backup/shadow/db/t/default_1.part0001.tar.lz4", archivePartName("backup/shadow/db/t/default_1.tar.lz4", 1))
+	assert.Equal(t, "default_all_1_1_0.part0012.tar", archivePartName("default_all_1_1_0.tar", 12))
+	assert.Equal(t, "default_1.part0002", archivePartName("default_1", 2))
+}
+
+func TestCompressedStreamUploadParts(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	localPath := t.TempDir()
+	files := []string{"data1.bin", "data2.bin"}
+	content := map[string][]byte{}
+	for _, f := range files {
+		content[f] = make([]byte, 2500)
+		_, err := rand.Read(content[f])
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(path.Join(localPath, f), content[f], 0644))
+	}
+	remotePath := "backup1/shadow/db/t/default_1.tar"
+
+	// tar with two 2500 bytes files takes 7168 bytes, so it shall be split into two parts
+	storage := &mockStorage{files: map[string][]byte{}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, verifyUpload: true, maxArchiveSize: 4096, deleteConcurrency: 1}
+	parts, uploadedBytes, err := bd.CompressedStreamUploadParts(localPath, files, remotePath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"backup1/shadow/db/t/default_1.part0001.tar", "backup1/shadow/db/t/default_1.part0002.tar"}, parts)
+	assert.Equal(t, int64(7168), uploadedBytes)
+	assert.Len(t, storage.files["backup1/shadow/db/t/default_1.part0001.tar"], 4096)
+	assert.Len(t, storage.files["backup1/shadow/db/t/default_1.part0002.tar"], 3072)
+	assert.NotContains(t, storage.files, remotePath)
+
+	downloadPath := t.TempDir()
+	assert.NoError(t, bd.CompressedStreamDownloadParts(parts, downloadPath))
+	for _, f := range files {
+		body, err := ioutil.ReadFile(path.Join(downloadPath, f))
+		assert.NoError(t, err)
+		assert.Equal(t, content[f], body)
+	}
+	// archive referenced only by name is found by part names
+	downloadPath = t.TempDir()
+	assert.NoError(t, bd.CompressedStreamDownload(remotePath, downloadPath))
+	body, err := ioutil.ReadFile(path.Join(downloadPath, "data2.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content["data2.bin"], body)
+
+	backupList, err := bd.BackupList(false, "")
+	assert.NoError(t, err)
+	assert.Len(t, backupList, 1)
+	assert.Equal(t, "backup1", backupList[0].BackupName)
+
+	// files which fit into max_archive_size are uploaded as single archive
+	storage = &mockStorage{files: map[string][]byte{}}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, maxArchiveSize: 8192, deleteConcurrency: 1}
+	parts, uploadedBytes, err = bd.CompressedStreamUploadParts(localPath, files, remotePath)
+	assert.NoError(t, err)
+	assert.Nil(t, parts)
+	assert.Equal(t, int64(7168), uploadedBytes)
+	assert.Contains(t, storage.files, remotePath)
+}
+
+// TestUploadProgressTransferred - progress counts files before compression and transferred bytes of compressed archives, which are uploaded to remote storage
+func TestUploadProgressTransferred(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	localPath := t.TempDir()
+	files := []string{"data.bin"}
+	data := bytes.Repeat([]byte("compressible data "), 1000)
+	assert.NoError(t, ioutil.WriteFile(path.Join(localPath, "data.bin"), data, 0644))
+	for _, maxArchiveSize := range []int64{0, 1024} {
+		tracker := progressbar.NewTracker()
+		tracker.Start(false, int64(len(data)))
+		storage := &mockStorage{files: map[string][]byte{}}
+		bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "gzip", compressionLevel: 1, disableProgressBar: true, maxArchiveSize: maxArchiveSize, progress: tracker, deleteConcurrency: 1}
+		parts, uploadedBytes, err := bd.CompressedStreamUploadParts(localPath, files, "backup1/shadow/db/t/default_1.tar.gz")
+		tracker.Finish()
+		assert.NoError(t, err)
+		assert.Equal(t, maxArchiveSize > 0, parts != nil)
+		var storedBytes int64
+		for _, body := range storage.files {
+			storedBytes += int64(len(body))
+		}
+		done, _ := tracker.Progress()
+		transferred, ratio := tracker.Transferred()
+		assert.Equal(t, int64(len(data)), done)
+		assert.Equal(t, storedBytes, transferred)
+		assert.Equal(t, uploadedBytes, transferred)
+		assert.Equal(t, float64(len(data))/float64(storedBytes), ratio)
+		assert.Greater(t, ratio, 10.0)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
@@ -29,6 +30,29 @@ type AzureBlob struct {
 	Config    *config.AzureBlobConfig
 }
 
+func init() {
+	registerBackend("azblob", newAzureBlob, func(cfg *config.Config) (string, int) {
+		return cfg.AzureBlob.CompressionFormat, cfg.AzureBlob.CompressionLevel
+	})
+}
+
+func newAzureBlob(cfg *config.Config) (RemoteStorage, error) {
+	azblobStorage := &AzureBlob{Config: &cfg.AzureBlob}
+	bufferSize := azblobStorage.Config.BufferSize
+	// https://github.com/AlexAkulov/clickhouse-backup/issues/317
+	if bufferSize <= 0 {
+		bufferSize = int(cfg.General.MaxFileSize / 10000)
+		if bufferSize < 2*1024*1024 {
+			bufferSize = 2 * 1024 * 1024
+		}
+		if bufferSize > 10*1024*1024 {
+			bufferSize = 10 * 1024 * 1024
+		}
+	}
+	azblobStorage.Config.BufferSize = bufferSize
+	return azblobStorage, nil
+}
+
 // Connect - connect to Azure
 func (s *AzureBlob) Connect() error {
 	if s.Config.EndpointSuffix == "" {
@@ -96,7 +120,15 @@ func (s *AzureBlob) Connect() error {
 	// don't pollute syslog with expected 404's and other garbage logs
 	pipeline.SetForceLogEnabled(false)
 
-	s.Container = azblob.NewServiceURL(*u, azblob.NewPipeline(credential, azblob.PipelineOptions{})).NewContainerURL(s.Config.Container)
+	pipelineOptions := azblob.PipelineOptions{}
+	if s.Config.CACert != "" || s.Config.DisableCertVerification || s.Config.ProxyURL != "" {
+		transport, err := newHTTPTransport(s.Kind(), s.Config.CACert, s.Config.DisableCertVerification, s.Config.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("can't create azblob transport: %v", err)
+		}
+		pipelineOptions.HTTPSender = newAzblobHTTPSender(&http.Client{Transport: transport})
+	}
+	s.Container = azblob.NewServiceURL(*u, azblob.NewPipeline(credential, pipelineOptions)).NewContainerURL(s.Config.Container)
 	_, err = s.Container.Create(context.Background(), azblob.Metadata{}, azblob.PublicAccessNone)
 	if err != nil && !isContainerAlreadyExists(err) {
 		return err
@@ -128,6 +160,19 @@ func (s *AzureBlob) Connect() error {
 	return nil
 }
 
+// newAzblobHTTPSender - send requests of pipeline by client instead of default one, the same way as pipeline does it
+func newAzblobHTTPSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			r, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(r), err
+		}
+	})
+}
+
 func (s *AzureBlob) Kind() string {
 	return "azblob"
 }
@@ -137,7 +182,7 @@ func (s *AzureBlob) GetFileReader(key string) (io.ReadCloser, error) {
 	blob := s.Container.NewBlockBlobURL(path.Join(s.Config.Path, key))
 	r, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, s.CPK)
 	if err != nil {
-		return nil, err
+		return nil, mapAzureBlobError(err)
 	}
 	return r.Body(azblob.RetryReaderOptions{}), nil
 }
@@ -148,14 +193,14 @@ func (s *AzureBlob) PutFile(key string, r io.ReadCloser) error {
 	bufferSize := s.Config.BufferSize // Configure the size of the rotating buffers that are used when uploading
 	maxBuffers := s.Config.MaxBuffers // Configure the number of rotating buffers that are used when uploading
 	_, err := x.UploadStreamToBlockBlob(ctx, r, blob, azblob.UploadStreamToBlockBlobOptions{BufferSize: bufferSize, MaxBuffers: maxBuffers}, s.CPK)
-	return err
+	return mapAzureBlobError(err)
 }
 
 func (s *AzureBlob) DeleteFile(key string) error {
 	ctx := context.Background()
 	blob := s.Container.NewBlockBlobURL(path.Join(s.Config.Path, key))
 	_, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
-	return err
+	return mapAzureBlobError(err)
 }
 
 func (s *AzureBlob) StatFile(key string) (RemoteFile, error) {
@@ -163,10 +208,7 @@ func (s *AzureBlob) StatFile(key string) (RemoteFile, error) {
 	blob := s.Container.NewBlockBlobURL(path.Join(s.Config.Path, key))
 	r, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, s.CPK)
 	if err != nil {
-		if se, ok := err.(azblob.StorageError); !ok || se.ServiceCode() != azblob.ServiceCodeBlobNotFound {
-			return nil, err
-		}
-		return nil, ErrNotFound
+		return nil, mapAzureBlobError(err)
 	}
 	return &azureBlobFile{
 		name:         key,
@@ -195,7 +237,7 @@ func (s *AzureBlob) Walk(azPath string, recursive bool, process func(r RemoteFil
 		// r, err := s.Container.ListBlobsFlatSegment(ctx, mrk, opt)
 		r, err := s.Container.ListBlobsHierarchySegment(ctx, mrk, delimiter, opt)
 		if err != nil {
-			return err
+			return mapAzureBlobError(err)
 		}
 		for _, p := range r.Segment.BlobPrefixes {
 			if err := process(&azureBlobFile{
@@ -224,6 +266,30 @@ func (s *AzureBlob) Walk(azPath string, recursive bool, process func(r RemoteFil
 	return nil
 }
 
+// mapAzureBlobError - map Azure service codes and HTTP status into ErrNotFound, ErrUnauthorized, ErrTransient and ErrRemoteStorage
+func mapAzureBlobError(err error) error {
+	if err == nil {
+		return nil
+	}
+	se, ok := err.(azblob.StorageError)
+	if !ok {
+		return mapStatusCodeError(0, err)
+	}
+	switch se.ServiceCode() {
+	case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeContainerNotFound:
+		return ErrNotFound
+	case azblob.ServiceCodeAuthenticationFailed, azblob.ServiceCodeInsufficientAccountPermissions:
+		return storageError(ErrUnauthorized, err)
+	case azblob.ServiceCodeServerBusy, azblob.ServiceCodeOperationTimedOut, azblob.ServiceCodeInternalError:
+		return storageError(ErrTransient, err)
+	}
+	statusCode := 0
+	if se.Response() != nil {
+		statusCode = se.Response().StatusCode
+	}
+	return mapStatusCodeError(statusCode, err)
+}
+
 type azureBlobFile struct {
 	size         int64
 	lastModified time.Time
@@ -0,0 +1,465 @@
+package new_storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	apexLog "github.com/apex/log"
+)
+
+// B2 - Backblaze B2 storage over native B2 API v2, files bigger than PartSize are uploaded as large files by parts
+type B2 struct {
+	Config   *config.B2Config
+	PartSize int64
+	client   *http.Client
+	authLock sync.RWMutex
+	auth     b2Auth
+	bucketID string
+}
+
+func init() {
+	registerBackend("b2", newB2, func(cfg *config.Config) (string, int) {
+		return cfg.B2.CompressionFormat, cfg.B2.CompressionLevel
+	})
+}
+
+func newB2(cfg *config.Config) (RemoteStorage, error) {
+	partSize := cfg.B2.PartSize
+	if cfg.B2.PartSize <= 0 {
+		partSize = cfg.General.MaxFileSize / 10000
+		if partSize < 5*1024*1024 {
+			partSize = 5 * 1024 * 1024
+		}
+		if partSize > 5*1024*1024*1024 {
+			partSize = 5 * 1024 * 1024 * 1024
+		}
+	}
+	return &B2{
+		Config:   &cfg.B2,
+		PartSize: partSize,
+	}, nil
+}
+
+type b2Auth struct {
+	AccountID          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+	Allowed            struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// b2Error - error response of B2 API
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("b2 error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type b2FileInfo struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	Action          string `json:"action"`
+	ContentLength   int64  `json:"contentLength"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+type b2UploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// Connect - authorize account and find bucket id
+func (b *B2) Connect() error {
+	if b.Config.KeyID == "" || b.Config.ApplicationKey == "" {
+		return fmt.Errorf("key_id and application_key must be set")
+	}
+	if b.Config.Bucket == "" {
+		return fmt.Errorf("bucket name not set")
+	}
+	if b.PartSize <= 0 {
+		return fmt.Errorf("part size shall be great than 0")
+	}
+	b.client = &http.Client{}
+	if err := b.authorize(); err != nil {
+		return err
+	}
+	auth := b.getAuth()
+	if auth.Allowed.BucketName == b.Config.Bucket && auth.Allowed.BucketID != "" {
+		b.bucketID = auth.Allowed.BucketID
+		return nil
+	}
+	var buckets struct {
+		Buckets []struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"buckets"`
+	}
+	if err := b.apiCall("b2_list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": b.Config.Bucket}, &buckets); err != nil {
+		return err
+	}
+	for _, bucket := range buckets.Buckets {
+		if bucket.BucketName == b.Config.Bucket {
+			b.bucketID = bucket.BucketID
+			return nil
+		}
+	}
+	return fmt.Errorf("bucket %s not found", b.Config.Bucket)
+}
+
+func (b *B2) Kind() string {
+	return "B2"
+}
+
+func (b *B2) getAuth() b2Auth {
+	b.authLock.RLock()
+	defer b.authLock.RUnlock()
+	return b.auth
+}
+
+func (b *B2) authorize() error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(b.Config.Endpoint, "/")+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.Config.KeyID, b.Config.ApplicationKey)
+	var auth b2Auth
+	if err := b.do(req, &auth); err != nil {
+		return err
+	}
+	b.authLock.Lock()
+	b.auth = auth
+	b.authLock.Unlock()
+	return nil
+}
+
+// apiCall - POST request to B2 API, expired authorization token is renewed once
+func (b *B2) apiCall(name string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		auth := b.getAuth()
+		req, err := http.NewRequest(http.MethodPost, auth.APIURL+"/b2api/v2/"+name, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		err = b.do(req, response)
+		if b2Err, ok := err.(*b2Error); ok && b2Err.Code == "expired_auth_token" && attempt == 0 {
+			if err := b.authorize(); err != nil {
+				return err
+			}
+			continue
+		}
+		return err
+	}
+}
+
+// do - send request, decode JSON response or B2 error
+func (b *B2) do(req *http.Request, response interface{}) error {
+	if b.Config.Debug {
+		apexLog.Debugf("[B2_DEBUG] %s %s", req.Method, req.URL.String())
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readB2Error(resp)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func readB2Error(resp *http.Response) error {
+	b2Err := &b2Error{Status: resp.StatusCode}
+	if body, err := ioutil.ReadAll(resp.Body); err == nil && len(body) > 0 {
+		_ = json.Unmarshal(body, b2Err)
+	}
+	if b2Err.Code == "" {
+		b2Err.Code = http.StatusText(resp.StatusCode)
+	}
+	return b2Err
+}
+
+// mapB2Error - map B2 error codes and HTTP status into ErrNotFound, ErrUnauthorized, ErrTransient and ErrRemoteStorage
+func mapB2Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	b2Err, ok := err.(*b2Error)
+	if !ok {
+		return mapStatusCodeError(0, err)
+	}
+	if b2Err.Code == "not_found" || b2Err.Code == "no_such_file" || b2Err.Code == "file_not_present" {
+		return ErrNotFound
+	}
+	return mapStatusCodeError(b2Err.Status, err)
+}
+
+// b2EscapeName - percent-encode file name for X-Bz-File-Name header and download URL, `/` is kept as is
+func b2EscapeName(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("._-~!$'()*;=:@/", c) >= 0 {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+	return sb.String()
+}
+
+func (b *B2) downloadRequest(method, key string) (*http.Response, error) {
+	auth := b.getAuth()
+	req, err := http.NewRequest(method, auth.DownloadURL+"/file/"+b2EscapeName(b.Config.Bucket)+"/"+b2EscapeName(path.Join(b.Config.Path, key)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	if b.Config.Debug {
+		apexLog.Debugf("[B2_DEBUG] %s %s", req.Method, req.URL.String())
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, mapB2Error(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, mapB2Error(readB2Error(resp))
+	}
+	return resp, nil
+}
+
+func (b *B2) StatFile(key string) (RemoteFile, error) {
+	resp, err := b.downloadRequest(http.MethodHead, key)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	f := &b2File{name: key, size: resp.ContentLength}
+	if timestamp, err := strconv.ParseInt(resp.Header.Get("X-Bz-Upload-Timestamp"), 10, 64); err == nil {
+		f.lastModified = time.Unix(0, timestamp*int64(time.Millisecond))
+	}
+	return f, nil
+}
+
+func (b *B2) GetFileReader(key string) (io.ReadCloser, error) {
+	resp, err := b.downloadRequest(http.MethodGet, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteFile - delete all versions of file, unfinished large file is cancelled
+func (b *B2) DeleteFile(key string) error {
+	fileName := path.Join(b.Config.Path, key)
+	for {
+		var versions struct {
+			Files []b2FileInfo `json:"files"`
+		}
+		if err := b.apiCall("b2_list_file_versions", map[string]interface{}{
+			"bucketId":      b.bucketID,
+			"startFileName": fileName,
+			"prefix":        fileName,
+			"maxFileCount":  100,
+		}, &versions); err != nil {
+			return mapB2Error(err)
+		}
+		deleted := 0
+		for _, file := range versions.Files {
+			if file.FileName != fileName {
+				continue
+			}
+			var err error
+			if file.Action == "start" {
+				err = b.apiCall("b2_cancel_large_file", map[string]string{"fileId": file.FileID}, nil)
+			} else {
+				err = b.apiCall("b2_delete_file_version", map[string]string{"fileName": file.FileName, "fileId": file.FileID}, nil)
+			}
+			if err != nil {
+				return mapB2Error(err)
+			}
+			deleted++
+		}
+		if deleted == 0 {
+			return nil
+		}
+	}
+}
+
+func (b *B2) Walk(b2Path string, recursive bool, process func(RemoteFile) error) error {
+	prefix := path.Join(b.Config.Path, b2Path)
+	if prefix == "" || prefix == "/" || prefix == "." {
+		prefix = ""
+	} else {
+		prefix = strings.TrimPrefix(prefix, "/") + "/"
+	}
+	request := map[string]interface{}{
+		"bucketId":     b.bucketID,
+		"prefix":       prefix,
+		"maxFileCount": 1000,
+	}
+	if !recursive {
+		request["delimiter"] = "/"
+	}
+	for {
+		var page struct {
+			Files        []b2FileInfo `json:"files"`
+			NextFileName *string      `json:"nextFileName"`
+		}
+		if err := b.apiCall("b2_list_file_names", request, &page); err != nil {
+			return mapB2Error(err)
+		}
+		for _, file := range page.Files {
+			f := &b2File{
+				name:         strings.TrimPrefix(file.FileName, prefix),
+				size:         file.ContentLength,
+				lastModified: time.Unix(0, file.UploadTimestamp*int64(time.Millisecond)),
+			}
+			if err := process(f); err != nil {
+				return err
+			}
+		}
+		if page.NextFileName == nil {
+			return nil
+		}
+		request["startFileName"] = *page.NextFileName
+	}
+}
+
+// PutFile - upload file in one request when it is not bigger than PartSize, otherwise upload it as large file by parts
+func (b *B2) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	fileName := path.Join(b.Config.Path, key)
+	reader := bufio.NewReader(r)
+	buf := make([]byte, b.PartSize)
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return mapB2Error(b.uploadFile(fileName, buf[:n]))
+	}
+	if err != nil {
+		return err
+	}
+	// large file shall contain at least two parts
+	if _, err := reader.Peek(1); err == io.EOF {
+		return mapB2Error(b.uploadFile(fileName, buf))
+	}
+	return mapB2Error(b.uploadLargeFile(fileName, buf, reader))
+}
+
+func (b *B2) uploadFile(fileName string, data []byte) error {
+	var uploadURL b2UploadURL
+	if err := b.apiCall("b2_get_upload_url", map[string]string{"bucketId": b.bucketID}, &uploadURL); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, uploadURL.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	req.Header.Set("Authorization", uploadURL.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", b2EscapeName(fileName))
+	req.Header.Set("Content-Type", "b2/x-auto")
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	req.ContentLength = int64(len(data))
+	return b.do(req, nil)
+}
+
+func (b *B2) uploadLargeFile(fileName string, firstPart []byte, r io.Reader) error {
+	var file b2FileInfo
+	if err := b.apiCall("b2_start_large_file", map[string]string{
+		"bucketId":    b.bucketID,
+		"fileName":    fileName,
+		"contentType": "b2/x-auto",
+	}, &file); err != nil {
+		return err
+	}
+	partSha1, err := b.uploadParts(file.FileID, firstPart, r)
+	if err == nil {
+		err = b.apiCall("b2_finish_large_file", map[string]interface{}{"fileId": file.FileID, "partSha1Array": partSha1}, nil)
+	}
+	if err != nil {
+		if cancelErr := b.apiCall("b2_cancel_large_file", map[string]string{"fileId": file.FileID}, nil); cancelErr != nil {
+			apexLog.Warnf("can't cancel B2 large file %s: %v", fileName, cancelErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *B2) uploadParts(fileID string, part []byte, r io.Reader) ([]string, error) {
+	var uploadURL b2UploadURL
+	if err := b.apiCall("b2_get_upload_part_url", map[string]string{"fileId": fileID}, &uploadURL); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, b.PartSize)
+	var partSha1 []string
+	for partNumber := 1; ; partNumber++ {
+		sum := sha1.Sum(part)
+		req, err := http.NewRequest(http.MethodPost, uploadURL.UploadURL, bytes.NewReader(part))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", uploadURL.AuthorizationToken)
+		req.Header.Set("X-Bz-Part-Number", strconv.Itoa(partNumber))
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+		req.ContentLength = int64(len(part))
+		if err := b.do(req, nil); err != nil {
+			return nil, err
+		}
+		partSha1 = append(partSha1, hex.EncodeToString(sum[:]))
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && err == io.EOF {
+			return partSha1, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		part = buf[:n]
+	}
+}
+
+type b2File struct {
+	size         int64
+	lastModified time.Time
+	name         string
+}
+
+func (f *b2File) Size() int64 {
+	return f.size
+}
+
+func (f *b2File) Name() string {
+	return f.name
+}
+
+func (f *b2File) LastModified() time.Time {
+	return f.lastModified
+}
@@ -0,0 +1,293 @@
+package new_storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockB2File struct {
+	id    string
+	name  string
+	data  []byte
+	parts map[int][]byte
+}
+
+// mockB2Server - in-memory implementation of B2 native API methods used by B2 storage
+type mockB2Server struct {
+	sync.Mutex
+	url       string
+	token     string
+	authCalls int
+	pageSize  int
+	nextID    int
+	files     map[string]*mockB2File // by name, finished files only
+	large     map[string]*mockB2File // by id, started large files
+}
+
+func newMockB2Server(t *testing.T) (*mockB2Server, *B2) {
+	server := &mockB2Server{pageSize: 1000, files: map[string]*mockB2File{}, large: map[string]*mockB2File{}}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	server.url = srv.URL
+	b := &B2{
+		Config: &config.B2Config{
+			KeyID:          "key",
+			ApplicationKey: "secret",
+			Bucket:         "bucket",
+			Endpoint:       srv.URL,
+			Path:           "prefix",
+		},
+		PartSize: 10,
+	}
+	assert.NoError(t, b.Connect())
+	return server, b
+}
+
+func (s *mockB2Server) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "code": code, "message": code})
+}
+
+func (s *mockB2Server) fileInfo(f *mockB2File, action string) map[string]interface{} {
+	return map[string]interface{}{"fileId": f.id, "fileName": f.name, "action": action, "contentLength": len(f.data), "uploadTimestamp": 1600000000000}
+}
+
+func (s *mockB2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		if user, password, _ := r.BasicAuth(); user != "key" || password != "secret" {
+			s.writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		s.authCalls++
+		s.token = fmt.Sprintf("token%d", s.authCalls)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"accountId": "account", "authorizationToken": s.token, "apiUrl": s.url, "downloadUrl": s.url})
+		return
+	}
+	if r.Header.Get("Authorization") != s.token && !strings.HasPrefix(r.URL.Path, "/upload") {
+		s.writeError(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/file/bucket/") {
+		f, exists := s.files[strings.TrimPrefix(r.URL.Path, "/file/bucket/")]
+		if !exists {
+			s.writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+		w.Header().Set("X-Bz-Upload-Timestamp", "1600000000000")
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(f.data)
+		}
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if strings.HasPrefix(r.URL.Path, "/upload") {
+		sum := sha1.Sum(body)
+		if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) || r.Header.Get("Authorization") != "upload_token" {
+			s.writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if r.URL.Path == "/upload_part" {
+			partNumber, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+			s.large[r.URL.Query().Get("fileId")].parts[partNumber] = body
+			return
+		}
+		name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		s.nextID++
+		s.files[name] = &mockB2File{id: strconv.Itoa(s.nextID), name: name, data: body}
+		return
+	}
+	var req struct {
+		BucketID      string   `json:"bucketId"`
+		FileID        string   `json:"fileId"`
+		FileName      string   `json:"fileName"`
+		Prefix        string   `json:"prefix"`
+		Delimiter     string   `json:"delimiter"`
+		StartFileName string   `json:"startFileName"`
+		PartSha1Array []string `json:"partSha1Array"`
+	}
+	_ = json.Unmarshal(body, &req)
+	var resp interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/b2api/v2/") {
+	case "b2_list_buckets":
+		resp = map[string]interface{}{"buckets": []map[string]string{{"bucketId": "bucket_id", "bucketName": "bucket"}}}
+	case "b2_get_upload_url":
+		resp = map[string]string{"uploadUrl": s.url + "/upload", "authorizationToken": "upload_token"}
+	case "b2_start_large_file":
+		s.nextID++
+		f := &mockB2File{id: strconv.Itoa(s.nextID), name: req.FileName, parts: map[int][]byte{}}
+		s.large[f.id] = f
+		resp = s.fileInfo(f, "start")
+	case "b2_get_upload_part_url":
+		resp = map[string]string{"uploadUrl": s.url + "/upload_part?fileId=" + req.FileID, "authorizationToken": "upload_token"}
+	case "b2_finish_large_file":
+		f := s.large[req.FileID]
+		if len(f.parts) < 2 || len(f.parts) != len(req.PartSha1Array) {
+			s.writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		for i := 1; i <= len(f.parts); i++ {
+			f.data = append(f.data, f.parts[i]...)
+		}
+		delete(s.large, f.id)
+		s.files[f.name] = f
+		resp = s.fileInfo(f, "upload")
+	case "b2_cancel_large_file":
+		delete(s.large, req.FileID)
+	case "b2_delete_file_version":
+		if f, exists := s.files[req.FileName]; !exists || f.id != req.FileID {
+			s.writeError(w, http.StatusBadRequest, "file_not_present")
+			return
+		}
+		delete(s.files, req.FileName)
+	case "b2_list_file_versions":
+		var files []map[string]interface{}
+		for name, f := range s.files {
+			if strings.HasPrefix(name, req.Prefix) && name >= req.StartFileName {
+				files = append(files, s.fileInfo(f, "upload"))
+			}
+		}
+		resp = map[string]interface{}{"files": files}
+	case "b2_list_file_names":
+		resp = s.listFileNames(req.Prefix, req.Delimiter, req.StartFileName)
+	default:
+		s.writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *mockB2Server) listFileNames(prefix, delimiter, startFileName string) map[string]interface{} {
+	entries := map[string]map[string]interface{}{}
+	for name, f := range s.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(strings.TrimPrefix(name, prefix), delimiter); delimiter != "" && i >= 0 {
+			folder := name[:len(prefix)+i+1]
+			entries[folder] = map[string]interface{}{"fileName": folder, "action": "folder"}
+			continue
+		}
+		entries[name] = s.fileInfo(f, "upload")
+	}
+	var names []string
+	for name := range entries {
+		if name >= startFileName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var nextFileName interface{}
+	if len(names) > s.pageSize {
+		nextFileName = names[s.pageSize]
+		names = names[:s.pageSize]
+	}
+	files := make([]map[string]interface{}, 0)
+	for _, name := range names {
+		files = append(files, entries[name])
+	}
+	return map[string]interface{}{"files": files, "nextFileName": nextFileName}
+}
+
+func TestB2RoundTrip(t *testing.T) {
+	server, b := newMockB2Server(t)
+	assert.Equal(t, "bucket_id", b.bucketID)
+	for _, body := range []string{"", "small", "exactly10b", "large file which is uploaded by parts"} {
+		for _, key := range []string{"backup1/metadata.json", "backup1/shadow/a%2Eb/t+1 с пробелом/default_all_1_1_0.tar"} {
+			assert.NoError(t, b.PutFile(key, ioutil.NopCloser(strings.NewReader(body))))
+			f, err := b.StatFile(key)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(body)), f.Size())
+			assert.Equal(t, int64(1600000000), f.LastModified().Unix())
+			r, err := b.GetFileReader(key)
+			assert.NoError(t, err)
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.NoError(t, r.Close())
+			assert.Equal(t, body, string(data))
+			assert.NotNil(t, server.files["prefix/"+key], "file shall be stored with path prefix")
+		}
+	}
+	assert.Empty(t, server.large, "all large files shall be finished")
+
+	assert.NoError(t, b.DeleteFile("backup1/metadata.json"))
+	_, err := b.StatFile("backup1/metadata.json")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = b.GetFileReader("backup1/metadata.json")
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, b.DeleteFile("backup1/metadata.json"), "missing file deletion shall be ignored")
+}
+
+func TestB2Walk(t *testing.T) {
+	server, b := newMockB2Server(t)
+	server.pageSize = 2
+	for _, key := range []string{"backup1/metadata.json", "backup1/shadow/db/t/default.tar", "backup2/metadata.json", "backup3/metadata.json", "legacy.tar"} {
+		assert.NoError(t, b.PutFile(key, ioutil.NopCloser(strings.NewReader(key))))
+	}
+	walk := func(prefix string, recursive bool) []string {
+		var names []string
+		assert.NoError(t, b.Walk(prefix, recursive, func(f RemoteFile) error {
+			names = append(names, f.Name())
+			return nil
+		}))
+		return names
+	}
+	assert.Equal(t, []string{"backup1/", "backup2/", "backup3/", "legacy.tar"}, walk("/", false))
+	assert.Equal(t, []string{"metadata.json", "shadow/db/t/default.tar"}, walk("backup1/", true))
+	assert.Equal(t, []string{"metadata.json", "shadow/"}, walk("backup1", false))
+
+	bd := &BackupDestination{RemoteStorage: b, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	backups, err := bd.BackupList(false, "")
+	assert.NoError(t, err)
+	assert.Len(t, backups, 4)
+	assert.NoError(t, bd.RemoveBackup(Backup{BackupMetadata: backups[0].BackupMetadata}))
+	assert.Equal(t, []string{"backup2/", "backup3/", "legacy.tar"}, walk("/", false))
+}
+
+func TestB2ExpiredToken(t *testing.T) {
+	server, b := newMockB2Server(t)
+	assert.NoError(t, b.PutFile("backup1/metadata.json", ioutil.NopCloser(strings.NewReader("{}"))))
+	server.Lock()
+	server.token = "expired"
+	server.Unlock()
+	assert.NoError(t, b.PutFile("backup2/metadata.json", ioutil.NopCloser(strings.NewReader("{}"))))
+	assert.Equal(t, 2, server.authCalls)
+	b.Config.ApplicationKey = "wrong"
+	server.Lock()
+	server.token = "expired"
+	server.Unlock()
+	err := b.PutFile("backup3/metadata.json", ioutil.NopCloser(strings.NewReader("{}")))
+	assert.True(t, errors.Is(err, ErrUnauthorized), "%v", err)
+}
+
+func TestB2EscapeName(t *testing.T) {
+	for _, name := range []string{"backup/metadata.json", "a%2Eb/t+1 с пробелом", "a&b,c?d#e"} {
+		escaped := b2EscapeName(name)
+		assert.NotContains(t, escaped, " ")
+		assert.NotContains(t, escaped, "+")
+		unescaped, err := url.PathUnescape(escaped)
+		assert.NoError(t, err)
+		assert.Equal(t, name, unescaped)
+	}
+}
@@ -0,0 +1,53 @@
+package new_storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+)
+
+// BackendConstructor - create RemoteStorage from config, it is called by NewBackupDestination before each operation with remote storage
+type BackendConstructor func(cfg *config.Config) (RemoteStorage, error)
+
+// backendCompression - compression_format and compression_level from config section of backend
+type backendCompression func(cfg *config.Config) (string, int)
+
+type backend struct {
+	constructor BackendConstructor
+	compression backendCompression
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]backend{}
+)
+
+// RegisterBackend - make custom RemoteStorage available as `remote_storage: name`, it shall be called from init() of package with backend,
+// custom backends don't have own config section and upload archives as tar without compression
+func RegisterBackend(name string, constructor BackendConstructor) {
+	registerBackend(name, constructor, func(cfg *config.Config) (string, int) {
+		return "tar", 0
+	})
+	config.RegisterRemoteStorage(name)
+}
+
+// registerBackend - built-in backends register themselves with compression from own config section, the same name can't be registered twice
+func registerBackend(name string, constructor BackendConstructor, compression backendCompression) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if constructor == nil {
+		panic(fmt.Sprintf("remote storage '%s' constructor is nil", name))
+	}
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("remote storage '%s' is already registered", name))
+	}
+	backends[name] = backend{constructor: constructor, compression: compression}
+}
+
+func getBackend(name string) (backend, bool) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	b, ok := backends[name]
+	return b, ok
+}
@@ -0,0 +1,48 @@
+package new_storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	var constructedWith *config.Config
+	RegisterBackend("test_mock", func(cfg *config.Config) (RemoteStorage, error) {
+		constructedWith = cfg
+		return &mockStorage{files: map[string][]byte{}}, nil
+	})
+	RegisterBackend("test_broken", func(cfg *config.Config) (RemoteStorage, error) {
+		return nil, fmt.Errorf("object store is unavailable")
+	})
+	assert.Panics(t, func() {
+		RegisterBackend("s3", func(cfg *config.Config) (RemoteStorage, error) { return nil, nil })
+	})
+
+	cfg := config.DefaultConfig()
+	cfg.General.RemoteStorage = "test_mock"
+	assert.NoError(t, config.ValidateConfig(cfg))
+	assert.Equal(t, "tar", cfg.GetArchiveExtension())
+	bd, err := NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "mock", bd.Kind())
+	assert.Equal(t, "tar", bd.compressionFormat)
+	assert.Equal(t, cfg, constructedWith)
+
+	cfg.General.RemoteStorage = "test_broken"
+	_, err = NewBackupDestination(cfg)
+	assert.EqualError(t, err, "object store is unavailable")
+
+	cfg.General.RemoteStorage = "unregistered"
+	_, err = NewBackupDestination(cfg)
+	assert.EqualError(t, err, "storage type 'unregistered' is not supported")
+
+	cfg.General.RemoteStorage = "s3"
+	cfg.S3.CompressionFormat = "gzip"
+	bd, err = NewBackupDestination(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "S3", bd.Kind())
+	assert.Equal(t, "gzip", bd.compressionFormat)
+}
@@ -0,0 +1,64 @@
+package new_storage
+
+import (
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/s2"
+	"github.com/mholt/archiver/v3"
+)
+
+// CompressedTar - tar archive in compressed stream, unlike archiver.TarSz it returns error of final flush from Close,
+// so truncated archive isn't uploaded as complete one
+type CompressedTar struct {
+	*archiver.Tar
+	extension string
+	newWriter func(w io.Writer) io.WriteCloser
+	newReader func(r io.Reader) io.Reader
+	writer    io.WriteCloser
+}
+
+// NewTarSz - snappy framing format, which is compatible with `.tar.sz` archives of archiver.TarSz, compression level is ignored
+func NewTarSz() *CompressedTar {
+	return &CompressedTar{
+		Tar:       archiver.NewTar(),
+		extension: "tar.sz",
+		newWriter: func(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) },
+		newReader: func(r io.Reader) io.Reader { return snappy.NewReader(r) },
+	}
+}
+
+// NewTarS2 - faster snappy extension from klauspost/compress, s2 reader also reads snappy streams, compression level is ignored
+func NewTarS2() *CompressedTar {
+	return &CompressedTar{
+		Tar:       archiver.NewTar(),
+		extension: "tar.s2",
+		newWriter: func(w io.Writer) io.WriteCloser { return s2.NewWriter(w) },
+		newReader: func(r io.Reader) io.Reader { return s2.NewReader(r) },
+	}
+}
+
+// Create - archiver.Writer which compresses tar into out
+func (t *CompressedTar) Create(out io.Writer) error {
+	t.writer = t.newWriter(out)
+	return t.Tar.Create(t.writer)
+}
+
+// Open - archiver.Reader which decompresses tar from in
+func (t *CompressedTar) Open(in io.Reader, size int64) error {
+	return t.Tar.Open(t.newReader(in), size)
+}
+
+// Close - close tar and flush compressed stream after it
+func (t *CompressedTar) Close() error {
+	err := t.Tar.Close()
+	if t.writer != nil {
+		if closeErr := t.writer.Close(); err == nil {
+			err = closeErr
+		}
+		t.writer = nil
+	}
+	return err
+}
+
+func (t *CompressedTar) String() string { return t.extension }
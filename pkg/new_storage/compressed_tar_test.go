@@ -0,0 +1,109 @@
+package new_storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mholt/archiver/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCompressedTarRoundTrip - archives uploaded with sz and s2 are downloaded back, levels are ignored by both formats
+func TestCompressedTarRoundTrip(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	localPath := t.TempDir()
+	content := map[string][]byte{
+		"data.bin":      bytes.Repeat([]byte("snappy compresses repeated data "), 1000),
+		"checksums.txt": []byte("checksums"),
+	}
+	files := make([]string, 0, len(content))
+	for f, body := range content {
+		files = append(files, f)
+		assert.NoError(t, ioutil.WriteFile(path.Join(localPath, f), body, 0644))
+	}
+	for format, extension := range map[string]string{"sz": "tar.sz", "s2": "tar.s2"} {
+		for _, level := range []int{-1, 0, 1, 100} {
+			storage := &mockStorage{files: map[string][]byte{}}
+			bd := &BackupDestination{RemoteStorage: storage, compressionFormat: format, compressionLevel: level, disableProgressBar: true, deleteConcurrency: 1}
+			remotePath := "backup1/shadow/db/t/default_1." + extension
+			assert.NoError(t, bd.CompressedStreamUpload(localPath, files, remotePath), format)
+			assert.Less(t, len(storage.files[remotePath]), len(content["data.bin"]), format)
+
+			downloadPath := t.TempDir()
+			assert.NoError(t, bd.CompressedStreamDownload(remotePath, downloadPath), format)
+			for f, expected := range content {
+				body, err := ioutil.ReadFile(path.Join(downloadPath, f))
+				assert.NoError(t, err, format)
+				assert.Equal(t, expected, body, format)
+			}
+		}
+	}
+}
+
+// TestTarSzCompatibility - `.tar.sz` archives which were written by archiver.TarSz are readable by both sz and s2 readers
+func TestTarSzCompatibility(t *testing.T) {
+	var archive bytes.Buffer
+	w := archiver.NewTarSz()
+	assert.NoError(t, w.Create(&archive))
+	assert.NoError(t, w.Write(archiver.File{
+		FileInfo:   archiver.FileInfo{FileInfo: fakeFileInfo{name: "data.bin", size: 4}, CustomName: "data.bin"},
+		ReadCloser: ioutil.NopCloser(bytes.NewReader([]byte("data"))),
+	}))
+	assert.NoError(t, w.Close())
+	for _, format := range []string{"sz", "s2"} {
+		r, err := getArchiveReader(format)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Open(bytes.NewReader(archive.Bytes()), 0))
+		file, err := r.Read()
+		assert.NoError(t, err, format)
+		assert.Equal(t, "data.bin", file.Name())
+		body, err := ioutil.ReadAll(file)
+		assert.NoError(t, err)
+		assert.Equal(t, "data", string(body))
+		_, err = r.Read()
+		assert.Equal(t, io.EOF, err)
+		assert.NoError(t, r.Close())
+	}
+}
+
+// failingWriter - accepts limit bytes and fails then
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, io.ErrShortWrite
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+// TestCompressedTarCloseError - failed flush of compressed stream on Close is returned, archive without its end is broken
+func TestCompressedTarCloseError(t *testing.T) {
+	for _, z := range []*CompressedTar{NewTarSz(), NewTarS2()} {
+		assert.NoError(t, z.Create(&failingWriter{}))
+		assert.NoError(t, z.Write(archiver.File{
+			FileInfo:   archiver.FileInfo{FileInfo: fakeFileInfo{name: "data.bin", size: 4}, CustomName: "data.bin"},
+			ReadCloser: ioutil.NopCloser(bytes.NewReader([]byte("data"))),
+		}))
+		assert.Error(t, z.Close(), z.String())
+	}
+}
+
+type fakeFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeFileInfo) IsDir() bool        { return false }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
@@ -1,22 +1,61 @@
 package new_storage
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	apexLog "github.com/apex/log"
 	"github.com/tencentyun/cos-go-sdk-v5"
 	"github.com/tencentyun/cos-go-sdk-v5/debug"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
+// COS - Tencent Cloud Object Storage, files bigger than PartSize are uploaded by multipart upload with Concurrency parallel parts
 type COS struct {
-	client *cos.Client
-	Config *config.COSConfig
+	client      *cos.Client
+	Config      *config.COSConfig
+	PartSize    int64
+	Concurrency int
+}
+
+func init() {
+	registerBackend("cos", newCOS, func(cfg *config.Config) (string, int) {
+		return cfg.COS.CompressionFormat, cfg.COS.CompressionLevel
+	})
+}
+
+func newCOS(cfg *config.Config) (RemoteStorage, error) {
+	partSize := cfg.COS.PartSize
+	if cfg.COS.PartSize <= 0 {
+		partSize = cfg.General.MaxFileSize / 10000
+		if partSize < 5*1024*1024 {
+			partSize = 5 * 1024 * 1024
+		}
+		if partSize > 5*1024*1024*1024 {
+			partSize = 5 * 1024 * 1024 * 1024
+		}
+	}
+	concurrency := cfg.COS.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &COS{
+		Config:      &cfg.COS,
+		PartSize:    partSize,
+		Concurrency: concurrency,
+	}, nil
 }
 
 // Connect - connect to cos
@@ -30,6 +69,18 @@ func (c *COS) Connect() error {
 	if err != nil {
 		return err
 	}
+	if c.PartSize <= 0 {
+		return fmt.Errorf("part size shall be great than 0")
+	}
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	var transport http.RoundTripper
+	if c.Config.CACert != "" || c.Config.DisableCertVerification || c.Config.ProxyURL != "" {
+		if transport, err = newHTTPTransport(c.Kind(), c.Config.CACert, c.Config.DisableCertVerification, c.Config.ProxyURL); err != nil {
+			return fmt.Errorf("can't create cos transport: %v", err)
+		}
+	}
 	c.client = cos.NewClient(b, &http.Client{
 		Timeout: timeout,
 		Transport: &cos.AuthorizationTransport{
@@ -41,12 +92,13 @@ func (c *COS) Connect() error {
 				RequestBody:    false,
 				ResponseHeader: c.Config.Debug,
 				ResponseBody:   false,
+				Transport:      transport,
 			},
 		},
 	})
 	// check bucket exists
 	_, err = c.client.Bucket.Head(context.Background())
-	return err
+	return mapCOSError(err)
 }
 
 func (c *COS) Kind() string {
@@ -54,87 +106,187 @@ func (c *COS) Kind() string {
 }
 
 func (c *COS) StatFile(key string) (RemoteFile, error) {
-	// file max size is 5Gb
-	resp, err := c.client.Object.Get(context.Background(), path.Join(c.Config.Path, key), nil)
+	resp, err := c.client.Object.Head(context.Background(), c.objectName(key), nil)
 	if err != nil {
-		cosErr, ok := err.(*cos.ErrorResponse)
-		if ok && cosErr.Code == "NoSuchKey" {
-			return nil, ErrNotFound
-		}
-		return nil, err
+		return nil, mapCOSError(err)
 	}
-	modifiedTime, _ := parseTime(resp.Response.Header.Get("Date"))
+	modifiedTime, _ := parseTime(resp.Header.Get("Last-Modified"))
 	return &cosFile{
-		size:         resp.Response.ContentLength,
-		name:         resp.Request.URL.Path,
+		size:         resp.ContentLength,
+		name:         key,
 		lastModified: modifiedTime,
 	}, nil
 }
 
+// objectName - object key in bucket, COS keys have no leading slash
+func (c *COS) objectName(key string) string {
+	return strings.TrimPrefix(path.Join(c.Config.Path, key), "/")
+}
+
 func (c *COS) DeleteFile(key string) error {
-	_, err := c.client.Object.Delete(context.Background(), path.Join(c.Config.Path, key))
-	return err
+	_, err := c.client.Object.Delete(context.Background(), c.objectName(key))
+	return mapCOSError(err)
 }
 
+// Walk - list objects page by page, COS returns at most 1000 keys per request
 func (c *COS) Walk(cosPath string, recursive bool, process func(RemoteFile) error) error {
-	// COS needs prefix ended with "/".
-	prefix := path.Join(c.Config.Path, cosPath) + "/"
-
-	delimiter := ""
-	if !recursive {
-		//
-		// When delimiter is "/", we only process all backups in the CommonPrefixes field of response.
-		// Then we get backupLists.
-		//
-		delimiter = "/"
+	// COS needs prefix ended with "/"
+	prefix := c.objectName(cosPath)
+	if prefix == "" || prefix == "." {
+		prefix = ""
 	} else {
-		//
-		// When delimiter is an empty string, we  process the items under specified path.
-		// Then we can Delete File object.
-		//
-		delimiter = ""
-	}
-	res, _, err := c.client.Bucket.Get(context.Background(), &cos.BucketGetOptions{
-		Delimiter: delimiter,
-		Prefix:    prefix,
-	})
-	if err != nil {
-		return err
+		prefix += "/"
 	}
-	// When recursive is false, only process all the backups in the CommonPrefixes part.
-	for _, dir := range res.CommonPrefixes {
-		if err := process(&cosFile{
-			name: strings.TrimPrefix(dir, prefix),
-		}); err != nil {
-			return err
-		}
+	opt := &cos.BucketGetOptions{
+		Prefix:  prefix,
+		MaxKeys: 1000,
+	}
+	if !recursive {
+		// backups and folders are returned in CommonPrefixes
+		opt.Delimiter = "/"
 	}
-	if recursive {
+	for {
+		res, _, err := c.client.Bucket.Get(context.Background(), opt)
+		if err != nil {
+			return mapCOSError(err)
+		}
+		for _, dir := range res.CommonPrefixes {
+			if err := process(&cosFile{
+				name: strings.TrimPrefix(dir, prefix),
+			}); err != nil {
+				return err
+			}
+		}
 		for _, v := range res.Contents {
 			modifiedTime, _ := parseTime(v.LastModified)
 			if err := process(&cosFile{
 				name:         strings.TrimPrefix(v.Key, prefix),
 				lastModified: modifiedTime,
-				size:         int64(v.Size),
+				size:         v.Size,
 			}); err != nil {
 				return err
 			}
 		}
+		if !res.IsTruncated {
+			return nil
+		}
+		opt.Marker = res.NextMarker
+		if opt.Marker == "" && len(res.Contents) > 0 {
+			// NextMarker is returned only when delimiter is set
+			opt.Marker = res.Contents[len(res.Contents)-1].Key
+		}
+		if opt.Marker == "" {
+			return fmt.Errorf("can't list COS objects with prefix '%s', truncated response without next marker", prefix)
+		}
 	}
-	return nil
 }
 
 func (c *COS) GetFileReader(key string) (io.ReadCloser, error) {
-	resp, err := c.client.Object.Get(context.Background(), path.Join(c.Config.Path, key), nil)
+	resp, err := c.client.Object.Get(context.Background(), c.objectName(key), nil)
 	if err != nil {
-		return nil, err
+		return nil, mapCOSError(err)
 	}
 	return resp.Body, nil
 }
 
+// PutFile - upload file in one request when it is not bigger than PartSize, otherwise upload it by multipart upload
 func (c *COS) PutFile(key string, r io.ReadCloser) error {
-	_, err := c.client.Object.Put(context.Background(), path.Join(c.Config.Path, key), r, nil)
-	return err
+	defer r.Close()
+	name := c.objectName(key)
+	reader := bufio.NewReader(r)
+	buf := make([]byte, c.PartSize)
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = c.client.Object.Put(context.Background(), name, bytes.NewReader(buf[:n]), nil)
+		return mapCOSError(err)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := reader.Peek(1); err == io.EOF {
+		_, err = c.client.Object.Put(context.Background(), name, bytes.NewReader(buf), nil)
+		return mapCOSError(err)
+	}
+	return mapCOSError(c.putMultipart(name, buf, reader))
+}
+
+// putMultipart - upload parts by Concurrency parallel requests, next part is read while previous are uploaded, upload is aborted on error
+func (c *COS) putMultipart(name string, firstPart []byte, r io.Reader) error {
+	ctx := context.Background()
+	upload, _, err := c.client.Object.InitiateMultipartUpload(ctx, name, nil)
+	if err != nil {
+		return err
+	}
+	parts, err := c.uploadParts(name, upload.UploadID, firstPart, r)
+	if err == nil {
+		_, _, err = c.client.Object.CompleteMultipartUpload(ctx, name, upload.UploadID, &cos.CompleteMultipartUploadOptions{Parts: parts})
+	}
+	if err != nil {
+		if _, abortErr := c.client.Object.AbortMultipartUpload(ctx, name, upload.UploadID); abortErr != nil {
+			apexLog.Warnf("can't abort COS multipart upload %s: %v", name, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *COS) uploadParts(name, uploadID string, part []byte, r io.Reader) ([]cos.Object, error) {
+	var parts []cos.Object
+	var partsLock sync.Mutex
+	s := semaphore.NewWeighted(int64(c.Concurrency))
+	g, ctx := errgroup.WithContext(context.Background())
+	for partNumber := 1; ; partNumber++ {
+		if err := s.Acquire(ctx, 1); err != nil {
+			// one of parts failed, error is returned by g.Wait
+			break
+		}
+		partNumber, data := partNumber, part
+		g.Go(func() error {
+			defer s.Release(1)
+			resp, err := c.client.Object.UploadPart(ctx, name, uploadID, partNumber, bytes.NewReader(data), nil)
+			if err != nil {
+				return err
+			}
+			partsLock.Lock()
+			parts = append(parts, cos.Object{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+			partsLock.Unlock()
+			return nil
+		})
+		buf := make([]byte, c.PartSize)
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			_ = g.Wait()
+			return nil, err
+		}
+		part = buf[:n]
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// mapCOSError - map COS error codes and HTTP status into ErrNotFound, ErrUnauthorized, ErrTransient and ErrRemoteStorage
+func mapCOSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	cosErr, ok := err.(*cos.ErrorResponse)
+	if !ok {
+		return mapStatusCodeError(0, err)
+	}
+	if cosErr.Code == "NoSuchKey" || cosErr.Code == "NoSuchBucket" {
+		return ErrNotFound
+	}
+	statusCode := 0
+	if cosErr.Response != nil {
+		statusCode = cosErr.Response.StatusCode
+	}
+	return mapStatusCodeError(statusCode, err)
 }
 
 type cosFile struct {
@@ -0,0 +1,204 @@
+package new_storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/tencentyun/cos-go-sdk-v5"
+)
+
+// mockCOSServer - objectServer with COS bucket listing by pages, multipart upload and DELETE
+type mockCOSServer struct {
+	objectServer
+	pageSize   int
+	uploads    map[string]map[int][]byte
+	failPart   int
+	partsTotal int
+}
+
+func (s *mockCOSServer) writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func (s *mockCOSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		s.Lock()
+		defer s.Unlock()
+		s.writeXML(w, s.list(query.Get("prefix"), query.Get("delimiter"), query.Get("marker")))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.Lock()
+		defer s.Unlock()
+		uploadID := fmt.Sprintf("upload%d", len(s.uploads)+1)
+		s.uploads[uploadID] = map[int][]byte{}
+		s.writeXML(w, cos.InitiateMultipartUploadResult{UploadID: uploadID})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		body, _ := ioutil.ReadAll(r.Body)
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		s.Lock()
+		defer s.Unlock()
+		s.partsTotal++
+		if partNumber == s.failPart {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.uploads[query.Get("uploadId")][partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%d"`, partNumber))
+		w.Header().Set("x-cos-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(body, crc64.MakeTable(crc64.ECMA)), 10))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete cos.CompleteMultipartUploadOptions
+		_ = xml.NewDecoder(r.Body).Decode(&complete)
+		s.Lock()
+		defer s.Unlock()
+		var body []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag%d"`, i+1) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = append(body, s.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		s.objects[r.URL.Path] = body
+		s.writeXML(w, cos.CompleteMultipartUploadResult{Key: r.URL.Path, ETag: `"etag"`})
+	case r.Method == http.MethodDelete:
+		s.Lock()
+		defer s.Unlock()
+		if query.Has("uploadId") {
+			delete(s.uploads, query.Get("uploadId"))
+		} else {
+			delete(s.objects, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.objectServer.ServeHTTP(w, r)
+	}
+}
+
+// list - return keys and common prefixes after marker, NextMarker is returned only with delimiter as real COS does
+func (s *mockCOSServer) list(prefix, delimiter, marker string) cos.BucketGetResult {
+	objects := map[string]cos.Object{}
+	prefixes := map[string]bool{}
+	for key, body := range s.objects {
+		key = strings.TrimPrefix(key, "/")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(strings.TrimPrefix(key, prefix), delimiter); delimiter != "" && i >= 0 {
+			prefixes[key[:len(prefix)+i+1]] = true
+			continue
+		}
+		objects[key] = cos.Object{Key: key, Size: int64(len(body)), LastModified: "2022-03-04T05:06:07.000Z"}
+	}
+	var entries []string
+	for entry := range objects {
+		entries = append(entries, entry)
+	}
+	for entry := range prefixes {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	result := cos.BucketGetResult{Prefix: prefix, Delimiter: delimiter, Marker: marker}
+	for _, entry := range entries {
+		if entry <= marker {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == s.pageSize {
+			result.IsTruncated = true
+			break
+		}
+		if object, ok := objects[entry]; ok {
+			result.Contents = append(result.Contents, object)
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, entry)
+		}
+		if delimiter != "" {
+			result.NextMarker = entry
+		}
+	}
+	return result
+}
+
+func newMockCOSServer(t *testing.T) (*mockCOSServer, *COS) {
+	server := &mockCOSServer{objectServer: objectServer{objects: map[string][]byte{}}, pageSize: 1000, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	c := &COS{
+		Config: &config.COSConfig{
+			RowURL:    srv.URL,
+			Path:      "prefix",
+			Timeout:   "10s",
+			SecretID:  "id",
+			SecretKey: "secret",
+		},
+		PartSize:    10,
+		Concurrency: 3,
+	}
+	assert.NoError(t, c.Connect())
+	return server, c
+}
+
+func TestCOSMultipartUpload(t *testing.T) {
+	server, c := newMockCOSServer(t)
+	for _, body := range []string{"", "small", "exactly10b", "large file which is uploaded by parts in parallel"} {
+		server.partsTotal = 0
+		assert.NoError(t, c.PutFile("backup1/shadow/default.tar", ioutil.NopCloser(strings.NewReader(body))))
+		assert.Equal(t, body, string(server.objects["/prefix/backup1/shadow/default.tar"]))
+		f, err := c.StatFile("backup1/shadow/default.tar")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(len(body)), f.Size())
+			assert.False(t, f.LastModified().IsZero())
+		}
+	}
+	assert.Equal(t, 5, server.partsTotal)
+	assert.Empty(t, server.uploads, "all multipart uploads shall be completed")
+
+	server.failPart = 3
+	assert.ErrorIs(t, c.PutFile("backup1/shadow/failed.tar", ioutil.NopCloser(strings.NewReader("large file which is uploaded by parts in parallel"))), ErrTransient)
+	assert.Empty(t, server.uploads, "failed multipart upload shall be aborted")
+	assert.NotContains(t, server.objects, "/prefix/backup1/shadow/failed.tar")
+
+	assert.NoError(t, c.DeleteFile("backup1/shadow/default.tar"))
+	_, err := c.StatFile("backup1/shadow/default.tar")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = c.GetFileReader("backup1/shadow/default.tar")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCOSWalk(t *testing.T) {
+	server, c := newMockCOSServer(t)
+	server.pageSize = 2
+	for _, key := range []string{"backup1/metadata.json", "backup1/shadow/db/t/default.tar", "backup2/metadata.json", "backup3/metadata.json", "legacy.tar"} {
+		assert.NoError(t, c.PutFile(key, ioutil.NopCloser(strings.NewReader(key))))
+	}
+	walk := func(prefix string, recursive bool) []string {
+		var names []string
+		assert.NoError(t, c.Walk(prefix, recursive, func(f RemoteFile) error {
+			names = append(names, f.Name())
+			return nil
+		}))
+		sort.Strings(names)
+		return names
+	}
+	assert.Equal(t, []string{"backup1/", "backup2/", "backup3/", "legacy.tar"}, walk("/", false))
+	assert.Equal(t, []string{"backup1/metadata.json", "backup1/shadow/db/t/default.tar", "backup2/metadata.json", "backup3/metadata.json", "legacy.tar"}, walk("/", true))
+	assert.Equal(t, []string{"metadata.json", "shadow/db/t/default.tar"}, walk("backup1/", true))
+	assert.Equal(t, []string{"metadata.json", "shadow/"}, walk("backup1", false))
+
+	bd := &BackupDestination{RemoteStorage: c, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	backups, err := bd.BackupList(false, "")
+	assert.NoError(t, err)
+	assert.Len(t, backups, 4)
+}
@@ -0,0 +1,87 @@
+package new_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// deleteBatchSize - max keys in one batch deletion request, S3 DeleteObjects doesn't accept more
+const deleteBatchSize = 1000
+
+// deleteErrorsToShow - max failed keys which are listed in error message
+const deleteErrorsToShow = 10
+
+// batchDeleter - remote storage which could delete many keys by one request, return errors for keys which weren't deleted
+type batchDeleter interface {
+	DeleteFiles(keys []string) map[string]error
+}
+
+// deleteKeys - delete keys by delete_concurrency parallel requests, keys are grouped into batches when remote storage supports it,
+// deletion doesn't stop on failure, all failed keys are reported in one error, already absent keys aren't failures
+func (bd *BackupDestination) deleteKeys(keys []string) error {
+	concurrency := bd.deleteConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	batchSize := 1
+	deleter, isBatchDeleter := bd.RemoteStorage.(batchDeleter)
+	if isBatchDeleter {
+		batchSize = deleteBatchSize
+	}
+	failed := map[string]error{}
+	var failedLock sync.Mutex
+	s := semaphore.NewWeighted(int64(concurrency))
+	g := errgroup.Group{}
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		if err := s.Acquire(context.Background(), 1); err != nil {
+			return err
+		}
+		g.Go(func() error {
+			defer s.Release(1)
+			var batchFailed map[string]error
+			if isBatchDeleter {
+				batchFailed = deleter.DeleteFiles(batch)
+			} else if err := bd.DeleteFile(batch[0]); err != nil {
+				batchFailed = map[string]error{batch[0]: err}
+			}
+			failedLock.Lock()
+			defer failedLock.Unlock()
+			for key, err := range batchFailed {
+				if !errors.Is(err, ErrNotFound) {
+					failed[key] = err
+				}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	if len(failed) == 0 {
+		return nil
+	}
+	failedKeys := make([]string, 0, len(failed))
+	for key := range failed {
+		failedKeys = append(failedKeys, key)
+	}
+	sort.Strings(failedKeys)
+	var messages []string
+	for i, key := range failedKeys {
+		if i == deleteErrorsToShow {
+			messages = append(messages, fmt.Sprintf("and %d more", len(failedKeys)-deleteErrorsToShow))
+			break
+		}
+		messages = append(messages, fmt.Sprintf("%s: %v", key, failed[key]))
+	}
+	return fmt.Errorf("can't delete %d of %d files: %s", len(failed), len(keys), strings.Join(messages, "; "))
+}
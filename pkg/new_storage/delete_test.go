@@ -0,0 +1,204 @@
+package new_storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+// deleteRecordingStorage - mockStorage which counts parallel DeleteFile calls and fails keys from failKeys
+type deleteRecordingStorage struct {
+	mockStorage
+	sync.Mutex
+	deleted     []string
+	inFlight    int
+	maxInFlight int
+	failKeys    map[string]error
+}
+
+func (s *deleteRecordingStorage) DeleteFile(key string) error {
+	s.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.Unlock()
+	time.Sleep(time.Millisecond)
+	s.Lock()
+	defer s.Unlock()
+	s.inFlight--
+	if err, fail := s.failKeys[key]; fail {
+		return err
+	}
+	s.deleted = append(s.deleted, key)
+	return nil
+}
+
+// batchDeleteStorage - deleteRecordingStorage which deletes keys by batches
+type batchDeleteStorage struct {
+	deleteRecordingStorage
+	batches []int
+}
+
+func (s *batchDeleteStorage) DeleteFiles(keys []string) map[string]error {
+	s.Lock()
+	s.batches = append(s.batches, len(keys))
+	s.Unlock()
+	failed := map[string]error{}
+	for _, key := range keys {
+		if err := s.DeleteFile(key); err != nil {
+			failed[key] = err
+		}
+	}
+	return failed
+}
+
+func deleteTestKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("backup1/shadow/default/t/default_%05d.tar", i)
+	}
+	return keys
+}
+
+func TestDeleteKeysConcurrency(t *testing.T) {
+	storage := &deleteRecordingStorage{}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 4}
+	assert.NoError(t, bd.deleteKeys(deleteTestKeys(40)))
+	assert.ElementsMatch(t, deleteTestKeys(40), storage.deleted)
+	assert.LessOrEqual(t, storage.maxInFlight, 4)
+	assert.Greater(t, storage.maxInFlight, 1)
+
+	storage = &deleteRecordingStorage{}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true}
+	assert.NoError(t, bd.deleteKeys(deleteTestKeys(5)))
+	assert.Equal(t, deleteTestKeys(5), storage.deleted, "zero delete_concurrency shall delete keys one by one")
+	assert.Equal(t, 1, storage.maxInFlight)
+	assert.NoError(t, bd.deleteKeys(nil))
+}
+
+func TestDeleteKeysBatches(t *testing.T) {
+	keys := deleteTestKeys(2500)
+	storage := &batchDeleteStorage{}
+	storage.failKeys = map[string]error{keys[1]: ErrNotFound}
+	for _, i := range []int{3, 1500, 1501, 1502, 1503, 1504, 1505, 1506, 1507, 1508, 1509, 2499} {
+		storage.failKeys[keys[i]] = errors.New("access denied")
+	}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 2}
+	err := bd.deleteKeys(keys)
+	assert.ElementsMatch(t, []int{1000, 1000, 500}, storage.batches)
+	assert.Len(t, storage.deleted, 2500-13, "deletion shall not stop on failure")
+	assert.EqualError(t, err, "can't delete 12 of 2500 files: "+
+		keys[3]+": access denied; "+
+		strings.Join(func() []string {
+			var messages []string
+			for i := 1500; i <= 1508; i++ {
+				messages = append(messages, keys[i]+": access denied")
+			}
+			return messages
+		}(), "; ")+"; and 2 more")
+}
+
+// deleteObjectsServer - S3 API which answers DeleteObjects request, keys with "denied" are not deleted
+type deleteObjectsServer struct {
+	sync.Mutex
+	requests       int
+	deleted        []string
+	notImplemented bool
+}
+
+func (s *deleteObjectsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Method == http.MethodDelete {
+		s.deleted = append(s.deleted, strings.TrimPrefix(r.URL.Path, "/bucket/"))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, isDelete := r.URL.Query()["delete"]; r.Method != http.MethodPost || !isDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.requests++
+	if s.notImplemented {
+		w.WriteHeader(http.StatusNotImplemented)
+		_, _ = w.Write([]byte(`<Error><Code>NotImplemented</Code><Message>not implemented</Message></Error>`))
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	result := "<DeleteResult>"
+	for _, object := range request.Objects {
+		if strings.Contains(object.Key, "denied") {
+			result += fmt.Sprintf("<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", object.Key)
+			continue
+		}
+		s.deleted = append(s.deleted, object.Key)
+	}
+	_, _ = w.Write([]byte(result + "</DeleteResult>"))
+}
+
+func TestS3DeleteFiles(t *testing.T) {
+	server := &deleteObjectsServer{}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	s := &S3{
+		Config: &config.S3Config{
+			Bucket:         "bucket",
+			Path:           "prefix",
+			Endpoint:       srv.URL,
+			Region:         "us-east-1",
+			AccessKey:      "access",
+			SecretKey:      "secret",
+			ForcePathStyle: true,
+			DisableSSL:     true,
+		},
+		Concurrency: 1,
+		BufferSize:  1024 * 1024,
+		PartSize:    5 * 1024 * 1024,
+	}
+	assert.NoError(t, s.Connect())
+	failed := s.DeleteFiles([]string{"backup1/metadata.json", "backup1/denied.tar", "backup1/shadow/a.tar"})
+	assert.Equal(t, 1, server.requests)
+	assert.Equal(t, []string{"prefix/backup1/metadata.json", "prefix/backup1/shadow/a.tar"}, server.deleted)
+	assert.Len(t, failed, 1)
+	assert.True(t, errors.Is(failed["backup1/denied.tar"], ErrUnauthorized), "%v", failed)
+
+	server.deleted = nil
+	server.notImplemented = true
+	assert.Empty(t, s.DeleteFiles([]string{"backup1/metadata.json", "backup1/shadow/a.tar"}))
+	assert.Equal(t, []string{"prefix/backup1/metadata.json", "prefix/backup1/shadow/a.tar"}, server.deleted, "storage without DeleteObjects shall get DeleteObject for each key")
+}
+
+func TestRemoveBackupBatches(t *testing.T) {
+	storage := &batchDeleteStorage{}
+	storage.files = map[string][]byte{"backup1/metadata.json": []byte(`{"backup_name":"backup1"}`)}
+	for _, key := range deleteTestKeys(1500) {
+		storage.files[key] = []byte("data")
+	}
+	storage.failKeys = map[string]error{"backup1/metadata.json": errors.New("access denied")}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	err := bd.RemoveBackup(Backup{BackupMetadata: metadata.BackupMetadata{BackupName: "backup1"}})
+	assert.EqualError(t, err, "can't delete 1 of 1501 files: backup1/metadata.json: access denied")
+	assert.ElementsMatch(t, []int{1000, 501}, storage.batches, "backup objects shall be deleted by DeleteFiles batches")
+	assert.ElementsMatch(t, deleteTestKeys(1500), storage.deleted)
+}
@@ -0,0 +1,73 @@
+package new_storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// storageError - wrap provider error into ErrUnauthorized or ErrTransient and keep provider message, ErrNotFound is returned as is cause callers compare it directly
+func storageError(kind error, err error) error {
+	if kind == ErrNotFound {
+		return ErrNotFound
+	}
+	return fmt.Errorf("%w: %v", kind, err)
+}
+
+// connectError - keep message of failed Connect as is and mark it as ErrRemoteStorage, errors.Is still matches ErrUnauthorized and ErrTransient of wrapped error
+type connectError struct {
+	err error
+}
+
+func (e connectError) Error() string {
+	return e.err.Error()
+}
+
+func (e connectError) Unwrap() error {
+	return e.err
+}
+
+func (e connectError) Is(target error) bool {
+	return target == ErrRemoteStorage
+}
+
+// errorKindByStatusCode - map HTTP status code of provider response, nil means permanent error which shall not be retried
+func errorKindByStatusCode(statusCode int) error {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ErrNotFound
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError:
+		return ErrTransient
+	}
+	return nil
+}
+
+// isNetworkError - timeouts, connection reset and truncated responses
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// mapStatusCodeError - common part of provider errors mapping, use HTTP status code when provider doesn't return known error code
+func mapStatusCodeError(statusCode int, err error) error {
+	if kind := errorKindByStatusCode(statusCode); kind != nil {
+		return storageError(kind, err)
+	}
+	if isNetworkError(err) {
+		return storageError(ErrTransient, err)
+	}
+	return storageError(ErrRemoteStorage, err)
+}
+
+// IsRetriable - return true when operation failed with ErrTransient and could be retried
+func IsRetriable(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
@@ -0,0 +1,122 @@
+package new_storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"google.golang.org/api/googleapi"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func assertErrorKind(t *testing.T, expected error, err error) {
+	if expected == nil {
+		assert.False(t, errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrTransient), "%v", err)
+		return
+	}
+	assert.ErrorIs(t, err, expected)
+}
+
+func TestMapS3Error(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected error
+	}{
+		{awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "id"), ErrNotFound},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "The specified key does not exist.", nil), http.StatusNotFound, "id"), ErrNotFound},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id"), ErrUnauthorized},
+		{awserr.NewRequestFailure(awserr.New("InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist", nil), http.StatusForbidden, "id"), ErrUnauthorized},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "id"), ErrTransient},
+		{awserr.NewRequestFailure(awserr.New("UnknownError", "bad gateway", nil), http.StatusBadGateway, "id"), ErrTransient},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", timeoutError{}), ErrTransient},
+		{awserr.NewRequestFailure(awserr.New("InvalidArgument", "Invalid Argument", nil), http.StatusBadRequest, "id"), ErrRemoteStorage},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), ErrTransient},
+	}
+	for _, tc := range testCases {
+		assertErrorKind(t, tc.expected, mapS3Error(tc.err))
+	}
+	assert.NoError(t, mapS3Error(nil))
+	assert.Equal(t, ErrNotFound, mapS3Error(awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "id")))
+	assert.Contains(t, mapS3Error(awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id")).Error(), "AccessDenied")
+}
+
+func TestMapGCSError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected error
+	}{
+		{storage.ErrObjectNotExist, ErrNotFound},
+		{storage.ErrBucketNotExist, ErrNotFound},
+		{&googleapi.Error{Code: http.StatusNotFound, Message: "No such object"}, ErrNotFound},
+		{&googleapi.Error{Code: http.StatusUnauthorized, Message: "Invalid Credentials"}, ErrUnauthorized},
+		{&googleapi.Error{Code: http.StatusForbidden, Message: "does not have storage.objects.get access"}, ErrUnauthorized},
+		{&googleapi.Error{Code: http.StatusTooManyRequests, Message: "rateLimitExceeded"}, ErrTransient},
+		{&googleapi.Error{Code: http.StatusInternalServerError, Message: "backendError"}, ErrTransient},
+		{&googleapi.Error{Code: http.StatusBadRequest, Message: "invalid"}, ErrRemoteStorage},
+		{fmt.Errorf("dial tcp: %w", timeoutError{}), ErrTransient},
+	}
+	for _, tc := range testCases {
+		assertErrorKind(t, tc.expected, mapGCSError(tc.err))
+	}
+}
+
+func TestMapCOSError(t *testing.T) {
+	cosError := func(code string, statusCode int) error {
+		return &cos.ErrorResponse{Response: &http.Response{StatusCode: statusCode, Request: &http.Request{}}, Code: code}
+	}
+	testCases := []struct {
+		err      error
+		expected error
+	}{
+		{cosError("NoSuchKey", http.StatusNotFound), ErrNotFound},
+		{cosError("AccessDenied", http.StatusForbidden), ErrUnauthorized},
+		{cosError("SignatureDoesNotMatch", http.StatusForbidden), ErrUnauthorized},
+		{cosError("ServiceUnavailable", http.StatusServiceUnavailable), ErrTransient},
+		{cosError("InvalidArgument", http.StatusBadRequest), ErrRemoteStorage},
+	}
+	for _, tc := range testCases {
+		assertErrorKind(t, tc.expected, mapCOSError(tc.err))
+	}
+}
+
+func TestIsRetriable(t *testing.T) {
+	assert.True(t, IsRetriable(storageError(ErrTransient, fmt.Errorf("503"))))
+	assert.True(t, IsRetriable(fmt.Errorf("can't upload: %w", storageError(ErrTransient, fmt.Errorf("503")))))
+	assert.False(t, IsRetriable(storageError(ErrUnauthorized, fmt.Errorf("403"))))
+	assert.False(t, IsRetriable(ErrNotFound))
+}
+
+func TestConnectError(t *testing.T) {
+	storage := &mockStorage{}
+	bd := &BackupDestination{RemoteStorage: storage}
+	assert.NoError(t, bd.Connect())
+	storage.connectErr = errors.New("dial tcp: no such host")
+	err := bd.Connect()
+	assert.EqualError(t, err, "dial tcp: no such host")
+	assert.ErrorIs(t, err, ErrRemoteStorage)
+	// kind of provider error is kept
+	storage.connectErr = storageError(ErrUnauthorized, errors.New("InvalidAccessKeyId"))
+	err = bd.Connect()
+	assert.EqualError(t, err, "access denied: InvalidAccessKeyId")
+	assert.ErrorIs(t, err, ErrRemoteStorage)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestMapGCSErrorReason(t *testing.T) {
+	err := mapGCSError(&googleapi.Error{Code: http.StatusTooManyRequests, Message: "The rate of change requests to the object is too high", Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}})
+	assert.EqualError(t, err, "temporary failure: GCS error 429 rateLimitExceeded: The rate of change requests to the object is too high")
+	err = mapGCSError(&googleapi.Error{Code: http.StatusForbidden, Body: "Access denied."})
+	assert.EqualError(t, err, "access denied: GCS error 403 Forbidden: Access denied.")
+}
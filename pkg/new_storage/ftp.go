@@ -7,6 +7,7 @@ import (
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	apexLog "github.com/apex/log"
 	"io"
+	"net"
 	"os"
 	"path"
 	"strings"
@@ -19,12 +20,21 @@ import (
 
 type FTP struct {
 	clients       *pool.ObjectPool
+	dialOptions   []ftp.DialOption
 	ctx           context.Context
 	Config        *config.FTPConfig
 	dirCache      map[string]bool
 	dirCacheMutex sync.RWMutex
 }
 
+func init() {
+	registerBackend("ftp", func(cfg *config.Config) (RemoteStorage, error) {
+		return &FTP{Config: &cfg.FTP}, nil
+	}, func(cfg *config.Config) (string, int) {
+		return cfg.FTP.CompressionFormat, cfg.FTP.CompressionLevel
+	})
+}
+
 func (f *FTP) Connect() error {
 	timeout, err := time.ParseDuration(f.Config.Timeout)
 	if err != nil {
@@ -37,12 +47,28 @@ func (f *FTP) Connect() error {
 	if f.Config.Debug {
 		options = append(options, ftp.DialWithDebugOutput(os.Stdout))
 	}
+	var tlsConfig *tls.Config
 	if f.Config.TLS {
-		tlsConfig := tls.Config{}
-		options = append(options, ftp.DialWithTLS(&tlsConfig))
+		tlsConfig = &tls.Config{}
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	}
+	if f.Config.ProxyURL != "" {
+		proxyTLSConfig := tlsConfig
+		if tlsConfig != nil {
+			// data connections are dialed by IP from PASV reply, so server name for certificate is taken from address
+			host, _, _ := net.SplitHostPort(f.Config.Address)
+			proxyTLSConfig = &tls.Config{ServerName: host}
+		}
+		dialFunc, err := newProxyDialFunc(f.Config.ProxyURL, timeout, proxyTLSConfig)
+		if err != nil {
+			return err
+		}
+		// remote address of control connection is address of proxy, so EPSV can't be used, PASV returns address of server for data connections
+		options = append(options, ftp.DialWithDialFunc(dialFunc), ftp.DialWithDisabledEPSV(true))
 	}
 	f.ctx = context.Background()
-	f.clients = pool.NewObjectPoolWithDefaultConfig(f.ctx, &ftpPoolFactory{options: options, ftp: f})
+	f.dialOptions = options
+	f.clients = pool.NewObjectPoolWithDefaultConfig(f.ctx, &ftpPoolFactory{ftp: f})
 	if f.Config.Concurrency > 1 {
 		f.clients.Config.MaxTotal = int(f.Config.Concurrency)*2 + 1
 	}
@@ -78,14 +104,48 @@ func (f *FTP) returnConnectionToPool(where string, client *ftp.ServerConn) {
 	}
 }
 
+// dial - new logged in connection
+func (f *FTP) dial() (*ftp.ServerConn, error) {
+	c, err := ftp.Dial(f.Config.Address, f.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Login(f.Config.Username, f.Config.Password); err != nil {
+		_ = c.Quit()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DedicatedConnection - logged in connection outside of pool, reads of metadata.json through it don't wait for pooled control channels
+func (f *FTP) DedicatedConnection() (dedicatedConnection, error) {
+	client, err := f.dial()
+	if err != nil {
+		return nil, err
+	}
+	return &ftpDedicatedConnection{client: client, ftp: f}, nil
+}
+
+// DedicatedConcurrency - count of dedicated connections which read metadata.json concurrently
+func (f *FTP) DedicatedConcurrency() int {
+	if f.Config.Concurrency > 1 {
+		return int(f.Config.Concurrency)
+	}
+	return 1
+}
+
 func (f *FTP) StatFile(key string) (RemoteFile, error) {
-	// cant list files, so check the dir
-	dir := path.Dir(path.Join(f.Config.Path, key))
 	client, err := f.getConnectionFromPool(fmt.Sprintf("StatFile, key=%s", key))
 	if err != nil {
 		return nil, err
 	}
 	defer f.returnConnectionToPool(fmt.Sprintf("StatFile, key=%s", key), client)
+	return f.statFile(client, key)
+}
+
+func (f *FTP) statFile(client *ftp.ServerConn, key string) (RemoteFile, error) {
+	// cant list files, so check the dir
+	dir := path.Dir(path.Join(f.Config.Path, key))
 	entries, err := client.List(dir)
 	if err != nil {
 		// proftpd return 550 error if `dir` not exists
@@ -257,17 +317,35 @@ func (fr *FTPFileReader) Close() error {
 	return fr.Response.Close()
 }
 
-type ftpPoolFactory struct {
-	options []ftp.DialOption
-	ftp     *FTP
+// ftpDedicatedConnection - connection outside of pool, it isn't thread-safe, each reader shall be closed before next call
+type ftpDedicatedConnection struct {
+	client *ftp.ServerConn
+	ftp    *FTP
 }
 
-func (f *ftpPoolFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
-	c, err := ftp.Dial(f.ftp.Config.Address, f.options...)
+func (c *ftpDedicatedConnection) StatFile(key string) (RemoteFile, error) {
+	return c.ftp.statFile(c.client, key)
+}
+
+func (c *ftpDedicatedConnection) GetFileReader(key string) (io.ReadCloser, error) {
+	resp, err := c.client.Retr(path.Join(c.ftp.Config.Path, key))
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Login(f.ftp.Config.Username, f.ftp.Config.Password); err != nil {
+	return resp, nil
+}
+
+func (c *ftpDedicatedConnection) Close() error {
+	return c.client.Quit()
+}
+
+type ftpPoolFactory struct {
+	ftp *FTP
+}
+
+func (f *ftpPoolFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
+	c, err := f.ftp.dial()
+	if err != nil {
 		return nil, err
 	}
 	return pool.NewPooledObject(c), nil
@@ -0,0 +1,167 @@
+package new_storage
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockFTPServer - passive mode FTP server which serves files from memory, each RETR is slow to check concurrent reads
+type mockFTPServer struct {
+	listener      net.Listener
+	files         map[string]string
+	retrDelay     time.Duration
+	activeRetr    int32
+	maxActiveRetr int32
+	controlConns  int32
+}
+
+func newMockFTPServer(t *testing.T, files map[string]string) *mockFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &mockFTPServer{listener: listener, files: files, retrDelay: 100 * time.Millisecond}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&srv.controlConns, 1)
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return srv
+}
+
+// list - unix `ls -l` lines of direct children of dir
+func (srv *mockFTPServer) list(dir string) []string {
+	var lines []string
+	seenDirs := map[string]bool{}
+	for name, body := range srv.files {
+		rel := strings.TrimPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+		if rel == name && dir != "/" {
+			continue
+		}
+		if i := strings.Index(rel, "/"); i >= 0 {
+			if !seenDirs[rel[:i]] {
+				seenDirs[rel[:i]] = true
+				lines = append(lines, fmt.Sprintf("drwxr-xr-x 1 ftp ftp 0 Jan 01 10:00 %s", rel[:i]))
+			}
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("-rw-r--r-- 1 ftp ftp %d Jan 01 10:00 %s", len(body), rel))
+	}
+	return lines
+}
+
+func (srv *mockFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 mock ready")
+	var data net.Listener
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg := strings.TrimSpace(line), ""
+		if i := strings.Index(cmd, " "); i > 0 {
+			// working directory is always root
+			cmd, arg = cmd[:i], path.Join("/", cmd[i+1:])
+		}
+		switch cmd {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 ok")
+		case "EPSV", "PASV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 %v", err)
+				continue
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256)
+			}
+		case "LIST", "RETR":
+			dataConn, err := data.Accept()
+			_ = data.Close()
+			if err != nil {
+				reply("425 %v", err)
+				continue
+			}
+			body, exists := srv.files[arg]
+			if cmd == "LIST" {
+				body, exists = strings.Join(srv.list(arg), "\r\n")+"\r\n", true
+			}
+			if !exists {
+				_ = dataConn.Close()
+				reply("550 %s not found", arg)
+				continue
+			}
+			reply("150 opening data connection")
+			if cmd == "RETR" {
+				active := atomic.AddInt32(&srv.activeRetr, 1)
+				for max := atomic.LoadInt32(&srv.maxActiveRetr); active > max && !atomic.CompareAndSwapInt32(&srv.maxActiveRetr, max, active); {
+					max = atomic.LoadInt32(&srv.maxActiveRetr)
+				}
+				time.Sleep(srv.retrDelay)
+				atomic.AddInt32(&srv.activeRetr, -1)
+			}
+			_, _ = dataConn.Write([]byte(body))
+			_ = dataConn.Close()
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 %s not implemented", cmd)
+		}
+	}
+}
+
+func TestFTPBackupListConcurrentMetadata(t *testing.T) {
+	prefix := fmt.Sprintf("ftp_metadata_%d", time.Now().UnixNano())
+	files := map[string]string{}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("%s_%d", prefix, i)
+		files[path.Join("/", name, "metadata.json")] = `{"backup_name":"` + name + `"}`
+	}
+	brokenName := prefix + "_broken"
+	files[path.Join("/", brokenName, "metadata.json")] = "{"
+	srv := newMockFTPServer(t, files)
+
+	f := &FTP{Config: &config.FTPConfig{Address: srv.listener.Addr().String(), Timeout: "5s", Concurrency: 4}}
+	assert.NoError(t, f.Connect())
+	bd := &BackupDestination{RemoteStorage: f, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	start := time.Now()
+	backups, err := bd.BackupListByPrefix(prefix, true, "")
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(9*srv.retrDelay), "metadata.json shall be read concurrently")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&srv.maxActiveRetr))
+	assert.Len(t, backups, 9)
+	for _, b := range backups {
+		if b.BackupName == brokenName {
+			assert.Equal(t, "broken (bad metadata.json)", b.Broken)
+			continue
+		}
+		assert.Empty(t, b.Broken, b.BackupName)
+		assert.True(t, strings.HasPrefix(b.BackupName, prefix))
+	}
+}
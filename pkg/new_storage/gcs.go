@@ -2,10 +2,12 @@ package new_storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"google.golang.org/api/option/internaloption"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"path"
 	"strings"
@@ -13,6 +15,7 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/apex/log"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	googleHTTPTransport "google.golang.org/api/transport/http"
@@ -20,8 +23,17 @@ import (
 
 // GCS - presents methods for manipulate data on GCS
 type GCS struct {
-	client *storage.Client
-	Config *config.GCSConfig
+	client     *storage.Client
+	Config     *config.GCSConfig
+	objectTags map[string]string
+}
+
+func init() {
+	registerBackend("gcs", func(cfg *config.Config) (RemoteStorage, error) {
+		return &GCS{Config: &cfg.GCS}, nil
+	}, func(cfg *config.Config) (string, int) {
+		return cfg.GCS.CompressionFormat, cfg.GCS.CompressionLevel
+	})
 }
 
 type debugGCSTransport struct {
@@ -52,6 +64,49 @@ func (w debugGCSTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return resp, err
 }
 
+// retryGCSTransport - retry requests which failed with network error, 408, 429 or 5xx with exponential backoff,
+// requests with body are retried only when body could be re-created, it is true for chunks of resumable upload
+type retryGCSTransport struct {
+	base           http.RoundTripper
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func (t retryGCSTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	backoff := t.initialBackoff
+	for attempt := 1; ; attempt++ {
+		req := r
+		if attempt > 1 && r.Body != nil {
+			req = r.Clone(r.Context())
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		resp, err := t.base.RoundTrip(req)
+		retriable := (err != nil && isNetworkError(err)) || (err == nil && errorKindByStatusCode(resp.StatusCode) == ErrTransient)
+		if !retriable || attempt > t.maxRetries || (r.Body != nil && r.GetBody == nil) {
+			return resp, err
+		}
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Status)
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		log.Warnf("GCS %s %s failed: %v, retry %d/%d after %s", r.Method, r.URL.Path, err, attempt, t.maxRetries, backoff)
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > t.maxBackoff {
+			backoff = t.maxBackoff
+		}
+	}
+}
+
 // Connect - connect to GCS
 func (gcs *GCS) Connect() error {
 	var err error
@@ -69,7 +124,8 @@ func (gcs *GCS) Connect() error {
 		clientOptions = append(clientOptions, option.WithCredentialsFile(gcs.Config.CredentialsFile))
 	}
 
-	if gcs.Config.Debug {
+	customTransport := gcs.Config.CACert != "" || gcs.Config.DisableCertVerification || gcs.Config.ProxyURL != ""
+	if gcs.Config.Debug || gcs.Config.MaxRetries > 0 || customTransport {
 		if gcs.Config.Endpoint == "" {
 			clientOptions = append([]option.ClientOption{option.WithScopes(storage.ScopeFullControl)}, clientOptions...)
 		}
@@ -78,12 +134,38 @@ func (gcs *GCS) Connect() error {
 			clientOptions = append(clientOptions, internaloption.WithDefaultMTLSEndpoint(endpoint))
 		}
 
-		debugClient, _, err := googleHTTPTransport.NewClient(ctx, clientOptions...)
-		if err != nil {
+		httpClient := &http.Client{}
+		if customTransport {
+			baseTransport, err := newHTTPTransport(gcs.Kind(), gcs.Config.CACert, gcs.Config.DisableCertVerification, gcs.Config.ProxyURL)
+			if err != nil {
+				return fmt.Errorf("can't create gcs transport: %v", err)
+			}
+			if httpClient.Transport, err = googleHTTPTransport.NewTransport(ctx, baseTransport, clientOptions...); err != nil {
+				return fmt.Errorf("googleHTTPTransport.NewTransport error: %v", err)
+			}
+		} else if httpClient, _, err = googleHTTPTransport.NewClient(ctx, clientOptions...); err != nil {
 			return fmt.Errorf("googleHTTPTransport.NewClient error: %v", err)
 		}
-		debugClient.Transport = debugGCSTransport{base: debugClient.Transport}
-		clientOptions = append(clientOptions, option.WithHTTPClient(debugClient))
+		if gcs.Config.Debug {
+			httpClient.Transport = debugGCSTransport{base: httpClient.Transport}
+		}
+		if gcs.Config.MaxRetries > 0 {
+			initialBackoff, err := time.ParseDuration(gcs.Config.RetryInitialBackoff)
+			if err != nil {
+				return fmt.Errorf("can't parse gcs.retry_initial_backoff: %v", err)
+			}
+			maxBackoff, err := time.ParseDuration(gcs.Config.RetryMaxBackoff)
+			if err != nil {
+				return fmt.Errorf("can't parse gcs.retry_max_backoff: %v", err)
+			}
+			httpClient.Transport = retryGCSTransport{
+				base:           httpClient.Transport,
+				maxRetries:     gcs.Config.MaxRetries,
+				initialBackoff: initialBackoff,
+				maxBackoff:     maxBackoff,
+			}
+		}
+		clientOptions = append(clientOptions, option.WithHTTPClient(httpClient))
 	}
 
 	gcs.client, err = storage.NewClient(ctx, clientOptions...)
@@ -127,7 +209,7 @@ func (gcs *GCS) Walk(gcsPath string, recursive bool, process func(r RemoteFile)
 		case iterator.Done:
 			return nil
 		default:
-			return err
+			return mapGCSError(err)
 		}
 	}
 }
@@ -141,7 +223,7 @@ func (gcs *GCS) GetFileReader(key string) (io.ReadCloser, error) {
 	obj := gcs.client.Bucket(gcs.Config.Bucket).Object(path.Join(gcs.Config.Path, key))
 	reader, err := obj.NewReader(ctx)
 	if err != nil {
-		return nil, err
+		return nil, mapGCSError(err)
 	}
 	return reader, nil
 }
@@ -153,25 +235,43 @@ func (gcs *GCS) GetFileWriter(key string) io.WriteCloser {
 	return obj.NewWriter(ctx)
 }
 
-func (gcs *GCS) PutFile(key string, r io.ReadCloser) error {
-	ctx := context.Background()
+// SetObjectTags - set tags which will be attached as custom metadata to all objects uploaded by PutFile, tags from config have priority
+func (gcs *GCS) SetObjectTags(tags map[string]string) {
+	gcs.objectTags = mergeObjectTags(tags, gcs.Config.ObjectTags)
+}
+
+func (gcs *GCS) newObjectWriter(ctx context.Context, key string) *storage.Writer {
 	key = path.Join(gcs.Config.Path, key)
 	obj := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
 	writer := obj.NewWriter(ctx)
-	defer writer.Close()
+	writer.ChunkSize = gcs.Config.ChunkSize
+	writer.KMSKeyName = gcs.Config.KMSKeyName
+	if len(gcs.objectTags) > 0 {
+		writer.Metadata = gcs.objectTags
+	}
+	return writer
+}
+
+// PutFile - object is uploaded by resumable upload with chunk_size chunks, it is committed by writer.Close, so Close error is returned
+func (gcs *GCS) PutFile(key string, r io.ReadCloser) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := gcs.newObjectWriter(ctx, key)
 	buffer := make([]byte, 4*1024*1024)
-	_, err := io.CopyBuffer(writer, r, buffer)
-	return err
+	if _, err := io.CopyBuffer(writer, r, buffer); err != nil {
+		// cancel upload, partially written object shall not be committed
+		cancel()
+		_ = writer.Close()
+		return mapGCSError(err)
+	}
+	return mapGCSError(writer.Close())
 }
 
 func (gcs *GCS) StatFile(key string) (RemoteFile, error) {
 	ctx := context.Background()
 	objAttr, err := gcs.client.Bucket(gcs.Config.Bucket).Object(path.Join(gcs.Config.Path, key)).Attrs(ctx)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			return nil, ErrNotFound
-		}
-		return nil, err
+		return nil, mapGCSError(err)
 	}
 	return &gcsFile{
 		size:         objAttr.Size,
@@ -184,7 +284,38 @@ func (gcs *GCS) DeleteFile(key string) error {
 	ctx := context.Background()
 	key = path.Join(gcs.Config.Path, key)
 	object := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
-	return object.Delete(ctx)
+	return mapGCSError(object.Delete(ctx))
+}
+
+// mapGCSError - map GCS errors and HTTP status into ErrNotFound, ErrUnauthorized, ErrTransient and ErrRemoteStorage
+func mapGCSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return ErrNotFound
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return mapStatusCodeError(apiErr.Code, gcsAPIError(apiErr))
+	}
+	return mapStatusCodeError(0, err)
+}
+
+// gcsAPIError - error with HTTP status and reason of GCS response, e.g. `rateLimitExceeded` or `forbidden`, instead of generic googleapi message
+func gcsAPIError(apiErr *googleapi.Error) error {
+	reason := http.StatusText(apiErr.Code)
+	if len(apiErr.Errors) > 0 && apiErr.Errors[0].Reason != "" {
+		reason = apiErr.Errors[0].Reason
+	}
+	message := apiErr.Message
+	if message == "" {
+		message = strings.TrimSpace(apiErr.Body)
+	}
+	if message == "" {
+		return fmt.Errorf("GCS error %d %s", apiErr.Code, reason)
+	}
+	return fmt.Errorf("GCS error %d %s: %s", apiErr.Code, reason, message)
 }
 
 type gcsFile struct {
@@ -0,0 +1,53 @@
+package new_storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryGCSTransport(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	statuses := []int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		bodies = append(bodies, string(body))
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: retryGCSTransport{base: http.DefaultTransport, maxRetries: 2, initialBackoff: time.Millisecond, maxBackoff: 2 * time.Millisecond}}
+	do := func(body []byte, codes ...int) (int, []string) {
+		statuses, bodies = codes, nil
+		req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(body))
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		return resp.StatusCode, bodies
+	}
+
+	status, sent := do([]byte("chunk"), http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"chunk", "chunk", "chunk"}, sent, "chunk shall be sent again after transient errors")
+
+	status, sent = do([]byte("chunk"), http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	assert.Equal(t, http.StatusServiceUnavailable, status, "error shall be returned after max retries")
+	assert.Len(t, sent, 3)
+
+	status, sent = do([]byte("chunk"), http.StatusForbidden)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Len(t, sent, 1, "permanent errors shall not be retried")
+}
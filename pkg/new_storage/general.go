@@ -2,12 +2,17 @@ package new_storage
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/progressbar"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -30,6 +35,8 @@ import (
 const (
 	// BufferSize - size of ring buffer between stream handlers
 	BufferSize = 4 * 1024 * 1024
+	// VerifyUploadAttempts - how many times CompressedStreamUpload will try to upload file when verify_upload check fails or remote storage returns ErrTransient
+	VerifyUploadAttempts = 3
 )
 
 type Backup struct {
@@ -40,15 +47,77 @@ type Backup struct {
 	UploadDate    time.Time
 }
 
+// GetDate - return creation date from metadata.json, object modification time could change after copy between buckets or re-upload,
+// so UploadDate is used only for legacy and broken backups which don't have metadata.json
+func (b Backup) GetDate() time.Time {
+	if b.Legacy || b.CreationDate.IsZero() {
+		return b.UploadDate
+	}
+	return b.CreationDate
+}
+
 type BackupDestination struct {
 	RemoteStorage
 	compressionFormat  string
 	compressionLevel   int
 	disableProgressBar bool
+	verifyUpload       bool
+	maxArchiveSize     int64
+	progress           *progressbar.Tracker
+	deleteConcurrency  int
+	backupManifest     bool
+	// preserveOwnership - uid and gid from tar header are set on extracted files when running as root
+	preserveOwnership bool
 }
 
 var metadataCacheLock sync.RWMutex
 
+// objectTagsSetter - remote storage which allows attaching tags to uploaded objects
+type objectTagsSetter interface {
+	SetObjectTags(tags map[string]string)
+}
+
+// Connect - connect to remote storage, failure is ErrRemoteStorage
+func (bd *BackupDestination) Connect() error {
+	if err := bd.RemoteStorage.Connect(); err != nil {
+		return connectError{err}
+	}
+	return nil
+}
+
+// SetObjectTags - attach tags to all objects which will be uploaded, ignored when remote storage doesn't support tags
+func (bd *BackupDestination) SetObjectTags(tags map[string]string) {
+	if setter, ok := bd.RemoteStorage.(objectTagsSetter); ok {
+		setter.SetObjectTags(tags)
+	}
+}
+
+// WithCompression - copy of BackupDestination which writes and reads archives with format and level, negative level keeps current level
+func (bd *BackupDestination) WithCompression(format string, level int) *BackupDestination {
+	result := *bd
+	result.compressionFormat = format
+	if level >= 0 {
+		result.compressionLevel = level
+	}
+	return &result
+}
+
+// SetProgressTracker - count all transferred bytes in tracker
+func (bd *BackupDestination) SetProgressTracker(tracker *progressbar.Tracker) {
+	bd.progress = tracker
+}
+
+func mergeObjectTags(autoTags, configTags map[string]string) map[string]string {
+	tags := make(map[string]string, len(autoTags)+len(configTags))
+	for k, v := range autoTags {
+		tags[k] = v
+	}
+	for k, v := range configTags {
+		tags[k] = v
+	}
+	return tags
+}
+
 func (bd *BackupDestination) RemoveOldBackups(keep int) error {
 	if keep < 1 {
 		return nil
@@ -82,15 +151,33 @@ func (bd *BackupDestination) RemoveOldBackups(keep int) error {
 
 func (bd *BackupDestination) RemoveBackup(backup Backup) error {
 	if bd.Kind() == "SFTP" || bd.Kind() == "FTP" {
-		return bd.DeleteFile(backup.BackupName)
+		if err := bd.DeleteFile(backup.BackupName); err != nil {
+			return err
+		}
+		return bd.removeUnreferencedSharedParts(backup)
 	}
 	if backup.Legacy {
 		archiveName := fmt.Sprintf("%s.%s", backup.BackupName, backup.FileExtension)
 		return bd.DeleteFile(archiveName)
 	}
-	return bd.Walk(backup.BackupName+"/", true, func(f RemoteFile) error {
-		return bd.DeleteFile(path.Join(backup.BackupName, f.Name()))
-	})
+	objects, fromManifest, err := bd.backupObjects(backup.BackupName)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(objects))
+	for i, object := range objects {
+		keys[i] = path.Join(backup.BackupName, object.Key)
+	}
+	if err := bd.deleteKeys(keys); err != nil {
+		return err
+	}
+	// manifest is deleted after all objects, so interrupted deletion could be repeated without Walk
+	if fromManifest {
+		if err := bd.DeleteFile(path.Join(backup.BackupName, ManifestFile)); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return bd.removeUnreferencedSharedParts(backup)
 }
 
 func isLegacyBackup(backupName string) (bool, string, string) {
@@ -132,7 +219,8 @@ func (bd *BackupDestination) loadMetadataCache() map[string]Backup {
 	return listCache
 }
 
-func (bd *BackupDestination) saveMetadataCache(listCache map[string]Backup, actualList []Backup) {
+// saveMetadataCache - write listCache without backups which have namePrefix and are absent in actualList, backups without namePrefix weren't listed and are kept
+func (bd *BackupDestination) saveMetadataCache(listCache map[string]Backup, actualList []Backup, namePrefix string) {
 	listCacheFile := path.Join(os.TempDir(), fmt.Sprintf(".clickhouse-backup-metadata.cache.%s", bd.Kind()))
 	f, err := os.OpenFile(listCacheFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -140,6 +228,9 @@ func (bd *BackupDestination) saveMetadataCache(listCache map[string]Backup, actu
 		return
 	}
 	for backupName := range listCache {
+		if !strings.HasPrefix(backupName, namePrefix) {
+			continue
+		}
 		found := false
 		for _, actualBackup := range actualList {
 			if backupName == actualBackup.BackupName {
@@ -164,14 +255,166 @@ func (bd *BackupDestination) saveMetadataCache(listCache map[string]Backup, actu
 	_ = f.Close()
 }
 
+// PutBackupMetadata - replace metadata.json of remote backup, cached metadata of this backup is dropped, so next BackupList will read new metadata.json
+func (bd *BackupDestination) PutBackupMetadata(backupMetadata metadata.BackupMetadata) error {
+	content, err := json.MarshalIndent(&backupMetadata, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal metadata.json: %v", err)
+	}
+	if err := bd.PutFile(path.Join(backupMetadata.BackupName, "metadata.json"), ioutil.NopCloser(bytes.NewReader(content))); err != nil {
+		return fmt.Errorf("can't upload metadata.json: %w", err)
+	}
+	if err := bd.updateManifest(backupMetadata.BackupName, ManifestObject{Key: "metadata.json", Size: int64(len(content))}); err != nil {
+		return err
+	}
+	metadataCacheLock.Lock()
+	defer metadataCacheLock.Unlock()
+	listCache := bd.loadMetadataCache()
+	if _, isCached := listCache[backupMetadata.BackupName]; isCached {
+		delete(listCache, backupMetadata.BackupName)
+		cachedList := make([]Backup, 0, len(listCache))
+		for _, backup := range listCache {
+			cachedList = append(cachedList, backup)
+		}
+		bd.saveMetadataCache(listCache, cachedList, "")
+	}
+	return nil
+}
+
+// pendingMetadata - backup which metadata.json shall be read, index is slot of backup in result of BackupListByPrefix
+type pendingMetadata struct {
+	index  int
+	name   string
+	folder RemoteFile
+}
+
+// metadataReader - part of RemoteStorage which reads metadata.json of backup
+type metadataReader interface {
+	StatFile(key string) (RemoteFile, error)
+	GetFileReader(key string) (io.ReadCloser, error)
+}
+
+// dedicatedConnection - connection outside of pool of remote storage, it shall be closed after reads
+type dedicatedConnection interface {
+	metadataReader
+	Close() error
+}
+
+// dedicatedConnector - remote storage with stateful control channel, like FTP, GetFileReader blocks the channel until reader is closed,
+// so metadata.json of many backups is read concurrently through dedicated connections instead of pooled ones
+type dedicatedConnector interface {
+	DedicatedConnection() (dedicatedConnection, error)
+	DedicatedConcurrency() int
+}
+
+// readPendingMetadata - read metadata.json of pending backups into their slots of result, sequentially through bd or concurrently through dedicated connections
+func (bd *BackupDestination) readPendingMetadata(pending []pendingMetadata, result []Backup) error {
+	connector, ok := bd.RemoteStorage.(dedicatedConnector)
+	if !ok || len(pending) < 2 {
+		for _, p := range pending {
+			b, err := readBackupMetadata(bd, p.name, p.folder)
+			if err != nil {
+				return err
+			}
+			result[p.index] = b
+		}
+		return nil
+	}
+	workers := connector.DedicatedConcurrency()
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	queue := make(chan pendingMetadata, len(pending))
+	for _, p := range pending {
+		queue <- p
+	}
+	close(queue)
+	g := errgroup.Group{}
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			var rs metadataReader = bd
+			if conn, err := connector.DedicatedConnection(); err != nil {
+				apexLog.Warnf("can't open dedicated %s connection, pooled connection is used: %v", bd.Kind(), err)
+			} else {
+				rs = conn
+				defer func() {
+					if err := conn.Close(); err != nil {
+						apexLog.Warnf("can't close dedicated %s connection: %v", bd.Kind(), err)
+					}
+				}()
+			}
+			for p := range queue {
+				b, err := readBackupMetadata(rs, p.name, p.folder)
+				if err != nil {
+					return err
+				}
+				result[p.index] = b
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// readBackupMetadata - backup from metadata.json in folder, backup is broken when metadata.json can't be read or parsed
+func readBackupMetadata(rs metadataReader, backupName string, folder RemoteFile) (Backup, error) {
+	brokenBackup := func(reason string) Backup {
+		return Backup{
+			metadata.BackupMetadata{
+				BackupName: backupName,
+			},
+			false,
+			"",
+			reason,
+			folder.LastModified(), // folder
+		}
+	}
+	mf, err := rs.StatFile(path.Join(folder.Name(), "metadata.json"))
+	if err != nil {
+		return brokenBackup("broken (can't stat metadata.json)"), nil
+	}
+	r, err := rs.GetFileReader(path.Join(folder.Name(), "metadata.json"))
+	if err != nil {
+		return brokenBackup("broken (can't open metadata.json)"), nil
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		_ = r.Close()
+		return brokenBackup("broken (can't read metadata.json)"), nil
+	}
+	if err := r.Close(); err != nil {
+		return Backup{}, err
+	}
+	var m metadata.BackupMetadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return brokenBackup("broken (bad metadata.json)"), nil
+	}
+	return Backup{
+		m, false, "", "", mf.LastModified(),
+	}, nil
+}
+
+// BackupList - list all backups, metadata.json is parsed only for parseMetadataOnly backup when it isn't empty, other backups are taken from cache
 func (bd *BackupDestination) BackupList(parseMetadata bool, parseMetadataOnly string) ([]Backup, error) {
+	return bd.BackupListByPrefix("", parseMetadata, parseMetadataOnly)
+}
+
+// BackupListByPrefix - list backups which names start with namePrefix, other backups are skipped during Walk and their metadata.json is never read, empty namePrefix lists all backups
+func (bd *BackupDestination) BackupListByPrefix(namePrefix string, parseMetadata bool, parseMetadataOnly string) ([]Backup, error) {
 	result := make([]Backup, 0)
 	metadataCacheLock.Lock()
 	defer metadataCacheLock.Unlock()
 	listCache := bd.loadMetadataCache()
+	var pending []pendingMetadata
 	err := bd.Walk("/", false, func(o RemoteFile) error {
+		if isSharedPartsPath(o.Name()) {
+			return nil
+		}
 		// Legacy backup
 		if ok, backupName, fileExtension := isLegacyBackup(strings.TrimPrefix(o.Name(), "/")); ok {
+			if !strings.HasPrefix(backupName, namePrefix) {
+				return nil
+			}
 			result = append(result, Backup{
 				metadata.BackupMetadata{
 					BackupName: backupName,
@@ -185,15 +428,20 @@ func (bd *BackupDestination) BackupList(parseMetadata bool, parseMetadataOnly st
 			return nil
 		}
 		backupName := strings.Trim(o.Name(), "/")
+		if !strings.HasPrefix(backupName, namePrefix) {
+			return nil
+		}
 		if !parseMetadata || (parseMetadataOnly != "" && parseMetadataOnly != backupName) {
 			if cachedMetadata, isCached := listCache[backupName]; isCached {
 				result = append(result, cachedMetadata)
 			} else {
+				// creation date is unknown without metadata.json, folder date is used for sorting
 				result = append(result, Backup{
 					BackupMetadata: metadata.BackupMetadata{
 						BackupName: backupName,
 					},
-					Legacy: false,
+					Legacy:     false,
+					UploadDate: o.LastModified(),
 				})
 			}
 			return nil
@@ -202,83 +450,27 @@ func (bd *BackupDestination) BackupList(parseMetadata bool, parseMetadataOnly st
 			result = append(result, cachedMetadata)
 			return nil
 		}
-		mf, err := bd.StatFile(path.Join(o.Name(), "metadata.json"))
-		if err != nil {
-			brokenBackup := Backup{
-				metadata.BackupMetadata{
-					BackupName: backupName,
-				},
-				false,
-				"",
-				"broken (can't stat metadata.json)",
-				o.LastModified(), // folder
-			}
-			listCache[backupName] = brokenBackup
-			result = append(result, brokenBackup)
-			return nil
-		}
-		r, err := bd.GetFileReader(path.Join(o.Name(), "metadata.json"))
-		if err != nil {
-			brokenBackup := Backup{
-				metadata.BackupMetadata{
-					BackupName: backupName,
-				},
-				false,
-				"",
-				"broken (can't open metadata.json)",
-				o.LastModified(), // folder
-			}
-			listCache[backupName] = brokenBackup
-			result = append(result, brokenBackup)
-			return nil
-		}
-		b, err := ioutil.ReadAll(r)
-		if err != nil {
-			brokenBackup := Backup{
-				metadata.BackupMetadata{
-					BackupName: backupName,
-				},
-				false,
-				"",
-				"broken (can't read metadata.json)",
-				o.LastModified(), // folder
-			}
-			listCache[backupName] = brokenBackup
-			result = append(result, brokenBackup)
-			return nil
-		}
-		if err := r.Close(); err != nil { // Never use defer in loops
-			return err
-		}
-		var m metadata.BackupMetadata
-		if err := json.Unmarshal(b, &m); err != nil {
-			brokenBackup := Backup{
-				metadata.BackupMetadata{
-					BackupName: backupName,
-				},
-				false,
-				"",
-				"broken (bad metadata.json)",
-				o.LastModified(), // folder
-			}
-			listCache[backupName] = brokenBackup
-			result = append(result, brokenBackup)
-			return nil
-		}
-		goodBackup := Backup{
-			m, false, "", "", mf.LastModified(),
-		}
-		listCache[backupName] = goodBackup
-		result = append(result, goodBackup)
+		// metadata.json is read after Walk, the slot keeps order of backups in result
+		pending = append(pending, pendingMetadata{index: len(result), name: backupName, folder: o})
+		result = append(result, Backup{})
 		return nil
 	})
+	if readErr := bd.readPendingMetadata(pending, result); readErr != nil && err == nil {
+		err = readErr
+	}
+	for _, p := range pending {
+		// slot is empty when reading was interrupted by error
+		if result[p.index].BackupName != "" {
+			listCache[p.name] = result[p.index]
+		}
+	}
 	if err != nil {
 		apexLog.Warnf("BackupList bd.Walk return error: %v", err)
 	}
 	sort.SliceStable(result, func(i, j int) bool {
-		return result[i].UploadDate.Before(result[j].UploadDate)
+		return result[i].GetDate().Before(result[j].GetDate())
 	})
-	bd.saveMetadataCache(listCache, result)
+	bd.saveMetadataCache(listCache, result, namePrefix)
 	return result, err
 }
 
@@ -287,12 +479,16 @@ func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPa
 		return err
 	}
 	// get this first as GetFileReader blocks the ftp control channel
-	file, err := bd.StatFile(remotePath)
+	_, err := bd.StatFile(remotePath)
+	if errors.Is(err, ErrNotFound) {
+		// archive referenced by name only, for example from required backup, could be uploaded as parts
+		if remoteParts := bd.findArchiveParts(remotePath); len(remoteParts) > 0 {
+			return bd.CompressedStreamDownloadParts(remoteParts, localPath)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	filesize := file.Size()
-
 	reader, err := bd.GetFileReader(remotePath)
 	if err != nil {
 		return err
@@ -302,12 +498,14 @@ func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPa
 			apexLog.Warnf("can't close GetFileReader descriptor %v", reader)
 		}
 	}()
+	return bd.extractArchive(reader, remotePath, localPath)
+}
 
-	bar := progressbar.StartNewByteBar(!bd.disableProgressBar, filesize)
+// extractArchive - decompress archive from reader into localPath, remotePath is used to detect compression format
+func (bd *BackupDestination) extractArchive(reader io.Reader, remotePath string, localPath string) error {
 	buf := buffer.New(BufferSize)
-	defer bar.Finish()
 	bufReader := nio.NewReader(reader, buf)
-	proxyReader := bar.NewProxyReader(bufReader)
+	proxyReader := bd.progress.NewProxyReader(bufReader)
 	compressionFormat := bd.compressionFormat
 	if !strings.HasSuffix(path.Ext(remotePath), compressionFormat) {
 		apexLog.Warnf("remote file backup extension %s not equal with %s", remotePath, compressionFormat)
@@ -355,31 +553,135 @@ func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPa
 		if err := file.Close(); err != nil {
 			return err
 		}
+		if err := bd.restoreFileHeader(extractFile, header); err != nil {
+			return err
+		}
 		//apexLog.Debugf("extract %s", extractFile)
 	}
 	return nil
 }
 
+// restoreFileHeader - set permissions from tar header after file is written, so read-only files are extracted too,
+// uid and gid are set only when preserve_file_ownership is enabled and process runs as root, archives without mode keep default permissions
+func (bd *BackupDestination) restoreFileHeader(extractFile string, header *tar.Header) error {
+	if mode := header.FileInfo().Mode().Perm(); mode != 0 {
+		if err := os.Chmod(extractFile, mode); err != nil {
+			return fmt.Errorf("can't restore mode of %s: %v", extractFile, err)
+		}
+	}
+	if bd.preserveOwnership && os.Geteuid() == 0 {
+		if err := os.Chown(extractFile, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("can't restore ownership of %s: %v", extractFile, err)
+		}
+	}
+	return nil
+}
+
 func (bd *BackupDestination) CompressedStreamUpload(baseLocalPath string, files []string, remotePath string) error {
 	if _, err := bd.StatFile(remotePath); err != nil {
 		if err != ErrNotFound && !os.IsNotExist(err) {
 			return err
 		}
 	}
+	return retryUpload(func() error {
+		uploadedBytes, md5sum, err := bd.compressedStreamUpload(baseLocalPath, files, remotePath)
+		if err == nil && (bd.verifyUpload || md5sum != nil) {
+			err = bd.verifyUploaded(remotePath, uploadedBytes, md5sum)
+		}
+		return err
+	})
+}
+
+// localFilesSize - return total size of regular files
+func localFilesSize(baseLocalPath string, files []string) (int64, error) {
 	var totalBytes int64
 	for _, filename := range files {
 		finfo, err := os.Stat(path.Join(baseLocalPath, filename))
 		if err != nil {
-			return err
+			return 0, err
 		}
 		if finfo.Mode().IsRegular() {
 			totalBytes += finfo.Size()
 		}
 	}
-	bar := progressbar.StartNewByteBar(!bd.disableProgressBar, totalBytes)
-	defer bar.Finish()
+	return totalBytes, nil
+}
+
+var errUploadVerification = errors.New("can't verify upload")
+
+// retryUpload - repeat upload up to VerifyUploadAttempts times when verify_upload check fails or remote storage returns ErrTransient
+func retryUpload(upload func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := upload()
+		if err == nil {
+			return nil
+		}
+		if (!errors.Is(err, errUploadVerification) && !IsRetriable(err)) || attempt >= VerifyUploadAttempts {
+			return err
+		}
+		apexLog.Warnf("%v, retry upload %d/%d", err, attempt, VerifyUploadAttempts)
+	}
+}
+
+// etagVerifier - remote storage which returns MD5 of content as ETag of objects uploaded by one request
+type etagVerifier interface {
+	VerifyETag() bool
+}
+
+// etagFile - RemoteFile with ETag, ETag of multipart upload isn't MD5 of content and contains `-`
+type etagFile interface {
+	ETag() string
+}
+
+// verifyUploaded - check size of uploaded object, some object storages could accept PUT and store truncated object,
+// ETag is compared with md5sum of uploaded bytes when md5sum is not nil and ETag of object is MD5 of its content
+func (bd *BackupDestination) verifyUploaded(remotePath string, uploadedBytes int64, md5sum []byte) error {
+	remoteFile, err := bd.StatFile(remotePath)
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", errUploadVerification, remotePath, err)
+	}
+	if remoteFile.Size() != uploadedBytes {
+		return fmt.Errorf("%w %s: remote size %d != uploaded size %d", errUploadVerification, remotePath, remoteFile.Size(), uploadedBytes)
+	}
+	f, hasETag := remoteFile.(etagFile)
+	if md5sum == nil || !hasETag {
+		return nil
+	}
+	if etag := f.ETag(); etag == "" || strings.Contains(etag, "-") {
+		apexLog.Debugf("%s is uploaded by multipart upload, ETag %s is not compared", remotePath, etag)
+	} else if etag != hex.EncodeToString(md5sum) {
+		return fmt.Errorf("%w %s: remote ETag %s != MD5 of uploaded bytes %s", errUploadVerification, remotePath, etag, hex.EncodeToString(md5sum))
+	}
+	return nil
+}
+
+// countingReadCloser - count bytes read through ReadCloser, they are written into hash when it is not nil and counted as transferred by progress tracker when it is not nil
+type countingReadCloser struct {
+	io.ReadCloser
+	count    int64
+	hash     hash.Hash
+	progress *progressbar.Tracker
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count += int64(n)
+	c.progress.AddTransferred(int64(n))
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// compressedStreamUpload - compress files on the fly and return count of bytes which was passed to PutFile,
+// MD5 of these bytes is returned when remote storage verifies ETag, otherwise it is nil
+func (bd *BackupDestination) compressedStreamUpload(baseLocalPath string, files []string, remotePath string) (int64, []byte, error) {
 	pipeBuffer := buffer.New(BufferSize)
-	body, w := nio.Pipe(pipeBuffer)
+	pipeReader, w := nio.Pipe(pipeBuffer)
+	body := &countingReadCloser{ReadCloser: pipeReader, progress: bd.progress}
+	if verifier, ok := bd.RemoteStorage.(etagVerifier); ok && verifier.VerifyETag() {
+		body.hash = md5.New()
+	}
 	g, _ := errgroup.WithContext(context.Background())
 
 	g.Go(func() error {
@@ -388,74 +690,85 @@ func (bd *BackupDestination) CompressedStreamUpload(baseLocalPath string, files
 				apexLog.Warnf("can't close nio.Pipe writer %v", w)
 			}
 		}()
-		localFileBuffer := buffer.New(BufferSize)
-		z, err := getArchiveWriter(bd.compressionFormat, bd.compressionLevel)
-		if err != nil {
-			return err
-		}
-		if err := z.Create(w); err != nil {
-			return err
-		}
-		defer func() {
-			if err := z.Close(); err != nil {
-				apexLog.Warnf("can't close getArchiveWriter %v: %v", z, err)
-			}
-		}()
-		for _, f := range files {
-			filePath := path.Join(baseLocalPath, f)
-			info, err := os.Stat(filePath)
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
-				continue
-			}
-			bar.Add64(info.Size())
-			file, err := os.Open(filePath)
-			if err != nil {
-				return err
-			}
-			bfile := nio.NewReader(file, localFileBuffer)
-			if err := z.Write(archiver.File{
-				FileInfo: archiver.FileInfo{
-					FileInfo:   info,
-					CustomName: f,
-				},
-				ReadCloser: bfile,
-			}); err != nil {
-				return err
-			}
-			if err := bfile.Close(); err != nil { // No use defer for this
-				return err
-			}
-			if err := file.Close(); err != nil { // No use defer for this too
-				return err
-			}
-			//apexLog.Debugf("compress %s to %s", filePath, remotePath)
-		}
-		return nil
+		return bd.writeArchive(w, baseLocalPath, files)
 	})
 	g.Go(func() error {
 		return bd.PutFile(remotePath, body)
 	})
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return 0, nil, err
+	}
+	if body.hash == nil {
+		return body.count, nil, nil
+	}
+	return body.count, body.hash.Sum(nil), nil
 }
 
-func (bd *BackupDestination) DownloadPath(size int64, remotePath string, localPath string) error {
-	var bar *progressbar.Bar
-	if !bd.disableProgressBar {
-		totalBytes := size
-		if size == 0 {
-			if err := bd.Walk(remotePath, true, func(f RemoteFile) error {
-				totalBytes += f.Size()
-				return nil
-			}); err != nil {
-				return err
+// writeArchive - compress files from baseLocalPath into w
+func (bd *BackupDestination) writeArchive(w io.Writer, baseLocalPath string, files []string) (err error) {
+	localFileBuffer := buffer.New(BufferSize)
+	z, err := getArchiveWriter(bd.compressionFormat, bd.compressionLevel)
+	if err != nil {
+		return err
+	}
+	if err := z.Create(w); err != nil {
+		return err
+	}
+	// close flushes the end of compressed stream, archive without it is truncated
+	defer func() {
+		if closeErr := z.Close(); closeErr != nil {
+			if err == nil {
+				err = fmt.Errorf("can't close archive: %v", closeErr)
+			} else {
+				apexLog.Warnf("can't close getArchiveWriter %v: %v", z, closeErr)
 			}
 		}
-		bar = progressbar.StartNewByteBar(!bd.disableProgressBar, totalBytes)
-		defer bar.Finish()
+	}()
+	for _, f := range files {
+		filePath := path.Join(baseLocalPath, f)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		bfile := nio.NewReader(file, localFileBuffer)
+		if err := z.Write(archiver.File{
+			FileInfo: archiver.FileInfo{
+				FileInfo:   info,
+				CustomName: f,
+			},
+			ReadCloser: bd.newProgressReadCloser(bfile),
+		}); err != nil {
+			return err
+		}
+		if err := bfile.Close(); err != nil { // No use defer for this
+			return err
+		}
+		if err := file.Close(); err != nil { // No use defer for this too
+			return err
+		}
+		//apexLog.Debugf("compress %s to %s", filePath, remotePath)
 	}
+	return nil
+}
+
+// progressReadCloser - count bytes read through ReadCloser in progress tracker
+type progressReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (bd *BackupDestination) newProgressReadCloser(r io.ReadCloser) io.ReadCloser {
+	return progressReadCloser{Reader: bd.progress.NewProxyReader(r), Closer: r}
+}
+
+func (bd *BackupDestination) DownloadPath(remotePath string, localPath string) error {
 	log := apexLog.WithFields(apexLog.Fields{
 		"path":      remotePath,
 		"operation": "download",
@@ -478,7 +791,7 @@ func (bd *BackupDestination) DownloadPath(size int64, remotePath string, localPa
 			log.Error(err.Error())
 			return err
 		}
-		if _, err := io.CopyBuffer(dst, r, nil); err != nil {
+		if _, err := io.CopyBuffer(dst, bd.progress.NewProxyReader(r), nil); err != nil {
 			log.Error(err.Error())
 			return err
 		}
@@ -490,47 +803,19 @@ func (bd *BackupDestination) DownloadPath(size int64, remotePath string, localPa
 			log.Error(err.Error())
 			return err
 		}
-		if !bd.disableProgressBar {
-			bar.Add64(f.Size())
-		}
 		return nil
 	})
 }
 
-func (bd *BackupDestination) UploadPath(size int64, baseLocalPath string, files []string, remotePath string) error {
-	var bar *progressbar.Bar
-	if !bd.disableProgressBar {
-		totalBytes := size
-		if size == 0 {
-			for _, filename := range files {
-				finfo, err := os.Stat(path.Join(baseLocalPath, filename))
-				if err != nil {
-					return err
-				}
-				if finfo.Mode().IsRegular() {
-					totalBytes += finfo.Size()
-				}
-			}
-		}
-		bar = progressbar.StartNewByteBar(!bd.disableProgressBar, totalBytes)
-		defer bar.Finish()
-	}
-
+func (bd *BackupDestination) UploadPath(baseLocalPath string, files []string, remotePath string) error {
 	for _, filename := range files {
 		f, err := os.Open(path.Join(baseLocalPath, filename))
 		if err != nil {
 			return err
 		}
-		if err := bd.PutFile(path.Join(remotePath, filename), f); err != nil {
+		if err := bd.PutFile(path.Join(remotePath, filename), bd.newProgressReadCloser(f)); err != nil {
 			return err
 		}
-		fi, err := f.Stat()
-		if err != nil {
-			return err
-		}
-		if !bd.disableProgressBar {
-			bar.Add64(fi.Size())
-		}
 		if err = f.Close(); err != nil {
 			apexLog.Warnf("can't close UploadPath file descriptor %v: %v", f, err)
 		}
@@ -540,87 +825,25 @@ func (bd *BackupDestination) UploadPath(size int64, baseLocalPath string, files
 }
 
 func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
-	switch cfg.General.RemoteStorage {
-	case "azblob":
-		azblobStorage := &AzureBlob{Config: &cfg.AzureBlob}
-		bufferSize := azblobStorage.Config.BufferSize
-		// https://github.com/AlexAkulov/clickhouse-backup/issues/317
-		if bufferSize <= 0 {
-			bufferSize = int(cfg.General.MaxFileSize / 10000)
-			if bufferSize < 2*1024*1024 {
-				bufferSize = 2 * 1024 * 1024
-			}
-			if bufferSize > 10*1024*1024 {
-				bufferSize = 10 * 1024 * 1024
-			}
-		}
-		azblobStorage.Config.BufferSize = bufferSize
-		return &BackupDestination{
-			azblobStorage,
-			cfg.AzureBlob.CompressionFormat,
-			cfg.AzureBlob.CompressionLevel,
-			cfg.General.DisableProgressBar,
-		}, nil
-	case "s3":
-		partSize := cfg.S3.PartSize
-		if cfg.S3.PartSize <= 0 {
-			partSize = cfg.General.MaxFileSize / 10000
-			if partSize < 5*1024*1024 {
-				partSize = 5 * 1024 * 1024
-			}
-			if partSize > 5*1024*1024*1024 {
-				partSize = 5 * 1024 * 1024 * 1024
-			}
-		}
-		s3Storage := &S3{
-			Config:      &cfg.S3,
-			Concurrency: cfg.S3.Concurrency,
-			BufferSize:  1024 * 1024,
-			PartSize:    partSize,
-		}
-		return &BackupDestination{
-			s3Storage,
-			cfg.S3.CompressionFormat,
-			cfg.S3.CompressionLevel,
-			cfg.General.DisableProgressBar,
-		}, nil
-	case "gcs":
-		googleCloudStorage := &GCS{Config: &cfg.GCS}
-		return &BackupDestination{
-			googleCloudStorage,
-			cfg.GCS.CompressionFormat,
-			cfg.GCS.CompressionLevel,
-			cfg.General.DisableProgressBar,
-		}, nil
-	case "cos":
-		tencentStorage := &COS{Config: &cfg.COS}
-		return &BackupDestination{
-			tencentStorage,
-			cfg.COS.CompressionFormat,
-			cfg.COS.CompressionLevel,
-			cfg.General.DisableProgressBar,
-		}, nil
-	case "ftp":
-		ftpStorage := &FTP{
-			Config: &cfg.FTP,
-		}
-		return &BackupDestination{
-			ftpStorage,
-			cfg.FTP.CompressionFormat,
-			cfg.FTP.CompressionLevel,
-			cfg.General.DisableProgressBar,
-		}, nil
-	case "sftp":
-		sftpStorage := &SFTP{
-			Config: &cfg.SFTP,
-		}
-		return &BackupDestination{
-			sftpStorage,
-			cfg.SFTP.CompressionFormat,
-			cfg.SFTP.CompressionLevel,
-			cfg.General.DisableProgressBar,
-		}, nil
-	default:
+	backend, ok := getBackend(cfg.General.RemoteStorage)
+	if !ok {
 		return nil, fmt.Errorf("storage type '%s' is not supported", cfg.General.RemoteStorage)
 	}
+	remoteStorage, err := backend.constructor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	compressionFormat, compressionLevel := backend.compression(cfg)
+	return &BackupDestination{
+		remoteStorage,
+		compressionFormat,
+		compressionLevel,
+		cfg.General.DisableProgressBar,
+		cfg.General.VerifyUpload,
+		cfg.General.MaxArchiveSize,
+		nil,
+		int(cfg.General.DeleteConcurrency),
+		cfg.General.BackupManifest,
+		cfg.General.PreserveFileOwnership,
+	}, nil
 }
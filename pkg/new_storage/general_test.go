@@ -0,0 +1,360 @@
+package new_storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockFile struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+func (f *mockFile) Size() int64             { return f.size }
+func (f *mockFile) Name() string            { return f.name }
+func (f *mockFile) LastModified() time.Time { return f.modified }
+
+// mockStorage - store files in memory, first truncateFirst uploads will lose last byte, first failFirst uploads will fail with putError,
+// modified keeps modification time of keys and first level folders, it is zero for absent keys, StatFile reports size smaller by underReport
+type mockStorage struct {
+	files         map[string][]byte
+	modified      map[string]time.Time
+	underReport   int64
+	putCalls      int
+	truncateFirst int
+	failFirst     int
+	putError      error
+	walkCalls     int
+	readKeys      []string
+	connectErr    error
+}
+
+func (m *mockStorage) Kind() string   { return "mock" }
+func (m *mockStorage) Connect() error { return m.connectErr }
+
+func (m *mockStorage) StatFile(key string) (RemoteFile, error) {
+	body, exists := m.files[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return &mockFile{name: key, size: int64(len(body)) - m.underReport, modified: m.modified[key]}, nil
+}
+
+func (m *mockStorage) DeleteFile(key string) error {
+	delete(m.files, key)
+	return nil
+}
+
+// Walk - recursive walk returns keys under prefix relative to it, non-recursive walk returns the first level of keys as directories
+func (m *mockStorage) Walk(prefix string, recursive bool, process func(RemoteFile) error) error {
+	m.walkCalls++
+	if recursive {
+		prefix = strings.TrimPrefix(prefix, "/")
+		for key, body := range m.files {
+			if strings.HasPrefix(key, prefix) {
+				if err := process(&mockFile{name: strings.TrimPrefix(key, prefix), size: int64(len(body)), modified: m.modified[key]}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	names := map[string]struct{}{}
+	for key := range m.files {
+		names[strings.SplitN(key, "/", 2)[0]] = struct{}{}
+	}
+	for name := range names {
+		if err := process(&mockFile{name: name, modified: m.modified[name]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockStorage) GetFileReader(key string) (io.ReadCloser, error) {
+	m.readKeys = append(m.readKeys, key)
+	body, exists := m.files[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (m *mockStorage) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.putCalls++
+	if m.putCalls <= m.failFirst {
+		return m.putError
+	}
+	if m.putCalls <= m.truncateFirst {
+		body = body[:len(body)-1]
+	}
+	m.files[key] = body
+	return nil
+}
+
+func TestCompressedStreamUploadVerify(t *testing.T) {
+	localPath := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(localPath, "data.bin"), []byte("some data"), 0644))
+	files := []string{"data.bin"}
+
+	storage := &mockStorage{files: map[string][]byte{}, truncateFirst: 1}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, verifyUpload: true, deleteConcurrency: 1}
+	assert.NoError(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+	assert.Equal(t, 2, storage.putCalls)
+
+	storage = &mockStorage{files: map[string][]byte{}, truncateFirst: VerifyUploadAttempts}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, verifyUpload: true, deleteConcurrency: 1}
+	assert.Error(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+	assert.Equal(t, VerifyUploadAttempts, storage.putCalls)
+
+	storage = &mockStorage{files: map[string][]byte{}, underReport: 1}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, verifyUpload: true, deleteConcurrency: 1}
+	err := bd.CompressedStreamUpload(localPath, files, "backup/part.tar")
+	assert.True(t, errors.Is(err, errUploadVerification))
+	assert.Contains(t, err.Error(), "remote size 2047 != uploaded size 2048")
+	assert.Equal(t, VerifyUploadAttempts, storage.putCalls)
+
+	storage = &mockStorage{files: map[string][]byte{}, truncateFirst: 1}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	assert.NoError(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+	assert.Equal(t, 1, storage.putCalls)
+}
+
+// etagStorage - mockStorage which returns MD5 of stored content as ETag, content is corrupted by first corruptFirst uploads
+type etagStorage struct {
+	*mockStorage
+	multipart    bool
+	corruptFirst int
+}
+
+type etagMockFile struct {
+	mockFile
+	etag string
+}
+
+func (f *etagMockFile) ETag() string { return f.etag }
+
+func (s *etagStorage) VerifyETag() bool { return true }
+
+func (s *etagStorage) PutFile(key string, r io.ReadCloser) error {
+	if err := s.mockStorage.PutFile(key, r); err != nil {
+		return err
+	}
+	if s.putCalls <= s.corruptFirst {
+		s.files[key][0]++
+	}
+	return nil
+}
+
+func (s *etagStorage) StatFile(key string) (RemoteFile, error) {
+	body, exists := s.files[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	sum := md5.Sum(body)
+	etag := hex.EncodeToString(sum[:])
+	if s.multipart {
+		etag = "0123abcd-2"
+	}
+	return &etagMockFile{mockFile{name: key, size: int64(len(body))}, etag}, nil
+}
+
+func TestCompressedStreamUploadVerifyETag(t *testing.T) {
+	localPath := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(localPath, "data.bin"), []byte("some data"), 0644))
+	files := []string{"data.bin"}
+
+	storage := &etagStorage{mockStorage: &mockStorage{files: map[string][]byte{}}, corruptFirst: 1}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	assert.NoError(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+	assert.Equal(t, 2, storage.putCalls, "upload with the same size and other content shall be retried")
+
+	storage = &etagStorage{mockStorage: &mockStorage{files: map[string][]byte{}}, corruptFirst: VerifyUploadAttempts}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	err := bd.CompressedStreamUpload(localPath, files, "backup/part.tar")
+	assert.True(t, errors.Is(err, errUploadVerification))
+	assert.Contains(t, err.Error(), "remote ETag")
+
+	storage = &etagStorage{mockStorage: &mockStorage{files: map[string][]byte{}}, corruptFirst: 1, multipart: true}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	assert.NoError(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+	assert.Equal(t, 1, storage.putCalls, "ETag of multipart upload is not compared")
+}
+
+func TestCompressedStreamUploadRetryTransient(t *testing.T) {
+	localPath := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(localPath, "data.bin"), []byte("some data"), 0644))
+	files := []string{"data.bin"}
+
+	storage := &mockStorage{files: map[string][]byte{}, failFirst: 1, putError: storageError(ErrTransient, fmt.Errorf("503 SlowDown"))}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	assert.NoError(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+	assert.Equal(t, 2, storage.putCalls)
+
+	storage = &mockStorage{files: map[string][]byte{}, failFirst: 1, putError: storageError(ErrUnauthorized, fmt.Errorf("403 AccessDenied"))}
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	err := bd.CompressedStreamUpload(localPath, files, "backup/part.tar")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.Equal(t, 1, storage.putCalls)
+}
+
+func TestCompressedStreamPreservesFileHeader(t *testing.T) {
+	localPath := t.TempDir()
+	modes := map[string]os.FileMode{"data.bin": 0640, "checksums.txt": 0600, "columns.txt": 0444, "sub/count.txt": 0755}
+	var files []string
+	for name, mode := range modes {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(localPath, name)), 0750))
+		assert.NoError(t, ioutil.WriteFile(path.Join(localPath, name), []byte(name), 0600))
+		assert.NoError(t, os.Chmod(path.Join(localPath, name), mode))
+		files = append(files, name)
+	}
+	isRoot := os.Geteuid() == 0
+	if isRoot {
+		assert.NoError(t, os.Chown(path.Join(localPath, "data.bin"), 1234, 5678))
+	}
+	for _, preserveOwnership := range []bool{false, true} {
+		storage := &mockStorage{files: map[string][]byte{}}
+		bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1, preserveOwnership: preserveOwnership}
+		assert.NoError(t, bd.CompressedStreamUpload(localPath, files, "backup/part.tar"))
+		downloadPath := t.TempDir()
+		assert.NoError(t, bd.CompressedStreamDownload("backup/part.tar", downloadPath))
+		for name, mode := range modes {
+			info, err := os.Stat(path.Join(downloadPath, name))
+			assert.NoError(t, err)
+			assert.Equal(t, mode, info.Mode().Perm(), name)
+		}
+		if !isRoot {
+			continue
+		}
+		stat := func(name string) *syscall.Stat_t {
+			info, err := os.Stat(path.Join(downloadPath, name))
+			assert.NoError(t, err)
+			return info.Sys().(*syscall.Stat_t)
+		}
+		if preserveOwnership {
+			assert.Equal(t, []uint32{1234, 5678}, []uint32{stat("data.bin").Uid, stat("data.bin").Gid})
+		} else {
+			assert.Equal(t, []uint32{0, 0}, []uint32{stat("data.bin").Uid, stat("data.bin").Gid}, "ownership is restored only when enabled")
+		}
+	}
+}
+
+func TestPutBackupMetadataDropsCache(t *testing.T) {
+	backupName := fmt.Sprintf("put_metadata_%d", time.Now().UnixNano())
+	storage := &mockStorage{files: map[string][]byte{
+		path.Join(backupName, "metadata.json"): []byte(`{"backup_name":"` + backupName + `","required_backup":"old_full"}`),
+	}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	backupList, err := bd.BackupList(true, backupName)
+	assert.NoError(t, err)
+	assert.Len(t, backupList, 1)
+	assert.Equal(t, "old_full", backupList[0].RequiredBackup)
+
+	backupMetadata := backupList[0].BackupMetadata
+	backupMetadata.RequiredBackup = "new_full"
+	assert.NoError(t, bd.PutBackupMetadata(backupMetadata))
+	assert.Contains(t, string(storage.files[path.Join(backupName, "metadata.json")]), `"required_backup": "new_full"`)
+	backupList, err = bd.BackupList(true, backupName)
+	assert.NoError(t, err)
+	assert.Equal(t, "new_full", backupList[0].RequiredBackup, "cached metadata shall not be used after change")
+}
+
+func TestBackupListCreationDate(t *testing.T) {
+	prefix := fmt.Sprintf("creation_date_%d", time.Now().UnixNano())
+	migrated, recent, legacy := prefix+"_migrated", prefix+"_recent", prefix+"_legacy"
+	storage := &mockStorage{
+		files: map[string][]byte{
+			path.Join(migrated, "metadata.json"): []byte(`{"backup_name":"` + migrated + `","creation_date":"2022-03-01T00:00:00Z"}`),
+			path.Join(recent, "metadata.json"):   []byte(`{"backup_name":"` + recent + `","creation_date":"2022-03-05T00:00:00Z"}`),
+			legacy + ".tar":                      []byte("legacy"),
+		},
+		modified: map[string]time.Time{
+			// bucket migration rewrote objects of the oldest backup
+			path.Join(migrated, "metadata.json"): time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC),
+			path.Join(recent, "metadata.json"):   time.Date(2022, 3, 6, 0, 0, 0, 0, time.UTC),
+			migrated:                             time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC),
+			legacy + ".tar":                      time.Date(2022, 3, 3, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	backupList, err := bd.BackupList(true, "")
+	assert.NoError(t, err)
+	var names []string
+	for _, backup := range backupList {
+		names = append(names, backup.BackupName)
+	}
+	assert.Equal(t, []string{migrated, legacy, recent}, names)
+	assert.Equal(t, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), backupList[0].GetDate().UTC(), "creation date from metadata.json wins")
+	assert.Equal(t, time.Date(2022, 3, 3, 0, 0, 0, 0, time.UTC), backupList[1].GetDate().UTC(), "legacy backup uses object date")
+
+	// backup without parsed and cached metadata falls back to folder date
+	notParsed := prefix + "_not_parsed"
+	storage.files[path.Join(notParsed, "metadata.json")] = []byte(`{"backup_name":"` + notParsed + `"}`)
+	storage.modified[notParsed] = time.Date(2022, 3, 2, 0, 0, 0, 0, time.UTC)
+	backupList, err = bd.BackupList(false, "")
+	assert.NoError(t, err)
+	for _, backup := range backupList {
+		if backup.BackupName == notParsed {
+			assert.Equal(t, storage.modified[notParsed], backup.GetDate())
+		}
+	}
+}
+
+func TestBackupListByPrefix(t *testing.T) {
+	prefix := fmt.Sprintf("by_prefix_%d", time.Now().UnixNano())
+	dailyFirst, dailySecond, dailyLegacy, weekly := prefix+"_daily_1", prefix+"_daily_2", prefix+"_daily_legacy", prefix+"_weekly_1"
+	storage := &mockStorage{files: map[string][]byte{
+		dailyLegacy + ".tar": []byte("legacy"),
+	}}
+	for i, backupName := range []string{dailyFirst, dailySecond, weekly} {
+		storage.files[path.Join(backupName, "metadata.json")] = []byte(fmt.Sprintf(`{"backup_name":"%s","creation_date":"2022-03-0%dT00:00:00Z"}`, backupName, i+1))
+	}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	names := func(backupList []Backup) []string {
+		var result []string
+		for _, backup := range backupList {
+			if strings.HasPrefix(backup.BackupName, prefix) {
+				result = append(result, backup.BackupName)
+			}
+		}
+		return result
+	}
+
+	backupList, err := bd.BackupListByPrefix(prefix+"_daily_", true, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{dailyLegacy, dailyFirst, dailySecond}, names(backupList))
+	assert.ElementsMatch(t, []string{path.Join(dailyFirst, "metadata.json"), path.Join(dailySecond, "metadata.json")}, storage.readKeys, "metadata.json of not matched backups shall not be read")
+
+	storage.readKeys = nil
+	backupList, err = bd.BackupListByPrefix("", true, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{dailyLegacy, dailyFirst, dailySecond, weekly}, names(backupList), "empty prefix lists all backups")
+	assert.Equal(t, []string{path.Join(weekly, "metadata.json")}, storage.readKeys, "matched backups are cached")
+
+	// listing by prefix keeps cached metadata of other backups
+	_, err = bd.BackupListByPrefix(prefix+"_daily_", true, "")
+	assert.NoError(t, err)
+	assert.Contains(t, bd.loadMetadataCache(), weekly)
+	backupList, err = bd.BackupListByPrefix(prefix+"_monthly_", true, "")
+	assert.NoError(t, err)
+	assert.Empty(t, names(backupList))
+}
@@ -0,0 +1,122 @@
+package new_storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	apexLog "github.com/apex/log"
+)
+
+// ManifestFile - name of object in backup folder which lists all other objects of backup
+const ManifestFile = "manifest.json"
+
+// ManifestObject - object of backup, Key is relative to backup folder
+type ManifestObject struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// Manifest - objects of remote backup written by upload with `backup_manifest: true`, it is read instead of Walk over backup folder
+type Manifest struct {
+	Objects []ManifestObject `json:"objects"`
+	Size    int64            `json:"size"`
+}
+
+// PutManifest - list objects of uploaded backup once and save them into manifest, nothing is done when `backup_manifest` is disabled
+func (bd *BackupDestination) PutManifest(backupName string) error {
+	if !bd.backupManifest {
+		return nil
+	}
+	var manifest Manifest
+	if err := bd.Walk(backupName+"/", true, func(f RemoteFile) error {
+		if f.Name() != ManifestFile {
+			manifest.Objects = append(manifest.Objects, ManifestObject{Key: f.Name(), Size: f.Size()})
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("can't list objects of '%s' for manifest: %v", backupName, err)
+	}
+	return bd.saveManifest(backupName, manifest)
+}
+
+func (bd *BackupDestination) saveManifest(backupName string, manifest Manifest) error {
+	manifest.Size = 0
+	for _, object := range manifest.Objects {
+		manifest.Size += object.Size
+	}
+	body, err := json.Marshal(&manifest)
+	if err != nil {
+		return fmt.Errorf("can't marshal %s: %v", ManifestFile, err)
+	}
+	if err := bd.PutFile(path.Join(backupName, ManifestFile), ioutil.NopCloser(bytes.NewReader(body))); err != nil {
+		return fmt.Errorf("can't upload %s: %v", ManifestFile, err)
+	}
+	return nil
+}
+
+// getManifest - manifest of remote backup, nil when backup was uploaded without manifest
+func (bd *BackupDestination) getManifest(backupName string) (*Manifest, error) {
+	r, err := bd.GetFileReader(path.Join(backupName, ManifestFile))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", ManifestFile, err)
+	}
+	return &manifest, nil
+}
+
+// updateManifest - keep manifest in sync after object of backup was replaced, backups without manifest are not changed
+func (bd *BackupDestination) updateManifest(backupName string, object ManifestObject) error {
+	manifest, err := bd.getManifest(backupName)
+	if err != nil {
+		return fmt.Errorf("can't read manifest of '%s': %v", backupName, err)
+	}
+	if manifest == nil {
+		return nil
+	}
+	found := false
+	for i := range manifest.Objects {
+		if manifest.Objects[i].Key == object.Key {
+			manifest.Objects[i] = object
+			found = true
+		}
+	}
+	if !found {
+		manifest.Objects = append(manifest.Objects, object)
+	}
+	return bd.saveManifest(backupName, *manifest)
+}
+
+// backupObjects - objects of remote backup from manifest, backups without manifest or with broken manifest are listed by Walk,
+// true is returned when objects are read from manifest, manifest itself is not included in this case
+func (bd *BackupDestination) backupObjects(backupName string) ([]ManifestObject, bool, error) {
+	manifest, err := bd.getManifest(backupName)
+	if err != nil {
+		apexLog.WithField("backup", backupName).Warnf("can't read %s, list objects on remote storage: %v", ManifestFile, err)
+	}
+	if manifest != nil {
+		return manifest.Objects, true, nil
+	}
+	var objects []ManifestObject
+	if err := bd.Walk(backupName+"/", true, func(f RemoteFile) error {
+		objects = append(objects, ManifestObject{Key: f.Name(), Size: f.Size()})
+		return nil
+	}); err != nil {
+		return nil, false, err
+	}
+	return objects, false, nil
+}
@@ -0,0 +1,95 @@
+package new_storage
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupManifest(t *testing.T) {
+	newStorage := func() *mockStorage {
+		return &mockStorage{files: map[string][]byte{
+			"backup1/metadata.json":              []byte(`{"backup_name":"backup1"}`),
+			"backup1/metadata/db/t.json":         []byte(`{}`),
+			"backup1/shadow/db/t/default_0.tar":  []byte("data"),
+			"backup2/shadow/db/t/default_0.tar":  []byte("other data"),
+			"backup10/shadow/db/t/default_0.tar": []byte("prefix of backup1 shall not match"),
+		}}
+	}
+	sortedKeys := func(objects []ManifestObject) []string {
+		keys := make([]string, len(objects))
+		for i, object := range objects {
+			keys[i] = object.Key
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	expectedKeys := []string{"metadata.json", "metadata/db/t.json", "shadow/db/t/default_0.tar"}
+
+	t.Run("disabled", func(t *testing.T) {
+		storage := newStorage()
+		bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+		assert.NoError(t, bd.PutManifest("backup1"))
+		assert.NotContains(t, storage.files, "backup1/"+ManifestFile)
+	})
+
+	t.Run("list and delete by manifest", func(t *testing.T) {
+		storage := newStorage()
+		bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1, backupManifest: true}
+		assert.NoError(t, bd.PutManifest("backup1"))
+		manifest, err := bd.getManifest("backup1")
+		assert.NoError(t, err)
+		assert.Equal(t, expectedKeys, sortedKeys(manifest.Objects))
+		assert.Equal(t, int64(len(`{"backup_name":"backup1"}`)+len(`{}`)+len("data")), manifest.Size)
+
+		storage.walkCalls = 0
+		objects, fromManifest, err := bd.backupObjects("backup1")
+		assert.NoError(t, err)
+		assert.True(t, fromManifest)
+		assert.Equal(t, expectedKeys, sortedKeys(objects))
+		assert.Equal(t, 0, storage.walkCalls)
+
+		assert.NoError(t, bd.RemoveBackup(Backup{BackupMetadata: metadata.BackupMetadata{BackupName: "backup1"}}))
+		assert.Equal(t, 0, storage.walkCalls, "objects of backup with manifest are not listed")
+		assert.Len(t, storage.files, 2)
+		assert.Contains(t, storage.files, "backup2/shadow/db/t/default_0.tar")
+		assert.Contains(t, storage.files, "backup10/shadow/db/t/default_0.tar")
+	})
+
+	t.Run("manifest follows metadata.json", func(t *testing.T) {
+		storage := newStorage()
+		bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1, backupManifest: true}
+		assert.NoError(t, bd.PutManifest("backup1"))
+		assert.NoError(t, bd.PutBackupMetadata(metadata.BackupMetadata{BackupName: "backup1", Tags: "weekly"}))
+		manifest, err := bd.getManifest("backup1")
+		assert.NoError(t, err)
+		assert.Equal(t, expectedKeys, sortedKeys(manifest.Objects))
+		for _, object := range manifest.Objects {
+			assert.Equal(t, int64(len(storage.files["backup1/"+object.Key])), object.Size, object.Key)
+		}
+
+		assert.NoError(t, bd.PutBackupMetadata(metadata.BackupMetadata{BackupName: "backup2"}))
+		assert.NotContains(t, storage.files, "backup2/"+ManifestFile, "manifest is not created for backup without it")
+	})
+
+	t.Run("walk fallback", func(t *testing.T) {
+		for name, manifest := range map[string][]byte{"absent": nil, "broken": []byte("{")} {
+			storage := newStorage()
+			if manifest != nil {
+				storage.files["backup1/"+ManifestFile] = manifest
+			}
+			bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1, backupManifest: true}
+			objects, fromManifest, err := bd.backupObjects("backup1")
+			assert.NoError(t, err, name)
+			assert.False(t, fromManifest, name)
+			assert.Equal(t, 1, storage.walkCalls, name)
+			assert.NoError(t, bd.RemoveBackup(Backup{BackupMetadata: metadata.BackupMetadata{BackupName: "backup1"}}), name)
+			assert.Len(t, storage.files, 2, name)
+			if manifest == nil {
+				assert.Equal(t, expectedKeys, sortedKeys(objects), name)
+			}
+		}
+	})
+}
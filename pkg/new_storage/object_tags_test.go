@@ -0,0 +1,68 @@
+package new_storage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+var autoTags = map[string]string{
+	"created-by":  "clickhouse-backup",
+	"backup-name": "backup1",
+	"backup-type": "incremental",
+}
+
+func TestS3ObjectTags(t *testing.T) {
+	s := &S3{Config: &config.S3Config{
+		Bucket:       "bucket",
+		StorageClass: "STANDARD",
+		ObjectTags:   map[string]string{"ttl-days": "30", "backup-type": "weekly"},
+	}}
+	input := s.newUploadInput("backup1/metadata.json", ioutil.NopCloser(strings.NewReader("")))
+	assert.Nil(t, input.Tagging)
+
+	s.SetObjectTags(autoTags)
+	input = s.newUploadInput("backup1/metadata.json", ioutil.NopCloser(strings.NewReader("")))
+	assert.NotNil(t, input.Tagging)
+	tags, err := url.ParseQuery(*input.Tagging)
+	assert.NoError(t, err)
+	assert.Equal(t, "clickhouse-backup", tags.Get("created-by"))
+	assert.Equal(t, "backup1", tags.Get("backup-name"))
+	assert.Equal(t, "weekly", tags.Get("backup-type"))
+	assert.Equal(t, "30", tags.Get("ttl-days"))
+}
+
+func TestGCSObjectTags(t *testing.T) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithoutAuthentication())
+	assert.NoError(t, err)
+	gcs := &GCS{client: client, Config: &config.GCSConfig{
+		Bucket:     "bucket",
+		ObjectTags: map[string]string{"ttl-days": "30"},
+	}}
+	gcs.SetObjectTags(autoTags)
+	writer := gcs.newObjectWriter(ctx, "backup1/metadata.json")
+	assert.Equal(t, map[string]string{
+		"created-by":  "clickhouse-backup",
+		"backup-name": "backup1",
+		"backup-type": "incremental",
+		"ttl-days":    "30",
+	}, writer.Metadata)
+}
+
+func TestBackupDestinationSetObjectTags(t *testing.T) {
+	// storage without tags support shall be ignored
+	bd := &BackupDestination{RemoteStorage: &mockStorage{files: map[string][]byte{}}, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	bd.SetObjectTags(autoTags)
+	s := &S3{Config: &config.S3Config{}}
+	bd = &BackupDestination{RemoteStorage: s, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	bd.SetObjectTags(autoTags)
+	assert.Equal(t, autoTags, s.objectTags)
+}
@@ -0,0 +1,180 @@
+package new_storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apexLog "github.com/apex/log"
+)
+
+// OrphanObject - remote object which doesn't belong to any backup, Key is relative to remote storage path
+type OrphanObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// RetainedObjects - objects under Prefix which could be orphans, but are kept because of Reason
+type RetainedObjects struct {
+	Prefix string
+	Reason string
+	Count  int
+	Size   int64
+}
+
+// Orphans - result of FindOrphans
+type Orphans struct {
+	Objects  []OrphanObject
+	Size     int64
+	Retained []RetainedObjects
+}
+
+// orphansFinder - classify objects of remote storage by backups which are listed before Walk
+type orphansFinder struct {
+	backups map[string]Backup
+	// manifests - objects of backups with manifest, nil for backups without manifest
+	manifests map[string]map[string]bool
+	// sharedParts - shared part archives which are referenced by backups, nil when they can't be checked because of broken backups
+	sharedParts map[string]bool
+	brokenNames []string
+	retained    map[string]*RetainedObjects
+}
+
+// backupLayout - names in backup folder which are written by upload and flatten, they are used when backup has no manifest
+var backupLayout = []string{"metadata.json", ManifestFile, "metadata/", "shadow/", "detached/", "access.", "configs."}
+
+// FindOrphans - objects which don't belong to any backup: objects of backups with manifest which are absent in manifest and shared part archives
+// which aren't referenced by any backup, objects of backups without manifest belong to backup when their names match layout of backup.
+// Anything ambiguous is retained: objects of broken backups, which could be uploaded right now, all shared parts when there is broken backup,
+// unknown objects of backups without manifest, objects which appeared after backup list and objects modified later than minAge ago
+func (bd *BackupDestination) FindOrphans(minAge time.Duration, now time.Time) (Orphans, error) {
+	var result Orphans
+	if bd.Kind() == "SFTP" || bd.Kind() == "FTP" {
+		return result, fmt.Errorf("search of orphaned objects is not supported by %s remote storage", bd.Kind())
+	}
+	backupList, err := bd.BackupList(true, "")
+	if err != nil {
+		return result, fmt.Errorf("can't get backup list: %v", err)
+	}
+	f := &orphansFinder{
+		backups:     map[string]Backup{},
+		manifests:   map[string]map[string]bool{},
+		sharedParts: map[string]bool{},
+		retained:    map[string]*RetainedObjects{},
+	}
+	for _, backup := range backupList {
+		f.backups[backup.BackupName] = backup
+		if backup.Broken != "" {
+			f.brokenNames = append(f.brokenNames, backup.BackupName)
+			continue
+		}
+		for _, key := range backup.SharedParts {
+			f.sharedParts[key] = true
+		}
+		if backup.Legacy {
+			continue
+		}
+		manifest, err := bd.getManifest(backup.BackupName)
+		if err != nil {
+			apexLog.WithField("backup", backup.BackupName).Warnf("can't read %s, objects are checked by layout of backup: %v", ManifestFile, err)
+		}
+		if manifest != nil {
+			objects := map[string]bool{ManifestFile: true, "metadata.json": true}
+			for _, object := range manifest.Objects {
+				objects[strings.Trim(object.Key, "/")] = true
+			}
+			f.manifests[backup.BackupName] = objects
+		}
+	}
+	if len(f.brokenNames) > 0 {
+		f.sharedParts = nil
+	}
+	err = bd.Walk("/", true, func(o RemoteFile) error {
+		key := strings.Trim(o.Name(), "/")
+		if key == "" {
+			return nil
+		}
+		if isOrphan := f.classify(key, o.Size()); !isOrphan {
+			return nil
+		}
+		if minAge > 0 && now.Sub(o.LastModified()) < minAge {
+			f.retain(strings.SplitN(key, "/", 2)[0]+"/", fmt.Sprintf("modified later than %s ago", minAge), o.Size())
+			return nil
+		}
+		result.Objects = append(result.Objects, OrphanObject{Key: key, Size: o.Size(), LastModified: o.LastModified()})
+		result.Size += o.Size()
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("can't list objects on remote storage: %v", err)
+	}
+	sort.Slice(result.Objects, func(i, j int) bool {
+		return result.Objects[i].Key < result.Objects[j].Key
+	})
+	for _, retained := range f.retained {
+		result.Retained = append(result.Retained, *retained)
+	}
+	sort.Slice(result.Retained, func(i, j int) bool {
+		return result.Retained[i].Prefix < result.Retained[j].Prefix
+	})
+	return result, nil
+}
+
+// classify - return true when key doesn't belong to any backup, ambiguous keys are retained
+func (f *orphansFinder) classify(key string, size int64) bool {
+	top, rel := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		top, rel = key[:i], key[i+1:]
+	}
+	if top == SharedPartsPath {
+		if f.sharedParts == nil {
+			f.retain(SharedPartsPath+"/", fmt.Sprintf("broken backups could reference shared parts: %s", strings.Join(f.brokenNames, ", ")), size)
+			return false
+		}
+		return !f.sharedParts[key]
+	}
+	if isLegacy, backupName, _ := isLegacyBackup(key); isLegacy && rel == "" {
+		if backup, exists := f.backups[backupName]; exists && backup.Legacy {
+			return false
+		}
+	}
+	backup, exists := f.backups[top]
+	if !exists {
+		f.retain(top+"/", "not listed as backup, it could be uploaded right now", size)
+		return false
+	}
+	if backup.Broken != "" {
+		f.retain(top+"/", fmt.Sprintf("backup is %s, it could be uploaded right now, use `delete remote` when it is abandoned", backup.Broken), size)
+		return false
+	}
+	if objects, hasManifest := f.manifests[top]; hasManifest {
+		return !objects[rel]
+	}
+	for _, name := range backupLayout {
+		if rel == name || (strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".")) && strings.HasPrefix(rel, name) {
+			return false
+		}
+	}
+	f.retain(top+"/", fmt.Sprintf("unknown objects of backup without %s", ManifestFile), size)
+	return false
+}
+
+func (f *orphansFinder) retain(prefix, reason string, size int64) {
+	id := prefix + "\n" + reason
+	if f.retained[id] == nil {
+		f.retained[id] = &RetainedObjects{Prefix: prefix, Reason: reason}
+	}
+	f.retained[id].Count++
+	f.retained[id].Size += size
+}
+
+// DeleteOrphans - delete objects found by FindOrphans
+func (bd *BackupDestination) DeleteOrphans(orphans Orphans) error {
+	keys := make([]string, len(orphans.Objects))
+	for i, object := range orphans.Objects {
+		keys[i] = object.Key
+	}
+	return bd.deleteKeys(keys)
+}
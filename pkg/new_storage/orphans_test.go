@@ -0,0 +1,70 @@
+package new_storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOrphans(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	now := time.Now()
+	newStorage := func() *mockStorage {
+		return &mockStorage{
+			files: map[string][]byte{
+				"full/metadata.json":                      []byte(`{"backup_name":"full"}`),
+				"full/" + ManifestFile:                    []byte(`{"objects":[{"key":"/metadata/db/t.json"},{"key":"/shadow/db/t/default_0.tar"}]}`),
+				"full/metadata/db/t.json":                 []byte(`{}`),
+				"full/shadow/db/t/default_0.tar":          []byte("data"),
+				"full/shadow/db/t/default_1.tar":          []byte("failed retry"),
+				"increment/metadata.json":                 []byte(`{"backup_name":"increment","required_backup":"full","shared_parts":[".shared/aa/aa11.tar"]}`),
+				"increment/metadata/db/t.json":            []byte(`{}`),
+				"increment/shadow/db/t/default_0.tar.001": []byte("data"),
+				"increment/access.tar":                    []byte("rbac"),
+				"increment/upload.tmp":                    []byte("unknown"),
+				"legacy.tar.gz":                           []byte("legacy"),
+				".shared/aa/aa11.tar":                     []byte("shared"),
+				".shared/bb/bb22.tar":                     []byte("unreferenced"),
+				".shared/cc/cc33.tar":                     []byte("fresh"),
+			},
+			modified: map[string]time.Time{".shared/cc/cc33.tar": now.Add(-time.Hour)},
+		}
+	}
+
+	storage := newStorage()
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1, backupManifest: true}
+	orphans, err := bd.FindOrphans(24*time.Hour, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []OrphanObject{{Key: ".shared/bb/bb22.tar", Size: 12}, {Key: "full/shadow/db/t/default_1.tar", Size: 12}}, orphans.Objects)
+	assert.Equal(t, int64(24), orphans.Size)
+	assert.Equal(t, []RetainedObjects{
+		{Prefix: ".shared/", Reason: "modified later than 24h0m0s ago", Count: 1, Size: 5},
+		{Prefix: "increment/", Reason: "unknown objects of backup without manifest.json", Count: 1, Size: 7},
+	}, orphans.Retained)
+
+	filesCount := len(storage.files)
+	assert.NoError(t, bd.DeleteOrphans(orphans))
+	assert.Len(t, storage.files, filesCount-2)
+	assert.NotContains(t, storage.files, ".shared/bb/bb22.tar")
+	assert.NotContains(t, storage.files, "full/shadow/db/t/default_1.tar")
+	orphans, err = bd.FindOrphans(24*time.Hour, now)
+	assert.NoError(t, err)
+	assert.Empty(t, orphans.Objects)
+
+	// broken backup could be uploaded right now, so it and all shared parts are retained
+	storage = newStorage()
+	storage.files["partial/shadow/db/t/default_0.tar"] = []byte("partial")
+	bd = &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1, backupManifest: true}
+	orphans, err = bd.FindOrphans(0, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []OrphanObject{{Key: "full/shadow/db/t/default_1.tar", Size: 12}}, orphans.Objects)
+	assert.Equal(t, []RetainedObjects{
+		{Prefix: ".shared/", Reason: "broken backups could reference shared parts: partial", Count: 3, Size: 23},
+		{Prefix: "increment/", Reason: "unknown objects of backup without manifest.json", Count: 1, Size: 7},
+		{Prefix: "partial/", Reason: "backup is broken (can't stat metadata.json), it could be uploaded right now, use `delete remote` when it is abandoned", Count: 1, Size: 7},
+	}, orphans.Retained)
+
+	_, err = (&BackupDestination{RemoteStorage: &FTP{}}).FindOrphans(0, now)
+	assert.EqualError(t, err, "search of orphaned objects is not supported by FTP remote storage")
+}
@@ -0,0 +1,73 @@
+package new_storage
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"golang.org/x/net/proxy"
+)
+
+// httpProxySchemes - proxy schemes which are supported by http.Transport
+var httpProxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// parseProxyURL - proxy_url with one of schemes, password of proxy is masked in logs and errors
+func parseProxyURL(kind, proxyURL string, schemes ...string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		// url.Error contains whole url with password
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("can't parse proxy_url: %v", err)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			apexLog.Infof("%s uses proxy %s", kind, u.Redacted())
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("proxy_url %s is not supported by %s, use one of %s schemes", u.Redacted(), kind, strings.Join(schemes, ", "))
+}
+
+// newHTTPTransport - transport with ca_cert, disable_cert_verification and proxy_url of remote storage
+func newHTTPTransport(kind, caCert string, skipVerify bool, proxyURL string) (*http.Transport, error) {
+	transport, err := newTLSTransport(caCert, skipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != "" {
+		u, err := parseProxyURL(kind, proxyURL, httpProxySchemes...)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return transport, nil
+}
+
+// newProxyDialFunc - dial control and data connections of FTP through socks5 proxy, tlsConfig wraps each connection when it isn't nil
+func newProxyDialFunc(proxyURL string, timeout time.Duration, tlsConfig *tls.Config) (func(network, address string) (net.Conn, error), error) {
+	u, err := parseProxyURL("FTP", proxyURL, "socks5", "socks5h")
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.FromURL(u, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("can't create dialer for proxy_url %s: %v", u.Redacted(), err)
+	}
+	return func(network, address string) (net.Conn, error) {
+		conn, err := dialer.Dial(network, address)
+		if err != nil || tlsConfig == nil {
+			return conn, err
+		}
+		return tls.Client(conn, tlsConfig), nil
+	}, nil
+}
@@ -1,17 +1,21 @@
 package new_storage
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,6 +23,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -53,6 +58,32 @@ type S3 struct {
 	PartSize    int64
 	Concurrency int
 	BufferSize  int
+	objectTags  map[string]string
+}
+
+func init() {
+	registerBackend("s3", newS3, func(cfg *config.Config) (string, int) {
+		return cfg.S3.CompressionFormat, cfg.S3.CompressionLevel
+	})
+}
+
+func newS3(cfg *config.Config) (RemoteStorage, error) {
+	partSize := cfg.S3.PartSize
+	if cfg.S3.PartSize <= 0 {
+		partSize = cfg.General.MaxFileSize / 10000
+		if partSize < 5*1024*1024 {
+			partSize = 5 * 1024 * 1024
+		}
+		if partSize > 5*1024*1024*1024 {
+			partSize = 5 * 1024 * 1024 * 1024
+		}
+	}
+	return &S3{
+		Config:      &cfg.S3,
+		Concurrency: cfg.S3.Concurrency,
+		BufferSize:  1024 * 1024,
+		PartSize:    partSize,
+	}, nil
 }
 
 // Connect - connect to s3
@@ -92,6 +123,8 @@ func (s *S3) Connect() error {
 		Endpoint:         aws.String(s.Config.Endpoint),
 		DisableSSL:       aws.Bool(s.Config.DisableSSL),
 		S3ForcePathStyle: aws.Bool(s.Config.ForcePathStyle),
+		S3UseAccelerate:  aws.Bool(s.Config.UseAccelerateEndpoint),
+		UseDualStack:     aws.Bool(s.Config.UseDualStack),
 		MaxRetries:       aws.Int(30),
 	}
 	if s.Config.Debug {
@@ -99,11 +132,8 @@ func (s *S3) Connect() error {
 		awsConfig.LogLevel = aws.LogLevel(aws.LogDebug)
 	}
 
-	if s.Config.DisableCertVerification {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		awsConfig.HTTPClient = &http.Client{Transport: tr}
+	if awsConfig.HTTPClient, err = s.newHTTPClient(); err != nil {
+		return err
 	}
 
 	if s.Config.AssumeRoleARN != "" {
@@ -111,7 +141,16 @@ func (s *S3) Connect() error {
 		awsConfig.Credentials = stscreds.NewCredentials(session.Must(session.NewSession(awsConfig)), s.Config.AssumeRoleARN)
 	}
 
-	if s.session, err = session.NewSession(awsConfig); err != nil {
+	sessionOptions := session.Options{Config: *awsConfig}
+	if s.Config.CACert != "" {
+		// AWS_CA_BUNDLE replaces root CAs of transport, ca_cert shall have priority over it
+		caPEM, err := readCACert(s.Config.CACert)
+		if err != nil {
+			return err
+		}
+		sessionOptions.CustomCABundle = bytes.NewReader(caPEM)
+	}
+	if s.session, err = session.NewSessionWithOptions(sessionOptions); err != nil {
 		return err
 	}
 
@@ -128,6 +167,26 @@ func (s *S3) Connect() error {
 	return nil
 }
 
+// newHTTPClient - client with ca_cert, disable_cert_verification, proxy_url, max_idle_conns and http_timeout,
+// default transport keeps only 2 idle connections per host, so concurrent upload and download reconnect permanently
+func (s *S3) newHTTPClient() (*http.Client, error) {
+	transport, err := newHTTPTransport(s.Kind(), s.Config.CACert, s.Config.DisableCertVerification, s.Config.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't create s3 transport: %v", err)
+	}
+	if s.Config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = s.Config.MaxIdleConns
+		transport.MaxIdleConnsPerHost = s.Config.MaxIdleConns
+	}
+	client := &http.Client{Transport: transport}
+	if s.Config.HTTPTimeout != "" {
+		if client.Timeout, err = time.ParseDuration(s.Config.HTTPTimeout); err != nil {
+			return nil, fmt.Errorf("can't parse s3.http_timeout: %v", err)
+		}
+	}
+	return client, nil
+}
+
 func (s *S3) Kind() string {
 	return "S3"
 }
@@ -153,26 +212,49 @@ func (s *S3) GetFileReader(key string) (io.ReadCloser, error) {
 		Key:    aws.String(path.Join(s.Config.Path, key)),
 	})
 	if err := req.Send(); err != nil {
-		return nil, err
+		return nil, mapS3Error(err)
 	}
 
 	return resp.Body, nil
 }
 
-func (s *S3) PutFile(key string, r io.ReadCloser) error {
+// SetObjectTags - set tags which will be attached to all objects uploaded by PutFile, tags from config have priority
+func (s *S3) SetObjectTags(tags map[string]string) {
+	s.objectTags = mergeObjectTags(tags, s.Config.ObjectTags)
+}
+
+func (s *S3) newUploadInput(key string, r io.ReadCloser) *s3manager.UploadInput {
 	var sse *string
 	if s.Config.SSE != "" {
 		sse = aws.String(s.Config.SSE)
 	}
-	_, err := s.uploader.Upload(&s3manager.UploadInput{
+	var tagging *string
+	if len(s.objectTags) > 0 {
+		tags := url.Values{}
+		for k, v := range s.objectTags {
+			tags.Set(k, v)
+		}
+		tagging = aws.String(tags.Encode())
+	}
+	return &s3manager.UploadInput{
 		ACL:                  aws.String(s.Config.ACL),
 		Bucket:               aws.String(s.Config.Bucket),
 		Key:                  aws.String(path.Join(s.Config.Path, key)),
 		Body:                 r,
 		ServerSideEncryption: sse,
 		StorageClass:         aws.String(strings.ToUpper(s.Config.StorageClass)),
-	})
-	return err
+		Tagging:              tagging,
+	}
+}
+
+// VerifyETag - etagVerifier, ETag of object encrypted by SSE-KMS isn't MD5 of its content
+func (s *S3) VerifyETag() bool {
+	return s.Config.VerifyETag && s.Config.SSE != "aws:kms"
+}
+
+func (s *S3) PutFile(key string, r io.ReadCloser) error {
+	_, err := s.uploader.Upload(s.newUploadInput(key, r))
+	return mapS3Error(err)
 }
 
 func (s *S3) DeleteFile(key string) error {
@@ -181,11 +263,45 @@ func (s *S3) DeleteFile(key string) error {
 		Key:    aws.String(path.Join(s.Config.Path, key)),
 	}
 	if _, err := s3.New(s.session).DeleteObject(params); err != nil {
-		return errors.Wrapf(err, "DeleteFile, deleting object %+v", params)
+		return errors.Wrapf(mapS3Error(err), "DeleteFile, deleting object %+v", params)
 	}
 	return nil
 }
 
+// DeleteFiles - delete keys by one DeleteObjects request, S3 compatible storages without DeleteObjects support get DeleteObject for each key
+func (s *S3) DeleteFiles(keys []string) map[string]error {
+	failed := map[string]error{}
+	objectKeys := make(map[string]string, len(keys))
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objectKey := path.Join(s.Config.Path, key)
+		objectKeys[objectKey] = key
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(objectKey)}
+	}
+	result, err := s3.New(s.session).DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(s.Config.Bucket),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotImplemented" {
+		for _, key := range keys {
+			if err := s.DeleteFile(key); err != nil {
+				failed[key] = err
+			}
+		}
+		return failed
+	}
+	if err != nil {
+		for _, key := range keys {
+			failed[key] = mapS3Error(err)
+		}
+		return failed
+	}
+	for _, e := range result.Errors {
+		failed[objectKeys[aws.StringValue(e.Key)]] = mapS3Error(awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil))
+	}
+	return failed
+}
+
 func (s *S3) StatFile(key string) (RemoteFile, error) {
 	svc := s3.New(s.session)
 	head, err := svc.HeadObject(&s3.HeadObjectInput{
@@ -193,21 +309,19 @@ func (s *S3) StatFile(key string) (RemoteFile, error) {
 		Key:    aws.String(path.Join(s.Config.Path, key)),
 	})
 	if err != nil {
-		aerr, ok := err.(awserr.Error)
-		if ok && aerr.Code() == "NotFound" {
-			return nil, ErrNotFound
-		}
-		return nil, err
+		return nil, mapS3Error(err)
 	}
-	return &s3File{*head.ContentLength, *head.LastModified, key}, nil
+	return &s3File{*head.ContentLength, *head.LastModified, key, aws.StringValue(head.ETag)}, nil
 }
 
+// Walk - process is called from one goroutine, next page is requested while current page is processed,
+// with list_concurrency > 1 recursive listing returns objects of different folders in mixed order
 func (s *S3) Walk(s3Path string, recursive bool, process func(r RemoteFile) error) error {
 	g, _ := errgroup.WithContext(context.Background())
-	s3Files := make(chan *s3File)
+	s3Files := make(chan *s3File, s3ListPageSize)
 	g.Go(func() error {
 		defer close(s3Files)
-		return s.remotePager(path.Join(s.Config.Path, s3Path), recursive, func(page *s3.ListObjectsV2Output) {
+		pager := func(page *s3.ListObjectsV2Output) {
 			for _, cp := range page.CommonPrefixes {
 				s3Files <- &s3File{
 					name: strings.TrimPrefix(*cp.Prefix, path.Join(s.Config.Path, s3Path)),
@@ -218,9 +332,14 @@ func (s *S3) Walk(s3Path string, recursive bool, process func(r RemoteFile) erro
 					*c.Size,
 					*c.LastModified,
 					strings.TrimPrefix(*c.Key, path.Join(s.Config.Path, s3Path)),
+					aws.StringValue(c.ETag),
 				}
 			}
-		})
+		}
+		if recursive && s.Config.ListConcurrency > 1 {
+			return s.concurrentRemotePager(path.Join(s.Config.Path, s3Path), pager)
+		}
+		return s.remotePager(path.Join(s.Config.Path, s3Path), recursive, pager)
 	})
 	g.Go(func() error {
 		var err error
@@ -234,6 +353,125 @@ func (s *S3) Walk(s3Path string, recursive bool, process func(r RemoteFile) erro
 	return g.Wait()
 }
 
+// concurrentRemotePager - ListObjectsV2 pages can't be requested in parallel for one prefix, so objects of first level are listed with delimiter
+// and each folder is listed recursively by list_concurrency parallel requests, pager is called by one folder at a time
+func (s *S3) concurrentRemotePager(s3Path string, pager func(page *s3.ListObjectsV2Output)) error {
+	var folders []string
+	if err := s.remotePager(s3Path, false, func(page *s3.ListObjectsV2Output) {
+		for _, cp := range page.CommonPrefixes {
+			folders = append(folders, strings.TrimSuffix(*cp.Prefix, "/"))
+		}
+		pager(&s3.ListObjectsV2Output{Contents: page.Contents})
+	}); err != nil {
+		return err
+	}
+	var pagerLock sync.Mutex
+	sem := semaphore.NewWeighted(int64(s.Config.ListConcurrency))
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, folder := range folders {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break
+		}
+		folder := folder
+		g.Go(func() error {
+			defer sem.Release(1)
+			return s.remotePager(folder, true, func(page *s3.ListObjectsV2Output) {
+				pagerLock.Lock()
+				defer pagerLock.Unlock()
+				pager(page)
+			})
+		})
+	}
+	return g.Wait()
+}
+
+// IncompleteUpload - multipart upload which was neither completed nor aborted, its parts are not returned by Walk but are stored and billed, Size is sum of uploaded parts
+type IncompleteUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+	Size      int64
+}
+
+// ListIncompleteUploads - multipart uploads under s3.path, uploads which were finished during listing are skipped
+func (s *S3) ListIncompleteUploads() ([]IncompleteUpload, error) {
+	svc := s3.New(s.session)
+	prefix := ""
+	if s.Config.Path != "" && s.Config.Path != "/" {
+		prefix = strings.TrimPrefix(s.Config.Path, "/") + "/"
+	}
+	var uploads []IncompleteUpload
+	err := svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Config.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			uploads = append(uploads, IncompleteUpload{
+				Key:       strings.TrimPrefix(aws.StringValue(u.Key), prefix),
+				UploadID:  aws.StringValue(u.UploadId),
+				Initiated: aws.TimeValue(u.Initiated),
+			})
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, errors.Wrap(mapS3Error(err), "can't list multipart uploads")
+	}
+	result := uploads[:0]
+	for _, upload := range uploads {
+		err := svc.ListPartsPages(&s3.ListPartsInput{
+			Bucket:   aws.String(s.Config.Bucket),
+			Key:      aws.String(path.Join(s.Config.Path, upload.Key)),
+			UploadId: aws.String(upload.UploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				upload.Size += aws.Int64Value(part.Size)
+			}
+			return !lastPage
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(mapS3Error(err), "can't list parts of multipart upload %s", upload.Key)
+		}
+		result = append(result, upload)
+	}
+	return result, nil
+}
+
+// AbortIncompleteUploads - abort multipart uploads under s3.path which were initiated before initiatedBefore, return aborted uploads
+func (s *S3) AbortIncompleteUploads(initiatedBefore time.Time) ([]IncompleteUpload, error) {
+	uploads, err := s.ListIncompleteUploads()
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(s.session)
+	var aborted []IncompleteUpload
+	for _, upload := range uploads {
+		if !upload.Initiated.Before(initiatedBefore) {
+			log.Infof("keep multipart upload %s initiated at %s", upload.Key, upload.Initiated.Format(time.RFC3339))
+			continue
+		}
+		_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.Config.Bucket),
+			Key:      aws.String(path.Join(s.Config.Path, upload.Key)),
+			UploadId: aws.String(upload.UploadID),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			continue
+		}
+		if err != nil {
+			return aborted, errors.Wrapf(mapS3Error(err), "can't abort multipart upload %s", upload.Key)
+		}
+		aborted = append(aborted, upload)
+	}
+	return aborted, nil
+}
+
+// s3ListPageSize - max keys in ListObjectsV2 page
+const s3ListPageSize = 1000
+
 func (s *S3) remotePager(s3Path string, recursive bool, pager func(page *s3.ListObjectsV2Output)) error {
 	prefix := s3Path + "/"
 	if s3Path == "" || s3Path == "/" {
@@ -241,7 +479,7 @@ func (s *S3) remotePager(s3Path string, recursive bool, pager func(page *s3.List
 	}
 	params := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(s.Config.Bucket), // Required
-		MaxKeys: aws.Int64(1000),
+		MaxKeys: aws.Int64(s3ListPageSize),
 		Prefix:  aws.String(prefix),
 	}
 	if !recursive {
@@ -251,13 +489,45 @@ func (s *S3) remotePager(s3Path string, recursive bool, pager func(page *s3.List
 		pager(page)
 		return !lastPage
 	}
-	return s3.New(s.session).ListObjectsV2Pages(params, wrapper)
+	return mapS3Error(s3.New(s.session).ListObjectsV2Pages(params, wrapper))
+}
+
+// mapS3Error - map S3 error codes and HTTP status into ErrNotFound, ErrUnauthorized, ErrTransient and ErrRemoteStorage
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return mapStatusCodeError(0, err)
+	}
+	switch aerr.Code() {
+	case "NotFound", "NoSuchKey", "NoSuchBucket":
+		return ErrNotFound
+	case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+		return storageError(ErrUnauthorized, err)
+	case "SlowDown", "Throttling", "RequestTimeout", "InternalError", "ServiceUnavailable", request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+		return storageError(ErrTransient, err)
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return mapStatusCodeError(reqErr.StatusCode(), err)
+	}
+	if aerr.OrigErr() != nil && isNetworkError(aerr.OrigErr()) {
+		return storageError(ErrTransient, err)
+	}
+	return storageError(ErrRemoteStorage, err)
 }
 
 type s3File struct {
 	size         int64
 	lastModified time.Time
 	name         string
+	etag         string
+}
+
+// ETag - etagFile, quotes are removed
+func (f *s3File) ETag() string {
+	return strings.Trim(f.etag, `"`)
 }
 
 func (f *s3File) Size() int64 {
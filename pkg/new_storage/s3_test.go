@@ -0,0 +1,278 @@
+package new_storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockMultipartUpload struct {
+	key       string
+	initiated time.Time
+	parts     []int64
+}
+
+// multipartUploadsServer - S3 API which answers ListMultipartUploads, ListParts and AbortMultipartUpload, ListParts returns one part per page
+type multipartUploadsServer struct {
+	sync.Mutex
+	uploads map[string]*mockMultipartUpload
+	aborted []string
+}
+
+func (s *multipartUploadsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	query := r.URL.Query()
+	if _, isList := query["uploads"]; isList && r.Method == http.MethodGet {
+		result := "<ListMultipartUploadsResult><Bucket>bucket</Bucket><IsTruncated>false</IsTruncated>"
+		for id, upload := range s.uploads {
+			if strings.HasPrefix(upload.key, query.Get("prefix")) {
+				result += fmt.Sprintf("<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>%s</Initiated></Upload>", upload.key, id, upload.initiated.UTC().Format(time.RFC3339))
+			}
+		}
+		_, _ = w.Write([]byte(result + "</ListMultipartUploadsResult>"))
+		return
+	}
+	upload, exists := s.uploads[query.Get("uploadId")]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`<Error><Code>NoSuchUpload</Code><Message>upload doesn't exist</Message></Error>`))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		marker := 0
+		_, _ = fmt.Sscanf(query.Get("part-number-marker"), "%d", &marker)
+		result := fmt.Sprintf("<ListPartsResult><IsTruncated>%v</IsTruncated><NextPartNumberMarker>%d</NextPartNumberMarker>", marker+1 < len(upload.parts), marker+1)
+		if marker < len(upload.parts) {
+			result += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><Size>%d</Size></Part>", marker+1, upload.parts[marker])
+		}
+		_, _ = w.Write([]byte(result + "</ListPartsResult>"))
+	case http.MethodDelete:
+		delete(s.uploads, query.Get("uploadId"))
+		s.aborted = append(s.aborted, upload.key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3AbortIncompleteUploads(t *testing.T) {
+	now := time.Now()
+	server := &multipartUploadsServer{uploads: map[string]*mockMultipartUpload{
+		"old":     {key: "prefix/backup1/shadow/default/t1/default.tar", initiated: now.Add(-48 * time.Hour), parts: []int64{5 << 20, 5 << 20, 1024}},
+		"fresh":   {key: "prefix/backup2/shadow/default/t1/default.tar", initiated: now.Add(-time.Minute), parts: []int64{5 << 20}},
+		"foreign": {key: "other/backup1/metadata.json", initiated: now.Add(-48 * time.Hour), parts: []int64{100}},
+	}}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	s := &S3{
+		Config: &config.S3Config{
+			Bucket:         "bucket",
+			Path:           "prefix",
+			Endpoint:       srv.URL,
+			Region:         "us-east-1",
+			AccessKey:      "access",
+			SecretKey:      "secret",
+			ForcePathStyle: true,
+			DisableSSL:     true,
+		},
+		Concurrency: 1,
+		BufferSize:  1024 * 1024,
+		PartSize:    5 * 1024 * 1024,
+	}
+	assert.NoError(t, s.Connect())
+
+	uploads, err := s.ListIncompleteUploads()
+	assert.NoError(t, err)
+	assert.Len(t, uploads, 2, "uploads outside of s3.path shall not be listed")
+	sizes := map[string]int64{}
+	for _, upload := range uploads {
+		sizes[upload.Key] = upload.Size
+	}
+	assert.Equal(t, map[string]int64{"backup1/shadow/default/t1/default.tar": 10<<20 + 1024, "backup2/shadow/default/t1/default.tar": 5 << 20}, sizes)
+
+	aborted, err := s.AbortIncompleteUploads(now.Add(-24 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []IncompleteUpload{{Key: "backup1/shadow/default/t1/default.tar", UploadID: "old", Initiated: aborted[0].Initiated, Size: 10<<20 + 1024}}, aborted)
+	assert.Equal(t, []string{"prefix/backup1/shadow/default/t1/default.tar"}, server.aborted)
+	assert.Contains(t, server.uploads, "fresh", "upload within grace period shall be kept")
+}
+
+// listObjectsServer - S3 API which answers ListObjectsV2 by pages of pageSize keys, each request takes latency
+type listObjectsServer struct {
+	keys     []string
+	pageSize int
+	latency  time.Duration
+}
+
+func newListObjectsServer(folders, filesPerFolder, pageSize int, latency time.Duration) *listObjectsServer {
+	server := &listObjectsServer{keys: []string{"prefix/root.json"}, pageSize: pageSize, latency: latency}
+	for i := 0; i < folders; i++ {
+		for j := 0; j < filesPerFolder; j++ {
+			server.keys = append(server.keys, fmt.Sprintf("prefix/backup%03d/shadow/db/t/part%05d.tar", i, j))
+		}
+	}
+	sort.Strings(server.keys)
+	return server
+}
+
+func (s *listObjectsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.latency)
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	var entries []string
+	isPrefix := map[string]bool{}
+	for _, key := range s.keys[sort.SearchStrings(s.keys, prefix):] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := key[:len(prefix)+i+1]
+			if !isPrefix[commonPrefix] {
+				isPrefix[commonPrefix] = true
+				entries = append(entries, commonPrefix)
+			}
+			continue
+		}
+		entries = append(entries, key)
+	}
+	start := 0
+	_, _ = fmt.Sscanf(query.Get("continuation-token"), "%d", &start)
+	end := start + s.pageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	result := &strings.Builder{}
+	_, _ = fmt.Fprintf(result, "<ListBucketResult><Name>bucket</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>%v</IsTruncated>", prefix, end-start, end < len(entries))
+	if end < len(entries) {
+		_, _ = fmt.Fprintf(result, "<NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	for _, entry := range entries[start:end] {
+		if isPrefix[entry] {
+			_, _ = fmt.Fprintf(result, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", entry)
+		} else {
+			_, _ = fmt.Fprintf(result, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2022-01-01T00:00:00.000Z</LastModified></Contents>", entry, len(entry))
+		}
+	}
+	_, _ = w.Write([]byte(result.String() + "</ListBucketResult>"))
+}
+
+func newListObjectsS3(t testing.TB, endpoint string, listConcurrency int) *S3 {
+	s := &S3{
+		Config: &config.S3Config{
+			Bucket:          "bucket",
+			Path:            "prefix",
+			Endpoint:        endpoint,
+			Region:          "us-east-1",
+			AccessKey:       "access",
+			SecretKey:       "secret",
+			ForcePathStyle:  true,
+			DisableSSL:      true,
+			ListConcurrency: listConcurrency,
+		},
+		Concurrency: 1,
+		BufferSize:  1024 * 1024,
+		PartSize:    5 * 1024 * 1024,
+	}
+	assert.NoError(t, s.Connect())
+	return s
+}
+
+func TestS3WalkListConcurrency(t *testing.T) {
+	server := newListObjectsServer(5, 25, 10, 0)
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	var expected []string
+	for _, key := range server.keys {
+		expected = append(expected, strings.TrimPrefix(key, "prefix/"))
+	}
+	for _, listConcurrency := range []int{1, 3} {
+		s := newListObjectsS3(t, srv.URL, listConcurrency)
+		var names []string
+		assert.NoError(t, s.Walk("/", true, func(f RemoteFile) error {
+			names = append(names, strings.TrimPrefix(f.Name(), "/"))
+			assert.Equal(t, int64(len("prefix/"+strings.TrimPrefix(f.Name(), "/"))), f.Size())
+			return nil
+		}))
+		sort.Strings(names)
+		assert.Equal(t, expected, names, "list_concurrency=%d", listConcurrency)
+
+		names = nil
+		assert.NoError(t, s.Walk("backup001/", true, func(f RemoteFile) error {
+			names = append(names, f.Name())
+			return nil
+		}))
+		assert.Len(t, names, 25, "list_concurrency=%d", listConcurrency)
+
+		names = nil
+		assert.NoError(t, s.Walk("/", false, func(f RemoteFile) error {
+			names = append(names, f.Name())
+			return nil
+		}))
+		assert.Len(t, names, 6, "non-recursive walk returns folders and root objects, list_concurrency=%d", listConcurrency)
+	}
+}
+
+// BenchmarkS3Walk - recursive listing of 20 folders with 500 objects by pages of 100 keys, each ListObjectsV2 request takes 20ms like real S3
+func BenchmarkS3Walk(b *testing.B) {
+	srv := httptest.NewServer(newListObjectsServer(20, 500, 100, 20*time.Millisecond))
+	defer srv.Close()
+	for _, listConcurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("list_concurrency=%d", listConcurrency), func(b *testing.B) {
+			s := newListObjectsS3(b, srv.URL, listConcurrency)
+			for i := 0; i < b.N; i++ {
+				count := 0
+				if err := s.Walk("/", true, func(f RemoteFile) error {
+					count++
+					return nil
+				}); err != nil || count != 20*500+1 {
+					b.Fatalf("walk returned %d objects: %v", count, err)
+				}
+			}
+		})
+	}
+}
+
+func TestS3Endpoints(t *testing.T) {
+	for _, tc := range []struct {
+		accelerate, dualStack bool
+		host                  string
+	}{
+		{false, false, "bucket.s3.amazonaws.com"},
+		{true, false, "bucket.s3-accelerate.amazonaws.com"},
+		{false, true, "bucket.s3.dualstack.us-east-1.amazonaws.com"},
+		{true, true, "bucket.s3-accelerate.dualstack.amazonaws.com"},
+	} {
+		cfg := config.DefaultConfig()
+		cfg.S3.Bucket = "bucket"
+		cfg.S3.AccessKey = "access"
+		cfg.S3.SecretKey = "secret"
+		cfg.S3.UseAccelerateEndpoint = tc.accelerate
+		cfg.S3.UseDualStack = tc.dualStack
+		storage, err := newS3(cfg)
+		assert.NoError(t, err)
+		s := storage.(*S3)
+		assert.NoError(t, s.Connect())
+		req, _ := s3.New(s.session).GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("backup/metadata.json")})
+		assert.NoError(t, req.Build())
+		assert.Equal(t, tc.host, req.HTTPRequest.URL.Host, "accelerate=%v dualstack=%v", tc.accelerate, tc.dualStack)
+	}
+}
+
+func TestS3VerifyETag(t *testing.T) {
+	assert.False(t, (&S3{Config: &config.S3Config{}}).VerifyETag())
+	assert.True(t, (&S3{Config: &config.S3Config{VerifyETag: true, SSE: "AES256"}}).VerifyETag())
+	assert.False(t, (&S3{Config: &config.S3Config{VerifyETag: true, SSE: "aws:kms"}}).VerifyETag(), "ETag of SSE-KMS object isn't MD5")
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", (&s3File{etag: `"5d41402abc4b2a76b9719d911017c592"`}).ETag())
+}
@@ -23,6 +23,14 @@ type SFTP struct {
 	Config *config.SFTPConfig
 }
 
+func init() {
+	registerBackend("sftp", func(cfg *config.Config) (RemoteStorage, error) {
+		return &SFTP{Config: &cfg.SFTP}, nil
+	}, func(cfg *config.Config) (string, int) {
+		return cfg.SFTP.CompressionFormat, cfg.SFTP.CompressionLevel
+	})
+}
+
 func (sftp *SFTP) Debug(msg string, v ...interface{}) {
 	if sftp.Config.Debug {
 		log.Infof(msg, v...)
@@ -0,0 +1,79 @@
+package new_storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	apexLog "github.com/apex/log"
+)
+
+// SharedPartsPath - remote folder for content-addressed part archives which are shared between backups, BackupList skips it
+const SharedPartsPath = ".shared"
+
+// SharedPartKey - remote key of part archive, hash is sha256 of part checksums.txt
+func SharedPartKey(hash string, extension string) string {
+	return path.Join(SharedPartsPath, hash[:2], fmt.Sprintf("%s.%s", hash, extension))
+}
+
+func isSharedPartsPath(name string) bool {
+	return strings.Trim(name, "/") == SharedPartsPath
+}
+
+// CompressedStreamUploadShared - upload files as archive into content-addressed key, upload is skipped when key already exists,
+// return true when archive was uploaded and remote size of archive
+func (bd *BackupDestination) CompressedStreamUploadShared(baseLocalPath string, files []string, key string) (bool, int64, error) {
+	remoteFile, err := bd.StatFile(key)
+	if err == nil {
+		return false, remoteFile.Size(), nil
+	}
+	if !errors.Is(err, ErrNotFound) && !os.IsNotExist(err) {
+		return false, 0, err
+	}
+	if err := bd.CompressedStreamUpload(baseLocalPath, files, key); err != nil {
+		return false, 0, err
+	}
+	if remoteFile, err = bd.StatFile(key); err != nil {
+		return false, 0, fmt.Errorf("can't check uploaded file: %v", err)
+	}
+	return true, remoteFile.Size(), nil
+}
+
+// removeUnreferencedSharedParts - delete shared part archives of removed backup which are not referenced by any other backup
+func (bd *BackupDestination) removeUnreferencedSharedParts(backup Backup) error {
+	if len(backup.SharedParts) == 0 {
+		return nil
+	}
+	backupList, err := bd.BackupList(true, "")
+	if err != nil {
+		return fmt.Errorf("can't get backup list to check shared parts references: %v", err)
+	}
+	references := map[string]int{}
+	for _, b := range backupList {
+		if b.BackupName == backup.BackupName {
+			continue
+		}
+		if b.Broken != "" {
+			// broken backup could reference any shared part, keep all of them
+			apexLog.Warnf("backup '%s' is %s, shared parts of '%s' will be kept", b.BackupName, b.Broken, backup.BackupName)
+			return nil
+		}
+		for _, key := range b.SharedParts {
+			references[key]++
+		}
+	}
+	var unreferenced []string
+	for _, key := range backup.SharedParts {
+		if references[key] == 0 {
+			unreferenced = append(unreferenced, key)
+		}
+	}
+	if err := bd.deleteKeys(unreferenced); err != nil {
+		return fmt.Errorf("can't delete shared parts: %v", err)
+	}
+	removed := len(unreferenced)
+	apexLog.WithField("backup", backup.BackupName).Infof("removed %d of %d shared parts, %d are referenced by other backups", removed, len(backup.SharedParts), len(backup.SharedParts)-removed)
+	return nil
+}
@@ -0,0 +1,83 @@
+package new_storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedStreamUploadSharedDedup(t *testing.T) {
+	localPath := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(localPath, "data.bin"), []byte("part data"), 0644))
+	storage := &mockStorage{files: map[string][]byte{}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	key := SharedPartKey("abcdef", "tar")
+	assert.Equal(t, ".shared/ab/abcdef.tar", key)
+
+	uploaded, size, err := bd.CompressedStreamUploadShared(localPath, []string{"data.bin"}, key)
+	assert.NoError(t, err)
+	assert.True(t, uploaded)
+	assert.Equal(t, int64(len(storage.files[key])), size)
+	assert.Equal(t, 1, storage.putCalls)
+
+	uploaded, sharedSize, err := bd.CompressedStreamUploadShared(localPath, []string{"data.bin"}, key)
+	assert.NoError(t, err)
+	assert.False(t, uploaded)
+	assert.Equal(t, size, sharedSize)
+	assert.Equal(t, 1, storage.putCalls)
+}
+
+func putTestBackupMetadata(t *testing.T, storage *mockStorage, backupName string, sharedParts []string) {
+	body, err := json.Marshal(metadata.BackupMetadata{BackupName: backupName, SharedParts: sharedParts})
+	assert.NoError(t, err)
+	storage.files[path.Join(backupName, "metadata.json")] = body
+}
+
+func TestRemoveUnreferencedSharedParts(t *testing.T) {
+	// BackupList keeps metadata cache in temp dir
+	t.Setenv("TMPDIR", t.TempDir())
+	storage := &mockStorage{files: map[string][]byte{
+		".shared/aa/aaa.tar": []byte("shared by both backups"),
+		".shared/bb/bbb.tar": []byte("only in first backup"),
+	}}
+	putTestBackupMetadata(t, storage, "first", []string{".shared/aa/aaa.tar", ".shared/bb/bbb.tar"})
+	putTestBackupMetadata(t, storage, "second", []string{".shared/aa/aaa.tar"})
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+
+	backupList, err := bd.BackupList(true, "")
+	assert.NoError(t, err)
+	assert.Len(t, backupList, 2)
+	var first, second Backup
+	for _, b := range backupList {
+		switch b.BackupName {
+		case "first":
+			first = b
+		case "second":
+			second = b
+		}
+	}
+
+	delete(storage.files, "first/metadata.json")
+	assert.NoError(t, bd.removeUnreferencedSharedParts(first))
+	assert.Contains(t, storage.files, ".shared/aa/aaa.tar")
+	assert.NotContains(t, storage.files, ".shared/bb/bbb.tar")
+
+	delete(storage.files, "second/metadata.json")
+	assert.NoError(t, bd.removeUnreferencedSharedParts(second))
+	assert.NotContains(t, storage.files, ".shared/aa/aaa.tar")
+}
+
+func TestRemoveUnreferencedSharedPartsKeepForBrokenBackup(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	storage := &mockStorage{files: map[string][]byte{
+		".shared/aa/aaa.tar":   []byte("shared part"),
+		"uploading/shadow.tar": []byte("backup without metadata.json yet"),
+	}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", compressionLevel: 1, disableProgressBar: true, deleteConcurrency: 1}
+	assert.NoError(t, bd.removeUnreferencedSharedParts(Backup{BackupMetadata: metadata.BackupMetadata{BackupName: "removed", SharedParts: []string{".shared/aa/aaa.tar"}}}))
+	assert.Contains(t, storage.files, ".shared/aa/aaa.tar")
+}
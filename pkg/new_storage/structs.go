@@ -10,6 +10,12 @@ var (
 	// ErrNotFound is returned when file/object cannot be found
 	ErrNotFound         = errors.New("key not found")
 	ErrFileDoesNotExist = errors.New("file does not exist")
+	// ErrUnauthorized is returned when remote storage rejects credentials or denies access
+	ErrUnauthorized = errors.New("access denied")
+	// ErrTransient is returned when remote storage failure could disappear after retry, like throttling, timeouts and 5xx responses
+	ErrTransient = errors.New("temporary failure")
+	// ErrRemoteStorage is returned when remote storage can't be connected or fails with error which isn't ErrNotFound, ErrUnauthorized or ErrTransient
+	ErrRemoteStorage = errors.New("remote storage failure")
 )
 
 // RemoteFile - interface describe file on remote storage
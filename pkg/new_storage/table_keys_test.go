@@ -0,0 +1,163 @@
+package new_storage
+
+import (
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/stretchr/testify/assert"
+)
+
+var specialTableNames = []string{"db.with.dots", "table/with/slash", "a+b", "a b", "a%2Eb", "a.b", "..", "таблица", "emoji😀", "a:b@c=d&e$f~g", "a;b,c?d#e"}
+
+// specialTableKeys - remote keys of data and metadata for tables with special characters in names
+func specialTableKeys() []string {
+	var keys []string
+	for _, database := range specialTableNames {
+		for _, table := range specialTableNames {
+			keys = append(keys,
+				path.Join("backup1", "metadata", common.TableMetadataPath(database, table)),
+				path.Join("backup1", "shadow", common.TablePath(database, table), "default_all_1_1_0.tar"),
+			)
+		}
+	}
+	return keys
+}
+
+// objectServer - minimal http object storage which keeps objects by decoded request path, enough for PUT, GET and HEAD of S3 and COS clients
+type objectServer struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.objects[r.URL.Path] = body
+		w.Header().Set("ETag", `"etag"`)
+		// COS client verifies uploaded data
+		w.Header().Set("x-cos-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(body, crc64.MakeTable(crc64.ECMA)), 10))
+	case http.MethodGet, http.MethodHead:
+		if strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 0 {
+			// bucket
+			return
+		}
+		body, exists := s.objects[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// assertKeysRoundTrip - upload each key, then check it is stored by expected path, has the same size and content
+func assertKeysRoundTrip(t *testing.T, storage RemoteStorage, server *objectServer, pathPrefix string) {
+	for _, key := range specialTableKeys() {
+		assert.NoError(t, storage.PutFile(key, ioutil.NopCloser(strings.NewReader(key))), key)
+		_, exists := server.objects[path.Join(pathPrefix, key)]
+		assert.True(t, exists, "%s shall be stored as %s", key, path.Join(pathPrefix, key))
+		file, err := storage.StatFile(key)
+		if assert.NoError(t, err, key) {
+			assert.Equal(t, int64(len(key)), file.Size(), key)
+		}
+		r, err := storage.GetFileReader(key)
+		if assert.NoError(t, err, key) {
+			body, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.NoError(t, r.Close())
+			assert.Equal(t, key, string(body))
+		}
+	}
+	assert.Len(t, server.objects, len(specialTableKeys()))
+}
+
+func TestS3SpecialTableKeysRoundTrip(t *testing.T) {
+	server := &objectServer{objects: map[string][]byte{}}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	s := &S3{
+		Config: &config.S3Config{
+			Bucket:         "bucket",
+			Path:           "prefix",
+			Endpoint:       srv.URL,
+			Region:         "us-east-1",
+			AccessKey:      "access",
+			SecretKey:      "secret",
+			ForcePathStyle: true,
+			DisableSSL:     true,
+		},
+		Concurrency: 1,
+		BufferSize:  1024 * 1024,
+		PartSize:    5 * 1024 * 1024,
+	}
+	assert.NoError(t, s.Connect())
+	assertKeysRoundTrip(t, s, server, "/bucket/prefix")
+}
+
+func TestCOSSpecialTableKeysRoundTrip(t *testing.T) {
+	server := &objectServer{objects: map[string][]byte{}}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	c := &COS{
+		Config: &config.COSConfig{
+			RowURL:    srv.URL,
+			Path:      "prefix",
+			Timeout:   "10s",
+			SecretID:  "id",
+			SecretKey: "secret",
+		},
+		PartSize:    5 * 1024 * 1024,
+		Concurrency: 1,
+	}
+	assert.NoError(t, c.Connect())
+	assertKeysRoundTrip(t, c, server, "/prefix")
+}
+
+func TestAzureBlobSpecialTableKeys(t *testing.T) {
+	u, err := url.Parse("https://account.blob.core.windows.net/container")
+	assert.NoError(t, err)
+	container := azblob.NewContainerURL(*u, pipeline.NewPipeline(nil, pipeline.Options{}))
+	for _, key := range specialTableKeys() {
+		blob := container.NewBlockBlobURL(path.Join("prefix", key))
+		blobURL, err := url.Parse(blob.String())
+		assert.NoError(t, err)
+		assert.Equal(t, "/container/prefix/"+key, blobURL.Path)
+	}
+}
+
+func TestSpecialTableKeysUnique(t *testing.T) {
+	// GCS object names, FTP and SFTP file names are used as is, so keys shall be unique and shall not contain path traversal
+	keys := map[string]struct{}{}
+	for _, key := range specialTableKeys() {
+		assert.Equal(t, key, path.Clean(key))
+		assert.NotContains(t, strings.Split(key, "/"), "..")
+		keys[key] = struct{}{}
+	}
+	assert.Len(t, keys, len(specialTableKeys()))
+}
@@ -0,0 +1,45 @@
+package new_storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// newTLSTransport - copy of http.DefaultTransport for endpoints behind internal CA, caCert is path to PEM file or PEM content inline,
+// its certificates are trusted in addition to system ones, server certificate isn't verified when skipVerify is true
+func newTLSTransport(caCert string, skipVerify bool) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caCert != "" {
+		pem, err := readCACert(caCert)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("can't parse ca_cert: no PEM certificates found")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// readCACert - PEM content of ca_cert, which is path to file when it doesn't contain PEM header
+func readCACert(caCert string) ([]byte, error) {
+	if strings.Contains(caCert, "-----BEGIN") {
+		return []byte(caCert), nil
+	}
+	pem, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("can't read ca_cert: %v", err)
+	}
+	return pem, nil
+}
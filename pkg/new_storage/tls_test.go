@@ -0,0 +1,56 @@
+package new_storage
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3CustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, []byte(caPEM), 0600))
+
+	// S3 SDK retries certificate errors, so failure is checked by client of S3 without SDK
+	client, err := (&S3{Config: &config.S3Config{}}).newHTTPClient()
+	assert.NoError(t, err)
+	_, err = client.Get(srv.URL)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate signed by unknown authority")
+	}
+	statFile := func(cfg config.S3Config) error {
+		cfg.Bucket, cfg.Endpoint, cfg.Region, cfg.ForcePathStyle = "bucket", srv.URL, "us-east-1", true
+		cfg.AccessKey, cfg.SecretKey, cfg.HTTPTimeout = "access", "secret", "10s"
+		s := &S3{Config: &cfg, Concurrency: 1, BufferSize: 1024 * 1024, PartSize: 5 * 1024 * 1024}
+		if err := s.Connect(); err != nil {
+			return err
+		}
+		_, err := s.StatFile("backup1/metadata.json")
+		return err
+	}
+	assert.ErrorIs(t, statFile(config.S3Config{CACert: caFile}), ErrNotFound)
+	assert.ErrorIs(t, statFile(config.S3Config{CACert: caPEM, MaxIdleConns: 10}), ErrNotFound)
+	assert.ErrorIs(t, statFile(config.S3Config{DisableCertVerification: true}), ErrNotFound)
+
+	absentFile := path.Join(t.TempDir(), "absent.pem")
+	assert.EqualError(t, statFile(config.S3Config{CACert: absentFile}), "can't create s3 transport: can't read ca_cert: open "+absentFile+": no such file or directory")
+}
+
+func TestNewTLSTransport(t *testing.T) {
+	_, err := newTLSTransport("-----BEGIN CERTIFICATE-----\nbroken\n-----END CERTIFICATE-----\n", false)
+	assert.EqualError(t, err, "can't parse ca_cert: no PEM certificates found")
+	transport, err := newTLSTransport("", true)
+	assert.NoError(t, err)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+	assert.Nil(t, transport.TLSClientConfig.RootCAs, "system CAs are used without ca_cert")
+}
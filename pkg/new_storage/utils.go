@@ -7,28 +7,74 @@ import (
 	"github.com/mholt/archiver/v3"
 )
 
+// GetBackupsToDelete - backups except keep newest ones, except required backups of kept ones and except backups which contain parts referenced by kept ones
 func GetBackupsToDelete(backups []Backup, keep int) []Backup {
 	if len(backups) > keep {
 		sort.SliceStable(backups, func(i, j int) bool {
-			return backups[i].UploadDate.After(backups[j].UploadDate)
+			return backups[i].GetDate().After(backups[j].GetDate())
 		})
 		// KeepRemoteBackups should respect incremental backups, fix https://github.com/AlexAkulov/clickhouse-backup/issues/111
+		kept := append([]Backup{}, backups[:keep]...)
 		deletedBackup := backups[keep:]
 		for _, b := range backups[:keep] {
 			if b.RequiredBackup != "" {
 				for i := range deletedBackup {
 					if b.RequiredBackup == deletedBackup[i].BackupName {
+						kept = append(kept, deletedBackup[i])
 						deletedBackup = append(deletedBackup[:i], deletedBackup[i+1:]...)
 						break
 					}
 				}
 			}
 		}
-		return deletedBackup
+		return withoutReferencedBackups(kept, deletedBackup)
 	}
 	return []Backup{}
 }
 
+// withoutReferencedBackups - exclude from deleted backups which contain parts referenced by kept backups, excluded backup is kept, so its references are kept too
+func withoutReferencedBackups(kept, deleted []Backup) []Backup {
+	deletedByName := make(map[string]Backup, len(deleted))
+	for _, b := range deleted {
+		deletedByName[b.BackupName] = b
+	}
+	referenced := map[string]bool{}
+	for len(kept) > 0 {
+		b := kept[0]
+		kept = kept[1:]
+		for _, name := range b.ReferencedBackups {
+			if referencedBackup, exists := deletedByName[name]; exists && !referenced[name] {
+				referenced[name] = true
+				kept = append(kept, referencedBackup)
+			}
+		}
+	}
+	result := make([]Backup, 0, len(deleted))
+	for _, b := range deleted {
+		if !referenced[b.BackupName] {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// ReferencedBy - names of backups which reference parts uploaded by backupName instead of upload them, such backups can't be downloaded without backupName
+func ReferencedBy(backups []Backup, backupName string) []string {
+	var names []string
+	for _, b := range backups {
+		if b.BackupName == backupName {
+			continue
+		}
+		for _, name := range b.ReferencedBackups {
+			if name == backupName {
+				names = append(names, b.BackupName)
+				break
+			}
+		}
+	}
+	return names
+}
+
 func getArchiveWriter(format string, level int) (archiver.Writer, error) {
 	switch format {
 	case "tar":
@@ -40,7 +86,9 @@ func getArchiveWriter(format string, level int) (archiver.Writer, error) {
 	case "gzip", "gz":
 		return &archiver.TarGz{CompressionLevel: level, Tar: archiver.NewTar()}, nil
 	case "sz":
-		return &archiver.TarSz{Tar: archiver.NewTar()}, nil
+		return NewTarSz(), nil
+	case "s2":
+		return NewTarS2(), nil
 	case "xz":
 		return &archiver.TarXz{Tar: archiver.NewTar()}, nil
 	case "br", "brotli":
@@ -48,7 +96,7 @@ func getArchiveWriter(format string, level int) (archiver.Writer, error) {
 	case "zstd":
 		return &archiver.TarZstd{Tar: archiver.NewTar()}, nil
 	}
-	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'bz2', 'gzip', 'gz', 'sz', 'xz', 'br', 'brotli', 'zstd'", format)
+	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'bz2', 'gzip', 'gz', 'sz', 's2', 'xz', 'br', 'brotli', 'zstd'", format)
 }
 
 func getArchiveReader(format string) (archiver.Reader, error) {
@@ -62,7 +110,9 @@ func getArchiveReader(format string) (archiver.Reader, error) {
 	case "gzip", "gz":
 		return archiver.NewTarGz(), nil
 	case "sz":
-		return archiver.NewTarSz(), nil
+		return NewTarSz(), nil
+	case "s2":
+		return NewTarS2(), nil
 	case "xz":
 		return archiver.NewTarXz(), nil
 	case "br", "brotli":
@@ -70,5 +120,5 @@ func getArchiveReader(format string) (archiver.Reader, error) {
 	case "zstd":
 		return archiver.NewTarZstd(), nil
 	}
-	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'bz2', 'gzip', 'gz', 'sz', 'xz', 'br', 'brotli', 'zstd'", format)
+	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'bz2', 'gzip', 'gz', 'sz', 's2', 'xz', 'br', 'brotli', 'zstd'", format)
 }
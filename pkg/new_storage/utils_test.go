@@ -47,3 +47,26 @@ func TestGetBackupsToDeleteWithRequiredBackup(t *testing.T) {
 	assert.Equal(t, expectedData, GetBackupsToDelete(testData, 3))
 	assert.Equal(t, []Backup{}, GetBackupsToDelete([]Backup{testData[0]}, 3))
 }
+
+func TestGetBackupsToDeleteByCreationDate(t *testing.T) {
+	// "newest" was copied between buckets before "oldest" was re-uploaded, so object modification time contradicts creation date
+	newest := Backup{metadata.BackupMetadata{BackupName: "newest", CreationDate: timeParse("2022-03-03T00-00-00")}, false, "", "", timeParse("2022-03-04T00-00-00")}
+	middle := Backup{metadata.BackupMetadata{BackupName: "middle", CreationDate: timeParse("2022-03-02T00-00-00")}, false, "", "", timeParse("2022-03-05T00-00-00")}
+	oldest := Backup{metadata.BackupMetadata{BackupName: "oldest", CreationDate: timeParse("2022-03-01T00-00-00")}, false, "", "", timeParse("2022-03-06T00-00-00")}
+	legacy := Backup{metadata.BackupMetadata{BackupName: "legacy"}, true, "tar", "", timeParse("2022-02-01T00-00-00")}
+	assert.Equal(t, []Backup{oldest, legacy}, GetBackupsToDelete([]Backup{oldest, newest, legacy, middle}, 2))
+	assert.Equal(t, timeParse("2022-02-01T00-00-00"), legacy.GetDate())
+	assert.Equal(t, timeParse("2022-03-03T00-00-00"), newest.GetDate())
+}
+
+func TestGetBackupsToDeleteWithReferencedBackups(t *testing.T) {
+	full := Backup{metadata.BackupMetadata{BackupName: "full"}, false, "", "", timeParse("2019-03-28T19-50-11")}
+	second := Backup{metadata.BackupMetadata{BackupName: "second", ReferencedBackups: []string{"full"}}, false, "", "", timeParse("2019-03-28T19-50-12")}
+	third := Backup{metadata.BackupMetadata{BackupName: "third", ReferencedBackups: []string{"second"}}, false, "", "", timeParse("2019-03-28T19-50-13")}
+	other := Backup{metadata.BackupMetadata{BackupName: "other"}, false, "", "", timeParse("2019-03-28T19-50-10")}
+	assert.Equal(t, []Backup{other}, GetBackupsToDelete([]Backup{full, second, third, other}, 1), "backups referenced by kept backup and by referenced backup are kept")
+	fourth := Backup{metadata.BackupMetadata{BackupName: "fourth", ReferencedBackups: []string{"full"}}, false, "", "", timeParse("2019-03-28T19-50-14")}
+	assert.Equal(t, []Backup{second, other}, GetBackupsToDelete([]Backup{full, second, other, fourth}, 1), "backup which references kept backup is deleted")
+	assert.Equal(t, []string{"second"}, ReferencedBy([]Backup{full, second, third, other}, "full"))
+	assert.Empty(t, ReferencedBy([]Backup{full, second, third, other}, "third"))
+}
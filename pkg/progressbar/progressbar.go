@@ -7,13 +7,21 @@ import (
 	progressbar "gopkg.in/cheggaaa/pb.v1"
 )
 
+// ForceShow - show progress bar even when stdout is not a terminal, it is set by `force_progress_bar` option
+var ForceShow = false
+
+// shouldShow - progress bar is shown only into terminal, control characters of bar are not written into log files and CI output unless ForceShow is true
+func shouldShow(show bool) bool {
+	return show && (ForceShow || isTerminal())
+}
+
 type Bar struct {
 	pb   *progressbar.ProgressBar
 	show bool
 }
 
 func StartNewByteBar(show bool, total int64) *Bar {
-	if show {
+	if shouldShow(show) {
 		return &Bar{
 			show: true,
 			pb:   progressbar.StartNew(int(total)).SetUnits(progressbar.U_BYTES),
@@ -25,7 +33,7 @@ func StartNewByteBar(show bool, total int64) *Bar {
 }
 
 func StartNewBar(show bool, total int) *Bar {
-	if show {
+	if shouldShow(show) {
 		return &Bar{
 			show: true,
 			pb:   progressbar.StartNew(total),
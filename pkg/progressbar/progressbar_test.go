@@ -0,0 +1,42 @@
+package progressbar
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captureStdout - run f with stdout redirected into regular file, like output of cron job or CI
+func captureStdout(t *testing.T, f func()) string {
+	out, err := os.Create(path.Join(t.TempDir(), "stdout"))
+	assert.NoError(t, err)
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+	f()
+	body, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestByteBarNotTerminal(t *testing.T) {
+	writeBar := func() {
+		bar := StartNewByteBar(true, 1024)
+		bar.Add64(512)
+		bar.Add64(512)
+		bar.Finish()
+		tracker := NewTracker()
+		tracker.Start(true, 10)
+		tracker.Add(10)
+		tracker.Finish()
+	}
+	assert.Empty(t, captureStdout(t, writeBar), "progress bar shall not be written when stdout is not a terminal")
+
+	ForceShow = true
+	defer func() { ForceShow = false }()
+	assert.Contains(t, captureStdout(t, writeBar), "\033[A", "progress bar shall be written when it is forced")
+}
@@ -0,0 +1,205 @@
+package progressbar
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// LogInterval - how often Tracker writes progress into log when progress bar is not shown
+var LogInterval = 30 * time.Second
+
+// Tracker - aggregate progress of all transfers of one operation, total is calculated up front and done bytes are counted when they pass through proxy reader,
+// compressed archives also count transferred bytes which are sent to remote storage after compression
+type Tracker struct {
+	done        int64
+	transferred int64
+	total       int64
+	started     time.Time
+	bar         *Bar
+	stop        chan struct{}
+	stopped     sync.WaitGroup
+	lock        sync.RWMutex
+}
+
+// NewTracker - create tracker which counts bytes but shows nothing until Start
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+// Start - begin new operation with total bytes, show one progress bar when showBar is true and stdout is terminal or ForceShow is true, otherwise write progress into log every LogInterval
+func (t *Tracker) Start(showBar bool, total int64) {
+	if t == nil {
+		return
+	}
+	t.Finish()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	atomic.StoreInt64(&t.done, 0)
+	atomic.StoreInt64(&t.transferred, 0)
+	atomic.StoreInt64(&t.total, total)
+	t.started = time.Now()
+	if shouldShow(showBar) {
+		t.bar = StartNewByteBar(true, total)
+		return
+	}
+	t.stop = make(chan struct{})
+	t.stopped.Add(1)
+	go t.logProgress(t.stop)
+}
+
+func (t *Tracker) logProgress(stop chan struct{}) {
+	defer t.stopped.Done()
+	ticker := time.NewTicker(LogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			apexLog.Info(t.String())
+		}
+	}
+}
+
+// Finish - stop progress bar or progress logging
+func (t *Tracker) Finish() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if t.bar != nil {
+		t.bar.Finish()
+		t.bar = nil
+	}
+	stop := t.stop
+	t.stop = nil
+	t.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		t.stopped.Wait()
+	}
+}
+
+// Add - count transferred bytes
+func (t *Tracker) Add(n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&t.done, n)
+	t.lock.RLock()
+	if t.bar != nil {
+		t.bar.Add64(n)
+	}
+	t.lock.RUnlock()
+}
+
+// AddTransferred - count bytes of compressed stream which are sent to remote storage, the same files are counted by Add before compression
+func (t *Tracker) AddTransferred(n int64) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.transferred, n)
+}
+
+// NewProxyReader - return reader which counts bytes read from r
+func (t *Tracker) NewProxyReader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &trackerReader{Reader: r, tracker: t}
+}
+
+type trackerReader struct {
+	io.Reader
+	tracker *Tracker
+}
+
+func (r *trackerReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.Add(int64(n))
+	return n, err
+}
+
+// Progress - return transferred and total bytes
+func (t *Tracker) Progress() (int64, int64) {
+	if t == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&t.done), atomic.LoadInt64(&t.total)
+}
+
+// Transferred - compressed bytes sent to remote storage and compression ratio of done bytes to them, both are 0 when nothing was compressed
+func (t *Tracker) Transferred() (int64, float64) {
+	if t == nil {
+		return 0, 0
+	}
+	done, transferred := atomic.LoadInt64(&t.done), atomic.LoadInt64(&t.transferred)
+	if transferred == 0 {
+		return 0, 0
+	}
+	return transferred, float64(done) / float64(transferred)
+}
+
+// String - return progress like `42% 512.00GiB/1.20TiB, 210.00MiB/s, ETA 1h02m, transferred 200.00GiB, ratio 2.56`, empty string when tracker wasn't started
+func (t *Tracker) String() string {
+	if t == nil {
+		return ""
+	}
+	t.lock.RLock()
+	started := t.started
+	t.lock.RUnlock()
+	if started.IsZero() {
+		return ""
+	}
+	done, total := t.Progress()
+	return formatProgress(done, total, atomic.LoadInt64(&t.transferred), time.Since(started))
+}
+
+// formatProgress - percent, speed and ETA are calculated by done bytes in the same units as total, which is the size of local files for upload,
+// compressed bytes are never compared with uncompressed total, they are shown with running compression ratio when archives are compressed
+func formatProgress(done, total, transferred int64, elapsed time.Duration) string {
+	percent := int64(100)
+	if total > 0 && done < total {
+		percent = done * 100 / total
+	}
+	var speed int64
+	if elapsed > 0 {
+		speed = int64(float64(done) / elapsed.Seconds())
+	}
+	eta := "unknown"
+	if speed > 0 && total >= done {
+		eta = formatETA(time.Duration(float64(total-done) / float64(speed) * float64(time.Second)))
+	}
+	progress := fmt.Sprintf("%d%% %s/%s, %s/s, ETA %s", percent, utils.FormatBytes(uint64(done)), utils.FormatBytes(uint64(total)), utils.FormatBytes(uint64(speed)), eta)
+	if transferred > 0 {
+		progress += fmt.Sprintf(", transferred %s, ratio %.2f", utils.FormatBytes(uint64(transferred)), float64(done)/float64(transferred))
+	}
+	return progress
+}
+
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	hours := d / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+	switch {
+	case hours > 0:
+		return fmt.Sprintf("%dh%02dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm%02ds", minutes, seconds)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,46 @@
+package progressbar
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatProgress(t *testing.T) {
+	assert.Equal(t, "50% 1.00KiB/2.00KiB, 512B/s, ETA 2s", formatProgress(1024, 2048, 0, 2*time.Second))
+	assert.Equal(t, "50% 1.00KiB/2.00KiB, 512B/s, ETA 2s, transferred 256B, ratio 4.00", formatProgress(1024, 2048, 256, 2*time.Second))
+	assert.Equal(t, "100% 0B/0B, 0B/s, ETA unknown", formatProgress(0, 0, 0, 0))
+	assert.Equal(t, "1h02m", formatETA(time.Hour+2*time.Minute+10*time.Second))
+	assert.Equal(t, "3m05s", formatETA(3*time.Minute+5*time.Second))
+}
+
+func TestTrackerProxyReader(t *testing.T) {
+	tracker := NewTracker()
+	assert.Equal(t, "", tracker.String())
+	tracker.Start(false, 10)
+	data, err := ioutil.ReadAll(tracker.NewProxyReader(strings.NewReader("12345")))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(data))
+	tracker.Finish()
+	done, total := tracker.Progress()
+	assert.Equal(t, int64(5), done)
+	assert.Equal(t, int64(10), total)
+	assert.True(t, strings.HasPrefix(tracker.String(), "50% 5B/10B"))
+	transferred, ratio := tracker.Transferred()
+	assert.Equal(t, int64(0), transferred)
+	assert.Equal(t, float64(0), ratio)
+	tracker.AddTransferred(2)
+	transferred, ratio = tracker.Transferred()
+	assert.Equal(t, int64(2), transferred)
+	assert.Equal(t, 2.5, ratio)
+	assert.True(t, strings.HasSuffix(tracker.String(), "transferred 2B, ratio 2.50"))
+
+	var nilTracker *Tracker
+	nilTracker.Start(false, 1)
+	nilTracker.Add(1)
+	nilTracker.AddTransferred(1)
+	assert.Equal(t, "", nilTracker.String())
+}
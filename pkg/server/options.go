@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// requestOptions - query arguments together with fields of JSON object from body of request with `Content-Type: application/json`,
+// strings, numbers and booleans are converted to argument values, arrays to repeated arguments
+func requestOptions(r *http.Request) (url.Values, error) {
+	values := r.URL.Query()
+	if r.Body == nil {
+		return values, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return values, nil
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("can't parse JSON body: %v", err)
+	}
+	for name, value := range body {
+		items, isArray := value.([]interface{})
+		if !isArray {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			switch v := item.(type) {
+			case string:
+				values.Add(name, v)
+			case bool, float64:
+				values.Add(name, fmt.Sprint(v))
+			default:
+				return nil, fmt.Errorf("can't parse JSON body: unsupported value of '%s'", name)
+			}
+		}
+	}
+	return values, nil
+}
+
+// queryOptions - backup.OptionsSource for arguments of request, `-` in CLI flag name is `_` in argument name,
+// argument without value is true, values which aren't boolean are reported by err
+type queryOptions struct {
+	values url.Values
+	err    error
+}
+
+func (q *queryOptions) lookup(name string) ([]string, bool) {
+	if values, exists := q.values[name]; exists {
+		return values, true
+	}
+	values, exists := q.values[strings.ReplaceAll(name, "-", "_")]
+	return values, exists
+}
+
+func (q *queryOptions) String(name string) string {
+	values, _ := q.lookup(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (q *queryOptions) StringSlice(name string) []string {
+	values, _ := q.lookup(name)
+	return values
+}
+
+func (q *queryOptions) Bool(name string) bool {
+	values, exists := q.lookup(name)
+	if !exists {
+		return false
+	}
+	if len(values) == 0 || values[0] == "" {
+		return true
+	}
+	value, err := strconv.ParseBool(values[0])
+	if err != nil && q.err == nil {
+		q.err = fmt.Errorf("can't parse %s: %v", strings.ReplaceAll(name, "-", "_"), err)
+	}
+	return value
+}
+
+// commandWithArgs - command of API status with CLI flags of its options
+func commandWithArgs(command, args string) string {
+	if args == "" {
+		return command
+	}
+	return command + " " + args
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/gorilla/mux"
+)
+
+// progressEventInterval - how often progress of operation is checked by httpOperationProgressHandler
+var progressEventInterval = time.Second
+
+// operationLogsBuffer - log entries which wait for slow client of progress stream, newer entries are dropped when buffer is full
+const operationLogsBuffer = 1024
+
+// operationLogs - log handler which passes each entry to handler of config and to subscribers of its `operation_id` field
+type operationLogs struct {
+	sync.RWMutex
+	handler     apexLog.Handler
+	subscribers map[string]map[chan *apexLog.Entry]struct{}
+}
+
+func newOperationLogs() *operationLogs {
+	return &operationLogs{subscribers: map[string]map[chan *apexLog.Entry]struct{}{}}
+}
+
+// wrap - config.WrapLogHandler, handler is replaced on each config load, so it is kept inside
+func (l *operationLogs) wrap(handler apexLog.Handler) apexLog.Handler {
+	l.Lock()
+	defer l.Unlock()
+	l.handler = handler
+	return l
+}
+
+// HandleLog - log.Handler, logging is never blocked by subscribers
+func (l *operationLogs) HandleLog(e *apexLog.Entry) error {
+	l.RLock()
+	handler := l.handler
+	if operationID, ok := e.Fields["operation_id"].(string); ok {
+		for entries := range l.subscribers[operationID] {
+			select {
+			case entries <- e:
+			default:
+			}
+		}
+	}
+	l.RUnlock()
+	if handler == nil {
+		return nil
+	}
+	return handler.HandleLog(e)
+}
+
+// subscribe - receive log entries of operation until returned function is called
+func (l *operationLogs) subscribe(operationID string) (<-chan *apexLog.Entry, func()) {
+	entries := make(chan *apexLog.Entry, operationLogsBuffer)
+	l.Lock()
+	defer l.Unlock()
+	if l.subscribers[operationID] == nil {
+		l.subscribers[operationID] = map[chan *apexLog.Entry]struct{}{}
+	}
+	l.subscribers[operationID][entries] = struct{}{}
+	return entries, func() {
+		l.Lock()
+		defer l.Unlock()
+		delete(l.subscribers[operationID], entries)
+		if len(l.subscribers[operationID]) == 0 {
+			delete(l.subscribers, operationID)
+		}
+	}
+}
+
+// progressEvent - data of `progress` event, the same bytes as progress bar of CLI
+type progressEvent struct {
+	Done     int64  `json:"done"`
+	Total    int64  `json:"total"`
+	Progress string `json:"progress"`
+}
+
+// logEvent - data of `log` event
+type logEvent struct {
+	Timestamp string                 `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+func newLogEvent(e *apexLog.Entry) logEvent {
+	fields := make(map[string]interface{}, len(e.Fields))
+	for name, value := range e.Fields {
+		if err, isError := value.(error); isError {
+			value = err.Error()
+		}
+		fields[name] = value
+	}
+	return logEvent{
+		Timestamp: e.Timestamp.Format(APITimeFormat),
+		Level:     e.Level.String(),
+		Message:   e.Message,
+		Fields:    fields,
+	}
+}
+
+// doneEvent - data of terminal `done` event
+type doneEvent struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Finish string `json:"finish,omitempty"`
+}
+
+// httpOperationProgressHandler - server-sent events of operation: `progress` with transferred bytes of upload or download,
+// `log` with log lines of operation and `done` with its status, stream is closed after `done`
+func (api *APIServer) httpOperationProgressHandler(w http.ResponseWriter, r *http.Request) {
+	operationID := mux.Vars(r)["operation_id"]
+	if _, exists := api.status.operation(operationID); !exists {
+		writeError(w, http.StatusNotFound, "operation", fmt.Errorf("operation '%s' not found", operationID))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "operation", fmt.Errorf("streaming isn't supported"))
+		return
+	}
+	var entries <-chan *apexLog.Entry
+	if api.logs != nil {
+		var unsubscribe func()
+		entries, unsubscribe = api.logs.subscribe(operationID)
+		defer unsubscribe()
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	ticker := time.NewTicker(progressEventInterval)
+	defer ticker.Stop()
+	var lastProgress progressEvent
+	for {
+		row, _ := api.status.operation(operationID)
+		if row.progressBytes != nil && row.Progress != "" {
+			event := progressEvent{Progress: row.Progress}
+			event.Done, event.Total = row.progressBytes()
+			if event != lastProgress {
+				if err := writeEvent(w, "progress", event); err != nil {
+					return
+				}
+				lastProgress = event
+			}
+		}
+		if row.Status != InProgressText {
+			for drained := false; !drained; {
+				select {
+				case e := <-entries:
+					if err := writeEvent(w, "log", newLogEvent(e)); err != nil {
+						return
+					}
+				default:
+					drained = true
+				}
+			}
+			_ = writeEvent(w, "done", doneEvent{Status: row.Status, Error: row.Error, Finish: row.Finish})
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-entries:
+			if err := writeEvent(w, "log", newLogEvent(e)); err != nil {
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	return err
+}
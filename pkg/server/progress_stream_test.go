@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/progressbar"
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents - read events of stream until it is closed
+func readEvents(t *testing.T, url string, events chan<- sseEvent) {
+	defer close(events)
+	resp, err := http.Get(url)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	var event sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events <- event
+			event = sseEvent{}
+		}
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent, name string) sseEvent {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("stream is closed before %s event", name)
+			}
+			if event.name == name {
+				return event
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s event isn't received", name)
+		}
+	}
+}
+
+func TestOperationProgressStream(t *testing.T) {
+	progressEventInterval = 10 * time.Millisecond
+	logs := newOperationLogs()
+	apexLog.SetHandler(logs.wrap(discard.New()))
+	defer apexLog.SetHandler(discard.New())
+	api := &APIServer{config: config.DefaultConfig(), status: &AsyncStatus{}, logs: logs}
+	server := httptest.NewServer(api.setupAPIServer().Handler)
+	defer server.Close()
+
+	tracker := progressbar.NewTracker()
+	tracker.Start(false, 100)
+	defer tracker.Finish()
+	commandId := api.status.startOperation("upload test", "0123abcd")
+	api.status.setProgress(commandId, tracker.String)
+	api.status.setProgressBytes(commandId, tracker.Progress)
+
+	events := make(chan sseEvent)
+	go readEvents(t, server.URL+"/operation/0123abcd/progress", events)
+	tracker.Add(42)
+	var progress progressEvent
+	for progress.Done != 42 {
+		assert.NoError(t, json.Unmarshal([]byte(nextEvent(t, events, "progress").data), &progress))
+	}
+	assert.Equal(t, int64(100), progress.Total)
+	assert.Contains(t, progress.Progress, "42% 42B/100B")
+
+	apexLog.WithField("operation_id", "other").Info("skipped")
+	apexLog.WithField("operation_id", "0123abcd").WithError(errors.New("timeout")).Warn("retry upload")
+	var logLine logEvent
+	assert.NoError(t, json.Unmarshal([]byte(nextEvent(t, events, "log").data), &logLine))
+	assert.Equal(t, "retry upload", logLine.Message)
+	assert.Equal(t, "warn", logLine.Level)
+	assert.Equal(t, "timeout", logLine.Fields["error"])
+
+	api.status.stop(commandId, errors.New("can't upload"))
+	var done doneEvent
+	assert.NoError(t, json.Unmarshal([]byte(nextEvent(t, events, "done").data), &done))
+	assert.Equal(t, "error", done.Status)
+	assert.Equal(t, "can't upload", done.Error)
+	_, open := <-events
+	assert.False(t, open, "stream shall be closed after done event")
+
+	// finished operation returns done event right away
+	events = make(chan sseEvent)
+	go readEvents(t, server.URL+"/backup/operation/0123abcd/progress", events)
+	assert.Equal(t, "done", nextEvent(t, events, "done").name)
+	assert.Eventually(t, func() bool {
+		logs.RLock()
+		defer logs.RUnlock()
+		return len(logs.subscribers) == 0
+	}, 10*time.Second, 10*time.Millisecond, "subscribers of closed streams shall be removed")
+
+	resp, err := http.Get(server.URL + "/operation/absent/progress")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, resp.Body.Close())
+}
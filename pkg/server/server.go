@@ -23,6 +23,7 @@ import (
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/backup"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 
 	apexLog "github.com/apex/log"
 	"github.com/google/shlex"
@@ -48,6 +49,7 @@ type APIServer struct {
 	metrics                 Metrics
 	routes                  []string
 	clickhouseBackupVersion string
+	logs                    *operationLogs
 }
 
 type AsyncStatus struct {
@@ -56,11 +58,20 @@ type AsyncStatus struct {
 }
 
 type ActionRow struct {
-	Command string `json:"command"`
-	Status  string `json:"status"`
-	Start   string `json:"start,omitempty"`
-	Finish  string `json:"finish,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Command     string `json:"command"`
+	Status      string `json:"status"`
+	Start       string `json:"start,omitempty"`
+	Finish      string `json:"finish,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Progress    string `json:"progress,omitempty"`
+	OperationID string `json:"operation_id,omitempty"`
+	// Tables - durations and sizes of tables which were processed by running create or upload
+	Tables []metadata.TableStats `json:"tables,omitempty"`
+	// Options - options of create, upload, download or restore resolved from query arguments and JSON body
+	Options       interface{} `json:"options,omitempty"`
+	progress      func() string
+	progressBytes func() (int64, int64)
+	tableStats    func() []metadata.TableStats
 }
 
 func (status *AsyncStatus) start(command string) int {
@@ -76,16 +87,43 @@ func (status *AsyncStatus) start(command string) int {
 	return lastCommandId
 }
 
-func (status *AsyncStatus) inProgress() bool {
-	status.RLock()
-	defer status.RUnlock()
-	n := len(status.commands) - 1
-	if n < 0 {
-		apexLog.Debugf("api.status.inProgress -> len(status.commands)=%d, inProgress=false", len(status.commands))
+// locked - new command can't be started, without allowParallel only one command runs at a time,
+// with allowParallel up to maxParallel commands run at a time, 0 means no limit, caller shall hold the lock of status
+func (status *AsyncStatus) locked(allowParallel bool, maxParallel int) bool {
+	if !allowParallel {
+		n := len(status.commands) - 1
+		return n >= 0 && status.commands[n].Status == InProgressText
+	}
+	if maxParallel <= 0 {
 		return false
 	}
-	apexLog.Debugf("api.status.inProgress -> status.commands[n].Status == %s, inProgress=%v", status.commands[n].Status, status.commands[n].Status == InProgressText)
-	return status.commands[n].Status == InProgressText
+	running := 0
+	for _, command := range status.commands {
+		if command.Status == InProgressText {
+			running++
+		}
+	}
+	return running >= maxParallel
+}
+
+// tryStartOperation - start command with operation_id when it isn't locked, check and start are done under one lock,
+// so concurrent requests can't start more commands than allowed, false when command isn't started
+func (status *AsyncStatus) tryStartOperation(command, operationID string, allowParallel bool, maxParallel int) (int, bool) {
+	status.Lock()
+	defer status.Unlock()
+	if status.locked(allowParallel, maxParallel) {
+		apexLog.Debugf("api.status.tryStartOperation -> %s is locked", command)
+		return -1, false
+	}
+	status.commands = append(status.commands, ActionRow{
+		Command:     command,
+		Start:       time.Now().Format(APITimeFormat),
+		Status:      InProgressText,
+		OperationID: operationID,
+	})
+	lastCommandId := len(status.commands) - 1
+	apexLog.Debugf("api.status.tryStartOperation -> status.commands[%d] == %v", lastCommandId, status.commands[lastCommandId])
+	return lastCommandId, true
 }
 
 func (status *AsyncStatus) stop(commandId int, err error) {
@@ -97,10 +135,131 @@ func (status *AsyncStatus) stop(commandId int, err error) {
 		status.commands[commandId].Error = err.Error()
 	}
 	status.commands[commandId].Status = s
+	status.commands[commandId].progress = nil
+	status.commands[commandId].tableStats = nil
 	status.commands[commandId].Finish = time.Now().Format(APITimeFormat)
 	apexLog.Debugf("api.status.stop -> status.commands[%d] == %v", commandId, status.commands[commandId])
 }
 
+// loadBackupLog - operations of this host from backup_log_table are loaded into history on start, so history survives restarts,
+// operations which are executed later are added by start and stop as before
+func (status *AsyncStatus) loadBackupLog(cfg *config.Config) {
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		apexLog.Warnf("can't load history from %s: %v", cfg.General.BackupLogTable, err)
+		return
+	}
+	defer ch.Close()
+	if err := ch.CreateBackupLogTable(cfg.General.BackupLogTable); err != nil {
+		apexLog.Warnf("can't create %s: %v", cfg.General.BackupLogTable, err)
+		return
+	}
+	host, _ := os.Hostname()
+	rows, err := ch.GetBackupLog(cfg.General.BackupLogTable, host, backupLogHistoryLimit)
+	if err != nil {
+		apexLog.Warnf("can't load history from %s: %v", cfg.General.BackupLogTable, err)
+		return
+	}
+	status.Lock()
+	defer status.Unlock()
+	history := make([]ActionRow, 0, len(rows)+len(status.commands))
+	for _, row := range rows {
+		history = append(history, ActionRow{
+			Command: strings.TrimSpace(row.Operation + " " + row.BackupName),
+			Status:  row.Status,
+			Start:   row.Start.Format(APITimeFormat),
+			Finish:  row.Finish.Format(APITimeFormat),
+			Error:   row.Error,
+		})
+	}
+	status.commands = append(history, status.commands...)
+	apexLog.Debugf("api.status.loadBackupLog -> %d commands loaded from %s", len(rows), cfg.General.BackupLogTable)
+}
+
+// startOperation - start command with operation_id in one step
+func (status *AsyncStatus) startOperation(command, operationID string) int {
+	commandId := status.start(command)
+	status.setOperationID(commandId, operationID)
+	return commandId
+}
+
+// runningCount - count of commands which are in progress
+func (status *AsyncStatus) runningCount() int {
+	status.RLock()
+	defer status.RUnlock()
+	count := 0
+	for _, command := range status.commands {
+		if command.Status == InProgressText {
+			count++
+		}
+	}
+	return count
+}
+
+// operation - the last command with operationID, false when there is no such command
+func (status *AsyncStatus) operation(operationID string) (ActionRow, bool) {
+	status.RLock()
+	defer status.RUnlock()
+	for i := len(status.commands) - 1; i >= 0; i-- {
+		if status.commands[i].OperationID == operationID {
+			row := status.commands[i]
+			row.fillRunning()
+			return row, true
+		}
+	}
+	return ActionRow{}, false
+}
+
+// fillRunning - current progress and stats of tables of running command
+func (row *ActionRow) fillRunning() {
+	if row.Status != InProgressText {
+		return
+	}
+	if row.progress != nil {
+		row.Progress = row.progress()
+	}
+	if row.tableStats != nil {
+		row.Tables = row.tableStats()
+	}
+}
+
+// setOperationID - operation_id of command is the same as `operation_id` field in its logs
+func (status *AsyncStatus) setOperationID(commandId int, operationID string) {
+	status.Lock()
+	defer status.Unlock()
+	status.commands[commandId].OperationID = operationID
+}
+
+// setProgress - register function which returns current progress of running command
+func (status *AsyncStatus) setProgress(commandId int, progress func() string) {
+	status.Lock()
+	defer status.Unlock()
+	status.commands[commandId].progress = progress
+}
+
+// setOptions - resolved options of command which are returned in its status
+func (status *AsyncStatus) setOptions(commandId int, options interface{}) {
+	status.Lock()
+	defer status.Unlock()
+	status.commands[commandId].Options = options
+}
+
+// setProgressBytes - register function which returns transferred and total bytes of running command
+func (status *AsyncStatus) setProgressBytes(commandId int, progressBytes func() (int64, int64)) {
+	status.Lock()
+	defer status.Unlock()
+	status.commands[commandId].progressBytes = progressBytes
+}
+
+// setTableStats - register function which returns stats of tables processed by running command
+func (status *AsyncStatus) setTableStats(commandId int, tableStats func() []metadata.TableStats) {
+	status.Lock()
+	defer status.Unlock()
+	status.commands[commandId].tableStats = tableStats
+}
+
 func (status *AsyncStatus) status(current bool, filter string, last int) []ActionRow {
 	status.RLock()
 	defer status.RUnlock()
@@ -135,19 +294,29 @@ func (status *AsyncStatus) status(current bool, filter string, last int) []Actio
 		begin = 0
 		end = l
 	}
-	return (*commands)[begin:end]
+	rows := make([]ActionRow, end-begin)
+	copy(rows, (*commands)[begin:end])
+	for i := range rows {
+		rows[i].fillRunning()
+	}
+	return rows
 }
 
 var (
 	ErrAPILocked = errors.New("another operation is currently running")
 )
 
+// backupLogHistoryLimit - count of last operations which are loaded from backup_log_table on start
+const backupLogHistoryLimit = 1000
+
 // Server - expose CLI commands as REST API
 func Server(c *cli.App, configPath string, clickhouseBackupVersion string) error {
 	var (
 		cfg *config.Config
 		err error
 	)
+	logs := newOperationLogs()
+	config.WrapLogHandler = logs.wrap
 	apexLog.Debug("Wait for ClickHouse")
 	for {
 		cfg, err = config.LoadConfig(configPath)
@@ -174,6 +343,10 @@ func Server(c *cli.App, configPath string, clickhouseBackupVersion string) error
 		restart:                 make(chan struct{}),
 		status:                  &AsyncStatus{},
 		clickhouseBackupVersion: clickhouseBackupVersion,
+		logs:                    logs,
+	}
+	if cfg.General.BackupLogTable != "" {
+		api.status.loadBackupLog(cfg)
 	}
 	if cfg.API.CreateIntegrationTables {
 		if err := api.CreateIntegrationTables(); err != nil {
@@ -260,6 +433,7 @@ func (api *APIServer) setupAPIServer() *http.Server {
 	r.HandleFunc("/", api.httpRestartHandler).Methods("POST")
 	r.HandleFunc("/backup/tables", api.httpTablesHandler).Methods("GET")
 	r.HandleFunc("/backup/tables/all", api.httpTablesHandler).Methods("GET")
+	r.HandleFunc("/backup/estimate", api.httpEstimateHandler).Methods("GET")
 	r.HandleFunc("/backup/list", api.httpListHandler).Methods("GET")
 	r.HandleFunc("/backup/list/{where}", api.httpListHandler).Methods("GET")
 	r.HandleFunc("/backup/create", api.httpCreateHandler).Methods("POST")
@@ -267,8 +441,12 @@ func (api *APIServer) setupAPIServer() *http.Server {
 	r.HandleFunc("/backup/upload/{name}", api.httpUploadHandler).Methods("POST")
 	r.HandleFunc("/backup/download/{name}", api.httpDownloadHandler).Methods("POST")
 	r.HandleFunc("/backup/restore/{name}", api.httpRestoreHandler).Methods("POST")
+	r.HandleFunc("/backup/delete/{where}", api.httpDeleteHandler).Methods("POST")
 	r.HandleFunc("/backup/delete/{where}/{name}", api.httpDeleteHandler).Methods("POST")
 	r.HandleFunc("/backup/status", api.httpBackupStatusHandler).Methods("GET")
+	r.HandleFunc("/backup/operation/{operation_id}", api.httpOperationHandler).Methods("GET")
+	r.HandleFunc("/backup/operation/{operation_id}/progress", api.httpOperationProgressHandler).Methods("GET")
+	r.HandleFunc("/operation/{operation_id}/progress", api.httpOperationProgressHandler).Methods("GET")
 
 	r.HandleFunc("/backup/actions", api.actionsLog).Methods("GET")
 	r.HandleFunc("/backup/actions", api.actions).Methods("POST")
@@ -346,7 +524,8 @@ func (api *APIServer) actions(w http.ResponseWriter, r *http.Request) {
 		command := args[0]
 		switch command {
 		case "create", "restore", "upload", "download", "create_remote", "restore_remote":
-			if !api.config.API.AllowParallel && api.status.inProgress() {
+			commandId, started := api.tryStartOperation(row.Command, "")
+			if !started {
 				apexLog.Info(ErrAPILocked.Error())
 				writeError(w, http.StatusLocked, row.Command, ErrAPILocked)
 				return
@@ -359,7 +538,6 @@ func (api *APIServer) actions(w http.ResponseWriter, r *http.Request) {
 					api.metrics.LastFinish[command].Set(float64(time.Now().Unix()))
 				}()
 
-				commandId := api.status.start(row.Command)
 				err := api.c.Run(append([]string{"clickhouse-backup", "-c", api.configPath}, args...))
 				defer api.status.stop(commandId, err)
 				if err != nil {
@@ -385,12 +563,17 @@ func (api *APIServer) actions(w http.ResponseWriter, r *http.Request) {
 			})
 			return
 		case "delete":
-			if !api.config.API.AllowParallel && api.status.inProgress() {
+			// server can't answer interactive confirmation
+			if (strings.Contains(row.Command, "--pattern") || strings.Contains(row.Command, "--older-than")) && !strings.Contains(row.Command, "--confirm") {
+				writeError(w, http.StatusBadRequest, row.Command, fmt.Errorf("--confirm is required to delete backups by --pattern or --older-than"))
+				return
+			}
+			commandId, started := api.tryStartOperation(row.Command, "")
+			if !started {
 				apexLog.Info(ErrAPILocked.Error())
 				writeError(w, http.StatusLocked, row.Command, ErrAPILocked)
 				return
 			}
-			commandId := api.status.start(row.Command)
 			err := api.c.Run(append([]string{"clickhouse-backup", "-c", api.configPath}, args...))
 			api.status.stop(commandId, err)
 			if err != nil {
@@ -399,8 +582,12 @@ func (api *APIServer) actions(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			apexLog.Info("OK")
+			isLocal := false
+			for _, arg := range args[1:] {
+				isLocal = isLocal || arg == "local"
+			}
 			go func() {
-				if err := api.updateSizeOfLastBackup(args[1] == "local"); err != nil {
+				if err := api.updateSizeOfLastBackup(isLocal); err != nil {
 					apexLog.Errorf("updateSizeOfLastBackup return error: %v", err)
 				}
 			}()
@@ -479,6 +666,25 @@ func (api *APIServer) httpTablesHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+// httpEstimateHandler - expected size of data which create would backup for tables matched by optional `table` query argument
+func (api *APIServer) httpEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := config.LoadConfig(api.configPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "estimate", err)
+		return
+	}
+	tablePattern := ""
+	if tp, exist := r.URL.Query()["table"]; exist {
+		tablePattern = strings.Join(tp, ",")
+	}
+	estimate, err := backup.EstimateBackupSize(cfg, tablePattern)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "estimate", err)
+		return
+	}
+	sendJSONEachRow(w, http.StatusOK, estimate)
+}
+
 func (api *APIServer) getTablesWithSkip(tables []clickhouse.Table) []clickhouse.Table {
 	showCounts := 0
 	for _, t := range tables {
@@ -571,64 +777,59 @@ func (api *APIServer) httpListHandler(w http.ResponseWriter, r *http.Request) {
 
 // httpCreateHandler - create a backup
 func (api *APIServer) httpCreateHandler(w http.ResponseWriter, r *http.Request) {
-	if !api.config.API.AllowParallel && api.status.inProgress() {
-		apexLog.Info(ErrAPILocked.Error())
-		writeError(w, http.StatusLocked, "create", ErrAPILocked)
-		return
-	}
 	cfg, err := config.LoadConfig(api.configPath)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "create", err)
 		return
 	}
-	tablePattern := ""
-	partitionsToBackup := make([]string, 0)
-	backupName := backup.NewBackupName()
-	schemaOnly := false
-	rbacOnly := false
-	configsOnly := false
-	fullCommand := "create"
-	query := r.URL.Query()
-	if tp, exist := query["table"]; exist {
-		tablePattern = tp[0]
-		fullCommand = fmt.Sprintf("%s --tables=\"%s\"", fullCommand, tablePattern)
-	}
-	if partitions, exist := query["partitions"]; exist {
-		partitionsToBackup = strings.Split(partitions[0], ",")
-		fullCommand = fmt.Sprintf("%s --partitions=\"%s\"", fullCommand, partitions)
-	}
-	if schema, exist := query["schema"]; exist {
-		schemaOnly, _ = strconv.ParseBool(schema[0])
-		if schemaOnly {
-			fullCommand = fmt.Sprintf("%s --schema", fullCommand)
-		}
+	query, err := requestOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "create", err)
+		return
 	}
-	if rbac, exist := query["rbac"]; exist {
-		rbacOnly, _ = strconv.ParseBool(rbac[0])
-		if rbacOnly {
-			fullCommand = fmt.Sprintf("%s --rbac", fullCommand)
-		}
+	src := &queryOptions{values: query}
+	options, err := backup.ParseCreateOptions(src)
+	if src.err != nil {
+		err = src.err
 	}
-	if configs, exist := query["configs"]; exist {
-		configsOnly, _ = strconv.ParseBool(configs[0])
-		if configsOnly {
-			fullCommand = fmt.Sprintf("%s --configs", fullCommand)
-		}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "create", err)
+		return
+	}
+	backupName := ""
+	fullCommand := commandWithArgs("create", options.Args())
+	if fullCommand, err = setTimeoutsFromQuery(cfg, query, fullCommand); err != nil {
+		writeError(w, http.StatusBadRequest, "create", err)
+		return
 	}
 	if name, exist := query["name"]; exist {
 		backupName = name[0]
 		fullCommand = fmt.Sprintf("%s %s", fullCommand, backupName)
+	} else if backupName, err = backup.ResolveBackupName(cfg, false); err != nil {
+		writeError(w, http.StatusInternalServerError, "create", err)
+		return
 	}
 
+	operationID := backup.NewOperationID()
+	// operation is registered before response, so it could be polled by operation_id right away
+	commandId, started := api.tryStartOperation(fullCommand, operationID)
+	if !started {
+		apexLog.Info(ErrAPILocked.Error())
+		writeError(w, http.StatusLocked, "create", ErrAPILocked)
+		return
+	}
+	api.status.setOptions(commandId, options)
 	go func() {
-		commandId := api.status.start(fullCommand)
 		start := time.Now()
 		api.metrics.LastStart["create"].Set(float64(start.Unix()))
 		defer func() {
 			api.metrics.LastDuration["create"].Set(float64(time.Since(start).Nanoseconds()))
 			api.metrics.LastFinish["create"].Set(float64(time.Now().Unix()))
 		}()
-		err := backup.CreateBackup(cfg, backupName, tablePattern, partitionsToBackup, schemaOnly, rbacOnly, configsOnly, api.clickhouseBackupVersion)
+		b := backup.NewBackuper(cfg)
+		b.OperationID = operationID
+		api.status.setTableStats(commandId, b.TableStats)
+		err := b.CreateBackup(backupName, options.Tables, options.Partitions, options.Schema, options.RBAC, options.Configs, options.IncludeDetached, options.ChangedSince, api.clickhouseBackupVersion)
 		defer api.status.stop(commandId, err)
 		if err != nil {
 			api.metrics.FailedCounter["create"].Inc()
@@ -643,81 +844,96 @@ func (api *APIServer) httpCreateHandler(w http.ResponseWriter, r *http.Request)
 		api.metrics.LastStatus["create"].Set(1)
 	}()
 	sendJSONEachRow(w, http.StatusCreated, struct {
-		Status     string `json:"status"`
-		Operation  string `json:"operation"`
-		BackupName string `json:"backup_name"`
+		Status      string               `json:"status"`
+		Operation   string               `json:"operation"`
+		BackupName  string               `json:"backup_name"`
+		OperationID string               `json:"operation_id"`
+		Options     backup.CreateOptions `json:"options"`
 	}{
-		Status:     "acknowledged",
-		Operation:  "create",
-		BackupName: backupName,
+		Status:      "acknowledged",
+		Operation:   "create",
+		BackupName:  backupName,
+		OperationID: operationID,
+		Options:     options,
 	})
 }
 
-// httpCleanHandler - clean ./shadow directory
-func (api *APIServer) httpCleanHandler(w http.ResponseWriter, _ *http.Request) {
-	commandId := api.status.start("clean")
-	err := backup.Clean(api.config)
+// httpCleanHandler - clean ./shadow directory and remove broken local backups when remove_broken=true
+func (api *APIServer) httpCleanHandler(w http.ResponseWriter, r *http.Request) {
+	removeBroken := false
+	fullCommand := "clean"
+	if rb, exist := r.URL.Query()["remove_broken"]; exist {
+		removeBroken, _ = strconv.ParseBool(rb[0])
+		if removeBroken {
+			fullCommand = fmt.Sprintf("%s --remove-broken", fullCommand)
+		}
+	}
+	commandId, started := api.tryStartOperation(fullCommand, "")
+	if !started {
+		apexLog.Info(ErrAPILocked.Error())
+		writeError(w, http.StatusLocked, "clean", ErrAPILocked)
+		return
+	}
+	removed, err := backup.Clean(api.config, removeBroken)
 	api.status.stop(commandId, err)
 	if err != nil {
 		log.Printf("Clean error: %+v\n", err)
 		writeError(w, http.StatusInternalServerError, "clean", err)
 		return
 	}
+	if removed == nil {
+		removed = []string{}
+	}
 	sendJSONEachRow(w, http.StatusOK, struct {
-		Status    string `json:"status"`
-		Operation string `json:"operation"`
+		Status    string   `json:"status"`
+		Operation string   `json:"operation"`
+		Removed   []string `json:"removed"`
 	}{
 		Status:    "success",
 		Operation: "clean",
+		Removed:   removed,
 	})
 }
 
 // httpUploadHandler - upload a backup to remote storage
 func (api *APIServer) httpUploadHandler(w http.ResponseWriter, r *http.Request) {
-	if !api.config.API.AllowParallel && api.status.inProgress() {
-		apexLog.Info(ErrAPILocked.Error())
-		writeError(w, http.StatusLocked, "upload", ErrAPILocked)
-		return
-	}
 	cfg, err := config.LoadConfig(api.configPath)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "upload", err)
 		return
 	}
-	vars := mux.Vars(r)
-	query := r.URL.Query()
-	diffFrom := ""
-	diffFromRemote := ""
-	name := vars["name"]
-	tablePattern := ""
-	partitionsToBackup := make([]string, 0)
-	schemaOnly := false
-	fullCommand := "upload"
-
-	if df, exist := query["diff-from"]; exist {
-		diffFrom = df[0]
-		fullCommand = fmt.Sprintf("%s --diff-from=\"%s\"", fullCommand, diffFrom)
-	}
-	if df, exist := query["diff-from-remote"]; exist {
-		diffFromRemote = df[0]
-		fullCommand = fmt.Sprintf("%s --diff-from-remote=\"%s\"", fullCommand, diffFromRemote)
+	name := mux.Vars(r)["name"]
+	query, err := requestOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "upload", err)
+		return
 	}
-	if tp, exist := query["table"]; exist {
-		tablePattern = tp[0]
-		fullCommand = fmt.Sprintf("%s --tables=\"%s\"", fullCommand, tablePattern)
+	src := &queryOptions{values: query}
+	options, err := backup.ParseUploadOptions(src, name)
+	if src.err != nil {
+		err = src.err
 	}
-	if partitions, exist := query["partitions"]; exist {
-		partitionsToBackup = strings.Split(partitions[0], ",")
-		fullCommand = fmt.Sprintf("%s --partitions=\"%s\"", fullCommand, partitions)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "upload", err)
+		return
 	}
-	if schema, exist := query["schema"]; exist {
-		schemaOnly, _ = strconv.ParseBool(schema[0])
-		fullCommand += " --schema"
+	fullCommand := commandWithArgs("upload", options.Args())
+	if fullCommand, err = setTimeoutsFromQuery(cfg, query, fullCommand); err != nil {
+		writeError(w, http.StatusBadRequest, "upload", err)
+		return
 	}
 	fullCommand = fmt.Sprint(fullCommand, " ", name)
 
+	operationID := backup.NewOperationID()
+	// operation is registered before response, so it could be polled by operation_id right away
+	commandId, started := api.tryStartOperation(fullCommand, operationID)
+	if !started {
+		apexLog.Info(ErrAPILocked.Error())
+		writeError(w, http.StatusLocked, "upload", ErrAPILocked)
+		return
+	}
+	api.status.setOptions(commandId, options)
 	go func() {
-		commandId := api.status.start(fullCommand)
 		start := time.Now()
 		api.metrics.LastStart["upload"].Set(float64(start.Unix()))
 		defer func() {
@@ -725,7 +941,11 @@ func (api *APIServer) httpUploadHandler(w http.ResponseWriter, r *http.Request)
 			api.metrics.LastFinish["upload"].Set(float64(time.Now().Unix()))
 		}()
 		b := backup.NewBackuper(cfg)
-		err := b.Upload(name, diffFrom, diffFromRemote, tablePattern, partitionsToBackup, schemaOnly)
+		b.OperationID = operationID
+		api.status.setProgress(commandId, b.Progress)
+		api.status.setProgressBytes(commandId, b.ProgressBytes)
+		api.status.setTableStats(commandId, b.TableStats)
+		err := b.Upload(name, options.DiffFrom, options.DiffFromRemote, options.Tables, options.Partitions, options.Schema, options.DeleteSource, options.Resume)
 		api.status.stop(commandId, err)
 		if err != nil {
 			apexLog.Errorf("Upload error: %+v\n", err)
@@ -742,88 +962,84 @@ func (api *APIServer) httpUploadHandler(w http.ResponseWriter, r *http.Request)
 		api.metrics.LastStatus["upload"].Set(1)
 	}()
 	sendJSONEachRow(w, http.StatusOK, struct {
-		Status     string `json:"status"`
-		Operation  string `json:"operation"`
-		BackupName string `json:"backup_name"`
-		BackupFrom string `json:"backup_from,omitempty"`
-		Diff       bool   `json:"diff"`
+		Status      string               `json:"status"`
+		Operation   string               `json:"operation"`
+		BackupName  string               `json:"backup_name"`
+		BackupFrom  string               `json:"backup_from,omitempty"`
+		Diff        bool                 `json:"diff"`
+		OperationID string               `json:"operation_id"`
+		Options     backup.UploadOptions `json:"options"`
 	}{
-		Status:     "acknowledged",
-		Operation:  "upload",
-		BackupName: name,
-		BackupFrom: diffFrom,
-		Diff:       diffFrom != "",
+		Status:      "acknowledged",
+		Operation:   "upload",
+		BackupName:  name,
+		BackupFrom:  options.DiffFrom,
+		Diff:        options.DiffFrom != "",
+		OperationID: operationID,
+		Options:     options,
 	})
 }
 
+// setTimeoutsFromQuery - override timeout_per_table and run_timeout config options by `timeout_per_table` and `timeout` query arguments
+func setTimeoutsFromQuery(cfg *config.Config, query url.Values, fullCommand string) (string, error) {
+	if timeout, exist := query["timeout_per_table"]; exist {
+		if _, err := time.ParseDuration(timeout[0]); err != nil {
+			return fullCommand, fmt.Errorf("can't parse timeout_per_table: %v", err)
+		}
+		cfg.General.TimeoutPerTable = timeout[0]
+		fullCommand = fmt.Sprintf("%s --timeout-per-table=%s", fullCommand, timeout[0])
+	}
+	if timeout, exist := query["timeout"]; exist {
+		if _, err := time.ParseDuration(timeout[0]); err != nil {
+			return fullCommand, fmt.Errorf("can't parse timeout: %v", err)
+		}
+		cfg.General.RunTimeout = timeout[0]
+		fullCommand = fmt.Sprintf("%s --timeout=%s", fullCommand, timeout[0])
+	}
+	return fullCommand, nil
+}
+
 // httpRestoreHandler - restore a backup from local storage
 func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request) {
-	if !api.config.API.AllowParallel && api.status.inProgress() {
-		apexLog.Info(ErrAPILocked.Error())
-		writeError(w, http.StatusLocked, "restore", ErrAPILocked)
-		return
-	}
 	cfg, err := config.LoadConfig(api.configPath)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "restore", err)
 		return
 	}
-	vars := mux.Vars(r)
-	tablePattern := ""
-	partitionsToBackup := make([]string, 0)
-	schemaOnly := false
-	dataOnly := false
-	dropTable := false
-	rbacOnly := false
-	configsOnly := false
-	fullCommand := "restore"
-
-	query := r.URL.Query()
-	if tp, exist := query["table"]; exist {
-		tablePattern = tp[0]
-		fullCommand = fmt.Sprintf("%s --tables=\"%s\"", fullCommand, tablePattern)
-	}
-	if partitions, exist := query["partitions"]; exist {
-		partitionsToBackup = strings.Split(partitions[0], ",")
-		fullCommand = fmt.Sprintf("%s --partitions=\"%s\"", fullCommand, partitions)
-	}
-	if _, exist := query["schema"]; exist {
-		schemaOnly = true
-		fullCommand += " --schema"
-	}
-	if _, exist := query["data"]; exist {
-		dataOnly = true
-		fullCommand += " --data"
-	}
-	if _, exist := query["drop"]; exist {
-		dropTable = true
-		fullCommand += " --drop"
-	}
-	if _, exist := query["rm"]; exist {
-		dropTable = true
-		fullCommand += " --rm"
+	query, err := requestOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "restore", err)
+		return
 	}
-	if _, exist := query["rbac"]; exist {
-		rbacOnly = true
-		fullCommand += " --rbac"
+	src := &queryOptions{values: query}
+	options, err := backup.ParseRestoreOptions(src)
+	if src.err != nil {
+		err = src.err
 	}
-	if _, exist := query["configs"]; exist {
-		configsOnly = true
-		fullCommand += " --configs"
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "restore", err)
+		return
 	}
+	name := mux.Vars(r)["name"]
+	fullCommand := commandWithArgs("restore", options.Args()) + " " + name
 
-	name := vars["name"]
-	fullCommand += fmt.Sprintf(" %s", name)
-
+	operationID := backup.NewOperationID()
+	// operation is registered before response, so it could be polled by operation_id right away
+	commandId, started := api.tryStartOperation(fullCommand, operationID)
+	if !started {
+		apexLog.Info(ErrAPILocked.Error())
+		writeError(w, http.StatusLocked, "restore", ErrAPILocked)
+		return
+	}
+	api.status.setOptions(commandId, options)
 	go func() {
-		commandId := api.status.start(fullCommand)
 		start := time.Now()
 		api.metrics.LastStart["restore"].Set(float64(start.Unix()))
 		defer func() {
 			api.metrics.LastDuration["restore"].Set(float64(time.Since(start).Nanoseconds()))
 			api.metrics.LastFinish["restore"].Set(float64(time.Now().Unix()))
 		}()
-		err := backup.Restore(cfg, name, tablePattern, partitionsToBackup, schemaOnly, dataOnly, dropTable, rbacOnly, configsOnly)
+		err := backup.Restore(cfg, name, options, operationID)
 		api.status.stop(commandId, err)
 		if err != nil {
 			apexLog.Errorf("Download error: %+v\n", err)
@@ -835,52 +1051,51 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		api.metrics.LastStatus["restore"].Set(1)
 	}()
 	sendJSONEachRow(w, http.StatusOK, struct {
-		Status     string `json:"status"`
-		Operation  string `json:"operation"`
-		BackupName string `json:"backup_name"`
+		Status      string                `json:"status"`
+		Operation   string                `json:"operation"`
+		BackupName  string                `json:"backup_name"`
+		OperationID string                `json:"operation_id"`
+		Options     backup.RestoreOptions `json:"options"`
 	}{
-		Status:     "acknowledged",
-		Operation:  "restore",
-		BackupName: name,
+		Status:      "acknowledged",
+		Operation:   "restore",
+		BackupName:  name,
+		OperationID: operationID,
+		Options:     options,
 	})
 }
 
 // httpDownloadHandler - download a backup from remote to local storage
 func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	if !api.config.API.AllowParallel && api.status.inProgress() {
-		apexLog.Info(ErrAPILocked.Error())
-		writeError(w, http.StatusLocked, "download", ErrAPILocked)
-		return
-	}
 	cfg, err := config.LoadConfig(api.configPath)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "download", err)
 		return
 	}
-	vars := mux.Vars(r)
-	name := vars["name"]
-	query := r.URL.Query()
-	tablePattern := ""
-	partitionsToBackup := make([]string, 0)
-	schemaOnly := false
-	fullCommand := "download"
-
-	if tp, exist := query["table"]; exist {
-		tablePattern = tp[0]
-		fullCommand = fmt.Sprintf("%s --tables=\"%s\"", fullCommand, tablePattern)
-	}
-	if partitions, exist := query["partitions"]; exist {
-		partitionsToBackup = strings.Split(partitions[0], ",")
-		fullCommand = fmt.Sprintf("%s --partitions=\"%s\"", fullCommand, partitions)
+	query, err := requestOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "download", err)
+		return
 	}
-	if _, exist := query["schema"]; exist {
-		schemaOnly = true
-		fullCommand += " --schema"
+	src := &queryOptions{values: query}
+	options := backup.ParseDownloadOptions(src)
+	if src.err != nil {
+		writeError(w, http.StatusBadRequest, "download", src.err)
+		return
 	}
-	fullCommand += fmt.Sprintf(" %s", name)
+	name := mux.Vars(r)["name"]
+	fullCommand := commandWithArgs("download", options.Args()) + " " + name
 
+	operationID := backup.NewOperationID()
+	// operation is registered before response, so it could be polled by operation_id right away
+	commandId, started := api.tryStartOperation(fullCommand, operationID)
+	if !started {
+		apexLog.Info(ErrAPILocked.Error())
+		writeError(w, http.StatusLocked, "download", ErrAPILocked)
+		return
+	}
+	api.status.setOptions(commandId, options)
 	go func() {
-		commandId := api.status.start(fullCommand)
 		start := time.Now()
 		api.metrics.LastStart["download"].Set(float64(start.Unix()))
 		defer func() {
@@ -889,7 +1104,10 @@ func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request
 		}()
 
 		b := backup.NewBackuper(cfg)
-		err := b.Download(name, tablePattern, partitionsToBackup, schemaOnly)
+		b.OperationID = operationID
+		api.status.setProgress(commandId, b.Progress)
+		api.status.setProgressBytes(commandId, b.ProgressBytes)
+		err := b.Download(name, options.Tables, options.Partitions, options.Schema, options.ForceDefaultDisk, "")
 		api.status.stop(commandId, err)
 		if err != nil {
 			apexLog.Errorf("Download error: %+v\n", err)
@@ -904,39 +1122,63 @@ func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request
 		api.metrics.LastStatus["download"].Set(1)
 	}()
 	sendJSONEachRow(w, http.StatusOK, struct {
-		Status     string `json:"status"`
-		Operation  string `json:"operation"`
-		BackupName string `json:"backup_name"`
+		Status      string                 `json:"status"`
+		Operation   string                 `json:"operation"`
+		BackupName  string                 `json:"backup_name"`
+		OperationID string                 `json:"operation_id"`
+		Options     backup.DownloadOptions `json:"options"`
 	}{
-		Status:     "acknowledged",
-		Operation:  "download",
-		BackupName: name,
+		Status:      "acknowledged",
+		Operation:   "download",
+		BackupName:  name,
+		OperationID: operationID,
+		Options:     options,
 	})
 }
 
-// httpDeleteHandler - delete a backup from local or remote storage
+// httpDeleteHandler - delete a backup from local or remote storage, remote backups could be selected by `pattern` and `older_than` query arguments instead of name,
+// they are deleted only with `confirm` query argument, otherwise matched backups are returned in error
 func (api *APIServer) httpDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if !api.config.API.AllowParallel && api.status.inProgress() {
-		apexLog.Info(ErrAPILocked.Error())
-		writeError(w, http.StatusLocked, "delete", ErrAPILocked)
-		return
-	}
 	cfg, err := config.LoadConfig(api.configPath)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "delete", err)
 		return
 	}
 	vars := mux.Vars(r)
+	query := r.URL.Query()
+	pattern, olderThan := query.Get("pattern"), query.Get("older_than")
+	_, confirm := query["confirm"]
 	fullCommand := fmt.Sprintf("delete %s %s", vars["where"], vars["name"])
-	commandId := api.status.start(fullCommand)
+	if pattern != "" || olderThan != "" {
+		fullCommand = fmt.Sprintf("delete --pattern=%q --older-than=%q", pattern, olderThan)
+		if confirm {
+			fullCommand += " --confirm"
+		}
+		fullCommand += " " + vars["where"]
+	}
+	commandId, started := api.tryStartOperation(fullCommand, "")
+	if !started {
+		apexLog.Info(ErrAPILocked.Error())
+		writeError(w, http.StatusLocked, "delete", ErrAPILocked)
+		return
+	}
 
-	switch vars["where"] {
-	case "local":
+	var deleted []string
+	switch {
+	case vars["where"] != "local" && vars["where"] != "remote":
+		err = fmt.Errorf("backup location must be 'local' or 'remote'")
+	case pattern != "" || olderThan != "":
+		if vars["where"] != "remote" || vars["name"] != "" {
+			err = fmt.Errorf("pattern and older_than could be used only for remote backups without backup name")
+			break
+		}
+		deleted, err = backup.RemoveBackupsRemote(cfg, pattern, olderThan, func([]string) bool { return confirm })
+	case vars["name"] == "":
+		err = fmt.Errorf("backup name, pattern or older_than must be defined")
+	case vars["where"] == "local":
 		err = backup.RemoveBackupLocal(cfg, vars["name"])
-	case "remote":
-		err = backup.RemoveBackupRemote(cfg, vars["name"])
 	default:
-		err = fmt.Errorf("backup location must be 'local' or 'remote'")
+		err = backup.RemoveBackupRemote(cfg, vars["name"])
 	}
 	api.status.stop(commandId, err)
 	if err != nil {
@@ -950,15 +1192,17 @@ func (api *APIServer) httpDeleteHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}()
 	sendJSONEachRow(w, http.StatusOK, struct {
-		Status     string `json:"status"`
-		Operation  string `json:"operation"`
-		BackupName string `json:"backup_name"`
-		Location   string `json:"location"`
+		Status      string   `json:"status"`
+		Operation   string   `json:"operation"`
+		BackupName  string   `json:"backup_name,omitempty"`
+		BackupNames []string `json:"backup_names,omitempty"`
+		Location    string   `json:"location"`
 	}{
-		Status:     "success",
-		Operation:  "delete",
-		BackupName: vars["name"],
-		Location:   vars["where"],
+		Status:      "success",
+		Operation:   "delete",
+		BackupName:  vars["name"],
+		BackupNames: deleted,
+		Location:    vars["where"],
 	})
 }
 
@@ -966,6 +1210,23 @@ func (api *APIServer) httpBackupStatusHandler(w http.ResponseWriter, _ *http.Req
 	sendJSONEachRow(w, http.StatusOK, api.status.status(true, "", 0))
 }
 
+// httpOperationHandler - status of async operation by operation_id which was returned by create, upload, download or restore
+func (api *APIServer) httpOperationHandler(w http.ResponseWriter, r *http.Request) {
+	operationID := mux.Vars(r)["operation_id"]
+	row, exists := api.status.operation(operationID)
+	if !exists {
+		writeError(w, http.StatusNotFound, "operation", fmt.Errorf("operation '%s' not found", operationID))
+		return
+	}
+	sendJSONEachRow(w, http.StatusOK, row)
+}
+
+// tryStartOperation - start command unless it is locked by running operations, without allow_parallel only one operation runs at a time,
+// with allow_parallel up to max_parallel_operations run at a time, 0 means no limit, caller answers 423 when command isn't started
+func (api *APIServer) tryStartOperation(command, operationID string) (int, bool) {
+	return api.status.tryStartOperation(command, operationID, api.config.API.AllowParallel, api.config.API.MaxParallelOperations)
+}
+
 func (api *APIServer) updateSizeOfLastBackup(onlyLocal bool) error {
 	startTime := time.Now()
 	apexLog.Infof("Update last backup size metrics start (onlyLocal=%v)", onlyLocal)
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	metricsOnce sync.Once
+	metrics     Metrics
+)
+
+// testMetrics - metrics are registered in default prometheus registry, so they are set up once for all tests
+func testMetrics() Metrics {
+	metricsOnce.Do(func() { metrics = setupMetrics() })
+	return metrics
+}
+
+func getOperation(t *testing.T, handler http.Handler, operationID string) (int, ActionRow) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backup/operation/"+operationID, nil))
+	var row ActionRow
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &row))
+	return w.Code, row
+}
+
+func TestCreateOperationPolling(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yml")
+	// nothing listens on port 1, so create fails on connect to clickhouse
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte("clickhouse:\n  host: 127.0.0.1\n  port: 1\n  timeout: 1s\n"), 0640))
+	cfg, err := config.LoadConfig(configPath)
+	assert.NoError(t, err)
+	api := &APIServer{configPath: configPath, config: cfg, status: &AsyncStatus{}, metrics: testMetrics()}
+	handler := api.setupAPIServer().Handler
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backup/create?name=polling", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created struct {
+		Status      string `json:"status"`
+		OperationID string `json:"operation_id"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "acknowledged", created.Status)
+	assert.Len(t, created.OperationID, 8)
+
+	var row ActionRow
+	assert.Eventually(t, func() bool {
+		var code int
+		code, row = getOperation(t, handler, created.OperationID)
+		assert.Equal(t, http.StatusOK, code, "operation shall be found right after response of create")
+		return row.Status != InProgressText
+	}, 30*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "error", row.Status)
+	assert.Equal(t, "create polling", row.Command)
+	assert.Equal(t, created.OperationID, row.OperationID)
+	assert.Contains(t, row.Error, "can't connect to clickhouse")
+	assert.NotEmpty(t, row.Finish)
+}
+
+func TestOperationHandler(t *testing.T) {
+	api := &APIServer{config: config.DefaultConfig(), status: &AsyncStatus{}}
+	handler := api.setupAPIServer().Handler
+
+	commandId := api.status.startOperation("upload test", "0123abcd")
+	api.status.setProgress(commandId, func() string { return "42% 42B/100B" })
+	code, row := getOperation(t, handler, "0123abcd")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, InProgressText, row.Status)
+	assert.Equal(t, "42% 42B/100B", row.Progress)
+
+	api.status.stop(commandId, nil)
+	code, row = getOperation(t, handler, "0123abcd")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "success", row.Status)
+	assert.Empty(t, row.Progress)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backup/operation/absent", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, `{"status":"error","operation":"operation","error":"operation 'absent' not found"}`, strings.TrimSpace(w.Body.String()))
+}
+
+func TestTryStartOperation(t *testing.T) {
+	api := &APIServer{config: config.DefaultConfig(), status: &AsyncStatus{}}
+	first, started := api.tryStartOperation("create first", "1")
+	assert.True(t, started)
+	_, started = api.tryStartOperation("create second", "2")
+	assert.False(t, started, "only one operation runs without allow_parallel")
+
+	api.config.API.AllowParallel = true
+	_, started = api.tryStartOperation("create second", "2")
+	assert.True(t, started, "max_parallel_operations 0 means no limit")
+	api.config.API.MaxParallelOperations = 2
+	_, started = api.tryStartOperation("create third", "3")
+	assert.False(t, started)
+	api.status.stop(first, nil)
+	_, started = api.tryStartOperation("create third", "3")
+	assert.True(t, started)
+	_, exists := api.status.operation("3")
+	assert.True(t, exists)
+
+	// check and start are atomic, concurrent requests can't exceed max_parallel_operations
+	api = &APIServer{config: config.DefaultConfig(), status: &AsyncStatus{}}
+	api.config.API.AllowParallel = true
+	api.config.API.MaxParallelOperations = 3
+	var startedCount int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, started := api.tryStartOperation("create", ""); started {
+				atomic.AddInt32(&startedCount, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), startedCount)
+	assert.Equal(t, 3, api.status.runningCount())
+
+	// locked handler answers 423 and doesn't register command
+	handler := api.setupAPIServer().Handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backup/clean", nil))
+	assert.Equal(t, http.StatusLocked, w.Code)
+	assert.Len(t, api.status.status(false, "", 0), 3)
+}
+
+func TestOperationOptions(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte("general:\n  remote_storage: s3\nclickhouse:\n  host: 127.0.0.1\n  port: 1\n  timeout: 1s\n"), 0640))
+	cfg, err := config.LoadConfig(configPath)
+	assert.NoError(t, err)
+	cfg.API.AllowParallel = true
+	api := &APIServer{configPath: configPath, config: cfg, status: &AsyncStatus{}, metrics: testMetrics()}
+	handler := api.setupAPIServer().Handler
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		options, command     string
+	}{
+		{http.MethodPost, "/backup/create?name=b1&table=db.a&table=db.b&partitions=db.a:1,2&schema=false&rbac", "",
+			`{"tables":"db.a,db.b","partitions":["db.a:1,2"],"rbac":true}`, `create --tables="db.a,db.b" --partitions="db.a:1,2" --rbac b1`},
+		{http.MethodPost, "/backup/create", `{"name":"b2","table":"db.*","changed_since":"b1"}`,
+			`{"tables":"db.*","changed_since":"b1"}`, `create --tables="db.*" --changed-since="b1" b2`},
+		{http.MethodPost, "/backup/upload/b2?diff-from=b1&delete_source", "",
+			`{"diff_from":"b1","delete_source":true}`, `upload --diff-from="b1" --delete-source b2`},
+		{http.MethodPost, "/backup/upload/b2", `{"diff_from_remote":"b1","table":["db.a","db.b"],"resume":true}`,
+			`{"tables":"db.a,db.b","diff_from_remote":"b1","resume":true}`, `upload --diff-from-remote="b1" --tables="db.a,db.b" --resume b2`},
+		{http.MethodPost, "/backup/download/b2?schema", "",
+			`{"schema":true}`, `download --schema b2`},
+		{http.MethodPost, "/backup/restore/b2?table=db.a&rm&partitions=1", "",
+			`{"tables":"db.a","partitions":["1"],"rm":true}`, `restore --tables="db.a" --partitions="1" --rm b2`},
+		{http.MethodPost, "/backup/restore/b2", `{"data":true,"drop":true,"replica_sync":false}`,
+			`{"data":true,"rm":true}`, `restore --data --rm b2`},
+	} {
+		w := request(tc.method, tc.target, tc.body)
+		var ack struct {
+			OperationID string          `json:"operation_id"`
+			Options     json.RawMessage `json:"options"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ack), tc.target)
+		assert.JSONEq(t, tc.options, string(ack.Options), tc.target)
+		_, row := getOperation(t, handler, ack.OperationID)
+		assert.Equal(t, tc.command, row.Command, tc.target)
+		options, err := json.Marshal(row.Options)
+		assert.NoError(t, err)
+		assert.JSONEq(t, tc.options, string(options), tc.target)
+	}
+
+	for _, tc := range []struct {
+		target, body, expectedErr string
+	}{
+		{"/backup/create?name=b3&schema&changed_since=b1", "", "--changed-since can't be used with --schema, --partitions or --include-detached"},
+		{"/backup/create?name=b3&include_detached=maybe", "", `can't parse include_detached: strconv.ParseBool: parsing "maybe": invalid syntax`},
+		{"/backup/upload/b2?diff-from=b1&diff_from_remote=b1", "", "choose setup only `--diff-from-remote` or `--diff-from`, not both"},
+		{"/backup/upload/b2", `{"diff_from":"b2"}`, "you cannot upload diff from the same backup"},
+		{"/backup/download/b2?schema=yes", "", `can't parse schema: strconv.ParseBool: parsing "yes": invalid syntax`},
+		{"/backup/restore/b2?rm&skip_existing", "", "`--drop-table` can't be used together with `--skip-existing`"},
+		{"/backup/restore/b2?attach_only&schema", "", "`--attach-only` can't be used together with `--schema`, `--rm` or `--skip-existing`"},
+		{"/backup/restore/b2", `{"table": {"db": "t"}}`, "can't parse JSON body: unsupported value of 'table'"},
+		{"/backup/restore/b2", `["db.t"]`, "can't parse JSON body: json: cannot unmarshal array into Go value of type map[string]interface {}"},
+	} {
+		w := request(http.MethodPost, tc.target, tc.body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tc.target)
+		var response struct {
+			Error string `json:"error"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response), tc.target)
+		assert.Equal(t, tc.expectedErr, response.Error, tc.target)
+	}
+	assert.Eventually(t, func() bool { return api.status.runningCount() == 0 }, 30*time.Second, 50*time.Millisecond)
+}
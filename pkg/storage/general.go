@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/progressbar"
 	"io"
 	"io/ioutil"
@@ -48,6 +49,8 @@ type BackupDestination struct {
 	compressionLevel   int
 	disableProgressBar bool
 	backupsToKeep      int
+	// tempDir - directory for meta.json of incremental archive, empty means system default temp dir
+	tempDir string
 }
 
 func (bd *BackupDestination) RemoveOldBackups(keep int) error {
@@ -108,6 +111,7 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 				strings.HasSuffix(parts[0], ".tar.bz2") ||
 				strings.HasSuffix(parts[0], ".tar.gz") ||
 				strings.HasSuffix(parts[0], ".tar.sz") ||
+				strings.HasSuffix(parts[0], ".tar.s2") ||
 				strings.HasSuffix(parts[0], ".tar.xz") {
 				files[parts[0]] = ClickhouseBackup{
 					Tar:  true,
@@ -234,7 +238,7 @@ func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPa
 		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
 			os.MkdirAll(extractDir, os.ModePerm)
 		}
-		if err := os.Link(oldname, newname); err != nil {
+		if err := filesystemhelper.HardlinkOrCopy(oldname, newname); err != nil {
 			return err
 		}
 	}
@@ -316,27 +320,17 @@ func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffF
 			return
 		}
 		if len(hardlinks) > 0 {
-			metafile := MetaFile{
+			tmpFileName, err := createMetaFile(bd.tempDir, MetaFile{
 				RequiredBackup: filepath.Base(diffFromPath),
 				Hardlinks:      hardlinks,
+			})
+			if tmpFileName != "" {
+				defer os.Remove(tmpFileName)
 			}
-			content, err := json.MarshalIndent(&metafile, "", "\t")
-			if err != nil {
-				ferr = fmt.Errorf("can't marshal json: %v", err)
-				return
-			}
-			tmpfile, err := ioutil.TempFile("", MetaFileName)
 			if err != nil {
-				ferr = fmt.Errorf("can't create meta.info: %v", err)
-				return
-			}
-			if _, err := tmpfile.Write(content); err != nil {
-				ferr = fmt.Errorf("can't write to meta.info: %v", err)
+				ferr = err
 				return
 			}
-			tmpfile.Close()
-			tmpFileName := tmpfile.Name()
-			defer os.Remove(tmpFileName)
 			info, err := os.Stat(tmpFileName)
 			if err != nil {
 				ferr = fmt.Errorf("can't get stat: %v", err)
@@ -369,7 +363,26 @@ func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffF
 	return nil
 }
 
+// createMetaFile - write meta.json of incremental archive into temporary file in tempDir, empty tempDir means system default temp dir,
+// caller removes the file when returned name is not empty
+func createMetaFile(tempDir string, metafile MetaFile) (string, error) {
+	content, err := json.MarshalIndent(&metafile, "", "\t")
+	if err != nil {
+		return "", fmt.Errorf("can't marshal json: %v", err)
+	}
+	tmpfile, err := ioutil.TempFile(tempDir, MetaFileName)
+	if err != nil {
+		return "", fmt.Errorf("can't create meta.info: %v", err)
+	}
+	defer tmpfile.Close()
+	if _, err := tmpfile.Write(content); err != nil {
+		return tmpfile.Name(), fmt.Errorf("can't write to meta.info: %v", err)
+	}
+	return tmpfile.Name(), nil
+}
+
 func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
+	progressbar.ForceShow = cfg.General.ForceProgressBar
 	switch cfg.General.RemoteStorage {
 	case "azblob":
 		azblobStorage := &AzureBlob{Config: &cfg.AzureBlob}
@@ -380,6 +393,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.AzureBlob.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.General.TempDir,
 		}, nil
 	case "s3":
 		s3Storage := &S3{
@@ -393,6 +407,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.S3.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.General.TempDir,
 		}, nil
 	case "gcs":
 		googleCloudStorage := &GCS{Config: &cfg.GCS}
@@ -403,6 +418,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.GCS.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.General.TempDir,
 		}, nil
 	case "cos":
 		tencentStorage := &COS{
@@ -416,6 +432,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.COS.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.General.TempDir,
 		}, nil
 	case "ftp":
 		ftpStorage := &FTP{
@@ -429,6 +446,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.FTP.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.General.TempDir,
 		}, nil
 	default:
 		return nil, fmt.Errorf("storage type '%s' not supported", cfg.General.RemoteStorage)
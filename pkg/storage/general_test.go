@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateMetaFile(t *testing.T) {
+	tempDir := t.TempDir()
+	metaFile, err := createMetaFile(tempDir, MetaFile{RequiredBackup: "full", Hardlinks: []string{"default/t/all_1_1_0/data.bin"}})
+	assert.NoError(t, err)
+	defer os.Remove(metaFile)
+	assert.Equal(t, tempDir, filepath.Dir(metaFile), "meta.json shall be created in temp_dir")
+	content, err := ioutil.ReadFile(metaFile)
+	assert.NoError(t, err)
+	var written MetaFile
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "full", written.RequiredBackup)
+	assert.Equal(t, []string{"default/t/all_1_1_0/data.bin"}, written.Hardlinks)
+
+	_, err = createMetaFile(filepath.Join(tempDir, "absent"), MetaFile{})
+	assert.Error(t, err)
+}
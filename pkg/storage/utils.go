@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
 	"github.com/mholt/archiver/v3"
 )
 
@@ -28,11 +29,13 @@ func getArchiveWriter(format string, level int) (archiver.Writer, error) {
 	case "gzip":
 		return &archiver.TarGz{CompressionLevel: level, Tar: archiver.NewTar()}, nil
 	case "sz":
-		return &archiver.TarSz{Tar: archiver.NewTar()}, nil
+		return new_storage.NewTarSz(), nil
+	case "s2":
+		return new_storage.NewTarS2(), nil
 	case "xz":
 		return &archiver.TarXz{Tar: archiver.NewTar()}, nil
 	}
-	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 'xz'", format)
+	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 's2', 'xz'", format)
 }
 
 func getExtension(format string) string {
@@ -47,6 +50,8 @@ func getExtension(format string) string {
 		return "tar.gz"
 	case "sz":
 		return "tar.sz"
+	case "s2":
+		return "tar.s2"
 	case "xz":
 		return "tar.xz"
 	}
@@ -64,9 +69,11 @@ func getArchiveReader(format string) (archiver.Reader, error) {
 	case "gzip":
 		return archiver.NewTarGz(), nil
 	case "sz":
-		return archiver.NewTarSz(), nil
+		return new_storage.NewTarSz(), nil
+	case "s2":
+		return new_storage.NewTarS2(), nil
 	case "xz":
 		return archiver.NewTarXz(), nil
 	}
-	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 'xz'", format)
+	return nil, fmt.Errorf("wrong compression_format: %s, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 's2', 'xz'", format)
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,3 +32,15 @@ func TestGetBackupsToDelete(t *testing.T) {
 	assert.Equal(t, expectedData, GetBackupsToDelete(testData, 3))
 	assert.Equal(t, []Backup{}, GetBackupsToDelete([]Backup{testData[0]}, 3))
 }
+
+func TestArchiveFormats(t *testing.T) {
+	for _, format := range []string{"tar", "lz4", "bzip2", "gzip", "sz", "s2", "xz"} {
+		assert.Equal(t, config.ArchiveExtensions[format], getExtension(format), format)
+		_, err := getArchiveWriter(format, 100)
+		assert.NoError(t, err, format)
+		_, err = getArchiveReader(format)
+		assert.NoError(t, err, format)
+	}
+	_, err := getArchiveWriter("zip", 0)
+	assert.EqualError(t, err, "wrong compression_format: zip, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 's2', 'xz'")
+}
@@ -3,6 +3,11 @@ package utils
 import (
 	"fmt"
 	"github.com/apex/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -53,3 +58,60 @@ func HumanizeDuration(d time.Duration) string {
 	}
 	return b.String()
 }
+
+// ParseDuration - time.ParseDuration which also accepts days as leading `d` unit, like `30d` or `1d12h`
+func ParseDuration(s string) (time.Duration, error) {
+	if i := strings.Index(s, "d"); i > 0 {
+		days, err := strconv.ParseUint(s[:i], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d := time.Duration(days) * day
+		if s[i+1:] == "" {
+			return d, nil
+		}
+		rest, err := time.ParseDuration(s[i+1:])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return d + rest, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// WriteFileAtomic - ioutil.WriteFile which writes into temporary file in the same directory and renames it to filename,
+// so filename is always complete or absent after crash in the middle of write
+func WriteFileAtomic(filename string, body []byte, perm os.FileMode) error {
+	return writeFileAtomic(filename, perm, func(w io.Writer) error {
+		_, err := w.Write(body)
+		return err
+	})
+}
+
+func writeFileAtomic(filename string, perm os.FileMode, write func(w io.Writer) error) error {
+	// temporary name doesn't end with .json, so it isn't read as metadata when it's left by crash
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if err = write(tmp); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tmpName); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Warnf("can't remove %s: %v", tmpName, removeErr)
+		}
+		return err
+	}
+	return nil
+}
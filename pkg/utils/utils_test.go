@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "metadata.json")
+	assert.NoError(t, WriteFileAtomic(filename, []byte(`{"backup_name":"old"}`), 0640))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// write interrupted after part of new content keeps old content
+	err = writeFileAtomic(filename, 0640, func(w io.Writer) error {
+		_, _ = w.Write([]byte(`{"backup_na`))
+		return errors.New("no space left on device")
+	})
+	assert.EqualError(t, err, "no space left on device")
+	body, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"backup_name":"old"}`, string(body))
+
+	// new file is absent until it's written completely
+	newFilename := filepath.Join(dir, "default", "t.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(newFilename), 0750))
+	assert.Error(t, writeFileAtomic(newFilename, 0640, func(w io.Writer) error {
+		_, _ = w.Write([]byte(`{"table`))
+		_, err := os.Stat(newFilename)
+		assert.True(t, os.IsNotExist(err), "file shall not be visible during write")
+		return errors.New("interrupted")
+	}))
+	_, err = os.Stat(newFilename)
+	assert.True(t, os.IsNotExist(err))
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*", ".*.tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers, "temporary file of failed write shall be removed")
+
+	assert.NoError(t, WriteFileAtomic(filename, []byte(`{"backup_name":"new"}`), 0640))
+	body, err = ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"backup_name":"new"}`, string(body))
+	leftovers, err = filepath.Glob(filepath.Join(dir, ".*.tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
@@ -935,6 +935,38 @@ func TestProjections(t *testing.T) {
 
 }
 
+func TestClickHouseTLS(t *testing.T) {
+	ch := &TestClickHouse{}
+	r := require.New(t)
+	ch.connectWithWait(r, 0*time.Second)
+	defer ch.chbackend.Close()
+
+	r.NoError(dockerCP("config-s3.yml", "clickhouse:/etc/clickhouse-backup/config.yml"))
+	_, err := ch.chbackend.Query("CREATE TABLE default.table_over_tls(id UInt64) ENGINE=MergeTree() ORDER BY id")
+	r.NoError(err)
+	_, err = ch.chbackend.Query("INSERT INTO default.table_over_tls SELECT number FROM numbers(10)")
+	r.NoError(err)
+
+	tlsEnv := "CLICKHOUSE_PORT=9440 CLICKHOUSE_SECURE=true CLICKHOUSE_TLS_CA=/etc/clickhouse-server/server.crt CLICKHOUSE_TLS_CERT=/etc/clickhouse-server/server.crt CLICKHOUSE_TLS_KEY=/etc/clickhouse-server/server.key"
+	// server.crt is self-signed without subjectAltName, so hostname verification shall fail with certificate error
+	out, err := dockerExecOut("clickhouse", "bash", "-c", tlsEnv+" clickhouse-backup tables")
+	r.Error(err)
+	r.Contains(out, "TLS handshake")
+	out, err = dockerExecOut("clickhouse", "bash", "-c", tlsEnv+" CLICKHOUSE_SKIP_VERIFY=true CLICKHOUSE_PASSWORD=wrong clickhouse-backup tables")
+	r.Error(err)
+	r.Contains(out, "authentication failed")
+
+	tlsEnv += " CLICKHOUSE_SKIP_VERIFY=true"
+	r.NoError(dockerExec("clickhouse", "bash", "-c", tlsEnv+" clickhouse-backup create --tables=default.table_over_tls test_backup_tls"))
+	r.NoError(dockerExec("clickhouse", "bash", "-c", tlsEnv+" clickhouse-backup restore --rm test_backup_tls"))
+	r.NoError(dockerExec("clickhouse", "bash", "-c", tlsEnv+" clickhouse-backup delete local test_backup_tls"))
+	counts := make([]int, 0)
+	r.NoError(ch.chbackend.Select(&counts, "SELECT count() FROM default.table_over_tls"))
+	r.Equal([]int{10}, counts)
+	_, err = ch.chbackend.Query("DROP TABLE default.table_over_tls NO DELAY")
+	r.NoError(err)
+}
+
 func TestS3AdvancedIntegration(t *testing.T) {
 	if isTestShouldSkip("S3_ADVANCED_TESTS") {
 		t.Skip("Skipping S3 Advanced integration tests...")
@@ -1436,7 +1468,7 @@ func testBackupSpecifiedPartition(r *require.Assertions, ch *TestClickHouse) {
 	ch.queryWithNoError(r, "TRUNCATE table default.t1")
 	// DELETE local backup before restore
 	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "delete", "local", testBackupName))
-	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "restore_remote", testBackupName))
+	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "restore_remote", "--keep", testBackupName))
 
 	log.Debug("testBackupSpecifiedPartition begin check \n")
 	// Check